@@ -0,0 +1,1032 @@
+package audio
+
+import (
+	"errors"
+	"math"
+)
+
+const (
+	AAC_OBJECT_LC     = 2
+	AAC_OBJECT_SBR    = 5
+	AAC_OBJECT_PS     = 29
+	AAC_OBJECT_ESCAPE = 31
+
+	AAC_FRAME_LENGTH = 1024
+	AAC_SHORT_LENGTH = 128
+	AAC_MAX_CHANNELS = 8
+
+	AAC_ELEMENT_SCE = 0
+	AAC_ELEMENT_CPE = 1
+	AAC_ELEMENT_CCE = 2
+	AAC_ELEMENT_LFE = 3
+	AAC_ELEMENT_DSE = 4
+	AAC_ELEMENT_PCE = 5
+	AAC_ELEMENT_FIL = 6
+	AAC_ELEMENT_END = 7
+
+	AAC_ONLY_LONG   = 0
+	AAC_LONG_START  = 1
+	AAC_EIGHT_SHORT = 2
+	AAC_LONG_STOP   = 3
+
+	AAC_WINDOW_SINE = 0
+	AAC_WINDOW_KBD  = 1
+
+	// codebooks with special meanings
+	AAC_ZERO_HCB       = 0
+	AAC_ESC_HCB        = 11
+	AAC_NOISE_HCB      = 13
+	AAC_INTENSITY_HCB2 = 14
+	AAC_INTENSITY_HCB  = 15
+
+	AAC_ESC_VALUE     = 16
+	AAC_MAX_BANDS     = 64
+	AAC_SF_OFFSET     = 100
+	AAC_TNS_MAX_ORDER = 20
+
+	// the highest TNS filter orders LC allows
+	AAC_TNS_MAX_ORDER_LONG  = 12
+	AAC_TNS_MAX_ORDER_SHORT = 7
+)
+
+var (
+	errAACConfig = errors.New("invalid AAC configuration")
+	errAACFrame  = errors.New("malformed AAC frame")
+)
+
+// aacBook is a spectral codebook ready for decoding
+type aacBook struct {
+	*aacHuffmanCode
+	tree huffmanTree
+}
+
+var (
+	aacBooks           [12]aacBook
+	aacScalefactorTree huffmanTree
+
+	// |x|^(4/3) of quantized values
+	aacPow43 [8192]float64
+)
+
+func init() {
+	for i, code := range aacHuffmanCodes {
+		if code != nil {
+			aacBooks[i] = aacBook{code, newHuffmanTree(code.lens, code.codes)}
+		}
+	}
+	aacScalefactorTree = newHuffmanTree(aacScalefactorCode.lens, aacScalefactorCode.codes)
+
+	for i := range aacPow43 {
+		aacPow43[i] = math.Pow(float64(i), 4.0/3.0)
+	}
+}
+
+// aacICSInfo describes the windows of a channel's frame
+type aacICSInfo struct {
+	windowSequence int
+	windowShape    int
+	maxSFB         int
+
+	numGroups   int
+	groupLength [8]int
+
+	// band offsets within one window
+	bands []uint16
+}
+
+func (info *aacICSInfo) windows() int {
+	if info.windowSequence == AAC_EIGHT_SHORT {
+		return 8
+	}
+	return 1
+}
+
+// aacTNS holds the temporal noise shaping filters of each window
+type aacTNS struct {
+	present bool
+	filters [8][]aacTNSFilter
+}
+
+type aacTNSFilter struct {
+	length    int
+	order     int
+	direction bool
+	coefs     [AAC_TNS_MAX_ORDER]float64
+}
+
+// aacChannel is the state of one output channel
+type aacChannel struct {
+	info aacICSInfo
+
+	globalGain   int
+	bandTypes    [8][AAC_MAX_BANDS]uint8
+	scalefactors [8][AAC_MAX_BANDS]int
+	tns          aacTNS
+
+	quant    [AAC_FRAME_LENGTH]int32
+	spectrum [AAC_FRAME_LENGTH]float64
+	output   [AAC_FRAME_LENGTH]float64
+
+	// second half of the last windowed block, and its window shape
+	overlap   [AAC_FRAME_LENGTH]float64
+	prevShape int
+}
+
+type aacDecoder struct {
+	rateIndex  int
+	sampleRate uint32
+	channels   int
+
+	chans []*aacChannel
+
+	// M/S flags of the current channel pair
+	msMaskPresent int
+	msUsed        [8][AAC_MAX_BANDS]bool
+
+	long  *imdct
+	short *imdct
+
+	// rising halves of the windows, by shape
+	longWindows  [2][]float64
+	shortWindows [2][]float64
+
+	block   []float64
+	scratch []float64
+	random  uint32
+}
+
+func newAACDecoder(config []byte) (*aacDecoder, error) {
+	dec := &aacDecoder{random: 1}
+	err := dec.readConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	dec.chans = make([]*aacChannel, dec.channels)
+	for i := range dec.chans {
+		dec.chans[i] = &aacChannel{}
+	}
+
+	dec.long = newIMDCT(2 * AAC_FRAME_LENGTH)
+	dec.short = newIMDCT(2 * AAC_SHORT_LENGTH)
+	dec.longWindows = [2][]float64{sineWindow(2 * AAC_FRAME_LENGTH), kbdWindow(2*AAC_FRAME_LENGTH, 4)}
+	dec.shortWindows = [2][]float64{sineWindow(2 * AAC_SHORT_LENGTH), kbdWindow(2*AAC_SHORT_LENGTH, 6)}
+	dec.block = make([]float64, 2*AAC_FRAME_LENGTH)
+	dec.scratch = make([]float64, 2*AAC_SHORT_LENGTH)
+	return dec, nil
+}
+
+// readConfig parses an AudioSpecificConfig, accepting the LC core of SBR and
+// PS streams
+func (dec *aacDecoder) readConfig(config []byte) error {
+	r := newBitReader(config)
+
+	objectType := readAACObjectType(r)
+	err := dec.readSampleRate(r)
+	if err != nil {
+		return err
+	}
+	channelConfig := int(r.readBits(4))
+
+	if objectType == AAC_OBJECT_SBR || objectType == AAC_OBJECT_PS {
+		// the extension's output rate, then the core's object type
+		rate := dec.sampleRate
+		index := dec.rateIndex
+		if err := dec.readSampleRate(r); err != nil {
+			return err
+		}
+		dec.sampleRate, dec.rateIndex = rate, index
+		objectType = readAACObjectType(r)
+	}
+	if objectType != AAC_OBJECT_LC {
+		return ErrUnsupportedFormat
+	}
+
+	// GASpecificConfig
+	if r.readBit() {
+		// 960 sample frames
+		return ErrUnsupportedFormat
+	}
+	if r.readBit() {
+		r.skipBits(14) // core coder delay
+	}
+	r.skipBits(1) // extension flag
+
+	switch {
+	case channelConfig == 0:
+		dec.channels, err = readAACProgramConfig(r)
+		if err != nil {
+			return err
+		}
+	case channelConfig <= 6:
+		dec.channels = channelConfig
+	case channelConfig == 7:
+		dec.channels = 8
+	default:
+		return ErrUnsupportedFormat
+	}
+
+	if r.overrun || dec.channels == 0 {
+		return errAACConfig
+	}
+	if dec.channels > AAC_MAX_CHANNELS {
+		return ErrUnsupportedFormat
+	}
+	return nil
+}
+
+func readAACObjectType(r *bitReader) int {
+	objectType := int(r.readBits(5))
+	if objectType == AAC_OBJECT_ESCAPE {
+		objectType = 32 + int(r.readBits(6))
+	}
+	return objectType
+}
+
+func (dec *aacDecoder) readSampleRate(r *bitReader) error {
+	index := int(r.readBits(4))
+	switch {
+	case index < len(aacSampleRates):
+		dec.rateIndex = index
+		dec.sampleRate = aacSampleRates[index]
+		return nil
+	case index == 15:
+		dec.sampleRate = r.readBits(24)
+		if dec.sampleRate == 0 || dec.sampleRate > MAX_SAMPLE_RATE {
+			return errAACConfig
+		}
+		// use the tables of the nearest standard rate
+		dec.rateIndex = 0
+		for dec.sampleRate < aacRateThresholds[dec.rateIndex] {
+			dec.rateIndex++
+		}
+		return nil
+	}
+	return errAACConfig
+}
+
+// readAACProgramConfig reads a program config element, returning the number
+// of channels it lays out
+func readAACProgramConfig(r *bitReader) (int, error) {
+	r.skipBits(4 + 2 + 4) // instance tag, object type, rate index
+	front := int(r.readBits(4))
+	side := int(r.readBits(4))
+	back := int(r.readBits(4))
+	lfe := int(r.readBits(2))
+	assoc := int(r.readBits(3))
+	cc := int(r.readBits(4))
+
+	for i := 0; i < 2; i++ {
+		// mono and stereo mixdowns
+		if r.readBit() {
+			r.skipBits(4)
+		}
+	}
+	if r.readBit() {
+		r.skipBits(3) // matrix mixdown
+	}
+
+	channels := lfe
+	for i := 0; i < front+side+back; i++ {
+		channels++
+		if r.readBit() {
+			channels++
+		}
+		r.skipBits(4)
+	}
+	r.skipBits(4*lfe + 4*assoc + 5*cc)
+
+	r.alignByte()
+	r.skipBits(8 * int(r.readBits(8))) // comment
+
+	if r.overrun {
+		return 0, errAACConfig
+	}
+	return channels, nil
+}
+
+func (dec *aacDecoder) format() *PCMWaveFormat {
+	return &PCMWaveFormat{
+		NumChannels: uint16(dec.channels),
+		SampleRate:  dec.sampleRate,
+		SampleDepth: 16,
+		PCMType:     PCM_TYPE_INT,
+	}
+}
+
+func (dec *aacDecoder) reset() {
+	for _, ch := range dec.chans {
+		clear(ch.overlap[:])
+		ch.prevShape = AAC_WINDOW_SINE
+	}
+}
+
+// the first frame after a seek only fills the overlap
+func (dec *aacDecoder) preroll() int {
+	return 1
+}
+
+func (dec *aacDecoder) decode(frame []byte) ([]float64, error) {
+	r := newBitReader(frame)
+
+	channel := 0
+	for {
+		if r.overrun {
+			return nil, errAACFrame
+		}
+
+		var err error
+		id := r.readBits(3)
+		switch id {
+		case AAC_ELEMENT_SCE, AAC_ELEMENT_LFE:
+			if channel+1 > dec.channels {
+				return nil, errAACFrame
+			}
+			r.skipBits(4) // instance tag
+			ch := dec.chans[channel]
+			err = dec.readICS(r, ch, false)
+			if err == nil {
+				dec.dequantize(ch)
+				dec.applyTNS(ch)
+				dec.synthesize(ch)
+			}
+			channel++
+
+		case AAC_ELEMENT_CPE:
+			if channel+2 > dec.channels {
+				return nil, errAACFrame
+			}
+			err = dec.readPair(r, dec.chans[channel], dec.chans[channel+1])
+			channel += 2
+
+		case AAC_ELEMENT_DSE:
+			r.skipBits(4)
+			aligned := r.readBit()
+			count := int(r.readBits(8))
+			if count == 255 {
+				count += int(r.readBits(8))
+			}
+			if aligned {
+				r.alignByte()
+			}
+			r.skipBits(8 * count)
+
+		case AAC_ELEMENT_PCE:
+			_, err = readAACProgramConfig(r)
+
+		case AAC_ELEMENT_FIL:
+			// extension payloads such as SBR are ignored
+			count := int(r.readBits(4))
+			if count == 15 {
+				count += int(r.readBits(8)) - 1
+			}
+			r.skipBits(8 * count)
+
+		case AAC_ELEMENT_CCE:
+			err = ErrUnsupportedFormat
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if id == AAC_ELEMENT_END {
+			break
+		}
+	}
+	if r.overrun || channel != dec.channels {
+		return nil, errAACFrame
+	}
+
+	// interleave into WAVE channel order
+	out := make([]float64, AAC_FRAME_LENGTH*dec.channels)
+	order := mp4ChannelOrder[dec.channels-1]
+	for c, from := range order {
+		samples := &dec.chans[from].output
+		for i, v := range samples {
+			out[i*dec.channels+c] = v
+		}
+	}
+	return out, nil
+}
+
+// readPair decodes a channel pair element through to its output
+func (dec *aacDecoder) readPair(r *bitReader, left *aacChannel, right *aacChannel) error {
+	r.skipBits(4) // instance tag
+
+	common := r.readBit()
+	dec.msMaskPresent = 0
+	if common {
+		err := dec.readICSInfo(r, &left.info)
+		if err != nil {
+			return err
+		}
+		right.info = left.info
+
+		dec.msMaskPresent = int(r.readBits(2))
+		switch dec.msMaskPresent {
+		case 1:
+			for g := 0; g < left.info.numGroups; g++ {
+				for sfb := 0; sfb < left.info.maxSFB; sfb++ {
+					dec.msUsed[g][sfb] = r.readBit()
+				}
+			}
+		case 3:
+			return errAACFrame
+		}
+	}
+
+	err := dec.readICS(r, left, common)
+	if err != nil {
+		return err
+	}
+	err = dec.readICS(r, right, common)
+	if err != nil {
+		return err
+	}
+
+	dec.dequantize(left)
+	dec.dequantize(right)
+	if common {
+		dec.applyStereo(left, right)
+	}
+	for _, ch := range []*aacChannel{left, right} {
+		dec.applyTNS(ch)
+		dec.synthesize(ch)
+	}
+	return nil
+}
+
+func (dec *aacDecoder) readICSInfo(r *bitReader, info *aacICSInfo) error {
+	r.skipBits(1) // reserved
+	info.windowSequence = int(r.readBits(2))
+	info.windowShape = int(r.readBits(1))
+
+	info.numGroups = 1
+	info.groupLength[0] = 1
+	if info.windowSequence == AAC_EIGHT_SHORT {
+		info.maxSFB = int(r.readBits(4))
+		grouping := r.readBits(7)
+		for i := 6; i >= 0; i-- {
+			if grouping>>i&1 != 0 {
+				info.groupLength[info.numGroups-1]++
+			} else {
+				info.groupLength[info.numGroups] = 1
+				info.numGroups++
+			}
+		}
+		info.bands = aacShortBands[dec.rateIndex]
+	} else {
+		info.maxSFB = int(r.readBits(6))
+		if r.readBit() {
+			// prediction belongs to the Main and LTP profiles
+			return ErrUnsupportedFormat
+		}
+		info.bands = aacLongBands[dec.rateIndex]
+	}
+
+	if info.maxSFB > len(info.bands)-1 {
+		return errAACFrame
+	}
+	return nil
+}
+
+// readICS reads an individual channel stream into the channel's quantized
+// spectrum
+func (dec *aacDecoder) readICS(r *bitReader, ch *aacChannel, common bool) error {
+	ch.globalGain = int(r.readBits(8))
+	if !common {
+		err := dec.readICSInfo(r, &ch.info)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := dec.readSections(r, ch)
+	if err != nil {
+		return err
+	}
+	err = dec.readScalefactors(r, ch)
+	if err != nil {
+		return err
+	}
+
+	var pulses []int
+	if r.readBit() {
+		if ch.info.windowSequence == AAC_EIGHT_SHORT {
+			return errAACFrame
+		}
+		count := int(r.readBits(2)) + 1
+		start := int(r.readBits(6))
+		if start >= len(ch.info.bands)-1 {
+			return errAACFrame
+		}
+		k := int(ch.info.bands[start])
+		for i := 0; i < count; i++ {
+			k += int(r.readBits(5))
+			pulses = append(pulses, k, int(r.readBits(4)))
+		}
+	}
+
+	ch.tns.present = r.readBit()
+	if ch.tns.present {
+		err = dec.readTNS(r, ch)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.readBit() {
+		// gain control belongs to the SSR profile
+		return ErrUnsupportedFormat
+	}
+
+	err = dec.readSpectrum(r, ch)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(pulses); i += 2 {
+		k, amp := pulses[i], int32(pulses[i+1])
+		if k >= AAC_FRAME_LENGTH {
+			return errAACFrame
+		}
+		if ch.quant[k] > 0 {
+			ch.quant[k] += amp
+		} else {
+			ch.quant[k] -= amp
+		}
+	}
+	return nil
+}
+
+func (dec *aacDecoder) readSections(r *bitReader, ch *aacChannel) error {
+	info := &ch.info
+	bits, escape := 5, uint32(31)
+	if info.windowSequence == AAC_EIGHT_SHORT {
+		bits, escape = 3, 7
+	}
+
+	for g := 0; g < info.numGroups; g++ {
+		for sfb := 0; sfb < info.maxSFB; {
+			book := uint8(r.readBits(4))
+			if book == 12 {
+				return errAACFrame
+			}
+
+			length := 0
+			for {
+				incr := r.readBits(bits)
+				length += int(incr)
+				if incr != escape || r.overrun {
+					break
+				}
+			}
+			if sfb+length > info.maxSFB {
+				return errAACFrame
+			}
+			for end := sfb + length; sfb < end; sfb++ {
+				ch.bandTypes[g][sfb] = book
+			}
+		}
+	}
+	return nil
+}
+
+func (dec *aacDecoder) readScalefactors(r *bitReader, ch *aacChannel) error {
+	info := &ch.info
+	gain := ch.globalGain
+	noise := ch.globalGain - 90
+	intensity := 0
+	firstNoise := true
+
+	for g := 0; g < info.numGroups; g++ {
+		for sfb := 0; sfb < info.maxSFB; sfb++ {
+			switch ch.bandTypes[g][sfb] {
+			case AAC_ZERO_HCB:
+				ch.scalefactors[g][sfb] = 0
+				continue
+			case AAC_NOISE_HCB:
+				if firstNoise {
+					firstNoise = false
+					noise += int(r.readBits(9)) - 256
+				} else {
+					noise += aacScalefactorTree.decode(r) - 60
+				}
+				ch.scalefactors[g][sfb] = noise
+			case AAC_INTENSITY_HCB, AAC_INTENSITY_HCB2:
+				intensity += aacScalefactorTree.decode(r) - 60
+				ch.scalefactors[g][sfb] = intensity
+			default:
+				gain += aacScalefactorTree.decode(r) - 60
+				if gain < 0 || gain > 255 {
+					return errAACFrame
+				}
+				ch.scalefactors[g][sfb] = gain
+			}
+			if r.overrun {
+				return errAACFrame
+			}
+		}
+	}
+	return nil
+}
+
+func (dec *aacDecoder) readTNS(r *bitReader, ch *aacChannel) error {
+	short := ch.info.windowSequence == AAC_EIGHT_SHORT
+	filterBits, lengthBits, orderBits, maxOrder := 2, 6, 5, AAC_TNS_MAX_ORDER_LONG
+	if short {
+		filterBits, lengthBits, orderBits, maxOrder = 1, 4, 3, AAC_TNS_MAX_ORDER_SHORT
+	}
+
+	for w := 0; w < ch.info.windows(); w++ {
+		filters := ch.tns.filters[w][:0]
+		count := int(r.readBits(filterBits))
+		resolution := 0
+		if count != 0 {
+			resolution = int(r.readBits(1)) + 3
+		}
+
+		for i := 0; i < count; i++ {
+			var f aacTNSFilter
+			f.length = int(r.readBits(lengthBits))
+			f.order = int(r.readBits(orderBits))
+			if f.order > maxOrder {
+				return errAACFrame
+			}
+			if f.order != 0 {
+				f.direction = r.readBit()
+				width := resolution - int(r.readBits(1))
+
+				// inverse quantize the reflection coefficients
+				iqfac := (float64(int(1)<<(resolution-1)) - 0.5) / (math.Pi / 2)
+				iqfacNeg := (float64(int(1)<<(resolution-1)) + 0.5) / (math.Pi / 2)
+				var reflection [AAC_TNS_MAX_ORDER]float64
+				for k := 0; k < f.order; k++ {
+					v := float64(r.readSigned(width))
+					if v >= 0 {
+						reflection[k] = math.Sin(v / iqfac)
+					} else {
+						reflection[k] = math.Sin(v / iqfacNeg)
+					}
+				}
+
+				// convert them to direct form LPC coefficients
+				var b [AAC_TNS_MAX_ORDER + 1]float64
+				a := &f.coefs
+				for m := 1; m <= f.order; m++ {
+					for k := 1; k < m; k++ {
+						b[k] = a[k-1] + reflection[m-1]*a[m-k-1]
+					}
+					for k := 1; k < m; k++ {
+						a[k-1] = b[k]
+					}
+					a[m-1] = reflection[m-1]
+				}
+			}
+			filters = append(filters, f)
+		}
+		ch.tns.filters[w] = filters
+	}
+	return nil
+}
+
+func (dec *aacDecoder) readSpectrum(r *bitReader, ch *aacChannel) error {
+	info := &ch.info
+	clear(ch.quant[:])
+
+	var values [4]int32
+	window := 0
+	for g := 0; g < info.numGroups; g++ {
+		for sfb := 0; sfb < info.maxSFB; sfb++ {
+			cb := ch.bandTypes[g][sfb]
+			if cb == AAC_ZERO_HCB || cb >= AAC_NOISE_HCB {
+				continue
+			}
+			book := &aacBooks[cb]
+			mod := 2*book.lav + 1
+			if book.unsigned {
+				mod = book.lav + 1
+			}
+
+			for w := window; w < window+info.groupLength[g]; w++ {
+				quant := ch.quant[w*AAC_SHORT_LENGTH:]
+				for k := int(info.bands[sfb]); k < int(info.bands[sfb+1]); k += book.dim {
+					index := book.tree.decode(r)
+					if index < 0 {
+						return errAACFrame
+					}
+
+					for i := book.dim - 1; i >= 0; i-- {
+						values[i] = int32(index % mod)
+						index /= mod
+						if !book.unsigned {
+							values[i] -= int32(book.lav)
+						}
+					}
+
+					if book.unsigned {
+						for i := 0; i < book.dim; i++ {
+							if values[i] != 0 && r.readBit() {
+								values[i] = -values[i]
+							}
+						}
+					}
+					if cb == AAC_ESC_HCB {
+						for i := 0; i < book.dim; i++ {
+							if values[i] != AAC_ESC_VALUE && values[i] != -AAC_ESC_VALUE {
+								continue
+							}
+							escape, err := readAACEscape(r)
+							if err != nil {
+								return err
+							}
+							if values[i] < 0 {
+								escape = -escape
+							}
+							values[i] = escape
+						}
+					}
+
+					copy(quant[k:k+book.dim], values[:book.dim])
+				}
+			}
+		}
+		window += info.groupLength[g]
+	}
+
+	if r.overrun {
+		return errAACFrame
+	}
+	return nil
+}
+
+// readAACEscape reads the magnitude of an escaped value of codebook 11
+func readAACEscape(r *bitReader) (int32, error) {
+	n := 4
+	for r.readBit() {
+		n++
+		if n > 12 || r.overrun {
+			return 0, errAACFrame
+		}
+	}
+	return 1<<n + int32(r.readBits(n)), nil
+}
+
+// forBands calls fn with the spectrum range of every window of each band
+func forBands(info *aacICSInfo, fn func(g int, sfb int, start int, end int)) {
+	window := 0
+	for g := 0; g < info.numGroups; g++ {
+		for sfb := 0; sfb < info.maxSFB; sfb++ {
+			for w := window; w < window+info.groupLength[g]; w++ {
+				base := w * AAC_SHORT_LENGTH
+				fn(g, sfb, base+int(info.bands[sfb]), base+int(info.bands[sfb+1]))
+			}
+		}
+		window += info.groupLength[g]
+	}
+}
+
+// dequantize scales the quantized spectrum and fills noise bands
+func (dec *aacDecoder) dequantize(ch *aacChannel) {
+	clear(ch.spectrum[:])
+	forBands(&ch.info, func(g int, sfb int, start int, end int) {
+		cb := ch.bandTypes[g][sfb]
+		sf := ch.scalefactors[g][sfb]
+		switch {
+		case cb == AAC_NOISE_HCB:
+			dec.fillNoise(ch.spectrum[start:end], sf)
+		case cb > AAC_ZERO_HCB && cb < AAC_NOISE_HCB:
+			gain := math.Exp2(0.25 * float64(sf-AAC_SF_OFFSET))
+			for k := start; k < end; k++ {
+				q := ch.quant[k]
+				switch {
+				case q > 0:
+					ch.spectrum[k] = aacPow43Of(q) * gain
+				case q < 0:
+					ch.spectrum[k] = -aacPow43Of(-q) * gain
+				}
+			}
+		}
+	})
+}
+
+func aacPow43Of(q int32) float64 {
+	if int(q) < len(aacPow43) {
+		return aacPow43[q]
+	}
+	return math.Pow(float64(q), 4.0/3.0)
+}
+
+// fillNoise writes a random vector with the energy of a noise band
+func (dec *aacDecoder) fillNoise(band []float64, sf int) {
+	energy := 0.0
+	for k := range band {
+		dec.random = dec.random*1664525 + 1013904223
+		v := float64(int32(dec.random))
+		band[k] = v
+		energy += v * v
+	}
+	if energy == 0 {
+		return
+	}
+
+	scale := math.Exp2(0.25*float64(sf)) / math.Sqrt(energy)
+	for k := range band {
+		band[k] *= scale
+	}
+}
+
+// applyStereo undoes M/S and intensity stereo coding of a pair sharing its
+// windows
+func (dec *aacDecoder) applyStereo(left *aacChannel, right *aacChannel) {
+	forBands(&left.info, func(g int, sfb int, start int, end int) {
+		lcb, rcb := left.bandTypes[g][sfb], right.bandTypes[g][sfb]
+		ms := dec.msMaskPresent == 2 || (dec.msMaskPresent == 1 && dec.msUsed[g][sfb])
+
+		switch {
+		case rcb == AAC_INTENSITY_HCB || rcb == AAC_INTENSITY_HCB2:
+			scale := math.Exp2(-0.25 * float64(right.scalefactors[g][sfb]))
+			if rcb == AAC_INTENSITY_HCB2 {
+				scale = -scale
+			}
+			if dec.msMaskPresent == 1 && dec.msUsed[g][sfb] {
+				scale = -scale
+			}
+			for k := start; k < end; k++ {
+				right.spectrum[k] = left.spectrum[k] * scale
+			}
+
+		case lcb == AAC_NOISE_HCB && rcb == AAC_NOISE_HCB:
+			// correlated noise where M/S is flagged
+			if dec.msMaskPresent != 1 || !dec.msUsed[g][sfb] {
+				break
+			}
+			scale := math.Exp2(0.25 * float64(right.scalefactors[g][sfb]-left.scalefactors[g][sfb]))
+			for k := start; k < end; k++ {
+				right.spectrum[k] = left.spectrum[k] * scale
+			}
+
+		case ms && lcb < AAC_NOISE_HCB && rcb < AAC_NOISE_HCB:
+			for k := start; k < end; k++ {
+				l, r := left.spectrum[k], right.spectrum[k]
+				left.spectrum[k], right.spectrum[k] = l+r, l-r
+			}
+		}
+	})
+}
+
+// applyTNS runs the noise shaping filters over the spectrum of each window
+func (dec *aacDecoder) applyTNS(ch *aacChannel) {
+	if !ch.tns.present {
+		return
+	}
+
+	info := &ch.info
+	numBands := len(info.bands) - 1
+	maxBands, maxOrder := aacTNSMaxBandsLong[dec.rateIndex], 12
+	if info.windowSequence == AAC_EIGHT_SHORT {
+		maxBands, maxOrder = aacTNSMaxBandsShort[dec.rateIndex], 7
+	}
+	limit := min(maxBands, info.maxSFB)
+
+	var state [AAC_TNS_MAX_ORDER]float64
+	for w := 0; w < info.windows(); w++ {
+		spectrum := ch.spectrum[w*AAC_SHORT_LENGTH:]
+		bottom := numBands
+		for i := range ch.tns.filters[w] {
+			f := &ch.tns.filters[w][i]
+			top := bottom
+			bottom = max(top-f.length, 0)
+			order := min(f.order, maxOrder)
+			if order == 0 {
+				continue
+			}
+
+			start := int(info.bands[min(bottom, limit)])
+			end := int(info.bands[min(top, limit)])
+			if start >= end {
+				continue
+			}
+
+			pos, inc := start, 1
+			if f.direction {
+				pos, inc = end-1, -1
+			}
+			clear(state[:order])
+			for n := start; n < end; n++ {
+				y := spectrum[pos]
+				for k := 0; k < order; k++ {
+					y -= f.coefs[k] * state[k]
+				}
+				copy(state[1:order], state[:order-1])
+				state[0] = y
+				spectrum[pos] = y
+				pos += inc
+			}
+		}
+	}
+}
+
+// synthesize transforms the spectrum, windows it and overlaps it with the
+// previous frame into the channel's output
+func (dec *aacDecoder) synthesize(ch *aacChannel) {
+	info := &ch.info
+	block := dec.block
+	longLeft, longRight := dec.longWindows[ch.prevShape], dec.longWindows[info.windowShape]
+	shortLeft, shortRight := dec.shortWindows[ch.prevShape], dec.shortWindows[info.windowShape]
+
+	const (
+		N     = AAC_FRAME_LENGTH
+		S     = AAC_SHORT_LENGTH
+		FLAT  = (N - S) / 2
+		SCALE = 1.0 / (N * 32768)
+	)
+
+	if info.windowSequence == AAC_EIGHT_SHORT {
+		clear(block)
+		out := dec.scratch
+		for w := 0; w < 8; w++ {
+			dec.short.transform(ch.spectrum[w*S:(w+1)*S], out)
+			left := shortRight
+			if w == 0 {
+				left = shortLeft
+			}
+			base := FLAT + w*S
+			for i := 0; i < S; i++ {
+				// short blocks have an eighth of the length to normalize
+				block[base+i] += out[i] * left[i] * 8
+				block[base+S+i] += out[S+i] * shortRight[S-1-i] * 8
+			}
+		}
+	} else {
+		dec.long.transform(ch.spectrum[:], block)
+
+		switch info.windowSequence {
+		case AAC_LONG_STOP:
+			for i := 0; i < N; i++ {
+				switch {
+				case i < FLAT:
+					block[i] = 0
+				case i < FLAT+S:
+					block[i] *= shortLeft[i-FLAT]
+				}
+			}
+		default:
+			for i := 0; i < N; i++ {
+				block[i] *= longLeft[i]
+			}
+		}
+
+		switch info.windowSequence {
+		case AAC_LONG_START:
+			for i := 0; i < N; i++ {
+				switch {
+				case i >= FLAT+S:
+					block[N+i] = 0
+				case i >= FLAT:
+					block[N+i] *= shortRight[S-1-(i-FLAT)]
+				}
+			}
+		default:
+			for i := 0; i < N; i++ {
+				block[N+i] *= longRight[N-1-i]
+			}
+		}
+	}
+
+	for i := 0; i < N; i++ {
+		ch.output[i] = (block[i] + ch.overlap[i]) * SCALE
+		ch.overlap[i] = block[N+i]
+	}
+	ch.prevShape = info.windowShape
+}
+
+// sineWindow returns the rising half of a sine window of length n
+func sineWindow(n int) []float64 {
+	w := make([]float64, n/2)
+	for i := range w {
+		w[i] = math.Sin(math.Pi / float64(n) * (float64(i) + 0.5))
+	}
+	return w
+}
+
+// kbdWindow returns the rising half of a Kaiser-Bessel derived window of
+// length n
+func kbdWindow(n int, alpha float64) []float64 {
+	half := n / 2
+	kaiser := make([]float64, half+1)
+	total := 0.0
+	for i := range kaiser {
+		x := float64(i-half/2) / float64(half/2)
+		kaiser[i] = besselI0(math.Pi * alpha * math.Sqrt(1-x*x))
+		total += kaiser[i]
+	}
+
+	w := make([]float64, half)
+	sum := 0.0
+	for i := range w {
+		sum += kaiser[i]
+		w[i] = math.Sqrt(sum / total)
+	}
+	return w
+}
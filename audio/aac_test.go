@@ -0,0 +1,912 @@
+package audio
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/bits"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// aacTestTNS is a TNS filter as coded, coefs being its quantized reflection
+// coefficients
+type aacTestTNS struct {
+	length, order int
+	down          bool
+	compress      bool
+	coefs         []int
+}
+
+// aacTestChannel is a channel's frame as the test encoder writes it
+type aacTestChannel struct {
+	seq, shape, maxSFB int
+	grouping           int // scale_factor_grouping of eight short windows
+	globalGain         int
+
+	books [8][AAC_MAX_BANDS]int
+	sfs   [8][AAC_MAX_BANDS]int   // scalefactors, or intensity positions
+	quant [AAC_FRAME_LENGTH]int32 // window by window
+
+	pulseStart int
+	pulses     [][2]int // offset and amplitude
+
+	tnsRes int // TNS coefficient resolution, 3 or 4 bits
+	tns    [8][]aacTestTNS
+}
+
+// aacTestFrame is a frame of a single channel or of a channel pair
+type aacTestFrame struct {
+	ch        []*aacTestChannel
+	common    bool
+	msPresent int
+	msUsed    [8][AAC_MAX_BANDS]bool
+}
+
+func (c *aacTestChannel) short() bool {
+	return c.seq == AAC_EIGHT_SHORT
+}
+
+func (c *aacTestChannel) bands(rate int) []uint16 {
+	if c.short() {
+		return aacShortBands[rate]
+	}
+	return aacLongBands[rate]
+}
+
+// groups returns the first window of each window group, and the window
+// after the last group
+func (c *aacTestChannel) groups() []int {
+	if !c.short() {
+		return []int{0, 1}
+	}
+	starts := []int{0}
+	for w := 1; w < 8; w++ {
+		if c.grouping>>(7-w)&1 == 0 {
+			starts = append(starts, w)
+		}
+	}
+	return append(starts, 8)
+}
+
+// writeAACValues writes a codeword of codebook cb holding values, with their
+// signs and escapes
+func writeAACValues(w *bitWriter, cb int, values []int32) {
+	book := aacHuffmanCodes[cb]
+	index := 0
+	for _, v := range values {
+		if book.unsigned {
+			index = index*(book.lav+1) + min(int(max(v, -v)), book.lav)
+		} else {
+			index = index*(2*book.lav+1) + int(v) + book.lav
+		}
+	}
+	w.writeBits(uint64(book.codes[index]), int(book.lens[index]))
+	if !book.unsigned {
+		return
+	}
+	for _, v := range values {
+		if v != 0 {
+			w.writeBits(boolBit(v < 0), 1)
+		}
+	}
+	if cb != AAC_ESC_HCB {
+		return
+	}
+	for _, v := range values {
+		v = max(v, -v)
+		if v < AAC_ESC_VALUE {
+			continue
+		}
+		n := bits.Len32(uint32(v)) - 1
+		for i := 4; i < n; i++ {
+			w.writeBits(1, 1)
+		}
+		w.writeBits(0, 1)
+		w.writeBits(uint64(v)-1<<n, n)
+	}
+}
+
+func writeAACICSInfo(w *bitWriter, c *aacTestChannel) {
+	w.writeBits(0, 1)
+	w.writeBits(uint64(c.seq), 2)
+	w.writeBits(uint64(c.shape), 1)
+	if c.short() {
+		w.writeBits(uint64(c.maxSFB), 4)
+		w.writeBits(uint64(c.grouping), 7)
+	} else {
+		w.writeBits(uint64(c.maxSFB), 6)
+		w.writeBits(0, 1)
+	}
+}
+
+func writeAACICS(w *bitWriter, c *aacTestChannel, common bool, rate int) {
+	w.writeBits(uint64(c.globalGain), 8)
+	if !common {
+		writeAACICSInfo(w, c)
+	}
+	groups := c.groups()
+	bands := c.bands(rate)
+
+	// sections run over bands of one codebook
+	lengthBits, escape := 5, 31
+	if c.short() {
+		lengthBits, escape = 3, 7
+	}
+	for g := 0; g < len(groups)-1; g++ {
+		for sfb := 0; sfb < c.maxSFB; {
+			end := sfb + 1
+			for end < c.maxSFB && c.books[g][end] == c.books[g][sfb] {
+				end++
+			}
+			w.writeBits(uint64(c.books[g][sfb]), 4)
+			n := end - sfb
+			for ; n >= escape; n -= escape {
+				w.writeBits(uint64(escape), lengthBits)
+			}
+			w.writeBits(uint64(n), lengthBits)
+			sfb = end
+		}
+	}
+
+	writeSF := func(diff int) {
+		w.writeBits(uint64(aacScalefactorCode.codes[diff+60]), int(aacScalefactorCode.lens[diff+60]))
+	}
+	gain, position := c.globalGain, 0
+	for g := 0; g < len(groups)-1; g++ {
+		for sfb := 0; sfb < c.maxSFB; sfb++ {
+			switch c.books[g][sfb] {
+			case AAC_ZERO_HCB:
+			case AAC_INTENSITY_HCB, AAC_INTENSITY_HCB2:
+				writeSF(c.sfs[g][sfb] - position)
+				position = c.sfs[g][sfb]
+			default:
+				writeSF(c.sfs[g][sfb] - gain)
+				gain = c.sfs[g][sfb]
+			}
+		}
+	}
+
+	w.writeBits(boolBit(len(c.pulses) > 0), 1)
+	if len(c.pulses) > 0 {
+		w.writeBits(uint64(len(c.pulses)-1), 2)
+		w.writeBits(uint64(c.pulseStart), 6)
+		for _, p := range c.pulses {
+			w.writeBits(uint64(p[0]), 5)
+			w.writeBits(uint64(p[1]), 4)
+		}
+	}
+
+	tns := false
+	for _, filters := range c.tns {
+		tns = tns || len(filters) > 0
+	}
+	w.writeBits(boolBit(tns), 1)
+	if tns {
+		countBits, lengthBits, orderBits := 2, 6, 5
+		if c.short() {
+			countBits, lengthBits, orderBits = 1, 4, 3
+		}
+		for win := 0; win < groups[len(groups)-1]; win++ {
+			w.writeBits(uint64(len(c.tns[win])), countBits)
+			if len(c.tns[win]) == 0 {
+				continue
+			}
+			w.writeBits(uint64(c.tnsRes-3), 1)
+			for _, f := range c.tns[win] {
+				w.writeBits(uint64(f.length), lengthBits)
+				w.writeBits(uint64(f.order), orderBits)
+				if f.order == 0 {
+					continue
+				}
+				w.writeBits(boolBit(f.down), 1)
+				w.writeBits(boolBit(f.compress), 1)
+				for _, coef := range f.coefs {
+					w.writeSigned(int64(coef), c.tnsRes-int(boolBit(f.compress)))
+				}
+			}
+		}
+	}
+	w.writeBits(0, 1) // gain control
+
+	for g := 0; g < len(groups)-1; g++ {
+		for sfb := 0; sfb < c.maxSFB; sfb++ {
+			cb := c.books[g][sfb]
+			if cb == AAC_ZERO_HCB || cb >= AAC_NOISE_HCB {
+				continue
+			}
+			dim := aacHuffmanCodes[cb].dim
+			for win := groups[g]; win < groups[g+1]; win++ {
+				quant := c.quant[win*AAC_SHORT_LENGTH:]
+				for k := int(bands[sfb]); k < int(bands[sfb+1]); k += dim {
+					writeAACValues(w, cb, quant[k:k+dim])
+				}
+			}
+		}
+	}
+}
+
+func boolBit(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// writeAACFrame codes a raw data block, with data and fill elements the
+// decoder passes over
+func writeAACFrame(f *aacTestFrame, rate int) []byte {
+	w := &bitWriter{}
+	w.writeBits(AAC_ELEMENT_DSE, 3)
+	w.writeBits(0, 4)
+	w.writeBits(1, 1)
+	w.writeBits(2, 8)
+	w.alignByte()
+	w.writeBits(0xDA7A, 16)
+
+	if len(f.ch) == 1 {
+		w.writeBits(AAC_ELEMENT_SCE, 3)
+		w.writeBits(0, 4)
+		writeAACICS(w, f.ch[0], false, rate)
+	} else {
+		w.writeBits(AAC_ELEMENT_CPE, 3)
+		w.writeBits(0, 4)
+		w.writeBits(boolBit(f.common), 1)
+		if f.common {
+			left := f.ch[0]
+			writeAACICSInfo(w, left)
+			w.writeBits(uint64(f.msPresent), 2)
+			if f.msPresent == 1 {
+				for g := 0; g < len(left.groups())-1; g++ {
+					for sfb := 0; sfb < left.maxSFB; sfb++ {
+						w.writeBits(boolBit(f.msUsed[g][sfb]), 1)
+					}
+				}
+			}
+		}
+		writeAACICS(w, f.ch[0], f.common, rate)
+		writeAACICS(w, f.ch[1], f.common, rate)
+	}
+
+	w.writeBits(AAC_ELEMENT_FIL, 3)
+	w.writeBits(2, 4)
+	w.writeBits(0xF111, 16)
+	w.writeBits(AAC_ELEMENT_END, 3)
+	return w.data
+}
+
+// aacReference decodes test frames from their description, following the
+// definitions of ISO/IEC 14496-3 directly rather than the decoder's faster
+// route to the same output
+type aacReference struct {
+	rate      int // sampling frequency index
+	overlap   [][]float64
+	prevShape []int
+}
+
+func newAACReference(rate, channels int) *aacReference {
+	ref := &aacReference{rate: rate, prevShape: make([]int, channels)}
+	for c := 0; c < channels; c++ {
+		ref.overlap = append(ref.overlap, make([]float64, AAC_FRAME_LENGTH))
+	}
+	return ref
+}
+
+// forWindowBands calls fn with the spectrum range of each band of each
+// window, and the group it is in
+func (ref *aacReference) forWindowBands(c *aacTestChannel, fn func(g, sfb, start, end int)) {
+	groups := c.groups()
+	bands := c.bands(ref.rate)
+	for g := 0; g < len(groups)-1; g++ {
+		for win := groups[g]; win < groups[g+1]; win++ {
+			for sfb := 0; sfb < c.maxSFB; sfb++ {
+				base := win * AAC_SHORT_LENGTH
+				fn(g, sfb, base+int(bands[sfb]), base+int(bands[sfb+1]))
+			}
+		}
+	}
+}
+
+func (ref *aacReference) dequantize(c *aacTestChannel) []float64 {
+	quant := c.quant
+	if len(c.pulses) > 0 {
+		k := int(c.bands(ref.rate)[c.pulseStart])
+		for _, p := range c.pulses {
+			k += p[0]
+			if quant[k] > 0 {
+				quant[k] += int32(p[1])
+			} else {
+				quant[k] -= int32(p[1])
+			}
+		}
+	}
+
+	spectrum := make([]float64, AAC_FRAME_LENGTH)
+	ref.forWindowBands(c, func(g, sfb, start, end int) {
+		if cb := c.books[g][sfb]; cb == AAC_ZERO_HCB || cb >= AAC_NOISE_HCB {
+			return
+		}
+		gain := math.Pow(2, 0.25*float64(c.sfs[g][sfb]-100))
+		for k := start; k < end; k++ {
+			q := float64(quant[k])
+			spectrum[k] = math.Copysign(math.Pow(math.Abs(q), 4.0/3), q) * gain
+		}
+	})
+	return spectrum
+}
+
+func (ref *aacReference) stereo(f *aacTestFrame, left, right []float64) {
+	l, r := f.ch[0], f.ch[1]
+	ref.forWindowBands(l, func(g, sfb, start, end int) {
+		msUsed := f.msPresent == 2 || (f.msPresent == 1 && f.msUsed[g][sfb])
+		switch r.books[g][sfb] {
+		case AAC_INTENSITY_HCB, AAC_INTENSITY_HCB2:
+			sign := 1.0
+			if r.books[g][sfb] == AAC_INTENSITY_HCB2 {
+				sign = -1
+			}
+			if f.msPresent == 1 && f.msUsed[g][sfb] {
+				sign = -sign
+			}
+			scale := sign * math.Pow(0.5, 0.25*float64(r.sfs[g][sfb]))
+			for k := start; k < end; k++ {
+				right[k] = left[k] * scale
+			}
+		default:
+			if !msUsed {
+				return
+			}
+			for k := start; k < end; k++ {
+				left[k], right[k] = left[k]+right[k], left[k]-right[k]
+			}
+		}
+	})
+}
+
+func (ref *aacReference) tns(c *aacTestChannel, spectrum []float64) {
+	bands := c.bands(ref.rate)
+	maxBands := aacTNSMaxBandsLong[ref.rate]
+	if c.short() {
+		maxBands = aacTNSMaxBandsShort[ref.rate]
+	}
+	limit := func(band int) int {
+		return int(bands[min(band, maxBands, c.maxSFB)])
+	}
+
+	for win, filters := range c.tns {
+		x := spectrum[win*AAC_SHORT_LENGTH:]
+		bottom := len(bands) - 1
+		for _, f := range filters {
+			top := bottom
+			bottom = max(top-f.length, 0)
+			if f.order == 0 {
+				continue
+			}
+
+			// the reflection coefficients, stepped up to a direct form
+			// filter
+			iqfac := (float64(int(1)<<(c.tnsRes-1)) - 0.5) / (math.Pi / 2)
+			iqfacNeg := (float64(int(1)<<(c.tnsRes-1)) + 0.5) / (math.Pi / 2)
+			lpc := []float64{1}
+			for _, coef := range f.coefs {
+				k := math.Sin(float64(coef) / iqfac)
+				if coef < 0 {
+					k = math.Sin(float64(coef) / iqfacNeg)
+				}
+				next := append(make([]float64, 0, len(lpc)+1), lpc...)
+				next = append(next, k)
+				for i := 1; i < len(lpc); i++ {
+					next[i] = lpc[i] + k*lpc[len(lpc)-i]
+				}
+				lpc = next
+			}
+
+			// y[n] = x[n] - sum of lpc[i] y[n-i], run up or down the region
+			start, end := limit(bottom), limit(top)
+			region := make([]int, 0, end-start)
+			for n := start; n < end; n++ {
+				region = append(region, n)
+			}
+			if f.down {
+				for i, j := 0, len(region)-1; i < j; i, j = i+1, j-1 {
+					region[i], region[j] = region[j], region[i]
+				}
+			}
+			y := make([]float64, len(region))
+			for n, pos := range region {
+				y[n] = x[pos]
+				for i := 1; i < len(lpc) && i <= n; i++ {
+					y[n] -= lpc[i] * y[n-i]
+				}
+			}
+			for n, pos := range region {
+				x[pos] = y[n]
+			}
+		}
+	}
+}
+
+// aacWindow is the rising half of a window of length n in the given shape
+func aacWindow(shape, n int) []float64 {
+	w := make([]float64, n/2)
+	if shape == AAC_WINDOW_SINE {
+		for i := range w {
+			w[i] = math.Sin(math.Pi / float64(n) * (float64(i) + 0.5))
+		}
+		return w
+	}
+
+	alpha := 4.0
+	if n == 2*AAC_SHORT_LENGTH {
+		alpha = 6
+	}
+	// I0 by its power series
+	i0 := func(x float64) float64 {
+		sum, term := 1.0, 1.0
+		for k := 1; term > 1e-20*sum; k++ {
+			term *= (x / 2 / float64(k)) * (x / 2 / float64(k))
+			sum += term
+		}
+		return sum
+	}
+	kaiser := func(j int) float64 {
+		x := float64(j-n/4) / float64(n/4)
+		return i0(math.Pi * alpha * math.Sqrt(1-x*x))
+	}
+	total := 0.0
+	for j := 0; j <= n/2; j++ {
+		total += kaiser(j)
+	}
+	sum := 0.0
+	for i := range w {
+		sum += kaiser(i)
+		w[i] = math.Sqrt(sum / total)
+	}
+	return w
+}
+
+// aacIMDCT is the inverse transform of a spectrum into 2*len(spectrum)
+// samples, by its definition
+func aacIMDCT(spectrum []float64) []float64 {
+	n := 2 * len(spectrum)
+	out := make([]float64, n)
+	for i := range out {
+		// the phase in quarter cycles over n, kept whole so it stays exact
+		sum := 0.0
+		for k, x := range spectrum {
+			m := (2*i + n/2 + 1) * (2*k + 1) % (4 * n)
+			sum += x * math.Cos(math.Pi*float64(m)/float64(2*n))
+		}
+		out[i] = 2 / float64(n) * sum
+	}
+	return out
+}
+
+func (ref *aacReference) synthesize(ch int, c *aacTestChannel, spectrum []float64) []float64 {
+	const N, S = 2 * AAC_FRAME_LENGTH, 2 * AAC_SHORT_LENGTH
+	long := [2][]float64{aacWindow(ref.prevShape[ch], N), aacWindow(c.shape, N)}
+	short := [2][]float64{aacWindow(ref.prevShape[ch], S), aacWindow(c.shape, S)}
+	ref.prevShape[ch] = c.shape
+
+	block := make([]float64, N)
+	if c.short() {
+		for win := 0; win < 8; win++ {
+			x := aacIMDCT(spectrum[win*AAC_SHORT_LENGTH : (win+1)*AAC_SHORT_LENGTH])
+			rise := short[1]
+			if win == 0 {
+				rise = short[0]
+			}
+			for i := 0; i < S/2; i++ {
+				block[448+win*128+i] += x[i] * rise[i]
+				block[448+win*128+S/2+i] += x[S/2+i] * short[1][S/2-1-i]
+			}
+		}
+	} else {
+		x := aacIMDCT(spectrum)
+		for i := range block {
+			var w float64
+			switch {
+			case i < N/2 && c.seq == AAC_LONG_STOP:
+				if i >= 448 && i < 576 {
+					w = short[0][i-448]
+				} else if i >= 576 {
+					w = 1
+				}
+			case i < N/2:
+				w = long[0][i]
+			case c.seq == AAC_LONG_START:
+				if i < 1472 {
+					w = 1
+				} else if i < 1600 {
+					w = short[1][1599-i]
+				}
+			default:
+				w = long[1][N-1-i]
+			}
+			block[i] = x[i] * w
+		}
+	}
+
+	out := make([]float64, AAC_FRAME_LENGTH)
+	for i := range out {
+		out[i] = (block[i] + ref.overlap[ch][i]) / 32768
+		ref.overlap[ch][i] = block[N/2+i]
+	}
+	return out
+}
+
+// decode returns a frame's output, interleaved
+func (ref *aacReference) decode(f *aacTestFrame) []float64 {
+	spectra := make([][]float64, len(f.ch))
+	for i, c := range f.ch {
+		spectra[i] = ref.dequantize(c)
+	}
+	if len(f.ch) == 2 && f.common {
+		ref.stereo(f, spectra[0], spectra[1])
+	}
+	out := make([]float64, AAC_FRAME_LENGTH*len(f.ch))
+	for i, c := range f.ch {
+		ref.tns(c, spectra[i])
+		for n, v := range ref.synthesize(i, c, spectra[i]) {
+			out[n*len(f.ch)+i] = v
+		}
+	}
+	return out
+}
+
+// randomAACChannel fills a frame of a channel with bands of every spectral
+// codebook, escapes included, at scalefactors wandering about gain
+func randomAACChannel(r *rand.Rand, seq, shape, grouping, rate int) *aacTestChannel {
+	c := &aacTestChannel{seq: seq, shape: shape, grouping: grouping, globalGain: 100}
+	bands := c.bands(rate)
+	c.maxSFB = len(bands) - 1 - r.Intn(3)
+	groups := c.groups()
+	sf := c.globalGain
+	for g := 0; g < len(groups)-1; g++ {
+		for sfb := 0; sfb < c.maxSFB; sfb++ {
+			cb := r.Intn(AAC_ESC_HCB + 1)
+			c.books[g][sfb] = cb
+			if cb == AAC_ZERO_HCB {
+				continue
+			}
+			sf = min(max(sf+r.Intn(13)-6, 70), 130)
+			c.sfs[g][sfb] = sf
+
+			lav := aacHuffmanCodes[cb].lav
+			for win := groups[g]; win < groups[g+1]; win++ {
+				for k := int(bands[sfb]); k < int(bands[sfb+1]); k++ {
+					v := int32(r.Intn(2*lav+1) - lav)
+					if cb == AAC_ESC_HCB && r.Intn(6) == 0 {
+						v = int32(AAC_ESC_VALUE+r.Intn(8000)) * (1 - 2*int32(r.Intn(2)))
+					}
+					c.quant[win*AAC_SHORT_LENGTH+k] = v
+				}
+			}
+		}
+	}
+	return c
+}
+
+// addAACTNS gives some windows of c filters of every order and direction,
+// covering its bands in up to three regions
+func addAACTNS(r *rand.Rand, c *aacTestChannel, rate int) {
+	c.tnsRes = 3 + r.Intn(2)
+	maxCount, maxLength, maxOrder := 3, 20, 12
+	windows := 1
+	if c.short() {
+		maxCount, maxLength, maxOrder, windows = 1, 8, 7, 8
+	}
+	for win := 0; win < windows; win++ {
+		if c.short() && win%3 == 1 {
+			continue
+		}
+		for i := 0; i < 1+r.Intn(maxCount); i++ {
+			f := aacTestTNS{
+				length:   1 + r.Intn(maxLength),
+				order:    r.Intn(maxOrder + 1),
+				down:     r.Intn(2) == 0,
+				compress: r.Intn(2) == 0,
+			}
+			if i == 0 {
+				f.order = max(f.order, 1)
+			}
+			width := c.tnsRes - int(boolBit(f.compress))
+			for k := 0; k < f.order; k++ {
+				f.coefs = append(f.coefs, r.Intn(1<<width)-1<<(width-1))
+			}
+			c.tns[win] = append(c.tns[win], f)
+		}
+	}
+}
+
+// randomAACPair is a channel pair sharing windows, with M/S coded bands as
+// msPresent says and the right channel intensity coded from band from on if
+// from is not -1
+func randomAACPair(r *rand.Rand, seq, shape, grouping, msPresent, from, rate int) *aacTestFrame {
+	f := &aacTestFrame{common: true, msPresent: msPresent}
+	f.ch = []*aacTestChannel{
+		randomAACChannel(r, seq, shape, grouping, rate),
+		randomAACChannel(r, seq, shape, grouping, rate),
+	}
+	f.ch[1].maxSFB = f.ch[0].maxSFB
+	for g := range f.msUsed {
+		for sfb := range f.msUsed[g] {
+			f.msUsed[g][sfb] = r.Intn(2) == 0
+		}
+	}
+	if from >= 0 {
+		position := 0
+		for g := 0; g < len(f.ch[1].groups())-1; g++ {
+			for sfb := from; sfb < f.ch[1].maxSFB; sfb++ {
+				position += r.Intn(9) - 4
+				f.ch[1].books[g][sfb] = AAC_INTENSITY_HCB2 + r.Intn(2)
+				f.ch[1].sfs[g][sfb] = position
+			}
+		}
+	}
+	return f
+}
+
+// aacSampleEntry is an mp4a sample entry carrying an AudioSpecificConfig
+// for AAC-LC
+func aacSampleEntry(channels, rate int) []byte {
+	index := 0
+	for int(aacSampleRates[index]) != rate {
+		index++
+	}
+	config := &bitWriter{}
+	config.writeBits(AAC_OBJECT_LC, 5)
+	config.writeBits(uint64(index), 4)
+	config.writeBits(uint64(channels), 4)
+	config.writeBits(0, 3)
+
+	descriptor := func(tag byte, body ...[]byte) []byte {
+		data := bytes.Join(body, nil)
+		// sizes written long, as many encoders do
+		return append([]byte{tag, 0x80, 0x80, 0x80, byte(len(data))}, data...)
+	}
+	decoderConfig := append([]byte{MP4_OBJECT_MPEG4_AUDIO, 0x15}, make([]byte, 11)...)
+	esds := descriptor(MP4_DESCRIPTOR_ES, []byte{0, 1, 0},
+		descriptor(MP4_DESCRIPTOR_DECODER_CONFIG, decoderConfig, descriptor(MP4_DESCRIPTOR_DECODER_INFO, config.data)),
+		descriptor(6, []byte{2}),
+	)
+
+	body := make([]byte, 28)
+	body[7] = 1
+	body[17] = byte(channels)
+	body[19] = 16
+	body[24], body[25] = byte(rate>>8), byte(rate)
+	return mp4BoxBytes("mp4a", body, mp4BoxBytes("esds", uint32s(0), esds))
+}
+
+// iTunSMPB is iTunes' gapless playback tag
+func iTunSMPB(priming, padding, samples int) []byte {
+	value := fmt.Sprintf(" 00000000 %08X %08X %016X 00000000 00000000", priming, padding, samples)
+	return mp4BoxBytes("----",
+		mp4BoxBytes("mean", uint32s(0), []byte("com.apple.iTunes")),
+		mp4BoxBytes("name", uint32s(0), []byte("iTunSMPB")),
+		mp4BoxBytes("data", uint32s(1, 0), []byte(value)),
+	)
+}
+
+// checkAAC muxes frames into a file trimmed by an edit list, or by iTunSMPB
+// if smpb is set, and checks it decodes as the reference does
+func checkAAC(t *testing.T, name string, frames []*aacTestFrame, rate, skip, play int, smpb bool) {
+	t.Helper()
+	channels := len(frames[0].ch)
+	index := 0
+	for int(aacSampleRates[index]) != rate {
+		index++
+	}
+
+	ref := newAACReference(index, channels)
+	var samples [][]byte
+	var durations []uint32
+	var want []float64
+	for _, f := range frames {
+		samples = append(samples, writeAACFrame(f, index))
+		durations = append(durations, AAC_FRAME_LENGTH)
+		want = append(want, ref.decode(f)...)
+	}
+	want = want[skip*channels : (skip+play)*channels]
+	peak := 0.0
+	for _, v := range want {
+		peak = max(peak, math.Abs(v))
+	}
+
+	var data []byte
+	if smpb {
+		padding := len(frames)*AAC_FRAME_LENGTH - skip - play
+		data = muxMP4(aacSampleEntry(channels, rate), samples, durations, uint32(rate), 0, 0, iTunSMPB(skip, padding, play))
+	} else {
+		data = muxMP4(aacSampleEntry(channels, rate), samples, durations, uint32(rate), uint32(skip), uint32(play), nil)
+	}
+	path := filepath.Join(t.TempDir(), name+".m4a")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dec, err := openMP4(path)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	defer dec.close()
+	checkFormat(t, dec, channels, rate, int64(play))
+	all := decodeAll(t, dec)
+	if len(all) != len(want) {
+		t.Fatalf("%s: %d samples, expected %d", name, len(all), len(want))
+	}
+	checkSamples(t, name, all, want, peak*1e-9)
+
+	var targets []int64
+	for _, frame := range []int{0, 1, AAC_FRAME_LENGTH - skip%AAC_FRAME_LENGTH, play / 2, play - 1} {
+		targets = append(targets, int64(frame))
+	}
+	checkSeek(t, dec, all, peak*1e-9, targets...)
+}
+
+func TestAACStereo(t *testing.T) {
+	const rate = 48000
+	index := 3
+	r := rand.New(rand.NewSource(7))
+	var frames []*aacTestFrame
+	add := func(f *aacTestFrame) *aacTestFrame {
+		frames = append(frames, f)
+		return f
+	}
+
+	// long windows of both shapes, with M/S and intensity stereo, TNS
+	// and pulses. The first two frames are mostly encoder delay.
+	f := add(randomAACPair(r, AAC_ONLY_LONG, AAC_WINDOW_SINE, 0, 1, -1, index))
+	addAACTNS(r, f.ch[0], index)
+	f = add(randomAACPair(r, AAC_ONLY_LONG, AAC_WINDOW_KBD, 0, 2, 30, index))
+	addAACTNS(r, f.ch[1], index)
+	f = add(randomAACPair(r, AAC_ONLY_LONG, AAC_WINDOW_SINE, 0, 1, 25, index))
+	f.ch[1].pulseStart, f.ch[1].pulses = 10, [][2]int{{3, 15}, {0, 2}, {31, 7}, {1, 1}}
+
+	// into short windows and out again, grouped and not
+	add(randomAACPair(r, AAC_LONG_START, AAC_WINDOW_KBD, 0, 0, -1, index))
+	f = add(randomAACPair(r, AAC_EIGHT_SHORT, AAC_WINDOW_SINE, 0b0110110, 1, 9, index))
+	addAACTNS(r, f.ch[0], index)
+	f = add(randomAACPair(r, AAC_EIGHT_SHORT, AAC_WINDOW_KBD, 0, 2, -1, index))
+	addAACTNS(r, f.ch[1], index)
+	f = add(randomAACPair(r, AAC_EIGHT_SHORT, AAC_WINDOW_KBD, 0b1111111, 1, 12, index))
+	add(randomAACPair(r, AAC_LONG_STOP, AAC_WINDOW_SINE, 0, 1, -1, index))
+
+	// channels with windows of their own
+	f = add(&aacTestFrame{ch: []*aacTestChannel{
+		randomAACChannel(r, AAC_ONLY_LONG, AAC_WINDOW_KBD, 0, index),
+		randomAACChannel(r, AAC_ONLY_LONG, AAC_WINDOW_SINE, 0, index),
+	}})
+	addAACTNS(r, f.ch[0], index)
+	add(&aacTestFrame{ch: []*aacTestChannel{
+		randomAACChannel(r, AAC_LONG_START, AAC_WINDOW_SINE, 0, index),
+		randomAACChannel(r, AAC_LONG_START, AAC_WINDOW_KBD, 0, index),
+	}})
+	add(&aacTestFrame{ch: []*aacTestChannel{
+		randomAACChannel(r, AAC_EIGHT_SHORT, AAC_WINDOW_SINE, 0b1010101, index),
+		randomAACChannel(r, AAC_EIGHT_SHORT, AAC_WINDOW_KBD, 0b0001111, index),
+	}})
+	add(randomAACPair(r, AAC_LONG_STOP, AAC_WINDOW_KBD, 0, 2, 40, index))
+	add(randomAACPair(r, AAC_ONLY_LONG, AAC_WINDOW_KBD, 0, 1, -1, index))
+
+	// the edit list trims the encoder delay and the padding of the last
+	// frame
+	checkAAC(t, "stereo", frames, rate, 2112, len(frames)*AAC_FRAME_LENGTH-2112-700, false)
+}
+
+func TestAACMono(t *testing.T) {
+	const rate = 44100
+	index := 4
+	r := rand.New(rand.NewSource(8))
+	var frames []*aacTestFrame
+	for _, seq := range []int{AAC_ONLY_LONG, AAC_LONG_START, AAC_EIGHT_SHORT, AAC_EIGHT_SHORT, AAC_LONG_STOP, AAC_ONLY_LONG, AAC_ONLY_LONG, AAC_ONLY_LONG} {
+		c := randomAACChannel(r, seq, r.Intn(2), r.Intn(128), index)
+		addAACTNS(r, c, index)
+		frames = append(frames, &aacTestFrame{ch: []*aacTestChannel{c}})
+	}
+
+	// with no edit list, iTunSMPB gives the delay and the length
+	checkAAC(t, "mono", frames, rate, 1024+321, len(frames)*AAC_FRAME_LENGTH-1024-321-97, true)
+}
+
+// a TNS filter of an order LC does not allow is refused rather than
+// overrunning the coefficients
+func TestAACTNSOrder(t *testing.T) {
+	index := 4
+	r := rand.New(rand.NewSource(8))
+	c := randomAACChannel(r, AAC_ONLY_LONG, r.Intn(2), r.Intn(128), index)
+	addAACTNS(r, c, index)
+	f := &aacTestFrame{ch: []*aacTestChannel{c}}
+
+	for _, order := range []int{AAC_TNS_MAX_ORDER_LONG, AAC_TNS_MAX_ORDER_LONG + 1, 21, 31} {
+		filter := &c.tns[0][0]
+		filter.order = order
+		filter.coefs = make([]int, order)
+		dec, err := newAACDecoder([]byte{0x12, 0x08})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = dec.decode(writeAACFrame(f, index))
+		if order <= AAC_TNS_MAX_ORDER_LONG && err != nil {
+			t.Fatalf("order %d: %v", order, err)
+		}
+		if order > AAC_TNS_MAX_ORDER_LONG && err != errAACFrame {
+			t.Fatalf("order %d: error %v, expected %v", order, err, errAACFrame)
+		}
+	}
+}
+
+func TestAACConfig(t *testing.T) {
+	config := func(fields ...uint64) []byte {
+		w := &bitWriter{}
+		for i := 0; i < len(fields); i += 2 {
+			w.writeBits(fields[i], int(fields[i+1]))
+		}
+		return w.data
+	}
+	for _, test := range []struct {
+		name     string
+		config   []byte
+		channels int
+		rate     uint32
+		err      error
+	}{
+		{"stereo", config(2, 5, 3, 4, 2, 4, 0, 3), 2, 48000, nil},
+		{"explicit rate", config(2, 5, 15, 4, 45000, 24, 1, 4, 0, 3), 1, 45000, nil},
+		{"HE-AAC", config(5, 5, 6, 4, 2, 4, 3, 4, 2, 5, 0, 3), 2, 24000, nil},
+		// a program config of a front pair and a centre channel
+		{"program", config(2, 5, 4, 4, 0, 4, 0, 3,
+			0, 4, 1, 2, 4, 4, 2, 4, 0, 4, 0, 4, 0, 2, 0, 3, 0, 4, 0, 1, 0, 1, 0, 1,
+			1, 1, 0, 4, 0, 1, 1, 4, 0, 8), 3, 44100, nil},
+		{"main profile", config(1, 5, 3, 4, 2, 4, 0, 3), 0, 0, ErrUnsupportedFormat},
+		{"960 frames", config(2, 5, 3, 4, 2, 4, 4, 3), 0, 0, ErrUnsupportedFormat},
+		{"no channels", config(2, 5, 3, 4, 8, 4, 0, 3), 0, 0, ErrUnsupportedFormat},
+		{"bad rate", config(2, 5, 13, 4, 2, 4, 0, 3), 0, 0, errAACConfig},
+		{"truncated", []byte{0x12}, 0, 0, errAACConfig},
+	} {
+		dec, err := newAACDecoder(test.config)
+		if err != test.err {
+			t.Fatalf("%s: error %v, expected %v", test.name, err, test.err)
+		}
+		if err == nil && (dec.channels != test.channels || dec.sampleRate != test.rate) {
+			t.Fatalf("%s: %d channels at %d", test.name, dec.channels, dec.sampleRate)
+		}
+	}
+}
+
+func TestAACFrameErrors(t *testing.T) {
+	r := rand.New(rand.NewSource(9))
+	good := writeAACFrame(randomAACPair(r, AAC_ONLY_LONG, AAC_WINDOW_SINE, 0, 1, -1, 3), 3)
+	element := func(id uint64, fields ...uint64) []byte {
+		w := &bitWriter{}
+		w.writeBits(id, 3)
+		for i := 0; i < len(fields); i += 2 {
+			w.writeBits(fields[i], int(fields[i+1]))
+		}
+		return w.data
+	}
+	for _, test := range []struct {
+		name  string
+		frame []byte
+		err   error
+	}{
+		{"truncated", good[:len(good)/2], errAACFrame},
+		{"coupling", element(AAC_ELEMENT_CCE), ErrUnsupportedFormat},
+		// a single channel where a pair is configured
+		{"missing channel", element(AAC_ELEMENT_SCE, 0, 4, 100, 8, 0, 1, 0, 2, 0, 1, 0, 6, 0, 1, AAC_ELEMENT_END, 3), errAACFrame},
+		{"prediction", element(AAC_ELEMENT_CPE, 0, 4, 1, 1, 0, 1, 0, 2, 0, 1, 0, 6, 1, 1), ErrUnsupportedFormat},
+		{"reserved M/S", element(AAC_ELEMENT_CPE, 0, 4, 1, 1, 0, 1, 0, 2, 0, 1, 0, 6, 0, 1, 3, 2), errAACFrame},
+		{"too many bands", element(AAC_ELEMENT_CPE, 0, 4, 1, 1, 0, 1, 0, 2, 0, 1, 63, 6, 0, 1), errAACFrame},
+	} {
+		dec, err := newAACDecoder([]byte{0x11, 0x90})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dec.decode(test.frame); err != test.err {
+			t.Fatalf("%s: error %v, expected %v", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,533 @@
+package audio
+
+// Tables from ISO/IEC 14496-3 used by the AAC-LC decoder.
+
+// aacHuffmanCode lists the codewords of one spectral Huffman codebook
+// (Tables 4.A.2 to 4.A.12). Entries are indexed by the values of a quad or
+// pair as digits of a number, first value most significant, offset by lav
+// for the signed books.
+type aacHuffmanCode struct {
+	dim      int
+	lav      int
+	unsigned bool
+	lens     []uint8
+	codes    []uint32
+}
+
+var aacHuffmanCodes = [12]*aacHuffmanCode{
+	1: {
+		dim:      4,
+		lav:      1,
+		unsigned: false,
+		lens: []uint8{
+			11, 9, 11, 10, 7, 10, 11, 9, 11,
+			10, 7, 10, 7, 5, 7, 9, 7, 10,
+			11, 9, 11, 9, 7, 9, 11, 9, 11,
+			9, 7, 9, 7, 5, 7, 9, 7, 9,
+			7, 5, 7, 5, 1, 5, 7, 5, 7,
+			9, 7, 9, 7, 5, 7, 9, 7, 9,
+			11, 9, 11, 9, 7, 9, 11, 9, 11,
+			10, 7, 9, 7, 5, 7, 9, 7, 10,
+			11, 9, 11, 10, 7, 9, 11, 9, 11,
+		},
+		codes: []uint32{
+			0x7f8, 0x1f1, 0x7fd, 0x3f5, 0x68, 0x3f0, 0x7f7, 0x1ec, 0x7f5,
+			0x3f1, 0x72, 0x3f4, 0x74, 0x11, 0x76, 0x1eb, 0x6c, 0x3f6,
+			0x7fc, 0x1e1, 0x7f1, 0x1f0, 0x61, 0x1f6, 0x7f2, 0x1ea, 0x7fb,
+			0x1f2, 0x69, 0x1ed, 0x77, 0x17, 0x6f, 0x1e6, 0x64, 0x1e5,
+			0x67, 0x15, 0x62, 0x12, 0x0, 0x14, 0x65, 0x16, 0x6d,
+			0x1e9, 0x63, 0x1e4, 0x6b, 0x13, 0x71, 0x1e3, 0x70, 0x1f3,
+			0x7fe, 0x1e7, 0x7f3, 0x1ef, 0x60, 0x1ee, 0x7f0, 0x1e2, 0x7fa,
+			0x3f3, 0x6a, 0x1e8, 0x75, 0x10, 0x73, 0x1f4, 0x6e, 0x3f7,
+			0x7f6, 0x1e0, 0x7f9, 0x3f2, 0x66, 0x1f5, 0x7ff, 0x1f7, 0x7f4,
+		},
+	},
+	2: {
+		dim:      4,
+		lav:      1,
+		unsigned: false,
+		lens: []uint8{
+			9, 7, 9, 8, 6, 8, 9, 8, 9,
+			8, 6, 7, 6, 5, 6, 7, 6, 8,
+			9, 7, 8, 8, 6, 8, 9, 7, 9,
+			8, 6, 7, 6, 5, 6, 7, 6, 8,
+			6, 5, 6, 5, 3, 5, 6, 5, 6,
+			8, 6, 7, 6, 5, 6, 8, 6, 8,
+			9, 7, 9, 8, 6, 8, 8, 7, 9,
+			8, 6, 7, 6, 4, 6, 8, 6, 7,
+			9, 7, 9, 7, 6, 8, 9, 7, 9,
+		},
+		codes: []uint32{
+			0x1f3, 0x6f, 0x1fd, 0xeb, 0x23, 0xea, 0x1f7, 0xe8, 0x1fa,
+			0xf2, 0x2d, 0x70, 0x20, 0x6, 0x2b, 0x6e, 0x28, 0xe9,
+			0x1f9, 0x66, 0xf8, 0xe7, 0x1b, 0xf1, 0x1f4, 0x6b, 0x1f5,
+			0xec, 0x2a, 0x6c, 0x2c, 0xa, 0x27, 0x67, 0x1a, 0xf5,
+			0x24, 0x8, 0x1f, 0x9, 0x0, 0x7, 0x1d, 0xb, 0x30,
+			0xef, 0x1c, 0x64, 0x1e, 0xc, 0x29, 0xf3, 0x2f, 0xf0,
+			0x1fc, 0x71, 0x1f2, 0xf4, 0x21, 0xe6, 0xf7, 0x68, 0x1f8,
+			0xee, 0x22, 0x65, 0x31, 0x2, 0x26, 0xed, 0x25, 0x6a,
+			0x1fb, 0x72, 0x1fe, 0x69, 0x2e, 0xf6, 0x1ff, 0x6d, 0x1f6,
+		},
+	},
+	3: {
+		dim:      4,
+		lav:      2,
+		unsigned: true,
+		lens: []uint8{
+			1, 4, 8, 4, 5, 8, 9, 9, 10,
+			4, 6, 9, 6, 6, 9, 9, 9, 10,
+			9, 10, 13, 9, 9, 11, 11, 10, 12,
+			4, 6, 10, 6, 7, 10, 10, 10, 12,
+			5, 7, 11, 6, 7, 10, 9, 9, 11,
+			9, 10, 13, 8, 9, 12, 10, 11, 12,
+			8, 10, 15, 9, 11, 15, 13, 14, 16,
+			8, 10, 14, 9, 10, 14, 12, 12, 15,
+			11, 12, 16, 10, 11, 15, 12, 12, 15,
+		},
+		codes: []uint32{
+			0x0, 0x9, 0xef, 0xb, 0x19, 0xf0, 0x1eb, 0x1e6, 0x3f2,
+			0xa, 0x35, 0x1ef, 0x34, 0x37, 0x1e9, 0x1ed, 0x1e7, 0x3f3,
+			0x1ee, 0x3ed, 0x1ffa, 0x1ec, 0x1f2, 0x7f9, 0x7f8, 0x3f8, 0xff8,
+			0x8, 0x38, 0x3f6, 0x36, 0x75, 0x3f1, 0x3eb, 0x3ec, 0xff4,
+			0x18, 0x76, 0x7f4, 0x39, 0x74, 0x3ef, 0x1f3, 0x1f4, 0x7f6,
+			0x1e8, 0x3ea, 0x1ffc, 0xf2, 0x1f1, 0xffb, 0x3f5, 0x7f3, 0xffc,
+			0xee, 0x3f7, 0x7ffe, 0x1f0, 0x7f5, 0x7ffd, 0x1ffb, 0x3ffa, 0xffff,
+			0xf1, 0x3f0, 0x3ffc, 0x1ea, 0x3ee, 0x3ffb, 0xff6, 0xffa, 0x7ffc,
+			0x7f2, 0xff5, 0xfffe, 0x3f4, 0x7f7, 0x7ffb, 0xff7, 0xff9, 0x7ffa,
+		},
+	},
+	4: {
+		dim:      4,
+		lav:      2,
+		unsigned: true,
+		lens: []uint8{
+			4, 5, 8, 5, 4, 8, 9, 8, 11,
+			5, 5, 8, 5, 4, 8, 8, 7, 10,
+			9, 8, 11, 8, 8, 10, 11, 10, 11,
+			4, 5, 8, 4, 4, 8, 8, 8, 10,
+			4, 4, 8, 4, 4, 7, 8, 7, 9,
+			8, 8, 10, 7, 7, 9, 10, 9, 10,
+			8, 8, 11, 8, 7, 10, 11, 10, 12,
+			8, 7, 10, 7, 7, 9, 10, 9, 11,
+			11, 10, 12, 10, 9, 11, 11, 10, 11,
+		},
+		codes: []uint32{
+			0x7, 0x16, 0xf6, 0x18, 0x8, 0xef, 0x1ef, 0xf3, 0x7f8,
+			0x19, 0x17, 0xed, 0x15, 0x1, 0xe2, 0xf0, 0x70, 0x3f0,
+			0x1ee, 0xf1, 0x7fa, 0xee, 0xe4, 0x3f2, 0x7f6, 0x3ef, 0x7fd,
+			0x5, 0x14, 0xf2, 0x9, 0x4, 0xe5, 0xf4, 0xe8, 0x3f4,
+			0x6, 0x2, 0xe7, 0x3, 0x0, 0x6b, 0xe3, 0x69, 0x1f3,
+			0xeb, 0xe6, 0x3f6, 0x6e, 0x6a, 0x1f4, 0x3ec, 0x1f0, 0x3f9,
+			0xf5, 0xec, 0x7fb, 0xea, 0x6f, 0x3f7, 0x7f9, 0x3f3, 0xfff,
+			0xe9, 0x6d, 0x3f8, 0x6c, 0x68, 0x1f5, 0x3ee, 0x1f2, 0x7f4,
+			0x7f7, 0x3f1, 0xffe, 0x3ed, 0x1f1, 0x7f5, 0x7fe, 0x3f5, 0x7fc,
+		},
+	},
+	5: {
+		dim:      2,
+		lav:      4,
+		unsigned: false,
+		lens: []uint8{
+			13, 12, 11, 11, 10, 11, 11, 12, 13,
+			12, 11, 10, 9, 8, 9, 10, 11, 12,
+			12, 10, 9, 8, 7, 8, 9, 10, 11,
+			11, 9, 8, 5, 4, 5, 8, 9, 11,
+			10, 8, 7, 4, 1, 4, 7, 8, 11,
+			11, 9, 8, 5, 4, 5, 8, 9, 11,
+			11, 10, 9, 8, 7, 8, 9, 10, 11,
+			12, 11, 10, 9, 8, 9, 10, 11, 12,
+			13, 12, 12, 11, 10, 10, 11, 12, 13,
+		},
+		codes: []uint32{
+			0x1fff, 0xff7, 0x7f4, 0x7e8, 0x3f1, 0x7ee, 0x7f9, 0xff8, 0x1ffd,
+			0xffd, 0x7f1, 0x3e8, 0x1e8, 0xf0, 0x1ec, 0x3ee, 0x7f2, 0xffa,
+			0xff4, 0x3ef, 0x1f2, 0xe8, 0x70, 0xec, 0x1f0, 0x3ea, 0x7f3,
+			0x7eb, 0x1eb, 0xea, 0x1a, 0x8, 0x19, 0xee, 0x1ef, 0x7ed,
+			0x3f0, 0xf2, 0x73, 0xb, 0x0, 0xa, 0x71, 0xf3, 0x7e9,
+			0x7ef, 0x1ee, 0xef, 0x18, 0x9, 0x1b, 0xeb, 0x1e9, 0x7ec,
+			0x7f6, 0x3eb, 0x1f3, 0xed, 0x72, 0xe9, 0x1f1, 0x3ed, 0x7f7,
+			0xff6, 0x7f0, 0x3e9, 0x1ed, 0xf1, 0x1ea, 0x3ec, 0x7f8, 0xff9,
+			0x1ffc, 0xffc, 0xff5, 0x7ea, 0x3f3, 0x3f2, 0x7f5, 0xffb, 0x1ffe,
+		},
+	},
+	6: {
+		dim:      2,
+		lav:      4,
+		unsigned: false,
+		lens: []uint8{
+			11, 10, 9, 9, 9, 9, 9, 10, 11,
+			10, 9, 8, 7, 7, 7, 8, 9, 10,
+			9, 8, 6, 6, 6, 6, 6, 8, 9,
+			9, 7, 6, 4, 4, 4, 6, 7, 9,
+			9, 7, 6, 4, 4, 4, 6, 7, 9,
+			9, 7, 6, 4, 4, 4, 6, 7, 9,
+			9, 8, 6, 6, 6, 6, 6, 8, 9,
+			10, 9, 8, 7, 7, 7, 7, 8, 10,
+			11, 10, 9, 9, 9, 9, 9, 10, 11,
+		},
+		codes: []uint32{
+			0x7fe, 0x3fd, 0x1f1, 0x1eb, 0x1f4, 0x1ea, 0x1f0, 0x3fc, 0x7fd,
+			0x3f6, 0x1e5, 0xea, 0x6c, 0x71, 0x68, 0xf0, 0x1e6, 0x3f7,
+			0x1f3, 0xef, 0x32, 0x27, 0x28, 0x26, 0x31, 0xeb, 0x1f7,
+			0x1e8, 0x6f, 0x2e, 0x8, 0x4, 0x6, 0x29, 0x6b, 0x1ee,
+			0x1ef, 0x72, 0x2d, 0x2, 0x0, 0x3, 0x2f, 0x73, 0x1fa,
+			0x1e7, 0x6e, 0x2b, 0x7, 0x1, 0x5, 0x2c, 0x6d, 0x1ec,
+			0x1f9, 0xee, 0x30, 0x24, 0x2a, 0x25, 0x33, 0xec, 0x1f2,
+			0x3f8, 0x1e4, 0xed, 0x6a, 0x70, 0x69, 0x74, 0xf1, 0x3fa,
+			0x7ff, 0x3f9, 0x1f6, 0x1ed, 0x1f8, 0x1e9, 0x1f5, 0x3fb, 0x7fc,
+		},
+	},
+	7: {
+		dim:      2,
+		lav:      7,
+		unsigned: true,
+		lens: []uint8{
+			1, 3, 6, 7, 8, 9, 10, 11,
+			3, 4, 6, 7, 8, 8, 9, 9,
+			6, 6, 7, 8, 8, 9, 9, 10,
+			7, 7, 8, 8, 9, 9, 10, 10,
+			8, 8, 9, 9, 10, 10, 10, 11,
+			9, 8, 9, 9, 10, 10, 11, 11,
+			10, 9, 9, 10, 10, 11, 12, 12,
+			11, 10, 10, 10, 11, 11, 12, 12,
+		},
+		codes: []uint32{
+			0x0, 0x5, 0x37, 0x74, 0xf2, 0x1eb, 0x3ed, 0x7f7,
+			0x4, 0xc, 0x35, 0x71, 0xec, 0xee, 0x1ee, 0x1f5,
+			0x36, 0x34, 0x72, 0xea, 0xf1, 0x1e9, 0x1f3, 0x3f5,
+			0x73, 0x70, 0xeb, 0xf0, 0x1f1, 0x1f0, 0x3ec, 0x3fa,
+			0xf3, 0xed, 0x1e8, 0x1ef, 0x3ef, 0x3f1, 0x3f9, 0x7fb,
+			0x1ed, 0xef, 0x1ea, 0x1f2, 0x3f3, 0x3f8, 0x7f9, 0x7fc,
+			0x3ee, 0x1ec, 0x1f4, 0x3f4, 0x3f7, 0x7f8, 0xffd, 0xffe,
+			0x7f6, 0x3f0, 0x3f2, 0x3f6, 0x7fa, 0x7fd, 0xffc, 0xfff,
+		},
+	},
+	8: {
+		dim:      2,
+		lav:      7,
+		unsigned: true,
+		lens: []uint8{
+			5, 4, 5, 6, 7, 8, 9, 10,
+			4, 3, 4, 5, 6, 7, 7, 8,
+			5, 4, 4, 5, 6, 7, 7, 8,
+			6, 5, 5, 6, 6, 7, 8, 8,
+			7, 6, 6, 6, 7, 7, 8, 9,
+			8, 7, 6, 7, 7, 8, 8, 10,
+			9, 7, 7, 8, 8, 8, 9, 9,
+			10, 8, 8, 8, 9, 9, 9, 10,
+		},
+		codes: []uint32{
+			0xe, 0x5, 0x10, 0x30, 0x6f, 0xf1, 0x1fa, 0x3fe,
+			0x3, 0x0, 0x4, 0x12, 0x2c, 0x6a, 0x75, 0xf8,
+			0xf, 0x2, 0x6, 0x14, 0x2e, 0x69, 0x72, 0xf5,
+			0x2f, 0x11, 0x13, 0x2a, 0x32, 0x6c, 0xec, 0xfa,
+			0x71, 0x2b, 0x2d, 0x31, 0x6d, 0x70, 0xf2, 0x1f9,
+			0xef, 0x68, 0x33, 0x6b, 0x6e, 0xee, 0xf9, 0x3fc,
+			0x1f8, 0x74, 0x73, 0xed, 0xf0, 0xf6, 0x1f6, 0x1fd,
+			0x3fd, 0xf3, 0xf4, 0xf7, 0x1f7, 0x1fb, 0x1fc, 0x3ff,
+		},
+	},
+	9: {
+		dim:      2,
+		lav:      12,
+		unsigned: true,
+		lens: []uint8{
+			1, 3, 6, 8, 9, 10, 10, 11, 11,
+			12, 12, 13, 13, 3, 4, 6, 7, 8,
+			8, 9, 10, 10, 10, 11, 12, 12, 6,
+			6, 7, 8, 8, 9, 10, 10, 10, 11,
+			12, 12, 12, 8, 7, 8, 9, 9, 10,
+			10, 11, 11, 11, 12, 12, 13, 9, 8,
+			9, 9, 10, 10, 11, 11, 11, 12, 12,
+			12, 13, 10, 9, 9, 10, 11, 11, 11,
+			12, 11, 12, 12, 13, 13, 11, 9, 10,
+			11, 11, 11, 12, 12, 12, 12, 13, 13,
+			13, 11, 10, 10, 11, 11, 12, 12, 13,
+			13, 13, 13, 13, 13, 11, 10, 10, 11,
+			11, 11, 12, 12, 13, 13, 14, 13, 14,
+			11, 10, 11, 11, 12, 12, 12, 12, 13,
+			13, 14, 14, 14, 12, 11, 11, 12, 12,
+			12, 13, 13, 13, 14, 14, 14, 15, 12,
+			11, 12, 12, 12, 13, 13, 13, 13, 14,
+			14, 15, 15, 13, 12, 12, 12, 13, 13,
+			13, 13, 14, 14, 14, 14, 15,
+		},
+		codes: []uint32{
+			0x0, 0x5, 0x37, 0xe7, 0x1de, 0x3ce, 0x3d9, 0x7c8, 0x7cd,
+			0xfc8, 0xfdd, 0x1fe4, 0x1fec, 0x4, 0xc, 0x35, 0x72, 0xea,
+			0xed, 0x1e2, 0x3d1, 0x3d3, 0x3e0, 0x7d8, 0xfcf, 0xfd5, 0x36,
+			0x34, 0x71, 0xe8, 0xec, 0x1e1, 0x3cf, 0x3dd, 0x3db, 0x7d0,
+			0xfc7, 0xfd4, 0xfe4, 0xe6, 0x70, 0xe9, 0x1dd, 0x1e3, 0x3d2,
+			0x3dc, 0x7cc, 0x7ca, 0x7de, 0xfd8, 0xfea, 0x1fdb, 0x1df, 0xeb,
+			0x1dc, 0x1e6, 0x3d5, 0x3de, 0x7cb, 0x7dd, 0x7dc, 0xfcd, 0xfe2,
+			0xfe7, 0x1fe1, 0x3d0, 0x1e0, 0x1e4, 0x3d6, 0x7c5, 0x7d1, 0x7db,
+			0xfd2, 0x7e0, 0xfd9, 0xfeb, 0x1fe3, 0x1fe9, 0x7c4, 0x1e5, 0x3d7,
+			0x7c6, 0x7cf, 0x7da, 0xfcb, 0xfda, 0xfe3, 0xfe9, 0x1fe6, 0x1ff3,
+			0x1ff7, 0x7d3, 0x3d8, 0x3e1, 0x7d4, 0x7d9, 0xfd3, 0xfde, 0x1fdd,
+			0x1fd9, 0x1fe2, 0x1fea, 0x1ff1, 0x1ff6, 0x7d2, 0x3d4, 0x3da, 0x7c7,
+			0x7d7, 0x7e2, 0xfce, 0xfdb, 0x1fd8, 0x1fee, 0x3ff0, 0x1ff4, 0x3ff2,
+			0x7e1, 0x3df, 0x7c9, 0x7d6, 0xfca, 0xfd0, 0xfe5, 0xfe6, 0x1feb,
+			0x1fef, 0x3ff3, 0x3ff4, 0x3ff5, 0xfe0, 0x7ce, 0x7d5, 0xfc6, 0xfd1,
+			0xfe1, 0x1fe0, 0x1fe8, 0x1ff0, 0x3ff1, 0x3ff8, 0x3ff6, 0x7ffc, 0xfe8,
+			0x7df, 0xfc9, 0xfd7, 0xfdc, 0x1fdc, 0x1fdf, 0x1fed, 0x1ff5, 0x3ff9,
+			0x3ffb, 0x7ffd, 0x7ffe, 0x1fe7, 0xfcc, 0xfd6, 0xfdf, 0x1fde, 0x1fda,
+			0x1fe5, 0x1ff2, 0x3ffa, 0x3ff7, 0x3ffc, 0x3ffd, 0x7fff,
+		},
+	},
+	10: {
+		dim:      2,
+		lav:      12,
+		unsigned: true,
+		lens: []uint8{
+			6, 5, 6, 6, 7, 8, 9, 10, 10,
+			10, 11, 11, 12, 5, 4, 4, 5, 6,
+			7, 7, 8, 8, 9, 10, 10, 11, 6,
+			4, 5, 5, 6, 6, 7, 8, 8, 9,
+			9, 10, 10, 6, 5, 5, 5, 6, 7,
+			7, 8, 8, 9, 9, 10, 10, 7, 6,
+			6, 6, 6, 7, 7, 8, 8, 9, 9,
+			10, 10, 8, 7, 6, 7, 7, 7, 8,
+			8, 8, 9, 10, 10, 11, 9, 7, 7,
+			7, 7, 8, 8, 9, 9, 9, 10, 10,
+			11, 9, 8, 8, 8, 8, 8, 9, 9,
+			9, 10, 10, 11, 11, 9, 8, 8, 8,
+			8, 8, 9, 9, 10, 10, 10, 11, 11,
+			10, 9, 9, 9, 9, 9, 9, 10, 10,
+			10, 11, 11, 12, 10, 9, 9, 9, 9,
+			10, 10, 10, 10, 11, 11, 11, 12, 11,
+			10, 9, 10, 10, 10, 10, 10, 11, 11,
+			11, 11, 12, 11, 10, 10, 10, 10, 10,
+			10, 11, 11, 12, 12, 12, 12,
+		},
+		codes: []uint32{
+			0x22, 0x8, 0x1d, 0x26, 0x5f, 0xd3, 0x1cf, 0x3d0, 0x3d7,
+			0x3ed, 0x7f0, 0x7f6, 0xffd, 0x7, 0x0, 0x1, 0x9, 0x20,
+			0x54, 0x60, 0xd5, 0xdc, 0x1d4, 0x3cd, 0x3de, 0x7e7, 0x1c,
+			0x2, 0x6, 0xc, 0x1e, 0x28, 0x5b, 0xcd, 0xd9, 0x1ce,
+			0x1dc, 0x3d9, 0x3f1, 0x25, 0xb, 0xa, 0xd, 0x24, 0x57,
+			0x61, 0xcc, 0xdd, 0x1cc, 0x1de, 0x3d3, 0x3e7, 0x5d, 0x21,
+			0x1f, 0x23, 0x27, 0x59, 0x64, 0xd8, 0xdf, 0x1d2, 0x1e2,
+			0x3dd, 0x3ee, 0xd1, 0x55, 0x29, 0x56, 0x58, 0x62, 0xce,
+			0xe0, 0xe2, 0x1da, 0x3d4, 0x3e3, 0x7eb, 0x1c9, 0x5e, 0x5a,
+			0x5c, 0x63, 0xca, 0xda, 0x1c7, 0x1ca, 0x1e0, 0x3db, 0x3e8,
+			0x7ec, 0x1e3, 0xd2, 0xcb, 0xd0, 0xd7, 0xdb, 0x1c6, 0x1d5,
+			0x1d8, 0x3ca, 0x3da, 0x7ea, 0x7f1, 0x1e1, 0xd4, 0xcf, 0xd6,
+			0xde, 0xe1, 0x1d0, 0x1d6, 0x3d1, 0x3d5, 0x3f2, 0x7ee, 0x7fb,
+			0x3e9, 0x1cd, 0x1c8, 0x1cb, 0x1d1, 0x1d7, 0x1df, 0x3cf, 0x3e0,
+			0x3ef, 0x7e6, 0x7f8, 0xffa, 0x3eb, 0x1dd, 0x1d3, 0x1d9, 0x1db,
+			0x3d2, 0x3cc, 0x3dc, 0x3ea, 0x7ed, 0x7f3, 0x7f9, 0xff9, 0x7f2,
+			0x3ce, 0x1e4, 0x3cb, 0x3d8, 0x3d6, 0x3e2, 0x3e5, 0x7e8, 0x7f4,
+			0x7f5, 0x7f7, 0xffb, 0x7fa, 0x3ec, 0x3df, 0x3e1, 0x3e4, 0x3e6,
+			0x3f0, 0x7e9, 0x7ef, 0xff8, 0xffe, 0xffc, 0xfff,
+		},
+	},
+	11: {
+		dim:      2,
+		lav:      16,
+		unsigned: true,
+		lens: []uint8{
+			4, 5, 6, 7, 8, 8, 9, 10, 10,
+			10, 11, 11, 12, 11, 12, 12, 10, 5,
+			4, 5, 6, 7, 7, 8, 8, 9, 9,
+			9, 10, 10, 10, 10, 11, 8, 6, 5,
+			5, 6, 7, 7, 8, 8, 8, 9, 9,
+			9, 10, 10, 10, 10, 8, 7, 6, 6,
+			6, 7, 7, 8, 8, 8, 9, 9, 9,
+			10, 10, 10, 10, 8, 8, 7, 7, 7,
+			7, 8, 8, 8, 8, 9, 9, 9, 10,
+			10, 10, 10, 8, 8, 7, 7, 7, 7,
+			8, 8, 8, 9, 9, 9, 9, 10, 10,
+			10, 10, 8, 9, 8, 8, 8, 8, 8,
+			8, 8, 9, 9, 9, 10, 10, 10, 10,
+			10, 8, 9, 8, 8, 8, 8, 8, 8,
+			9, 9, 9, 10, 10, 10, 10, 10, 10,
+			8, 10, 9, 8, 8, 9, 9, 9, 9,
+			9, 10, 10, 10, 10, 10, 10, 11, 8,
+			10, 9, 9, 9, 9, 9, 9, 9, 10,
+			10, 10, 10, 10, 10, 11, 11, 8, 11,
+			9, 9, 9, 9, 9, 9, 10, 10, 10,
+			10, 10, 11, 10, 11, 11, 8, 11, 10,
+			9, 9, 10, 9, 10, 10, 10, 10, 10,
+			11, 11, 11, 11, 11, 8, 11, 10, 10,
+			10, 10, 10, 10, 10, 10, 10, 10, 11,
+			11, 11, 11, 11, 9, 11, 10, 9, 9,
+			10, 10, 10, 10, 10, 10, 11, 11, 11,
+			11, 11, 11, 9, 11, 10, 10, 10, 10,
+			10, 10, 10, 10, 10, 11, 11, 11, 11,
+			11, 11, 9, 12, 10, 10, 10, 10, 10,
+			10, 10, 11, 11, 11, 11, 11, 11, 12,
+			12, 9, 9, 8, 8, 8, 8, 8, 8,
+			8, 8, 8, 8, 8, 8, 8, 8, 9,
+			5,
+		},
+		codes: []uint32{
+			0x0, 0x6, 0x19, 0x3d, 0x9c, 0xc6, 0x1a7, 0x390, 0x3c2,
+			0x3df, 0x7e6, 0x7f3, 0xffb, 0x7ec, 0xffa, 0xffe, 0x38e, 0x5,
+			0x1, 0x8, 0x14, 0x37, 0x42, 0x92, 0xaf, 0x191, 0x1a5,
+			0x1b5, 0x39e, 0x3c0, 0x3a2, 0x3cd, 0x7d6, 0xae, 0x17, 0x7,
+			0x9, 0x18, 0x39, 0x40, 0x8e, 0xa3, 0xb8, 0x199, 0x1ac,
+			0x1c1, 0x3b1, 0x396, 0x3be, 0x3ca, 0x9d, 0x3c, 0x15, 0x16,
+			0x1a, 0x3b, 0x44, 0x91, 0xa5, 0xbe, 0x196, 0x1ae, 0x1b9,
+			0x3a1, 0x391, 0x3a5, 0x3d5, 0x94, 0x9a, 0x36, 0x38, 0x3a,
+			0x41, 0x8c, 0x9b, 0xb0, 0xc3, 0x19e, 0x1ab, 0x1bc, 0x39f,
+			0x38f, 0x3a9, 0x3cf, 0x93, 0xbf, 0x3e, 0x3f, 0x43, 0x45,
+			0x9e, 0xa7, 0xb9, 0x194, 0x1a2, 0x1ba, 0x1c3, 0x3a6, 0x3a7,
+			0x3bb, 0x3d4, 0x9f, 0x1a0, 0x8f, 0x8d, 0x90, 0x98, 0xa6,
+			0xb6, 0xc4, 0x19f, 0x1af, 0x1bf, 0x399, 0x3bf, 0x3b4, 0x3c9,
+			0x3e7, 0xa8, 0x1b6, 0xab, 0xa4, 0xaa, 0xb2, 0xc2, 0xc5,
+			0x198, 0x1a4, 0x1b8, 0x38c, 0x3a4, 0x3c4, 0x3c6, 0x3dd, 0x3e8,
+			0xad, 0x3af, 0x192, 0xbd, 0xbc, 0x18e, 0x197, 0x19a, 0x1a3,
+			0x1b1, 0x38d, 0x398, 0x3b7, 0x3d3, 0x3d1, 0x3db, 0x7dd, 0xb4,
+			0x3de, 0x1a9, 0x19b, 0x19c, 0x1a1, 0x1aa, 0x1ad, 0x1b3, 0x38b,
+			0x3b2, 0x3b8, 0x3ce, 0x3e1, 0x3e0, 0x7d2, 0x7e5, 0xb7, 0x7e3,
+			0x1bb, 0x1a8, 0x1a6, 0x1b0, 0x1b2, 0x1b7, 0x39b, 0x39a, 0x3ba,
+			0x3b5, 0x3d6, 0x7d7, 0x3e4, 0x7d8, 0x7ea, 0xba, 0x7e8, 0x3a0,
+			0x1bd, 0x1b4, 0x38a, 0x1c4, 0x392, 0x3aa, 0x3b0, 0x3bc, 0x3d7,
+			0x7d4, 0x7dc, 0x7db, 0x7d5, 0x7f0, 0xc1, 0x7fb, 0x3c8, 0x3a3,
+			0x395, 0x39d, 0x3ac, 0x3ae, 0x3c5, 0x3d8, 0x3e2, 0x3e6, 0x7e4,
+			0x7e7, 0x7e0, 0x7e9, 0x7f7, 0x190, 0x7f2, 0x393, 0x1be, 0x1c0,
+			0x394, 0x397, 0x3ad, 0x3c3, 0x3c1, 0x3d2, 0x7da, 0x7d9, 0x7df,
+			0x7eb, 0x7f4, 0x7fa, 0x195, 0x7f8, 0x3bd, 0x39c, 0x3ab, 0x3a8,
+			0x3b3, 0x3b9, 0x3d0, 0x3e3, 0x3e5, 0x7e2, 0x7de, 0x7ed, 0x7f1,
+			0x7f9, 0x7fc, 0x193, 0xffd, 0x3dc, 0x3b6, 0x3c7, 0x3cc, 0x3cb,
+			0x3d9, 0x3da, 0x7d3, 0x7e1, 0x7ee, 0x7ef, 0x7f5, 0x7f6, 0xffc,
+			0xfff, 0x19d, 0x1c2, 0xb5, 0xa1, 0x96, 0x97, 0x95, 0x99,
+			0xa0, 0xa2, 0xac, 0xa9, 0xb1, 0xb3, 0xbb, 0xc0, 0x18f,
+			0x4,
+		},
+	},
+}
+
+// aacScalefactorCode codes the differences between scalefactors, offset by
+// 60 (Table 4.A.1)
+var aacScalefactorCode = struct {
+	lens  []uint8
+	codes []uint32
+}{
+	lens: []uint8{
+		18, 18, 18, 18, 19, 19, 19, 19, 19, 19, 19,
+		19, 19, 19, 19, 19, 19, 19, 19, 18, 19, 18,
+		17, 17, 16, 17, 16, 16, 16, 16, 15, 15, 14,
+		14, 14, 14, 14, 14, 13, 13, 12, 12, 12, 11,
+		12, 11, 10, 10, 10, 9, 9, 8, 8, 8, 7,
+		6, 6, 5, 4, 3, 1, 4, 4, 5, 6, 6,
+		7, 7, 8, 8, 9, 9, 10, 10, 10, 11, 11,
+		11, 11, 12, 12, 13, 13, 13, 14, 14, 16, 15,
+		16, 15, 18, 19, 19, 19, 19, 19, 19, 19, 19,
+		19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19,
+		19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19,
+	},
+	codes: []uint32{
+		0x3ffe8, 0x3ffe6, 0x3ffe7, 0x3ffe5, 0x7fff5, 0x7fff1, 0x7ffed, 0x7fff6, 0x7ffee, 0x7ffef, 0x7fff0,
+		0x7fffc, 0x7fffd, 0x7ffff, 0x7fffe, 0x7fff7, 0x7fff8, 0x7fffb, 0x7fff9, 0x3ffe4, 0x7fffa, 0x3ffe3,
+		0x1ffef, 0x1fff0, 0xfff5, 0x1ffee, 0xfff2, 0xfff3, 0xfff4, 0xfff1, 0x7ff6, 0x7ff7, 0x3ff9,
+		0x3ff5, 0x3ff7, 0x3ff3, 0x3ff6, 0x3ff2, 0x1ff7, 0x1ff5, 0xff9, 0xff7, 0xff6, 0x7f9,
+		0xff4, 0x7f8, 0x3f9, 0x3f7, 0x3f5, 0x1f8, 0x1f7, 0xfa, 0xf8, 0xf6, 0x79,
+		0x3a, 0x38, 0x1a, 0xb, 0x4, 0x0, 0xa, 0xc, 0x1b, 0x39, 0x3b,
+		0x78, 0x7a, 0xf7, 0xf9, 0x1f6, 0x1f9, 0x3f4, 0x3f6, 0x3f8, 0x7f5, 0x7f4,
+		0x7f6, 0x7f7, 0xff5, 0xff8, 0x1ff4, 0x1ff6, 0x1ff8, 0x3ff8, 0x3ff4, 0xfff0, 0x7ff4,
+		0xfff6, 0x7ff5, 0x3ffe2, 0x7ffd9, 0x7ffda, 0x7ffdb, 0x7ffdc, 0x7ffdd, 0x7ffde, 0x7ffd8, 0x7ffd2,
+		0x7ffd3, 0x7ffd4, 0x7ffd5, 0x7ffd6, 0x7fff2, 0x7ffdf, 0x7ffe7, 0x7ffe8, 0x7ffe9, 0x7ffea, 0x7ffeb,
+		0x7ffe6, 0x7ffe0, 0x7ffe1, 0x7ffe2, 0x7ffe3, 0x7ffe4, 0x7ffe5, 0x7ffd7, 0x7ffec, 0x7fff4, 0x7fff3,
+	},
+}
+
+// aacSampleRates are the rates of the sampling frequency indices
+var aacSampleRates = [13]uint32{
+	96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+// aacRateThresholds pick the tables of the nearest index for rates outside
+// aacSampleRates
+var aacRateThresholds = [12]uint32{
+	92017, 75132, 55426, 46009, 37566, 27713, 23004, 18783, 13856, 11502, 9391, 0,
+}
+
+// scalefactor band offsets of long windows
+var (
+	aacLongBands96 = []uint16{
+		0, 4, 8, 12, 16, 20, 24, 28, 32, 36, 40, 44,
+		48, 52, 56, 64, 72, 80, 88, 96, 108, 120, 132, 144,
+		156, 172, 188, 212, 240, 276, 320, 384, 448, 512, 576, 640,
+		704, 768, 832, 896, 960, 1024,
+	}
+	aacLongBands64 = []uint16{
+		0, 4, 8, 12, 16, 20, 24, 28, 32, 36, 40, 44,
+		48, 52, 56, 64, 72, 80, 88, 100, 112, 124, 140, 156,
+		172, 192, 216, 240, 268, 304, 344, 384, 424, 464, 504, 544,
+		584, 624, 664, 704, 744, 784, 824, 864, 904, 944, 984, 1024,
+	}
+	aacLongBands48 = []uint16{
+		0, 4, 8, 12, 16, 20, 24, 28, 32, 36, 40, 48,
+		56, 64, 72, 80, 88, 96, 108, 120, 132, 144, 160, 176,
+		196, 216, 240, 264, 292, 320, 352, 384, 416, 448, 480, 512,
+		544, 576, 608, 640, 672, 704, 736, 768, 800, 832, 864, 896,
+		928, 1024,
+	}
+	aacLongBands32 = []uint16{
+		0, 4, 8, 12, 16, 20, 24, 28, 32, 36, 40, 48,
+		56, 64, 72, 80, 88, 96, 108, 120, 132, 144, 160, 176,
+		196, 216, 240, 264, 292, 320, 352, 384, 416, 448, 480, 512,
+		544, 576, 608, 640, 672, 704, 736, 768, 800, 832, 864, 896,
+		928, 960, 992, 1024,
+	}
+	aacLongBands24 = []uint16{
+		0, 4, 8, 12, 16, 20, 24, 28, 32, 36, 40, 44,
+		52, 60, 68, 76, 84, 92, 100, 108, 116, 124, 136, 148,
+		160, 172, 188, 204, 220, 240, 260, 284, 308, 336, 364, 396,
+		432, 468, 508, 552, 600, 652, 704, 768, 832, 896, 960, 1024,
+	}
+	aacLongBands16 = []uint16{
+		0, 8, 16, 24, 32, 40, 48, 56, 64, 72, 80, 88,
+		100, 112, 124, 136, 148, 160, 172, 184, 196, 212, 228, 244,
+		260, 280, 300, 320, 344, 368, 396, 424, 456, 492, 532, 572,
+		616, 664, 716, 772, 832, 896, 960, 1024,
+	}
+	aacLongBands8 = []uint16{
+		0, 12, 24, 36, 48, 60, 72, 84, 96, 108, 120, 132,
+		144, 156, 172, 188, 204, 220, 236, 252, 268, 288, 308, 328,
+		348, 372, 396, 420, 448, 476, 508, 544, 580, 620, 664, 712,
+		764, 820, 880, 944, 1024,
+	}
+)
+
+// scalefactor band offsets of short windows
+var (
+	aacShortBands96 = []uint16{
+		0, 4, 8, 12, 16, 20, 24, 32, 40, 48, 64, 92,
+		128,
+	}
+	aacShortBands48 = []uint16{
+		0, 4, 8, 12, 16, 20, 28, 36, 44, 56, 68, 80,
+		96, 112, 128,
+	}
+	aacShortBands24 = []uint16{
+		0, 4, 8, 12, 16, 20, 24, 28, 36, 44, 52, 64,
+		76, 92, 108, 128,
+	}
+	aacShortBands16 = []uint16{
+		0, 4, 8, 12, 16, 20, 24, 28, 32, 40, 48, 60,
+		72, 88, 108, 128,
+	}
+	aacShortBands8 = []uint16{
+		0, 4, 8, 12, 16, 20, 24, 28, 36, 44, 52, 60,
+		72, 88, 108, 128,
+	}
+)
+
+// band offsets by sampling frequency index
+var aacLongBands = [13][]uint16{
+	aacLongBands96, aacLongBands96, aacLongBands64, aacLongBands48, aacLongBands48, aacLongBands32, aacLongBands24,
+	aacLongBands24, aacLongBands16, aacLongBands16, aacLongBands16, aacLongBands8, aacLongBands8,
+}
+
+var aacShortBands = [13][]uint16{
+	aacShortBands96, aacShortBands96, aacShortBands96, aacShortBands48, aacShortBands48, aacShortBands48, aacShortBands24,
+	aacShortBands24, aacShortBands16, aacShortBands16, aacShortBands16, aacShortBands8, aacShortBands8,
+}
+
+// highest bands TNS filters reach in the LC profile
+var (
+	aacTNSMaxBandsLong  = [13]int{31, 31, 34, 40, 42, 51, 46, 46, 42, 42, 42, 39, 39}
+	aacTNSMaxBandsShort = [13]int{9, 9, 10, 14, 14, 14, 14, 14, 14, 14, 14, 14, 14}
+)
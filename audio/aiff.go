@@ -0,0 +1,292 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+)
+
+var (
+	ErrNotAiff = errors.New("not an AIFF/AIFF-C file")
+)
+
+func init() {
+	provider := &AudioSourceProvider{createAiffAudioSourceFromFile, getAiffFileMetadata}
+	RegisterAudioSourceProvider(".aif", provider)
+	RegisterAudioSourceProvider(".aiff", provider)
+	RegisterAudioSourceProvider(".aifc", provider)
+}
+
+type aiffDecoder struct {
+	file *os.File
+
+	// format of the samples once converted to little-endian
+	format     PCMWaveFormat
+	blockAlign int
+	bigEndian  bool
+
+	dataStart  int64
+	dataFrames int64
+	frame      int64
+
+	meta Metadata
+	buf  []byte
+}
+
+func openAiff(path string) (*aiffDecoder, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := &aiffDecoder{file: file}
+	err = dec.readHeader(path)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return dec, nil
+}
+
+func (dec *aiffDecoder) readHeader(path string) error {
+	info, err := dec.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(dec.file, header); err != nil {
+		return ErrNotAiff
+	}
+	form := string(header[8:])
+	if string(header[:4]) != "FORM" || (form != "AIFF" && form != "AIFC") {
+		return ErrNotAiff
+	}
+
+	chunks, err := readChunks(dec.file, 12, info.Size(), binary.BigEndian)
+	if err != nil {
+		return err
+	}
+
+	dec.meta = *NewMetadata()
+	dec.meta.Filepath = path
+
+	var data *riffChunk
+	frames := int64(-1)
+	for i, chunk := range chunks {
+		switch chunk.id {
+		case "COMM":
+			body, err := readChunkBody(dec.file, chunk)
+			if err != nil {
+				return err
+			}
+			frames, err = dec.parseCommon(body, form == "AIFC")
+			if err != nil {
+				return err
+			}
+		case "SSND":
+			data = &chunks[i]
+		case "NAME", "AUTH":
+			body, err := readChunkBody(dec.file, chunk)
+			if err != nil {
+				continue
+			}
+			value := trimTagString(body)
+			if value == "" {
+				continue
+			}
+			if chunk.id == "NAME" {
+				dec.meta.Title = value
+			} else {
+				dec.meta.Artist = value
+			}
+		case "ID3 ", "id3 ":
+			body, err := readChunkBody(dec.file, chunk)
+			if err != nil {
+				continue
+			}
+			tag, err := readID3v2(bytes.NewReader(body))
+			if err == nil && tag != nil {
+				tag.apply(&dec.meta)
+			}
+		}
+	}
+
+	if frames < 0 || data == nil || data.size < 8 {
+		return ErrNotAiff
+	}
+
+	// the sound data chunk starts with an offset to the first frame
+	header = make([]byte, 4)
+	if _, err := dec.file.Seek(data.offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(dec.file, header); err != nil {
+		return ErrNotAiff
+	}
+	offset := int64(binary.BigEndian.Uint32(header))
+
+	dec.dataStart = data.offset + 8 + offset
+	dec.dataFrames = min(frames, max(data.size-8-offset, 0)/int64(dec.blockAlign))
+	dec.meta.Duration = uint64(dec.dataFrames * SECOND / int64(dec.format.SampleRate))
+
+	dec.buf = make([]byte, DECODE_BLOCK_FRAMES*dec.blockAlign)
+	return dec.seek(0)
+}
+
+// parseCommon reads the format out of a COMM chunk, returning the number of
+// sample frames it declares
+func (dec *aiffDecoder) parseCommon(body []byte, compressed bool) (int64, error) {
+	if len(body) < 18 || (compressed && len(body) < 22) {
+		return 0, ErrNotAiff
+	}
+
+	channels := binary.BigEndian.Uint16(body[0:])
+	frames := int64(binary.BigEndian.Uint32(body[2:]))
+	bits := binary.BigEndian.Uint16(body[6:])
+	rate := parseExtended(body[8:18])
+
+	if channels == 0 || bits == 0 || rate < 1 || rate > math.MaxUint32 {
+		return 0, ErrNotAiff
+	}
+
+	dec.format = PCMWaveFormat{
+		NumChannels: channels,
+		SampleRate:  uint32(math.Round(rate)),
+		// samples are left-justified in whole bytes
+		SampleDepth: (bits + 7) / 8 * 8,
+		PCMType:     PCM_TYPE_INT,
+	}
+	dec.bigEndian = true
+
+	compression := "NONE"
+	if compressed {
+		compression = string(body[18:22])
+	}
+	switch compression {
+	case "NONE", "twos":
+	case "sowt":
+		dec.bigEndian = false
+	case "fl32", "FL32":
+		dec.format.PCMType = PCM_TYPE_FLOAT
+		dec.format.SampleDepth = 32
+	case "fl64", "FL64":
+		dec.format.PCMType = PCM_TYPE_FLOAT
+		dec.format.SampleDepth = 64
+	default:
+		return 0, ErrUnsupportedFormat
+	}
+
+	if !isSupportedFormat(&dec.format) {
+		return 0, ErrUnsupportedFormat
+	}
+
+	dec.blockAlign = int(channels) * int(dec.format.SampleDepth/8)
+	return frames, nil
+}
+
+// parseExtended reads an 80-bit IEEE 754 extended precision float
+func parseExtended(b []byte) float64 {
+	exponent := int(binary.BigEndian.Uint16(b)&0x7FFF) - 16383
+	mantissa := binary.BigEndian.Uint64(b[2:])
+
+	v := math.Ldexp(float64(mantissa), exponent-63)
+	if b[0]&0x80 != 0 {
+		v = -v
+	}
+	return v
+}
+
+func (dec *aiffDecoder) nativeFormat() *PCMWaveFormat {
+	format := dec.format
+	return &format
+}
+
+func (dec *aiffDecoder) decode() ([]float64, int64, error) {
+	frames := dec.dataFrames - dec.frame
+	if frames <= 0 {
+		return nil, 0, io.EOF
+	}
+	if frames > DECODE_BLOCK_FRAMES {
+		frames = DECODE_BLOCK_FRAMES
+	}
+
+	n, err := io.ReadFull(dec.file, dec.buf[:frames*int64(dec.blockAlign)])
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		// sound data chunk claims more than the file holds
+		frames = int64(n / dec.blockAlign)
+		dec.dataFrames = dec.frame + frames
+		if frames == 0 {
+			return nil, 0, io.EOF
+		}
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	raw := dec.buf[:frames*int64(dec.blockAlign)]
+	width := int(dec.format.SampleDepth / 8)
+	if dec.bigEndian {
+		for i := 0; i+width <= len(raw); i += width {
+			for a, b := i, i+width-1; a < b; a, b = a+1, b-1 {
+				raw[a], raw[b] = raw[b], raw[a]
+			}
+		}
+	}
+	if width == 1 {
+		// 8-bit AIFF is signed where WAVE is offset
+		for i := range raw {
+			raw[i] ^= 0x80
+		}
+	}
+
+	samples := make([]float64, frames*int64(dec.format.NumChannels))
+	decodeSamples(samples, raw, &dec.format)
+
+	start := dec.frame
+	dec.frame += frames
+	return samples, start, nil
+}
+
+func (dec *aiffDecoder) seek(frame int64) error {
+	frame = min(max(frame, 0), dec.dataFrames)
+
+	_, err := dec.file.Seek(dec.dataStart+frame*int64(dec.blockAlign), io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	dec.frame = frame
+	return nil
+}
+
+func (dec *aiffDecoder) metadata() Metadata {
+	return dec.meta
+}
+
+func (dec *aiffDecoder) close() error {
+	return dec.file.Close()
+}
+
+func createAiffAudioSourceFromFile(metadata *Metadata) (AudioSource, error) {
+	dec, err := openAiff(metadata.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDecodedSource(dec), nil
+}
+
+func getAiffFileMetadata(path string) (*Metadata, error) {
+	dec, err := openAiff(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.file.Close()
+
+	metadata := dec.metadata()
+	return &metadata, nil
+}
@@ -0,0 +1,128 @@
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// extended80 is rate as an 80-bit IEEE 754 extended precision float
+func extended80(rate float64) []byte {
+	b := make([]byte, 10)
+	fraction, exponent := math.Frexp(rate)
+	binary.BigEndian.PutUint16(b, uint16(exponent-1+16383))
+	binary.BigEndian.PutUint64(b[2:], uint64(fraction*(1<<64)))
+	return b
+}
+
+// iffChunk is a big-endian chunk, padded to an even length
+func iffChunk(id string, body []byte) []byte {
+	b := binary.BigEndian.AppendUint32([]byte(id), uint32(len(body)))
+	b = append(b, body...)
+	if len(body)&1 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// writeAiff writes a ramp as an AIFF file, or as AIFF-C if compression is
+// set, with encode laying out each sample
+func writeAiff(t *testing.T, path, compression string, ch, rate, bits, frames int, encode func([]byte, float64) []byte) {
+	t.Helper()
+	comm := binary.BigEndian.AppendUint16(nil, uint16(ch))
+	comm = binary.BigEndian.AppendUint32(comm, uint32(frames))
+	comm = binary.BigEndian.AppendUint16(comm, uint16(bits))
+	comm = append(comm, extended80(float64(rate))...)
+	form := "AIFF"
+	if compression != "" {
+		form = "AIFC"
+		comm = append(comm, compression...)
+		comm = append(comm, 0, 0) // empty compression name
+	}
+
+	// the sound data starts past an offset of four bytes
+	ssnd := binary.BigEndian.AppendUint32(nil, 4)
+	ssnd = append(ssnd, 0, 0, 0, 0, 9, 9, 9, 9)
+	for f := 0; f < frames; f++ {
+		for c := 0; c < ch; c++ {
+			ssnd = encode(ssnd, ramp(f, c))
+		}
+	}
+
+	id3 := []byte("ID3\x03\x00\x00\x00\x00\x00\x16TALB\x00\x00\x00\x0c\x00\x00\x00Sample Pack")
+	body := append([]byte(form), iffChunk("COMM", comm)...)
+	body = append(body, iffChunk("NAME", []byte("Kick"))...)
+	body = append(body, iffChunk("AUTH", []byte("Someone\x00"))...)
+	body = append(body, iffChunk("ID3 ", id3)...)
+	body = append(body, iffChunk("SSND", ssnd)...)
+	if err := os.WriteFile(path, iffChunk("FORM", body), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAiff(t *testing.T) {
+	dir := t.TempDir()
+	for _, test := range []struct {
+		name        string
+		compression string
+		ch, rate    int
+		bits, depth int
+		encode      func([]byte, float64) []byte
+	}{
+		{"8 bit", "", 1, 8000, 8, 8, func(b []byte, v float64) []byte {
+			return append(b, byte(int8(v*128)))
+		}},
+		// 12 bits are left-justified in two bytes
+		{"12 bit", "", 2, 22050, 12, 16, func(b []byte, v float64) []byte {
+			return binary.BigEndian.AppendUint16(b, uint16(int16(v*2048))<<4)
+		}},
+		{"16 bit", "NONE", 2, 44100, 16, 16, func(b []byte, v float64) []byte {
+			return binary.BigEndian.AppendUint16(b, uint16(int16(v*32768)))
+		}},
+		{"sowt", "sowt", 2, 44100, 16, 16, func(b []byte, v float64) []byte {
+			return binary.LittleEndian.AppendUint16(b, uint16(int16(v*32768)))
+		}},
+		{"24 bit", "twos", 3, 48000, 24, 24, func(b []byte, v float64) []byte {
+			x := uint32(int32(v * (1 << 23)))
+			return append(b, byte(x>>16), byte(x>>8), byte(x))
+		}},
+		{"fl32", "fl32", 2, 96000, 32, 32, func(b []byte, v float64) []byte {
+			return binary.BigEndian.AppendUint32(b, math.Float32bits(float32(v)))
+		}},
+		{"fl64", "fl64", 1, 44100, 64, 64, func(b []byte, v float64) []byte {
+			return binary.BigEndian.AppendUint64(b, math.Float64bits(v))
+		}},
+	} {
+		const frames = 9000
+		path := filepath.Join(dir, test.name+".aif")
+		writeAiff(t, path, test.compression, test.ch, test.rate, test.bits, frames, test.encode)
+
+		dec, err := openAiff(path)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		checkFormat(t, dec, test.ch, test.rate, frames)
+		if depth := dec.nativeFormat().SampleDepth; int(depth) != test.depth {
+			t.Fatalf("%s: depth %d, expected %d", test.name, depth, test.depth)
+		}
+		if m := dec.metadata(); m.Title != "Kick" || m.Artist != "Someone" || m.Album != "Sample Pack" {
+			t.Fatalf("%s: metadata %+v", test.name, m)
+		}
+
+		want := make([]float64, frames*test.ch)
+		for f := 0; f < frames; f++ {
+			for c := 0; c < test.ch; c++ {
+				want[f*test.ch+c] = ramp(f, c)
+			}
+		}
+		all := decodeAll(t, dec)
+		if len(all) != len(want) {
+			t.Fatalf("%s: %d samples, expected %d", test.name, len(all), len(want))
+		}
+		checkSamples(t, test.name, all, want, 0)
+		checkSeek(t, dec, all, 0, 0, 1, 4095, 4096, frames/2, frames-1)
+		dec.close()
+	}
+}
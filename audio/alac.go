@@ -0,0 +1,533 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+const (
+	ALAC_CONFIG_SIZE = 24
+
+	ALAC_ELEMENT_SCE = 0
+	ALAC_ELEMENT_CPE = 1
+	ALAC_ELEMENT_CCE = 2
+	ALAC_ELEMENT_LFE = 3
+	ALAC_ELEMENT_DSE = 4
+	ALAC_ELEMENT_PCE = 5
+	ALAC_ELEMENT_FIL = 6
+	ALAC_ELEMENT_END = 7
+
+	// parameters of the adaptive Golomb coder
+	ALAC_QB_SHIFT    = 9
+	ALAC_QB          = 1 << ALAC_QB_SHIFT
+	ALAC_MMUL_SHIFT  = 2
+	ALAC_MDEN_SHIFT  = ALAC_QB_SHIFT - ALAC_MMUL_SHIFT - 1
+	ALAC_MOFF        = 1 << (ALAC_MDEN_SHIFT - 2)
+	ALAC_BITOFF      = 24
+	ALAC_MAX_PREFIX  = 9
+	ALAC_RUN_BITS    = 16
+	ALAC_MEAN_CLAMP  = 0xFFFF
+	ALAC_MAX_COEFS   = 32
+	ALAC_MAX_CHANNEL = 8
+)
+
+var (
+	errALACConfig = errors.New("invalid ALAC configuration")
+	errALACFrame  = errors.New("malformed ALAC frame")
+)
+
+// alacConfig is the ALACSpecificConfig of a track
+type alacConfig struct {
+	frameLength int
+	bitDepth    int
+	pb          int
+	mb          int
+	kb          int
+	channels    int
+	sampleRate  uint32
+}
+
+type alacDecoder struct {
+	config alacConfig
+
+	predictor []int32
+	mixU      []int32
+	mixV      []int32
+	shift     []uint16
+
+	// decoded frame in ALAC channel order
+	pcm []int32
+}
+
+func newALACDecoder(cookie []byte) (*alacDecoder, error) {
+	if len(cookie) < ALAC_CONFIG_SIZE {
+		return nil, errALACConfig
+	}
+
+	c := alacConfig{
+		frameLength: int(binary.BigEndian.Uint32(cookie[0:])),
+		bitDepth:    int(cookie[5]),
+		pb:          int(cookie[6]),
+		mb:          int(cookie[7]),
+		kb:          int(cookie[8]),
+		channels:    int(cookie[9]),
+		sampleRate:  binary.BigEndian.Uint32(cookie[20:]),
+	}
+	switch c.bitDepth {
+	case 16, 20, 24, 32:
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+	if c.frameLength <= 0 || c.frameLength > 1<<16 || c.channels < 1 || c.channels > ALAC_MAX_CHANNEL || c.sampleRate == 0 || c.sampleRate > MAX_SAMPLE_RATE {
+		return nil, errALACConfig
+	}
+
+	return &alacDecoder{
+		config:    c,
+		predictor: make([]int32, c.frameLength),
+		mixU:      make([]int32, c.frameLength),
+		mixV:      make([]int32, c.frameLength),
+		shift:     make([]uint16, 2*c.frameLength),
+		pcm:       make([]int32, c.frameLength*c.channels),
+	}, nil
+}
+
+func (dec *alacDecoder) format() *PCMWaveFormat {
+	depth := dec.config.bitDepth
+	if depth == 20 {
+		depth = 24
+	}
+	return &PCMWaveFormat{
+		NumChannels: uint16(dec.config.channels),
+		SampleRate:  dec.config.sampleRate,
+		SampleDepth: uint16(depth),
+		PCMType:     PCM_TYPE_INT,
+	}
+}
+
+func (dec *alacDecoder) reset() {}
+
+// every ALAC frame stands alone
+func (dec *alacDecoder) preroll() int {
+	return 0
+}
+
+// alacBits reads a frame MSB first, at any bit position
+type alacBits struct {
+	data []byte
+	pos  int
+}
+
+// peek returns the 32 bits at pos, padded with zeros past the end
+func (r *alacBits) peek(pos int) uint32 {
+	var v uint64
+	idx := pos >> 3
+	for i := 0; i < 5; i++ {
+		v <<= 8
+		if idx+i < len(r.data) {
+			v |= uint64(r.data[idx+i])
+		}
+	}
+	return uint32(v >> (8 - pos&7))
+}
+
+func (r *alacBits) read(n int) uint32 {
+	if n == 0 {
+		return 0
+	}
+	v := r.peek(r.pos) >> (32 - n)
+	r.pos += n
+	return v
+}
+
+func (r *alacBits) overrun() bool {
+	return r.pos > len(r.data)*8
+}
+
+// golomb32 reads one residual with a Rice parameter of k and an escape of
+// maxBits raw bits
+func (r *alacBits) golomb32(m uint32, k int, maxBits int) uint32 {
+	stream := r.peek(r.pos)
+	prefix := bits.LeadingZeros32(^stream)
+
+	if prefix >= ALAC_MAX_PREFIX {
+		r.pos += ALAC_MAX_PREFIX
+		return r.read(maxBits)
+	}
+
+	r.pos += prefix + 1
+	if k == 1 {
+		return uint32(prefix)
+	}
+
+	v := stream << (prefix + 1) >> (32 - k)
+	result := uint32(prefix) * m
+	if v >= 2 {
+		result += v - 1
+		r.pos += k
+	} else {
+		r.pos += k - 1
+	}
+	return result
+}
+
+// golomb16 reads the length of a run of zeros
+func (r *alacBits) golomb16(m uint32, k int) uint32 {
+	stream := r.peek(r.pos)
+	prefix := bits.LeadingZeros32(^stream)
+
+	if prefix >= ALAC_MAX_PREFIX {
+		r.pos += ALAC_MAX_PREFIX
+		return r.read(ALAC_RUN_BITS)
+	}
+
+	r.pos += prefix + 1
+	v := stream << (prefix + 1) >> (32 - k)
+	if v < 2 {
+		r.pos += k - 1
+		return uint32(prefix) * m
+	}
+	r.pos += k
+	return uint32(prefix)*m + v - 1
+}
+
+// decompress reads numSamples residuals coded with the adaptive Golomb coder
+func (dec *alacDecoder) decompress(r *alacBits, out []int32, numSamples int, pb int, maxBits int) error {
+	c := &dec.config
+	mb := uint32(c.mb)
+	kbMask := uint32(1)<<c.kb - 1
+	zmode := uint32(0)
+
+	for i := 0; i < numSamples; {
+		if r.overrun() {
+			return errALACFrame
+		}
+
+		k := min(31-bits.LeadingZeros32(mb>>ALAC_QB_SHIFT+3), c.kb)
+		m := uint32(1)<<k - 1
+		n := r.golomb32(m, k, maxBits)
+
+		// the low bit holds the sign
+		folded := n + zmode
+		if folded&1 != 0 {
+			out[i] = -int32((folded + 1) >> 1)
+		} else {
+			out[i] = int32((folded + 1) >> 1)
+		}
+		i++
+
+		mb = uint32(pb)*(n+zmode) + mb - (uint32(pb)*mb)>>ALAC_QB_SHIFT
+		if n > ALAC_MEAN_CLAMP {
+			mb = ALAC_MEAN_CLAMP
+		}
+
+		// a small mean switches to coding runs of zeros
+		zmode = 0
+		if mb<<ALAC_MMUL_SHIFT < ALAC_QB && i < numSamples {
+			zmode = 1
+			k := bits.LeadingZeros32(mb) - ALAC_BITOFF + int((mb+ALAC_MOFF)>>ALAC_MDEN_SHIFT)
+			mz := (uint32(1)<<k - 1) & kbMask
+			run := int(r.golomb16(mz, k))
+			if i+run > numSamples {
+				return errALACFrame
+			}
+			for j := 0; j < run; j++ {
+				out[i] = 0
+				i++
+			}
+			if run >= 65535 {
+				zmode = 0
+			}
+			mb = 0
+		}
+	}
+	return nil
+}
+
+func signOf(v int32) int32 {
+	switch {
+	case v > 0:
+		return 1
+	case v < 0:
+		return -1
+	}
+	return 0
+}
+
+// unpredict runs the adaptive FIR predictor over residuals in, with the
+// special orders 0, a copy, and 31, a first order integrator
+func unpredict(in []int32, out []int32, num int, coefs []int16, order int, chanBits int, denShift int) {
+	shift := 32 - chanBits
+	wrap := func(v int32) int32 {
+		return v << shift >> shift
+	}
+
+	out[0] = in[0]
+	if order == 0 {
+		copy(out[1:num], in[1:num])
+		return
+	}
+	if order == 31 {
+		prev := out[0]
+		for j := 1; j < num; j++ {
+			prev = wrap(in[j] + prev)
+			out[j] = prev
+		}
+		return
+	}
+
+	for j := 1; j <= order && j < num; j++ {
+		out[j] = wrap(in[j] + out[j-1])
+	}
+
+	denHalf := int32(0)
+	if denShift > 0 {
+		denHalf = 1 << (denShift - 1)
+	}
+	for j := order + 1; j < num; j++ {
+		top := out[j-order-1]
+		sum := int32(0)
+		for k := 0; k < order; k++ {
+			sum += int32(coefs[k]) * (out[j-1-k] - top)
+		}
+
+		del := in[j]
+		del0 := del
+		sg := signOf(del)
+		del += top + (sum+denHalf)>>denShift
+		out[j] = wrap(del)
+
+		// adapt the coefficients towards the sign of the error
+		if sg > 0 {
+			for k := order - 1; k >= 0; k-- {
+				dd := top - out[j-1-k]
+				sgn := signOf(dd)
+				coefs[k] -= int16(sgn)
+				del0 -= int32(order-k) * ((sgn * dd) >> denShift)
+				if del0 <= 0 {
+					break
+				}
+			}
+		} else if sg < 0 {
+			for k := order - 1; k >= 0; k-- {
+				dd := top - out[j-1-k]
+				sgn := signOf(dd)
+				coefs[k] += int16(sgn)
+				del0 -= int32(order-k) * ((-sgn * dd) >> denShift)
+				if del0 >= 0 {
+					break
+				}
+			}
+		}
+	}
+}
+
+// alacChannelParams are the predictor settings of one channel of an element
+type alacChannelParams struct {
+	mode     int
+	denShift int
+	pbFactor int
+	coefs    [ALAC_MAX_COEFS]int16
+	order    int
+}
+
+func (p *alacChannelParams) read(r *alacBits) {
+	b := r.read(8)
+	p.mode, p.denShift = int(b>>4), int(b&0xF)
+	b = r.read(8)
+	p.pbFactor, p.order = int(b>>5), int(b&0x1F)
+	for i := 0; i < p.order; i++ {
+		p.coefs[i] = int16(r.read(16))
+	}
+}
+
+// decodeChannel decompresses and unpredicts one channel into out
+func (dec *alacDecoder) decodeChannel(r *alacBits, p *alacChannelParams, out []int32, numSamples int, chanBits int) error {
+	err := dec.decompress(r, dec.predictor, numSamples, dec.config.pb*p.pbFactor/4, chanBits)
+	if err != nil {
+		return err
+	}
+
+	if p.mode != 0 {
+		unpredict(dec.predictor, dec.predictor, numSamples, nil, 31, chanBits, 0)
+	}
+	unpredict(dec.predictor, out, numSamples, p.coefs[:], p.order, chanBits, p.denShift)
+	return nil
+}
+
+func (dec *alacDecoder) decode(frame []byte) ([]float64, error) {
+	c := &dec.config
+	r := &alacBits{data: frame}
+	channels := c.channels
+
+	numSamples := c.frameLength
+	channel := 0
+	for channel < channels {
+		if r.overrun() {
+			return nil, errALACFrame
+		}
+
+		tag := r.read(3)
+		switch tag {
+		case ALAC_ELEMENT_SCE, ALAC_ELEMENT_LFE, ALAC_ELEMENT_CPE:
+			pair := tag == ALAC_ELEMENT_CPE
+			count := 1
+			if pair {
+				count = 2
+			}
+			if channel+count > channels {
+				return nil, errALACFrame
+			}
+
+			r.read(4) // element instance tag
+			if r.read(12) != 0 {
+				return nil, errALACFrame
+			}
+			header := r.read(4)
+			partial := header>>3 != 0
+			bytesShifted := int(header>>1) & 0x3
+			escape := header&1 != 0
+			if bytesShifted == 3 {
+				return nil, errALACFrame
+			}
+
+			if partial {
+				numSamples = int(r.read(16)<<16 | r.read(16))
+				if numSamples > c.frameLength {
+					return nil, errALACFrame
+				}
+			}
+
+			chanBits := c.bitDepth - 8*bytesShifted + count - 1
+			if chanBits < 1 || (chanBits > 32 && !escape) {
+				return nil, errALACFrame
+			}
+			mixBits, mixRes := 0, int32(0)
+			if !escape {
+				mixBits = int(r.read(8))
+				mixRes = int32(int8(r.read(8)))
+
+				var params [2]alacChannelParams
+				for i := 0; i < count; i++ {
+					params[i].read(r)
+				}
+
+				// low bytes are stored raw after the compressed data
+				shiftPos := r.pos
+				r.pos += 8 * bytesShifted * count * numSamples
+
+				err := dec.decodeChannel(r, &params[0], dec.mixU, numSamples, chanBits)
+				if err != nil {
+					return nil, err
+				}
+				if pair {
+					err = dec.decodeChannel(r, &params[1], dec.mixV, numSamples, chanBits)
+					if err != nil {
+						return nil, err
+					}
+				}
+
+				if bytesShifted != 0 {
+					end := r.pos
+					r.pos = shiftPos
+					for i := 0; i < count*numSamples; i++ {
+						dec.shift[i] = uint16(r.read(8 * bytesShifted))
+					}
+					r.pos = end
+				}
+			} else {
+				// uncompressed samples, interleaved across the pair
+				chanBits = c.bitDepth
+				for i := 0; i < numSamples; i++ {
+					dec.mixU[i] = readALACRaw(r, chanBits)
+					if pair {
+						dec.mixV[i] = readALACRaw(r, chanBits)
+					}
+				}
+				bytesShifted = 0
+			}
+
+			dec.output(channel, pair, numSamples, mixBits, mixRes, bytesShifted)
+			channel += count
+
+		case ALAC_ELEMENT_DSE:
+			r.read(4) // element instance tag
+			aligned := r.read(1) != 0
+			count := int(r.read(8))
+			if count == 255 {
+				count += int(r.read(8))
+			}
+			if aligned {
+				r.pos = (r.pos + 7) &^ 7
+			}
+			r.pos += 8 * count
+
+		case ALAC_ELEMENT_FIL:
+			count := int(r.read(4))
+			if count == 15 {
+				count += int(r.read(8)) - 1
+			}
+			r.pos += 8 * count
+
+		case ALAC_ELEMENT_END:
+			channels = channel
+
+		default:
+			return nil, ErrUnsupportedFormat
+		}
+	}
+	if r.overrun() || channel == 0 {
+		return nil, errALACFrame
+	}
+
+	// scale to float and put the channels into WAVE order
+	out := make([]float64, numSamples*c.channels)
+	scale := 1 / float64(int64(1)<<(c.bitDepth-1))
+	order := mp4ChannelOrder[c.channels-1]
+	for i := 0; i < numSamples; i++ {
+		for ch, from := range order {
+			out[i*c.channels+ch] = float64(dec.pcm[i*c.channels+from]) * scale
+		}
+	}
+	return out, nil
+}
+
+// readALACRaw reads an uncompressed sample of n bits
+func readALACRaw(r *alacBits, n int) int32 {
+	if n <= 16 {
+		return int32(r.read(n)<<(32-n)) >> (32 - n)
+	}
+	high := int32(r.read(16)<<16) >> (32 - n)
+	return high | int32(r.read(n-16))
+}
+
+// output unmixes an element's channels and restores their shifted off low
+// bytes into the frame
+func (dec *alacDecoder) output(channel int, pair bool, numSamples int, mixBits int, mixRes int32, bytesShifted int) {
+	channels := dec.config.channels
+	shift := 8 * bytesShifted
+	for i := 0; i < numSamples; i++ {
+		if !pair {
+			v := dec.mixU[i]
+			if shift != 0 {
+				v = v<<shift | int32(dec.shift[i])
+			}
+			dec.pcm[i*channels+channel] = v
+			continue
+		}
+
+		u, v := dec.mixU[i], dec.mixV[i]
+		l, r := u, v
+		if mixRes != 0 {
+			l = u + v - (mixRes*v)>>mixBits
+			r = l - v
+		}
+		if shift != 0 {
+			l = l<<shift | int32(dec.shift[2*i])
+			r = r<<shift | int32(dec.shift[2*i+1])
+		}
+		dec.pcm[i*channels+channel] = l
+		dec.pcm[i*channels+channel+1] = r
+	}
+}
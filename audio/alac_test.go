@@ -0,0 +1,247 @@
+package audio
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// alacEncoder writes ALAC frames with fixed settings: every channel predicts
+// with the same coefficients, and pairs mix to (l+3r)/4 and l-r
+type alacEncoder struct {
+	frameLength int
+	bitDepth    int
+	channels    int
+	// low bytes stored raw, the prediction mode and the predictor order
+	shiftBytes int
+	mode       int
+	order      int
+}
+
+// alacElements is the elements each channel count is coded in, in ALAC's
+// channel order
+var alacElements = [8][]uint64{
+	{ALAC_ELEMENT_SCE},
+	{ALAC_ELEMENT_CPE},
+	{ALAC_ELEMENT_SCE, ALAC_ELEMENT_CPE},
+	{ALAC_ELEMENT_SCE, ALAC_ELEMENT_CPE, ALAC_ELEMENT_SCE},
+	{ALAC_ELEMENT_SCE, ALAC_ELEMENT_CPE, ALAC_ELEMENT_CPE},
+	{ALAC_ELEMENT_SCE, ALAC_ELEMENT_CPE, ALAC_ELEMENT_CPE, ALAC_ELEMENT_LFE},
+}
+
+const (
+	testALACPB       = 40
+	testALACMB       = 10
+	testALACKB       = 14
+	testALACDenShift = 9
+)
+
+func (e *alacEncoder) cookie(rate int) []byte {
+	c := make([]byte, ALAC_CONFIG_SIZE)
+	binary.BigEndian.PutUint32(c, uint32(e.frameLength))
+	c[5] = byte(e.bitDepth)
+	c[6], c[7], c[8] = testALACPB, testALACMB, testALACKB
+	c[9] = byte(e.channels)
+	binary.BigEndian.PutUint16(c[10:], 255)
+	binary.BigEndian.PutUint32(c[20:], uint32(rate))
+	return c
+}
+
+// frame codes channels, each a channel's samples in ALAC order, with every
+// element stored uncompressed if escape is set
+func (e *alacEncoder) frame(channels [][]int32, escape bool) []byte {
+	w := &bitWriter{}
+	// a fill element ahead of the audio is passed over
+	w.writeBits(ALAC_ELEMENT_FIL, 3)
+	w.writeBits(2, 4)
+	w.writeBits(0xFFFF, 16)
+
+	ch := 0
+	for _, tag := range alacElements[e.channels-1] {
+		count := 1
+		if tag == ALAC_ELEMENT_CPE {
+			count = 2
+		}
+		e.element(w, tag, channels[ch:ch+count], escape)
+		ch += count
+	}
+	w.writeBits(ALAC_ELEMENT_END, 3)
+	return w.data
+}
+
+func (e *alacEncoder) element(w *bitWriter, tag uint64, samples [][]int32, escape bool) {
+	n := len(samples[0])
+	partial := n != e.frameLength
+	shiftBytes := e.shiftBytes
+	if escape {
+		shiftBytes = 0
+	}
+
+	w.writeBits(tag, 3)
+	w.writeBits(0, 4+12)
+	w.writeBits(uint64(flagBit(partial)<<3|uint64(shiftBytes)<<1|flagBit(escape)), 4)
+	if partial {
+		w.writeBits(uint64(n), 32)
+	}
+	if escape {
+		for i := 0; i < n; i++ {
+			for _, s := range samples {
+				w.writeSigned(int64(s[i]), e.bitDepth)
+			}
+		}
+		return
+	}
+
+	// the low bytes are split off and the rest mixed
+	shift := 8 * shiftBytes
+	chanBits := e.bitDepth - shift + len(samples) - 1
+	high := make([][]int32, len(samples))
+	for c, s := range samples {
+		high[c] = make([]int32, n)
+		for i, v := range s {
+			high[c][i] = v >> shift
+		}
+	}
+	if len(samples) == 2 {
+		for i := range high[0] {
+			l, r := high[0][i], high[1][i]
+			high[0][i], high[1][i] = (l+3*r)>>2, l-r
+		}
+		w.writeBits(2, 8)
+		w.writeBits(1, 8)
+	} else {
+		w.writeBits(0, 8+8)
+	}
+
+	coefs := []int16{160, -190, 170, -130, 80, -60, 40, -20}[:e.order]
+	for range samples {
+		w.writeBits(uint64(e.mode<<4|testALACDenShift), 8)
+		w.writeBits(uint64(4<<5|e.order), 8)
+		for _, c := range coefs {
+			w.writeBits(uint64(uint16(c)), 16)
+		}
+	}
+	for i := 0; i < n; i++ {
+		for _, s := range samples {
+			w.writeBits(uint64(s[i])&(1<<shift-1), shift)
+		}
+	}
+	for _, h := range high {
+		residuals := alacPredict(h, coefs, chanBits)
+		if e.mode != 0 {
+			residuals = alacPredict(residuals, nil, chanBits)
+		}
+		alacCompress(w, residuals, testALACPB, chanBits)
+	}
+}
+
+// alacPredict is the inverse of unpredict, taking a first difference when
+// coefs is nil
+func alacPredict(in []int32, coefs []int16, chanBits int) []int32 {
+	shift := 32 - chanBits
+	wrap := func(v int32) int32 {
+		return v << shift >> shift
+	}
+	order := len(coefs)
+	if coefs == nil {
+		order = len(in)
+	}
+	coefs = append([]int16(nil), coefs...)
+
+	res := make([]int32, len(in))
+	res[0] = in[0]
+	for j := 1; j <= order && j < len(in); j++ {
+		res[j] = wrap(in[j] - in[j-1])
+	}
+	for j := order + 1; j < len(in); j++ {
+		top := in[j-order-1]
+		sum := int32(0)
+		for k := 0; k < order; k++ {
+			sum += int32(coefs[k]) * (in[j-1-k] - top)
+		}
+		del := wrap(in[j] - top - (sum+1<<(testALACDenShift-1))>>testALACDenShift)
+		res[j] = del
+
+		del0 := del
+		if del > 0 {
+			for k := order - 1; k >= 0; k-- {
+				dd := top - in[j-1-k]
+				sgn := signOf(dd)
+				coefs[k] -= int16(sgn)
+				del0 -= int32(order-k) * ((sgn * dd) >> testALACDenShift)
+				if del0 <= 0 {
+					break
+				}
+			}
+		} else if del < 0 {
+			for k := order - 1; k >= 0; k-- {
+				dd := top - in[j-1-k]
+				sgn := signOf(dd)
+				coefs[k] += int16(sgn)
+				del0 -= int32(order-k) * ((-sgn * dd) >> testALACDenShift)
+				if del0 >= 0 {
+					break
+				}
+			}
+		}
+	}
+	return res
+}
+
+// alacGolomb writes n with a Rice parameter of k, or escaped as escapeBits
+// raw bits
+func alacGolomb(w *bitWriter, n uint32, m uint32, k int, escapeBits int) {
+	prefix := n / m
+	if prefix >= ALAC_MAX_PREFIX {
+		w.writeBits(1<<ALAC_MAX_PREFIX-1, ALAC_MAX_PREFIX)
+		w.writeBits(uint64(n), escapeBits)
+		return
+	}
+	w.writeBits(1<<prefix-1, int(prefix))
+	w.writeBits(0, 1)
+	if k == 1 {
+		return
+	}
+	if rem := n % m; rem == 0 {
+		w.writeBits(0, k-1)
+	} else {
+		w.writeBits(uint64(rem+1), k)
+	}
+}
+
+// alacCompress is the inverse of decompress
+func alacCompress(w *bitWriter, residuals []int32, pb int, chanBits int) {
+	mb := uint32(testALACMB)
+	zmode := uint32(0)
+	for i := 0; i < len(residuals); {
+		k := min(31-bits.LeadingZeros32(mb>>ALAC_QB_SHIFT+3), testALACKB)
+		del := residuals[i]
+		folded := uint32(2 * del)
+		if del < 0 {
+			folded = uint32(-2*del - 1)
+		}
+		n := folded - zmode
+		alacGolomb(w, n, 1<<k-1, k, chanBits)
+		i++
+
+		mb = uint32(pb)*(n+zmode) + mb - (uint32(pb)*mb)>>ALAC_QB_SHIFT
+		if n > ALAC_MEAN_CLAMP {
+			mb = ALAC_MEAN_CLAMP
+		}
+
+		zmode = 0
+		if mb<<ALAC_MMUL_SHIFT < ALAC_QB && i < len(residuals) {
+			zmode = 1
+			run := 0
+			for i+run < len(residuals) && residuals[i+run] == 0 && run < 65535 {
+				run++
+			}
+			k := bits.LeadingZeros32(mb) - ALAC_BITOFF + int((mb+ALAC_MOFF)>>ALAC_MDEN_SHIFT)
+			alacGolomb(w, uint32(run), (1<<k-1)&(1<<testALACKB-1), k, ALAC_RUN_BITS)
+			i += run
+			if run >= 65535 {
+				zmode = 0
+			}
+			mb = 0
+		}
+	}
+}
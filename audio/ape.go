@@ -0,0 +1,161 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+)
+
+const (
+	APE_FOOTER_SIZE     = 32
+	APE_ITEM_MIN_SIZE   = 9
+	APE_MAX_TAG_SIZE    = 1 << 24
+	APE_FLAG_HAS_HEADER = 1 << 31
+
+	APE_ITEM_TYPE_MASK = 0x6
+	APE_ITEM_BINARY    = 0x2
+)
+
+// apeTag holds the fields maestro cares about from an APEv1 or APEv2 tag
+type apeTag struct {
+	title  string
+	album  string
+	artist string
+
+	cover *Artwork
+}
+
+// apply copies the fields that were present into metadata
+func (tag *apeTag) apply(metadata *Metadata) {
+	if tag.title != "" {
+		metadata.Title = tag.title
+	}
+	if tag.album != "" {
+		metadata.Album = tag.album
+	}
+	if tag.artist != "" {
+		metadata.Artist = tag.artist
+	}
+	if tag.cover != nil {
+		metadata.Cover = tag.cover
+	}
+}
+
+// readAPETag parses the APE tag that ends at end, or just before an ID3v1
+// tag there. It returns nil if no tag is present, along with the offset
+// where the trailing tags start.
+func readAPETag(r io.ReadSeeker, end int64) (*apeTag, int64, error) {
+	if end >= ID3V1_SIZE {
+		marker := make([]byte, 3)
+		if _, err := r.Seek(end-ID3V1_SIZE, io.SeekStart); err != nil {
+			return nil, end, err
+		}
+		if _, err := io.ReadFull(r, marker); err != nil {
+			return nil, end, err
+		}
+		if string(marker) == "TAG" {
+			end -= ID3V1_SIZE
+		}
+	}
+
+	if end < APE_FOOTER_SIZE {
+		return nil, end, nil
+	}
+	footer := make([]byte, APE_FOOTER_SIZE)
+	if _, err := r.Seek(end-APE_FOOTER_SIZE, io.SeekStart); err != nil {
+		return nil, end, err
+	}
+	if _, err := io.ReadFull(r, footer); err != nil {
+		return nil, end, err
+	}
+	if string(footer[:8]) != "APETAGEX" {
+		return nil, end, nil
+	}
+
+	// the size covers the items and the footer but not the header
+	size := int64(binary.LittleEndian.Uint32(footer[12:]))
+	count := int(binary.LittleEndian.Uint32(footer[16:]))
+	flags := binary.LittleEndian.Uint32(footer[20:])
+	if size < APE_FOOTER_SIZE || size > min(end, APE_MAX_TAG_SIZE) {
+		return nil, end, nil
+	}
+
+	start := end - size
+	if flags&APE_FLAG_HAS_HEADER != 0 && start >= APE_FOOTER_SIZE {
+		start -= APE_FOOTER_SIZE
+	}
+
+	body := make([]byte, size-APE_FOOTER_SIZE)
+	if _, err := r.Seek(end-size, io.SeekStart); err != nil {
+		return nil, end, err
+	}
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, end, err
+	}
+
+	return parseAPEItems(body, count), start, nil
+}
+
+func parseAPEItems(body []byte, count int) *apeTag {
+	tag := &apeTag{}
+	for ; count > 0 && len(body) >= APE_ITEM_MIN_SIZE; count-- {
+		size := int(binary.LittleEndian.Uint32(body))
+		flags := binary.LittleEndian.Uint32(body[4:])
+
+		keyEnd := bytes.IndexByte(body[8:], 0)
+		if keyEnd < 0 {
+			break
+		}
+		key := strings.ToLower(string(body[8 : 8+keyEnd]))
+		body = body[8+keyEnd+1:]
+		if size < 0 || size > len(body) {
+			break
+		}
+		value := body[:size]
+		body = body[size:]
+
+		if flags&APE_ITEM_TYPE_MASK == APE_ITEM_BINARY {
+			if key == "cover art (front)" {
+				tag.cover = parseAPECover(value)
+			}
+			continue
+		}
+
+		// lists are separated by null bytes, keep the first entry
+		text := value
+		if idx := bytes.IndexByte(text, 0); idx >= 0 {
+			text = text[:idx]
+		}
+		switch key {
+		case "title":
+			tag.title = strings.TrimSpace(string(text))
+		case "artist":
+			tag.artist = strings.TrimSpace(string(text))
+		case "album":
+			tag.album = strings.TrimSpace(string(text))
+		}
+	}
+	return tag
+}
+
+// parseAPECover splits a binary cover item into its file name and image
+func parseAPECover(value []byte) *Artwork {
+	idx := bytes.IndexByte(value, 0)
+	if idx < 0 || idx+1 >= len(value) {
+		return nil
+	}
+	name := strings.ToLower(string(value[:idx]))
+	data := bytes.Clone(value[idx+1:])
+
+	art := &Artwork{Data: data, MIMEType: "image/jpeg"}
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG")) || strings.HasSuffix(name, ".png"):
+		art.MIMEType = "image/png"
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		art.MIMEType = "image/gif"
+	case bytes.HasPrefix(data, []byte("BM")) && strings.HasSuffix(name, ".bmp"):
+		art.MIMEType = "image/bmp"
+	}
+	return art
+}
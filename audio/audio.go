@@ -1,8 +1,13 @@
 package audio
 
 import (
+	"context"
 	"errors"
 	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,16 +17,15 @@ const (
 	SEEK_UNIT      = 5 * SECOND
 )
 
-const (
-	EVENT_SOURCE_CHANGE = iota
-)
-
 const (
 	CTL_PLAY = iota
 	CTL_PAUSE
 	CTL_SKIP
 	CTL_SEEK
 	CTL_SEEK_TO
+	CTL_CROSSFADE
+	CTL_VOLUME
+	CTL_MUTE
 )
 
 const (
@@ -48,6 +52,17 @@ type Metadata struct {
 	Artist string
 
 	Duration uint64
+
+	// free text such as a module's song message and instrument names
+	Comment string
+
+	// embedded cover art, nil if the file has none
+	Cover *Artwork
+}
+
+type Artwork struct {
+	MIMEType string
+	Data     []byte
 }
 
 func NewMetadata() (m *Metadata) {
@@ -70,6 +85,14 @@ type AudioClient interface {
 
 	Start() error
 	Stop() (bool, error)
+
+	Close() error
+}
+
+// offlineClient is implemented by clients that take audio as fast as it is
+// decoded, such as one rendering to a file, rather than as a device plays it
+type offlineClient interface {
+	offline() bool
 }
 
 type AudioSource interface {
@@ -80,75 +103,186 @@ type AudioSource interface {
 	GetPCMWaveFormat() (*PCMWaveFormat, error)
 
 	GetMetadata() Metadata
+
+	Close() error
 }
 
 type AudioSourceProvider struct {
 	GetAudioSourceFromFile func(metadata *Metadata) (AudioSource, error)
+	GetFileMetadata        func(path string) (*Metadata, error)
+}
+
+// providers for formats decoded natively, keyed by lowercase file extension
+var audioSourceProviders = make(map[string]*AudioSourceProvider)
+
+func RegisterAudioSourceProvider(ext string, provider *AudioSourceProvider) {
+	audioSourceProviders[strings.ToLower(ext)] = provider
+}
+
+func getProviderForPath(path string) *AudioSourceProvider {
+	if provider, ok := audioSourceProviders[strings.ToLower(filepath.Ext(path))]; ok {
+		return provider
+	}
+	return getBackendSourceProvider()
 }
 
 type Player struct {
-	client AudioClient
-	format *PCMWaveFormat
+	client    AudioClient
+	newClient func() (AudioClient, error) // reopens the device, nil if it cannot be
+	clock     Clock
+	format    *PCMWaveFormat
+
+	sources      *sourceSelector
+	refillPeriod time.Duration
+	seekStep     int // in 100ns units
+
+	crossfadeLength int // in 100ns units, 0 if off
+	crossfadeCurve  int
+
+	declickLength int // in 100ns units, 0 if off
+
+	chain processorChain // run over the audio before it reaches the client
+
+	volume        float64 // in dB
+	muted         bool
+	volumeControl *volumeProcessor // pinned to the end of chain, applying volume
 
 	control     chan int
 	controlDone chan struct{}
 	playing     bool
 
 	curSource     AudioSource
-	trackPosition int // in 100ns units
+	trackPosition int       // in 100ns units
+	outgoing      *Metadata // the track fading out under curSource, if any
 
 	queueIn chan string
 	queue   Queue
 
-	sourceChangeSubscribers []chan<- struct{}
-	queueUpdateSubscribers  []chan<- struct{}
-}
+	events   eventBus
+	snapshot atomic.Pointer[Snapshot]
 
-func getDefaultClient() (AudioClient, error) {
-	return getDefaultWindowsClient()
+	closing   chan struct{} // closed by Close to stop the player thread
+	closed    chan struct{} // closed once the player thread has stopped
+	closeOnce sync.Once
+	closeErr  error
 }
 
 func GetAudioSourceProvider() *AudioSourceProvider {
-	return getWinAudioSourceProvider()
+	return &AudioSourceProvider{
+		func(metadata *Metadata) (AudioSource, error) {
+			return getProviderForPath(metadata.Filepath).GetAudioSourceFromFile(metadata)
+		},
+		func(path string) (*Metadata, error) {
+			return getProviderForPath(path).GetFileMetadata(path)
+		},
+	}
 }
 
-func NewPlayer() (player *Player, err error) {
-	player = &Player{}
+// NewPlayer makes a player for the default output device, decoding files
+// with the registered providers, unless options say otherwise
+func NewPlayer(options ...PlayerOption) (player *Player, err error) {
+	player = &Player{
+		sources:       newSourceSelector(),
+		refillPeriod:  REFILL_PERIOD,
+		seekStep:      SEEK_UNIT,
+		declickLength: int(DECLICK_LENGTH / 100),
+	}
+	for _, option := range options {
+		option(player)
+	}
+	if player.refillPeriod <= 0 || player.seekStep <= 0 || player.crossfadeLength < 0 || !isCrossfadeCurve(player.crossfadeCurve) || player.declickLength < 0 {
+		return nil, ErrInvalidOption
+	}
+	if !(player.volume >= VOLUME_MIN && player.volume <= VOLUME_MAX) {
+		return nil, ErrInvalidOption
+	}
+	player.volumeControl = newVolumeProcessor(volumeGain(player.volume, player.muted))
+	player.chain.pin(player.volumeControl)
+
+	if player.client == nil {
+		if player.newClient == nil {
+			player.newClient = getDefaultClient
+		}
+		player.client, err = player.newClient()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, err = player.client.GetBufferSize(); err != nil {
+		player.client.Close()
+		return nil, err
+	}
 
 	player.control = make(chan int)
 	player.controlDone = make(chan struct{})
 	player.playing = false
 
 	player.queueIn = make(chan string, 2)
-	player.queue = Queue{make([]QueueItem, 0), make([]QueueItem, 0)}
+	player.queue = Queue{
+		prevQ:     make([]QueueItem, 0),
+		nextQ:     make([]QueueItem, 0),
+		provider:  player.sources.provider(),
+		loadError: player.publishLoadError,
+	}
 
-	player.queueUpdateSubscribers = make([]chan<- struct{}, 0)
-	player.sourceChangeSubscribers = make([]chan<- struct{}, 0)
+	player.closing = make(chan struct{})
+	player.closed = make(chan struct{})
 
 	// make player thread
-	client, err := getDefaultClient()
-	player.client = client
-	player.format = client.GetPCMWaveFormat()
-	if err != nil {
+	player.format = player.client.GetPCMWaveFormat()
+	if err = player.chain.configure(player.format); err != nil {
+		player.client.Close()
 		return nil, err
 	}
+	player.updateSnapshot()
 	go player.playerThread()
 
 	return player, nil
 }
 
+// Close stops playback, closes the client and every source the player has
+// opened and drops its subscribers, waiting until ctx is done for the player
+// thread to finish. The player does nothing once closed.
+func (p *Player) Close(ctx context.Context) error {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+	})
+
+	select {
+	case <-p.closed:
+		return p.closeErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// command sends an operation and its arguments to the player thread and
+// waits for it to be done, unless the player is closed
+func (p *Player) command(op ...int) {
+	for _, v := range op {
+		select {
+		case p.control <- v:
+		case <-p.closed:
+			return
+		}
+	}
+
+	select {
+	case <-p.controlDone:
+	case <-p.closed:
+	}
+}
+
 func (p *Player) Start() {
-	p.control <- CTL_PLAY
-	<-p.controlDone
+	p.command(CTL_PLAY)
 }
 
 func (p *Player) Stop() {
-	p.control <- CTL_PAUSE
-	<-p.controlDone
+	p.command(CTL_PAUSE)
 }
 
 func (p *Player) Toggle() {
-	if p.playing {
+	if p.Snapshot().State == STATE_PLAYING {
 		p.Stop()
 	} else {
 		p.Start()
@@ -156,145 +290,422 @@ func (p *Player) Toggle() {
 }
 
 func (p *Player) Skip() {
-	p.control <- CTL_SKIP
-	p.control <- 1
-	<-p.controlDone
-
+	p.command(CTL_SKIP, 1)
 }
 
 func (p *Player) Back() {
-	if p.trackPosition < BACK_THRESHOLD {
+	if p.Snapshot().Position < BACK_THRESHOLD {
 		// skip backwards
-		p.control <- CTL_SKIP
-		p.control <- -1
+		p.command(CTL_SKIP, -1)
 	} else {
 		// restart the song
-		p.control <- CTL_SEEK_TO
-		p.control <- 0
+		p.command(CTL_SEEK_TO, 0)
 	}
-
-	<-p.controlDone
 }
 
 func (p *Player) SeekForward() {
-	p.control <- CTL_SEEK
-	p.control <- SEEK_UNIT
-	<-p.controlDone
+	p.command(CTL_SEEK, p.seekStep)
 }
 
 func (p *Player) SeekBackward() {
-	p.control <- CTL_SEEK
-	p.control <- -1 * SEEK_UNIT
-	<-p.controlDone
+	p.command(CTL_SEEK, -1*p.seekStep)
 }
 
 func (p *Player) AddSourcesToQueue(sources ...string) {
 	for _, source := range sources {
-		p.queueIn <- source
+		select {
+		case p.queueIn <- source:
+		case <-p.closed:
+			return
+		}
 	}
 }
 
 func (p *Player) GetQueue(lookBehind int) []Metadata {
-	return p.queue.GetDataQueue(lookBehind)
+	return p.Snapshot().Queue(lookBehind)
 }
 
 func (p *Player) GetCurrentSourceMetadata() Metadata {
-	if p.curSource != nil {
-		return p.curSource.GetMetadata()
-	} else {
-		return *NewMetadata()
-	}
+	return p.Snapshot().Current
 }
 
 func (p *Player) GetPositionInTrack() int {
-	return p.trackPosition
+	return p.Snapshot().Position
 }
 
-func (p *Player) SubscribeToSourceChange(c chan<- struct{}) {
-	p.sourceChangeSubscribers = append(p.sourceChangeSubscribers, c)
+// Subscribe starts sending the player's events to the subscription
+// returned, holding up to buffer of them until read. A full buffer is dealt
+// with by policy, one of the EVENT_ constants.
+func (p *Player) Subscribe(buffer int, policy int) *Subscription {
+	s := p.events.subscribe(buffer, policy)
+	select {
+	case <-p.closed:
+		// too late for any events
+		s.Unsubscribe()
+	default:
+	}
+	return s
 }
 
-func (p *Player) publishSourceChange() {
-	for _, c := range p.sourceChangeSubscribers {
-		c <- struct{}{}
-	}
+// publish sends e to subscribers, recording the state it describes first so
+// that a subscriber taking a snapshot on hearing it sees the change
+func (p *Player) publish(e Event) {
+	p.updateSnapshot()
+	p.events.publish(e, p.closing)
 }
 
-func (p *Player) SubscribeToQueueUpdate(c chan<- struct{}) {
-	p.queueUpdateSubscribers = append(p.queueUpdateSubscribers, c)
+// commandDone records the state a command left the player in and lets its
+// caller return
+func (p *Player) commandDone() {
+	p.updateSnapshot()
+	p.controlDone <- struct{}{}
 }
 
-func (p *Player) publishQueueUpdate() {
-	for _, c := range p.queueUpdateSubscribers {
-		c <- struct{}{}
+func (p *Player) publishTrackChanged() {
+	p.publish(TrackChanged{p.curSource.GetMetadata()})
+}
+
+func (p *Player) publishError(kind int, path string, err error) {
+	p.publish(PlayerError{kind, path, err})
+}
+
+// publishLoadError reports a file that could not be opened, which the queue
+// drops
+func (p *Player) publishLoadError(index int, metadata Metadata, err error) {
+	p.publishError(ERROR_SOURCE, metadata.Filepath, err)
+	p.publish(QueueChanged{Index: index, Removed: 1})
+}
+
+// exit releases what the player holds as its thread stops, fatal being the
+// error that stopped it if it was not closed
+func (p *Player) exit(clock Clock, fatal error) {
+	if fatal != nil {
+		p.publishError(ERROR_FATAL, "", fatal)
+		p.closeOnce.Do(func() {
+			close(p.closing)
+		})
 	}
+	clock.Stop()
+
+	_, err := p.client.Stop()
+	p.storeSnapshot(STATE_CLOSED)
+	p.closeErr = errors.Join(fatal, err, p.queue.Close(), p.client.Close())
+
+	// subscribing from here on gets no events
+	close(p.closed)
+	p.events.close()
+
+	// a clock waiting to hear its last tick was handled hears it here
+	clock.C()
 }
 
 func (player *Player) playerThread() {
-	CLK_DUR := 100 * time.Millisecond
+	CLK_DUR := player.refillPeriod
 
-	client := player.client
-	format := client.GetPCMWaveFormat()
+	var client AudioClient
+	var format *PCMWaveFormat
+	var bufferFrames, frameSize int
 
-	waitingForNextTrack := true
+	// fades the audio written to the client around pauses and jumps
+	var declick *declicker
 
-	// get max buffer size
-	bufferFrames, err := client.GetBufferSize()
-	if err != nil {
-		panic(err)
+	// useClient plays through c from here on
+	useClient := func(c AudioClient) error {
+		size, err := c.GetBufferSize()
+		if err != nil {
+			return err
+		}
+		client, bufferFrames = c, size
+		player.client = c
+		format = c.GetPCMWaveFormat()
+		frameSize = int(format.NumChannels * format.SampleDepth / 8)
+		declick = newDeclicker(player.declickLength, format)
+		return nil
 	}
 
-	// get frame size
-	frameSize := int(format.NumChannels * format.SampleDepth / 8)
+	// the error that stops the player, if any
+	fatal := useClient(player.client)
+
+	waitingForNextTrack := true
 
 	//initialize "leftover" buffer
 	leftover := make([]byte, 0)
 
 	// create clock
-	clock := time.NewTicker(CLK_DUR)
+	clock := player.clock
+	if clock == nil {
+		clock = newTickerClock(CLK_DUR)
+		if c, ok := client.(offlineClient); ok && c.offline() {
+			clock = &immediateClock{}
+		}
+	}
 	clock.Stop() // wait for first track
 
+	// ticks while a lost device is being reopened, nil otherwise
+	var reconnect <-chan time.Time
+	reconnectDelay := RECONNECT_DELAY
+	reconnectAttempts := 0
+
+	// startClock resumes refilling the buffer, once there is a device to fill
+	startClock := func() {
+		if reconnect == nil {
+			clock.Reset(CLK_DUR)
+		}
+	}
+
 	// last known timestamp
 	lastKnownTS := 0
 
+	// if the client is playing out the fade of a pause, to be stopped once
+	// it has
+	stopping := false
+
 	// if EOF is reached
 	reachedEOF := false
 
-	bytesTo100ns := (8 * 1e7) / (int(format.SampleDepth) * int(format.SampleRate) * int(format.NumChannels))
+	// the tracks after the current one, opened and decoded into the buffer
+	// behind it once it reaches EOF so that no gap is heard between them
+	var ahead []prerolledTrack
+
+	// the fade from the end of one track into the next being mixed, nil if
+	// none
+	var fade *crossfade
+
+	// endFade stops mixing, closing the track faded out unless it is still
+	// the one playing
+	endFade := func() {
+		if fade.from != player.curSource {
+			player.queue.CloseSource(fade.from)
+		}
+		fade = nil
+	}
+
+	// the timestamp in the current track that player.outgoing has faded out
+	// by
+	outgoingEnd := 0
 
-	for {
+	// setOutgoing changes the track heard fading out under the current one
+	setOutgoing := func(outgoing *Metadata, end int) {
+		if outgoing != nil || player.outgoing != nil {
+			player.outgoing, outgoingEnd = outgoing, end
+			player.publish(CrossfadeChanged{outgoing})
+		}
+	}
+
+	// dropAhead forgets the tracks decoded ahead of time, once the audio
+	// buffered behind the current one is thrown away
+	dropAhead := func() {
+		for _, t := range ahead {
+			player.queue.CloseSource(t.source)
+		}
+		ahead = nil
+		if fade != nil {
+			endFade()
+		}
+		setOutgoing(nil, 0)
+	}
+
+	// prerollNext opens the track after the last one read, returning false
+	// if the queue has run out
+	prerollNext := func() bool {
+		source := player.queue.PeekSource(len(ahead))
+		if source == nil {
+			return false
+		}
+		ahead = append(ahead, prerolledTrack{source: source})
+		return true
+	}
+
+	// metadata last seen for the current source
+	var metaSource AudioSource
+	lastMeta := Metadata{}
+
+	bytesTo100ns := func(n int) int {
+		return int(int64(n/frameSize) * SECOND / int64(format.SampleRate))
+	}
+
+	// startFade starts fading the next track in if frames, read from source
+	// at timestamp, run into the end of source that is to be faded out. It
+	// returns the part of frames before the fade, and whether it started.
+	startFade := func(source AudioSource, frames []byte, timestamp int) ([]byte, bool) {
+		length := player.crossfadeLength
+		if fade != nil || length == 0 {
+			return frames, false
+		}
+		meta := source.GetMetadata()
+		start := int(meta.Duration) - length
+		if start <= 0 || timestamp > start || timestamp+bytesTo100ns(len(frames)) < start {
+			return frames, false
+		}
+
+		into := player.queue.PeekSource(len(ahead))
+		if into == nil || !canCrossfade(meta, into.GetMetadata(), length) {
+			return frames, false
+		}
+		ahead = append(ahead, prerolledTrack{source: into, fadeFrom: &meta, fadeEnd: length})
+
+		split := min(int(int64(start-timestamp)*int64(format.SampleRate)/SECOND)*frameSize, len(frames))
+		tail := append([]byte(nil), frames[split:]...)
+		fade = newCrossfade(source, into, tail, length, player.crossfadeCurve, player.format)
+		return frames[:split], true
+	}
+
+	// loseClient stops playing through a client that has failed, and starts
+	// reopening the device if it can be
+	loseClient := func(err error) {
+		if player.newClient == nil {
+			if fatal == nil {
+				fatal = err
+			}
+			return
+		}
+		player.publishError(ERROR_DEVICE, "", err)
+
+		client.Close()
+		useClient(disconnectedClient{*format})
+		clock.Stop()
+		leftover = leftover[:0]
+		player.chain.reset()
+		dropAhead()
+
+		reconnectDelay = RECONNECT_DELAY
+		reconnectAttempts = 0
+		reconnect = reconnectAfter(reconnectDelay)
+	}
+
+	// seekSource moves the current track to pos, reporting it if the source
+	// cannot be moved
+	seekSource := func(pos int) bool {
+		if err := player.curSource.SetPosition(int64(pos)); err != nil {
+			player.publishError(ERROR_SOURCE, player.curSource.GetMetadata().Filepath, err)
+			return false
+		}
+		return true
+	}
+
+	for fatal == nil {
 		select {
+		case <-player.closing:
+			player.exit(clock, nil)
+			return
+		case <-reconnect:
+			c, err := player.newClient()
+			if err == nil {
+				if err = useClient(c); err != nil {
+					c.Close()
+				}
+			}
+			if err != nil {
+				reconnectAttempts++
+				if reconnectAttempts == RECONNECT_ATTEMPTS {
+					fatal = errors.Join(ErrReconnectFailed, err)
+					break
+				}
+				reconnectDelay = min(2*reconnectDelay, RECONNECT_MAX_DELAY)
+				reconnect = reconnectAfter(reconnectDelay)
+				break
+			}
+			reconnect = nil
+
+			// the new device may want another format
+			if *format != *player.format {
+				*player.format = *format
+				if err := player.queue.SetPCMWaveFormat(player.format); err != nil {
+					fatal = err
+					break
+				}
+				if err := player.chain.configure(player.format); err != nil {
+					player.publishError(ERROR_PROCESSOR, "", err)
+				}
+			}
+
+			// pick up from what was last heard, fading in
+			declick.reset()
+			if !waitingForNextTrack {
+				seekSource(player.trackPosition)
+				lastKnownTS = player.trackPosition
+				reachedEOF = false
+				startClock()
+			}
+			if player.playing {
+				client.Start()
+			}
 		case source := <-player.queueIn:
-			player.queue.AddSourcePath(source, player.format)
-			player.publishQueueUpdate()
+			index := player.queue.Len()
+			metadata := player.queue.AddSourcePath(source, player.format)
+			player.publish(QueueChanged{Index: index, Added: []Metadata{metadata}})
 			if waitingForNextTrack {
+				last := player.curSource
 				player.curSource, waitingForNextTrack = player.queue.NextSource()
+				if last != nil && last != player.curSource {
+					player.queue.CloseSource(last)
+				}
 				if waitingForNextTrack {
+					// nothing added so far can be played
+					player.publish(QueueEnded{})
 					break
 				}
 
 				player.trackPosition = 0
 				lastKnownTS = 0
 
-				player.publishSourceChange()
-				clock.Reset(CLK_DUR)
+				player.publishTrackChanged()
+				startClock()
 			}
 		case op := <-player.control:
 			switch op {
 			case CTL_PLAY:
-				client.Start()
-				player.playing = true
-				player.controlDone <- struct{}{}
+				if !player.playing {
+					// what was cut off by pausing goes straight back in,
+					// fading in
+					stopping = false
+					padding, err := client.GetBufferPadding()
+					if err == nil {
+						declick.played(padding)
+						n := min(len(leftover), (bufferFrames-padding)*frameSize)
+						_, err = client.LoadToBuffer(declick.load(leftover[:n]))
+						leftover = leftover[n:]
+					}
+					if err != nil {
+						loseClient(err)
+					}
+				}
+				if err := client.Start(); err != nil {
+					loseClient(err)
+				}
+				if !player.playing {
+					player.playing = true
+					player.publish(PlayStateChanged{true})
+				}
+				player.commandDone()
 			case CTL_PAUSE:
-				client.Stop()
-				player.playing = false
-				player.controlDone <- struct{}{}
+				if player.playing && !stopping {
+					// fade out before stopping, keeping what would have
+					// been heard after for resuming
+					rest, ramped, err := declick.pause(client)
+					if err != nil {
+						loseClient(err)
+					} else {
+						leftover = append(rest, leftover...)
+						stopping = ramped
+					}
+				}
+				if !stopping {
+					if _, err := client.Stop(); err != nil {
+						loseClient(err)
+					}
+				}
+				if player.playing {
+					player.playing = false
+					player.publish(PlayStateChanged{false})
+				}
+				player.commandDone()
 			case CTL_SKIP:
 				//grab exra data
 				amt := <-player.control
 
-				if amt == 0 { //if skipping 0 songs, or if index is already waiting, skip
-					player.controlDone <- struct{}{}
+				if amt == 0 || player.curSource == nil { //if skipping 0 songs, or if nothing has loaded, skip
+					player.commandDone()
 					break
 				} else {
 					player.queue.Skip(amt)
@@ -302,90 +713,187 @@ func (player *Player) playerThread() {
 
 				// interrupt current song
 				leftover = leftover[:0]
-				client.ClearBuffer()
+				player.chain.reset()
+				reachedEOF = false
+				dropAhead()
+				if err := declick.interrupt(client, player.playing && !stopping); err != nil {
+					loseClient(err)
+				}
 
 				var nextSource AudioSource
 				nextSource, waitingForNextTrack = player.queue.NextSource()
 
 				if waitingForNextTrack {
-					player.curSource.SetPosition(int64(player.curSource.GetMetadata().Duration))
+					seekSource(int(player.curSource.GetMetadata().Duration))
 					player.trackPosition = int(player.curSource.GetMetadata().Duration)
 					clock.Stop()
 				} else {
 					// play next song
-					player.curSource.SetPosition(0)
+					if nextSource != player.curSource {
+						player.queue.CloseSource(player.curSource)
+					} else {
+						seekSource(0)
+					}
 					player.curSource = nextSource
 					player.trackPosition = 0
 					lastKnownTS = 0
-					clock.Reset(CLK_DUR)
+					startClock()
 				}
 
-				player.publishSourceChange()
-				player.controlDone <- struct{}{}
+				player.publishTrackChanged()
+				player.commandDone()
 			case CTL_SEEK:
 				// find new position
 				amt := <-player.control
+				if player.curSource == nil {
+					// nothing has loaded to seek in
+					player.commandDone()
+					break
+				}
 				newPos := player.trackPosition + amt
 				newPos = Clamp(newPos, 0, int(player.curSource.GetMetadata().Duration))
 
-				// set new position
-				player.curSource.SetPosition(int64(newPos))
+				// set new position, playing on from where it was if it
+				// cannot be
+				if !seekSource(newPos) {
+					player.commandDone()
+					break
+				}
 				player.trackPosition = newPos
 				lastKnownTS = player.trackPosition
 
 				// clear buffer
-				player.client.ClearBuffer()
+				if err := declick.interrupt(client, player.playing && !stopping); err != nil {
+					loseClient(err)
+				}
 				leftover = leftover[:0]
+				player.chain.reset()
+				reachedEOF = false
+				dropAhead()
 
 				if waitingForNextTrack {
 					waitingForNextTrack = false
-					clock.Reset(CLK_DUR)
+					startClock()
 					//player.client.Start()
 				}
 
-				player.controlDone <- struct{}{}
+				player.publish(Seeked{newPos})
+				player.commandDone()
 
 			case CTL_SEEK_TO:
 				newPos := int(<-player.control)
-				player.curSource.SetPosition(int64(newPos))
+				if player.curSource == nil {
+					player.commandDone()
+					break
+				}
+				if !seekSource(newPos) {
+					player.commandDone()
+					break
+				}
 				player.trackPosition = newPos
+				lastKnownTS = player.trackPosition
 
-				player.client.ClearBuffer()
+				if err := declick.interrupt(client, player.playing && !stopping); err != nil {
+					loseClient(err)
+				}
 				leftover = leftover[:0]
+				player.chain.reset()
+				reachedEOF = false
+				dropAhead()
 				if waitingForNextTrack {
 					waitingForNextTrack = false
-					clock.Reset(CLK_DUR)
+					startClock()
 					//player.client.Start()
 				}
-				player.controlDone <- struct{}{}
+				player.publish(Seeked{newPos})
+				player.commandDone()
+
+			case CTL_CROSSFADE:
+				player.crossfadeLength = <-player.control
+				player.crossfadeCurve = <-player.control
+				player.commandDone()
+
+			case CTL_VOLUME, CTL_MUTE:
+				volume, muted := player.volume, player.muted
+				if op == CTL_VOLUME {
+					volume = float64(<-player.control) / 100
+				} else {
+					muted = <-player.control != 0
+				}
+				if volume != player.volume || muted != player.muted {
+					player.volume, player.muted = volume, muted
+					player.volumeControl.target = volumeGain(volume, muted)
+					player.publish(VolumeChanged{volume, muted})
+				}
+				player.commandDone()
 			}
-		case <-clock.C:
+		case <-clock.C():
 			// Get buffer
 			padding, err := client.GetBufferPadding()
 			if err != nil {
-				panic(err)
+				loseClient(err)
+				break
+			}
+
+			// audio faded out before a jump is not part of the current track,
+			// while what the processors hold is
+			declick.played(padding)
+			totalBufferedData := (padding * frameSize) + len(leftover) - declick.stale
+			totalBufferedData += player.chain.heldFrames() * frameSize
+			aheadData := 0
+			for _, t := range ahead {
+				aheadData += t.bytes
+			}
+
+			// once nothing of the current track is left buffered, the one
+			// decoded behind it takes over
+			for len(ahead) > 0 && totalBufferedData <= aheadData {
+				player.queue.NextSource()
+				if fade == nil || fade.from != player.curSource {
+					player.queue.CloseSource(player.curSource)
+				}
+				next := ahead[0]
+				player.curSource = next.source
+				lastKnownTS, reachedEOF = next.ts, next.eof
+				aheadData -= next.bytes
+				ahead = ahead[1:]
+				player.trackPosition = lastKnownTS - bytesTo100ns(totalBufferedData-aheadData)
+				player.publishTrackChanged()
+				setOutgoing(next.fadeFrom, next.fadeEnd)
 			}
 
 			// Estimate timestamp
-			totalBufferedData := (padding * frameSize) + len(leftover)
-			timeDiff := totalBufferedData * bytesTo100ns
-			player.trackPosition = lastKnownTS - timeDiff
+			player.trackPosition = lastKnownTS - bytesTo100ns(totalBufferedData-aheadData)
+
+			if player.outgoing != nil && player.trackPosition >= outgoingEnd {
+				// the last track has faded out
+				setOutgoing(nil, 0)
+			}
 
-			if reachedEOF && player.trackPosition == lastKnownTS { //if song is done
+			if reachedEOF && len(ahead) == 0 {
+				// tracks may have been queued since the current one was read
+				prerollNext()
+			}
+
+			if reachedEOF && len(ahead) == 0 && player.trackPosition == lastKnownTS { //if song is done
 				reachedEOF = false
 
-				// exit and move to next song
-				var nextSource AudioSource
-				nextSource, waitingForNextTrack = player.queue.NextSource()
-				if waitingForNextTrack {
-					clock.Stop()
-					break
+				// nothing is left to play
+				waitingForNextTrack = true
+				clock.Stop()
+				player.publish(QueueEnded{})
+				break
+			}
+
+			if stopping {
+				// nothing more is written until the fade out has played
+				if padding == 0 {
+					stopping = false
+					if _, err := client.Stop(); err != nil {
+						loseClient(err)
+					}
 				}
-				player.curSource.SetPosition(0)
-				player.trackPosition = 0
-				lastKnownTS = 0
-				player.curSource = nextSource
-				player.publishSourceChange()
+				break
 			}
 
 			freeFrames := bufferFrames - padding
@@ -397,65 +905,212 @@ func (player *Player) playerThread() {
 			totalCopied := copy(acc, leftover)
 			leftover = leftover[totalCopied:]
 
-			//load new data
-			for i := 0; totalCopied < freeFrames*frameSize; i++ {
-				frames, timestamp, err := player.curSource.ReadNext()
-				if err == io.EOF {
-					reachedEOF = true
-					break
-				} else if err != nil {
-					panic(err)
+			//load new data, running on into the next track
+			for totalCopied < freeFrames*frameSize {
+				// the track read from, nil while it is the current one
+				var t *prerolledTrack
+				source := player.curSource
+				if reachedEOF {
+					if (len(ahead) == 0 || ahead[len(ahead)-1].eof) && !prerollNext() {
+						// the queue has run out, so what the processors
+						// hold is the last of it
+						frames := player.chain.flush()
+						copied := copy(acc[totalCopied:], frames)
+						leftover = frames[copied:]
+						totalCopied += copied
+						break
+					}
+					t = &ahead[len(ahead)-1]
+					source = t.source
+				}
+
+				frames, timestamp, err := readSource(source)
+				if err != nil {
+					if err != io.EOF {
+						// play what was decoded, then skip the rest of the file
+						player.publishError(ERROR_SOURCE, source.GetMetadata().Filepath, err)
+					}
+					if t != nil {
+						t.eof = true
+					} else {
+						reachedEOF = true
+					}
+					if fade != nil && fade.into == source {
+						// ended before it had finished fading in
+						endFade()
+					}
+					continue
+				}
+
+				if fade != nil && fade.into == source {
+					frames, err = fade.mix(frames, player.format)
+					if err != nil {
+						player.publishError(ERROR_SOURCE, fade.fromMeta.Filepath, err)
+					}
+					if fade.mixedAll() {
+						endFade()
+					}
 				}
+
+				// the rest of source may be mixed under the next track
+				frames, faded := startFade(source, frames, timestamp)
+				read := len(frames)
+
+				frames = player.chain.process(frames)
 				copied := copy(acc[totalCopied:], frames)
 				if copied < len(frames) {
 					leftover = frames[copied:]
 				}
 				totalCopied += copied
-				lastKnownTS = timestamp + len(frames)*bytesTo100ns
+				if t != nil {
+					t.ts = timestamp + bytesTo100ns(read)
+					t.bytes += read
+					t.eof = t.eof || faded
+				} else {
+					lastKnownTS = timestamp + bytesTo100ns(read)
+					reachedEOF = faded
+				}
 			}
+
+			// chained streams can change their tags mid-file
+			meta := player.curSource.GetMetadata()
+			if player.curSource == metaSource && meta != lastMeta {
+				player.publish(TrackChanged{meta})
+			}
+			metaSource, lastMeta = player.curSource, meta
 			if totalCopied > 0 {
 				//load into buffer
-				_, err = client.LoadToBuffer(acc[:totalCopied])
+				_, err = client.LoadToBuffer(declick.load(acc[:totalCopied]))
 				if err != nil {
-					panic(err)
+					loseClient(err)
 				}
 			}
 
 		}
+		player.updateSnapshot()
 	}
+
+	player.exit(clock, fatal)
+}
+
+// prerolledTrack is a track read into the buffer behind the one playing
+type prerolledTrack struct {
+	source AudioSource
+	ts     int  // timestamp just past the audio read from it so far
+	bytes  int  // audio read from it, buffered or leftover
+	eof    bool // if it has been read to its end
+
+	// the track it fades in over and the timestamp in it the fade ends at,
+	// if crossfaded
+	fadeFrom *Metadata
+	fadeEnd  int
 }
 
 type Queue struct {
 	prevQ []QueueItem
 	nextQ []QueueItem
+
+	// loads the queued files, the registered providers if nil
+	provider *AudioSourceProvider
+
+	// told of the files dropped because they could not be opened, and where
+	// in the queue they were, if not nil
+	loadError func(index int, metadata Metadata, err error)
+
+	// changes each time the tracks queued or the current one do
+	version uint64
+}
+
+// Len is the number of tracks in the queue, played or not
+func (q *Queue) Len() int {
+	return len(q.prevQ) + len(q.nextQ)
 }
 
-func (q *Queue) AddSourcePath(path string, format *PCMWaveFormat) {
-	metadata, err := WinGetFileMetadata(path)
+// AddSourcePath queues the file at path, returning what is known of it
+func (q *Queue) AddSourcePath(path string, format *PCMWaveFormat) Metadata {
+	provider := q.provider
+	if provider == nil {
+		provider = GetAudioSourceProvider()
+	}
+
+	metadata, err := provider.GetFileMetadata(path)
 	if err != nil {
-		metadata := NewMetadata()
+		metadata = NewMetadata()
 		metadata.Filepath = path
 	}
-	q.nextQ = append(q.nextQ, QueueItem{*metadata, format, nil})
+	q.nextQ = append(q.nextQ, QueueItem{*metadata, format, nil, provider})
+	q.version++
+	return *metadata
 }
 
 func (q *Queue) NextSource() (s AudioSource, endOfQueue bool) {
-
-	// find next valid source
-	var nextItem QueueItem
-	err := errors.New("")
-	for len(q.nextQ) > 0 && err != nil {
-		nextItem = q.nextQ[0]
-		_, err = nextItem.Source()
+	s = q.PeekSource(0)
+	if s != nil {
+		q.prevQ = append(q.prevQ, q.nextQ[0])
 		q.nextQ = q.nextQ[1:]
-	}
-	if err == nil {
-		q.prevQ = append(q.prevQ, nextItem)
-		s, _ = nextItem.Source()
+		q.version++
 	}
 	return s, (len(q.nextQ) == 0 && s == nil)
 }
 
+// PeekSource opens the source n places after the next one without moving on
+// to it, dropping those in its place that cannot be opened. It returns nil if
+// the queue runs out first.
+func (q *Queue) PeekSource(n int) AudioSource {
+	for n < len(q.nextQ) {
+		s, err := q.nextQ[n].Source()
+		if err == nil {
+			return s
+		}
+
+		item := q.nextQ[n]
+		q.nextQ = append(q.nextQ[:n], q.nextQ[n+1:]...)
+		q.version++
+		if q.loadError != nil {
+			q.loadError(len(q.prevQ)+n, item.metadata, err)
+		}
+	}
+	return nil
+}
+
+// CloseSource closes s if the queue opened it, leaving its track to be
+// opened again if it is played again
+func (q *Queue) CloseSource(s AudioSource) error {
+	for _, items := range [][]QueueItem{q.prevQ, q.nextQ} {
+		for i := range items {
+			if items[i].source == s {
+				return items[i].Close()
+			}
+		}
+	}
+	return nil
+}
+
+// SetPCMWaveFormat changes the format of the sources the queue has opened,
+// those opened later are given the format they were queued with
+func (q *Queue) SetPCMWaveFormat(format *PCMWaveFormat) error {
+	var errs []error
+	for _, items := range [][]QueueItem{q.prevQ, q.nextQ} {
+		for i := range items {
+			if items[i].source != nil {
+				errs = append(errs, items[i].source.SetPCMWaveFormat(format))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes every source the queue has opened
+func (q *Queue) Close() error {
+	var errs []error
+	for _, items := range [][]QueueItem{q.prevQ, q.nextQ} {
+		for i := range items {
+			errs = append(errs, items[i].Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
 func (q *Queue) forwardShift(amt int) {
 	if amt > len(q.nextQ) {
 		amt = len(q.nextQ)
@@ -478,6 +1133,7 @@ func (q *Queue) backShift(amt int) {
 }
 
 func (q *Queue) Skip(amt int) {
+	q.version++
 	if amt < 0 {
 		q.backShift(-amt + 1)
 	} else if amt > 0 {
@@ -510,6 +1166,7 @@ type QueueItem struct {
 	metadata Metadata
 	format   *PCMWaveFormat
 	source   AudioSource
+	provider *AudioSourceProvider
 }
 
 func (i *QueueItem) Source() (AudioSource, error) {
@@ -523,8 +1180,23 @@ func (i *QueueItem) Source() (AudioSource, error) {
 	return i.source, nil
 }
 
+// Close closes the item's source if it has been opened
+func (i *QueueItem) Close() error {
+	if i.source == nil {
+		return nil
+	}
+	err := i.source.Close()
+	i.source = nil
+	return err
+}
+
 func (i *QueueItem) loadSource() error {
-	s, err := GetAudioSourceProvider().GetAudioSourceFromFile(&i.metadata)
+	provider := i.provider
+	if provider == nil {
+		provider = GetAudioSourceProvider()
+	}
+
+	s, err := provider.GetAudioSourceFromFile(&i.metadata)
 	if err != nil {
 		return err
 	}
@@ -532,6 +1204,7 @@ func (i *QueueItem) loadSource() error {
 	if i.format != nil {
 		err = s.SetPCMWaveFormat(i.format)
 		if err != nil {
+			s.Close()
 			return err
 		}
 	}
@@ -0,0 +1,429 @@
+package audio
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tap collects a player's events
+type tap struct {
+	sub     *Subscription
+	pending []Event
+}
+
+func newTap(p *Player) *tap {
+	return &tap{sub: p.Subscribe(10000, EVENT_DROP_NEWEST)}
+}
+
+// drain returns every event published since it was last called
+func (tp *tap) drain() []Event {
+	out := tp.pending
+	tp.pending = nil
+	for {
+		select {
+		case e, ok := <-tp.sub.Events:
+			if !ok {
+				return out
+			}
+			out = append(out, e)
+		default:
+			return out
+		}
+	}
+}
+
+// waitQueued waits for n tracks to be queued, keeping the events for drain
+func (tp *tap) waitQueued(t *testing.T, n int) {
+	t.Helper()
+	for n > 0 {
+		select {
+		case e := <-tp.sub.Events:
+			if q, ok := e.(QueueChanged); ok {
+				n -= len(q.Added)
+			}
+			tp.pending = append(tp.pending, e)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out queueing")
+		}
+	}
+}
+
+// simPlayer is a player on a virtual clock, playing 16 bit stereo at 48kHz
+// into a simulated client with a 200ms buffer
+type simPlayer struct {
+	*Player
+	clock  *VirtualClock
+	client *SimulatedClient
+	tap    *tap
+}
+
+func newSimPlayer(t *testing.T, paths []string, options ...PlayerOption) *simPlayer {
+	t.Helper()
+	clock := NewVirtualClock()
+	client, err := NewSimulatedClient(clock, &PCMWaveFormat{2, 48000, 16, PCM_TYPE_INT}, 9600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPlayer(append([]PlayerOption{WithClient(client), WithClock(clock)}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close(context.Background()) })
+
+	s := &simPlayer{p, clock, client, newTap(p)}
+	if len(paths) > 0 {
+		p.AddSourcesToQueue(paths...)
+		s.tap.waitQueued(t, len(paths))
+	}
+	return s
+}
+
+// step advances the clock n refill periods
+func (s *simPlayer) step(n int) {
+	for i := 0; i < n; i++ {
+		s.clock.Advance(REFILL_PERIOD)
+	}
+}
+
+// describe names events for comparing their order
+func describe(events []Event) []string {
+	var out []string
+	for _, e := range events {
+		switch e := e.(type) {
+		case TrackChanged:
+			out = append(out, "track "+filepath.Base(e.Metadata.Filepath))
+		case QueueChanged:
+			out = append(out, fmt.Sprintf("queue %d -%d +%d", e.Index, e.Removed, len(e.Added)))
+		case PlayStateChanged:
+			out = append(out, fmt.Sprint("playing ", e.Playing))
+		case Seeked:
+			out = append(out, fmt.Sprint("seek ", e.Position))
+		case CrossfadeChanged:
+			if e.Outgoing != nil {
+				out = append(out, "fade from "+filepath.Base(e.Outgoing.Filepath))
+			} else {
+				out = append(out, "fade over")
+			}
+		case PlayerError:
+			out = append(out, fmt.Sprint("error ", e.Kind))
+		case QueueEnded:
+			out = append(out, "end")
+		}
+	}
+	return out
+}
+
+// runs splits the left channel of 16 bit stereo audio into runs of equal
+// samples
+func runs(data []byte) (values []int16, lengths []int) {
+	for i := 0; i+4 <= len(data); i += 4 {
+		v := int16(binary.LittleEndian.Uint16(data[i:]))
+		if len(values) > 0 && values[len(values)-1] == v {
+			lengths[len(lengths)-1]++
+			continue
+		}
+		values = append(values, v)
+		lengths = append(lengths, 1)
+	}
+	return values, lengths
+}
+
+func TestPositionInTrack(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.wav")
+	writeWav(t, a, 2, 48000, 16, false, 96000, constant(0.1))
+	p := newSimPlayer(t, []string{a})
+
+	if pos := p.GetPositionInTrack(); pos != 0 {
+		t.Fatalf("position %d before playing", pos)
+	}
+	p.Start()
+	// the buffer is first filled on the first tick
+	p.clock.Advance(300 * time.Millisecond)
+	if pos := p.GetPositionInTrack(); pos != 200*SECOND/1000 {
+		t.Fatalf("position %d after 300ms", pos)
+	}
+
+	// the pause fades out for DECLICK_LENGTH before it stops
+	p.Stop()
+	p.step(1)
+	pos := p.GetPositionInTrack()
+	p.clock.Advance(time.Second)
+	if p.GetPositionInTrack() != pos {
+		t.Fatal("position moved while paused")
+	}
+
+	p.Start()
+	p.clock.Advance(500 * time.Millisecond)
+	if moved := p.GetPositionInTrack() - pos; moved < 400*SECOND/1000 || moved > 500*SECOND/1000 {
+		t.Fatalf("moved %d in 500ms", moved)
+	}
+	if p.Snapshot().Duration != 2*SECOND {
+		t.Fatalf("duration %d", p.Snapshot().Duration)
+	}
+}
+
+func TestBackRestarts(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.wav")
+	b := filepath.Join(dir, "b.wav")
+	writeWav(t, a, 2, 48000, 16, false, 48000, constant(0.1))
+	writeWav(t, b, 2, 48000, 16, false, 240000, constant(0.2))
+	p := newSimPlayer(t, []string{a, b})
+	p.Start()
+	p.clock.Advance(3900 * time.Millisecond)
+	if p.Snapshot().Current.Filepath != b || p.Snapshot().Position < BACK_THRESHOLD {
+		t.Fatalf("at %d in %s", p.Snapshot().Position, p.Snapshot().Current.Filepath)
+	}
+
+	// past BACK_THRESHOLD going back restarts the track, and it counts on
+	// from the start
+	p.Back()
+	if pos := p.Snapshot().Position; pos != 0 {
+		t.Fatalf("position %d after going back", pos)
+	}
+	for i := 0; i < 5; i++ {
+		p.step(1)
+		if pos := p.Snapshot().Position; pos > (i+1)*int(REFILL_PERIOD/100) {
+			t.Fatalf("position %d %d refills after going back", pos, i+1)
+		}
+	}
+
+	// so going back again goes to the track before
+	p.Back()
+	if p.Snapshot().Current.Filepath != a {
+		t.Fatalf("back to %s", p.Snapshot().Current.Filepath)
+	}
+}
+
+func TestEventOrder(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.wav")
+	b := filepath.Join(dir, "b.wav")
+	writeWav(t, a, 2, 48000, 16, false, 24000, constant(0.1))
+	writeWav(t, b, 2, 48000, 16, false, 12000, constant(-0.1))
+	missing := filepath.Join(dir, "missing.wav")
+
+	p := newSimPlayer(t, []string{missing, a, b}, WithSeekStep(SECOND/10))
+	p.Start()
+	p.clock.Advance(300 * time.Millisecond)
+	p.SeekForward()
+	p.step(20)
+
+	got := fmt.Sprint(describe(p.tap.drain()))
+	want := fmt.Sprint([]string{
+		// the missing file is dropped as soon as it is queued
+		"queue 0 -0 +1", "error 0", "queue 0 -1 +0", "end",
+		"queue 0 -0 +1", "track a.wav", "queue 1 -0 +1",
+		"playing true", "seek 3000000", "track b.wav", "end",
+	})
+	if got != want {
+		t.Fatalf("events\n got %v\nwant %v", got, want)
+	}
+	// b follows on whole
+	if _, lengths := runs(p.client.Written()); lengths[len(lengths)-1] != 12000 {
+		t.Fatalf("runs %v", lengths)
+	}
+}
+
+func TestGapless(t *testing.T) {
+	dir := t.TempDir()
+	lengths := []int{24000, 7001, 3000, 1000, 4000, 0, 20000}
+	var paths []string
+	for i, n := range lengths {
+		path := filepath.Join(dir, fmt.Sprintf("%d.wav", i))
+		writeWav(t, path, 2, 48000, 16, false, n, constant(0.1*float64(i+1)))
+		paths = append(paths, path)
+	}
+	// and an unreadable file among them
+	paths = append(paths[:4], append([]string{filepath.Join(dir, "bad.wav")}, paths[4:]...)...)
+
+	p := newSimPlayer(t, paths)
+	p.clock.Advance(100 * time.Millisecond)
+	p.Start()
+
+	var underruns int
+	var tracks []string
+	for i := 0; i < 200 && p.client.Played() < 59001; i++ {
+		underruns = p.client.Underruns()
+		p.clock.Advance(10 * time.Millisecond)
+		for _, e := range p.tap.drain() {
+			if tc, ok := e.(TrackChanged); ok {
+				tracks = append(tracks, filepath.Base(tc.Metadata.Filepath))
+			}
+		}
+	}
+	if underruns != 0 {
+		t.Fatalf("%d frames of silence between tracks", underruns)
+	}
+	if fmt.Sprint(tracks) != "[0.wav 1.wav 2.wav 3.wav 4.wav 5.wav 6.wav]" {
+		t.Fatalf("tracks %v", tracks)
+	}
+	// every frame of every track is written, with nothing between them
+	_, got := runs(p.client.Written())
+	if fmt.Sprint(got) != "[24000 7001 3000 1000 4000 20000]" {
+		t.Fatalf("runs %v", got)
+	}
+}
+
+func TestGaplessInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.wav")
+	b := filepath.Join(dir, "b.wav")
+	c := filepath.Join(dir, "c.wav")
+	writeWav(t, a, 2, 48000, 16, false, 12000, constant(0.1))
+	writeWav(t, b, 2, 48000, 16, false, 12000, constant(0.2))
+	writeWav(t, c, 2, 48000, 16, false, 12000, constant(0.3))
+
+	for _, action := range []string{"skip", "seek", "back", "add"} {
+		paths := []string{a, b, c}
+		if action == "add" {
+			paths = paths[:1]
+		}
+		p := newSimPlayer(t, paths)
+		p.Start()
+		// a lasts 250ms, so by now b is decoded behind it
+		p.clock.Advance(200 * time.Millisecond)
+		switch action {
+		case "skip":
+			p.Skip()
+		case "seek":
+			p.SeekBackward()
+		case "back":
+			p.Back()
+		case "add":
+			p.AddSourcesToQueue(b)
+			p.tap.waitQueued(t, 1)
+		}
+		p.step(10)
+
+		// what was decoded ahead is thrown away, the next track played
+		// whole
+		_, lengths := runs(p.client.Written())
+		if last := lengths[len(lengths)-1]; last != 12000 {
+			t.Fatalf("%s: last track ran %d frames", action, last)
+		}
+		if action == "add" && fmt.Sprint(lengths) != "[12000 12000]" {
+			t.Fatalf("track added late not gapless: %v", lengths)
+		}
+	}
+}
+
+func TestCommandsWithNothingLoaded(t *testing.T) {
+	dir := t.TempDir()
+	p := newSimPlayer(t, nil)
+	commands := func() {
+		p.Start()
+		p.SeekForward()
+		p.SeekBackward()
+		p.Skip()
+		p.Back()
+		p.Stop()
+		p.step(2)
+	}
+	commands()
+
+	// every file queued fails to open
+	p.AddSourcesToQueue(filepath.Join(dir, "a.wav"), filepath.Join(dir, "b.wav"))
+	p.tap.waitQueued(t, 2)
+	commands()
+
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// openCounter counts the sources open at once
+type openCounter struct {
+	mutex sync.Mutex
+	open  int
+	peak  int
+}
+
+type countedSource struct {
+	AudioSource
+	counter *openCounter
+}
+
+func (s countedSource) Close() error {
+	s.counter.mutex.Lock()
+	s.counter.open--
+	s.counter.mutex.Unlock()
+	return s.AudioSource.Close()
+}
+
+func (c *openCounter) provider() *AudioSourceProvider {
+	return &AudioSourceProvider{func(m *Metadata) (AudioSource, error) {
+		s, err := createWavAudioSourceFromFile(m)
+		if err != nil {
+			return nil, err
+		}
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.open++
+		c.peak = max(c.peak, c.open)
+		return countedSource{s, c}, nil
+	}, getWavFileMetadata}
+}
+
+func (c *openCounter) counts() (open, peak int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.open, c.peak
+}
+
+func TestTracksClosedOncePlayed(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for i := 0; i < 40; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("%d.wav", i))
+		writeWav(t, path, 2, 48000, 16, false, 2400+10*i, constant(0.1))
+		paths = append(paths, path)
+	}
+
+	for _, crossfade := range []time.Duration{0, 20 * time.Millisecond} {
+		counter := &openCounter{}
+		p := newSimPlayer(t, paths, WithSourceProvider(counter.provider(), ".wav"), WithCrossfade(crossfade, CROSSFADE_LINEAR))
+		p.Start()
+		p.Skip()
+		p.SeekForward()
+		var ended bool
+		for i := 0; i < 50 && !ended; i++ {
+			p.step(1)
+			for _, e := range p.tap.drain() {
+				if _, ok := e.(QueueEnded); ok {
+					ended = true
+				}
+			}
+		}
+		if !ended {
+			t.Fatal("queue did not end")
+		}
+		// only the last track is left open, and no more than what fits in
+		// the buffer was ever open together
+		if open, peak := counter.counts(); open != 1 || peak > 8 {
+			t.Fatalf("crossfade %v: %d open, %d at most", crossfade, open, peak)
+		}
+
+		// going back opens the last track but one again
+		p.Back()
+		if p.Snapshot().Current.Filepath != paths[38] {
+			t.Fatalf("back to %s", p.Snapshot().Current.Filepath)
+		}
+		written := len(p.client.Written())
+		p.step(1)
+		if len(p.client.Written()) == written {
+			t.Fatal("nothing played after going back")
+		}
+
+		p.Close(context.Background())
+		if open, _ := counter.counts(); open != 0 {
+			t.Fatalf("%d left open", open)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package audio
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNoBackend          = errors.New("no audio backend available on this platform")
+	ErrNoDecoder          = errors.New("no decoder for this type of file")
+	ErrBackendNotFound    = errors.New("no audio backend by that name")
+	ErrBackendUnavailable = errors.New("audio backend failed to initialize")
+)
+
+// Backend is a platform's audio system. Backends register themselves from an
+// init function in a file built only for the platforms they support.
+type Backend struct {
+	Name string
+
+	// Initialize prepares the audio system before any client is made, nil if
+	// there is nothing to prepare
+	Initialize func() error
+
+	// NewClient opens the default output device
+	NewClient func() (AudioClient, error)
+
+	// Sources decodes the formats no native decoder handles, nil if the
+	// backend has no decoders of its own
+	Sources *AudioSourceProvider
+}
+
+// backends in order of preference
+var backends = make([]*Backend, 0)
+
+// the backend in use, chosen by InitializeAudioAPI
+var activeBackend *Backend
+
+// RegisterBackend adds a backend after those already registered, panicking
+// if one by the same name is already there
+func RegisterBackend(backend *Backend) {
+	for _, b := range backends {
+		if b.Name == backend.Name {
+			panic("audio: backend " + backend.Name + " registered twice")
+		}
+	}
+	backends = append(backends, backend)
+}
+
+// Backends lists the names of the backends built for this platform, in
+// order of preference
+func Backends() []string {
+	names := make([]string, len(backends))
+	for i, b := range backends {
+		names[i] = b.Name
+	}
+	return names
+}
+
+// InitializeAudioAPI starts the first backend that initializes, or the one
+// named if a name is given
+func InitializeAudioAPI(name ...string) error {
+	activeBackend = nil
+	if len(backends) == 0 {
+		return ErrNoBackend
+	}
+
+	var errs []error
+	for _, b := range backends {
+		if len(name) > 0 && name[0] != b.Name {
+			continue
+		}
+		if b.Initialize != nil {
+			if err := b.Initialize(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", b.Name, err))
+				continue
+			}
+		}
+		activeBackend = b
+		return nil
+	}
+
+	if len(errs) == 0 {
+		return ErrBackendNotFound
+	}
+	return errors.Join(append([]error{ErrBackendUnavailable}, errs...)...)
+}
+
+func getDefaultClient() (AudioClient, error) {
+	if activeBackend == nil {
+		// callers that skip InitializeAudioAPI get the preferred backend
+		if err := InitializeAudioAPI(); err != nil {
+			return nil, err
+		}
+	}
+	return activeBackend.NewClient()
+}
+
+// getBackendSourceProvider returns the active backend's decoders, or a
+// provider that refuses every file if it has none
+func getBackendSourceProvider() *AudioSourceProvider {
+	if activeBackend != nil && activeBackend.Sources != nil {
+		return activeBackend.Sources
+	}
+	return &AudioSourceProvider{
+		func(metadata *Metadata) (AudioSource, error) {
+			return nil, ErrNoDecoder
+		},
+		func(path string) (*Metadata, error) {
+			return nil, ErrNoDecoder
+		},
+	}
+}
@@ -0,0 +1,111 @@
+package audio
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+// useBackends swaps the registry for one holding only the backends given,
+// in order, for the length of the test
+func useBackends(t *testing.T, list ...*Backend) {
+	t.Helper()
+	saved, savedActive := backends, activeBackend
+	t.Cleanup(func() { backends, activeBackend = saved, savedActive })
+	backends, activeBackend = nil, nil
+	for _, b := range list {
+		RegisterBackend(b)
+	}
+}
+
+// testBackend is a backend called name whose initialization fails with err,
+// and whose clients fail with an error naming it so tests can tell which
+// backend made them
+func testBackend(name string, err error, initialized *[]string) *Backend {
+	return &Backend{
+		Name: name,
+		Initialize: func() error {
+			*initialized = append(*initialized, name)
+			return err
+		},
+		NewClient: func() (AudioClient, error) {
+			return nil, errors.New(name)
+		},
+	}
+}
+
+func TestBackendPreference(t *testing.T) {
+	var initialized []string
+	broken := errors.New("no device")
+	useBackends(t,
+		testBackend("first", broken, &initialized),
+		testBackend("second", nil, &initialized),
+		testBackend("third", nil, &initialized),
+	)
+	if names := Backends(); !slices.Equal(names, []string{"first", "second", "third"}) {
+		t.Fatalf("backends %v", names)
+	}
+
+	// the first to initialize is used, those after it are left alone
+	if err := InitializeAudioAPI(); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(initialized, []string{"first", "second"}) {
+		t.Fatalf("initialized %v", initialized)
+	}
+	if _, err := getDefaultClient(); err == nil || err.Error() != "second" {
+		t.Fatalf("client from %v, expected second", err)
+	}
+
+	// a name picks its backend over any preferred
+	initialized = nil
+	if err := InitializeAudioAPI("third"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getDefaultClient(); err == nil || err.Error() != "third" || !slices.Equal(initialized, []string{"third"}) {
+		t.Fatalf("client from %v after initializing %v, expected third", err, initialized)
+	}
+
+	if err := InitializeAudioAPI("fourth"); !errors.Is(err, ErrBackendNotFound) {
+		t.Fatalf("error %v, expected %v", err, ErrBackendNotFound)
+	}
+	err := InitializeAudioAPI("first")
+	if !errors.Is(err, ErrBackendUnavailable) || !errors.Is(err, broken) {
+		t.Fatalf("error %v, expected %v and %v", err, ErrBackendUnavailable, broken)
+	}
+	if activeBackend != nil {
+		t.Fatalf("backend %s active after failing", activeBackend.Name)
+	}
+}
+
+func TestNoBackend(t *testing.T) {
+	useBackends(t)
+	if err := InitializeAudioAPI(); err != ErrNoBackend {
+		t.Fatalf("error %v, expected %v", err, ErrNoBackend)
+	}
+
+	// clients asked for without initializing meet the same error
+	if _, err := getDefaultClient(); err != ErrNoBackend {
+		t.Fatalf("error %v, expected %v", err, ErrNoBackend)
+	}
+
+	// and no backend decodes anything
+	provider := getBackendSourceProvider()
+	if _, err := provider.GetFileMetadata("a.wma"); err != ErrNoDecoder {
+		t.Fatalf("error %v, expected %v", err, ErrNoDecoder)
+	}
+}
+
+func TestBackendRegisteredTwice(t *testing.T) {
+	var initialized []string
+	useBackends(t, testBackend("first", nil, &initialized))
+	defer func() {
+		if recover() == nil {
+			t.Fatal("no panic")
+		}
+		if names := Backends(); !slices.Equal(names, []string{"first"}) {
+			t.Fatalf("backends %v", names)
+		}
+	}()
+	RegisterBackend(testBackend("first", nil, &initialized))
+}
@@ -0,0 +1,147 @@
+package audio
+
+import "math/bits"
+
+// bitReader reads MSB-first bit fields out of a byte slice. Reads past the
+// end of the data return zero bits and set overrun.
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+
+	overrun bool
+}
+
+func newBitReader(data []byte) *bitReader {
+	return &bitReader{data: data}
+}
+
+func (r *bitReader) readBits(n int) uint32 {
+	return uint32(r.readBits64(n))
+}
+
+func (r *bitReader) readBits64(n int) uint64 {
+	var v uint64
+	for n > 0 {
+		idx := r.pos >> 3
+		if idx >= len(r.data) {
+			r.overrun = true
+			r.pos += n
+			return v << n
+		}
+
+		avail := 8 - r.pos&7
+		take := min(avail, n)
+		b := uint64(r.data[idx]>>(avail-take)) & (1<<take - 1)
+
+		v = v<<take | b
+		n -= take
+		r.pos += take
+	}
+	return v
+}
+
+func (r *bitReader) readBit() bool {
+	return r.readBits(1) == 1
+}
+
+// readSigned reads an n bit two's complement value
+func (r *bitReader) readSigned(n int) int32 {
+	return int32(r.readSigned64(n))
+}
+
+func (r *bitReader) readSigned64(n int) int64 {
+	if n == 0 {
+		return 0
+	}
+	v := r.readBits64(n)
+	return int64(v<<(64-n)) >> (64 - n)
+}
+
+// readUnary counts zero bits up to the next set bit
+func (r *bitReader) readUnary() int {
+	n := 0
+	for {
+		idx := r.pos >> 3
+		if idx >= len(r.data) {
+			r.overrun = true
+			return n
+		}
+
+		// examine the rest of the current byte at once
+		used := r.pos & 7
+		b := r.data[idx] << used
+		if b == 0 {
+			n += 8 - used
+			r.pos += 8 - used
+			continue
+		}
+
+		zeros := bits.LeadingZeros8(b)
+		r.pos += zeros + 1
+		return n + zeros
+	}
+}
+
+func (r *bitReader) skipBits(n int) {
+	r.pos += n
+}
+
+func (r *bitReader) alignByte() {
+	r.pos = (r.pos + 7) &^ 7
+}
+
+func (r *bitReader) bitsLeft() int {
+	return len(r.data)*8 - r.pos
+}
+
+// huffmanTree decodes prefix codes one bit at a time. Node children are
+// indices of further nodes, or -(value+1) for leaves; 0 marks a missing
+// branch since the root is never a child.
+type huffmanTree [][2]int32
+
+// newHuffmanTree builds a tree where the codeword of value i is the lens[i]
+// low bits of codes[i]. Entries with a length of zero are unused.
+func newHuffmanTree(lens []uint8, codes []uint32) huffmanTree {
+	tree := huffmanTree{{0, 0}}
+	for value, length := range lens {
+		if length == 0 {
+			continue
+		}
+
+		node := 0
+		for bit := int(length) - 1; bit >= 0; bit-- {
+			branch := (codes[value] >> bit) & 1
+			if bit == 0 {
+				tree[node][branch] = int32(-(value + 1))
+				break
+			}
+
+			next := tree[node][branch]
+			if next <= 0 {
+				tree = append(tree, [2]int32{0, 0})
+				next = int32(len(tree) - 1)
+				tree[node][branch] = next
+			}
+			node = int(next)
+		}
+	}
+	return tree
+}
+
+// decode reads one codeword, returning -1 if the bits match no code
+func (tree huffmanTree) decode(r *bitReader) int {
+	node := int32(0)
+	for {
+		var bit uint32
+		if r.readBit() {
+			bit = 1
+		}
+
+		node = tree[node][bit]
+		if node < 0 {
+			return int(-node - 1)
+		} else if node == 0 || r.overrun {
+			return -1
+		}
+	}
+}
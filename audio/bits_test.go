@@ -0,0 +1,84 @@
+package audio
+
+import "testing"
+
+// bitWriter packs MSB-first bit fields, the inverse of bitReader
+type bitWriter struct {
+	data []byte
+	pos  int // in bits
+}
+
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.pos&7 == 0 {
+			w.data = append(w.data, 0)
+		}
+		if v>>i&1 != 0 {
+			w.data[len(w.data)-1] |= 0x80 >> (w.pos & 7)
+		}
+		w.pos++
+	}
+}
+
+// writeSigned writes v as an n bit two's complement value
+func (w *bitWriter) writeSigned(v int64, n int) {
+	w.writeBits(uint64(v)&(1<<n-1), n)
+}
+
+// writeUnary writes n zero bits and a set bit
+func (w *bitWriter) writeUnary(n int) {
+	for ; n > 0; n-- {
+		w.writeBits(0, 1)
+	}
+	w.writeBits(1, 1)
+}
+
+func (w *bitWriter) alignByte() {
+	w.pos = (w.pos + 7) &^ 7
+}
+
+func TestBitReader(t *testing.T) {
+	w := &bitWriter{}
+	w.writeBits(5, 3)
+	w.writeSigned(-3, 7)
+	w.writeUnary(13)
+	w.writeBits(0x123456789, 36)
+	w.alignByte()
+	w.writeBits(0xAB, 8)
+
+	r := newBitReader(w.data)
+	if v := r.readBits(3); v != 5 {
+		t.Fatalf("read %d, expected 5", v)
+	}
+	if v := r.readSigned(7); v != -3 {
+		t.Fatalf("read %d, expected -3", v)
+	}
+	if v := r.readUnary(); v != 13 {
+		t.Fatalf("read unary %d, expected 13", v)
+	}
+	if v := r.readBits64(36); v != 0x123456789 {
+		t.Fatalf("read %x, expected 123456789", v)
+	}
+	r.alignByte()
+	if v := r.readBits(8); v != 0xAB || r.bitsLeft() != 0 || r.overrun {
+		t.Fatalf("read %x with %d bits left", v, r.bitsLeft())
+	}
+	if r.readBits(4); !r.overrun {
+		t.Fatal("no overrun reading past the end")
+	}
+
+	tree := newHuffmanTree([]uint8{1, 3, 2, 3}, []uint32{1, 1, 1, 0})
+	w = &bitWriter{}
+	for _, code := range []struct {
+		v uint64
+		n int
+	}{{1, 1}, {1, 2}, {0, 3}, {1, 3}} {
+		w.writeBits(code.v, code.n)
+	}
+	r = newBitReader(w.data)
+	for _, want := range []int{0, 2, 3, 1} {
+		if v := tree.decode(r); v != want {
+			t.Fatalf("decoded %d, expected %d", v, want)
+		}
+	}
+}
@@ -0,0 +1,1967 @@
+package audio
+
+import (
+	"math"
+)
+
+const (
+	CELT_BANDS      = 21
+	CELT_OVERLAP    = 120
+	CELT_SHORT_MDCT = 120 // bins in a 2.5 ms frame
+	CELT_MAX_LM     = 3   // log2 of the most short MDCTs in a frame
+
+	CELT_DECODE_BUFFER_SIZE = 2048
+
+	CELT_MAX_FINE_BITS          = 8
+	CELT_FINE_OFFSET            = 21
+	CELT_QTHETA_OFFSET          = 4
+	CELT_QTHETA_OFFSET_TWOPHASE = 16
+	CELT_ALLOC_STEPS            = 6
+	CELT_LOG_MAX_PSEUDO         = 6
+
+	CELT_COMBFILTER_MIN_PERIOD = 15
+	CELT_PREEMPHASIS           = 0.85000610
+
+	CELT_SPREAD_NONE       = 0
+	CELT_SPREAD_LIGHT      = 1
+	CELT_SPREAD_NORMAL     = 2
+	CELT_SPREAD_AGGRESSIVE = 3
+)
+
+// celtDecoder decodes CELT frames, the MDCT layer of Opus, following the
+// float build of the reference decoder. It keeps the signal history that
+// overlapping frames and the postfilter need.
+type celtDecoder struct {
+	channels       int // output channels
+	streamChannels int // channels coded in the current packet
+
+	// range of bands coded, start is raised above SILK's bandwidth in
+	// hybrid frames
+	start int
+	end   int
+
+	rng          uint32
+	lossDuration int
+	skipPLC      bool
+
+	postfilterPeriod    int
+	postfilterPeriodOld int
+	postfilterGain      float64
+	postfilterGainOld   float64
+	postfilterTapset    int
+	postfilterTapsetOld int
+
+	preemphasis [2]float64
+	history     [2][]float64 // CELT_DECODE_BUFFER_SIZE past samples and the overlap
+
+	oldBandE       [2 * CELT_BANDS]float64
+	oldLogE        [2 * CELT_BANDS]float64
+	oldLogE2       [2 * CELT_BANDS]float64
+	backgroundLogE [2 * CELT_BANDS]float64
+
+	window     []float64
+	transforms [CELT_MAX_LM + 1]*celtMDCT
+}
+
+func newCELTDecoder(channels int) *celtDecoder {
+	dec := &celtDecoder{channels: channels, streamChannels: channels, end: CELT_BANDS}
+	for c := range dec.history {
+		dec.history[c] = make([]float64, CELT_DECODE_BUFFER_SIZE+CELT_OVERLAP)
+	}
+
+	dec.window = make([]float64, CELT_OVERLAP)
+	for i := range dec.window {
+		s := math.Sin(0.5 * math.Pi * (float64(i) + 0.5) / CELT_OVERLAP)
+		dec.window[i] = math.Sin(0.5 * math.Pi * s * s)
+	}
+	for shift := range dec.transforms {
+		dec.transforms[shift] = newCELTMDCT(2 * CELT_SHORT_MDCT << CELT_MAX_LM >> shift)
+	}
+
+	dec.reset()
+	return dec
+}
+
+func (dec *celtDecoder) reset() {
+	dec.rng = 0
+	dec.lossDuration = 0
+	dec.skipPLC = true
+
+	dec.postfilterPeriod, dec.postfilterPeriodOld = 0, 0
+	dec.postfilterGain, dec.postfilterGainOld = 0, 0
+	dec.postfilterTapset, dec.postfilterTapsetOld = 0, 0
+
+	dec.preemphasis = [2]float64{}
+	for c := range dec.history {
+		clear(dec.history[c])
+	}
+
+	dec.oldBandE = [2 * CELT_BANDS]float64{}
+	dec.backgroundLogE = [2 * CELT_BANDS]float64{}
+	for i := range dec.oldLogE {
+		dec.oldLogE[i] = -28
+		dec.oldLogE2[i] = -28
+	}
+}
+
+// decode decodes a frame of frameSize samples per channel from rd into out,
+// interleaved. A nil decoder, or one holding a single byte, conceals a lost
+// frame instead.
+func (dec *celtDecoder) decode(rd *rangeDecoder, frameSize int, out []float64) {
+	lm := 0
+	for lm <= CELT_MAX_LM && CELT_SHORT_MDCT<<lm != frameSize {
+		lm++
+	}
+	m := 1 << lm
+	n := m * CELT_SHORT_MDCT
+
+	if rd == nil || len(rd.buf) <= 1 {
+		dec.conceal(n, lm)
+		dec.deemphasis(n, out)
+		return
+	}
+
+	dec.skipPLC = dec.lossDuration != 0
+
+	cc := dec.channels
+	c := dec.streamChannels
+	start := dec.start
+	end := dec.end
+
+	if c == 1 {
+		for i := 0; i < CELT_BANDS; i++ {
+			dec.oldBandE[i] = max(dec.oldBandE[i], dec.oldBandE[CELT_BANDS+i])
+		}
+	}
+
+	length := len(rd.buf)
+	totalBits := length * 8
+	tell := rd.tell()
+
+	silence := false
+	if tell >= totalBits {
+		silence = true
+	} else if tell == 1 {
+		silence = rd.decodeBitLogp(15)
+	}
+	if silence {
+		// pretend all the remaining bits were read
+		tell = length * 8
+		rd.totalBits += tell - rd.tell()
+	}
+
+	postfilterGain := 0.0
+	postfilterPitch := 0
+	postfilterTapset := 0
+	if start == 0 && tell+16 <= totalBits {
+		if rd.decodeBitLogp(1) {
+			octave := int(rd.decodeUint(6))
+			postfilterPitch = (16 << octave) + int(rd.decodeBits(uint(4+octave))) - 1
+			qg := int(rd.decodeBits(3))
+			if rd.tell()+2 <= totalBits {
+				postfilterTapset = rd.decodeICDF(celtTapsetICDF, 2)
+			}
+			postfilterGain = 0.09375 * float64(qg+1)
+		}
+		tell = rd.tell()
+	}
+
+	transient := false
+	if lm > 0 && tell+3 <= totalBits {
+		transient = rd.decodeBitLogp(3)
+		tell = rd.tell()
+	}
+	shortBlocks := 0
+	if transient {
+		shortBlocks = m
+	}
+
+	intra := false
+	if tell+3 <= totalBits {
+		intra = rd.decodeBitLogp(3)
+	}
+	dec.decodeCoarseEnergy(rd, start, end, intra, c, lm)
+
+	tfRes := make([]int, CELT_BANDS)
+	celtDecodeTF(rd, start, end, transient, tfRes, lm)
+
+	tell = rd.tell()
+	spread := CELT_SPREAD_NORMAL
+	if tell+4 <= totalBits {
+		spread = rd.decodeICDF(celtSpreadICDF, 5)
+	}
+
+	var caps [CELT_BANDS]int
+	for i := range caps {
+		width := (celtBands[i+1] - celtBands[i]) << lm
+		caps[i] = (int(celtCacheCaps[CELT_BANDS*(2*lm+c-1)+i]) + 64) * c * width >> 2
+	}
+
+	// dynamic allocation boosts
+	var offsets [CELT_BANDS]int
+	dynallocLogp := 6
+	totalBits <<= RANGE_BITRES
+	tell = rd.tellFrac()
+	for i := start; i < end; i++ {
+		width := c * (celtBands[i+1] - celtBands[i]) << lm
+		// 6 bits, but no more than 1 bit and no less than 1/8 bit per sample
+		quanta := min(width<<RANGE_BITRES, max(6<<RANGE_BITRES, width))
+		loopLogp := dynallocLogp
+		boost := 0
+		for tell+(loopLogp<<RANGE_BITRES) < totalBits && boost < caps[i] {
+			flag := rd.decodeBitLogp(uint(loopLogp))
+			tell = rd.tellFrac()
+			if !flag {
+				break
+			}
+			boost += quanta
+			totalBits -= quanta
+			loopLogp = 1
+		}
+		offsets[i] = boost
+		if boost > 0 {
+			dynallocLogp = max(2, dynallocLogp-1)
+		}
+	}
+
+	allocTrim := 5
+	if tell+(6<<RANGE_BITRES) <= totalBits {
+		allocTrim = rd.decodeICDF(celtTrimICDF, 7)
+	}
+
+	bits := length*8<<RANGE_BITRES - rd.tellFrac() - 1
+	antiCollapseRsv := 0
+	if transient && lm >= 2 && bits >= (lm+2)<<RANGE_BITRES {
+		antiCollapseRsv = 1 << RANGE_BITRES
+	}
+	bits -= antiCollapseRsv
+
+	alloc := celtAllocation{start: start, end: end, channels: c, lm: lm}
+	codedBands := alloc.compute(rd, offsets[:], caps[:], allocTrim, bits)
+
+	dec.decodeFineEnergy(rd, start, end, alloc.fineQuant[:], c)
+
+	for ch := 0; ch < cc; ch++ {
+		copy(dec.history[ch], dec.history[ch][n:CELT_DECODE_BUFFER_SIZE+CELT_OVERLAP/2])
+	}
+
+	x := make([]float64, c*n)
+	var y []float64
+	if c == 2 {
+		y = x[n:]
+	}
+	collapse := make([]uint8, c*CELT_BANDS)
+	bands := celtBandDecoder{
+		rd:         rd,
+		intensity:  alloc.intensity,
+		spread:     spread,
+		seed:       dec.rng,
+		disableInv: cc == 1,
+	}
+	bands.decodeAll(start, end, x, y, collapse, alloc.pulses[:], shortBlocks, alloc.dualStereo,
+		tfRes, length*(8<<RANGE_BITRES)-antiCollapseRsv, alloc.balance, lm, codedBands)
+	dec.rng = bands.seed
+
+	antiCollapse := false
+	if antiCollapseRsv > 0 {
+		antiCollapse = rd.decodeBits(1) == 1
+	}
+
+	dec.finaliseEnergy(rd, start, end, alloc.fineQuant[:], alloc.finePriority[:], length*8-rd.tell(), c)
+
+	if antiCollapse {
+		dec.antiCollapse(x, collapse, lm, c, n, start, end, alloc.pulses[:], dec.rng)
+	}
+
+	if silence {
+		for i := range dec.oldBandE {
+			dec.oldBandE[i] = -28
+		}
+	}
+
+	dec.synthesis(x, start, min(end, CELT_BANDS), c, transient, lm, silence)
+
+	for ch := 0; ch < cc; ch++ {
+		dec.postfilterPeriod = max(dec.postfilterPeriod, CELT_COMBFILTER_MIN_PERIOD)
+		dec.postfilterPeriodOld = max(dec.postfilterPeriodOld, CELT_COMBFILTER_MIN_PERIOD)
+		syn := CELT_DECODE_BUFFER_SIZE - n
+		dec.combFilter(dec.history[ch], syn, dec.postfilterPeriodOld, dec.postfilterPeriod, CELT_SHORT_MDCT,
+			dec.postfilterGainOld, dec.postfilterGain, dec.postfilterTapsetOld, dec.postfilterTapset, CELT_OVERLAP)
+		if lm != 0 {
+			dec.combFilter(dec.history[ch], syn+CELT_SHORT_MDCT, dec.postfilterPeriod, postfilterPitch, n-CELT_SHORT_MDCT,
+				dec.postfilterGain, postfilterGain, dec.postfilterTapset, postfilterTapset, CELT_OVERLAP)
+		}
+	}
+	dec.postfilterPeriodOld = dec.postfilterPeriod
+	dec.postfilterGainOld = dec.postfilterGain
+	dec.postfilterTapsetOld = dec.postfilterTapset
+	dec.postfilterPeriod = postfilterPitch
+	dec.postfilterGain = postfilterGain
+	dec.postfilterTapset = postfilterTapset
+	if lm != 0 {
+		dec.postfilterPeriodOld = dec.postfilterPeriod
+		dec.postfilterGainOld = dec.postfilterGain
+		dec.postfilterTapsetOld = dec.postfilterTapset
+	}
+
+	if c == 1 {
+		copy(dec.oldBandE[CELT_BANDS:], dec.oldBandE[:CELT_BANDS])
+	}
+
+	if !transient {
+		dec.oldLogE2 = dec.oldLogE
+		dec.oldLogE = dec.oldBandE
+	} else {
+		for i := range dec.oldLogE {
+			dec.oldLogE[i] = min(dec.oldLogE[i], dec.oldBandE[i])
+		}
+	}
+
+	// the noise floor rises by up to 2.4 dB a second
+	maxBackgroundIncrease := float64(min(160, dec.lossDuration+m)) * 0.001
+	for i := range dec.backgroundLogE {
+		dec.backgroundLogE[i] = min(dec.backgroundLogE[i]+maxBackgroundIncrease, dec.oldBandE[i])
+	}
+
+	for ch := 0; ch < 2; ch++ {
+		for i := 0; i < CELT_BANDS; i++ {
+			if i >= start && i < end {
+				continue
+			}
+			dec.oldBandE[ch*CELT_BANDS+i] = 0
+			dec.oldLogE[ch*CELT_BANDS+i] = -28
+			dec.oldLogE2[ch*CELT_BANDS+i] = -28
+		}
+	}
+	dec.rng = rd.rng
+
+	dec.deemphasis(n, out)
+	dec.lossDuration = 0
+}
+
+// conceal fills a lost frame with noise shaped like the last band energies,
+// slowly decaying towards the background noise
+func (dec *celtDecoder) conceal(n int, lm int) {
+	c := dec.channels
+	start := dec.start
+	end := dec.end
+	effEnd := max(start, min(end, CELT_BANDS))
+
+	for ch := 0; ch < c; ch++ {
+		copy(dec.history[ch], dec.history[ch][n:CELT_DECODE_BUFFER_SIZE+CELT_OVERLAP/2])
+	}
+
+	decay := 0.5
+	if dec.lossDuration == 0 {
+		decay = 1.5
+	}
+	for ch := 0; ch < c; ch++ {
+		for i := start; i < end; i++ {
+			k := ch*CELT_BANDS + i
+			dec.oldBandE[k] = max(dec.backgroundLogE[k], dec.oldBandE[k]-decay)
+		}
+	}
+
+	x := make([]float64, c*n)
+	seed := dec.rng
+	for ch := 0; ch < c; ch++ {
+		for i := start; i < effEnd; i++ {
+			offset := n*ch + celtBands[i]<<lm
+			width := (celtBands[i+1] - celtBands[i]) << lm
+			for j := 0; j < width; j++ {
+				seed = celtLCG(seed)
+				x[offset+j] = float64(int32(seed) >> 20)
+			}
+			celtRenormalise(x[offset:offset+width], 1)
+		}
+	}
+	dec.rng = seed
+
+	streamChannels := dec.streamChannels
+	dec.streamChannels = c
+	dec.synthesis(x, start, effEnd, c, false, lm, false)
+	dec.streamChannels = streamChannels
+
+	dec.lossDuration = min(10000, dec.lossDuration+1<<lm)
+}
+
+// decodeCoarseEnergy reads the band energies at a 6 dB resolution, predicted
+// from the previous frame and the band below
+func (dec *celtDecoder) decodeCoarseEnergy(rd *rangeDecoder, start int, end int, intra bool, c int, lm int) {
+	model := celtEnergyProbModel[lm][0][:]
+	coef := celtPredCoef[lm]
+	beta := celtBetaCoef[lm]
+	if intra {
+		model = celtEnergyProbModel[lm][1][:]
+		coef = 0
+		beta = CELT_BETA_INTRA
+	}
+
+	var prev [2]float64
+	budget := len(rd.buf) * 8
+	for i := start; i < end; i++ {
+		for ch := 0; ch < c; ch++ {
+			var qi int
+			tell := rd.tell()
+			switch {
+			case budget-tell >= 15:
+				pi := 2 * min(i, 20)
+				qi = rd.decodeLaplace(uint32(model[pi])<<7, int(model[pi+1])<<6)
+			case budget-tell >= 2:
+				qi = rd.decodeICDF(celtSmallEnergyICDF, 2)
+				qi = qi>>1 ^ -(qi & 1)
+			case budget-tell >= 1:
+				qi = 0
+				if rd.decodeBitLogp(1) {
+					qi = -1
+				}
+			default:
+				qi = -1
+			}
+			q := float64(qi)
+
+			k := ch*CELT_BANDS + i
+			dec.oldBandE[k] = max(-9, dec.oldBandE[k])
+			dec.oldBandE[k] = coef*dec.oldBandE[k] + prev[ch] + q
+			prev[ch] = prev[ch] + q - beta*q
+		}
+	}
+}
+
+func (dec *celtDecoder) decodeFineEnergy(rd *rangeDecoder, start int, end int, fineQuant []int, c int) {
+	for i := start; i < end; i++ {
+		if fineQuant[i] <= 0 {
+			continue
+		}
+		for ch := 0; ch < c; ch++ {
+			q2 := rd.decodeBits(uint(fineQuant[i]))
+			offset := (float64(q2)+0.5)*float64(int(1)<<(14-fineQuant[i]))/16384 - 0.5
+			dec.oldBandE[ch*CELT_BANDS+i] += offset
+		}
+	}
+}
+
+// finaliseEnergy spends the bits left at the end of the frame on one more
+// bit of energy resolution per band
+func (dec *celtDecoder) finaliseEnergy(rd *rangeDecoder, start int, end int, fineQuant []int, finePriority []int, bitsLeft int, c int) {
+	for prio := 0; prio < 2; prio++ {
+		for i := start; i < end && bitsLeft >= c; i++ {
+			if fineQuant[i] >= CELT_MAX_FINE_BITS || finePriority[i] != prio {
+				continue
+			}
+			for ch := 0; ch < c; ch++ {
+				q2 := rd.decodeBits(1)
+				offset := (float64(q2) - 0.5) * float64(int(1)<<(14-fineQuant[i]-1)) / 16384
+				dec.oldBandE[ch*CELT_BANDS+i] += offset
+				bitsLeft--
+			}
+		}
+	}
+}
+
+func celtDecodeTF(rd *rangeDecoder, start int, end int, transient bool, tfRes []int, lm int) {
+	budget := len(rd.buf) * 8
+	tell := rd.tell()
+	logp := 4
+	if transient {
+		logp = 2
+	}
+
+	selectRsv := 0
+	if lm > 0 && tell+logp+1 <= budget {
+		selectRsv = 1
+	}
+	budget -= selectRsv
+
+	changed := 0
+	curr := 0
+	for i := start; i < end; i++ {
+		if tell+logp <= budget {
+			if rd.decodeBitLogp(uint(logp)) {
+				curr ^= 1
+			}
+			tell = rd.tell()
+			changed |= curr
+		}
+		tfRes[i] = curr
+		logp = 5
+		if transient {
+			logp = 4
+		}
+	}
+
+	t := 0
+	if transient {
+		t = 4
+	}
+	tfSelect := 0
+	if selectRsv != 0 && celtTFSelect[lm][t+changed] != celtTFSelect[lm][t+2+changed] {
+		if rd.decodeBitLogp(1) {
+			tfSelect = 1
+		}
+	}
+	for i := start; i < end; i++ {
+		tfRes[i] = celtTFSelect[lm][t+2*tfSelect+tfRes[i]]
+	}
+}
+
+// antiCollapse fills short blocks that received no pulses with noise, so a
+// transient frame does not leave holes in time
+func (dec *celtDecoder) antiCollapse(x []float64, collapse []uint8, lm int, c int, size int, start int, end int, pulses []int, seed uint32) {
+	for i := start; i < end; i++ {
+		n0 := celtBands[i+1] - celtBands[i]
+		// depth in 1/8 bits
+		depth := (1 + pulses[i]) / n0 >> lm
+
+		thresh := 0.5 * math.Exp2(-0.125*float64(depth))
+		sqrt1 := 1 / math.Sqrt(float64(n0<<lm))
+
+		for ch := 0; ch < c; ch++ {
+			prev1 := dec.oldLogE[ch*CELT_BANDS+i]
+			prev2 := dec.oldLogE2[ch*CELT_BANDS+i]
+			if c == 1 {
+				prev1 = max(prev1, dec.oldLogE[CELT_BANDS+i])
+				prev2 = max(prev2, dec.oldLogE2[CELT_BANDS+i])
+			}
+			ediff := max(0, dec.oldBandE[ch*CELT_BANDS+i]-min(prev1, prev2))
+
+			// short blocks have less energy than long ones
+			r := 2 * math.Exp2(-ediff)
+			if lm == 3 {
+				r *= 1.41421356
+			}
+			r = min(thresh, r) * sqrt1
+
+			band := x[ch*size+celtBands[i]<<lm:]
+			renormalise := false
+			for k := 0; k < 1<<lm; k++ {
+				if collapse[i*c+ch]&(1<<k) != 0 {
+					continue
+				}
+				for j := 0; j < n0; j++ {
+					seed = celtLCG(seed)
+					if seed&0x8000 != 0 {
+						band[j<<lm+k] = r
+					} else {
+						band[j<<lm+k] = -r
+					}
+				}
+				renormalise = true
+			}
+			if renormalise {
+				celtRenormalise(band[:n0<<lm], 1)
+			}
+		}
+	}
+}
+
+// synthesis scales the normalised bands by their energies and runs the
+// inverse MDCTs into the end of the history
+func (dec *celtDecoder) synthesis(x []float64, start int, effEnd int, c int, transient bool, lm int, silence bool) {
+	cc := dec.channels
+	m := 1 << lm
+	n := m * CELT_SHORT_MDCT
+
+	b := 1
+	nb := n
+	shift := CELT_MAX_LM - lm
+	if transient {
+		b = m
+		nb = CELT_SHORT_MDCT
+		shift = CELT_MAX_LM
+	}
+	transform := dec.transforms[shift]
+
+	freq := make([]float64, n)
+	syn := CELT_DECODE_BUFFER_SIZE - n
+	switch {
+	case cc == 2 && c == 1:
+		celtDenormalise(x, freq, dec.oldBandE[:], start, effEnd, m, silence)
+		freq2 := append([]float64(nil), freq...)
+		for k := 0; k < b; k++ {
+			transform.backward(freq2[k:], b, dec.history[0][syn+nb*k:], dec.window)
+		}
+		for k := 0; k < b; k++ {
+			transform.backward(freq[k:], b, dec.history[1][syn+nb*k:], dec.window)
+		}
+	case cc == 1 && c == 2:
+		// downmix
+		freq2 := make([]float64, n)
+		celtDenormalise(x, freq, dec.oldBandE[:], start, effEnd, m, silence)
+		celtDenormalise(x[n:], freq2, dec.oldBandE[CELT_BANDS:], start, effEnd, m, silence)
+		for i := range freq {
+			freq[i] = 0.5*freq[i] + 0.5*freq2[i]
+		}
+		for k := 0; k < b; k++ {
+			transform.backward(freq[k:], b, dec.history[0][syn+nb*k:], dec.window)
+		}
+	default:
+		for ch := 0; ch < cc; ch++ {
+			celtDenormalise(x[ch*n:], freq, dec.oldBandE[ch*CELT_BANDS:], start, effEnd, m, silence)
+			for k := 0; k < b; k++ {
+				transform.backward(freq[k:], b, dec.history[ch][syn+nb*k:], dec.window)
+			}
+		}
+	}
+}
+
+func celtDenormalise(x []float64, freq []float64, bandLogE []float64, start int, end int, m int, silence bool) {
+	n := m * CELT_SHORT_MDCT
+	bound := m * celtBands[end]
+	if silence {
+		bound = 0
+		start, end = 0, 0
+	}
+
+	clear(freq[:m*celtBands[start]])
+	for i := start; i < end; i++ {
+		g := math.Exp2(min(32, bandLogE[i]+celtEnergyMeans[i]))
+		for j := m * celtBands[i]; j < m*celtBands[i+1]; j++ {
+			freq[j] = x[j] * g
+		}
+	}
+	clear(freq[bound:n])
+}
+
+// combFilter applies the pitch postfilter in place to the n samples of x
+// from offset, crossfading from the old filter to the new one over the
+// first overlap samples
+func (dec *celtDecoder) combFilter(x []float64, offset int, t0 int, t1 int, n int, g0 float64, g1 float64, tapset0 int, tapset1 int, overlap int) {
+	if g0 == 0 && g1 == 0 {
+		return
+	}
+
+	t0 = max(t0, CELT_COMBFILTER_MIN_PERIOD)
+	t1 = max(t1, CELT_COMBFILTER_MIN_PERIOD)
+	g00 := g0 * celtCombGains[tapset0][0]
+	g01 := g0 * celtCombGains[tapset0][1]
+	g02 := g0 * celtCombGains[tapset0][2]
+	g10 := g1 * celtCombGains[tapset1][0]
+	g11 := g1 * celtCombGains[tapset1][1]
+	g12 := g1 * celtCombGains[tapset1][2]
+
+	// the overlap is only needed when the filter changes
+	if g0 == g1 && t0 == t1 && tapset0 == tapset1 {
+		overlap = 0
+	}
+
+	y := x[offset:]
+	i := 0
+	for ; i < overlap; i++ {
+		j := offset + i
+		f := dec.window[i] * dec.window[i]
+		y[i] = x[j] +
+			(1-f)*g00*x[j-t0] +
+			(1-f)*g01*(x[j-t0+1]+x[j-t0-1]) +
+			(1-f)*g02*(x[j-t0+2]+x[j-t0-2]) +
+			f*g10*x[j-t1] +
+			f*g11*(x[j-t1+1]+x[j-t1-1]) +
+			f*g12*(x[j-t1+2]+x[j-t1-2])
+	}
+	if g1 == 0 {
+		return
+	}
+
+	for ; i < n; i++ {
+		j := offset + i
+		y[i] = x[j] +
+			g10*x[j-t1] +
+			g11*(x[j-t1+1]+x[j-t1-1]) +
+			g12*(x[j-t1+2]+x[j-t1-2])
+	}
+}
+
+// deemphasis undoes the encoder's pre-emphasis on the new samples and
+// writes them out interleaved
+func (dec *celtDecoder) deemphasis(n int, out []float64) {
+	cc := dec.channels
+	for ch := 0; ch < cc; ch++ {
+		x := dec.history[ch][CELT_DECODE_BUFFER_SIZE-n:]
+		mem := dec.preemphasis[ch]
+		for j := 0; j < n; j++ {
+			tmp := x[j] + 1e-30 + mem
+			mem = CELT_PREEMPHASIS * tmp
+			out[j*cc+ch] = tmp / 32768
+		}
+		dec.preemphasis[ch] = mem
+	}
+}
+
+// celtAllocation splits the bits of a frame between the bands, and within
+// each band between fine energy and the shape
+type celtAllocation struct {
+	start    int
+	end      int
+	channels int
+	lm       int
+
+	pulses       [CELT_BANDS]int // shape bits, in 1/8 bits
+	fineQuant    [CELT_BANDS]int
+	finePriority [CELT_BANDS]int
+
+	intensity  int
+	dualStereo bool
+	balance    int
+}
+
+func (a *celtAllocation) compute(rd *rangeDecoder, offsets []int, caps []int, allocTrim int, total int) int {
+	c := a.channels
+	lm := a.lm
+	start := a.start
+	end := a.end
+
+	total = max(total, 0)
+	skipStart := start
+	// reserve a bit to signal the end of manually skipped bands
+	skipRsv := 0
+	if total >= 1<<RANGE_BITRES {
+		skipRsv = 1 << RANGE_BITRES
+	}
+	total -= skipRsv
+
+	// and bits for the intensity and dual stereo parameters
+	intensityRsv, dualStereoRsv := 0, 0
+	if c == 2 {
+		intensityRsv = celtLog2Frac[end-start]
+		if intensityRsv > total {
+			intensityRsv = 0
+		} else {
+			total -= intensityRsv
+			if total >= 1<<RANGE_BITRES {
+				dualStereoRsv = 1 << RANGE_BITRES
+			}
+			total -= dualStereoRsv
+		}
+	}
+
+	var bits1, bits2, thresh, trimOffset [CELT_BANDS]int
+	for j := start; j < end; j++ {
+		width := celtBands[j+1] - celtBands[j]
+		// below this, no PVQ bits are allocated
+		thresh[j] = max(c<<RANGE_BITRES, (3*width<<lm<<RANGE_BITRES)>>4)
+		// tilt of the allocation curve
+		trimOffset[j] = c * width * (allocTrim - 5 - lm) * (end - j - 1) * (1 << (lm + RANGE_BITRES)) >> 6
+		// single coefficient bands benefit more from coarse energy
+		if width<<lm == 1 {
+			trimOffset[j] -= c << RANGE_BITRES
+		}
+	}
+
+	lo := 1
+	hi := len(celtBandAllocation) - 1
+	for lo <= hi {
+		done := false
+		psum := 0
+		mid := (lo + hi) >> 1
+		for j := end - 1; j >= start; j-- {
+			width := celtBands[j+1] - celtBands[j]
+			bitsj := c * width * int(celtBandAllocation[mid][j]) << lm >> 2
+			if bitsj > 0 {
+				bitsj = max(0, bitsj+trimOffset[j])
+			}
+			bitsj += offsets[j]
+			if bitsj >= thresh[j] || done {
+				done = true
+				psum += min(bitsj, caps[j])
+			} else if bitsj >= c<<RANGE_BITRES {
+				psum += c << RANGE_BITRES
+			}
+		}
+		if psum > total {
+			hi = mid - 1
+		} else {
+			lo = mid + 1
+		}
+	}
+	hi = lo
+	lo--
+
+	for j := start; j < end; j++ {
+		width := celtBands[j+1] - celtBands[j]
+		bits1j := c * width * int(celtBandAllocation[lo][j]) << lm >> 2
+		bits2j := caps[j]
+		if hi < len(celtBandAllocation) {
+			bits2j = c * width * int(celtBandAllocation[hi][j]) << lm >> 2
+		}
+		if bits1j > 0 {
+			bits1j = max(0, bits1j+trimOffset[j])
+		}
+		if bits2j > 0 {
+			bits2j = max(0, bits2j+trimOffset[j])
+		}
+		if lo > 0 {
+			bits1j += offsets[j]
+		}
+		bits2j += offsets[j]
+		if offsets[j] > 0 {
+			skipStart = j
+		}
+		bits1[j] = bits1j
+		bits2[j] = max(0, bits2j-bits1j)
+	}
+
+	return a.interpolate(rd, skipStart, bits1[:], bits2[:], thresh[:], caps, total, skipRsv, intensityRsv, dualStereoRsv)
+}
+
+func (a *celtAllocation) interpolate(rd *rangeDecoder, skipStart int, bits1 []int, bits2 []int, thresh []int, caps []int, total int, skipRsv int, intensityRsv int, dualStereoRsv int) int {
+	c := a.channels
+	lm := a.lm
+	start := a.start
+	end := a.end
+	bits := a.pulses[:]
+	ebits := a.fineQuant[:]
+
+	allocFloor := c << RANGE_BITRES
+	stereo := 0
+	if c > 1 {
+		stereo = 1
+	}
+	logM := lm << RANGE_BITRES
+
+	lo := 0
+	hi := 1 << CELT_ALLOC_STEPS
+	for i := 0; i < CELT_ALLOC_STEPS; i++ {
+		mid := (lo + hi) >> 1
+		psum := 0
+		done := false
+		for j := end - 1; j >= start; j-- {
+			tmp := bits1[j] + (mid * bits2[j] >> CELT_ALLOC_STEPS)
+			if tmp >= thresh[j] || done {
+				done = true
+				// don't allocate more than can be used
+				psum += min(tmp, caps[j])
+			} else if tmp >= allocFloor {
+				psum += allocFloor
+			}
+		}
+		if psum > total {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+
+	psum := 0
+	done := false
+	for j := end - 1; j >= start; j-- {
+		tmp := bits1[j] + (lo * bits2[j] >> CELT_ALLOC_STEPS)
+		if tmp < thresh[j] && !done {
+			if tmp >= allocFloor {
+				tmp = allocFloor
+			} else {
+				tmp = 0
+			}
+		} else {
+			done = true
+		}
+		tmp = min(tmp, caps[j])
+		bits[j] = tmp
+		psum += tmp
+	}
+
+	// decide which bands to skip, working down from the top
+	codedBands := end
+	for ; ; codedBands-- {
+		j := codedBands - 1
+		// never skip the first band, nor one boosted by dynalloc
+		if j <= skipStart {
+			total += skipRsv
+			break
+		}
+
+		// the left over bits this band would get, including those taken
+		// back from higher bands that were skipped
+		left := total - psum
+		percoeff := left / (celtBands[codedBands] - celtBands[start])
+		left -= (celtBands[codedBands] - celtBands[start]) * percoeff
+		rem := max(left-(celtBands[j]-celtBands[start]), 0)
+		bandWidth := celtBands[codedBands] - celtBands[j]
+		bandBits := bits[j] + percoeff*bandWidth + rem
+
+		// a skip flag is only coded for bands above the threshold, others
+		// are skipped outright
+		if bandBits >= max(thresh[j], allocFloor+(1<<RANGE_BITRES)) {
+			if rd.decodeBitLogp(1) {
+				break
+			}
+			psum += 1 << RANGE_BITRES
+			bandBits -= 1 << RANGE_BITRES
+		}
+
+		// reclaim the bits given to this band
+		psum -= bits[j] + intensityRsv
+		if intensityRsv > 0 {
+			intensityRsv = celtLog2Frac[j-start]
+		}
+		psum += intensityRsv
+		if bandBits >= allocFloor {
+			// enough for a fine energy bit per channel
+			psum += allocFloor
+			bits[j] = allocFloor
+		} else {
+			bits[j] = 0
+		}
+	}
+
+	if intensityRsv > 0 {
+		a.intensity = start + int(rd.decodeUint(uint32(codedBands+1-start)))
+	} else {
+		a.intensity = 0
+	}
+	if a.intensity <= start {
+		total += dualStereoRsv
+		dualStereoRsv = 0
+	}
+	a.dualStereo = false
+	if dualStereoRsv > 0 {
+		a.dualStereo = rd.decodeBitLogp(1)
+	}
+
+	// spread the remaining bits
+	left := total - psum
+	percoeff := left / (celtBands[codedBands] - celtBands[start])
+	left -= (celtBands[codedBands] - celtBands[start]) * percoeff
+	for j := start; j < codedBands; j++ {
+		bits[j] += percoeff * (celtBands[j+1] - celtBands[j])
+	}
+	for j := start; j < codedBands; j++ {
+		tmp := min(left, celtBands[j+1]-celtBands[j])
+		bits[j] += tmp
+		left -= tmp
+	}
+
+	balance := 0
+	j := start
+	for ; j < codedBands; j++ {
+		n0 := celtBands[j+1] - celtBands[j]
+		n := n0 << lm
+		bit := bits[j] + balance
+		var excess int
+
+		if n > 1 {
+			excess = max(bit-caps[j], 0)
+			bits[j] = bit - excess
+
+			// compensate for the extra degree of freedom in stereo
+			den := c * n
+			if c == 2 && n > 2 && !a.dualStereo && j < a.intensity {
+				den++
+			}
+			nClogN := den * (celtLogN[j] + logM)
+
+			// offset the fine bits by log2(N)/2 + CELT_FINE_OFFSET compared to
+			// their fair share of total/N
+			offset := (nClogN >> 1) - den*CELT_FINE_OFFSET
+			// N=2 is the only point that doesn't match the curve
+			if n == 2 {
+				offset += den << RANGE_BITRES >> 2
+			}
+			// change the offset for the second and third fine energy bits
+			if bits[j]+offset < den*2<<RANGE_BITRES {
+				offset += nClogN >> 2
+			} else if bits[j]+offset < den*3<<RANGE_BITRES {
+				offset += nClogN >> 3
+			}
+
+			ebits[j] = max(0, bits[j]+offset+(den<<(RANGE_BITRES-1)))
+			ebits[j] = ebits[j] / den >> RANGE_BITRES
+
+			// don't bust the budget
+			if c*ebits[j] > bits[j]>>RANGE_BITRES {
+				ebits[j] = bits[j] >> stereo >> RANGE_BITRES
+			}
+			// PVQ can't make use of more than this
+			ebits[j] = min(ebits[j], CELT_MAX_FINE_BITS)
+
+			// bands that were rounded down or capped are candidates for the
+			// final fine energy pass
+			a.finePriority[j] = 0
+			if ebits[j]*(den<<RANGE_BITRES) >= bits[j]+offset {
+				a.finePriority[j] = 1
+			}
+
+			// the rest goes to PVQ
+			bits[j] -= c * ebits[j] << RANGE_BITRES
+		} else {
+			// all bits go to fine energy but for a sign bit
+			excess = max(0, bit-(c<<RANGE_BITRES))
+			bits[j] = bit - excess
+			ebits[j] = 0
+			a.finePriority[j] = 1
+		}
+
+		// rebalance what fine energy can't take advantage of later
+		if excess > 0 {
+			extraFine := min(excess>>(stereo+RANGE_BITRES), CELT_MAX_FINE_BITS-ebits[j])
+			ebits[j] += extraFine
+			extraBits := extraFine * c << RANGE_BITRES
+			a.finePriority[j] = 0
+			if extraBits >= excess-balance {
+				a.finePriority[j] = 1
+			}
+			excess -= extraBits
+		}
+		balance = excess
+	}
+	a.balance = balance
+
+	// skipped bands use all their bits for fine energy
+	for ; j < end; j++ {
+		ebits[j] = bits[j] >> stereo >> RANGE_BITRES
+		bits[j] = 0
+		a.finePriority[j] = 0
+		if ebits[j] < 1 {
+			a.finePriority[j] = 1
+		}
+	}
+
+	return codedBands
+}
+
+func celtCache(band int, lm int) []uint8 {
+	return celtCacheBits[celtPulseCache[(lm+1)*CELT_BANDS+band]:]
+}
+
+func celtBitsToPulses(band int, lm int, bits int) int {
+	cache := celtCache(band, lm)
+
+	lo := 0
+	hi := int(cache[0])
+	bits--
+	for i := 0; i < CELT_LOG_MAX_PSEUDO; i++ {
+		mid := (lo + hi + 1) >> 1
+		if int(cache[mid]) >= bits {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+
+	loBits := -1
+	if lo != 0 {
+		loBits = int(cache[lo])
+	}
+	if bits-loBits <= int(cache[hi])-bits {
+		return lo
+	}
+	return hi
+}
+
+func celtPulsesToBits(band int, lm int, pulses int) int {
+	if pulses == 0 {
+		return 0
+	}
+	return int(celtCache(band, lm)[pulses]) + 1
+}
+
+func celtGetPulses(i int) int {
+	if i < 8 {
+		return i
+	}
+	return (8 + i&7) << (i>>3 - 1)
+}
+
+func celtLCG(seed uint32) uint32 {
+	return 1664525*seed + 1013904223
+}
+
+func celtRenormalise(x []float64, gain float64) {
+	e := 1e-15
+	for _, v := range x {
+		e += v * v
+	}
+	g := gain / math.Sqrt(e)
+	for i := range x {
+		x[i] *= g
+	}
+}
+
+// celtBandDecoder decodes the normalised shape of every band with pyramid
+// vector quantisation, recursively splitting bands that are given more bits
+// than a single codebook can use
+type celtBandDecoder struct {
+	rd *rangeDecoder
+
+	band          int
+	intensity     int
+	spread        int
+	tfChange      int
+	remainingBits int
+	seed          uint32
+	disableInv    bool
+
+	// avoid injecting noise in the first band on transients
+	avoidSplitNoise bool
+}
+
+func (ctx *celtBandDecoder) decodeAll(start int, end int, x []float64, y []float64, collapse []uint8, pulses []int, shortBlocks int, dualStereo bool, tfRes []int, totalBits int, balance int, lm int, codedBands int) {
+	m := 1 << lm
+	b := 1
+	if shortBlocks != 0 {
+		b = m
+	}
+	c := 1
+	if y != nil {
+		c = 2
+	}
+
+	normOffset := m * celtBands[start]
+	// the last band's output is never folded from
+	normSize := m*celtBands[CELT_BANDS-1] - normOffset
+	norm := make([]float64, 2*normSize)
+	norm2 := norm[normSize:]
+	scratch := make([]float64, m*(celtBands[CELT_BANDS]-celtBands[CELT_BANDS-1]))
+
+	ctx.avoidSplitNoise = b > 1
+
+	lowbandOffset := 0
+	updateLowband := true
+	for i := start; i < end; i++ {
+		ctx.band = i
+		last := i == end-1
+
+		bx := x[m*celtBands[i]:]
+		var by []float64
+		if y != nil {
+			by = y[m*celtBands[i]:]
+		}
+		n := m*celtBands[i+1] - m*celtBands[i]
+
+		tell := ctx.rd.tellFrac()
+		if i != start {
+			balance -= tell
+		}
+		remainingBits := totalBits - tell - 1
+		ctx.remainingBits = remainingBits
+
+		bits := 0
+		if i <= codedBands-1 {
+			currBalance := balance / min(3, codedBands-i)
+			bits = max(0, min(16383, min(remainingBits+1, pulses[i]+currBalance)))
+		}
+
+		if (m*celtBands[i]-n >= m*celtBands[start] || i == start+1) && (updateLowband || lowbandOffset == 0) {
+			lowbandOffset = i
+		}
+		if i == start+1 {
+			// duplicate enough of the first band to fold the second
+			n1 := m * (celtBands[start+1] - celtBands[start])
+			n2 := m * (celtBands[start+2] - celtBands[start+1])
+			copy(norm[n1:n2], norm[2*n1-n2:n1])
+			if dualStereo {
+				copy(norm2[n1:n2], norm2[2*n1-n2:n1])
+			}
+		}
+
+		ctx.tfChange = tfRes[i]
+		bandScratch := scratch
+		if last {
+			bandScratch = nil
+		}
+
+		// a conservative estimate of the collapse masks of the bands to be
+		// folded from
+		effectiveLowband := -1
+		var xcm, ycm uint
+		if lowbandOffset != 0 && (ctx.spread != CELT_SPREAD_AGGRESSIVE || b > 1 || ctx.tfChange < 0) {
+			// never repeat spectral content within one band
+			effectiveLowband = max(0, m*celtBands[lowbandOffset]-normOffset-n)
+			foldStart := lowbandOffset - 1
+			for m*celtBands[foldStart] > effectiveLowband+normOffset {
+				foldStart--
+			}
+			foldEnd := lowbandOffset
+			for foldEnd < i && m*celtBands[foldEnd] < effectiveLowband+normOffset+n {
+				foldEnd++
+			}
+			for foldI := foldStart; ; {
+				xcm |= uint(collapse[foldI*c])
+				ycm |= uint(collapse[foldI*c+c-1])
+				foldI++
+				if foldI >= foldEnd {
+					break
+				}
+			}
+		} else {
+			// the LCG will be used to fold, so all blocks are likely non-zero
+			xcm = 1<<b - 1
+			ycm = xcm
+		}
+
+		if dualStereo && i == ctx.intensity {
+			// switch off dual stereo to do intensity
+			dualStereo = false
+			for j := 0; j < m*celtBands[i]-normOffset; j++ {
+				norm[j] = 0.5 * (norm[j] + norm2[j])
+			}
+		}
+
+		var lowband, lowband2, lowbandOut, lowbandOut2 []float64
+		if effectiveLowband != -1 {
+			lowband = norm[effectiveLowband:]
+			lowband2 = norm2[effectiveLowband:]
+		}
+		if !last {
+			lowbandOut = norm[m*celtBands[i]-normOffset:]
+			lowbandOut2 = norm2[m*celtBands[i]-normOffset:]
+		}
+
+		if dualStereo {
+			xcm = ctx.decodeBand(bx, n, bits/2, b, lowband, lm, lowbandOut, 1, bandScratch, xcm)
+			ycm = ctx.decodeBand(by, n, bits/2, b, lowband2, lm, lowbandOut2, 1, bandScratch, ycm)
+		} else {
+			if by != nil {
+				xcm = ctx.decodeBandStereo(bx, by, n, bits, b, lowband, lm, lowbandOut, bandScratch, xcm|ycm)
+			} else {
+				xcm = ctx.decodeBand(bx, n, bits, b, lowband, lm, lowbandOut, 1, bandScratch, xcm|ycm)
+			}
+			ycm = xcm
+		}
+		collapse[i*c] = uint8(xcm)
+		collapse[i*c+c-1] = uint8(ycm)
+		balance += pulses[i] + tell
+
+		// the folding position only moves while there is 1 bit per sample
+		updateLowband = bits > n<<RANGE_BITRES
+		ctx.avoidSplitNoise = false
+	}
+}
+
+// celtSplit describes how a band was divided between mid and side, or
+// between its two halves
+type celtSplit struct {
+	inv    bool
+	imid   int
+	iside  int
+	delta  int
+	itheta int
+	qalloc int
+}
+
+func celtComputeQN(n int, b int, offset int, pulseCap int, stereo bool) int {
+	n2 := 2*n - 1
+	if stereo && n == 2 {
+		n2--
+	}
+	// leave enough bits to code at least one pulse in the side of a stereo
+	// split with itheta==16384, since it won't be folded
+	qb := (b + n2*offset) / n2
+	qb = min(b-pulseCap-(4<<RANGE_BITRES), qb)
+	qb = min(8<<RANGE_BITRES, qb)
+	if qb < 1<<RANGE_BITRES>>1 {
+		return 1
+	}
+	qn := celtExp2Table8[qb&0x7] >> (14 - qb>>RANGE_BITRES)
+	return (qn + 1) >> 1 << 1
+}
+
+func (ctx *celtBandDecoder) computeTheta(n int, b *int, bands int, bands0 int, lm int, stereo bool, fill *uint) celtSplit {
+	rd := ctx.rd
+	var split celtSplit
+
+	// the resolution given to the split angle
+	pulseCap := celtLogN[ctx.band] + lm*(1<<RANGE_BITRES)
+	offset := pulseCap >> 1
+	if stereo && n == 2 {
+		offset -= CELT_QTHETA_OFFSET_TWOPHASE
+	} else {
+		offset -= CELT_QTHETA_OFFSET
+	}
+	qn := celtComputeQN(n, *b, offset, pulseCap, stereo)
+	if stereo && ctx.band >= ctx.intensity {
+		qn = 1
+	}
+
+	itheta := 0
+	tell := rd.tellFrac()
+	if qn != 1 {
+		switch {
+		case stereo && n > 2:
+			// a step pdf
+			const p0 = 3
+			x0 := qn / 2
+			ft := uint32(p0*(x0+1) + x0)
+			fs := int(rd.decode(ft))
+			var x int
+			if fs < (x0+1)*p0 {
+				x = fs / p0
+			} else {
+				x = x0 + 1 + (fs - (x0+1)*p0)
+			}
+			if x <= x0 {
+				rd.update(uint32(p0*x), uint32(p0*(x+1)), ft)
+			} else {
+				rd.update(uint32((x-1-x0)+(x0+1)*p0), uint32((x-x0)+(x0+1)*p0), ft)
+			}
+			itheta = x
+		case bands0 > 1 || stereo:
+			itheta = int(rd.decodeUint(uint32(qn + 1)))
+		default:
+			// a triangular pdf
+			ft := ((qn >> 1) + 1) * ((qn >> 1) + 1)
+			fm := int(rd.decode(uint32(ft)))
+			var fs, fl int
+			if fm < ((qn>>1)*((qn>>1)+1))>>1 {
+				itheta = (celtISqrt(uint32(8*fm+1)) - 1) >> 1
+				fs = itheta + 1
+				fl = itheta * (itheta + 1) >> 1
+			} else {
+				itheta = (2*(qn+1) - celtISqrt(uint32(8*(ft-fm-1)+1))) >> 1
+				fs = qn + 1 - itheta
+				fl = ft - ((qn + 1 - itheta) * (qn + 2 - itheta) >> 1)
+			}
+			rd.update(uint32(fl), uint32(fl+fs), uint32(ft))
+		}
+		itheta = itheta * 16384 / qn
+	} else if stereo {
+		if *b > 2<<RANGE_BITRES && ctx.remainingBits > 2<<RANGE_BITRES {
+			split.inv = rd.decodeBitLogp(2)
+		}
+		// to avoid problems with downmixing
+		if ctx.disableInv {
+			split.inv = false
+		}
+		itheta = 0
+	}
+	split.qalloc = rd.tellFrac() - tell
+	*b -= split.qalloc
+
+	switch itheta {
+	case 0:
+		split.imid = 32767
+		split.iside = 0
+		*fill &= 1<<bands - 1
+		split.delta = -16384
+	case 16384:
+		split.imid = 0
+		split.iside = 32767
+		*fill &= (1<<bands - 1) << bands
+		split.delta = 16384
+	default:
+		split.imid = celtBitexactCos(itheta)
+		split.iside = celtBitexactCos(16384 - itheta)
+		// the mid and side allocation that minimises the squared error
+		split.delta = celtFracMul16((n-1)<<7, celtBitexactLog2Tan(split.iside, split.imid))
+	}
+	split.itheta = itheta
+	return split
+}
+
+func (ctx *celtBandDecoder) decodeBandN1(x []float64, y []float64, lowbandOut []float64) uint {
+	for _, v := range [][]float64{x, y} {
+		if v == nil {
+			break
+		}
+		sign := uint32(0)
+		if ctx.remainingBits >= 1<<RANGE_BITRES {
+			sign = ctx.rd.decodeBits(1)
+			ctx.remainingBits -= 1 << RANGE_BITRES
+		}
+		v[0] = 1
+		if sign != 0 {
+			v[0] = -1
+		}
+	}
+	if lowbandOut != nil {
+		lowbandOut[0] = x[0]
+	}
+	return 1
+}
+
+// decodePartition decodes a mono partition, splitting it in two halves
+// coded with their energy ratio while that leaves too many bits for one
+// codebook
+func (ctx *celtBandDecoder) decodePartition(x []float64, n int, b int, bands int, lowband []float64, lm int, gain float64, fill uint) uint {
+	bands0 := bands
+	var cm uint
+
+	if lm != -1 && n > 2 {
+		cache := celtCache(ctx.band, lm)
+		if b > int(cache[cache[0]])+12 {
+			n >>= 1
+			y := x[n:]
+			lm--
+			if bands == 1 {
+				fill = fill&1 | fill<<1
+			}
+			bands = (bands + 1) >> 1
+
+			split := ctx.computeTheta(n, &b, bands, bands0, lm, false, &fill)
+			mid := float64(split.imid) / 32768
+			side := float64(split.iside) / 32768
+			delta := split.delta
+			itheta := split.itheta
+
+			// give more bits to low energy MDCTs than they would otherwise get
+			if bands0 > 1 && itheta&0x3fff != 0 {
+				if itheta > 8192 {
+					// a rough approximation of pre-echo masking
+					delta -= delta >> (4 - lm)
+				} else {
+					// a forward masking slope of 1.5 dB per 10 ms
+					delta = min(0, delta+(n<<RANGE_BITRES>>(5-lm)))
+				}
+			}
+			mbits := max(0, min(b, (b-delta)/2))
+			sbits := b - mbits
+			ctx.remainingBits -= split.qalloc
+
+			var nextLowband2 []float64
+			if lowband != nil {
+				nextLowband2 = lowband[n:]
+			}
+
+			rebalance := ctx.remainingBits
+			if mbits >= sbits {
+				cm = ctx.decodePartition(x, n, mbits, bands, lowband, lm, gain*mid, fill)
+				rebalance = mbits - (rebalance - ctx.remainingBits)
+				if rebalance > 3<<RANGE_BITRES && itheta != 0 {
+					sbits += rebalance - (3 << RANGE_BITRES)
+				}
+				cm |= ctx.decodePartition(y, n, sbits, bands, nextLowband2, lm, gain*side, fill>>bands) << (bands0 >> 1)
+			} else {
+				cm = ctx.decodePartition(y, n, sbits, bands, nextLowband2, lm, gain*side, fill>>bands) << (bands0 >> 1)
+				rebalance = sbits - (rebalance - ctx.remainingBits)
+				if rebalance > 3<<RANGE_BITRES && itheta != 16384 {
+					mbits += rebalance - (3 << RANGE_BITRES)
+				}
+				cm |= ctx.decodePartition(x, n, mbits, bands, lowband, lm, gain*mid, fill)
+			}
+			return cm
+		}
+	}
+
+	// no split
+	q := celtBitsToPulses(ctx.band, lm, b)
+	currBits := celtPulsesToBits(ctx.band, lm, q)
+	ctx.remainingBits -= currBits
+	// never bust the budget
+	for ctx.remainingBits < 0 && q > 0 {
+		ctx.remainingBits += currBits
+		q--
+		currBits = celtPulsesToBits(ctx.band, lm, q)
+		ctx.remainingBits -= currBits
+	}
+
+	if q != 0 {
+		return ctx.decodePulses(x[:n], celtGetPulses(q), bands, gain)
+	}
+
+	// without pulses the band is filled anyway
+	mask := uint(1)<<bands - 1
+	fill &= mask
+	if fill == 0 {
+		clear(x[:n])
+		return 0
+	}
+	if lowband == nil {
+		// noise
+		for j := 0; j < n; j++ {
+			ctx.seed = celtLCG(ctx.seed)
+			x[j] = float64(int32(ctx.seed) >> 20)
+		}
+		cm = mask
+	} else {
+		// folded spectrum, about 48 dB below the normal folding level
+		for j := 0; j < n; j++ {
+			ctx.seed = celtLCG(ctx.seed)
+			tmp := 1.0 / 256
+			if ctx.seed&0x8000 == 0 {
+				tmp = -tmp
+			}
+			x[j] = lowband[j] + tmp
+		}
+		cm = fill
+	}
+	celtRenormalise(x[:n], gain)
+	return cm
+}
+
+// decodePulses reads a codeword of k pulses and turns it into a unit vector
+// scaled by gain, returning the blocks that received pulses
+func (ctx *celtBandDecoder) decodePulses(x []float64, k int, bands int, gain float64) uint {
+	n := len(x)
+	iy := make([]int, n)
+	u := make([]uint32, k+2)
+	v := celtPVQRow(n, k, u)
+	celtPVQDecode(n, k, ctx.rd.decodeUint(v), iy, u)
+
+	ryy := 0.0
+	for _, p := range iy {
+		ryy += float64(p * p)
+	}
+	g := gain / math.Sqrt(ryy)
+	for i := range x {
+		x[i] = g * float64(iy[i])
+	}
+	celtExpRotation(x, -1, bands, k, ctx.spread)
+
+	if bands <= 1 {
+		return 1
+	}
+	n0 := n / bands
+	var cm uint
+	for i := 0; i < bands; i++ {
+		for j := 0; j < n0; j++ {
+			if iy[i*n0+j] != 0 {
+				cm |= 1 << i
+				break
+			}
+		}
+	}
+	return cm
+}
+
+func (ctx *celtBandDecoder) decodeBand(x []float64, n int, b int, bands int, lowband []float64, lm int, lowbandOut []float64, gain float64, scratch []float64, fill uint) uint {
+	n0 := n
+	nb := n
+	bands0 := bands
+	longBlocks := bands0 == 1
+	timeDivide := 0
+	recombine := 0
+	tfChange := ctx.tfChange
+
+	nb /= bands
+
+	if n == 1 {
+		return ctx.decodeBandN1(x, nil, lowbandOut)
+	}
+
+	if tfChange > 0 {
+		recombine = tfChange
+	}
+
+	// band recombining to increase frequency resolution
+	if scratch != nil && lowband != nil && (recombine != 0 || (nb&1 == 0 && tfChange < 0) || bands0 > 1) {
+		copy(scratch, lowband[:n])
+		lowband = scratch
+	}
+
+	for k := 0; k < recombine; k++ {
+		if lowband != nil {
+			celtHaar1(lowband, n>>k, 1<<k)
+		}
+		fill = celtBitInterleave[fill&0xF] | celtBitInterleave[fill>>4]<<2
+	}
+	bands >>= recombine
+	nb <<= recombine
+
+	// increasing the time resolution
+	for nb&1 == 0 && tfChange < 0 {
+		if lowband != nil {
+			celtHaar1(lowband, nb, bands)
+		}
+		fill |= fill << bands
+		bands <<= 1
+		nb >>= 1
+		timeDivide++
+		tfChange++
+	}
+	bands0 = bands
+	nb0 := nb
+
+	// reorganise the samples in time order instead of frequency order
+	if bands0 > 1 && lowband != nil {
+		celtDeinterleaveHadamard(lowband, nb>>recombine, bands0<<recombine, longBlocks)
+	}
+
+	cm := ctx.decodePartition(x, n, b, bands, lowband, lm, gain, fill)
+
+	if bands0 > 1 {
+		celtInterleaveHadamard(x, nb>>recombine, bands0<<recombine, longBlocks)
+	}
+
+	nb = nb0
+	bands = bands0
+	for k := 0; k < timeDivide; k++ {
+		bands >>= 1
+		nb <<= 1
+		cm |= cm >> bands
+		celtHaar1(x, nb, bands)
+	}
+	for k := 0; k < recombine; k++ {
+		cm = celtBitDeinterleave[cm]
+		celtHaar1(x, n0>>k, 1<<k)
+	}
+	bands <<= recombine
+
+	// scale the output for later folding
+	if lowbandOut != nil {
+		scale := math.Sqrt(float64(n0))
+		for j := 0; j < n0; j++ {
+			lowbandOut[j] = scale * x[j]
+		}
+	}
+	return cm & (1<<bands - 1)
+}
+
+func (ctx *celtBandDecoder) decodeBandStereo(x []float64, y []float64, n int, b int, bands int, lowband []float64, lm int, lowbandOut []float64, scratch []float64, fill uint) uint {
+	if n == 1 {
+		return ctx.decodeBandN1(x, y, lowbandOut)
+	}
+
+	origFill := fill
+	split := ctx.computeTheta(n, &b, bands, bands, lm, true, &fill)
+	mid := float64(split.imid) / 32768
+	side := float64(split.iside) / 32768
+	itheta := split.itheta
+
+	var cm uint
+	if n == 2 {
+		// mid and side are orthogonal, so the side only takes a sign bit
+		mbits := b
+		sbits := 0
+		if itheta != 0 && itheta != 16384 {
+			sbits = 1 << RANGE_BITRES
+		}
+		mbits -= sbits
+		ctx.remainingBits -= split.qalloc + sbits
+
+		x2, y2 := x, y
+		if itheta > 8192 {
+			x2, y2 = y, x
+		}
+		sign := 1.0
+		if sbits != 0 && ctx.rd.decodeBits(1) == 1 {
+			sign = -1
+		}
+
+		// the original fill folds the side even if itheta==16384 cleared it
+		cm = ctx.decodeBand(x2, n, mbits, bands, lowband, lm, lowbandOut, 1, scratch, origFill)
+		y2[0] = -sign * x2[1]
+		y2[1] = sign * x2[0]
+
+		x[0] *= mid
+		x[1] *= mid
+		y[0] *= side
+		y[1] *= side
+		x[0], y[0] = x[0]-y[0], x[0]+y[0]
+		x[1], y[1] = x[1]-y[1], x[1]+y[1]
+	} else {
+		mbits := max(0, min(b, (b-split.delta)/2))
+		sbits := b - mbits
+		ctx.remainingBits -= split.qalloc
+
+		// the mid is left unscaled since it is folded from later, while the
+		// high bits of fill are always zero for the side so nothing is
+		// folded into it
+		rebalance := ctx.remainingBits
+		if mbits >= sbits {
+			cm = ctx.decodeBand(x, n, mbits, bands, lowband, lm, lowbandOut, 1, scratch, fill)
+			rebalance = mbits - (rebalance - ctx.remainingBits)
+			if rebalance > 3<<RANGE_BITRES && itheta != 0 {
+				sbits += rebalance - (3 << RANGE_BITRES)
+			}
+			cm |= ctx.decodeBand(y, n, sbits, bands, nil, lm, nil, side, nil, fill>>bands)
+		} else {
+			cm = ctx.decodeBand(y, n, sbits, bands, nil, lm, nil, side, nil, fill>>bands)
+			rebalance = sbits - (rebalance - ctx.remainingBits)
+			if rebalance > 3<<RANGE_BITRES && itheta != 16384 {
+				mbits += rebalance - (3 << RANGE_BITRES)
+			}
+			cm |= ctx.decodeBand(x, n, mbits, bands, lowband, lm, lowbandOut, 1, scratch, fill)
+		}
+		celtStereoMerge(x[:n], y[:n], mid)
+	}
+
+	if split.inv {
+		for j := 0; j < n; j++ {
+			y[j] = -y[j]
+		}
+	}
+	return cm
+}
+
+func celtStereoMerge(x []float64, y []float64, mid float64) {
+	// the norms of X+Y and X-Y as |X|^2 + |Y|^2 +/- sum(xy)
+	xp, side := 0.0, 0.0
+	for j := range x {
+		xp += y[j] * x[j]
+		side += y[j] * y[j]
+	}
+	// compensate for the mid normalisation
+	xp *= mid
+	el := mid*mid + side - 2*xp
+	er := mid*mid + side + 2*xp
+	if er < 6e-4 || el < 6e-4 {
+		copy(y, x)
+		return
+	}
+
+	lgain := 1 / math.Sqrt(el)
+	rgain := 1 / math.Sqrt(er)
+	for j := range x {
+		l := mid * x[j]
+		r := y[j]
+		x[j] = lgain * (l - r)
+		y[j] = rgain * (l + r)
+	}
+}
+
+func celtHaar1(x []float64, n0 int, stride int) {
+	n0 >>= 1
+	for i := 0; i < stride; i++ {
+		for j := 0; j < n0; j++ {
+			tmp1 := math.Sqrt2 / 2 * x[stride*2*j+i]
+			tmp2 := math.Sqrt2 / 2 * x[stride*(2*j+1)+i]
+			x[stride*2*j+i] = tmp1 + tmp2
+			x[stride*(2*j+1)+i] = tmp1 - tmp2
+		}
+	}
+}
+
+func celtDeinterleaveHadamard(x []float64, n0 int, stride int, hadamard bool) {
+	n := n0 * stride
+	tmp := make([]float64, n)
+	if hadamard {
+		ordery := celtOrdery[stride-2:]
+		for i := 0; i < stride; i++ {
+			for j := 0; j < n0; j++ {
+				tmp[ordery[i]*n0+j] = x[j*stride+i]
+			}
+		}
+	} else {
+		for i := 0; i < stride; i++ {
+			for j := 0; j < n0; j++ {
+				tmp[i*n0+j] = x[j*stride+i]
+			}
+		}
+	}
+	copy(x, tmp)
+}
+
+func celtInterleaveHadamard(x []float64, n0 int, stride int, hadamard bool) {
+	n := n0 * stride
+	tmp := make([]float64, n)
+	if hadamard {
+		ordery := celtOrdery[stride-2:]
+		for i := 0; i < stride; i++ {
+			for j := 0; j < n0; j++ {
+				tmp[j*stride+i] = x[ordery[i]*n0+j]
+			}
+		}
+	} else {
+		for i := 0; i < stride; i++ {
+			for j := 0; j < n0; j++ {
+				tmp[j*stride+i] = x[i*n0+j]
+			}
+		}
+	}
+	copy(x, tmp)
+}
+
+// celtExpRotation spreads the energy of a vector with few pulses over more
+// coefficients, or undoes it when dir is negative
+func celtExpRotation(x []float64, dir int, stride int, k int, spread int) {
+	length := len(x)
+	if 2*k >= length || spread == CELT_SPREAD_NONE {
+		return
+	}
+	factor := [3]int{15, 10, 5}[spread-1]
+
+	gain := float64(length) / float64(length+factor*k)
+	theta := 0.5 * gain * gain
+	c := math.Cos(0.5 * math.Pi * theta)
+	s := math.Cos(0.5 * math.Pi * (1 - theta))
+
+	stride2 := 0
+	if length >= 8*stride {
+		// roughly sqrt(length/stride)
+		stride2 = 1
+		for (stride2*stride2+stride2)*stride+(stride>>2) < length {
+			stride2++
+		}
+	}
+
+	length /= stride
+	for i := 0; i < stride; i++ {
+		v := x[i*length : (i+1)*length]
+		if dir < 0 {
+			if stride2 != 0 {
+				celtExpRotation1(v, stride2, s, c)
+			}
+			celtExpRotation1(v, 1, c, s)
+		} else {
+			celtExpRotation1(v, 1, c, -s)
+			if stride2 != 0 {
+				celtExpRotation1(v, stride2, s, -c)
+			}
+		}
+	}
+}
+
+func celtExpRotation1(x []float64, stride int, c float64, s float64) {
+	length := len(x)
+	for i := 0; i < length-stride; i++ {
+		x1, x2 := x[i], x[i+stride]
+		x[i+stride] = c*x2 + s*x1
+		x[i] = c*x1 - s*x2
+	}
+	for i := length - 2*stride - 1; i >= 0; i-- {
+		x1, x2 := x[i], x[i+stride]
+		x[i+stride] = c*x2 + s*x1
+		x[i] = c*x1 - s*x2
+	}
+}
+
+// celtPVQRow fills u with row n of the table U(n, k) for counting pulse
+// vectors, returning V(n, k), the number of vectors of n dimensions with k
+// pulses
+func celtPVQRow(n int, k int, u []uint32) uint32 {
+	u[0] = 0
+	u[1] = 1
+	for j := 2; j < k+2; j++ {
+		u[j] = uint32(2*j - 1)
+	}
+	for j := 2; j < n; j++ {
+		celtPVQNext(u[1:k+2], 1)
+	}
+	return u[k] + u[k+1]
+}
+
+func celtPVQNext(u []uint32, u0 uint32) {
+	j := 1
+	for ; j < len(u); j++ {
+		u1 := u[j] + u[j-1] + u0
+		u[j-1] = u0
+		u0 = u1
+	}
+	u[j-1] = u0
+}
+
+func celtPVQPrev(u []uint32, u0 uint32) {
+	j := 1
+	for ; j < len(u); j++ {
+		u1 := u[j] - u[j-1] - u0
+		u[j-1] = u0
+		u0 = u1
+	}
+	u[j-1] = u0
+}
+
+// celtPVQDecode turns index i into the vector of n dimensions and k pulses
+// it enumerates, given row n of U in u
+func celtPVQDecode(n int, k int, i uint32, y []int, u []uint32) {
+	for j := 0; j < n; j++ {
+		p := u[k+1]
+		s := 0
+		if i >= p {
+			s = -1
+			i -= p
+		}
+		yj := k
+		p = u[k]
+		for p > i {
+			k--
+			p = u[k]
+		}
+		i -= p
+		yj -= k
+		y[j] = (yj + s) ^ s
+		celtPVQPrev(u[:k+2], 0)
+	}
+}
+
+func celtISqrt(v uint32) int {
+	g := uint32(0)
+	shift := (bits32Len(v) - 1) >> 1
+	b := uint32(1) << shift
+	for {
+		t := (g<<1 + b) << shift
+		if t <= v {
+			g += b
+			v -= t
+		}
+		b >>= 1
+		shift--
+		if shift < 0 {
+			break
+		}
+	}
+	return int(g)
+}
+
+func bits32Len(v uint32) int {
+	n := 0
+	for ; v != 0; v >>= 1 {
+		n++
+	}
+	return n
+}
+
+func celtFracMul16(a int, b int) int {
+	return (16384 + int(int32(int16(a))*int32(int16(b)))) >> 15
+}
+
+func celtBitexactCos(x int) int {
+	tmp := (4096 + x*x) >> 13
+	x2 := tmp
+	x2 = (32767 - x2) + celtFracMul16(x2, -7651+celtFracMul16(x2, 8277+celtFracMul16(-626, x2)))
+	return 1 + x2
+}
+
+func celtBitexactLog2Tan(isin int, icos int) int {
+	lc := bits32Len(uint32(icos))
+	ls := bits32Len(uint32(isin))
+	icos <<= 15 - lc
+	isin <<= 15 - ls
+	return (ls-lc)*(1<<11) +
+		celtFracMul16(isin, celtFracMul16(isin, -2597)+7932) -
+		celtFracMul16(icos, celtFracMul16(icos, -2597)+7932)
+}
+
+// celtMDCT computes CELT's inverse MDCT of one size, whose windowed overlap
+// is folded into the first samples of the previous output
+type celtMDCT struct {
+	n       int
+	trig    []float64
+	fft     *fft
+	scratch []complex128
+}
+
+func newCELTMDCT(n int) *celtMDCT {
+	t := &celtMDCT{n: n, trig: make([]float64, n/2), fft: newFFT(n / 4), scratch: make([]complex128, n/4)}
+	for i := range t.trig {
+		t.trig[i] = math.Cos(2 * math.Pi * (float64(i) + 0.125) / float64(n))
+	}
+	return t
+}
+
+// backward transforms the n/2 coefficients in[0], in[stride]... and adds
+// the result to out, which holds the folded overlap of the previous block
+func (t *celtMDCT) backward(in []float64, stride int, out []float64, window []float64) {
+	n2 := t.n / 2
+	n4 := t.n / 4
+	trig := t.trig
+	z := t.scratch
+
+	// pre-rotate, with real and imaginary parts swapped to use a forward FFT
+	for i := 0; i < n4; i++ {
+		x1 := in[2*i*stride]
+		x2 := in[stride*(n2-1-2*i)]
+		yr := x2*trig[i] + x1*trig[n4+i]
+		yi := x1*trig[i] - x2*trig[n4+i]
+		z[i] = complex(yi, yr)
+	}
+
+	t.fft.transform(z)
+
+	// post-rotate
+	y := out[CELT_OVERLAP/2:]
+	for k := 0; k < n4; k++ {
+		re := imag(z[k])
+		im := real(z[k])
+		y[2*k] = re*trig[k] + im*trig[n4+k]
+		y[n2-1-2*k] = re*trig[n4+k] - im*trig[k]
+	}
+
+	// mirror on both sides for TDAC
+	for i := 0; i < CELT_OVERLAP/2; i++ {
+		x1 := out[CELT_OVERLAP-1-i]
+		x2 := out[i]
+		w1 := window[i]
+		w2 := window[CELT_OVERLAP-1-i]
+		out[i] = w2*x2 - w1*x1
+		out[CELT_OVERLAP-1-i] = w1*x2 + w2*x1
+	}
+}
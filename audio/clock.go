@@ -0,0 +1,141 @@
+package audio
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock paces the player thread's refills of the client's buffer. The player
+// reads C each time it waits for something to do, and once more as it stops.
+type Clock interface {
+	C() <-chan time.Time
+	Reset(d time.Duration)
+	Stop()
+}
+
+type tickerClock struct {
+	ticker *time.Ticker
+}
+
+func newTickerClock(d time.Duration) *tickerClock {
+	return &tickerClock{time.NewTicker(d)}
+}
+
+func (c *tickerClock) C() <-chan time.Time {
+	return c.ticker.C
+}
+
+func (c *tickerClock) Reset(d time.Duration) {
+	c.ticker.Reset(d)
+}
+
+func (c *tickerClock) Stop() {
+	c.ticker.Stop()
+}
+
+// immediateClock ticks whenever it is read until stopped, for clients that
+// never need to wait for their buffer to drain
+type immediateClock struct {
+	running bool
+}
+
+// a closed channel, always ready to receive from
+var alwaysReady = func() chan time.Time {
+	c := make(chan time.Time)
+	close(c)
+	return c
+}()
+
+func (c *immediateClock) C() <-chan time.Time {
+	if c.running {
+		return alwaysReady
+	}
+	return nil
+}
+
+func (c *immediateClock) Reset(d time.Duration) {
+	c.running = true
+}
+
+func (c *immediateClock) Stop() {
+	c.running = false
+}
+
+// VirtualClock is a Clock whose time only moves when Advance is called, so a
+// player driven by it, playing through a SimulatedClient on the same clock,
+// does the same thing on every run
+type VirtualClock struct {
+	mutex   sync.Mutex
+	now     time.Duration
+	period  time.Duration
+	next    time.Duration // when the next tick is due
+	running bool
+
+	ticks   chan time.Time // holds the tick due until the player takes it
+	waiting bool           // a tick was sent and the player has not waited since taking it
+	handled chan struct{}
+}
+
+func NewVirtualClock() *VirtualClock {
+	return &VirtualClock{
+		ticks:   make(chan time.Time, 1),
+		handled: make(chan struct{}, 1),
+	}
+}
+
+// C is read by the player each time it waits, which is how the clock knows
+// the last tick has been handled. It is read too while a tick is still
+// waiting to be taken, when the player comes to wait after handling
+// something else.
+func (c *VirtualClock) C() <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.waiting && len(c.ticks) == 0 {
+		c.waiting = false
+		c.handled <- struct{}{}
+	}
+	return c.ticks
+}
+
+func (c *VirtualClock) Reset(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.period = d
+	c.next = c.now + d
+	c.running = true
+}
+
+func (c *VirtualClock) Stop() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.running = false
+}
+
+// Now is the time since the clock was made
+func (c *VirtualClock) Now() time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Advance moves time forward by d, delivering the ticks that fall due one at
+// a time and returning once the player has handled the last of them. The
+// player must not be left blocked on anything else meanwhile, so channels
+// subscribed to its events should be buffered.
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	target := c.now + d
+	for c.running && c.period > 0 && c.next <= target {
+		c.now = c.next
+		c.next += c.period
+		c.waiting = true
+		c.ticks <- time.Unix(0, 0).Add(c.now)
+		c.mutex.Unlock()
+
+		<-c.handled
+
+		c.mutex.Lock()
+	}
+	c.now = target
+	c.mutex.Unlock()
+}
@@ -0,0 +1,137 @@
+package audio
+
+import (
+	"io"
+	"math"
+	"time"
+)
+
+const (
+	CROSSFADE_LINEAR = iota
+	CROSSFADE_EQUAL_POWER
+	CROSSFADE_LOGARITHMIC
+)
+
+const (
+	CROSSFADE_LOG_FLOOR = -60 // dB, where a logarithmic fade starts from and ends at
+)
+
+// SetCrossfade fades each track in over the last length of the one before,
+// with curve one of the CROSSFADE_ constants. Tracks from the same album
+// are never faded into each other. A length of 0 turns crossfading off.
+func (p *Player) SetCrossfade(length time.Duration, curve int) error {
+	if !isCrossfadeCurve(curve) || length < 0 {
+		return ErrInvalidOption
+	}
+	p.command(CTL_CROSSFADE, int(length/100), curve)
+	return nil
+}
+
+func isCrossfadeCurve(curve int) bool {
+	return curve == CROSSFADE_LINEAR || curve == CROSSFADE_EQUAL_POWER || curve == CROSSFADE_LOGARITHMIC
+}
+
+// canCrossfade reports whether a track may be faded into the one before it
+func canCrossfade(from, into Metadata, length int) bool {
+	sameAlbum := from.Album == into.Album && from.Album != NOT_FOUND && from.Album != ""
+	return !sameAlbum && int(into.Duration) >= length
+}
+
+// crossfadeGains returns how loud the track fading out and the one fading
+// in are at x, from 0 at the start of the fade to 1 at its end
+func crossfadeGains(curve int, x float64) (out, in float64) {
+	switch curve {
+	case CROSSFADE_EQUAL_POWER:
+		return math.Cos(x * math.Pi / 2), math.Sin(x * math.Pi / 2)
+	case CROSSFADE_LOGARITHMIC:
+		return logFade(1 - x), logFade(x)
+	default:
+		return 1 - x, x
+	}
+}
+
+// logFade rises evenly in decibels from CROSSFADE_LOG_FLOOR to full volume,
+// shifted to start from silence
+func logFade(x float64) float64 {
+	floor := math.Pow(10, CROSSFADE_LOG_FLOOR/20.0)
+	g := math.Pow(10, CROSSFADE_LOG_FLOOR*(1-x)/20)
+	return (g - floor) / (1 - floor)
+}
+
+// crossfade mixes the end of one track under the start of the next
+type crossfade struct {
+	from     AudioSource
+	fromMeta Metadata
+	into     AudioSource
+
+	pending []byte // audio read from from and not yet mixed
+	fromEOF bool
+
+	curve  int
+	frames int // length of the fade
+	mixed  int // frames mixed so far
+}
+
+// newCrossfade starts fading into in over from, beginning with the audio
+// in tail, lasting length in 100ns units
+func newCrossfade(from, into AudioSource, tail []byte, length, curve int, format *PCMWaveFormat) *crossfade {
+	return &crossfade{
+		from:     from,
+		fromMeta: from.GetMetadata(),
+		into:     into,
+		pending:  tail,
+		curve:    curve,
+		frames:   int(int64(length) * int64(format.SampleRate) / SECOND),
+	}
+}
+
+// mix fades data, the next audio read from into, in over audio read from
+// from. Errors reading from are returned, the rest of it being treated as
+// silence.
+func (f *crossfade) mix(data []byte, format *PCMWaveFormat) ([]byte, error) {
+	frameSize := int(format.NumChannels) * int(format.SampleDepth/8)
+	n := min(len(data)/frameSize, f.frames-f.mixed)
+	if n <= 0 {
+		return data, nil
+	}
+
+	// gather as much of from as there is to go under data
+	var err error
+	for len(f.pending) < n*frameSize && !f.fromEOF {
+		var frames []byte
+		frames, _, err = readSource(f.from)
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			f.fromEOF = true
+			break
+		}
+		f.pending = append(f.pending, frames...)
+	}
+
+	channels := int(format.NumChannels)
+	in := make([]float64, len(data)/(frameSize/channels))
+	out := make([]float64, n*channels)
+	decodeSamples(in, data, format)
+	decodeSamples(out, f.pending, format)
+	f.pending = f.pending[min(n*frameSize, len(f.pending)):]
+
+	for i := 0; i < n; i++ {
+		gOut, gIn := crossfadeGains(f.curve, float64(f.mixed+i)/float64(f.frames))
+		for c := 0; c < channels; c++ {
+			s := i*channels + c
+			in[s] = in[s]*gIn + out[s]*gOut
+		}
+	}
+	f.mixed += n
+
+	mixed := make([]byte, len(data))
+	encodeSamples(mixed, in, format)
+	return mixed, err
+}
+
+// mixed reports whether the whole fade has been mixed
+func (f *crossfade) mixedAll() bool {
+	return f.mixed >= f.frames
+}
@@ -0,0 +1,173 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCrossfadeGains(t *testing.T) {
+	for _, curve := range []int{CROSSFADE_LINEAR, CROSSFADE_EQUAL_POWER, CROSSFADE_LOGARITHMIC} {
+		if out, in := crossfadeGains(curve, 0); math.Abs(out-1) > 1e-9 || math.Abs(in) > 1e-9 {
+			t.Fatalf("curve %d starts at %v, %v", curve, out, in)
+		}
+		if out, in := crossfadeGains(curve, 1); math.Abs(out) > 1e-9 || math.Abs(in-1) > 1e-9 {
+			t.Fatalf("curve %d ends at %v, %v", curve, out, in)
+		}
+		last := -1.0
+		for x := 0.0; x <= 1; x += 0.01 {
+			if _, in := crossfadeGains(curve, x); in < last {
+				t.Fatalf("curve %d falls at %v", curve, x)
+			} else {
+				last = in
+			}
+		}
+	}
+	if out, in := crossfadeGains(CROSSFADE_EQUAL_POWER, 0.5); math.Abs(out*out+in*in-1) > 1e-9 {
+		t.Fatal("equal power curve not equal power")
+	}
+}
+
+// crossfadeFiles writes three 3 second tracks, each its own album
+func crossfadeFiles(t *testing.T) (a, b, c string, albums PlayerOption) {
+	dir := t.TempDir()
+	a = filepath.Join(dir, "a.wav")
+	b = filepath.Join(dir, "b.wav")
+	c = filepath.Join(dir, "c.wav")
+	writeWav(t, a, 2, 48000, 16, false, 144000, constant(0.5))
+	writeWav(t, b, 2, 48000, 16, false, 144000, constant(-0.25))
+	writeWav(t, c, 2, 48000, 16, false, 144000, constant(0.3))
+	albums = WithMetadataReader(func(path string) (*Metadata, error) {
+		m := NewMetadata()
+		m.Album = filepath.Base(path)
+		return m, nil
+	})
+	return a, b, c, albums
+}
+
+func TestCrossfade(t *testing.T) {
+	a, b, c, albums := crossfadeFiles(t)
+	p := newSimPlayer(t, []string{a, b, c}, albums, WithCrossfade(time.Second, CROSSFADE_LINEAR))
+	p.clock.Advance(100 * time.Millisecond)
+	p.Start()
+
+	var events []string
+	var at []time.Duration
+	for i := 0; i < 900; i++ {
+		p.clock.Advance(10 * time.Millisecond)
+		for _, e := range describe(p.tap.drain()) {
+			if !strings.HasPrefix(e, "queue") && e != "playing true" {
+				events = append(events, e)
+				at = append(at, p.clock.Now())
+			}
+		}
+	}
+	want := "[track a.wav track b.wav fade from a.wav fade over track c.wav fade from b.wav fade over end]"
+	if fmt.Sprint(events) != want {
+		t.Fatalf("events\n got %v\nwant %s", events, want)
+	}
+	// b starts a second before a ends and fades in over that second
+	if at[1] < 2100*time.Millisecond || at[1] > 2100*time.Millisecond+REFILL_PERIOD {
+		t.Fatalf("b started at %v", at[1])
+	}
+	if at[3] < 3100*time.Millisecond || at[3] > 3100*time.Millisecond+REFILL_PERIOD {
+		t.Fatalf("fade over at %v", at[3])
+	}
+	// each fade overlaps a second of two tracks
+	if played := p.client.Played(); played != 3*144000-2*48000 {
+		t.Fatalf("played %d", played)
+	}
+}
+
+func TestCrossfadeSameAlbum(t *testing.T) {
+	a, b, _, _ := crossfadeFiles(t)
+	// both files are on "Record"
+	p := newSimPlayer(t, []string{a, b}, WithCrossfade(time.Second, CROSSFADE_EQUAL_POWER))
+	p.Start()
+	p.step(70)
+	for _, e := range p.tap.drain() {
+		if _, ok := e.(CrossfadeChanged); ok {
+			t.Fatal("crossfaded within an album")
+		}
+	}
+	if played := p.client.Played(); played != 2*144000 {
+		t.Fatalf("played %d", played)
+	}
+}
+
+func TestCrossfadeInterrupted(t *testing.T) {
+	a, b, c, albums := crossfadeFiles(t)
+	for _, action := range []string{"skip", "back", "seek", "off"} {
+		p := newSimPlayer(t, []string{a, b, c}, albums, WithCrossfade(time.Second, CROSSFADE_EQUAL_POWER))
+		p.clock.Advance(100 * time.Millisecond)
+		p.Start()
+		// halfway through b fading in over a
+		p.clock.Advance(2500 * time.Millisecond)
+		if s := p.Snapshot(); s.Outgoing == nil || s.Current.Filepath != b {
+			t.Fatalf("%s: not fading, at %s", action, s.Current.Filepath)
+		}
+		p.tap.drain()
+
+		switch action {
+		case "skip":
+			p.Skip()
+		case "back":
+			p.Back()
+		case "seek":
+			p.SeekBackward()
+		case "off":
+			if err := p.SetCrossfade(0, CROSSFADE_LINEAR); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s := p.Snapshot()
+		events := fmt.Sprint(describe(p.tap.drain()))
+		switch action {
+		case "skip":
+			if events != "[fade over track c.wav]" || s.Outgoing != nil || s.Position != 0 {
+				t.Fatalf("skip: %s, %+v", events, s)
+			}
+		case "back":
+			if events != "[fade over track a.wav]" || s.Outgoing != nil || s.Position != 0 {
+				t.Fatalf("back: %s, %+v", events, s)
+			}
+		case "seek":
+			if events != "[fade over seek 0]" || s.Outgoing != nil || s.Current.Filepath != b {
+				t.Fatalf("seek: %s, %+v", events, s)
+			}
+		case "off":
+			// the fade under way plays out
+			if events != "[]" || s.Outgoing == nil {
+				t.Fatalf("off: %s, %+v", events, s)
+			}
+		}
+
+		// what follows fades as it would have
+		p.step(80)
+		var fades []string
+		for _, e := range describe(p.tap.drain()) {
+			if strings.HasPrefix(e, "fade from") {
+				fades = append(fades, e)
+			}
+		}
+		want := map[string]string{
+			"skip": "[]",
+			"back": "[fade from a.wav fade from b.wav]",
+			"seek": "[fade from b.wav]",
+			"off":  "[]",
+		}[action]
+		if fmt.Sprint(fades) != want {
+			t.Fatalf("%s: then %v", action, fades)
+		}
+		if action == "skip" {
+			// c is heard whole, but for fading in after the cut
+			_, lengths := runs(p.client.Written())
+			if last := lengths[len(lengths)-1]; last < 144000-p.declickLength*48000/SECOND {
+				t.Fatalf("skip: c ran %d frames", last)
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package audio
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	DECLICK_LENGTH = 10 * time.Millisecond // default length of the fades around pauses and jumps
+)
+
+// declicker fades the audio written to a client in and out around pauses,
+// seeks and skips, so the stream is never cut or started mid-waveform. It
+// keeps a copy of what the client has yet to play so that what is about to
+// be heard can be faded out in its place.
+type declicker struct {
+	format    *PCMWaveFormat
+	frameSize int
+	frames    int // length of a fade, 0 if off
+
+	unplayed []byte // the audio in the client's buffer
+	stale    int    // bytes at the front of unplayed faded out before a jump
+	rampIn   int    // frames still to fade in
+}
+
+// newDeclicker fades audio in format over length, in 100ns units
+func newDeclicker(length int, format *PCMWaveFormat) *declicker {
+	return &declicker{
+		format:    format,
+		frameSize: int(format.NumChannels) * int(format.SampleDepth/8),
+		frames:    int(int64(length) * int64(format.SampleRate) / SECOND),
+	}
+}
+
+// played forgets the audio the client has played, given the frames it has
+// left
+func (d *declicker) played(padding int) {
+	n := max(len(d.unplayed)-padding*d.frameSize, 0)
+	d.unplayed = d.unplayed[n:]
+	d.stale = max(d.stale-n, 0)
+}
+
+// load returns data faded in as needed, to be written to the client
+func (d *declicker) load(data []byte) []byte {
+	if n := min(d.rampIn, len(data)/d.frameSize); n > 0 {
+		faded := append([]byte(nil), data...)
+		d.ramp(faded[:n*d.frameSize], d.frames-d.rampIn, d.frames, true)
+		d.rampIn -= n
+		data = faded
+	}
+	d.unplayed = append(d.unplayed, data...)
+	return data
+}
+
+// pause fades out what the client is about to play, in place of all it has
+// buffered. It returns the rest of that audio to be written again once
+// playing resumes, and whether any fade is left to play before the client
+// can be stopped.
+func (d *declicker) pause(client AudioClient) ([]byte, bool, error) {
+	rest, err := d.cut(client, true)
+	return rest, len(d.unplayed) > 0, err
+}
+
+// interrupt throws away what the client has buffered for a jump elsewhere,
+// fading out what it is about to play first if it is playing
+func (d *declicker) interrupt(client AudioClient, playing bool) error {
+	_, err := d.cut(client, playing)
+	d.stale = len(d.unplayed)
+	return err
+}
+
+// reset forgets what was written to a client that has been lost, fading in
+// on the next one
+func (d *declicker) reset() {
+	d.unplayed, d.stale, d.rampIn = nil, 0, d.frames
+}
+
+// cut clears the client's buffer, writing back the start of it faded out if
+// fadeOut is set, and returns the rest. What is written next fades in.
+func (d *declicker) cut(client AudioClient, fadeOut bool) ([]byte, error) {
+	padding, err := client.GetBufferPadding()
+	if err != nil {
+		return nil, err
+	}
+	unplayed := d.unplayed[max(len(d.unplayed)-padding*d.frameSize, 0):]
+	if err := client.ClearBuffer(); err != nil {
+		return nil, err
+	}
+	d.unplayed, d.stale, d.rampIn = nil, 0, d.frames
+
+	n := 0
+	if fadeOut {
+		n = min(d.frames*d.frameSize, len(unplayed))
+	}
+	if n > 0 {
+		ramp := append([]byte(nil), unplayed[:n]...)
+		// as much as is left if less than a whole fade
+		d.ramp(ramp, 0, n/d.frameSize, false)
+		if _, err := client.LoadToBuffer(ramp); err != nil {
+			return nil, err
+		}
+		d.unplayed = ramp
+	}
+	return append([]byte(nil), unplayed[n:]...), nil
+}
+
+// ramp fades data in or out, starting from frame from of a fade frames long
+func (d *declicker) ramp(data []byte, from, frames int, in bool) {
+	channels := int(d.format.NumChannels)
+	samples := make([]float64, len(data)/d.frameSize*channels)
+	decodeSamples(samples, data, d.format)
+	for i := range samples {
+		// raised cosine, from 1 down to 0
+		x := float64(from+i/channels) / float64(frames)
+		g := (1 + math.Cos(math.Pi*min(x, 1))) / 2
+		if in {
+			g = 1 - g
+		}
+		samples[i] *= g
+	}
+	encodeSamples(data, samples, d.format)
+}
@@ -0,0 +1,186 @@
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// declickFrames is the length of a DECLICK_LENGTH fade at 48kHz
+const declickFrames = int(DECLICK_LENGTH * 48000 / time.Second)
+
+// left returns the left channel of 16 bit stereo audio
+func left(data []byte) []int16 {
+	out := make([]int16, len(data)/4)
+	for i := range out {
+		out[i] = int16(binary.LittleEndian.Uint16(data[i*4:]))
+	}
+	return out
+}
+
+// rampLeft is the left channel of frame f of ramp in 16 bits
+func rampLeft(f int) int16 {
+	return int16((f*7%256 - 128) * 256)
+}
+
+// checkFade checks that got is a whole raised cosine fade over the frames
+// of ramp from frame from on, followed by those frames as they are
+func checkFade(t *testing.T, what string, got []int16, from int, in bool) {
+	t.Helper()
+	if len(got) < declickFrames {
+		t.Fatalf("%s: %d frames, shorter than a fade", what, len(got))
+	}
+	for i, v := range got {
+		g := 1.0
+		if i < declickFrames {
+			g = (1 + math.Cos(math.Pi*float64(i)/float64(declickFrames))) / 2
+			if in {
+				g = 1 - g
+			}
+		} else if !in {
+			t.Fatalf("%s: %d frames written after the fade out", what, len(got)-i)
+		}
+		if want := g * float64(rampLeft(from+i)); math.Abs(float64(v)-want) > 2 {
+			t.Fatalf("%s: frame %d is %d, want %.1f", what, i, v, want)
+		}
+	}
+}
+
+// checkPosition checks the position in the track is frame, to within the
+// rounding of a frame into 100ns units
+func checkPosition(t *testing.T, what string, p *simPlayer, frame int) {
+	t.Helper()
+	if pos, want := p.GetPositionInTrack(), frame*SECOND/48000; pos < want-1 || pos > want+1 {
+		t.Fatalf("%s: position %d, want %d", what, pos, want)
+	}
+}
+
+// newDeclickPlayer plays 10s of ramp for 300ms, returning the frame it
+// has got to
+func newDeclickPlayer(t *testing.T, paths ...string) (*simPlayer, int) {
+	t.Helper()
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.wav")
+	writeWav(t, a, 2, 48000, 16, false, 480000, ramp)
+	p := newSimPlayer(t, append([]string{a}, paths...), WithSeekStep(SECOND))
+	p.Start()
+	p.clock.Advance(300 * time.Millisecond)
+
+	// nothing is faded before anything is cut
+	for i, v := range left(p.client.Written()) {
+		if v != rampLeft(i) {
+			t.Fatalf("frame %d is %d before pausing, want %d", i, v, rampLeft(i))
+		}
+	}
+	return p, p.client.Played()
+}
+
+func TestDeclickPause(t *testing.T) {
+	p, at := newDeclickPlayer(t)
+	written := len(left(p.client.Written()))
+
+	// pausing fades out what was about to play in place of the buffer
+	p.Stop()
+	checkFade(t, "pause", left(p.client.Written())[written:], at, false)
+	written += declickFrames
+
+	// which plays out before the client stops, the position holding after
+	p.step(1)
+	if played := p.client.Played(); played != at+declickFrames {
+		t.Fatalf("played %d frames, want %d", played, at+declickFrames)
+	}
+	checkPosition(t, "paused", p, at+declickFrames)
+	p.step(10)
+	if p.client.Played() != at+declickFrames {
+		t.Fatal("played on while paused")
+	}
+	checkPosition(t, "paused 1s", p, at+declickFrames)
+
+	// what is buffered again while paused and on resuming fades in from
+	// the frame after the fade out, so nothing is lost or heard twice
+	underruns := p.client.Underruns()
+	p.Start()
+	p.step(5)
+	checkFade(t, "resume", left(p.client.Written())[written:], at+declickFrames, true)
+	if n := p.client.Underruns() - underruns; n != 0 {
+		t.Fatalf("%d frames of silence after resuming", n)
+	}
+	checkPosition(t, "resumed", p, at+declickFrames+5*48000/10)
+}
+
+func TestDeclickResumeDuringFade(t *testing.T) {
+	p, at := newDeclickPlayer(t)
+	written := len(left(p.client.Written()))
+	underruns := p.client.Underruns()
+
+	// resuming halfway through the fade out lets the fade out finish, then
+	// fades straight back in
+	p.Stop()
+	p.clock.Advance(DECLICK_LENGTH / 2)
+	p.Start()
+	p.step(5)
+
+	got := left(p.client.Written())[written:]
+	checkFade(t, "pause", got[:declickFrames], at, false)
+	checkFade(t, "resume", got[declickFrames:], at+declickFrames, true)
+	if n := p.client.Underruns() - underruns; n != 0 {
+		t.Fatalf("%d frames of silence after resuming", n)
+	}
+	// the fade out was played as part of the track, so the position counts
+	// on through it as it would have without pausing
+	checkPosition(t, "resumed", p, at+5*48000/10)
+}
+
+func TestDeclickSeek(t *testing.T) {
+	p, at := newDeclickPlayer(t)
+	written := len(left(p.client.Written()))
+
+	// seeking fades out where it was and fades in where it seeks to
+	p.SeekForward()
+	target := at + 48000
+	checkPosition(t, "seeked", p, target)
+	p.step(2)
+	got := left(p.client.Written())[written:]
+	checkFade(t, "seek", got[:declickFrames], at, false)
+	checkFade(t, "seeked", got[declickFrames:], target, true)
+
+	// the fade out of where it was, played before the next refill, doesn't
+	// count toward the position it seeked to
+	checkPosition(t, "200ms after seeking", p, target+48000/10)
+
+	// seeking while paused cuts the buffer as is, fading in on resuming
+	p.Stop()
+	p.step(1)
+	written = len(left(p.client.Written()))
+	from := target + 48000/10 + declickFrames
+	p.SeekForward()
+	if n := len(left(p.client.Written())); n != written {
+		t.Fatalf("%d frames written seeking while paused", n-written)
+	}
+	p.Start()
+	p.step(1)
+	checkFade(t, "resume", left(p.client.Written())[written:], from+48000, true)
+}
+
+func TestDeclickSkip(t *testing.T) {
+	dir := t.TempDir()
+	b := filepath.Join(dir, "b.wav")
+	writeWav(t, b, 2, 48000, 16, false, 480000, ramp)
+	p, at := newDeclickPlayer(t, b)
+	written := len(left(p.client.Written()))
+
+	// skipping fades out the track and fades in the next from its start
+	p.Skip()
+	if s := p.Snapshot(); s.Current.Filepath != b || s.Position != 0 {
+		t.Fatalf("at %d in %s after skipping", s.Position, s.Current.Filepath)
+	}
+	p.step(2)
+	got := left(p.client.Written())[written:]
+	checkFade(t, "skip", got[:declickFrames], at, false)
+	checkFade(t, "skipped", got[declickFrames:], 0, true)
+
+	// the fade out of the track before isn't counted in the next
+	checkPosition(t, "200ms after skipping", p, 48000/10)
+}
@@ -0,0 +1,262 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+const (
+	DFF_HEADER_SIZE = 16
+	DFF_CHUNK_SIZE  = 12
+	DFF_MAX_TEXT    = 1 << 16
+)
+
+var (
+	ErrNotDFF = errors.New("not a DSDIFF file")
+)
+
+// output position of each DSDIFF loudspeaker, in WAVE order
+var dffChannelOrder = map[string]int{
+	"SLFT": 0, "MLFT": 0,
+	"SRGT": 1, "MRGT": 1,
+	"C   ": 2,
+	"LFE ": 3,
+	"LS  ": 4,
+	"RS  ": 5,
+}
+
+func init() {
+	RegisterAudioSourceProvider(".dff", &AudioSourceProvider{createDFFAudioSourceFromFile, getDFFFileMetadata})
+}
+
+func openDFF(path string) (*dsdDecoder, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := &dsdDecoder{file: file}
+	err = readDFFHeader(dec, path)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return dec, nil
+}
+
+// readDFFChunks is readChunks for DSDIFF, whose chunk sizes are 64-bit
+func readDFFChunks(r io.ReadSeeker, start int64, end int64) ([]riffChunk, error) {
+	chunks := make([]riffChunk, 0)
+	header := make([]byte, DFF_CHUNK_SIZE)
+
+	pos := start
+	for pos+DFF_CHUNK_SIZE <= end {
+		if _, err := r.Seek(pos, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+
+		size := binary.BigEndian.Uint64(header[4:])
+		chunk := riffChunk{string(header[:4]), int64(size), pos + DFF_CHUNK_SIZE}
+		if size > uint64(end-chunk.offset) {
+			chunk.size = end - chunk.offset
+		}
+		chunks = append(chunks, chunk)
+
+		pos = chunk.offset + chunk.size + chunk.size&1
+	}
+
+	return chunks, nil
+}
+
+func readDFFHeader(dec *dsdDecoder, path string) error {
+	info, err := dec.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, DFF_HEADER_SIZE)
+	if _, err := io.ReadFull(dec.file, header); err != nil {
+		return ErrNotDFF
+	}
+	if string(header[:4]) != "FRM8" || string(header[12:]) != "DSD " {
+		return ErrNotDFF
+	}
+	end := min(info.Size(), DFF_CHUNK_SIZE+int64(binary.BigEndian.Uint64(header[4:])))
+
+	chunks, err := readDFFChunks(dec.file, DFF_HEADER_SIZE, end)
+	if err != nil {
+		return err
+	}
+
+	dec.meta = *NewMetadata()
+	dec.meta.Filepath = path
+	dec.interleave = 1
+
+	var data *riffChunk
+	hasProp := false
+	for i, chunk := range chunks {
+		switch chunk.id {
+		case "PROP":
+			if err := dec.parseDFFProperties(chunk); err != nil {
+				return err
+			}
+			hasProp = true
+		case "DSD ":
+			data = &chunks[i]
+		case "DST ":
+			return ErrUnsupportedFormat
+		case "DIIN":
+			dec.parseDFFInfo(chunk)
+		case "ID3 ", "id3 ":
+			body, err := readChunkBody(dec.file, chunk)
+			if err != nil {
+				continue
+			}
+			tag, err := readID3v2(bytes.NewReader(body))
+			if err == nil && tag != nil {
+				tag.apply(&dec.meta)
+			}
+		}
+	}
+
+	if !hasProp || data == nil || dec.channels == 0 {
+		return ErrNotDFF
+	}
+	dec.dataStart = data.offset
+	dec.dataBytes = data.size / int64(dec.channels)
+	dec.samples = dec.dataBytes * 8
+
+	return dec.init()
+}
+
+func (dec *dsdDecoder) parseDFFProperties(prop riffChunk) error {
+	header := make([]byte, 4)
+	if _, err := dec.file.Seek(prop.offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(dec.file, header); err != nil || string(header) != "SND " {
+		return ErrNotDFF
+	}
+
+	chunks, err := readDFFChunks(dec.file, prop.offset+4, prop.offset+prop.size)
+	if err != nil {
+		return err
+	}
+
+	for _, chunk := range chunks {
+		switch chunk.id {
+		case "FS  ", "CHNL", "CMPR":
+		default:
+			continue
+		}
+		if chunk.size > DFF_MAX_TEXT {
+			return ErrNotDFF
+		}
+		body, err := readChunkBody(dec.file, chunk)
+		if err != nil {
+			return ErrNotDFF
+		}
+
+		switch chunk.id {
+		case "FS  ":
+			if len(body) < 4 {
+				return ErrNotDFF
+			}
+			dec.dsdRate = int(binary.BigEndian.Uint32(body))
+		case "CHNL":
+			if len(body) < 2 {
+				return ErrNotDFF
+			}
+			dec.channels = int(binary.BigEndian.Uint16(body))
+			if len(body) < 2+4*dec.channels {
+				return ErrNotDFF
+			}
+			dec.order = dffChannelMap(body[2:], dec.channels)
+		case "CMPR":
+			if len(body) < 4 || string(body[:4]) != "DSD " {
+				return ErrUnsupportedFormat
+			}
+		}
+	}
+
+	return nil
+}
+
+// dffChannelMap returns where each stored channel belongs in WAVE order, or
+// nil if they are stored in that order already or cannot all be placed
+func dffChannelMap(ids []byte, channels int) []int {
+	order := make([]int, channels)
+	used := make([]bool, channels)
+	inOrder := true
+	for ch := range order {
+		pos, ok := dffChannelOrder[string(ids[ch*4:ch*4+4])]
+		if !ok || pos >= channels || used[pos] {
+			return nil
+		}
+		order[ch] = pos
+		used[pos] = true
+		inOrder = inOrder && pos == ch
+	}
+
+	if inOrder {
+		return nil
+	}
+	return order
+}
+
+// parseDFFInfo reads the title and artist from the edited master information
+func (dec *dsdDecoder) parseDFFInfo(info riffChunk) {
+	chunks, err := readDFFChunks(dec.file, info.offset, info.offset+info.size)
+	if err != nil {
+		return
+	}
+
+	for _, chunk := range chunks {
+		if (chunk.id != "DITI" && chunk.id != "DIAR") || chunk.size > DFF_MAX_TEXT {
+			continue
+		}
+		body, err := readChunkBody(dec.file, chunk)
+		if err != nil || len(body) < 4 {
+			continue
+		}
+
+		// a 32-bit count precedes the text
+		count := int(binary.BigEndian.Uint32(body))
+		value := trimTagString(body[4:min(len(body), 4+count)])
+		if value == "" {
+			continue
+		}
+		if chunk.id == "DITI" {
+			dec.meta.Title = value
+		} else {
+			dec.meta.Artist = value
+		}
+	}
+}
+
+func createDFFAudioSourceFromFile(metadata *Metadata) (AudioSource, error) {
+	dec, err := openDFF(metadata.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDecodedSource(dec), nil
+}
+
+func getDFFFileMetadata(path string) (*Metadata, error) {
+	dec, err := openDFF(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.file.Close()
+
+	metadata := dec.metadata()
+	return &metadata, nil
+}
@@ -0,0 +1,287 @@
+package audio
+
+import (
+	"io"
+	"math"
+	"math/bits"
+	"os"
+)
+
+const (
+	// 1-bit rates are multiples of 64 times a PCM base rate
+	DSD64_RATE_44 = 2822400
+	DSD64_RATE_48 = 3072000
+	DSD_MAX_RATE  = 16 * DSD64_RATE_48 // DSD1024
+
+	DSD_READ_BYTES = 4096 // per channel
+	DSD_SILENCE    = 0x69 // idle pattern with no DC
+
+	// the decimation filter spans this many output periods
+	DSD_FILTER_PERIODS = 32
+	DSD_KAISER_B       = 9.0
+	// cutoff as a fraction of the output rate, and never above the 1-bit
+	// rate over this divisor where the shaped noise takes over
+	DSD_CUTOFF         = 0.4
+	DSD_MAX_CUTOFF_DIV = 64
+)
+
+// dsdFilter decimates 1-bit audio to PCM with a linear phase low-pass FIR.
+// The taps are grouped by byte so each input byte costs one table lookup.
+type dsdFilter struct {
+	step   int // input bytes per output sample
+	tables [][256]float64
+
+	// the last window of input bytes of each channel
+	history [][]byte
+}
+
+func newDSDFilter(dsdRate int, outRate int, channels int) *dsdFilter {
+	decimation := dsdRate / outRate
+	taps := decimation * DSD_FILTER_PERIODS
+	cutoff := math.Min(DSD_CUTOFF*float64(outRate), float64(dsdRate)/DSD_MAX_CUTOFF_DIV) / float64(dsdRate)
+
+	h := make([]float64, taps)
+	sum := 0.0
+	for i := range h {
+		x := float64(i) - float64(taps-1)/2
+		h[i] = 2 * cutoff * sinc(2*cutoff*x) * kaiser(x/(float64(taps)/2), DSD_KAISER_B)
+		sum += h[i]
+	}
+
+	f := &dsdFilter{step: decimation / 8, tables: make([][256]float64, taps/8)}
+	for g := range f.tables {
+		for b := 0; b < 256; b++ {
+			acc := 0.0
+			for k := 0; k < 8; k++ {
+				// the most significant bit is the earliest sample
+				if b>>(7-k)&1 != 0 {
+					acc += h[g*8+k]
+				} else {
+					acc -= h[g*8+k]
+				}
+			}
+			f.tables[g][b] = acc / sum
+		}
+	}
+
+	f.history = make([][]byte, channels)
+	f.reset()
+	return f
+}
+
+func (f *dsdFilter) reset() {
+	for ch := range f.history {
+		window := make([]byte, len(f.tables))
+		for i := range window {
+			window[i] = DSD_SILENCE
+		}
+		f.history[ch] = window
+	}
+}
+
+// process filters the next bytes of channel ch, writing one sample per step
+// bytes into out at the given stride
+func (f *dsdFilter) process(ch int, data []byte, out []float64, stride int) {
+	window := len(f.tables)
+	buf := append(f.history[ch], data...)
+
+	// the first window ends one step past the history
+	for j := 0; (j+1)*f.step+window <= len(buf) && j*stride+ch < len(out); j++ {
+		in := buf[(j+1)*f.step : (j+1)*f.step+window]
+		acc := 0.0
+		for g, b := range in {
+			acc += f.tables[g][b]
+		}
+		out[j*stride+ch] = acc
+	}
+
+	f.history[ch] = append(f.history[ch][:0], buf[len(buf)-window:]...)
+}
+
+// dsdDecoder converts the 1-bit audio of a DSF or DFF file to PCM
+type dsdDecoder struct {
+	file *os.File
+
+	channels   int
+	dsdRate    int
+	lsbFirst   bool  // DSF may store the earliest sample in the low bit
+	interleave int   // bytes of one channel stored together
+	order      []int // output position of each stored channel, nil if in order
+
+	dataStart int64
+	dataBytes int64 // per channel
+	samples   int64 // per channel
+
+	format PCMWaveFormat
+	filter *dsdFilter
+	frames int64
+	pos    int64 // per channel byte offset of the next read
+
+	meta Metadata
+	buf  []byte
+}
+
+// init picks the default output rate once the container has been parsed
+func (dec *dsdDecoder) init() error {
+	if dec.channels <= 0 || dec.interleave <= 0 || DSD_READ_BYTES%dec.interleave != 0 {
+		return ErrUnsupportedFormat
+	}
+
+	base := dec.baseRate()
+	if base == 0 || dec.dsdRate > DSD_MAX_RATE {
+		return ErrUnsupportedFormat
+	}
+
+	rate := base * 2
+	if dec.dsdRate >= base*128 {
+		rate = base * 4
+	}
+	dec.setRate(rate)
+
+	dec.meta.Duration = uint64(dec.samples * SECOND / int64(dec.dsdRate))
+	dec.buf = make([]byte, DSD_READ_BYTES*dec.channels)
+	return dec.seek(0)
+}
+
+// baseRate is the PCM family of the 1-bit rate, or 0 if it is not one
+func (dec *dsdDecoder) baseRate() int {
+	for _, rate := range []int{DSD64_RATE_44, DSD64_RATE_48} {
+		if dec.dsdRate >= rate && dec.dsdRate%rate == 0 && bits.OnesCount(uint(dec.dsdRate/rate)) == 1 {
+			return rate / 64
+		}
+	}
+	return 0
+}
+
+func (dec *dsdDecoder) setRate(rate int) {
+	dec.format = PCMWaveFormat{
+		NumChannels: uint16(dec.channels),
+		SampleRate:  uint32(rate),
+		SampleDepth: 32,
+		PCMType:     PCM_TYPE_FLOAT,
+	}
+	dec.filter = newDSDFilter(dec.dsdRate, rate, dec.channels)
+	dec.frames = dec.samples / int64(dec.dsdRate/rate)
+}
+
+// selectRate decimates to 88.2 or 176.4 kHz (96 or 192 kHz for the 48 kHz
+// family), taking the lowest that is not below the requested rate
+func (dec *dsdDecoder) selectRate(rate uint32) *PCMWaveFormat {
+	base := dec.baseRate()
+	chosen := base * 4
+	if int(rate) <= base*2 {
+		chosen = base * 2
+	}
+
+	if chosen != int(dec.format.SampleRate) {
+		dec.setRate(chosen)
+	}
+	return dec.nativeFormat()
+}
+
+// outputFrame is the frame centred on the filter window that ends at the
+// per channel byte offset pos
+func (dec *dsdDecoder) outputFrame(pos int64) int64 {
+	return pos/int64(dec.filter.step) - DSD_FILTER_PERIODS/2
+}
+
+func (dec *dsdDecoder) nativeFormat() *PCMWaveFormat {
+	format := dec.format
+	return &format
+}
+
+func (dec *dsdDecoder) metadata() Metadata {
+	return dec.meta
+}
+
+func (dec *dsdDecoder) close() error {
+	return dec.file.Close()
+}
+
+// read fetches the next DSD_READ_BYTES of every channel, padding past the
+// end of the data with silence to flush the filter
+func (dec *dsdDecoder) read() ([][]byte, error) {
+	raw := dec.buf
+	n := 0
+	if dec.pos < dec.dataBytes {
+		size := min(int64(len(raw)), (dec.dataBytes-dec.pos)*int64(dec.channels))
+		var err error
+		n, err = dec.file.ReadAt(raw[:size], dec.dataStart+dec.pos*int64(dec.channels))
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+	for i := n; i < len(raw); i++ {
+		raw[i] = DSD_SILENCE
+	}
+
+	channels := make([][]byte, dec.channels)
+	for ch := range channels {
+		channels[ch] = make([]byte, 0, DSD_READ_BYTES)
+	}
+	for group := 0; group < len(raw); group += dec.interleave * dec.channels {
+		for ch := range channels {
+			start := group + ch*dec.interleave
+			channels[ch] = append(channels[ch], raw[start:start+dec.interleave]...)
+		}
+	}
+
+	// blocks are padded past the last sample
+	end := max(0, min(DSD_READ_BYTES, (dec.samples+7)/8-dec.pos))
+	for _, data := range channels {
+		if dec.lsbFirst {
+			for i, b := range data[:end] {
+				data[i] = bits.Reverse8(b)
+			}
+		}
+		for i := end; i < DSD_READ_BYTES; i++ {
+			data[i] = DSD_SILENCE
+		}
+	}
+	return channels, nil
+}
+
+func (dec *dsdDecoder) decode() ([]float64, int64, error) {
+	for {
+		first := dec.outputFrame(dec.pos) + 1
+		if first >= dec.frames {
+			return nil, 0, io.EOF
+		}
+
+		data, err := dec.read()
+		if err != nil {
+			return nil, 0, err
+		}
+		dec.pos += DSD_READ_BYTES
+
+		count := DSD_READ_BYTES / dec.filter.step
+		samples := make([]float64, count*dec.channels)
+		for ch, bytes := range data {
+			out := ch
+			if dec.order != nil {
+				out = dec.order[ch]
+			}
+			dec.filter.process(out, bytes, samples, dec.channels)
+		}
+
+		// frames centred before the start are only the filter filling up
+		start := max(0, -first)
+		end := min(int64(count), dec.frames-first)
+		if start >= end {
+			continue
+		}
+		return samples[start*int64(dec.channels) : end*int64(dec.channels)], first + start, nil
+	}
+}
+
+// seek restarts far enough ahead of frame for the filter to have filled
+func (dec *dsdDecoder) seek(frame int64) error {
+	frame = min(max(frame, 0), dec.frames)
+
+	pos := (frame - DSD_FILTER_PERIODS/2) * int64(dec.filter.step)
+	pos = max(pos, 0) / DSD_READ_BYTES * DSD_READ_BYTES
+
+	dec.pos = pos
+	dec.filter.reset()
+	return nil
+}
@@ -0,0 +1,216 @@
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sigmaDelta modulates a sine of the given amplitude and frequency to n bits
+// with a second order loop, the earliest bit of each byte the highest
+func sigmaDelta(amplitude, freq float64, rate, n int) []byte {
+	out := make([]byte, n/8)
+	var i1, i2 float64
+	y := -1.0
+	for i := 0; i < n; i++ {
+		x := amplitude * math.Sin(2*math.Pi*freq*float64(i)/float64(rate))
+		i1 += x - y
+		i2 += i1 - y
+		y = -1
+		if i2 >= 0 {
+			y = 1
+			out[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return out
+}
+
+// writeDSF lays channels out in blocks of DSF_BLOCK_DEFAULT bytes, followed
+// by an ID3v2 tag
+func writeDSF(t *testing.T, path string, rate int, channels [][]byte, lsbFirst bool) {
+	t.Helper()
+	per := (len(channels[0]) + DSF_BLOCK_DEFAULT - 1) / DSF_BLOCK_DEFAULT * DSF_BLOCK_DEFAULT
+	var data []byte
+	for block := 0; block < per; block += DSF_BLOCK_DEFAULT {
+		for _, ch := range channels {
+			for i := block; i < block+DSF_BLOCK_DEFAULT; i++ {
+				// the last block is padded out with zeros
+				b := byte(0)
+				if i < len(ch) {
+					b = ch[i]
+				}
+				if lsbFirst {
+					b = bits.Reverse8(b)
+				}
+				data = append(data, b)
+			}
+		}
+	}
+	order := uint32(DSF_MSB_FIRST)
+	if lsbFirst {
+		order = DSF_LSB_FIRST
+	}
+
+	le := binary.LittleEndian
+	tag := []byte("ID3\x03\x00\x00\x00\x00\x00\x1eTIT2\x00\x00\x00\x05\x00\x00\x00SongTPE1\x00\x00\x00\x05\x00\x00\x00Band")
+	end := uint64(DSF_HEADER_SIZE + DSF_FMT_SIZE + DSF_DATA_HEADER + len(data))
+	out := le.AppendUint64([]byte("DSD "), DSF_HEADER_SIZE)
+	out = le.AppendUint64(out, end+uint64(len(tag)))
+	out = le.AppendUint64(out, end)
+	out = le.AppendUint64(append(out, "fmt "...), DSF_FMT_SIZE)
+	out = le.AppendUint32(out, 1)
+	out = le.AppendUint32(out, DSF_FORMAT_RAW)
+	out = le.AppendUint32(out, 2) // channel type, stereo
+	out = le.AppendUint32(out, uint32(len(channels)))
+	out = le.AppendUint32(out, uint32(rate))
+	out = le.AppendUint32(out, order)
+	out = le.AppendUint64(out, uint64(len(channels[0])*8))
+	out = le.AppendUint32(out, DSF_BLOCK_DEFAULT)
+	out = le.AppendUint32(out, 0)
+	out = le.AppendUint64(append(out, "data"...), uint64(DSF_DATA_HEADER+len(data)))
+	out = append(out, data...)
+	if err := os.WriteFile(path, append(out, tag...), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func dffChunk(id string, parts ...[]byte) []byte {
+	var body []byte
+	for _, part := range parts {
+		body = append(body, part...)
+	}
+	out := binary.BigEndian.AppendUint64([]byte(id), uint64(len(body)))
+	out = append(out, body...)
+	if len(body)&1 != 0 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+// writeDFF interleaves channels byte by byte, stored as the loudspeaker ids
+// name them
+func writeDFF(t *testing.T, path string, rate int, ids []string, channels [][]byte) {
+	t.Helper()
+	be := binary.BigEndian
+	chnl := be.AppendUint16(nil, uint16(len(ids)))
+	for _, id := range ids {
+		chnl = append(chnl, id...)
+	}
+	var data []byte
+	for i := range channels[0] {
+		for _, ch := range channels {
+			data = append(data, ch[i])
+		}
+	}
+	title := "Song"
+	file := dffChunk("FRM8", []byte("DSD "),
+		dffChunk("FVER", be.AppendUint32(nil, 0x01050000)),
+		dffChunk("PROP", []byte("SND "),
+			dffChunk("FS  ", be.AppendUint32(nil, uint32(rate))),
+			dffChunk("CHNL", chnl),
+			dffChunk("CMPR", []byte("DSD \x0enot compressed\x00")),
+		),
+		dffChunk("DSD ", data),
+		dffChunk("DIIN", dffChunk("DITI", be.AppendUint32(nil, uint32(len(title))), []byte(title))),
+	)
+	if err := os.WriteFile(path, file, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkTone fits a sine of freq to channel ch of samples, away from the ends,
+// and fails unless it is of the given amplitude, in phase and clean
+func checkTone(t *testing.T, what string, samples []float64, ch, channels int, freq float64, rate int, amplitude float64) {
+	t.Helper()
+	n := len(samples) / channels
+	var ss, sc, cc, xs, xc float64
+	for i := n / 10; i < n*9/10; i++ {
+		s, c := math.Sincos(2 * math.Pi * freq * float64(i) / float64(rate))
+		v := samples[i*channels+ch]
+		ss, sc, cc = ss+s*s, sc+s*c, cc+c*c
+		xs, xc = xs+v*s, xc+v*c
+	}
+	det := ss*cc - sc*sc
+	a, b := (xs*cc-xc*sc)/det, (xc*ss-xs*sc)/det
+
+	var noise float64
+	for i := n / 10; i < n*9/10; i++ {
+		s, c := math.Sincos(2 * math.Pi * freq * float64(i) / float64(rate))
+		d := samples[i*channels+ch] - a*s - b*c
+		noise += d * d
+	}
+	snr := 10 * math.Log10(amplitude*amplitude/2/(noise/float64(n*8/10)))
+	if math.Abs(a-amplitude) > 0.01 || math.Abs(b) > 0.01 || snr < 50 {
+		t.Fatalf("%s: channel %d fits %.4f sin + %.4f cos at %.1f dB", what, ch, a, b, snr)
+	}
+}
+
+func TestDSF(t *testing.T) {
+	dir := t.TempDir()
+	const rate = DSD64_RATE_44
+	n := rate / 4
+	left := sigmaDelta(0.5, 1000, rate, n)
+	right := sigmaDelta(0.5, 2500, rate, n)
+
+	for _, lsbFirst := range []bool{false, true} {
+		path := filepath.Join(dir, "a.dsf")
+		writeDSF(t, path, rate, [][]byte{left, right}, lsbFirst)
+		dec, err := openDSF(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m := dec.metadata(); m.Title != "Song" || m.Artist != "Band" {
+			t.Fatalf("metadata %+v", m)
+		}
+
+		// 88.2 kHz by default, 176.4 kHz when asked for more
+		for _, out := range []int{88200, 176400} {
+			dec.selectRate(uint32(out))
+			frames := int64(n / (rate / out))
+			checkFormat(t, dec, 2, out, frames)
+			dec.seek(0)
+			all := decodeAll(t, dec)
+			if int64(len(all)) != frames*2 {
+				t.Fatalf("%d frames, expected %d", len(all)/2, frames)
+			}
+			checkTone(t, "left", all, 0, 2, 1000, out, 0.5)
+			checkTone(t, "right", all, 1, 2, 2500, out, 0.5)
+			checkSeek(t, dec, all, 0, 0, 1, 100, 5000, frames/2, frames-1)
+		}
+		dec.close()
+	}
+}
+
+func TestDFF(t *testing.T) {
+	dir := t.TempDir()
+	const rate = 2 * DSD64_RATE_44
+	n := rate / 8
+	left := sigmaDelta(0.5, 1000, rate, n)
+	right := sigmaDelta(0.5, 3000, rate, n)
+
+	// stored right first, and put back in order
+	path := filepath.Join(dir, "a.dff")
+	writeDFF(t, path, rate, []string{"SRGT", "SLFT"}, [][]byte{right, left})
+	dec, err := openDFF(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.close()
+	if m := dec.metadata(); m.Title != "Song" {
+		t.Fatalf("metadata %+v", m)
+	}
+
+	// DSD128 decimates to 176.4 kHz by default
+	frames := int64(n / 32)
+	checkFormat(t, dec, 2, 176400, frames)
+	all := decodeAll(t, dec)
+	if int64(len(all)) != frames*2 {
+		t.Fatalf("%d frames, expected %d", len(all)/2, frames)
+	}
+	checkTone(t, "left", all, 0, 2, 1000, 176400, 0.5)
+	checkTone(t, "right", all, 1, 2, 3000, 176400, 0.5)
+	checkSeek(t, dec, all, 0, 0, 1, 3000, frames/2, frames-1)
+}
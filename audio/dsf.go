@@ -0,0 +1,126 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+const (
+	DSF_HEADER_SIZE = 28
+	DSF_FMT_SIZE    = 52
+	DSF_DATA_HEADER = 12
+
+	DSF_FORMAT_RAW    = 0
+	DSF_LSB_FIRST     = 1
+	DSF_MSB_FIRST     = 8
+	DSF_MAX_CHANNELS  = 6
+	DSF_BLOCK_DEFAULT = 4096
+)
+
+var (
+	ErrNotDSF = errors.New("not a DSF file")
+)
+
+func init() {
+	RegisterAudioSourceProvider(".dsf", &AudioSourceProvider{createDSFAudioSourceFromFile, getDSFFileMetadata})
+}
+
+func openDSF(path string) (*dsdDecoder, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := &dsdDecoder{file: file}
+	err = readDSFHeader(dec, path)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return dec, nil
+}
+
+func readDSFHeader(dec *dsdDecoder, path string) error {
+	header := make([]byte, DSF_HEADER_SIZE+DSF_FMT_SIZE+DSF_DATA_HEADER)
+	if _, err := io.ReadFull(dec.file, header); err != nil {
+		return ErrNotDSF
+	}
+	le := binary.LittleEndian
+
+	if string(header[:4]) != "DSD " || le.Uint64(header[4:]) != DSF_HEADER_SIZE {
+		return ErrNotDSF
+	}
+	tagOffset := int64(le.Uint64(header[20:]))
+
+	fmtChunk := header[DSF_HEADER_SIZE:]
+	if string(fmtChunk[:4]) != "fmt " || le.Uint64(fmtChunk[4:]) != DSF_FMT_SIZE {
+		return ErrNotDSF
+	}
+	if le.Uint32(fmtChunk[16:]) != DSF_FORMAT_RAW {
+		return ErrUnsupportedFormat
+	}
+	dec.channels = int(le.Uint32(fmtChunk[24:]))
+	dec.dsdRate = int(le.Uint32(fmtChunk[28:]))
+	dec.samples = int64(le.Uint64(fmtChunk[36:]))
+	dec.interleave = int(le.Uint32(fmtChunk[44:]))
+
+	switch le.Uint32(fmtChunk[32:]) {
+	case DSF_LSB_FIRST:
+		dec.lsbFirst = true
+	case DSF_MSB_FIRST:
+	default:
+		return ErrUnsupportedFormat
+	}
+	if dec.channels > DSF_MAX_CHANNELS || dec.samples < 0 {
+		return ErrUnsupportedFormat
+	}
+
+	data := fmtChunk[DSF_FMT_SIZE:]
+	if string(data[:4]) != "data" {
+		return ErrNotDSF
+	}
+	size := int64(le.Uint64(data[4:])) - DSF_DATA_HEADER
+	if size < 0 || dec.channels == 0 {
+		return ErrNotDSF
+	}
+	dec.dataStart = DSF_HEADER_SIZE + DSF_FMT_SIZE + DSF_DATA_HEADER
+	dec.dataBytes = size / int64(dec.channels)
+	dec.samples = min(dec.samples, dec.dataBytes*8)
+
+	dec.meta = *NewMetadata()
+	dec.meta.Filepath = path
+
+	if tagOffset > 0 {
+		if _, err := dec.file.Seek(tagOffset, io.SeekStart); err == nil {
+			tag, err := readID3v2(dec.file)
+			if err == nil && tag != nil {
+				tag.apply(&dec.meta)
+			}
+		}
+	}
+
+	return dec.init()
+}
+
+func createDSFAudioSourceFromFile(metadata *Metadata) (AudioSource, error) {
+	dec, err := openDSF(metadata.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDecodedSource(dec), nil
+}
+
+func getDSFFileMetadata(path string) (*Metadata, error) {
+	dec, err := openDSF(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.file.Close()
+
+	metadata := dec.metadata()
+	return &metadata, nil
+}
@@ -0,0 +1,96 @@
+package audio
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	ERROR_SOURCE    = iota // a file could not be played and was skipped
+	ERROR_DEVICE           // the output device was lost and is being reopened
+	ERROR_FATAL            // the player could not recover and has closed
+	ERROR_PROCESSOR        // a processor could not take the device's format and was dropped
+)
+
+const (
+	RECONNECT_DELAY     = 250 * time.Millisecond // wait before the first attempt to reopen a lost device
+	RECONNECT_MAX_DELAY = 8 * time.Second
+	RECONNECT_ATTEMPTS  = 10
+)
+
+var (
+	ErrReconnectFailed = errors.New("could not reopen the output device")
+	ErrSourcePanicked  = errors.New("decoder failed")
+)
+
+// reconnectAfter times the attempts to reopen a lost device
+var reconnectAfter = time.After
+
+// PlayerError is published when playback runs into a problem
+type PlayerError struct {
+	Kind int
+	Path string // the file that failed, for ERROR_SOURCE
+	Err  error
+}
+
+func (e PlayerError) Error() string {
+	if e.Path != "" {
+		return e.Path + ": " + e.Err.Error()
+	}
+	return e.Err.Error()
+}
+
+func (e PlayerError) Unwrap() error {
+	return e.Err
+}
+
+// readSource reads the next block of source, turning a panic in its decoder
+// into an error so a broken file costs its track rather than the program
+func readSource(source AudioSource) (data []byte, tstamp int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			data, tstamp, err = nil, 0, fmt.Errorf("%w: %v", ErrSourcePanicked, r)
+		}
+	}()
+	return source.ReadNext()
+}
+
+// disconnectedClient stands in for a lost client while the player reopens
+// the device, taking commands without doing anything
+type disconnectedClient struct {
+	format PCMWaveFormat
+}
+
+func (c disconnectedClient) GetPCMWaveFormat() *PCMWaveFormat {
+	format := c.format
+	return &format
+}
+
+func (c disconnectedClient) GetBufferSize() (int, error) {
+	return 0, nil
+}
+
+func (c disconnectedClient) GetBufferPadding() (int, error) {
+	return 0, nil
+}
+
+func (c disconnectedClient) LoadToBuffer(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (c disconnectedClient) ClearBuffer() error {
+	return nil
+}
+
+func (c disconnectedClient) Start() error {
+	return nil
+}
+
+func (c disconnectedClient) Stop() (bool, error) {
+	return false, nil
+}
+
+func (c disconnectedClient) Close() error {
+	return nil
+}
@@ -0,0 +1,328 @@
+package audio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingClient is a simulated client whose calls fail once broken, those
+// named in calls or all of them if none are
+type failingClient struct {
+	*SimulatedClient
+	mutex sync.Mutex
+	err   error
+	calls []string
+}
+
+func (c *failingClient) breakWith(err error, calls ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.err, c.calls = err, calls
+}
+
+func (c *failingClient) failing(call string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.calls) == 0 {
+		return c.err
+	}
+	for _, name := range c.calls {
+		if name == call {
+			return c.err
+		}
+	}
+	return nil
+}
+
+func (c *failingClient) GetBufferPadding() (int, error) {
+	if err := c.failing("GetBufferPadding"); err != nil {
+		return 0, err
+	}
+	return c.SimulatedClient.GetBufferPadding()
+}
+
+func (c *failingClient) LoadToBuffer(data []byte) (int, error) {
+	if err := c.failing("LoadToBuffer"); err != nil {
+		return 0, err
+	}
+	return c.SimulatedClient.LoadToBuffer(data)
+}
+
+func (c *failingClient) Start() error {
+	if err := c.failing("Start"); err != nil {
+		return err
+	}
+	return c.SimulatedClient.Start()
+}
+
+func (c *failingClient) Stop() (bool, error) {
+	if err := c.failing("Stop"); err != nil {
+		return false, err
+	}
+	return c.SimulatedClient.Stop()
+}
+
+// reconnectTimer is an attempt to reopen the device waiting on the test
+type reconnectTimer struct {
+	delay time.Duration
+	fire  chan time.Time
+}
+
+// timeReconnects hands the player's waits between attempts to reopen the
+// device to the test, rather than waiting them out
+func timeReconnects(t *testing.T) <-chan reconnectTimer {
+	timers := make(chan reconnectTimer, 1)
+	saved := reconnectAfter
+	t.Cleanup(func() { reconnectAfter = saved })
+	reconnectAfter = func(d time.Duration) <-chan time.Time {
+		fire := make(chan time.Time, 1)
+		timers <- reconnectTimer{d, fire}
+		return fire
+	}
+	return timers
+}
+
+// nextTimer waits for the player to wait to reopen the device
+func nextTimer(t *testing.T, timers <-chan reconnectTimer) reconnectTimer {
+	t.Helper()
+	select {
+	case timer := <-timers:
+		return timer
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a reconnect")
+	}
+	return reconnectTimer{}
+}
+
+// failingPlayer plays path through a client that can be broken, reopening
+// the device with newClient
+func failingPlayer(t *testing.T, path string, newClient func(clock *VirtualClock) (AudioClient, error)) (*simPlayer, *failingClient) {
+	t.Helper()
+	clock := NewVirtualClock()
+	sim, err := NewSimulatedClient(clock, &PCMWaveFormat{2, 48000, 16, PCM_TYPE_INT}, 9600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &failingClient{SimulatedClient: sim}
+	p, err := NewPlayer(WithClient(client), WithClock(clock), WithClientFactory(func() (AudioClient, error) {
+		return newClient(clock)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close(context.Background()) })
+
+	s := &simPlayer{p, clock, sim, newTap(p)}
+	p.AddSourcesToQueue(path)
+	s.tap.waitQueued(t, 1)
+	return s, client
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	timers := timeReconnects(t)
+	a := filepath.Join(t.TempDir(), "a.wav")
+	writeWav(t, a, 2, 48000, 16, false, 480000, constant(0.1))
+
+	// the device cannot be reopened the first three times
+	var attempts int
+	var reopened *SimulatedClient
+	p, client := failingPlayer(t, a, func(clock *VirtualClock) (AudioClient, error) {
+		attempts++
+		if attempts <= 3 {
+			return nil, fmt.Errorf("attempt %d", attempts)
+		}
+		var err error
+		reopened, err = NewSimulatedClient(clock, &PCMWaveFormat{2, 48000, 16, PCM_TYPE_INT}, 9600)
+		return reopened, err
+	})
+	p.Start()
+	p.step(5)
+	p.tap.drain()
+
+	lost := errors.New("device unplugged")
+	client.breakWith(lost)
+	pos := p.GetPositionInTrack()
+	p.step(1)
+
+	// each failure doubles the wait before the next attempt
+	var delays []time.Duration
+	for i := 0; i < 4; i++ {
+		timer := nextTimer(t, timers)
+		delays = append(delays, timer.delay)
+		timer.fire <- time.Time{}
+	}
+	// a command is only taken once the last attempt has been handled
+	p.Start()
+	if fmt.Sprint(delays) != "[250ms 500ms 1s 2s]" || attempts != 4 {
+		t.Fatalf("waited %v over %d attempts", delays, attempts)
+	}
+	events := p.tap.drain()
+	if len(events) != 1 || !errors.Is(events[0].(PlayerError).Err, lost) || events[0].(PlayerError).Kind != ERROR_DEVICE {
+		t.Fatalf("events %v", events)
+	}
+
+	// the track picks up from where it was last heard on the new device
+	if got := p.GetPositionInTrack(); got != pos {
+		t.Fatalf("position %d after reconnecting, was %d", got, pos)
+	}
+	p.step(5)
+	if got := p.GetPositionInTrack(); got <= pos {
+		t.Fatalf("position %d after reconnecting, was %d", got, pos)
+	}
+	if played := reopened.Played(); played < 4*4800 {
+		t.Fatalf("%d frames played after reconnecting", played)
+	}
+	if events := p.tap.drain(); len(events) != 0 {
+		t.Fatalf("events %v", events)
+	}
+}
+
+func TestReconnectGivesUp(t *testing.T) {
+	timers := timeReconnects(t)
+	a := filepath.Join(t.TempDir(), "a.wav")
+	writeWav(t, a, 2, 48000, 16, false, 480000, constant(0.1))
+	never := errors.New("no device")
+	p, client := failingPlayer(t, a, func(clock *VirtualClock) (AudioClient, error) {
+		return nil, never
+	})
+	p.Start()
+	p.step(2)
+	p.tap.drain()
+
+	// a stop that fails while pausing loses the device like any other call
+	client.breakWith(errors.New("stuck"), "Stop")
+	p.Stop()
+	p.step(3)
+
+	// the waits between attempts stop growing at RECONNECT_MAX_DELAY, and
+	// after RECONNECT_ATTEMPTS the player gives up and closes
+	var delays []time.Duration
+	for i := 0; i < RECONNECT_ATTEMPTS; i++ {
+		timer := nextTimer(t, timers)
+		delays = append(delays, timer.delay)
+		timer.fire <- time.Time{}
+	}
+	if fmt.Sprint(delays) != "[250ms 500ms 1s 2s 4s 8s 8s 8s 8s 8s]" {
+		t.Fatalf("waited %v", delays)
+	}
+	var errs []PlayerError
+	for e := range p.tap.sub.Events {
+		if pe, ok := e.(PlayerError); ok {
+			errs = append(errs, pe)
+		}
+	}
+	if len(errs) != 2 || errs[0].Kind != ERROR_DEVICE || errs[1].Kind != ERROR_FATAL ||
+		!errors.Is(errs[1].Err, ErrReconnectFailed) || !errors.Is(errs[1].Err, never) {
+		t.Fatalf("errors %v", errs)
+	}
+}
+
+var errUnseekable = errors.New("cannot seek")
+
+// unseekableSource is a source that cannot be moved
+type unseekableSource struct {
+	AudioSource
+}
+
+func (s unseekableSource) SetPosition(int64) error {
+	return errUnseekable
+}
+
+func TestSeekError(t *testing.T) {
+	a := filepath.Join(t.TempDir(), "a.stuck")
+	writeWav(t, a, 2, 48000, 16, false, 480000, constant(0.1))
+	wav := getProviderForPath("a.wav")
+	stuck := &AudioSourceProvider{
+		func(metadata *Metadata) (AudioSource, error) {
+			source, err := wav.GetAudioSourceFromFile(metadata)
+			return unseekableSource{source}, err
+		},
+		wav.GetFileMetadata,
+	}
+	p := newSimPlayer(t, []string{a}, WithSourceProvider(stuck, ".stuck"))
+	p.Start()
+	p.step(5)
+	p.tap.drain()
+
+	// a seek the track cannot make is reported, and it plays on from where
+	// it was
+	for _, seek := range []func(){p.SeekForward, p.SeekBackward} {
+		pos := p.GetPositionInTrack()
+		seek()
+		events := p.tap.drain()
+		if len(events) != 1 {
+			t.Fatalf("events %v", events)
+		}
+		if e, ok := events[0].(PlayerError); !ok || e.Kind != ERROR_SOURCE || e.Path != a || e.Err != errUnseekable {
+			t.Fatalf("event %v", events[0])
+		}
+		if got := p.GetPositionInTrack(); got != pos {
+			t.Fatalf("position %d after seeking, was %d", got, pos)
+		}
+		p.step(1)
+		if got := p.GetPositionInTrack(); got <= pos {
+			t.Fatalf("position %d after playing on, was %d", got, pos)
+		}
+	}
+}
+
+// panickingSource is a source whose decoder breaks partway through
+type panickingSource struct {
+	AudioSource
+	reads *int
+}
+
+func (s panickingSource) ReadNext() ([]byte, int, error) {
+	if *s.reads++; *s.reads > 3 {
+		var table []int
+		_ = table[*s.reads]
+	}
+	return s.AudioSource.ReadNext()
+}
+
+func TestSourcePanic(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.boom")
+	b := filepath.Join(dir, "b.wav")
+	writeWav(t, a, 2, 48000, 16, false, 480000, constant(0.1))
+	writeWav(t, b, 2, 48000, 16, false, 12000, constant(-0.1))
+	wav := getProviderForPath("a.wav")
+	var reads int
+	boom := &AudioSourceProvider{
+		func(metadata *Metadata) (AudioSource, error) {
+			source, err := wav.GetAudioSourceFromFile(metadata)
+			return panickingSource{source, &reads}, err
+		},
+		wav.GetFileMetadata,
+	}
+	p := newSimPlayer(t, []string{a, b}, WithSourceProvider(boom, ".boom"))
+	p.Start()
+	p.step(10)
+
+	// the panic is reported against the file, which is skipped, and the
+	// player goes on to the next
+	var errs []PlayerError
+	var tracks []string
+	for _, e := range p.tap.drain() {
+		switch e := e.(type) {
+		case PlayerError:
+			errs = append(errs, e)
+		case TrackChanged:
+			tracks = append(tracks, filepath.Base(e.Metadata.Filepath))
+		}
+	}
+	if len(errs) != 1 || errs[0].Kind != ERROR_SOURCE || errs[0].Path != a || !errors.Is(errs[0].Err, ErrSourcePanicked) {
+		t.Fatalf("errors %v", errs)
+	}
+	if fmt.Sprint(tracks) != "[a.boom b.wav]" {
+		t.Fatalf("tracks %v", tracks)
+	}
+	if _, lengths := runs(p.client.Written()); lengths[len(lengths)-1] != 12000 {
+		t.Fatalf("runs %v", lengths)
+	}
+}
@@ -0,0 +1,202 @@
+package audio
+
+import "sync"
+
+// what a subscription does with an event when its buffer is full
+const (
+	EVENT_DROP_OLDEST = iota // drop the oldest event waiting to make room
+	EVENT_DROP_NEWEST        // drop the event being published
+	EVENT_BLOCK              // wait for room, so a stalled subscriber stalls playback
+)
+
+// Event is something the player did, one of the types below
+type Event interface {
+	event()
+}
+
+// TrackChanged is published when another track starts, or the current one's
+// tags change as it plays
+type TrackChanged struct {
+	Metadata Metadata
+}
+
+// QueueChanged is published when the queue changes, with Removed tracks from
+// Index onwards replaced by Added. Index counts from the first track played.
+type QueueChanged struct {
+	Index   int
+	Removed int
+	Added   []Metadata
+}
+
+// PlayStateChanged is published when the player starts or stops
+type PlayStateChanged struct {
+	Playing bool
+}
+
+// Seeked is published when the player moves within the current track, to
+// Position in 100ns units
+type Seeked struct {
+	Position int
+}
+
+// VolumeChanged is published when the player's volume is set or it is muted
+// or unmuted
+type VolumeChanged struct {
+	Volume float64 // in dB
+	Muted  bool
+}
+
+// CrossfadeChanged is published as the current track starts fading in over
+// the one before it, and again once that one has faded out
+type CrossfadeChanged struct {
+	Outgoing *Metadata // the track fading out, nil once it has
+}
+
+// QueueEnded is published when the queue runs out of tracks to play, once
+// the last finishes or when none of those added so far can be played
+type QueueEnded struct{}
+
+func (TrackChanged) event()     {}
+func (QueueChanged) event()     {}
+func (PlayStateChanged) event() {}
+func (Seeked) event()           {}
+func (VolumeChanged) event()    {}
+func (CrossfadeChanged) event() {}
+func (QueueEnded) event()       {}
+func (PlayerError) event()      {}
+
+// Subscription receives the player's events on Events, which is closed once
+// unsubscribed or the player is closed
+type Subscription struct {
+	Events <-chan Event
+
+	events chan Event
+	policy int
+	bus    *eventBus
+
+	mutex   sync.Mutex // held while sending
+	dropped int
+
+	gone     chan struct{} // closed when unsubscribed
+	goneOnce sync.Once
+}
+
+// Unsubscribe stops the events, even if the player is waiting to send one
+func (s *Subscription) Unsubscribe() {
+	s.goneOnce.Do(func() {
+		close(s.gone)
+		s.bus.remove(s)
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		close(s.events)
+	})
+}
+
+// Dropped is the number of events lost to a full buffer
+func (s *Subscription) Dropped() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.dropped
+}
+
+func (s *Subscription) send(e Event, stop <-chan struct{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	select {
+	case <-s.gone:
+		return
+	default:
+	}
+
+	switch s.policy {
+	case EVENT_BLOCK:
+		select {
+		case s.events <- e:
+		case <-s.gone:
+		case <-stop:
+		}
+	case EVENT_DROP_NEWEST:
+		select {
+		case s.events <- e:
+		default:
+			s.dropped++
+		}
+	default:
+		for {
+			select {
+			case s.events <- e:
+				return
+			default:
+			}
+			select {
+			case <-s.events:
+				s.dropped++
+			default:
+			}
+		}
+	}
+}
+
+// eventBus hands the player's events to its subscriptions. They may come and
+// go from any goroutine while the player thread publishes.
+type eventBus struct {
+	mutex sync.Mutex
+	subs  []*Subscription
+}
+
+func (b *eventBus) subscribe(buffer int, policy int) *Subscription {
+	if policy != EVENT_BLOCK {
+		// dropping needs somewhere to drop from
+		buffer = max(buffer, 1)
+	}
+
+	events := make(chan Event, buffer)
+	s := &Subscription{
+		Events: events,
+		events: events,
+		policy: policy,
+		bus:    b,
+		gone:   make(chan struct{}),
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subs = append(b.subs, s)
+	return s
+}
+
+func (b *eventBus) remove(s *Subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i, sub := range b.subs {
+		if sub == s {
+			b.subs = append(b.subs[:i:i], b.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+// publish sends e to every subscription, giving up on those that block once
+// stop is closed
+func (b *eventBus) publish(e Event, stop <-chan struct{}) {
+	b.mutex.Lock()
+	subs := b.subs
+	b.mutex.Unlock()
+
+	for _, s := range subs {
+		s.send(e, stop)
+	}
+}
+
+// close unsubscribes everyone
+func (b *eventBus) close() {
+	b.mutex.Lock()
+	subs := b.subs
+	b.mutex.Unlock()
+
+	for _, s := range subs {
+		s.Unsubscribe()
+	}
+}
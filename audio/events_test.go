@@ -0,0 +1,173 @@
+package audio
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// received returns the events waiting on s
+func received(s *Subscription) []Event {
+	var out []Event
+	for {
+		select {
+		case e, ok := <-s.Events:
+			if !ok {
+				return out
+			}
+			out = append(out, e)
+		default:
+			return out
+		}
+	}
+}
+
+// seeks is an event for each position given
+func seeks(positions ...int) []Event {
+	out := make([]Event, len(positions))
+	for i, pos := range positions {
+		out[i] = Seeked{pos}
+	}
+	return out
+}
+
+func TestEventPolicies(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		policy  int
+		want    []Event
+		dropped int
+	}{
+		{"drop oldest", EVENT_DROP_OLDEST, seeks(3, 4, 5), 2},
+		{"drop newest", EVENT_DROP_NEWEST, seeks(1, 2, 3), 2},
+	} {
+		var bus eventBus
+		s := bus.subscribe(3, test.policy)
+		for pos := 1; pos <= 5; pos++ {
+			bus.publish(Seeked{pos}, nil)
+		}
+		if got := received(s); fmt.Sprint(got) != fmt.Sprint(test.want) || s.Dropped() != test.dropped {
+			t.Fatalf("%s: received %v with %d dropped, expected %v with %d", test.name, got, s.Dropped(), test.want, test.dropped)
+		}
+
+		// with room again nothing more is lost
+		bus.publish(Seeked{6}, nil)
+		if got := received(s); fmt.Sprint(got) != fmt.Sprint(seeks(6)) || s.Dropped() != test.dropped {
+			t.Fatalf("%s: received %v with %d dropped", test.name, got, s.Dropped())
+		}
+	}
+
+	// a subscription with no buffer that drops still holds one event
+	var bus eventBus
+	s := bus.subscribe(0, EVENT_DROP_OLDEST)
+	bus.publish(Seeked{1}, nil)
+	bus.publish(Seeked{2}, nil)
+	if got := received(s); fmt.Sprint(got) != fmt.Sprint(seeks(2)) {
+		t.Fatalf("unbuffered: received %v", got)
+	}
+}
+
+func TestEventBlocking(t *testing.T) {
+	var bus eventBus
+	s := bus.subscribe(2, EVENT_BLOCK)
+	other := bus.subscribe(10, EVENT_DROP_NEWEST)
+
+	// the third event waits for the subscriber to make room, holding up the
+	// publisher and everyone after it
+	published := make(chan struct{})
+	go func() {
+		for pos := 1; pos <= 3; pos++ {
+			bus.publish(Seeked{pos}, nil)
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+		t.Fatal("publishing did not wait for room")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if got := received(other); fmt.Sprint(got) != fmt.Sprint(seeks(1, 2)) {
+		t.Fatalf("other subscriber received %v", got)
+	}
+	if e := <-s.Events; e != (Seeked{1}) {
+		t.Fatalf("received %v", e)
+	}
+	<-published
+	if got := received(s); fmt.Sprint(got) != fmt.Sprint(seeks(2, 3)) || s.Dropped() != 0 {
+		t.Fatalf("received %v with %d dropped", got, s.Dropped())
+	}
+
+	// closing stop gives up on a subscriber that never makes room
+	bus.publish(Seeked{4}, nil)
+	bus.publish(Seeked{5}, nil)
+	stop := make(chan struct{})
+	close(stop)
+	bus.publish(Seeked{6}, stop)
+	if got := received(s); fmt.Sprint(got) != fmt.Sprint(seeks(4, 5)) {
+		t.Fatalf("received %v", got)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	var bus eventBus
+	s := bus.subscribe(1, EVENT_DROP_OLDEST)
+	bus.publish(Seeked{1}, nil)
+	s.Unsubscribe()
+	s.Unsubscribe()
+
+	// what was waiting is still read, then the channel is closed and
+	// nothing more is sent
+	bus.publish(Seeked{2}, nil)
+	if e, ok := <-s.Events; !ok || e != (Seeked{1}) {
+		t.Fatalf("received %v", e)
+	}
+	if e, ok := <-s.Events; ok {
+		t.Fatalf("received %v after unsubscribing", e)
+	}
+	if len(bus.subs) != 0 {
+		t.Fatalf("%d subscriptions left", len(bus.subs))
+	}
+}
+
+func TestUnsubscribeBlockedPlayer(t *testing.T) {
+	p := newSimPlayer(t, nil)
+
+	// a subscriber that never reads holds up the player thread, until it
+	// unsubscribes
+	s := p.Subscribe(0, EVENT_BLOCK)
+	started := make(chan struct{})
+	go func() {
+		p.Start()
+		close(started)
+	}()
+	select {
+	case <-started:
+		t.Fatal("player did not wait for the subscriber")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.Unsubscribe()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("player still held up after unsubscribing")
+	}
+	if _, ok := <-s.Events; ok {
+		t.Fatal("events still open")
+	}
+
+	// the player carries on, others hearing all it does
+	p.Stop()
+	if got := describe(p.tap.drain()); fmt.Sprint(got) != "[playing true playing false]" {
+		t.Fatalf("events %v", got)
+	}
+
+	// closing the player closes its subscriptions, and any made later
+	p.Close(context.Background())
+	if _, ok := <-p.tap.sub.Events; ok {
+		t.Fatal("events open after closing")
+	}
+	if _, ok := <-p.Subscribe(10, EVENT_DROP_NEWEST).Events; ok {
+		t.Fatal("events open on subscribing after closing")
+	}
+}
@@ -0,0 +1,865 @@
+package audio
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	FLAC_BLOCK_STREAMINFO     = 0
+	FLAC_BLOCK_SEEKTABLE      = 3
+	FLAC_BLOCK_VORBIS_COMMENT = 4
+
+	FLAC_CHANNEL_LEFT_SIDE  = 8
+	FLAC_CHANNEL_SIDE_RIGHT = 9
+	FLAC_CHANNEL_MID_SIDE   = 10
+
+	FLAC_SUBFRAME_CONSTANT = 0
+	FLAC_SUBFRAME_VERBATIM = 1
+
+	// initial size of the read window when STREAMINFO gives no maximum frame size
+	FLAC_DEFAULT_WINDOW = 64 * 1024
+
+	FLAC_PLACEHOLDER_POINT = 0xFFFFFFFFFFFFFFFF
+)
+
+var (
+	ErrNotFLAC       = errors.New("not a FLAC file")
+	ErrFLACCRC       = errors.New("FLAC frame failed its CRC check")
+	ErrFLACChecksum  = errors.New("decoded FLAC audio does not match the STREAMINFO MD5")
+	errFLACTruncated = errors.New("FLAC frame runs past the read window")
+	errFLACInvalid   = errors.New("invalid FLAC frame")
+)
+
+var (
+	flacBlockSizes = [16]int{0, 192, 576, 1152, 2304, 4608, 0, 0, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768}
+
+	flacSampleRates = [12]int{0, 88200, 176400, 192000, 8000, 16000, 22050, 24000, 32000, 44100, 48000, 96000}
+
+	flacSampleSizes = [8]int{0, 8, 12, 0, 16, 20, 24, 32}
+
+	flacFixedCoefficients = [5][]int64{
+		{},
+		{1},
+		{2, -1},
+		{3, -3, 1},
+		{4, -6, 4, -1},
+	}
+
+	crc8Table  [256]uint8
+	crc16Table [256]uint16
+)
+
+func init() {
+	RegisterAudioSourceProvider(".flac", &AudioSourceProvider{createFLACAudioSourceFromFile, getFLACFileMetadata})
+
+	for i := range crc8Table {
+		crc := uint8(i)
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+		crc8Table[i] = crc
+	}
+
+	for i := range crc16Table {
+		crc := uint16(i) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+		crc16Table[i] = crc
+	}
+}
+
+func crc8(data []byte) uint8 {
+	var crc uint8
+	for _, b := range data {
+		crc = crc8Table[crc^b]
+	}
+	return crc
+}
+
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^b]
+	}
+	return crc
+}
+
+type flacStreamInfo struct {
+	minBlockSize int
+	maxBlockSize int
+	maxFrameSize int
+
+	sampleRate    int
+	channels      int
+	bitsPerSample int
+	totalSamples  int64 // 0 if unknown
+
+	md5 [16]byte
+}
+
+type flacSeekPoint struct {
+	sample int64
+	offset int64 // from the first frame
+}
+
+type flacFrameHeader struct {
+	blockSize     int
+	sampleRate    int
+	channels      int
+	assignment    int
+	bitsPerSample int
+
+	// first sample of the frame, in inter-channel samples
+	sample int64
+
+	size int // header size in bytes, including the CRC
+}
+
+type flacDecoder struct {
+	file *os.File
+
+	info      flacStreamInfo
+	seekTable []flacSeekPoint
+
+	audioStart int64
+	fileEnd    int64
+
+	// read window over the file
+	window     []byte
+	windowAt   int64 // file offset of window[0]
+	windowPos  int
+	windowSize int
+
+	// MD5 of the decoded audio, only meaningful when decoding has run
+	// uninterrupted from the first frame
+	hash         hash.Hash
+	verify       bool
+	decodedCount int64
+	finished     bool
+
+	channelBuf [][]int64
+	residual   []int64
+
+	meta Metadata
+}
+
+func openFLAC(path string) (*flacDecoder, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := &flacDecoder{file: file}
+	err = dec.readHeader(path)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return dec, nil
+}
+
+func (dec *flacDecoder) readHeader(path string) error {
+	info, err := dec.file.Stat()
+	if err != nil {
+		return err
+	}
+	dec.fileEnd = info.Size()
+
+	dec.meta = *NewMetadata()
+	dec.meta.Filepath = path
+
+	// the stream may be preceded by an ID3v2 tag
+	header := make([]byte, ID3V2_HEADER_SIZE)
+	if _, err := io.ReadFull(dec.file, header); err != nil {
+		return ErrNotFLAC
+	}
+	start := id3v2Size(header)
+	if _, err := dec.file.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+
+	marker := make([]byte, 4)
+	if _, err := io.ReadFull(dec.file, marker); err != nil || string(marker) != "fLaC" {
+		return ErrNotFLAC
+	}
+
+	foundInfo := false
+	blockHeader := make([]byte, 4)
+	for last := false; !last; {
+		if _, err := io.ReadFull(dec.file, blockHeader); err != nil {
+			return ErrNotFLAC
+		}
+		last = blockHeader[0]&0x80 != 0
+		blockType := blockHeader[0] & 0x7F
+		size := int(blockHeader[1])<<16 | int(blockHeader[2])<<8 | int(blockHeader[3])
+
+		body := make([]byte, size)
+		if _, err := io.ReadFull(dec.file, body); err != nil {
+			return ErrNotFLAC
+		}
+
+		switch blockType {
+		case FLAC_BLOCK_STREAMINFO:
+			err = dec.parseStreamInfo(body)
+			if err != nil {
+				return err
+			}
+			foundInfo = true
+		case FLAC_BLOCK_SEEKTABLE:
+			dec.parseSeekTable(body)
+		case FLAC_BLOCK_VORBIS_COMMENT:
+			parseVorbisComment(body, &dec.meta)
+		}
+	}
+
+	if !foundInfo {
+		return ErrNotFLAC
+	}
+
+	dec.audioStart, err = dec.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	if dec.info.totalSamples > 0 {
+		dec.meta.Duration = uint64(dec.info.totalSamples * SECOND / int64(dec.info.sampleRate))
+	}
+
+	dec.windowSize = FLAC_DEFAULT_WINDOW
+	if dec.info.maxFrameSize > 0 {
+		dec.windowSize = max(dec.windowSize, 2*dec.info.maxFrameSize)
+	}
+	dec.hash = md5.New()
+
+	return dec.seek(0)
+}
+
+func (dec *flacDecoder) parseStreamInfo(body []byte) error {
+	if len(body) < 34 {
+		return ErrNotFLAC
+	}
+
+	br := newBitReader(body)
+	dec.info.minBlockSize = int(br.readBits(16))
+	dec.info.maxBlockSize = int(br.readBits(16))
+	br.skipBits(24) // minimum frame size
+	dec.info.maxFrameSize = int(br.readBits(24))
+	dec.info.sampleRate = int(br.readBits(20))
+	dec.info.channels = int(br.readBits(3)) + 1
+	dec.info.bitsPerSample = int(br.readBits(5)) + 1
+	dec.info.totalSamples = int64(br.readBits64(36))
+	copy(dec.info.md5[:], body[18:34])
+
+	if dec.info.sampleRate == 0 || dec.info.sampleRate > MAX_SAMPLE_RATE || dec.info.bitsPerSample < 4 {
+		return ErrUnsupportedFormat
+	}
+	return nil
+}
+
+func (dec *flacDecoder) parseSeekTable(body []byte) {
+	for pos := 0; pos+18 <= len(body); pos += 18 {
+		sample := binary.BigEndian.Uint64(body[pos:])
+		if sample == FLAC_PLACEHOLDER_POINT {
+			continue
+		}
+		dec.seekTable = append(dec.seekTable, flacSeekPoint{int64(sample), int64(binary.BigEndian.Uint64(body[pos+8:]))})
+	}
+}
+
+// parseVorbisComment reads the title, artist and album out of a Vorbis
+// comment block, as used by FLAC, Ogg Vorbis and Opus
+func parseVorbisComment(body []byte, metadata *Metadata) {
+	if len(body) < 8 {
+		return
+	}
+
+	vendorLen := int(binary.LittleEndian.Uint32(body))
+	pos := 4 + vendorLen
+	if pos+4 > len(body) {
+		return
+	}
+	count := int(binary.LittleEndian.Uint32(body[pos:]))
+	pos += 4
+
+	seen := make(map[string]bool)
+	for i := 0; i < count && pos+4 <= len(body); i++ {
+		length := int(binary.LittleEndian.Uint32(body[pos:]))
+		pos += 4
+		if length < 0 || pos+length > len(body) {
+			return
+		}
+		comment := string(body[pos : pos+length])
+		pos += length
+
+		key, value, found := strings.Cut(comment, "=")
+		key = strings.ToUpper(key)
+		value = strings.TrimSpace(value)
+		if !found || value == "" || seen[key] {
+			continue
+		}
+
+		// only the first value of a repeated field is kept
+		switch key {
+		case "TITLE":
+			metadata.Title = value
+		case "ARTIST":
+			metadata.Artist = value
+		case "ALBUM":
+			metadata.Album = value
+		default:
+			continue
+		}
+		seen[key] = true
+	}
+}
+
+func (dec *flacDecoder) nativeFormat() *PCMWaveFormat {
+	// samples are stored left-justified in the next whole byte size
+	depth := (dec.info.bitsPerSample + 7) / 8 * 8
+	return &PCMWaveFormat{
+		NumChannels: uint16(dec.info.channels),
+		SampleRate:  uint32(dec.info.sampleRate),
+		SampleDepth: uint16(depth),
+		PCMType:     PCM_TYPE_INT,
+	}
+}
+
+func (dec *flacDecoder) metadata() Metadata {
+	return dec.meta
+}
+
+func (dec *flacDecoder) close() error {
+	return dec.file.Close()
+}
+
+// moveTo points the read window at a file offset
+func (dec *flacDecoder) moveTo(offset int64) {
+	dec.window = dec.window[:0]
+	dec.windowAt = offset
+	dec.windowPos = 0
+}
+
+// fill tops the read window up to windowSize bytes past windowPos. It
+// returns false once the end of the file has been buffered.
+func (dec *flacDecoder) fill() bool {
+	if dec.windowPos > 0 {
+		dec.window = append(dec.window[:0], dec.window[dec.windowPos:]...)
+		dec.windowAt += int64(dec.windowPos)
+		dec.windowPos = 0
+	}
+
+	want := min(int64(dec.windowSize), dec.fileEnd-dec.windowAt)
+	have := int64(len(dec.window))
+	if have >= want {
+		return dec.windowAt+have < dec.fileEnd
+	}
+
+	if int64(cap(dec.window)) < want {
+		grown := make([]byte, have, want)
+		copy(grown, dec.window)
+		dec.window = grown
+	}
+	n, _ := dec.file.ReadAt(dec.window[have:want], dec.windowAt+have)
+	dec.window = dec.window[:have+int64(n)]
+
+	return dec.windowAt+int64(len(dec.window)) < dec.fileEnd
+}
+
+// nextHeader advances the window to the next frame header that passes its
+// CRC, returning io.EOF if there is none
+func (dec *flacDecoder) nextHeader() (*flacFrameHeader, error) {
+	for {
+		if len(dec.window)-dec.windowPos < dec.windowSize/2 {
+			dec.fill()
+		}
+
+		data := dec.window[dec.windowPos:]
+		if len(data) < 2 {
+			return nil, io.EOF
+		}
+
+		idx := bytes.IndexByte(data, 0xFF)
+		if idx < 0 {
+			dec.windowPos = len(dec.window)
+			continue
+		}
+		dec.windowPos += idx
+
+		h, err := dec.parseFrameHeader(dec.window[dec.windowPos:])
+		if err == nil {
+			return h, nil
+		}
+		dec.windowPos++
+	}
+}
+
+func (dec *flacDecoder) parseFrameHeader(data []byte) (*flacFrameHeader, error) {
+	br := newBitReader(data)
+	if br.readBits(15) != 0x7FFC {
+		return nil, errFLACInvalid
+	}
+	variable := br.readBit()
+
+	h := &flacFrameHeader{}
+	blockCode := int(br.readBits(4))
+	rateCode := int(br.readBits(4))
+	h.assignment = int(br.readBits(4))
+	sizeCode := int(br.readBits(3))
+	if br.readBit() || blockCode == 0 || rateCode == 15 || h.assignment > FLAC_CHANNEL_MID_SIDE || sizeCode == 3 {
+		return nil, errFLACInvalid
+	}
+
+	// UTF-8 style coded frame or sample number
+	first := br.readBits(8)
+	extra := 0
+	for first&(0x80>>extra) != 0 {
+		extra++
+	}
+	if extra == 1 || extra > 7 {
+		return nil, errFLACInvalid
+	}
+	number := uint64(first) & (0xFF >> (extra + 1))
+	for i := 1; i < extra; i++ {
+		b := br.readBits(8)
+		if b&0xC0 != 0x80 {
+			return nil, errFLACInvalid
+		}
+		number = number<<6 | uint64(b&0x3F)
+	}
+
+	switch blockCode {
+	case 6:
+		h.blockSize = int(br.readBits(8)) + 1
+	case 7:
+		h.blockSize = int(br.readBits(16)) + 1
+	default:
+		h.blockSize = flacBlockSizes[blockCode]
+	}
+
+	switch rateCode {
+	case 0:
+		h.sampleRate = dec.info.sampleRate
+	case 12:
+		h.sampleRate = int(br.readBits(8)) * 1000
+	case 13:
+		h.sampleRate = int(br.readBits(16))
+	case 14:
+		h.sampleRate = int(br.readBits(16)) * 10
+	default:
+		h.sampleRate = flacSampleRates[rateCode]
+	}
+
+	h.bitsPerSample = flacSampleSizes[sizeCode]
+	if sizeCode == 0 {
+		h.bitsPerSample = dec.info.bitsPerSample
+	}
+
+	h.channels = h.assignment + 1
+	if h.assignment >= FLAC_CHANNEL_LEFT_SIDE {
+		h.channels = 2
+	}
+
+	h.size = br.pos/8 + 1
+	if br.overrun || h.size > len(data) || crc8(data[:h.size-1]) != data[h.size-1] {
+		return nil, errFLACInvalid
+	}
+
+	// a frame that disagrees with STREAMINFO is most likely a false sync
+	if h.channels != dec.info.channels || h.bitsPerSample != dec.info.bitsPerSample {
+		return nil, errFLACInvalid
+	}
+
+	if variable {
+		h.sample = int64(number)
+	} else {
+		fixed := dec.info.maxBlockSize
+		if fixed == 0 || dec.info.minBlockSize != dec.info.maxBlockSize {
+			fixed = h.blockSize
+		}
+		h.sample = int64(number) * int64(fixed)
+	}
+
+	return h, nil
+}
+
+// readFrame decodes the frame at the start of the window into channelBuf.
+// The window grows until the whole frame fits.
+func (dec *flacDecoder) readFrame(h *flacFrameHeader) (int, error) {
+	for {
+		size, err := dec.decodeFrame(h, dec.window[dec.windowPos:])
+		if err != errFLACTruncated {
+			return size, err
+		}
+
+		before := len(dec.window) - dec.windowPos
+		dec.windowSize *= 2
+		dec.fill()
+		if len(dec.window)-dec.windowPos == before {
+			// the file ends mid-frame
+			return 0, io.EOF
+		}
+	}
+}
+
+func (dec *flacDecoder) decodeFrame(h *flacFrameHeader, data []byte) (int, error) {
+	br := newBitReader(data)
+	br.skipBits(h.size * 8)
+
+	if len(dec.channelBuf) != h.channels {
+		dec.channelBuf = make([][]int64, h.channels)
+	}
+
+	for ch := 0; ch < h.channels; ch++ {
+		if cap(dec.channelBuf[ch]) < h.blockSize {
+			dec.channelBuf[ch] = make([]int64, h.blockSize)
+		}
+		dec.channelBuf[ch] = dec.channelBuf[ch][:h.blockSize]
+
+		// side channels carry an extra bit
+		bps := h.bitsPerSample
+		switch {
+		case h.assignment == FLAC_CHANNEL_LEFT_SIDE && ch == 1,
+			h.assignment == FLAC_CHANNEL_SIDE_RIGHT && ch == 0,
+			h.assignment == FLAC_CHANNEL_MID_SIDE && ch == 1:
+			bps++
+		}
+
+		err := dec.decodeSubframe(br, dec.channelBuf[ch], bps)
+		if br.overrun {
+			return 0, errFLACTruncated
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	br.alignByte()
+	end := br.pos / 8
+	footer := br.readBits(16)
+	if br.overrun {
+		return 0, errFLACTruncated
+	}
+	if crc16(data[:end]) != uint16(footer) {
+		return end + 2, ErrFLACCRC
+	}
+
+	decorrelate(h.assignment, dec.channelBuf)
+	return end + 2, nil
+}
+
+func (dec *flacDecoder) decodeSubframe(br *bitReader, out []int64, bps int) error {
+	if br.readBit() {
+		return errFLACInvalid
+	}
+	kind := int(br.readBits(6))
+
+	wasted := 0
+	if br.readBit() {
+		wasted = br.readUnary() + 1
+		bps -= wasted
+	}
+	if bps <= 0 {
+		return errFLACInvalid
+	}
+
+	var err error
+	switch {
+	case kind == FLAC_SUBFRAME_CONSTANT:
+		v := br.readSigned64(bps)
+		for i := range out {
+			out[i] = v
+		}
+	case kind == FLAC_SUBFRAME_VERBATIM:
+		for i := range out {
+			out[i] = br.readSigned64(bps)
+		}
+	case kind >= 8 && kind <= 12:
+		order := kind - 8
+		err = dec.decodePredicted(br, out, bps, order, flacFixedCoefficients[order], 0)
+	case kind >= 32:
+		order := kind - 31
+		err = dec.decodeLPC(br, out, bps, order)
+	default:
+		return errFLACInvalid
+	}
+	if err != nil {
+		return err
+	}
+
+	if wasted > 0 {
+		for i := range out {
+			out[i] <<= wasted
+		}
+	}
+	return nil
+}
+
+func (dec *flacDecoder) decodeLPC(br *bitReader, out []int64, bps int, order int) error {
+	if order > len(out) {
+		return errFLACInvalid
+	}
+
+	// warm-up samples precede the coefficients, read them into place first
+	for i := 0; i < order; i++ {
+		out[i] = br.readSigned64(bps)
+	}
+
+	precision := int(br.readBits(4)) + 1
+	shift := int(br.readSigned(5))
+	if precision == 16 || shift < 0 {
+		return errFLACInvalid
+	}
+
+	coefficients := make([]int64, order)
+	for i := range coefficients {
+		coefficients[i] = int64(br.readSigned(precision))
+	}
+
+	return dec.predict(br, out, order, coefficients, shift)
+}
+
+func (dec *flacDecoder) decodePredicted(br *bitReader, out []int64, bps int, order int, coefficients []int64, shift int) error {
+	if order > len(out) {
+		return errFLACInvalid
+	}
+	for i := 0; i < order; i++ {
+		out[i] = br.readSigned64(bps)
+	}
+	return dec.predict(br, out, order, coefficients, shift)
+}
+
+// predict reads the residual following the warm-up samples and restores the
+// signal. coefficients[0] applies to the most recent sample.
+func (dec *flacDecoder) predict(br *bitReader, out []int64, order int, coefficients []int64, shift int) error {
+	err := dec.readResidual(br, len(out), order)
+	if err != nil {
+		return err
+	}
+
+	for i := order; i < len(out); i++ {
+		var sum int64
+		for j, c := range coefficients {
+			sum += c * out[i-1-j]
+		}
+		out[i] = dec.residual[i-order] + sum>>shift
+	}
+	return nil
+}
+
+func (dec *flacDecoder) readResidual(br *bitReader, blockSize int, order int) error {
+	method := br.readBits(2)
+	if method > 1 {
+		return errFLACInvalid
+	}
+	paramBits, escape := 4, uint32(15)
+	if method == 1 {
+		paramBits, escape = 5, 31
+	}
+
+	partitionOrder := int(br.readBits(4))
+	partitions := 1 << partitionOrder
+	if blockSize%partitions != 0 || blockSize>>partitionOrder < order {
+		return errFLACInvalid
+	}
+
+	if cap(dec.residual) < blockSize {
+		dec.residual = make([]int64, blockSize)
+	}
+	dec.residual = dec.residual[:blockSize-order]
+
+	pos := 0
+	for p := 0; p < partitions; p++ {
+		count := blockSize >> partitionOrder
+		if p == 0 {
+			count -= order
+		}
+
+		param := br.readBits(paramBits)
+		if param == escape {
+			bits := int(br.readBits(5))
+			for i := 0; i < count; i++ {
+				dec.residual[pos] = br.readSigned64(bits)
+				pos++
+			}
+			continue
+		}
+
+		for i := 0; i < count; i++ {
+			v := uint64(br.readUnary())<<param | br.readBits64(int(param))
+			dec.residual[pos] = int64(v>>1) ^ -int64(v&1)
+			pos++
+			if br.overrun {
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
+
+// decorrelate restores left and right from the stereo coding of a frame
+func decorrelate(assignment int, channels [][]int64) {
+	switch assignment {
+	case FLAC_CHANNEL_LEFT_SIDE:
+		left, side := channels[0], channels[1]
+		for i := range left {
+			side[i] = left[i] - side[i]
+		}
+	case FLAC_CHANNEL_SIDE_RIGHT:
+		side, right := channels[0], channels[1]
+		for i := range side {
+			side[i] += right[i]
+		}
+	case FLAC_CHANNEL_MID_SIDE:
+		mid, side := channels[0], channels[1]
+		for i := range mid {
+			m := mid[i]<<1 | side[i]&1
+			mid[i] = (m + side[i]) >> 1
+			side[i] = (m - side[i]) >> 1
+		}
+	}
+}
+
+func (dec *flacDecoder) decode() ([]float64, int64, error) {
+	if dec.finished {
+		return nil, 0, io.EOF
+	}
+
+	h, err := dec.nextHeader()
+	if err == nil {
+		var size int
+		size, err = dec.readFrame(h)
+		dec.windowPos += size
+	}
+
+	if err == io.EOF {
+		dec.finished = true
+		if dec.verify && dec.info.md5 != [16]byte{} && dec.decodedCount == dec.info.totalSamples {
+			if !bytes.Equal(dec.hash.Sum(nil), dec.info.md5[:]) {
+				return nil, 0, ErrFLACChecksum
+			}
+		}
+		return nil, 0, io.EOF
+	} else if err != nil {
+		// the damaged frame is dropped, so the checksum can no longer match
+		dec.verify = false
+		return nil, 0, err
+	}
+
+	if dec.verify {
+		dec.hashFrame(h)
+	}
+	dec.decodedCount += int64(h.blockSize)
+
+	channels := h.channels
+	scale := 1 / float64(int64(1)<<(h.bitsPerSample-1))
+	samples := make([]float64, h.blockSize*channels)
+	for ch, buf := range dec.channelBuf {
+		for i, v := range buf {
+			samples[i*channels+ch] = float64(v) * scale
+		}
+	}
+
+	return samples, h.sample, nil
+}
+
+// hashFrame feeds a decoded frame to the MD5, as little-endian interleaved
+// samples in the smallest whole number of bytes
+func (dec *flacDecoder) hashFrame(h *flacFrameHeader) {
+	width := (h.bitsPerSample + 7) / 8
+	buf := make([]byte, h.blockSize*h.channels*width)
+
+	pos := 0
+	for i := 0; i < h.blockSize; i++ {
+		for ch := 0; ch < h.channels; ch++ {
+			v := dec.channelBuf[ch][i]
+			for b := 0; b < width; b++ {
+				buf[pos] = byte(v >> (8 * b))
+				pos++
+			}
+		}
+	}
+	dec.hash.Write(buf)
+}
+
+func (dec *flacDecoder) seek(frame int64) error {
+	dec.finished = false
+
+	if frame <= 0 {
+		dec.moveTo(dec.audioStart)
+		dec.hash.Reset()
+		dec.verify = true
+		dec.decodedCount = 0
+		return nil
+	}
+	dec.verify = false
+
+	lo, hi := dec.audioStart, dec.fileEnd
+	for _, point := range dec.seekTable {
+		if point.sample <= frame {
+			lo = dec.audioStart + point.offset
+		} else {
+			hi = min(hi, dec.audioStart+point.offset)
+			break
+		}
+	}
+
+	// bisect what is left of the range on frame headers
+	for hi-lo > int64(dec.windowSize) {
+		mid := lo + (hi-lo)/2
+		dec.moveTo(mid)
+		h, err := dec.nextHeader()
+		offset := dec.windowAt + int64(dec.windowPos)
+		if err != nil || offset >= hi {
+			hi = mid
+			continue
+		}
+
+		if h.sample <= frame {
+			lo = offset
+		} else {
+			// the first frame past mid is already too late
+			hi = mid
+		}
+	}
+
+	dec.moveTo(lo)
+	return nil
+}
+
+func createFLACAudioSourceFromFile(metadata *Metadata) (AudioSource, error) {
+	dec, err := openFLAC(metadata.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDecodedSource(dec), nil
+}
+
+func getFLACFileMetadata(path string) (*Metadata, error) {
+	dec, err := openFLAC(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.file.Close()
+
+	metadata := dec.metadata()
+	return &metadata, nil
+}
@@ -0,0 +1,364 @@
+package audio
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// vorbisComment builds a comment block holding the given "KEY=value" fields
+func vorbisComment(fields ...string) []byte {
+	le := binary.LittleEndian
+	body := le.AppendUint32(nil, 4)
+	body = append(body, "test"...)
+	body = le.AppendUint32(body, uint32(len(fields)))
+	for _, field := range fields {
+		body = le.AppendUint32(body, uint32(len(field)))
+		body = append(body, field...)
+	}
+	return body
+}
+
+// flacSignal is a sine with a little noise per channel, at the given depth.
+// Some stretches are silent, to be coded as constant subframes, and some
+// have their low bits clear, to be coded with wasted bits.
+func flacSignal(frames, ch, bps int) [][]int64 {
+	r := rand.New(rand.NewSource(1))
+	peak := float64(int64(1)<<(bps-1) - 1)
+	out := make([][]int64, ch)
+	for c := range out {
+		out[c] = make([]int64, frames)
+		for i := range out[c] {
+			switch (i / 4096) % 6 {
+			case 4:
+				continue
+			case 5:
+				out[c][i] = int64(0.5*peak*math.Sin(float64(i)*0.01*float64(c+1))) &^ 7
+			default:
+				v := 0.7*peak*math.Sin(float64(i)*0.02*float64(c+1)) + peak/64*r.Float64()
+				out[c][i] = int64(v)
+			}
+		}
+	}
+	return out
+}
+
+// flacResidual writes a single partition Rice coded residual
+func flacResidual(w *bitWriter, residual []int64) {
+	sum := uint64(0)
+	for _, r := range residual {
+		sum += uint64(r<<1 ^ r>>63)
+	}
+	param := 0
+	for len(residual) > 0 && param < 30 && uint64(len(residual))<<(param+1) < sum {
+		param++
+	}
+	w.writeBits(1, 2) // 5 bit parameters
+	w.writeBits(0, 4) // partition order
+	w.writeBits(uint64(param), 5)
+	for _, r := range residual {
+		u := uint64(r<<1 ^ r>>63)
+		w.writeUnary(int(u >> param))
+		w.writeBits(u, param)
+	}
+}
+
+// flacSubframe codes samples as the subframe kind chosen by the frame's index
+// among constant, verbatim, the fixed predictors and LPC
+func flacSubframe(w *bitWriter, samples []int64, bps int, index int) {
+	constant, wasted := true, 0
+	or := int64(0)
+	for _, v := range samples {
+		constant = constant && v == samples[0]
+		or |= v
+	}
+	if or != 0 {
+		for or>>wasted&1 == 0 {
+			wasted++
+		}
+	}
+
+	w.writeBits(0, 1)
+	switch {
+	case constant:
+		w.writeBits(FLAC_SUBFRAME_CONSTANT, 6)
+		w.writeBits(0, 1)
+		w.writeSigned(samples[0], bps)
+		return
+	case index%7 == 0:
+		w.writeBits(FLAC_SUBFRAME_VERBATIM, 6)
+		w.writeBits(0, 1)
+		for _, v := range samples {
+			w.writeSigned(v, bps)
+		}
+		return
+	}
+
+	order := index % 7
+	coefficients := []int64{}
+	shift := 0
+	if order <= 4 {
+		w.writeBits(uint64(8+order), 6)
+		coefficients = flacFixedCoefficients[order]
+	} else {
+		// a second order LPC predictor, quantized to 12 bits
+		order = 2
+		w.writeBits(uint64(31+order), 6)
+		coefficients = []int64{1900, -950}
+		shift = 10
+	}
+
+	if wasted > 0 {
+		w.writeBits(1, 1)
+		w.writeUnary(wasted - 1)
+		bps -= wasted
+		shifted := make([]int64, len(samples))
+		for i, v := range samples {
+			shifted[i] = v >> wasted
+		}
+		samples = shifted
+	} else {
+		w.writeBits(0, 1)
+	}
+
+	for _, v := range samples[:order] {
+		w.writeSigned(v, bps)
+	}
+	if shift > 0 {
+		w.writeBits(12-1, 4)
+		w.writeSigned(int64(shift), 5)
+		for _, c := range coefficients {
+			w.writeSigned(c, 12)
+		}
+	}
+	residual := make([]int64, 0, len(samples)-order)
+	for i := order; i < len(samples); i++ {
+		var sum int64
+		for j, c := range coefficients {
+			sum += c * samples[i-1-j]
+		}
+		residual = append(residual, samples[i]-sum>>shift)
+	}
+	flacResidual(w, residual)
+}
+
+// flacFrame codes one block, its stereo decorrelation chosen by its index
+func flacFrame(index int, rateCode int, bps int, block [][]int64) []byte {
+	w := &bitWriter{}
+	w.writeBits(0x7FFC, 15)
+	w.writeBits(0, 1)
+	size := len(block[0])
+	if size == 4096 {
+		w.writeBits(12, 4)
+	} else {
+		w.writeBits(7, 4)
+	}
+	w.writeBits(uint64(rateCode), 4)
+
+	subframes, depths := block, []int{bps, bps}
+	assignment := len(block) - 1
+	if len(block) == 2 && index%4 != 0 {
+		left, right := block[0], block[1]
+		mid, side := make([]int64, size), make([]int64, size)
+		for i := range left {
+			mid[i] = (left[i] + right[i]) >> 1
+			side[i] = left[i] - right[i]
+		}
+		assignment = FLAC_CHANNEL_LEFT_SIDE + index%4 - 1
+		switch assignment {
+		case FLAC_CHANNEL_LEFT_SIDE:
+			subframes, depths = [][]int64{left, side}, []int{bps, bps + 1}
+		case FLAC_CHANNEL_SIDE_RIGHT:
+			subframes, depths = [][]int64{side, right}, []int{bps + 1, bps}
+		case FLAC_CHANNEL_MID_SIDE:
+			subframes, depths = [][]int64{mid, side}, []int{bps, bps + 1}
+		}
+	}
+	w.writeBits(uint64(assignment), 4)
+	sizeCode := map[int]int{8: 1, 12: 2, 16: 4, 20: 5, 24: 6}[bps]
+	w.writeBits(uint64(sizeCode), 3)
+	w.writeBits(0, 1)
+
+	// the frame number, UTF-8 style
+	if index < 0x80 {
+		w.writeBits(uint64(index), 8)
+	} else {
+		w.writeBits(uint64(0xC0|index>>6), 8)
+		w.writeBits(uint64(0x80|index&0x3F), 8)
+	}
+	if size != 4096 {
+		w.writeBits(uint64(size-1), 16)
+	}
+	if rateCode == 13 {
+		w.writeBits(37800, 16)
+	}
+	w.writeBits(uint64(crc8(w.data)), 8)
+
+	for c, samples := range subframes {
+		flacSubframe(w, samples, depths[c%2], index+c)
+	}
+	w.alignByte()
+	w.writeBits(uint64(crc16(w.data)), 16)
+	return w.data
+}
+
+// writeFLAC encodes signal in blocks of 4096, with a seek table if seekTable
+// is set
+func writeFLAC(t *testing.T, path string, rate int, bps int, signal [][]int64, seekTable bool) {
+	t.Helper()
+	ch, frames := len(signal), len(signal[0])
+	rateCode := map[int]int{44100: 9, 48000: 10, 96000: 11, 37800: 13}[rate]
+
+	var audio []byte
+	var points []byte
+	hash := md5.New()
+	for index := 0; index*4096 < frames; index++ {
+		start, end := index*4096, min(index*4096+4096, frames)
+		block := make([][]int64, ch)
+		for c := range block {
+			block[c] = signal[c][start:end]
+		}
+		if seekTable && index%5 == 0 {
+			points = binary.BigEndian.AppendUint64(points, uint64(start))
+			points = binary.BigEndian.AppendUint64(points, uint64(len(audio)))
+			points = binary.BigEndian.AppendUint16(points, uint16(end-start))
+		}
+		audio = append(audio, flacFrame(index, rateCode, bps, block)...)
+
+		width := (bps + 7) / 8
+		for i := start; i < end; i++ {
+			for c := 0; c < ch; c++ {
+				for b := 0; b < width; b++ {
+					hash.Write([]byte{byte(signal[c][i] >> (8 * b))})
+				}
+			}
+		}
+	}
+
+	info := &bitWriter{}
+	info.writeBits(4096, 16)
+	info.writeBits(4096, 16)
+	info.writeBits(0, 24+24)
+	info.writeBits(uint64(rate), 20)
+	info.writeBits(uint64(ch-1), 3)
+	info.writeBits(uint64(bps-1), 5)
+	info.writeBits(uint64(frames), 36)
+	info.data = append(info.data, hash.Sum(nil)...)
+
+	out := []byte("fLaC")
+	block := func(kind byte, body []byte, last bool) {
+		if last {
+			kind |= 0x80
+		}
+		out = append(out, kind, byte(len(body)>>16), byte(len(body)>>8), byte(len(body)))
+		out = append(out, body...)
+	}
+	block(FLAC_BLOCK_STREAMINFO, info.data, false)
+	if seekTable {
+		// placeholders are skipped
+		placeholder := binary.BigEndian.AppendUint64(nil, FLAC_PLACEHOLDER_POINT)
+		block(FLAC_BLOCK_SEEKTABLE, append(points, append(placeholder, make([]byte, 10)...)...), false)
+	}
+	block(FLAC_BLOCK_VORBIS_COMMENT, vorbisComment("TITLE=Song", "ALBUM=Record", "ARTIST=Band"), true)
+	if err := os.WriteFile(path, append(out, audio...), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFLAC(t *testing.T) {
+	dir := t.TempDir()
+	for _, test := range []struct {
+		name      string
+		ch, rate  int
+		bps       int
+		frames    int
+		seekTable bool
+	}{
+		{"16 bit stereo", 2, 44100, 16, 100000, false},
+		{"seek table", 2, 44100, 16, 100000, true},
+		{"24 bit mono", 1, 96000, 24, 60000, false},
+		{"12 bit", 2, 37800, 12, 30000, false},
+		{"20 bit", 1, 48000, 20, 30000, true},
+	} {
+		path := filepath.Join(dir, test.name+".flac")
+		signal := flacSignal(test.frames, test.ch, test.bps)
+		writeFLAC(t, path, test.rate, test.bps, signal, test.seekTable)
+
+		dec, err := openFLAC(path)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		checkFormat(t, dec, test.ch, test.rate, int64(test.frames))
+		if m := dec.metadata(); m.Title != "Song" || m.Album != "Record" || m.Artist != "Band" {
+			t.Fatalf("%s: metadata %+v", test.name, m)
+		}
+
+		// decoded through, the audio is lossless and its MD5 checks out
+		want := make([]float64, test.frames*test.ch)
+		scale := float64(int64(1) << (test.bps - 1))
+		for i := range want {
+			want[i] = float64(signal[i%test.ch][i/test.ch]) / scale
+		}
+		all := decodeAll(t, dec)
+		if len(all) != len(want) {
+			t.Fatalf("%s: %d samples, expected %d", test.name, len(all), len(want))
+		}
+		checkSamples(t, test.name, all, want, 0)
+		checkSeek(t, dec, all, 0, 0, 1, 4096, 50000%int64(test.frames), int64(test.frames)-1)
+		dec.close()
+	}
+}
+
+func TestFLACDamaged(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.flac")
+	signal := flacSignal(20000, 2, 16)
+	writeFLAC(t, path, 44100, 16, signal, false)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a wrong MD5 is reported at the end of the stream
+	info := 4 + 4
+	data[info+18] ^= 1
+	os.WriteFile(path, data, 0644)
+	if errs := decodeErrors(t, path); len(errs) != 1 || !errors.Is(errs[0], ErrFLACChecksum) {
+		t.Fatalf("got %v with a bad MD5", errs)
+	}
+
+	// a damaged frame fails its CRC, and is dropped without the MD5 failing
+	data[info+18] ^= 1
+	data[len(data)-100] ^= 0x10
+	os.WriteFile(path, data, 0644)
+	if errs := decodeErrors(t, path); len(errs) != 2 || !errors.Is(errs[0], ErrFLACCRC) || errs[1] != io.EOF {
+		t.Fatalf("got %v with a damaged frame", errs)
+	}
+}
+
+// decodeErrors decodes the file at path to the end, returning the errors
+// along the way
+func decodeErrors(t *testing.T, path string) []error {
+	t.Helper()
+	dec, err := openFLAC(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.close()
+	var errs []error
+	for {
+		_, _, err := dec.decode()
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if err != nil && !errors.Is(err, ErrFLACCRC) {
+			return errs
+		}
+	}
+}
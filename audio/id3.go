@@ -0,0 +1,261 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	ID3V2_HEADER_SIZE = 10
+	ID3V1_SIZE        = 128
+
+	ID3_FLAG_UNSYNC   = 0x80
+	ID3_FLAG_EXTENDED = 0x40
+	ID3_FLAG_FOOTER   = 0x10
+)
+
+// id3Tag holds the fields maestro cares about from an ID3v1 or ID3v2 tag
+type id3Tag struct {
+	title  string
+	album  string
+	artist string
+
+	length uint64 // TLEN, in 100ns units
+}
+
+// apply copies the fields that were present into metadata
+func (tag *id3Tag) apply(metadata *Metadata) {
+	if tag.title != "" {
+		metadata.Title = tag.title
+	}
+	if tag.album != "" {
+		metadata.Album = tag.album
+	}
+	if tag.artist != "" {
+		metadata.Artist = tag.artist
+	}
+	if tag.length != 0 {
+		metadata.Duration = tag.length
+	}
+}
+
+// id3v2Size returns the total size of the ID3v2 tag at the start of header,
+// or 0 if there is none
+func id3v2Size(header []byte) int64 {
+	if len(header) < ID3V2_HEADER_SIZE || string(header[:3]) != "ID3" {
+		return 0
+	}
+
+	size := int64(syncsafe(header[6:10])) + ID3V2_HEADER_SIZE
+	if header[5]&ID3_FLAG_FOOTER != 0 {
+		size += ID3V2_HEADER_SIZE
+	}
+	return size
+}
+
+// readID3v2 parses an ID3v2 tag at the reader's current position. It
+// returns nil if no tag is present.
+func readID3v2(r io.Reader) (*id3Tag, error) {
+	header := make([]byte, ID3V2_HEADER_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if string(header[:3]) != "ID3" {
+		return nil, nil
+	}
+
+	body := make([]byte, syncsafe(header[6:10]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	return parseID3v2(header[3], header[5], body), nil
+}
+
+func parseID3v2(version byte, flags byte, body []byte) *id3Tag {
+	tag := &id3Tag{}
+
+	// tag-wide unsynchronisation predates per-frame flags in v2.4
+	if flags&ID3_FLAG_UNSYNC != 0 && version < 4 {
+		body = removeUnsync(body)
+	}
+
+	if flags&ID3_FLAG_EXTENDED != 0 && version >= 3 && len(body) >= 4 {
+		var skip int
+		if version == 3 {
+			skip = int(binary.BigEndian.Uint32(body)) + 4
+		} else {
+			skip = int(syncsafe(body))
+		}
+		if skip > len(body) {
+			return tag
+		}
+		body = body[skip:]
+	}
+
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+
+	for pos := 0; pos+headerLen <= len(body); {
+		id := string(body[pos : pos+idLen])
+		if id[0] == 0 {
+			// reached padding
+			break
+		}
+
+		var size int
+		var formatFlags byte
+		switch version {
+		case 2:
+			size = int(body[pos+3])<<16 | int(body[pos+4])<<8 | int(body[pos+5])
+		case 3:
+			size = int(binary.BigEndian.Uint32(body[pos+4:]))
+			formatFlags = body[pos+9]
+		default:
+			size = int(syncsafe(body[pos+4:]))
+			formatFlags = body[pos+9]
+		}
+		pos += headerLen
+
+		if size < 0 || pos+size > len(body) {
+			break
+		}
+		data := body[pos : pos+size]
+		pos += size
+
+		// skip compressed and encrypted frames
+		if version == 3 && formatFlags&0xC0 != 0 || version == 4 && formatFlags&0x0C != 0 {
+			continue
+		}
+		if version == 4 {
+			if formatFlags&0x01 != 0 && len(data) >= 4 {
+				// data length indicator
+				data = data[4:]
+			}
+			if formatFlags&0x02 != 0 {
+				data = removeUnsync(data)
+			}
+		}
+
+		switch id {
+		case "TIT2", "TT2":
+			tag.title = decodeID3Text(data)
+		case "TALB", "TAL":
+			tag.album = decodeID3Text(data)
+		case "TPE1", "TP1":
+			tag.artist = decodeID3Text(data)
+		case "TLEN", "TLE":
+			ms, err := strconv.ParseUint(decodeID3Text(data), 10, 64)
+			if err == nil {
+				tag.length = ms * SECOND / 1000
+			}
+		}
+	}
+
+	return tag
+}
+
+// readID3v1 parses the ID3v1 tag in the last 128 bytes of a file, returning
+// nil if there is none
+func readID3v1(r io.ReadSeeker) (*id3Tag, error) {
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if end < ID3V1_SIZE {
+		return nil, nil
+	}
+
+	if _, err := r.Seek(end-ID3V1_SIZE, io.SeekStart); err != nil {
+		return nil, err
+	}
+	body := make([]byte, ID3V1_SIZE)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if string(body[:3]) != "TAG" {
+		return nil, nil
+	}
+
+	return &id3Tag{
+		title:  decodeLatin1(trimTagBytes(body[3:33])),
+		artist: decodeLatin1(trimTagBytes(body[33:63])),
+		album:  decodeLatin1(trimTagBytes(body[63:93])),
+	}, nil
+}
+
+func syncsafe(b []byte) uint32 {
+	return uint32(b[0]&0x7F)<<21 | uint32(b[1]&0x7F)<<14 | uint32(b[2]&0x7F)<<7 | uint32(b[3]&0x7F)
+}
+
+// removeUnsync undoes the 0xFF 0x00 escaping of unsynchronised data
+func removeUnsync(b []byte) []byte {
+	return bytes.ReplaceAll(b, []byte{0xFF, 0x00}, []byte{0xFF})
+}
+
+// decodeID3Text decodes a text frame body, keeping only the first value
+func decodeID3Text(data []byte) string {
+	if len(data) < 1 {
+		return ""
+	}
+
+	encoding, text := data[0], data[1:]
+	switch encoding {
+	case 0:
+		return decodeLatin1(trimTagBytes(text))
+	case 1, 2:
+		return decodeUTF16(text, encoding == 2)
+	default:
+		return trimTagString(text)
+	}
+}
+
+func decodeLatin1(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return strings.TrimSpace(string(runes))
+}
+
+// decodeUTF16 decodes UTF-16 text up to the first terminator. A byte order
+// mark, if present, overrides bigEndian.
+func decodeUTF16(b []byte, bigEndian bool) string {
+	if len(b) >= 2 {
+		if b[0] == 0xFF && b[1] == 0xFE {
+			bigEndian, b = false, b[2:]
+		} else if b[0] == 0xFE && b[1] == 0xFF {
+			bigEndian, b = true, b[2:]
+		}
+	}
+
+	units := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		var u uint16
+		if bigEndian {
+			u = binary.BigEndian.Uint16(b[i:])
+		} else {
+			u = binary.LittleEndian.Uint16(b[i:])
+		}
+		if u == 0 {
+			break
+		}
+		units = append(units, u)
+	}
+
+	return strings.TrimSpace(string(utf16.Decode(units)))
+}
+
+// trimTagBytes cuts a fixed width field at its first NUL
+func trimTagBytes(b []byte) []byte {
+	if idx := bytes.IndexByte(b, 0); idx >= 0 {
+		return b[:idx]
+	}
+	return b
+}
@@ -0,0 +1,524 @@
+package audio
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+const (
+	IT_HEADER_SIZE     = 0xC0
+	IT_CHANNELS        = 64
+	IT_SAMPLE_SIZE     = 0x50
+	IT_INSTRUMENT_SIZE = 0x22A
+	IT_ENV_POINTS      = 25
+	IT_KEYS            = 120
+	IT_NOTE_CUT        = 254
+	IT_NOTE_OFF        = 255
+	IT_PAN_SURROUND    = 100
+	IT_CHANNEL_OFF     = 128
+	IT_DEFAULT_MIX     = 48
+	IT_NEW_INSTRUMENTS = 0x200 // compatible version that changed the instrument layout
+
+	IT_FLAG_STEREO      = 1
+	IT_FLAG_INSTRUMENTS = 4
+	IT_FLAG_LINEAR      = 8
+	IT_FLAG_LINK_PORTA  = 32
+	IT_SPECIAL_MESSAGE  = 1
+
+	IT_SAMPLE_PRESENT       = 1
+	IT_SAMPLE_16BIT         = 2
+	IT_SAMPLE_STEREO        = 4
+	IT_SAMPLE_COMPRESSED    = 8
+	IT_SAMPLE_LOOP          = 16
+	IT_SAMPLE_SUSTAIN       = 32
+	IT_SAMPLE_PINGPONG      = 64
+	IT_SAMPLE_SUS_PINGPONG  = 128
+	IT_CONVERT_SIGNED       = 1
+	IT_CONVERT_DELTA        = 4 // IT 2.15 compression
+	IT_SAMPLE_USE_PAN       = 128
+	IT_INSTRUMENT_NO_PAN    = 128
+	IT_ENV_ON               = 1
+	IT_ENV_LOOP             = 2
+	IT_ENV_SUSTAIN          = 4
+	IT_ENV_FILTER           = 128
+	IT_COMPRESSED_BLOCK_8   = 0x8000
+	IT_COMPRESSED_BLOCK_16  = 0x4000
+	IT_OLD_ENV_NODES_OFFSET = 0x1F8
+)
+
+// speeds of the volume column's tone portamento
+var itPortaSpeeds = [10]uint8{0, 1, 4, 8, 16, 32, 64, 96, 128, 255}
+
+func loadIT(data []byte) (*trackerModule, error) {
+	if len(data) < IT_HEADER_SIZE || string(data[:4]) != "IMPM" {
+		return nil, ErrNotTracker
+	}
+	le := binary.LittleEndian
+
+	numOrders := int(le.Uint16(data[0x20:]))
+	numInstruments := int(le.Uint16(data[0x22:]))
+	numSamples := int(le.Uint16(data[0x24:]))
+	numPatterns := int(le.Uint16(data[0x26:]))
+	compatible := le.Uint16(data[0x2A:])
+	flags := le.Uint16(data[0x2C:])
+	special := le.Uint16(data[0x2E:])
+
+	pos := IT_HEADER_SIZE
+	if len(data) < pos+numOrders+4*(numInstruments+numSamples+numPatterns) {
+		return nil, ErrNotTracker
+	}
+
+	mod := &trackerModule{
+		kind:         TRACKER_IT,
+		title:        trackerString(data[4:30]),
+		globalVolume: min(int(data[0x30]), 128),
+		speed:        int(data[0x32]),
+		tempo:        int(data[0x33]),
+		linear:       flags&IT_FLAG_LINEAR != 0,
+		linkedPorta:  flags&IT_FLAG_LINK_PORTA != 0,
+	}
+	if mod.speed == 0 {
+		mod.speed = MOD_DEFAULT_SPEED
+	}
+	if mod.tempo < 32 {
+		mod.tempo = MOD_DEFAULT_TEMPO
+	}
+	mixVolume := min(int(data[0x31]), 128)
+
+	if special&IT_SPECIAL_MESSAGE != 0 {
+		length := int(le.Uint16(data[0x36:]))
+		offset := int(le.Uint32(data[0x38:]))
+		if offset < len(data) {
+			msg := trimTagString(data[offset:min(offset+length, len(data))])
+			mod.message = strings.ReplaceAll(msg, "\r", "\n")
+		}
+	}
+
+	channelPan := make([]int, IT_CHANNELS)
+	channelVolume := make([]int, IT_CHANNELS)
+	for c := range channelPan {
+		pan := int(data[0x40+c])
+		if pan&IT_CHANNEL_OFF == 0 {
+			channelVolume[c] = min(int(data[0x80+c]), 64)
+		}
+		// surround plays from the centre
+		channelPan[c] = 128
+		if pan = pan &^ IT_CHANNEL_OFF; pan != IT_PAN_SURROUND && pan <= 64 && flags&IT_FLAG_STEREO != 0 {
+			channelPan[c] = pan * 4
+		}
+	}
+
+	mod.orders = append([]uint8(nil), data[pos:pos+numOrders]...)
+	pos += numOrders
+	pointers := func(n int) []int {
+		ptrs := make([]int, n)
+		for i := range ptrs {
+			ptrs[i] = int(le.Uint32(data[pos:]))
+			pos += 4
+		}
+		return ptrs
+	}
+	instrumentPtrs := pointers(numInstruments)
+	samplePtrs := pointers(numSamples)
+	patternPtrs := pointers(numPatterns)
+
+	mod.samples = make([]trackerSample, numSamples)
+	for i, ptr := range samplePtrs {
+		mod.samples[i] = parseITSample(data, ptr)
+	}
+
+	if flags&IT_FLAG_INSTRUMENTS != 0 {
+		mod.instruments = make([]trackerInstrument, numInstruments)
+		for i, ptr := range instrumentPtrs {
+			mod.instruments[i] = parseITInstrument(data, ptr, compatible >= IT_NEW_INSTRUMENTS)
+		}
+	}
+
+	// patterns always have 64 channels, so keep only those in use
+	mod.patterns = make([]trackerPattern, numPatterns)
+	used := 0
+	for i, ptr := range patternPtrs {
+		var n int
+		mod.patterns[i], n = parseITPattern(data, ptr)
+		used = max(used, n)
+	}
+	if used == 0 {
+		return nil, ErrNotTracker
+	}
+	for i := range mod.patterns {
+		pat := &mod.patterns[i]
+		cells := make([]trackerCell, pat.rows*used)
+		for r := 0; r < pat.rows; r++ {
+			copy(cells[r*used:(r+1)*used], pat.cells[r*IT_CHANNELS:])
+		}
+		pat.cells = cells
+	}
+	mod.channels = used
+	mod.channelPan = channelPan[:used]
+	mod.channelVolume = channelVolume[:used]
+	mod.mixVolume = trackerMixVolume(used) * float64(mixVolume) / IT_DEFAULT_MIX
+
+	return mod, nil
+}
+
+func parseITSample(data []byte, ptr int) trackerSample {
+	s := trackerSample{pan: -1}
+	if ptr <= 0 || ptr+IT_SAMPLE_SIZE > len(data) || string(data[ptr:ptr+4]) != "IMPS" {
+		return s
+	}
+	le := binary.LittleEndian
+	h := data[ptr : ptr+IT_SAMPLE_SIZE]
+
+	s.name = trackerString(h[0x14:0x2E])
+	s.globalVolume = min(int(h[0x11]), 64)
+	s.volume = min(int(h[0x13]), 64)
+	if pan := h[0x2F]; pan&IT_SAMPLE_USE_PAN != 0 {
+		s.pan = min(int(pan&^IT_SAMPLE_USE_PAN), 64) * 4
+	}
+	s.baseFreq = float64(le.Uint32(h[0x3C:]))
+
+	flags, convert := h[0x12], h[0x2E]
+	s.loopStart = int(le.Uint32(h[0x34:]))
+	s.loopEnd = int(le.Uint32(h[0x38:]))
+	s.susStart = int(le.Uint32(h[0x40:]))
+	s.susEnd = int(le.Uint32(h[0x44:]))
+	if flags&IT_SAMPLE_LOOP != 0 {
+		s.loop = TRACKER_LOOP_FORWARD
+		if flags&IT_SAMPLE_PINGPONG != 0 {
+			s.loop = TRACKER_LOOP_PINGPONG
+		}
+	}
+	if flags&IT_SAMPLE_SUSTAIN != 0 {
+		s.susLoop = TRACKER_LOOP_FORWARD
+		if flags&IT_SAMPLE_SUS_PINGPONG != 0 {
+			s.susLoop = TRACKER_LOOP_PINGPONG
+		}
+	}
+
+	// the rate only builds the vibrato up, and without it there is none
+	s.vibRate, s.vibDepth, s.vibType = int(h[0x4C]), int(h[0x4D]), int(h[0x4F]&3)
+	if rate := int(h[0x4E]); rate > 0 {
+		s.vibSweep = s.vibDepth * 256 / rate
+	} else {
+		s.vibDepth = 0
+	}
+
+	if flags&IT_SAMPLE_PRESENT != 0 {
+		length := int(le.Uint32(h[0x30:]))
+		offset := int(le.Uint32(h[0x48:]))
+		width, channels := 1, 1
+		if flags&IT_SAMPLE_16BIT != 0 {
+			width = 2
+		}
+		if flags&IT_SAMPLE_STEREO != 0 {
+			channels = 2
+		}
+		if flags&IT_SAMPLE_COMPRESSED != 0 {
+			s.data = itDecompress(data, offset, length, width, channels, convert&IT_CONVERT_DELTA != 0)
+		} else {
+			s.data = trackerPCM(data, offset, length, width, channels, convert&IT_CONVERT_SIGNED != 0, false)
+		}
+	}
+	clampLoop(&s.loop, &s.loopStart, &s.loopEnd, len(s.data))
+	clampLoop(&s.susLoop, &s.susStart, &s.susEnd, len(s.data))
+	return s
+}
+
+func parseITInstrument(data []byte, ptr int, newFormat bool) trackerInstrument {
+	ins := trackerInstrument{globalVolume: 128, pan: -1}
+	for k := range ins.keymap {
+		ins.keymap[k] = trackerKey{note: uint8(k), sample: -1}
+	}
+	if ptr <= 0 || ptr+IT_INSTRUMENT_SIZE > len(data) || string(data[ptr:ptr+4]) != "IMPI" {
+		return ins
+	}
+	le := binary.LittleEndian
+	h := data[ptr : ptr+IT_INSTRUMENT_SIZE]
+
+	ins.name = trackerString(h[0x20:0x3A])
+	for k := range ins.keymap {
+		note, sample := h[0x40+2*k], h[0x41+2*k]
+		if note < IT_KEYS {
+			ins.keymap[k].note = note
+		}
+		ins.keymap[k].sample = int(sample) - 1
+	}
+
+	if !newFormat {
+		ins.nna = int(h[0x1A] & 3)
+		ins.fadeout = int(le.Uint16(h[0x18:])) * 128
+		ins.volEnv = parseITOldEnvelope(h)
+		return ins
+	}
+
+	ins.nna = int(h[0x11] & 3)
+	ins.fadeout = int(le.Uint16(h[0x14:])) * 64
+	ins.globalVolume = min(int(h[0x18]), 128)
+	if pan := h[0x19]; pan&IT_INSTRUMENT_NO_PAN == 0 {
+		ins.pan = min(int(pan), 64) * 4
+	}
+	ins.volEnv = parseITEnvelope(h[0x130:])
+	ins.panEnv = parseITEnvelope(h[0x182:])
+	ins.pitchEnv = parseITEnvelope(h[0x1D4:])
+	// a filter envelope shapes a resonant filter rather than the pitch
+	if h[0x1D4]&IT_ENV_FILTER != 0 {
+		ins.pitchEnv.enabled = false
+	}
+	return ins
+}
+
+func parseITEnvelope(b []byte) trackerEnvelope {
+	flags := b[0]
+	n := min(int(b[1]), IT_ENV_POINTS)
+	pts := make([]trackerEnvPoint, n)
+	for i := range pts {
+		node := b[6+3*i:]
+		pts[i] = trackerEnvPoint{tick: int(binary.LittleEndian.Uint16(node[1:])), value: int(int8(node[0]))}
+	}
+	return newTrackerEnvelope(pts, trackerEnvelope{
+		enabled:   flags&IT_ENV_ON != 0,
+		loop:      flags&IT_ENV_LOOP != 0,
+		loopStart: int(b[2]),
+		loopEnd:   int(b[3]),
+		sustain:   flags&IT_ENV_SUSTAIN != 0,
+		susStart:  int(b[4]),
+		susEnd:    int(b[5]),
+	})
+}
+
+// parseITOldEnvelope reads the volume envelope of the layout before IT 2.00,
+// whose nodes are byte pairs ending at a tick of 0xFF
+func parseITOldEnvelope(h []byte) trackerEnvelope {
+	flags := h[0x11]
+	pts := make([]trackerEnvPoint, 0, IT_ENV_POINTS)
+	for i := 0; i < IT_ENV_POINTS; i++ {
+		tick, value := h[IT_OLD_ENV_NODES_OFFSET+2*i], h[IT_OLD_ENV_NODES_OFFSET+2*i+1]
+		if tick == 0xFF {
+			break
+		}
+		pts = append(pts, trackerEnvPoint{tick: int(tick), value: int(value)})
+	}
+	return newTrackerEnvelope(pts, trackerEnvelope{
+		enabled:   flags&IT_ENV_ON != 0,
+		loop:      flags&IT_ENV_LOOP != 0,
+		loopStart: int(h[0x12]),
+		loopEnd:   int(h[0x13]),
+		sustain:   flags&IT_ENV_SUSTAIN != 0,
+		susStart:  int(h[0x14]),
+		susEnd:    int(h[0x15]),
+	})
+}
+
+// parseITPattern unpacks a pattern with all 64 channels, also returning how
+// many of them it uses
+func parseITPattern(data []byte, ptr int) (trackerPattern, int) {
+	le := binary.LittleEndian
+	if ptr <= 0 || ptr+8 > len(data) {
+		return trackerPattern{rows: TRACKER_DEFAULT_ROWS, cells: make([]trackerCell, TRACKER_DEFAULT_ROWS*IT_CHANNELS)}, 0
+	}
+	length := int(le.Uint16(data[ptr:]))
+	rows := int(le.Uint16(data[ptr+2:]))
+	if rows == 0 || rows > TRACKER_MAX_ROWS {
+		rows = TRACKER_DEFAULT_ROWS
+	}
+	pat := trackerPattern{rows: rows, cells: make([]trackerCell, rows*IT_CHANNELS)}
+	packed := data[ptr+8 : min(ptr+8+length, len(data))]
+
+	var masks [IT_CHANNELS]uint8
+	var last [IT_CHANNELS]trackerCell
+	used := 0
+	pos := 0
+	next := func() uint8 {
+		if pos >= len(packed) {
+			return 0
+		}
+		pos++
+		return packed[pos-1]
+	}
+
+	for row := 0; row < rows && pos < len(packed); {
+		chanvar := next()
+		if chanvar == 0 {
+			row++
+			continue
+		}
+		c := int(chanvar-1) & (IT_CHANNELS - 1)
+		if chanvar&0x80 != 0 {
+			masks[c] = next()
+		}
+		mask := masks[c]
+		cell := &pat.cells[row*IT_CHANNELS+c]
+
+		if mask&1 != 0 {
+			switch note := next(); {
+			case note == IT_NOTE_OFF:
+				last[c].note = TRACKER_NOTE_OFF
+			case note == IT_NOTE_CUT:
+				last[c].note = TRACKER_NOTE_CUT
+			case note >= IT_KEYS:
+				last[c].note = TRACKER_NOTE_FADE
+			default:
+				last[c].note = note + 1
+			}
+		}
+		if mask&2 != 0 {
+			last[c].instrument = next()
+		}
+		if mask&4 != 0 {
+			last[c].volCmd, last[c].volParam = itVolumeColumn(next())
+		}
+		if mask&8 != 0 {
+			cmd := next()
+			last[c].effect, last[c].param = s3mEffect(TRACKER_IT, cmd, next())
+		}
+
+		if mask&(1|16) != 0 {
+			cell.note = last[c].note
+		}
+		if mask&(2|32) != 0 {
+			cell.instrument = last[c].instrument
+		}
+		if mask&(4|64) != 0 {
+			cell.volCmd, cell.volParam = last[c].volCmd, last[c].volParam
+		}
+		if mask&(8|128) != 0 {
+			cell.effect, cell.param = last[c].effect, last[c].param
+		}
+		used = max(used, c+1)
+	}
+	return pat, used
+}
+
+func itVolumeColumn(vol uint8) (uint8, uint8) {
+	switch {
+	case vol <= 64:
+		return TRACKER_VOL_SET, vol
+	case vol <= 74:
+		return TRACKER_VOL_FINE_UP, vol - 65
+	case vol <= 84:
+		return TRACKER_VOL_FINE_DOWN, vol - 75
+	case vol <= 94:
+		return TRACKER_VOL_SLIDE_UP, vol - 85
+	case vol <= 104:
+		return TRACKER_VOL_SLIDE_DOWN, vol - 95
+	case vol <= 114:
+		return TRACKER_VOL_PORTA_DOWN, (vol - 105) * 4
+	case vol <= 124:
+		return TRACKER_VOL_PORTA_UP, (vol - 115) * 4
+	case vol >= 128 && vol <= 192:
+		return TRACKER_VOL_PAN, uint8(int(vol-128) * 255 / 64)
+	case vol >= 193 && vol <= 202:
+		return TRACKER_VOL_TONE_PORTA, itPortaSpeeds[vol-193]
+	case vol >= 203 && vol <= 212:
+		return TRACKER_VOL_VIBRATO, vol - 203
+	}
+	return TRACKER_VOL_NONE, 0
+}
+
+// itBits reads the bit stream of a compressed block, least significant bit
+// first
+type itBits struct {
+	data []byte
+	pos  int
+	bit  uint
+}
+
+func (b *itBits) read(n int) (int, bool) {
+	v := 0
+	for i := 0; i < n; i++ {
+		if b.pos >= len(b.data) {
+			return 0, false
+		}
+		v |= int(b.data[b.pos]>>b.bit&1) << i
+		b.bit++
+		if b.bit == 8 {
+			b.bit = 0
+			b.pos++
+		}
+	}
+	return v, true
+}
+
+// itDecompress unpacks IT 2.14 compressed sample data, in which each block
+// of samples is delta coded with a bit width that changes as it goes.
+// IT 2.15 applies the delta coding twice. Stereo channels are compressed
+// one after the other and mixed down to mono.
+func itDecompress(data []byte, offset int, length int, width int, channels int, twice bool) []float32 {
+	if offset <= 0 || offset >= len(data) || length <= 0 {
+		return nil
+	}
+	bits := 8 * width
+	blockLen := IT_COMPRESSED_BLOCK_8
+	if width == 2 {
+		blockLen = IT_COMPRESSED_BLOCK_16
+	}
+	scale := 1 / float32(channels) / float32(int(1)<<(bits-1))
+	// no sample takes less than a bit
+	length = min(length, 8*(len(data)-offset)/channels)
+
+	out := make([]float32, length)
+	pos := offset
+	for c := 0; c < channels; c++ {
+		for done := 0; done < length; {
+			if pos+2 > len(data) {
+				return out
+			}
+			size := int(binary.LittleEndian.Uint16(data[pos:]))
+			block := &itBits{data: data[pos+2 : min(pos+2+size, len(data))]}
+			pos += 2 + size
+
+			n := min(blockLen, length-done)
+			w := bits + 1
+			d1, d2 := 0, 0
+			for i := 0; i < n; {
+				v, ok := block.read(w)
+				if !ok || w < 1 || w > bits+1 {
+					break
+				}
+				switch {
+				case w < 7:
+					if v == 1<<(w-1) {
+						v, _ = block.read(3)
+						w = itNextWidth(v+1, w)
+						continue
+					}
+				case w < bits+1:
+					border := (1<<bits-1)>>(bits+1-w) - bits/2
+					if v > border && v <= border+bits {
+						w = itNextWidth(v-border, w)
+						continue
+					}
+				default:
+					if v&(1<<bits) != 0 {
+						w = (v + 1) & 0xFF
+						continue
+					}
+				}
+
+				// sign extend from the current width
+				shift := 32 - min(w, bits)
+				v = int(int32(v<<shift) >> shift)
+				d1 += v
+				d2 += d1
+				sample := d1
+				if twice {
+					sample = d2
+				}
+				shift = 32 - bits
+				sample = int(int32(sample<<shift) >> shift)
+				out[done+i] += float32(sample) * scale
+				i++
+			}
+			done += n
+		}
+	}
+	return out
+}
+
+// itNextWidth decodes a new bit width, which skips the width in use
+func itNextWidth(v int, w int) int {
+	if v < w {
+		return v
+	}
+	return v + 1
+}
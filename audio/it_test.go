@@ -0,0 +1,132 @@
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+)
+
+// itTestSine is packed by itCompress8
+var itTestSine = func() []int8 {
+	s := make([]int8, 40)
+	for i := range s {
+		s[i] = int8(100 * math.Sin(float64(i)/3))
+	}
+	return s
+}()
+
+// itCompress8 packs samples as deltas in a single block, 9 bits each, so the
+// width never changes
+func itCompress8(s []int8) []byte {
+	var packed []byte
+	var acc uint32
+	n := 0
+	prev := int8(0)
+	for _, v := range s {
+		acc |= uint32(uint8(v-prev)) << n
+		prev = v
+		for n += 9; n >= 8; n -= 8 {
+			packed = append(packed, byte(acc))
+			acc >>= 8
+		}
+	}
+	if n > 0 {
+		packed = append(packed, byte(acc))
+	}
+	return append(binary.LittleEndian.AppendUint16(nil, uint16(len(packed))), packed...)
+}
+
+// itTestFile plays a 16 bit square and a compressed 8 bit sine on two of
+// three channels, with a song message
+func itTestFile() []byte {
+	le := binary.LittleEndian
+	out := make([]byte, 0x400)
+	copy(out, "IMPM")
+	copy(out[4:], "IT Song")
+	le.PutUint16(out[0x20:], 2) // orders
+	le.PutUint16(out[0x24:], 2) // samples
+	le.PutUint16(out[0x26:], 1) // patterns
+	le.PutUint16(out[0x28:], 0x214)
+	le.PutUint16(out[0x2A:], 0x214)
+	le.PutUint16(out[0x2C:], 1|8)
+	le.PutUint16(out[0x2E:], 1) // has a message
+	out[0x30], out[0x31], out[0x32], out[0x33] = 128, 48, 6, 125
+	msg := "Hello\rWorld"
+	le.PutUint16(out[0x36:], uint16(len(msg)+1))
+	le.PutUint32(out[0x38:], 0x3C0)
+	copy(out[0x3C0:], msg)
+	for c := 0; c < 64; c++ {
+		out[0x40+c] = 32
+		out[0x80+c] = 64
+	}
+	out[0xC0], out[0xC1] = 0, 255
+	le.PutUint32(out[0xC2:], 0x100)
+	le.PutUint32(out[0xC6:], 0x150)
+	le.PutUint32(out[0xCA:], 0x200)
+
+	sample := func(at int, name string, flags byte, length int, ptr int) {
+		h := out[at:]
+		copy(h, "IMPS")
+		h[0x11], h[0x12], h[0x13] = 64, flags, 64
+		copy(h[0x14:], name)
+		h[0x2E] = 1 // signed
+		le.PutUint32(h[0x30:], uint32(length))
+		le.PutUint32(h[0x38:], uint32(length))
+		le.PutUint32(h[0x3C:], 8363)
+		le.PutUint32(h[0x48:], uint32(ptr))
+	}
+	sample(0x100, "it sample", 1|2|16, 32, 0x300)
+	for i := 0; i < 32; i++ {
+		v := int16(16000)
+		if i >= 16 {
+			v = -16000
+		}
+		le.PutUint16(out[0x300+2*i:], uint16(v))
+	}
+	sample(0x150, "packed", 1|8|16, len(itTestSine), 0x340)
+	copy(out[0x340:], itCompress8(itTestSine))
+
+	p := []byte{0x81, 0x0F, 60, 1, 64, 1, 6, 0x83, 0x03, 72, 2, 0}
+	for r := 1; r < 32; r++ {
+		p = append(p, 0)
+	}
+	le.PutUint16(out[0x200:], uint16(len(p)))
+	le.PutUint16(out[0x202:], 32)
+	copy(out[0x208:], p)
+	return out
+}
+
+func TestIT(t *testing.T) {
+	data := itTestFile()
+	mod, err := loadIT(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mod.channels != 3 || mod.message != "Hello\nWorld" {
+		t.Fatalf("%d channels, message %q", mod.channels, mod.message)
+	}
+	packed := mod.samples[1].data
+	if len(packed) != len(itTestSine) {
+		t.Fatalf("%d packed samples, expected %d", len(packed), len(itTestSine))
+	}
+	for i, v := range itTestSine {
+		if math.Abs(float64(packed[i])-float64(v)/128) > 1e-6 {
+			t.Fatalf("packed sample %d is %v, expected %v", i, packed[i], float64(v)/128)
+		}
+	}
+
+	const frames = 32 * 6 * TRACKER_TEST_TICK
+	dec := openTestModule(t, "a.it", data, loadIT, frames)
+	if m := dec.metadata(); m.Title != "IT Song" || m.Artist != NOT_FOUND || !strings.Contains(m.Comment, "it sample") {
+		t.Fatalf("metadata %+v", m)
+	}
+	all := decodeAll(t, dec)
+	if len(all) != frames*2 {
+		t.Fatalf("%d frames, expected %d", len(all)/2, frames)
+	}
+	if stereoEnergy(all, 100, 2000) == 0 {
+		t.Fatal("silent")
+	}
+	checkSeek(t, dec, all, 1e-9, 0, 10*6*TRACKER_TEST_TICK+99, frames-1)
+}
@@ -0,0 +1,153 @@
+package audio
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// imdct computes inverse MDCTs of one size through a quarter size complex FFT
+type imdct struct {
+	n       int
+	pre     []complex128
+	post    []complex128
+	fft     *fft
+	scratch []complex128
+	dct     []float64
+}
+
+func newIMDCT(n int) *imdct {
+	m := n / 2
+	t := &imdct{n: n, fft: newFFT(m / 2)}
+	t.pre = make([]complex128, m/2)
+	t.post = make([]complex128, m/2)
+	for k := range t.pre {
+		t.pre[k] = cmplx.Exp(complex(0, -math.Pi*(float64(k)+0.25)/float64(m)))
+		t.post[k] = cmplx.Exp(complex(0, -math.Pi*float64(k)/float64(m)))
+	}
+	t.scratch = make([]complex128, m/2)
+	t.dct = make([]float64, m)
+	return t
+}
+
+// transform writes n outputs for the n/2 coefficients in spectrum
+func (t *imdct) transform(spectrum []float64, out []float64) {
+	m := t.n / 2
+	z := t.scratch
+
+	// DCT-IV of the spectrum
+	for k := range z {
+		z[k] = complex(spectrum[2*k], spectrum[m-1-2*k]) * t.pre[k]
+	}
+	t.fft.transform(z)
+	u := t.dct
+	for k := range z {
+		w := z[k] * t.post[k]
+		u[2*k] = real(w)
+		u[m-1-2*k] = -imag(w)
+	}
+
+	// unfold it into the symmetric halves of the IMDCT
+	for i := 0; i < t.n; i++ {
+		j := i + m/2
+		switch {
+		case j < m:
+			out[i] = u[j]
+		case j < 2*m:
+			out[i] = -u[2*m-1-j]
+		default:
+			out[i] = -u[j-2*m]
+		}
+	}
+}
+
+// fft is a mixed radix complex FFT for any size, fastest when the size
+// factors into 2, 3, 4 and 5
+type fft struct {
+	n       int
+	radices []int
+	twiddle []complex128
+	scratch []complex128
+	sums    []complex128
+}
+
+func newFFT(n int) *fft {
+	f := &fft{n: n, twiddle: make([]complex128, n), scratch: make([]complex128, n)}
+	for k := range f.twiddle {
+		f.twiddle[k] = cmplx.Exp(complex(0, -2*math.Pi*float64(k)/float64(n)))
+	}
+
+	largest := 1
+	for rest := n; rest > 1; {
+		p := 2
+		switch {
+		case rest%4 == 0:
+			p = 4
+		case rest%2 == 0:
+			p = 2
+		case rest%3 == 0:
+			p = 3
+		case rest%5 == 0:
+			p = 5
+		default:
+			for p = 7; rest%p != 0; p += 2 {
+			}
+		}
+		f.radices = append(f.radices, p)
+		largest = max(largest, p)
+		rest /= p
+	}
+	f.sums = make([]complex128, largest)
+	return f
+}
+
+func (f *fft) transform(a []complex128) {
+	if f.n <= 1 {
+		return
+	}
+	copy(f.scratch, a)
+	f.work(a, f.scratch, 1, 0, f.n)
+}
+
+// work writes the n point DFT of in[0], in[stride], in[2*stride]... to out
+// by splitting it into radices[stage] interleaved DFTs of n/radices[stage]
+func (f *fft) work(out []complex128, in []complex128, stride int, stage int, n int) {
+	p := f.radices[stage]
+	m := n / p
+	if m == 1 {
+		for r := 0; r < p; r++ {
+			out[r] = in[r*stride]
+		}
+	} else {
+		for r := 0; r < p; r++ {
+			f.work(out[r*m:], in[r*stride:], stride*p, stage+1, m)
+		}
+	}
+
+	// twiddle each sub-DFT and combine them with a p point DFT
+	t := f.sums[:p]
+	for k := 0; k < m; k++ {
+		for r := range t {
+			t[r] = out[r*m+k] * f.twiddle[r*k*stride]
+		}
+
+		switch p {
+		case 2:
+			out[k], out[m+k] = t[0]+t[1], t[0]-t[1]
+		case 4:
+			a0, a1 := t[0]+t[2], t[0]-t[2]
+			b0, b1 := t[1]+t[3], t[1]-t[3]
+			// multiplying by -i
+			b1 = complex(imag(b1), -real(b1))
+			out[k], out[m+k], out[2*m+k], out[3*m+k] = a0+b0, a1+b1, a0-b0, a1-b1
+		default:
+			step := m * stride
+			for q := 0; q < p; q++ {
+				var sum complex128
+				for r := range t {
+					sum += t[r] * f.twiddle[(r*q*step)%f.n]
+				}
+				out[q*m+k] = sum
+			}
+		}
+	}
+}
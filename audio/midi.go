@@ -0,0 +1,496 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	MIDI_HEADER_SIZE   = 6
+	MIDI_DEFAULT_TEMPO = 500000 // microseconds per quarter note
+	MIDI_SMPTE         = 0x8000 // division counts frames rather than beats
+
+	MIDI_META           = 0xFF
+	MIDI_SYSEX          = 0xF0
+	MIDI_SYSEX_ESCAPE   = 0xF7
+	MIDI_META_TEXT      = 0x01
+	MIDI_META_COPYRIGHT = 0x02
+	MIDI_META_NAME      = 0x03
+	MIDI_META_END       = 0x2F
+	MIDI_META_TEMPO     = 0x51
+
+	MIDI_DEFAULT_RATE = 44100
+	MIDI_MIN_RATE     = 8000
+	MIDI_MAX_RATE     = 192000
+
+	// how long notes may ring on after the last event
+	MIDI_MAX_TAIL = 3 * SECOND
+
+	MIDI_SOUNDFONT_ENV = "MAESTRO_SOUNDFONT"
+)
+
+// places SoundFonts are commonly installed
+var MIDI_SOUNDFONT_PATHS = []string{
+	"/usr/share/sounds/sf2/FluidR3_GM.sf2",
+	"/usr/share/sounds/sf2/default-GM.sf2",
+	"/usr/share/soundfonts/FluidR3_GM.sf2",
+	"/usr/share/soundfonts/default.sf2",
+	"C:\\soundfonts\\default.sf2",
+}
+
+// system exclusive messages that reset a synthesizer, without their F0
+var midiResets = [][]byte{
+	{0x7E, 0x7F, 0x09, 0x01, 0xF7},                               // General MIDI on
+	{0x41, 0x10, 0x42, 0x12, 0x40, 0x00, 0x7F, 0x00, 0x41, 0xF7}, // Roland GS reset
+	{0x43, 0x10, 0x4C, 0x00, 0x00, 0x7E, 0x00, 0xF7},             // Yamaha XG on
+}
+
+var (
+	ErrNotMIDI     = errors.New("not a standard MIDI file")
+	ErrNoSoundFont = errors.New("no SoundFont found, set one with " + MIDI_SOUNDFONT_ENV)
+)
+
+func init() {
+	RegisterAudioSourceProvider(".mid", getMIDIAudioSourceProvider())
+	RegisterAudioSourceProvider(".midi", getMIDIAudioSourceProvider())
+}
+
+type midiEvent struct {
+	time   int64 // 100ns units from the start
+	status uint8 // MIDI_SYSEX for a reset
+	data1  uint8
+	data2  uint8
+}
+
+// midiSequence is a file's tracks merged into one stream of timed events
+type midiSequence struct {
+	events []midiEvent
+	length int64
+
+	title     string
+	copyright string
+	text      []string
+}
+
+// trackEvent is an event as read from its track, before tempo is applied
+type trackEvent struct {
+	tick  int64
+	event midiEvent
+	tempo int // for a tempo change, 0 otherwise
+}
+
+func readMIDI(data []byte) (*midiSequence, error) {
+	// RIFF MIDI files wrap a standard one in a data chunk
+	if len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "RMID" {
+		chunks, err := readChunks(bytes.NewReader(data), 12, int64(len(data)), binary.LittleEndian)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range chunks {
+			if c.id == "data" {
+				data = data[c.offset : c.offset+c.size]
+				break
+			}
+		}
+	}
+
+	be := binary.BigEndian
+	if len(data) < 8+MIDI_HEADER_SIZE || string(data[:4]) != "MThd" {
+		return nil, ErrNotMIDI
+	}
+	headerLen := int(be.Uint32(data[4:]))
+	if headerLen < MIDI_HEADER_SIZE || 8+headerLen > len(data) {
+		return nil, ErrNotMIDI
+	}
+	format := be.Uint16(data[8:])
+	division := int(be.Uint16(data[12:]))
+	if division == 0 {
+		return nil, ErrNotMIDI
+	}
+
+	seq := &midiSequence{}
+	events := make([]trackEvent, 0)
+	var offset int64 // format 2 tracks play one after another
+	tracks := 0
+	pos := 8 + headerLen
+	for pos+8 <= len(data) {
+		id := string(data[pos : pos+4])
+		size := int(be.Uint32(data[pos+4:]))
+		body := data[pos+8 : min(pos+8+size, len(data))]
+		pos += 8 + size
+		if id != "MTrk" {
+			continue
+		}
+
+		first := len(events)
+		end := seq.readTrack(body, tracks, &events)
+		if format == 2 {
+			for i := first; i < len(events); i++ {
+				events[i].tick += offset
+			}
+			offset += end
+		}
+		tracks++
+	}
+	if tracks == 0 {
+		return nil, ErrNotMIDI
+	}
+
+	// tracks are merged in time, keeping the order of events that coincide
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].tick < events[j].tick
+	})
+
+	// turn ticks into time through the tempo map
+	tempo := MIDI_DEFAULT_TEMPO
+	var lastTick, lastTime int64
+	toTime := func(tick int64) int64 {
+		if division&MIDI_SMPTE != 0 {
+			fps := int64(-int8(division >> 8))
+			perFrame := int64(division & 0xFF)
+			if fps == 29 {
+				// drop frame timecode runs at 29.97
+				return tick * SECOND * 1001 / (30000 * max(perFrame, 1))
+			}
+			return tick * SECOND / max(fps*perFrame, 1)
+		}
+		return lastTime + (tick-lastTick)*int64(tempo)*10/int64(division)
+	}
+	for _, e := range events {
+		t := toTime(e.tick)
+		if e.tempo > 0 {
+			lastTick, lastTime = e.tick, t
+			tempo = e.tempo
+			continue
+		}
+		e.event.time = t
+		if e.event.status != 0 {
+			seq.events = append(seq.events, e.event)
+		}
+		seq.length = max(seq.length, t)
+	}
+	return seq, nil
+}
+
+// readTrack adds a track's events, returning the tick it ends on
+func (seq *midiSequence) readTrack(body []byte, track int, events *[]trackEvent) int64 {
+	pos := 0
+	var tick int64
+	var running uint8
+
+	for pos < len(body) {
+		delta, n := readVLQ(body[pos:])
+		if n == 0 {
+			break
+		}
+		pos += n
+		tick += delta
+		if pos >= len(body) {
+			break
+		}
+
+		status := body[pos]
+		if status < 0x80 {
+			// running status reuses the last channel message's
+			if running == 0 {
+				break
+			}
+			status = running
+		} else {
+			pos++
+		}
+
+		switch {
+		case status == MIDI_META:
+			if pos >= len(body) {
+				return tick
+			}
+			kind := body[pos]
+			length, n := readVLQ(body[pos+1:])
+			start := pos + 1 + n
+			end := min(start+int(length), len(body))
+			if n == 0 || start > end {
+				return tick
+			}
+			seq.readMeta(kind, body[start:end], track, tick, events)
+			pos = end
+			if kind == MIDI_META_END {
+				return tick
+			}
+		case status == MIDI_SYSEX || status == MIDI_SYSEX_ESCAPE:
+			length, n := readVLQ(body[pos:])
+			start := pos + n
+			end := min(start+int(length), len(body))
+			if n == 0 || start > end {
+				return tick
+			}
+			if status == MIDI_SYSEX && isMIDIReset(body[start:end]) {
+				*events = append(*events, trackEvent{tick: tick, event: midiEvent{status: MIDI_SYSEX}})
+			}
+			pos = end
+		case status >= 0xF0:
+			// system real time and common messages have no place in a file
+			running = 0
+		default:
+			running = status
+			size := 2
+			if kind := status & 0xF0; kind == 0xC0 || kind == 0xD0 {
+				size = 1
+			}
+			if pos+size > len(body) {
+				return tick
+			}
+			e := midiEvent{status: status, data1: body[pos] & 0x7F}
+			if size == 2 {
+				e.data2 = body[pos+1] & 0x7F
+			}
+			pos += size
+			*events = append(*events, trackEvent{tick: tick, event: e})
+		}
+	}
+	return tick
+}
+
+func (seq *midiSequence) readMeta(kind uint8, body []byte, track int, tick int64, events *[]trackEvent) {
+	switch kind {
+	case MIDI_META_TEMPO:
+		if len(body) >= 3 {
+			tempo := int(body[0])<<16 | int(body[1])<<8 | int(body[2])
+			if tempo > 0 {
+				*events = append(*events, trackEvent{tick: tick, tempo: tempo})
+			}
+		}
+	case MIDI_META_NAME:
+		// the first track's name is the song's
+		if track == 0 && seq.title == "" {
+			seq.title = trimTagString(body)
+		}
+	case MIDI_META_COPYRIGHT:
+		if seq.copyright == "" {
+			seq.copyright = trimTagString(body)
+		}
+	case MIDI_META_TEXT:
+		if text := trimTagString(body); text != "" {
+			seq.text = append(seq.text, text)
+		}
+	case MIDI_META_END:
+		// a song may hold silence after its last note
+		*events = append(*events, trackEvent{tick: tick})
+	}
+}
+
+func isMIDIReset(body []byte) bool {
+	for _, reset := range midiResets {
+		if bytes.Equal(body, reset) {
+			return true
+		}
+	}
+	return false
+}
+
+// readVLQ reads a variable length quantity, returning it with the number of
+// bytes it took, or 0 bytes if it runs off the end
+func readVLQ(b []byte) (int64, int) {
+	var v int64
+	for i := 0; i < len(b) && i < 4; i++ {
+		v = v<<7 | int64(b[i]&0x7F)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// findSoundFont returns the SoundFont to use, the one configured if there is
+// one, or else the first that exists of MAESTRO_SOUNDFONT, default.sf2 next to
+// the executable and the usual install locations
+func findSoundFont(configured string) string {
+	if configured != "" {
+		return configured
+	}
+	candidates := make([]string, 0)
+	if env := os.Getenv(MIDI_SOUNDFONT_ENV); env != "" {
+		candidates = append(candidates, env)
+	}
+	if exe, err := os.Executable(); err == nil {
+		candidates = append(candidates, filepath.Join(filepath.Dir(exe), "default.sf2"))
+	}
+	candidates = append(candidates, MIDI_SOUNDFONT_PATHS...)
+
+	for _, path := range candidates {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+	}
+	return ""
+}
+
+// midiDecoder renders a sequence through the synthesizer as a frameDecoder
+type midiDecoder struct {
+	seq   *midiSequence
+	font  *soundFont
+	synth *midiSynth
+
+	next  int   // next event to play
+	frame int64 // next frame to render
+
+	meta   Metadata
+	format PCMWaveFormat
+}
+
+func openMIDI(path string) (*midiDecoder, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seq, err := readMIDI(data)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := &midiDecoder{seq: seq}
+	dec.meta = *NewMetadata()
+	dec.meta.Filepath = path
+	dec.meta.Title = seq.title
+	if dec.meta.Title == "" {
+		dec.meta.Title = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	if seq.copyright != "" {
+		dec.meta.Artist = seq.copyright
+	}
+	dec.meta.Comment = strings.Join(seq.text, "\n")
+	dec.meta.Duration = uint64(seq.length)
+	return dec, nil
+}
+
+func (dec *midiDecoder) nativeFormat() *PCMWaveFormat {
+	format := dec.format
+	return &format
+}
+
+// selectRate synthesizes at any rate within reason, so no resampling is
+// needed
+func (dec *midiDecoder) selectRate(rate uint32) *PCMWaveFormat {
+	rate = min(max(rate, MIDI_MIN_RATE), MIDI_MAX_RATE)
+	if dec.synth != nil && rate == dec.format.SampleRate {
+		return dec.nativeFormat()
+	}
+	dec.format = PCMWaveFormat{
+		NumChannels: 2,
+		SampleRate:  rate,
+		SampleDepth: 32,
+		PCMType:     PCM_TYPE_FLOAT,
+	}
+	dec.synth = newMIDISynth(dec.font, int(rate))
+	dec.next, dec.frame = 0, 0
+	return dec.nativeFormat()
+}
+
+// eventFrame is the frame an event falls on
+func (dec *midiDecoder) eventFrame(i int) int64 {
+	return dec.seq.events[i].time * int64(dec.format.SampleRate) / SECOND
+}
+
+func (dec *midiDecoder) play(e midiEvent) {
+	if e.status == MIDI_SYSEX {
+		for i := range dec.synth.channels {
+			dec.synth.channels[i].reset(i == MIDI_DRUM_CHANNEL)
+		}
+		return
+	}
+	dec.synth.handle(e.status, e.data1, e.data2)
+}
+
+func (dec *midiDecoder) decode() ([]float64, int64, error) {
+	rate := int64(dec.format.SampleRate)
+	end := dec.seq.length * rate / SECOND
+	tail := end + MIDI_MAX_TAIL*rate/SECOND
+	events := dec.seq.events
+
+	start := dec.frame
+	out := make([]float64, DECODE_BLOCK_FRAMES*2)
+	n := 0
+	for n < DECODE_BLOCK_FRAMES {
+		for dec.next < len(events) && dec.eventFrame(dec.next) <= dec.frame {
+			dec.play(events[dec.next])
+			dec.next++
+		}
+		// once the song is over, notes may only ring out
+		if dec.frame >= end && (!dec.synth.active() || dec.frame >= tail) {
+			break
+		}
+
+		k := DECODE_BLOCK_FRAMES - n
+		if dec.next < len(events) {
+			k = min(k, int(dec.eventFrame(dec.next)-dec.frame))
+		} else if dec.frame < end {
+			k = min(k, int(end-dec.frame))
+		}
+		dec.synth.render(out[2*n : 2*(n+k)])
+		n += k
+		dec.frame += int64(k)
+	}
+
+	if n == 0 {
+		return nil, 0, io.EOF
+	}
+	return out[:2*n], start, nil
+}
+
+// seek runs the events before frame through the synthesizer without
+// rendering, so each channel has the program, controllers and held notes it
+// would have had
+func (dec *midiDecoder) seek(frame int64) error {
+	dec.synth.reset()
+	dec.next = 0
+	events := dec.seq.events
+	for dec.next < len(events) && dec.eventFrame(dec.next) < frame {
+		dec.play(events[dec.next])
+		dec.next++
+		if len(dec.synth.voices) > MIDI_MAX_VOICES/2 {
+			dec.synth.silenceReleased()
+		}
+	}
+	dec.synth.silenceReleased()
+	dec.frame = frame
+	return nil
+}
+
+func (dec *midiDecoder) metadata() Metadata {
+	return dec.meta
+}
+
+// close has nothing to release, the file was read whole when opened
+func (dec *midiDecoder) close() error {
+	return nil
+}
+
+func getMIDIAudioSourceProvider() *AudioSourceProvider {
+	return &AudioSourceProvider{
+		func(metadata *Metadata) (AudioSource, error) {
+			dec, err := openMIDI(metadata.Filepath)
+			if err != nil {
+				return nil, err
+			}
+			if dec.font, err = getSoundFont(); err != nil {
+				return nil, err
+			}
+			dec.selectRate(MIDI_DEFAULT_RATE)
+			return newDecodedSource(dec), nil
+		},
+		func(path string) (*Metadata, error) {
+			dec, err := openMIDI(path)
+			if err != nil {
+				return nil, err
+			}
+			metadata := dec.metadata()
+			return &metadata, nil
+		},
+	}
+}
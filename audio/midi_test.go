@@ -0,0 +1,266 @@
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type smfEvent struct {
+	delta int
+	data  []byte
+}
+
+func vlq(v int) []byte {
+	out := []byte{byte(v & 0x7F)}
+	for v >>= 7; v > 0; v >>= 7 {
+		out = append([]byte{byte(v&0x7F | 0x80)}, out...)
+	}
+	return out
+}
+
+func smfMeta(kind byte, body []byte) []byte {
+	return append(append([]byte{MIDI_META, kind}, vlq(len(body))...), body...)
+}
+
+var smfEnd = smfMeta(MIDI_META_END, nil)
+
+// smfFile is a standard MIDI file of the given format and ticks per beat
+func smfFile(format, division int, tracks ...[]smfEvent) []byte {
+	be := binary.BigEndian
+	out := be.AppendUint32([]byte("MThd"), MIDI_HEADER_SIZE)
+	out = be.AppendUint16(out, uint16(format))
+	out = be.AppendUint16(out, uint16(len(tracks)))
+	out = be.AppendUint16(out, uint16(division))
+	for _, track := range tracks {
+		var body []byte
+		for _, e := range track {
+			body = append(body, vlq(e.delta)...)
+			body = append(body, e.data...)
+		}
+		out = be.AppendUint32(append(out, "MTrk"...), uint32(len(body)))
+		out = append(out, body...)
+	}
+	return out
+}
+
+// openTestMIDI opens smf played with sf2TestFont at 44.1 kHz
+func openTestMIDI(t *testing.T, smf []byte) *midiDecoder {
+	t.Helper()
+	dir := t.TempDir()
+	font, path := filepath.Join(dir, "a.sf2"), filepath.Join(dir, "a.mid")
+	if err := os.WriteFile(font, sf2TestFont(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, smf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	SetSoundFontPath(font)
+	t.Cleanup(func() { SetSoundFontPath("") })
+
+	dec, err := openMIDI(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec.font, err = getSoundFont(); err != nil {
+		t.Fatal(err)
+	}
+	dec.selectRate(MIDI_DEFAULT_RATE)
+	return dec
+}
+
+// pitch is the frequency of the left channel over [from, to), going by its
+// zero crossings
+func pitch(all []float64, from, to int) float64 {
+	return float64(zeroCrossings(all, from, to)) / 2 * MIDI_DEFAULT_RATE / float64(to-from)
+}
+
+func TestMIDI(t *testing.T) {
+	// a second at 120 bpm, then half a second at 240 bpm
+	dec := openTestMIDI(t, smfFile(1, 480,
+		[]smfEvent{
+			{0, smfMeta(MIDI_META_NAME, []byte("Song"))},
+			{0, smfMeta(MIDI_META_COPYRIGHT, []byte("Someone"))},
+			{960, smfMeta(MIDI_META_TEMPO, []byte{0x03, 0xD0, 0x90})},
+			{960, smfEnd},
+		},
+		[]smfEvent{
+			{0, []byte{0x90, 69, 100}},
+			{960, []byte{69, 0}}, // note off by running status
+			{0, smfEnd},
+		}))
+	const frames = MIDI_DEFAULT_RATE * 3 / 2
+	checkFormat(t, dec, 2, MIDI_DEFAULT_RATE, frames)
+	if m := dec.metadata(); m.Title != "Song" || m.Artist != "Someone" || m.Album != NOT_FOUND {
+		t.Fatalf("metadata %+v", m)
+	}
+
+	all := decodeAll(t, dec)
+	if n := len(all) / 2; n < frames || n > frames+DECODE_BLOCK_FRAMES {
+		t.Fatalf("%d frames, expected %d and the release", n, frames)
+	}
+	if f := pitch(all, 4410, 40000); math.Abs(f-440) > 3 {
+		t.Fatalf("%.1f Hz, expected 440", f)
+	}
+	if e := stereoEnergy(all, 50000, 66000); e > 1e-6 {
+		t.Fatalf("energy %v after the release", e)
+	}
+	checkSeek(t, dec, all, 0, 0)
+
+	// seeking restarts held notes, so only their level carries over
+	if err := dec.seek(22050); err != nil {
+		t.Fatal(err)
+	}
+	samples, frame, err := dec.decode()
+	if err != nil || frame != 22050 {
+		t.Fatalf("block at %d after seek to 22050: %v", frame, err)
+	}
+	want := stereoEnergy(all, 22050, 22050+DECODE_BLOCK_FRAMES)
+	if e := stereoEnergy(samples, 0, DECODE_BLOCK_FRAMES); math.Abs(e-want) > 0.2*want {
+		t.Fatalf("energy %v after seek, expected %v", e, want)
+	}
+	// asking for the same rate again keeps the position
+	dec.selectRate(MIDI_DEFAULT_RATE)
+	if _, frame, _ := dec.decode(); frame != 22050+DECODE_BLOCK_FRAMES {
+		t.Fatalf("block at %d after selectRate", frame)
+	}
+}
+
+func TestMIDIControllers(t *testing.T) {
+	const beats = 480 * 2 // a second at the default tempo
+	dec := openTestMIDI(t, smfFile(0, 480, []smfEvent{
+		{0, []byte{0x90, 69, 100}},
+		{beats, []byte{0xE0, 0x7F, 0x7F}}, // two semitones up
+		{beats, []byte{0xE0, 0x00, 0x40}},
+		{0, []byte{0xB0, 64, 127}}, // sustain
+		{0, []byte{0x80, 69, 0}},
+		{beats, []byte{0xB0, 64, 0}},
+		{beats, []byte{0xC0, 5}},
+		{0, []byte{0x90, 69, 100}},
+		{beats, []byte{0x80, 69, 0}},
+		{0, []byte{0x99, 69, 100}}, // drums
+		{beats / 2, []byte{0x89, 69, 0}},
+		{beats, smfEnd},
+	}))
+	all := decodeAll(t, dec)
+	const s = MIDI_DEFAULT_RATE
+	if f := pitch(all, s/10, s-100); math.Abs(f-440) > 3 {
+		t.Fatalf("%.1f Hz, expected 440", f)
+	}
+	if f := pitch(all, s+s/10, 2*s-100); math.Abs(f-493.88) > 3 {
+		t.Fatalf("%.1f Hz bent, expected 493.9", f)
+	}
+	loud := stereoEnergy(all, s/10, s-100)
+	if e := stereoEnergy(all, 2*s+s/2, 3*s-100); e < 0.8*loud {
+		t.Fatalf("energy %v with the pedal down, expected %v", e, loud)
+	}
+	if e := stereoEnergy(all, 3*s+s/2, 4*s-100); e > 1e-4*loud {
+		t.Fatalf("energy %v after the pedal came up", e)
+	}
+	// program 5 is 20 dB down
+	if e := stereoEnergy(all, 4*s+s/10, 5*s-100); math.Abs(e/loud-0.158) > 0.02 {
+		t.Fatalf("program 5 at %v of program 0", e/loud)
+	}
+	if e := stereoEnergy(all, 5*s+s/10, 5*s+s/2-100); e < 0.5*loud {
+		t.Fatalf("drums at %v of program 0", e/loud)
+	}
+
+	// seeking replays the program change and the pedal
+	dec.seek(4*s + s/2)
+	samples, _, _ := dec.decode()
+	if e := stereoEnergy(samples, 0, DECODE_BLOCK_FRAMES); math.Abs(e/loud-0.158) > 0.02 {
+		t.Fatalf("program 5 at %v of program 0 after seek", e/loud)
+	}
+	dec.seek(2*s + s/2)
+	samples, _, _ = dec.decode()
+	if e := stereoEnergy(samples, 0, DECODE_BLOCK_FRAMES); e < 0.8*loud {
+		t.Fatalf("energy %v with the pedal down after seek", e)
+	}
+}
+
+func TestMIDIReset(t *testing.T) {
+	note := []smfEvent{
+		{0, []byte{0x90, 60, 100}},
+		{480, []byte{0x80, 60, 0}},
+		{0, smfEnd},
+	}
+	// a General MIDI reset puts program 5 back to 0
+	reset := append([]byte{MIDI_SYSEX}, vlq(len(midiResets[0]))...)
+	reset = append(reset, midiResets[0]...)
+	loud := decodeAll(t, openTestMIDI(t, smfFile(0, 480,
+		append([]smfEvent{{0, []byte{0xC0, 5}}, {0, reset}}, note...))))
+	quiet := decodeAll(t, openTestMIDI(t, smfFile(0, 480,
+		append([]smfEvent{{0, []byte{0xC0, 5}}}, note...))))
+	if e, q := stereoEnergy(loud, 1000, 20000), stereoEnergy(quiet, 1000, 20000); e < 5*q {
+		t.Fatalf("energy %v after reset, %v without", e, q)
+	}
+}
+
+func TestMIDIFormats(t *testing.T) {
+	// format 2 tracks play one after the other
+	track := []smfEvent{{0, []byte{0x90, 60, 100}}, {480, []byte{0x80, 60, 0}}, {0, smfEnd}}
+	smf := smfFile(2, 480, track, track)
+	seq, err := readMIDI(smf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq.length != SECOND {
+		t.Fatalf("format 2 plays for %d, expected %d", seq.length, int64(SECOND))
+	}
+
+	rmid := riffChunkBytes("RIFF", []byte("RMID"), riffChunkBytes("data", smf))
+	if seq, err = readMIDI(rmid); err != nil || seq.length != SECOND {
+		t.Fatalf("RMID: %v", err)
+	}
+	if _, err := readMIDI([]byte("garbage garbage")); err == nil {
+		t.Fatal("garbage read")
+	}
+}
+
+// TestMIDICorrupt plays damaged songs through damaged SoundFonts, which must
+// fail cleanly or play without panicking
+func TestMIDICorrupt(t *testing.T) {
+	smf := smfFile(1, 96, []smfEvent{
+		{0, smfMeta(MIDI_META_TEMPO, []byte{0x07, 0xA1, 0x20})},
+		{0, []byte{0x90, 60, 100, 64, 100, 67, 100}},
+		{96, []byte{0xB0, 7, 50}},
+		{96, []byte{0x80, 60, 0}},
+		{0, smfEnd},
+	})
+	sf := sf2TestFont()
+	path := filepath.Join(t.TempDir(), "a.sf2")
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 300; i++ {
+		data := append([]byte(nil), smf...)
+		for j := 0; j < 4; j++ {
+			data[r.Intn(len(data))] = byte(r.Intn(256))
+		}
+		seq, err := readMIDI(data[:r.Intn(len(data)+1)])
+		if err != nil {
+			continue
+		}
+
+		font := append([]byte(nil), sf...)
+		for j := 0; j < 4; j++ {
+			font[r.Intn(len(font))] = byte(r.Intn(256))
+		}
+		if err := os.WriteFile(path, font, 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := loadSoundFont(path)
+		if err != nil {
+			continue
+		}
+		dec := &midiDecoder{seq: seq, font: f}
+		dec.selectRate(22050)
+		for k := 0; k < 100; k++ {
+			if _, _, err := dec.decode(); err != nil {
+				break
+			}
+		}
+		dec.seek(1000)
+	}
+}
@@ -0,0 +1,614 @@
+package audio
+
+import (
+	"math"
+)
+
+const (
+	MIDI_CHANNELS       = 16
+	MIDI_DRUM_CHANNEL   = 9
+	MIDI_MAX_VOICES     = 256
+	MIDI_CONTROL_FRAMES = 64 // envelopes and pitch are updated this often
+	MIDI_GAIN           = 0.5
+
+	// the attenuation generator is scaled as the EMU hardware, and every
+	// player after it, did
+	SF2_ATTENUATION_SCALE = 0.4
+	SF2_SILENCE_CB        = 960 // a voice this quiet is finished
+	SF2_FULL_SCALE_CB     = 1000
+
+	MIDI_DEFAULT_BEND_RANGE = 200 // cents
+	MIDI_MOD_WHEEL_DEPTH    = 50  // cents of vibrato at full modulation
+	MIDI_LFO_BASE_FREQ      = 8.176
+)
+
+// controllers
+const (
+	MIDI_CC_BANK         = 0
+	MIDI_CC_MODULATION   = 1
+	MIDI_CC_DATA         = 6
+	MIDI_CC_VOLUME       = 7
+	MIDI_CC_PAN          = 10
+	MIDI_CC_EXPRESSION   = 11
+	MIDI_CC_DATA_LSB     = 38
+	MIDI_CC_SUSTAIN      = 64
+	MIDI_CC_NRPN_LSB     = 98
+	MIDI_CC_NRPN_MSB     = 99
+	MIDI_CC_RPN_LSB      = 100
+	MIDI_CC_RPN_MSB      = 101
+	MIDI_CC_SOUND_OFF    = 120
+	MIDI_CC_RESET        = 121
+	MIDI_CC_NOTES_OFF    = 123
+	MIDI_RPN_BEND_RANGE  = 0
+	MIDI_RPN_NONE        = 0x3FFF
+	MIDI_BEND_CENTER     = 8192
+	MIDI_CONTROLLER_SIZE = 128
+)
+
+// volume envelope stages
+const (
+	SF2_ENV_DELAY = iota
+	SF2_ENV_ATTACK
+	SF2_ENV_HOLD
+	SF2_ENV_DECAY
+	SF2_ENV_SUSTAIN
+	SF2_ENV_RELEASE
+	SF2_ENV_DONE
+)
+
+type midiChannel struct {
+	program int
+	bank    int
+	bend    int // 0-16383
+	// in cents
+	bendRange int
+
+	controllers [MIDI_CONTROLLER_SIZE]int
+	rpn         int
+	sustained   []*midiVoice // released while the pedal was down
+}
+
+func (ch *midiChannel) reset(drums bool) {
+	ch.program = 0
+	ch.bank = 0
+	if drums {
+		ch.bank = SF2_PERCUSSION
+	}
+	ch.resetControllers()
+}
+
+func (ch *midiChannel) resetControllers() {
+	ch.bend = MIDI_BEND_CENTER
+	ch.bendRange = MIDI_DEFAULT_BEND_RANGE
+	clear(ch.controllers[:])
+	ch.controllers[MIDI_CC_VOLUME] = 100
+	ch.controllers[MIDI_CC_PAN] = 64
+	ch.controllers[MIDI_CC_EXPRESSION] = 127
+	ch.rpn = MIDI_RPN_NONE
+}
+
+// gain is the channel's volume and expression, which are squared as the
+// default SoundFont modulators do
+func (ch *midiChannel) gain() float64 {
+	v := float64(ch.controllers[MIDI_CC_VOLUME]) / 127
+	e := float64(ch.controllers[MIDI_CC_EXPRESSION]) / 127
+	return v * v * e * e
+}
+
+// bendCents is the pitch wheel's offset
+func (ch *midiChannel) bendCents() float64 {
+	return float64(ch.bend-MIDI_BEND_CENTER) / MIDI_BEND_CENTER * float64(ch.bendRange)
+}
+
+// midiSynth plays MIDI events with the sounds of a SoundFont
+type midiSynth struct {
+	font *soundFont
+	rate int
+
+	channels [MIDI_CHANNELS]midiChannel
+	voices   []*midiVoice
+}
+
+func newMIDISynth(font *soundFont, rate int) *midiSynth {
+	s := &midiSynth{font: font, rate: rate}
+	s.reset()
+	return s
+}
+
+// reset silences every voice and returns the channels to their defaults
+func (s *midiSynth) reset() {
+	for i := range s.channels {
+		s.channels[i].reset(i == MIDI_DRUM_CHANNEL)
+		s.channels[i].sustained = nil
+	}
+	s.voices = s.voices[:0]
+}
+
+// handle applies one channel message
+func (s *midiSynth) handle(status uint8, data1 uint8, data2 uint8) {
+	c := int(status & 0x0F)
+	ch := &s.channels[c]
+	switch status & 0xF0 {
+	case 0x80:
+		s.noteOff(c, int(data1))
+	case 0x90:
+		if data2 == 0 {
+			s.noteOff(c, int(data1))
+		} else {
+			s.noteOn(c, int(data1), int(data2))
+		}
+	case 0xB0:
+		s.controlChange(c, int(data1), int(data2))
+	case 0xC0:
+		ch.program = int(data1)
+	case 0xE0:
+		ch.bend = int(data1) | int(data2)<<7
+	}
+}
+
+func (s *midiSynth) controlChange(c int, cc int, value int) {
+	ch := &s.channels[c]
+	if cc >= MIDI_CONTROLLER_SIZE {
+		return
+	}
+	ch.controllers[cc] = value
+
+	switch cc {
+	case MIDI_CC_BANK:
+		if c != MIDI_DRUM_CHANNEL {
+			ch.bank = value
+		}
+	case MIDI_CC_RPN_MSB:
+		ch.rpn = ch.rpn&0x7F | value<<7
+	case MIDI_CC_RPN_LSB:
+		ch.rpn = ch.rpn&^0x7F | value
+	case MIDI_CC_NRPN_MSB, MIDI_CC_NRPN_LSB:
+		ch.rpn = MIDI_RPN_NONE
+	case MIDI_CC_DATA, MIDI_CC_DATA_LSB:
+		if ch.rpn == MIDI_RPN_BEND_RANGE {
+			ch.bendRange = ch.controllers[MIDI_CC_DATA]*100 + ch.controllers[MIDI_CC_DATA_LSB]
+		}
+	case MIDI_CC_SUSTAIN:
+		if value < 64 {
+			for _, v := range ch.sustained {
+				v.release()
+			}
+			ch.sustained = ch.sustained[:0]
+		}
+	case MIDI_CC_SOUND_OFF:
+		for _, v := range s.voices {
+			if v.channel == c {
+				v.kill()
+			}
+		}
+		ch.sustained = ch.sustained[:0]
+	case MIDI_CC_NOTES_OFF:
+		for _, v := range s.voices {
+			if v.channel == c {
+				v.release()
+			}
+		}
+		ch.sustained = ch.sustained[:0]
+	case MIDI_CC_RESET:
+		ch.resetControllers()
+	}
+}
+
+func (s *midiSynth) noteOn(c int, key int, vel int) {
+	ch := &s.channels[c]
+	// a key struck again ends the note it was playing
+	s.noteOff(c, key)
+
+	preset := s.font.preset(ch.bank, ch.program)
+	if preset == nil {
+		return
+	}
+	for i := range preset.zones {
+		pz := &preset.zones[i]
+		if !pz.covers(key, vel) {
+			continue
+		}
+		ins := &s.font.instruments[pz.target]
+		for j := range ins.zones {
+			iz := &ins.zones[j]
+			if !iz.covers(key, vel) {
+				continue
+			}
+			gens := iz.gens
+			for g := range gens {
+				if !sf2InstrumentOnly[g] {
+					gens[g] += pz.gens[g]
+				}
+			}
+			s.startVoice(c, key, vel, &gens, &s.font.samples[iz.target])
+		}
+	}
+}
+
+func (s *midiSynth) startVoice(c int, key int, vel int, gens *[SF2_GENERATORS]int, sample *sf2Sample) {
+	if class := gens[SF2_GEN_EXCLUSIVE_CLASS]; class != 0 {
+		for _, v := range s.voices {
+			if v.channel == c && v.class == class {
+				v.kill()
+			}
+		}
+	}
+
+	v := newMIDIVoice(s, c, key, vel, gens, sample)
+	if v == nil {
+		return
+	}
+	if len(s.voices) >= MIDI_MAX_VOICES {
+		s.stealVoice()
+	}
+	s.voices = append(s.voices, v)
+}
+
+// stealVoice drops the quietest voice to make room, preferring released
+// ones
+func (s *midiSynth) stealVoice() {
+	best := 0
+	for i, v := range s.voices {
+		b := s.voices[best]
+		if (v.released && !b.released) || (v.released == b.released && v.gain < b.gain) {
+			best = i
+		}
+	}
+	s.voices = append(s.voices[:best], s.voices[best+1:]...)
+}
+
+func (s *midiSynth) noteOff(c int, key int) {
+	ch := &s.channels[c]
+	for _, v := range s.voices {
+		if v.channel != c || v.key != key || v.released || v.held {
+			continue
+		}
+		if ch.controllers[MIDI_CC_SUSTAIN] >= 64 {
+			v.held = true
+			ch.sustained = append(ch.sustained, v)
+		} else {
+			v.release()
+		}
+	}
+}
+
+// active reports whether any voice can still be heard
+func (s *midiSynth) active() bool {
+	return len(s.voices) > 0
+}
+
+// render mixes every voice into the interleaved stereo block
+func (s *midiSynth) render(out []float64) {
+	clear(out)
+	for _, v := range s.voices {
+		v.render(out)
+	}
+	kept := s.voices[:0]
+	for _, v := range s.voices {
+		if !v.done {
+			kept = append(kept, v)
+		}
+	}
+	clear(s.voices[len(kept):])
+	s.voices = kept
+}
+
+// silenceReleased drops voices that are on their way out, used after a seek
+// where they would otherwise start over from the beginning
+func (s *midiSynth) silenceReleased() {
+	kept := s.voices[:0]
+	for _, v := range s.voices {
+		if !v.released {
+			kept = append(kept, v)
+		}
+	}
+	clear(s.voices[len(kept):])
+	s.voices = kept
+}
+
+// midiVoice plays one sample of a note
+type midiVoice struct {
+	synth   *midiSynth
+	channel int
+	key     int
+	class   int
+
+	data      []int16
+	pos       float64
+	end       int
+	loopStart int
+	loopEnd   int
+	loopMode  int
+
+	// pitch before the channel's bend and vibrato, as a step through the
+	// sample per output frame
+	cents    float64
+	baseStep float64
+
+	vibDelay  int // frames
+	vibStep   float64
+	vibPhase  float64
+	vibDepth  float64
+	frameTime int
+
+	// envelope, in frames and centibels
+	stage       int
+	stageLeft   int
+	attack      int
+	hold        int
+	decayRate   float64 // centibels per frame
+	sustain     float64
+	releaseRate float64
+	atten       float64 // envelope attenuation
+	level       float64 // rising through the attack
+
+	velGain  float64
+	baseGain float64 // attenuation generator and velocity
+	pan      float64 // -500 to 500
+	gain     float64
+	left     float64
+	right    float64
+
+	// two pole low pass, unused when the cutoff is open
+	filter         bool
+	b0, b1, b2     float64
+	a1, a2         float64
+	x1, x2, y1, y2 float64
+
+	released bool
+	held     bool // released while the sustain pedal was down
+	done     bool
+}
+
+// timecents converts an envelope time to frames
+func timecents(tc int, rate int) int {
+	if tc <= -12000 {
+		return 0
+	}
+	return int(math.Exp2(float64(tc)/1200) * float64(rate))
+}
+
+func newMIDIVoice(s *midiSynth, c int, key int, vel int, gens *[SF2_GENERATORS]int, sample *sf2Sample) *midiVoice {
+	g := gens
+	font := s.font
+	v := &midiVoice{synth: s, channel: c, key: key, class: g[SF2_GEN_EXCLUSIVE_CLASS], data: font.data}
+
+	v.pos = float64(sample.start + g[SF2_GEN_START_OFFSET] + 32768*g[SF2_GEN_START_COARSE])
+	v.end = sample.end + g[SF2_GEN_END_OFFSET] + 32768*g[SF2_GEN_END_COARSE]
+	v.loopStart = sample.loopStart + g[SF2_GEN_LOOP_START_OFFSET] + 32768*g[SF2_GEN_LOOP_START_COARSE]
+	v.loopEnd = sample.loopEnd + g[SF2_GEN_LOOP_END_OFFSET] + 32768*g[SF2_GEN_LOOP_END_COARSE]
+	v.end = min(v.end, len(v.data))
+	v.pos = max(v.pos, 0)
+	if int(v.pos) >= v.end {
+		return nil
+	}
+	v.loopMode = g[SF2_GEN_SAMPLE_MODES] & 3
+	if v.loopMode == 2 || v.loopStart < 0 || v.loopEnd > v.end || v.loopEnd-v.loopStart < 2 {
+		v.loopMode = SF2_LOOP_NONE
+	}
+
+	if g[SF2_GEN_KEYNUM] >= 0 {
+		key = g[SF2_GEN_KEYNUM]
+	}
+	if g[SF2_GEN_VELOCITY] >= 0 {
+		vel = g[SF2_GEN_VELOCITY]
+	}
+	root := sample.key
+	if g[SF2_GEN_ROOT_KEY] >= 0 {
+		root = g[SF2_GEN_ROOT_KEY]
+	}
+	if root > 127 {
+		root = 60
+	}
+	v.cents = float64((key-root)*g[SF2_GEN_SCALE_TUNING]+g[SF2_GEN_COARSE_TUNE]*100+g[SF2_GEN_FINE_TUNE]) + float64(sample.cents)
+	v.baseStep = float64(sample.rate) / float64(s.rate)
+
+	v.vibDelay = timecents(g[SF2_GEN_DELAY_VIB_LFO], s.rate)
+	v.vibStep = MIDI_LFO_BASE_FREQ * math.Exp2(float64(g[SF2_GEN_FREQ_VIB_LFO])/1200) / float64(s.rate)
+	v.vibDepth = float64(g[SF2_GEN_VIB_LFO_TO_PITCH])
+
+	// the note's key shortens or lengthens hold and decay
+	v.stageLeft = timecents(g[SF2_GEN_DELAY_VOL_ENV], s.rate)
+	v.attack = timecents(g[SF2_GEN_ATTACK_VOL_ENV], s.rate)
+	v.hold = timecents(g[SF2_GEN_HOLD_VOL_ENV]+(60-key)*g[SF2_GEN_KEY_TO_VOL_ENV_HOLD], s.rate)
+	decay := timecents(g[SF2_GEN_DECAY_VOL_ENV]+(60-key)*g[SF2_GEN_KEY_TO_VOL_ENV_DECAY], s.rate)
+	v.decayRate = SF2_FULL_SCALE_CB / float64(max(decay, 1))
+	v.sustain = float64(min(max(g[SF2_GEN_SUSTAIN_VOL_ENV], 0), 1440))
+	v.releaseRate = SF2_FULL_SCALE_CB / float64(max(timecents(g[SF2_GEN_RELEASE_VOL_ENV], s.rate), 1))
+	v.stage = SF2_ENV_DELAY
+
+	vf := float64(vel) / 127
+	atten := float64(max(g[SF2_GEN_ATTENUATION], 0)) * SF2_ATTENUATION_SCALE
+	v.baseGain = math.Pow(10, -atten/200) * vf * vf * MIDI_GAIN
+	v.pan = float64(min(max(g[SF2_GEN_PAN], -500), 500))
+
+	if fc := g[SF2_GEN_INITIAL_FILTER_FC]; fc < 13500 {
+		v.setFilter(MIDI_LFO_BASE_FREQ*math.Exp2(float64(fc)/1200), float64(max(g[SF2_GEN_INITIAL_FILTER_Q], 0)))
+	}
+	return v
+}
+
+// setFilter sets up a resonant low pass, with the resonance in centibels
+func (v *midiVoice) setFilter(freq float64, q float64) {
+	rate := float64(v.synth.rate)
+	if freq >= rate*0.45 {
+		return
+	}
+	w := 2 * math.Pi * max(freq, 5) / rate
+	alpha := math.Sin(w) / (2 * max(math.Pow(10, q/200), math.Sqrt2/2))
+	a0 := 1 + alpha
+	v.b1 = (1 - math.Cos(w)) / a0
+	v.b0 = v.b1 / 2
+	v.b2 = v.b0
+	v.a1 = -2 * math.Cos(w) / a0
+	v.a2 = (1 - alpha) / a0
+	v.filter = true
+}
+
+// release lets the note go into its release stage
+func (v *midiVoice) release() {
+	v.held = false
+	if v.released {
+		return
+	}
+	v.released = true
+	if v.stage < SF2_ENV_DECAY {
+		// the attack rises in amplitude, so carry on from the same loudness
+		v.atten = -200 * math.Log10(max(v.level, 1e-5))
+		if v.stage < SF2_ENV_HOLD {
+			v.atten = max(v.atten, 0)
+		}
+	}
+	v.stage = SF2_ENV_RELEASE
+}
+
+// kill stops the voice quickly, without a click
+func (v *midiVoice) kill() {
+	v.release()
+	v.releaseRate = SF2_FULL_SCALE_CB / (0.005 * float64(v.synth.rate))
+}
+
+// advance runs the envelope forward, returning the gain it gives
+func (v *midiVoice) advance(frames int) float64 {
+	for frames > 0 {
+		switch v.stage {
+		case SF2_ENV_DELAY, SF2_ENV_HOLD:
+			if v.stageLeft > frames {
+				v.stageLeft -= frames
+				frames = 0
+				break
+			}
+			frames -= v.stageLeft
+			if v.stage == SF2_ENV_DELAY {
+				v.stage, v.stageLeft = SF2_ENV_ATTACK, v.attack
+			} else {
+				v.stage = SF2_ENV_DECAY
+			}
+		case SF2_ENV_ATTACK:
+			if v.stageLeft > frames {
+				v.stageLeft -= frames
+				v.level = 1 - float64(v.stageLeft)/float64(max(v.attack, 1))
+				frames = 0
+				break
+			}
+			frames -= v.stageLeft
+			v.level, v.atten = 1, 0
+			v.stage, v.stageLeft = SF2_ENV_HOLD, v.hold
+		case SF2_ENV_DECAY:
+			v.atten += v.decayRate * float64(frames)
+			frames = 0
+			if v.atten >= v.sustain {
+				v.atten = v.sustain
+				v.stage = SF2_ENV_SUSTAIN
+			}
+		case SF2_ENV_SUSTAIN:
+			frames = 0
+		case SF2_ENV_RELEASE:
+			v.atten += v.releaseRate * float64(frames)
+			frames = 0
+		default:
+			frames = 0
+		}
+	}
+
+	if v.atten >= SF2_SILENCE_CB {
+		v.stage = SF2_ENV_DONE
+		return 0
+	}
+	switch v.stage {
+	case SF2_ENV_DELAY:
+		return 0
+	case SF2_ENV_ATTACK:
+		return v.level
+	}
+	return math.Pow(10, -v.atten/200)
+}
+
+// render adds the voice to an interleaved stereo block
+func (v *midiVoice) render(out []float64) {
+	ch := &v.synth.channels[v.channel]
+	frames := len(out) / 2
+
+	for n := 0; n < frames && !v.done; {
+		k := min(MIDI_CONTROL_FRAMES, frames-n)
+
+		// pitch for this stretch
+		cents := v.cents + ch.bendCents()
+		depth := v.vibDepth + float64(ch.controllers[MIDI_CC_MODULATION])/127*MIDI_MOD_WHEEL_DEPTH
+		if depth != 0 && v.frameTime >= v.vibDelay {
+			cents += depth * math.Sin(2*math.Pi*v.vibPhase)
+			v.vibPhase = math.Mod(v.vibPhase+v.vibStep*float64(k), 1)
+		}
+		v.frameTime += k
+		step := v.baseStep * math.Exp2(cents/1200)
+
+		// gains ramp across the stretch to the envelope's value at its end
+		env := v.advance(k)
+		gain := env * v.baseGain * ch.gain()
+		pan := v.pan + float64(ch.controllers[MIDI_CC_PAN]-64)/64*500
+		angle := (min(max(pan, -500), 500) + 500) / 1000 * math.Pi / 2
+		left, right := gain*math.Cos(angle), gain*math.Sin(angle)
+		dl, dr := (left-v.left)/float64(k), (right-v.right)/float64(k)
+
+		for i := 0; i < k; i++ {
+			sample := v.sample()
+			if v.filter {
+				y := v.b0*sample + v.b1*v.x1 + v.b2*v.x2 - v.a1*v.y1 - v.a2*v.y2
+				v.x2, v.x1 = v.x1, sample
+				v.y2, v.y1 = v.y1, y
+				sample = y
+			}
+			v.left += dl
+			v.right += dr
+			out[2*(n+i)] += sample * v.left
+			out[2*(n+i)+1] += sample * v.right
+
+			if !v.move(step) {
+				v.done = true
+				break
+			}
+		}
+		v.gain = gain
+		if v.stage == SF2_ENV_DONE {
+			v.done = true
+		}
+		n += k
+	}
+}
+
+// looping reports whether the sample is still going round its loop
+func (v *midiVoice) looping() bool {
+	return v.loopMode == SF2_LOOP || (v.loopMode == SF2_LOOP_RELEASE && !v.released)
+}
+
+// sample interpolates the sample at the current position
+func (v *midiVoice) sample() float64 {
+	idx := int(v.pos)
+	t := v.pos - float64(idx)
+	at := func(i int) float64 {
+		if v.looping() && i >= v.loopEnd {
+			i -= v.loopEnd - v.loopStart
+		}
+		if i < 0 || i >= v.end {
+			return 0
+		}
+		return float64(v.data[i]) / 32768
+	}
+	s0, s1, s2, s3 := at(idx-1), at(idx), at(idx+1), at(idx+2)
+	c1 := 0.5 * (s2 - s0)
+	c2 := s0 - 2.5*s1 + 2*s2 - 0.5*s3
+	c3 := 0.5*(s3-s0) + 1.5*(s1-s2)
+	return ((c3*t+c2)*t+c1)*t + s1
+}
+
+// move advances through the sample, returning false at its end
+func (v *midiVoice) move(step float64) bool {
+	v.pos += step
+	if v.looping() {
+		if length := float64(v.loopEnd - v.loopStart); v.pos >= float64(v.loopEnd) {
+			v.pos = float64(v.loopStart) + math.Mod(v.pos-float64(v.loopStart), length)
+		}
+		return true
+	}
+	return v.pos < float64(v.end)
+}
@@ -0,0 +1,269 @@
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+)
+
+const (
+	MOD_TITLE_SIZE     = 20
+	MOD_SAMPLE_SIZE    = 30
+	MOD_ROWS           = 64
+	MOD_ORDERS         = 128
+	MOD_SIGNATURE      = 1080
+	MOD_OLD_SAMPLES    = 15
+	MOD_SAMPLES        = 31
+	MOD_MAX_CHANNELS   = 32
+	MOD_PAL_CLOCK      = 3546895
+	MOD_PERIOD_C2      = 428 // plays a sample at its base frequency
+	MOD_STEREO_LEFT    = 64
+	MOD_STEREO_RIGHT   = 192
+	MOD_DEFAULT_SPEED  = 6
+	MOD_DEFAULT_TEMPO  = 125
+	MOD_FINETUNE_STEPS = 96 // per octave
+)
+
+// channel counts for the signatures that are not just a number
+var modSignatures = map[string]int{
+	"M.K.": 4, "M!K!": 4, "M&K!": 4, "FLT4": 4, "NSMS": 4, "LARD": 4, "PATT": 4,
+	"FLT8": 8, "OKTA": 8, "OCTA": 8, "CD81": 8,
+}
+
+// modChannels returns the channel count a signature stands for, or 0
+func modChannels(sig string) int {
+	if n, ok := modSignatures[sig]; ok {
+		return n
+	}
+
+	var digits string
+	switch {
+	case sig[1:] == "CHN":
+		digits = sig[:1]
+	case sig[2:] == "CH" || sig[2:] == "CN":
+		digits = sig[:2]
+	case sig[:3] == "TDZ":
+		digits = sig[3:]
+	default:
+		return 0
+	}
+	n, err := strconv.Atoi(digits)
+	if err != nil || n < 1 || n > MOD_MAX_CHANNELS {
+		return 0
+	}
+	return n
+}
+
+func loadMOD(data []byte) (*trackerModule, error) {
+	if len(data) < MOD_SIGNATURE+4 {
+		return loadOldMOD(data)
+	}
+	channels := modChannels(string(data[MOD_SIGNATURE : MOD_SIGNATURE+4]))
+	if channels == 0 {
+		return loadOldMOD(data)
+	}
+	return parseMOD(data, MOD_SAMPLES, channels)
+}
+
+// loadOldMOD reads the original Soundtracker layout, which has 15 samples and
+// no signature
+func loadOldMOD(data []byte) (*trackerModule, error) {
+	headerSize := MOD_TITLE_SIZE + MOD_OLD_SAMPLES*MOD_SAMPLE_SIZE + 2 + MOD_ORDERS
+	if len(data) < headerSize {
+		return nil, ErrNotTracker
+	}
+	// without a signature, insist on plausible text and orders
+	for _, c := range data[:MOD_TITLE_SIZE] {
+		if c != 0 && (c < 32 || c > 126) {
+			return nil, ErrNotTracker
+		}
+	}
+	length := int(data[headerSize-MOD_ORDERS-2])
+	if length == 0 || length > MOD_ORDERS {
+		return nil, ErrNotTracker
+	}
+	for _, o := range data[headerSize-MOD_ORDERS : headerSize] {
+		if o >= 64 {
+			return nil, ErrNotTracker
+		}
+	}
+	return parseMOD(data, MOD_OLD_SAMPLES, 4)
+}
+
+func parseMOD(data []byte, numSamples int, channels int) (*trackerModule, error) {
+	be := binary.BigEndian
+	mod := &trackerModule{
+		kind:         TRACKER_MOD,
+		title:        trackerString(data[:MOD_TITLE_SIZE]),
+		channels:     channels,
+		speed:        MOD_DEFAULT_SPEED,
+		tempo:        MOD_DEFAULT_TEMPO,
+		globalVolume: 128,
+		amigaLimits:  true,
+	}
+	mod.mixVolume = trackerMixVolume(channels)
+
+	// Amiga channels alternate left, right, right, left
+	mod.channelPan = make([]int, channels)
+	for c := range mod.channelPan {
+		mod.channelPan[c] = MOD_STEREO_LEFT
+		if c%4 == 1 || c%4 == 2 {
+			mod.channelPan[c] = MOD_STEREO_RIGHT
+		}
+	}
+
+	pos := MOD_TITLE_SIZE
+	mod.samples = make([]trackerSample, numSamples)
+	lengths := make([]int, numSamples)
+	for i := range mod.samples {
+		h := data[pos : pos+MOD_SAMPLE_SIZE]
+		pos += MOD_SAMPLE_SIZE
+
+		finetune := int(h[24]&0xF) << 28 >> 28
+		s := &mod.samples[i]
+		s.name = trackerString(h[:22])
+		s.volume = min(int(h[25]), 64)
+		s.globalVolume = 64
+		s.pan = -1
+		s.baseFreq = MOD_PAL_CLOCK / float64(MOD_PERIOD_C2) * math.Exp2(float64(finetune)/MOD_FINETUNE_STEPS)
+
+		lengths[i] = int(be.Uint16(h[22:])) * 2
+		loopStart := int(be.Uint16(h[26:])) * 2
+		loopLength := int(be.Uint16(h[28:])) * 2
+		if loopLength > 2 {
+			s.loop = TRACKER_LOOP_FORWARD
+			s.loopStart, s.loopEnd = loopStart, loopStart+loopLength
+		}
+	}
+
+	length := int(data[pos])
+	orders := data[pos+2 : pos+2+MOD_ORDERS]
+	pos += 2 + MOD_ORDERS
+	if numSamples == MOD_SAMPLES {
+		pos += 4
+	}
+	if length == 0 || length > MOD_ORDERS {
+		return nil, ErrNotTracker
+	}
+
+	numPatterns := 0
+	for _, o := range orders {
+		numPatterns = max(numPatterns, int(o)+1)
+	}
+	mod.orders = append([]uint8(nil), orders[:length]...)
+
+	patternSize := MOD_ROWS * channels * 4
+	mod.patterns = make([]trackerPattern, numPatterns)
+	for i := range mod.patterns {
+		pat := trackerPattern{rows: MOD_ROWS, cells: make([]trackerCell, MOD_ROWS*channels)}
+		for c := range pat.cells {
+			off := pos + c*4
+			if off+4 > len(data) {
+				break
+			}
+			pat.cells[c] = parseMODCell(data[off : off+4])
+		}
+		mod.patterns[i] = pat
+		pos += patternSize
+	}
+
+	for i := range mod.samples {
+		s := &mod.samples[i]
+		n := min(lengths[i], max(len(data)-pos, 0))
+		s.data = make([]float32, n)
+		for j := range s.data {
+			s.data[j] = float32(int8(data[pos+j])) / 128
+		}
+		pos += lengths[i]
+		clampLoop(&s.loop, &s.loopStart, &s.loopEnd, len(s.data))
+	}
+
+	return mod, nil
+}
+
+func parseMODCell(b []byte) trackerCell {
+	cell := trackerCell{instrument: b[0]&0xF0 | b[2]>>4}
+	if period := int(b[0]&0xF)<<8 | int(b[1]); period > 0 {
+		key := TRACKER_BASE_NOTE + int(math.Round(12*math.Log2(MOD_PERIOD_C2/float64(period))))
+		cell.note = uint8(min(max(key, 0), TRACKER_NOTES-1) + 1)
+	}
+	cell.effect, cell.param = modEffect(b[2]&0xF, b[3])
+	return cell
+}
+
+// modEffect translates a ProTracker effect, which FastTracker shares
+func modEffect(cmd uint8, param uint8) (uint8, uint8) {
+	x, y := param>>4, param&0xF
+	switch cmd {
+	case 0x0:
+		if param != 0 {
+			return TRACKER_FX_ARPEGGIO, param
+		}
+	case 0x1:
+		return TRACKER_FX_PORTA_UP, param
+	case 0x2:
+		return TRACKER_FX_PORTA_DOWN, param
+	case 0x3:
+		return TRACKER_FX_TONE_PORTA, param
+	case 0x4:
+		return TRACKER_FX_VIBRATO, param
+	case 0x5:
+		return TRACKER_FX_TONE_PORTA_VOL, param
+	case 0x6:
+		return TRACKER_FX_VIBRATO_VOL, param
+	case 0x7:
+		return TRACKER_FX_TREMOLO, param
+	case 0x8:
+		return TRACKER_FX_PAN, param
+	case 0x9:
+		return TRACKER_FX_OFFSET, param
+	case 0xA:
+		return TRACKER_FX_VOL_SLIDE, param
+	case 0xB:
+		return TRACKER_FX_JUMP, param
+	case 0xC:
+		return TRACKER_FX_VOLUME, param
+	case 0xD:
+		return TRACKER_FX_BREAK, x*10 + y
+	case 0xE:
+		switch x {
+		case 0x1:
+			return TRACKER_FX_FINE_PORTA_UP, y
+		case 0x2:
+			return TRACKER_FX_FINE_PORTA_DOWN, y
+		case 0x4:
+			return TRACKER_FX_VIB_WAVE, y
+		case 0x6:
+			return TRACKER_FX_PATTERN_LOOP, y
+		case 0x7:
+			return TRACKER_FX_TREM_WAVE, y
+		case 0x8:
+			return TRACKER_FX_PAN, y * 17
+		case 0x9:
+			return TRACKER_FX_RETRIG, y
+		case 0xA:
+			return TRACKER_FX_FINE_VOL_UP, y
+		case 0xB:
+			return TRACKER_FX_FINE_VOL_DOWN, y
+		case 0xC:
+			return TRACKER_FX_NOTE_CUT, y
+		case 0xD:
+			return TRACKER_FX_NOTE_DELAY, y
+		case 0xE:
+			return TRACKER_FX_PATTERN_DELAY, y
+		}
+	case 0xF:
+		if param >= 0x20 {
+			return TRACKER_FX_TEMPO, param
+		}
+		if param > 0 {
+			return TRACKER_FX_SPEED, param
+		}
+	}
+	return TRACKER_FX_NONE, 0
+}
+
+// trackerMixVolume scales the mix so busier modules do not clip as easily
+func trackerMixVolume(channels int) float64 {
+	return TRACKER_MIX_GAIN / math.Sqrt(float64(max(channels, 4))/4)
+}
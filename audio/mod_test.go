@@ -0,0 +1,70 @@
+package audio
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// modTestFile is a four channel module playing a looped square on the first
+// channel, at its base pitch and then an octave up from row 32
+func modTestFile() []byte {
+	be := binary.BigEndian
+	out := trackerField("Test Song", MOD_TITLE_SIZE)
+	for i := 0; i < MOD_SAMPLES; i++ {
+		h := trackerField("", MOD_SAMPLE_SIZE)
+		if i == 0 {
+			copy(h, "by Tester")
+			be.PutUint16(h[22:], 16) // in words
+			h[25] = 64
+			be.PutUint16(h[28:], 16)
+		}
+		out = append(out, h...)
+	}
+	out = append(out, 1, 127)
+	out = append(out, make([]byte, MOD_ORDERS)...)
+	out = append(out, "M.K."...)
+
+	pattern := make([]byte, MOD_ROWS*4*4)
+	note := func(row, sample, period int) {
+		c := pattern[row*4*4:]
+		c[0] = byte(sample&0xF0 | period>>8)
+		c[1] = byte(period)
+		c[2] = byte(sample & 0xF << 4)
+	}
+	note(0, 1, MOD_PERIOD_C2)
+	note(32, 0, MOD_PERIOD_C2/2)
+	out = append(out, pattern...)
+	for i := 0; i < 32; i++ {
+		if i < 16 {
+			out = append(out, 64)
+		} else {
+			out = append(out, 0xC0)
+		}
+	}
+	return out
+}
+
+func TestMOD(t *testing.T) {
+	const frames = MOD_ROWS * MOD_DEFAULT_SPEED * TRACKER_TEST_TICK
+	dec := openTestModule(t, "a.mod", modTestFile(), loadMOD, frames)
+	m := dec.metadata()
+	if m.Title != "Test Song" || m.Artist != NOT_FOUND || !strings.Contains(m.Comment, "by Tester") {
+		t.Fatalf("metadata %+v", m)
+	}
+
+	all := decodeAll(t, dec)
+	if len(all) != frames*2 {
+		t.Fatalf("%d frames, expected %d", len(all)/2, frames)
+	}
+	checkPitch(t, "row 0", all, 1000, 1)
+	checkPitch(t, "row 33", all, 33*MOD_DEFAULT_SPEED*TRACKER_TEST_TICK, 2)
+	checkSeek(t, dec, all, 1e-9, 0, 5, 4096, 40*MOD_DEFAULT_SPEED*TRACKER_TEST_TICK+123, frames-1)
+
+	// another rate plays for as long
+	dec.selectRate(48000)
+	checkFormat(t, dec, 2, 48000, frames*48000/TRACKER_DEFAULT_RATE)
+	if n := len(decodeAll(t, dec)) / 2; n != frames*48000/TRACKER_DEFAULT_RATE {
+		t.Fatalf("%d frames at 48 kHz", n)
+	}
+}
@@ -0,0 +1,1433 @@
+package audio
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	MPEG_25 = iota
+	MPEG_RESERVED
+	MPEG_2
+	MPEG_1
+)
+
+const (
+	MPEG_MODE_STEREO = iota
+	MPEG_MODE_JOINT_STEREO
+	MPEG_MODE_DUAL_CHANNEL
+	MPEG_MODE_MONO
+)
+
+const (
+	MP3_GRANULE_SAMPLES = 576
+
+	// samples of delay introduced by the decoder's filterbanks
+	MP3_DECODER_DELAY = 529
+
+	// frames read ahead of a seek target to refill the bit reservoir
+	MP3_RESERVOIR_FRAMES = 9
+
+	XING_FLAG_FRAMES  = 0x1
+	XING_FLAG_BYTES   = 0x2
+	XING_FLAG_TOC     = 0x4
+	XING_FLAG_QUALITY = 0x8
+)
+
+var (
+	ErrNotMP3 = errors.New("no MPEG audio frames found")
+)
+
+var (
+	mp3Bitrates = [2][16]int{
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+	}
+
+	// indexed by version, then the sample rate field
+	mp3SampleRates = [4][3]int{
+		MPEG_25: {11025, 12000, 8000},
+		MPEG_2:  {22050, 24000, 16000},
+		MPEG_1:  {44100, 48000, 32000},
+	}
+
+	// scalefactor band boundaries for 44.1, 48, 32, 22.05, 24, 16, 11.025, 12 and 8 kHz
+	mp3BandsLong = [9][23]int{
+		{0, 4, 8, 12, 16, 20, 24, 30, 36, 44, 52, 62, 74, 90, 110, 134, 162, 196, 238, 288, 342, 418, 576},
+		{0, 4, 8, 12, 16, 20, 24, 30, 36, 42, 50, 60, 72, 88, 106, 128, 156, 190, 230, 276, 330, 384, 576},
+		{0, 4, 8, 12, 16, 20, 24, 30, 36, 44, 54, 66, 82, 102, 126, 156, 194, 240, 296, 364, 448, 550, 576},
+		{0, 6, 12, 18, 24, 30, 36, 44, 54, 66, 80, 96, 116, 140, 168, 200, 238, 284, 336, 396, 464, 522, 576},
+		{0, 6, 12, 18, 24, 30, 36, 44, 54, 66, 80, 96, 114, 136, 162, 194, 232, 278, 332, 394, 464, 540, 576},
+		{0, 6, 12, 18, 24, 30, 36, 44, 54, 66, 80, 96, 116, 140, 168, 200, 238, 284, 336, 396, 464, 522, 576},
+		{0, 6, 12, 18, 24, 30, 36, 44, 54, 66, 80, 96, 116, 140, 168, 200, 238, 284, 336, 396, 464, 522, 576},
+		{0, 6, 12, 18, 24, 30, 36, 44, 54, 66, 80, 96, 116, 140, 168, 200, 238, 284, 336, 396, 464, 522, 576},
+		{0, 12, 24, 36, 48, 60, 72, 88, 108, 132, 160, 192, 232, 280, 336, 400, 476, 566, 568, 570, 572, 574, 576},
+	}
+	mp3BandsShort = [9][14]int{
+		{0, 4, 8, 12, 16, 22, 30, 40, 52, 66, 84, 106, 136, 192},
+		{0, 4, 8, 12, 16, 22, 28, 38, 50, 64, 80, 100, 126, 192},
+		{0, 4, 8, 12, 16, 22, 30, 42, 58, 78, 104, 138, 180, 192},
+		{0, 4, 8, 12, 18, 24, 32, 42, 56, 74, 100, 132, 174, 192},
+		{0, 4, 8, 12, 18, 26, 36, 48, 62, 80, 104, 136, 180, 192},
+		{0, 4, 8, 12, 18, 26, 36, 48, 62, 80, 104, 134, 174, 192},
+		{0, 4, 8, 12, 18, 26, 36, 48, 62, 80, 104, 134, 174, 192},
+		{0, 4, 8, 12, 18, 26, 36, 48, 62, 80, 104, 134, 174, 192},
+		{0, 8, 16, 24, 36, 52, 72, 96, 124, 160, 162, 164, 166, 192},
+	}
+
+	mp3Pretab = [22]int{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 3, 3, 3, 2, 0}
+
+	mp3Slen = [2][16]int{
+		{0, 0, 0, 0, 3, 1, 1, 1, 2, 2, 2, 3, 3, 3, 4, 4},
+		{0, 1, 2, 3, 0, 1, 2, 3, 1, 2, 3, 1, 2, 3, 2, 3},
+	}
+
+	// number of scalefactors per slen group for MPEG-2 LSF, indexed by the
+	// scalefac_compress range and block type (long, short, mixed)
+	mp3LSFBands = [6][3][4]int{
+		{{6, 5, 5, 5}, {9, 9, 9, 9}, {6, 9, 9, 9}},
+		{{6, 5, 7, 3}, {9, 9, 12, 6}, {6, 9, 12, 6}},
+		{{11, 10, 0, 0}, {18, 18, 0, 0}, {15, 18, 0, 0}},
+		{{7, 7, 7, 0}, {12, 12, 12, 0}, {6, 15, 12, 0}},
+		{{6, 6, 6, 3}, {12, 9, 9, 6}, {6, 12, 9, 6}},
+		{{8, 8, 5, 0}, {15, 12, 9, 0}, {6, 18, 9, 0}},
+	}
+
+	mp3AliasCoefficients = [8]float64{-0.6, -0.535, -0.33, -0.185, -0.095, -0.041, -0.0142, -0.0037}
+)
+
+// lookup tables filled in by init
+var (
+	mp3Trees      = make(map[int]huffmanTree)
+	mp3Count1Tree huffmanTree
+
+	mp3Pow43 [8207]float64
+
+	mp3AliasCS, mp3AliasCA [8]float64
+
+	mp3IMDCTLong  [36][18]float64
+	mp3IMDCTShort [12][6]float64
+	mp3Windows    [4][36]float64
+
+	mp3SynthMatrix [64][32]float64
+
+	// MPEG-1 intensity stereo left gains, the right gain is mp3IntensityRatios[6-pos]
+	mp3IntensityRatios [7]float64
+)
+
+func init() {
+	RegisterAudioSourceProvider(".mp3", &AudioSourceProvider{createMP3AudioSourceFromFile, getMP3FileMetadata})
+
+	for table, code := range mp3HuffmanCodes {
+		mp3Trees[table] = newHuffmanTree(code.lens, code.codes)
+	}
+	mp3Count1Tree = newHuffmanTree(mp3Count1CodeA.lens, mp3Count1CodeA.codes)
+
+	for i := range mp3Pow43 {
+		mp3Pow43[i] = math.Pow(float64(i), 4.0/3.0)
+	}
+
+	for i, c := range mp3AliasCoefficients {
+		sq := math.Sqrt(1 + c*c)
+		mp3AliasCS[i] = 1 / sq
+		mp3AliasCA[i] = c / sq
+	}
+
+	for i := 0; i < 36; i++ {
+		for k := 0; k < 18; k++ {
+			mp3IMDCTLong[i][k] = math.Cos(math.Pi / 72 * float64((2*i+1+18)*(2*k+1)))
+		}
+	}
+	for i := 0; i < 12; i++ {
+		for k := 0; k < 6; k++ {
+			mp3IMDCTShort[i][k] = math.Cos(math.Pi / 24 * float64((2*i+1+6)*(2*k+1)))
+		}
+	}
+
+	// block types 0 (normal), 1 (start), 2 (short, 12 points) and 3 (stop)
+	for i := 0; i < 36; i++ {
+		mp3Windows[0][i] = math.Sin(math.Pi / 36 * (float64(i) + 0.5))
+	}
+	for i := 0; i < 18; i++ {
+		mp3Windows[1][i] = mp3Windows[0][i]
+		mp3Windows[3][i+18] = mp3Windows[0][i+18]
+	}
+	for i := 18; i < 24; i++ {
+		mp3Windows[1][i] = 1
+	}
+	for i := 24; i < 30; i++ {
+		mp3Windows[1][i] = math.Sin(math.Pi / 12 * (float64(i-18) + 0.5))
+	}
+	for i := 6; i < 12; i++ {
+		mp3Windows[3][i] = math.Sin(math.Pi / 12 * (float64(i-6) + 0.5))
+	}
+	for i := 12; i < 18; i++ {
+		mp3Windows[3][i] = 1
+	}
+	for i := 0; i < 12; i++ {
+		mp3Windows[2][i] = math.Sin(math.Pi / 12 * (float64(i) + 0.5))
+	}
+
+	for i := 0; i < 64; i++ {
+		for k := 0; k < 32; k++ {
+			mp3SynthMatrix[i][k] = math.Cos(float64((16+i)*(2*k+1)) * math.Pi / 64)
+		}
+	}
+
+	for pos := range mp3IntensityRatios {
+		ratio := math.Tan(float64(pos) * math.Pi / 12)
+		if pos == 6 {
+			mp3IntensityRatios[pos] = 1
+		} else {
+			mp3IntensityRatios[pos] = ratio / (1 + ratio)
+		}
+	}
+}
+
+type mp3FrameHeader struct {
+	version    int
+	layer      int
+	crc        bool
+	bitrate    int // in kbit/s
+	rateIndex  int
+	sampleRate int
+	padding    int
+	mode       int
+	modeExt    int
+
+	channels     int
+	size         int // in bytes, including the header
+	samples      int // per channel
+	sideInfoSize int
+}
+
+// parseMP3Header decodes a Layer III frame header. Free-format streams are
+// not supported.
+func parseMP3Header(b []byte) (h mp3FrameHeader, ok bool) {
+	if len(b) < 4 || b[0] != 0xFF || b[1]&0xE0 != 0xE0 {
+		return h, false
+	}
+
+	h.version = int(b[1]>>3) & 3
+	h.layer = int(b[1]>>1) & 3
+	h.crc = b[1]&1 == 0
+	bitrateIndex := int(b[2] >> 4)
+	h.rateIndex = int(b[2]>>2) & 3
+	h.padding = int(b[2]>>1) & 1
+	h.mode = int(b[3] >> 6)
+	h.modeExt = int(b[3]>>4) & 3
+
+	if h.version == MPEG_RESERVED || h.layer != 1 || h.rateIndex == 3 || bitrateIndex == 0 || bitrateIndex == 15 {
+		return h, false
+	}
+
+	h.sampleRate = mp3SampleRates[h.version][h.rateIndex]
+	h.channels = 2
+	if h.mode == MPEG_MODE_MONO {
+		h.channels = 1
+	}
+
+	if h.version == MPEG_1 {
+		h.bitrate = mp3Bitrates[0][bitrateIndex]
+		h.samples = 1152
+		h.size = 144000*h.bitrate/h.sampleRate + h.padding
+		h.sideInfoSize = 32
+		if h.channels == 1 {
+			h.sideInfoSize = 17
+		}
+	} else {
+		h.bitrate = mp3Bitrates[1][bitrateIndex]
+		h.samples = 576
+		h.size = 72000*h.bitrate/h.sampleRate + h.padding
+		h.sideInfoSize = 17
+		if h.channels == 1 {
+			h.sideInfoSize = 9
+		}
+	}
+
+	return h, true
+}
+
+// compatible reports whether two headers can belong to the same stream
+func (h *mp3FrameHeader) compatible(other *mp3FrameHeader) bool {
+	return h.version == other.version && h.layer == other.layer && h.rateIndex == other.rateIndex
+}
+
+func (h *mp3FrameHeader) lsf() bool {
+	return h.version != MPEG_1
+}
+
+func (h *mp3FrameHeader) granules() int {
+	if h.lsf() {
+		return 1
+	}
+	return 2
+}
+
+// bandIndex picks the scalefactor band table for the header's sample rate
+func (h *mp3FrameHeader) bandIndex() int {
+	switch h.version {
+	case MPEG_1:
+		return h.rateIndex
+	case MPEG_2:
+		return 3 + h.rateIndex
+	default:
+		return 6 + h.rateIndex
+	}
+}
+
+// mainDataOffset is where side information ends within a frame
+func (h *mp3FrameHeader) mainDataOffset() int {
+	offset := 4 + h.sideInfoSize
+	if h.crc {
+		offset += 2
+	}
+	return offset
+}
+
+// mp3FrameReader pulls whole frames out of a file, resynchronising past
+// junk between frames
+type mp3FrameReader struct {
+	file io.ReadSeeker
+	buf  *bufio.Reader
+	pos  int64
+	end  int64
+
+	ref    *mp3FrameHeader
+	synced bool
+}
+
+func newMP3FrameReader(file io.ReadSeeker, start, end int64) (*mp3FrameReader, error) {
+	r := &mp3FrameReader{file: file, end: end}
+	r.buf = bufio.NewReaderSize(file, 8192)
+	return r, r.seekTo(start)
+}
+
+func (r *mp3FrameReader) seekTo(offset int64) error {
+	_, err := r.file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	r.buf.Reset(r.file)
+	r.pos = offset
+	r.synced = false
+	return nil
+}
+
+func (r *mp3FrameReader) next() (h mp3FrameHeader, frame []byte, offset int64, err error) {
+	for {
+		if r.pos+4 > r.end {
+			return h, nil, 0, io.EOF
+		}
+
+		b, err := r.buf.Peek(4)
+		if err != nil {
+			return h, nil, 0, io.EOF
+		}
+
+		h, ok := parseMP3Header(b)
+		if ok && r.ref != nil && !h.compatible(r.ref) {
+			ok = false
+		}
+		if ok && !r.synced && r.pos+int64(h.size)+4 <= r.end {
+			// confirm a fresh sync with the header that should follow
+			next, err := r.buf.Peek(h.size + 4)
+			if err == nil {
+				following, valid := parseMP3Header(next[h.size:])
+				ok = valid && following.compatible(&h)
+			}
+		}
+
+		if !ok {
+			r.buf.Discard(1)
+			r.pos++
+			r.synced = false
+			continue
+		}
+
+		if r.pos+int64(h.size) > r.end {
+			return h, nil, 0, io.EOF
+		}
+
+		frame = make([]byte, h.size)
+		if _, err := io.ReadFull(r.buf, frame); err != nil {
+			return h, nil, 0, io.EOF
+		}
+
+		offset = r.pos
+		r.pos += int64(h.size)
+		r.synced = true
+		return h, frame, offset, nil
+	}
+}
+
+type mp3GranuleInfo struct {
+	part23Length     int
+	bigValues        int
+	globalGain       int
+	scalefacCompress int
+	windowSwitching  bool
+	blockType        int
+	mixedBlock       bool
+	tableSelect      [3]int
+	subblockGain     [3]int
+	region0Count     int
+	region1Count     int
+	preflag          int
+	scalefacScale    int
+	count1Table      int
+}
+
+type mp3SideInfo struct {
+	mainDataBegin int
+	scfsi         [2][4]bool
+	granules      [2][2]mp3GranuleInfo
+}
+
+// mp3Channel holds the per-channel state of the decoder
+type mp3Channel struct {
+	scalefacL [22]int
+	scalefacS [13][3]int
+
+	// MPEG-2 intensity stereo positions that mark a band as not intensity coded
+	illegalL [22]bool
+	illegalS [13][3]bool
+
+	values [MP3_GRANULE_SAMPLES]int
+	xr     [MP3_GRANULE_SAMPLES]float64
+
+	overlap [32][18]float64
+	synthV  [1024]float64
+}
+
+type mp3Decoder struct {
+	file   *os.File
+	reader *mp3FrameReader
+
+	first    mp3FrameHeader
+	channels int
+
+	audioStart int64
+	audioEnd   int64
+
+	// offsets of every audio frame, built on the first seek
+	frameOffsets []int64
+	frameIdx     int64
+
+	// total audio frames from a Xing or VBRI header, 0 if unknown
+	totalFrames int64
+	toc         []byte
+
+	// gapless playback, in samples
+	skip   int64
+	length int64 // -1 if unknown
+
+	reservoir []byte
+	state     [2]mp3Channel
+
+	meta Metadata
+}
+
+func openMP3(path string) (*mp3Decoder, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := &mp3Decoder{file: file, length: -1}
+	err = dec.readHeader(path)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return dec, nil
+}
+
+func (dec *mp3Decoder) readHeader(path string) error {
+	dec.meta = *NewMetadata()
+	dec.meta.Filepath = path
+
+	end, err := dec.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	// tags at either end of the file
+	if _, err := dec.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	header := make([]byte, ID3V2_HEADER_SIZE)
+	var tag *id3Tag
+	if _, err := io.ReadFull(dec.file, header); err == nil {
+		dec.audioStart = id3v2Size(header)
+		if dec.audioStart > 0 {
+			dec.file.Seek(0, io.SeekStart)
+			tag, _ = readID3v2(dec.file)
+		}
+	}
+
+	dec.audioEnd = end
+	v1, _ := readID3v1(dec.file)
+	if v1 != nil {
+		dec.audioEnd -= ID3V1_SIZE
+		if tag == nil {
+			tag = v1
+		}
+	}
+
+	// find the first frame
+	dec.reader, err = newMP3FrameReader(dec.file, dec.audioStart, dec.audioEnd)
+	if err != nil {
+		return err
+	}
+	h, frame, offset, err := dec.reader.next()
+	if err != nil {
+		return ErrNotMP3
+	}
+	dec.first = h
+	dec.channels = h.channels
+	dec.reader.ref = &dec.first
+	dec.audioStart = offset
+
+	// an info frame carries no audio, skip past it
+	if dec.parseInfoFrame(&h, frame) {
+		dec.audioStart += int64(h.size)
+	}
+
+	streamDuration := uint64(0)
+	if dec.length >= 0 {
+		streamDuration = uint64(dec.length * SECOND / int64(h.sampleRate))
+	} else if dec.totalFrames > 0 {
+		streamDuration = uint64(dec.totalFrames * int64(h.samples) * SECOND / int64(h.sampleRate))
+	} else {
+		// assume a constant bitrate
+		streamDuration = uint64((dec.audioEnd - dec.audioStart) * 8 * SECOND / int64(h.bitrate*1000))
+	}
+	dec.meta.Duration = streamDuration
+
+	if tag != nil {
+		tag.apply(&dec.meta)
+	}
+
+	return dec.reader.seekTo(dec.audioStart)
+}
+
+// parseInfoFrame reads Xing/Info, LAME and VBRI headers out of the first
+// frame, returning whether the frame is an info frame
+func (dec *mp3Decoder) parseInfoFrame(h *mp3FrameHeader, frame []byte) bool {
+	xing := frame[h.mainDataOffset():]
+	if len(xing) >= 8 && (string(xing[:4]) == "Xing" || string(xing[:4]) == "Info") {
+		flags := binary.BigEndian.Uint32(xing[4:])
+		pos := 8
+		if flags&XING_FLAG_FRAMES != 0 && pos+4 <= len(xing) {
+			dec.totalFrames = int64(binary.BigEndian.Uint32(xing[pos:]))
+			pos += 4
+		}
+		if flags&XING_FLAG_BYTES != 0 {
+			pos += 4
+		}
+		if flags&XING_FLAG_TOC != 0 && pos+100 <= len(xing) {
+			dec.toc = append([]byte(nil), xing[pos:pos+100]...)
+			pos += 100
+		}
+		if flags&XING_FLAG_QUALITY != 0 {
+			pos += 4
+		}
+
+		// LAME extension with encoder delay and padding
+		if pos+24 <= len(xing) && dec.totalFrames > 0 {
+			lame := xing[pos:]
+			switch string(lame[:4]) {
+			case "LAME", "Lavf", "Lavc":
+				delay := int64(lame[21])<<4 | int64(lame[22])>>4
+				padding := int64(lame[22]&0x0F)<<8 | int64(lame[23])
+				dec.skip = delay + MP3_DECODER_DELAY
+				dec.length = dec.totalFrames*int64(h.samples) - delay - padding
+				if dec.length < 0 {
+					dec.length = 0
+				}
+			}
+		}
+		return true
+	}
+
+	vbri := frame[min(36, len(frame)):]
+	if len(vbri) >= 26 && string(vbri[:4]) == "VBRI" {
+		dec.totalFrames = int64(binary.BigEndian.Uint32(vbri[14:]))
+		return true
+	}
+
+	return false
+}
+
+func (dec *mp3Decoder) nativeFormat() *PCMWaveFormat {
+	return &PCMWaveFormat{
+		NumChannels: uint16(dec.channels),
+		SampleRate:  uint32(dec.first.sampleRate),
+		SampleDepth: 32,
+		PCMType:     PCM_TYPE_FLOAT,
+	}
+}
+
+func (dec *mp3Decoder) metadata() Metadata {
+	return dec.meta
+}
+
+func (dec *mp3Decoder) close() error {
+	return dec.file.Close()
+}
+
+func (dec *mp3Decoder) decode() ([]float64, int64, error) {
+	for {
+		h, frame, _, err := dec.reader.next()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		samples := dec.decodeFrame(&h, frame)
+		start := dec.frameIdx*int64(dec.first.samples) - dec.skip
+		dec.frameIdx++
+
+		// trim encoder delay and padding
+		frames := int64(len(samples) / dec.channels)
+		if start < 0 {
+			cut := min(-start, frames)
+			samples = samples[cut*int64(dec.channels):]
+			frames -= cut
+			start += cut
+		}
+		if dec.length >= 0 && start+frames > dec.length {
+			if start >= dec.length {
+				return nil, 0, io.EOF
+			}
+			samples = samples[:(dec.length-start)*int64(dec.channels)]
+		}
+
+		if len(samples) > 0 {
+			return samples, start, nil
+		}
+	}
+}
+
+func (dec *mp3Decoder) seek(frame int64) error {
+	if dec.frameOffsets == nil {
+		err := dec.buildIndex()
+		if err != nil {
+			return err
+		}
+	}
+
+	target := (frame + dec.skip) / int64(dec.first.samples)
+	// decode two granules early so the overlap and filterbank are primed
+	start := max(target-int64(2/dec.first.granules()), 0)
+	prime := max(start-MP3_RESERVOIR_FRAMES, 0)
+
+	dec.reservoir = dec.reservoir[:0]
+	dec.state = [2]mp3Channel{}
+
+	if start >= int64(len(dec.frameOffsets)) {
+		dec.frameIdx = int64(len(dec.frameOffsets))
+		return dec.reader.seekTo(dec.audioEnd)
+	}
+
+	err := dec.reader.seekTo(dec.frameOffsets[prime])
+	if err != nil {
+		return err
+	}
+
+	// refill the bit reservoir without decoding
+	for i := prime; i < start; i++ {
+		h, frame, _, err := dec.reader.next()
+		if err != nil {
+			break
+		}
+		dec.storeMainData(frame[min(h.mainDataOffset(), len(frame)):])
+	}
+
+	dec.frameIdx = start
+	return dec.reader.seekTo(dec.frameOffsets[start])
+}
+
+// buildIndex scans the file once for frame offsets so seeks can land on an
+// exact frame. If no frames are found the Xing table of contents is used to
+// approximate them.
+func (dec *mp3Decoder) buildIndex() error {
+	reader, err := newMP3FrameReader(dec.file, dec.audioStart, dec.audioEnd)
+	if err != nil {
+		return err
+	}
+	reader.ref = &dec.first
+
+	dec.frameOffsets = make([]int64, 0, dec.totalFrames)
+	for {
+		_, _, offset, err := reader.next()
+		if err != nil {
+			break
+		}
+		dec.frameOffsets = append(dec.frameOffsets, offset)
+	}
+
+	if len(dec.frameOffsets) == 0 && dec.toc != nil && dec.totalFrames > 0 {
+		size := dec.audioEnd - dec.audioStart
+		for i := int64(0); i < dec.totalFrames; i++ {
+			percent := min(i*100/dec.totalFrames, 99)
+			dec.frameOffsets = append(dec.frameOffsets, dec.audioStart+int64(dec.toc[percent])*size/256)
+		}
+	}
+
+	return nil
+}
+
+func (dec *mp3Decoder) storeMainData(data []byte) {
+	dec.reservoir = append(dec.reservoir, data...)
+	if len(dec.reservoir) > 4096 {
+		dec.reservoir = append(dec.reservoir[:0], dec.reservoir[len(dec.reservoir)-4096:]...)
+	}
+}
+
+// decodeFrame decodes one frame into interleaved samples. Frames whose bit
+// reservoir is unavailable decode to silence.
+func (dec *mp3Decoder) decodeFrame(h *mp3FrameHeader, frame []byte) []float64 {
+	out := make([]float64, h.samples*dec.channels)
+
+	offset := h.mainDataOffset()
+	if offset > len(frame) {
+		return out
+	}
+
+	side := readMP3SideInfo(h, frame[offset-h.sideInfoSize:offset])
+	mainData := frame[offset:]
+
+	if side.mainDataBegin > len(dec.reservoir) {
+		dec.storeMainData(mainData)
+		return out
+	}
+	data := make([]byte, 0, side.mainDataBegin+len(mainData))
+	data = append(data, dec.reservoir[len(dec.reservoir)-side.mainDataBegin:]...)
+	data = append(data, mainData...)
+	dec.storeMainData(mainData)
+
+	br := newBitReader(data)
+	bands := h.bandIndex()
+	pcm := make([]float64, MP3_GRANULE_SAMPLES)
+
+	for gr := 0; gr < h.granules(); gr++ {
+		for ch := 0; ch < h.channels; ch++ {
+			gi := &side.granules[gr][ch]
+			part2Start := br.pos
+
+			if h.lsf() {
+				dec.readLSFScalefactors(br, h, gi, ch)
+			} else {
+				dec.readScalefactors(br, gi, ch, gr, side.scfsi[ch])
+			}
+			dec.readHuffman(br, gi, ch, bands, part2Start+gi.part23Length)
+			br.pos = part2Start + gi.part23Length
+
+			dec.requantize(gi, ch, bands)
+		}
+
+		if h.mode == MPEG_MODE_JOINT_STEREO && h.channels == 2 {
+			dec.stereo(h, &side.granules[gr][1], bands)
+		}
+
+		for ch := 0; ch < h.channels; ch++ {
+			gi := &side.granules[gr][ch]
+			st := &dec.state[ch]
+
+			if gi.windowSwitching && gi.blockType == 2 {
+				reorderMP3(st, gi, bands)
+			}
+			antialiasMP3(st, gi)
+			hybridSynthesisMP3(st, gi)
+			synthesizeMP3(st, pcm)
+
+			dec.writeGranule(out, pcm, gr, ch, h.channels)
+		}
+	}
+
+	return out
+}
+
+// writeGranule interleaves one channel of a granule into out, adapting
+// frames whose channel count differs from the stream's
+func (dec *mp3Decoder) writeGranule(out []float64, pcm []float64, gr int, ch int, frameChannels int) {
+	base := gr * MP3_GRANULE_SAMPLES * dec.channels
+	for i, v := range pcm {
+		switch {
+		case frameChannels == dec.channels:
+			out[base+i*dec.channels+ch] = v
+		case dec.channels == 2:
+			out[base+i*2] = v
+			out[base+i*2+1] = v
+		default:
+			out[base+i] += v / 2
+		}
+	}
+}
+
+func readMP3SideInfo(h *mp3FrameHeader, data []byte) *mp3SideInfo {
+	br := newBitReader(data)
+	side := &mp3SideInfo{}
+
+	if h.lsf() {
+		side.mainDataBegin = int(br.readBits(8))
+		br.skipBits(h.channels) // private bits
+	} else {
+		side.mainDataBegin = int(br.readBits(9))
+		if h.channels == 1 {
+			br.skipBits(5)
+		} else {
+			br.skipBits(3)
+		}
+		for ch := 0; ch < h.channels; ch++ {
+			for band := 0; band < 4; band++ {
+				side.scfsi[ch][band] = br.readBit()
+			}
+		}
+	}
+
+	for gr := 0; gr < h.granules(); gr++ {
+		for ch := 0; ch < h.channels; ch++ {
+			gi := &side.granules[gr][ch]
+			gi.part23Length = int(br.readBits(12))
+			gi.bigValues = int(br.readBits(9))
+			gi.globalGain = int(br.readBits(8))
+			if h.lsf() {
+				gi.scalefacCompress = int(br.readBits(9))
+			} else {
+				gi.scalefacCompress = int(br.readBits(4))
+			}
+
+			gi.windowSwitching = br.readBit()
+			if gi.windowSwitching {
+				gi.blockType = int(br.readBits(2))
+				gi.mixedBlock = br.readBit()
+				for i := 0; i < 2; i++ {
+					gi.tableSelect[i] = int(br.readBits(5))
+				}
+				for i := 0; i < 3; i++ {
+					gi.subblockGain[i] = int(br.readBits(3))
+				}
+
+				gi.region0Count = 7
+				if gi.blockType == 2 && !gi.mixedBlock {
+					gi.region0Count = 8
+				}
+				gi.region1Count = 20 - gi.region0Count
+			} else {
+				for i := 0; i < 3; i++ {
+					gi.tableSelect[i] = int(br.readBits(5))
+				}
+				gi.region0Count = int(br.readBits(4))
+				gi.region1Count = int(br.readBits(3))
+			}
+
+			if !h.lsf() {
+				gi.preflag = int(br.readBits(1))
+			}
+			gi.scalefacScale = int(br.readBits(1))
+			gi.count1Table = int(br.readBits(1))
+		}
+	}
+
+	return side
+}
+
+func (dec *mp3Decoder) readScalefactors(br *bitReader, gi *mp3GranuleInfo, ch int, gr int, scfsi [4]bool) {
+	st := &dec.state[ch]
+	slen1 := int(mp3Slen[0][gi.scalefacCompress])
+	slen2 := int(mp3Slen[1][gi.scalefacCompress])
+
+	if gi.windowSwitching && gi.blockType == 2 {
+		startShort := 0
+		if gi.mixedBlock {
+			for sfb := 0; sfb < 8; sfb++ {
+				st.scalefacL[sfb] = int(br.readBits(slen1))
+			}
+			startShort = 3
+		}
+		for sfb := startShort; sfb < 12; sfb++ {
+			slen := slen1
+			if sfb >= 6 {
+				slen = slen2
+			}
+			for w := 0; w < 3; w++ {
+				st.scalefacS[sfb][w] = int(br.readBits(slen))
+			}
+		}
+		st.scalefacS[12] = [3]int{}
+		return
+	}
+
+	// the second granule may reuse groups of the first's scalefactors
+	groups := [5]int{0, 6, 11, 16, 21}
+	for g := 0; g < 4; g++ {
+		if gr == 1 && scfsi[g] {
+			continue
+		}
+		slen := slen1
+		if g >= 2 {
+			slen = slen2
+		}
+		for sfb := groups[g]; sfb < groups[g+1]; sfb++ {
+			st.scalefacL[sfb] = int(br.readBits(slen))
+		}
+	}
+	st.scalefacL[21] = 0
+}
+
+func (dec *mp3Decoder) readLSFScalefactors(br *bitReader, h *mp3FrameHeader, gi *mp3GranuleInfo, ch int) {
+	st := &dec.state[ch]
+
+	var slen [4]int
+	var table int
+	intensityRight := ch == 1 && h.mode == MPEG_MODE_JOINT_STEREO && h.modeExt&1 != 0
+
+	if !intensityRight {
+		sfc := gi.scalefacCompress
+		switch {
+		case sfc < 400:
+			slen = [4]int{(sfc >> 4) / 5, (sfc >> 4) % 5, (sfc & 15) >> 2, sfc & 3}
+			table = 0
+		case sfc < 500:
+			sfc -= 400
+			slen = [4]int{(sfc >> 2) / 5, (sfc >> 2) % 5, sfc & 3, 0}
+			table = 1
+		default:
+			sfc -= 500
+			slen = [4]int{sfc / 3, sfc % 3, 0, 0}
+			table = 2
+			gi.preflag = 1
+		}
+	} else {
+		sfc := gi.scalefacCompress >> 1
+		switch {
+		case sfc < 180:
+			slen = [4]int{sfc / 36, (sfc % 36) / 6, (sfc % 36) % 6, 0}
+			table = 3
+		case sfc < 244:
+			sfc -= 180
+			slen = [4]int{(sfc % 64) >> 4, (sfc % 16) >> 2, sfc % 4, 0}
+			table = 4
+		default:
+			sfc -= 244
+			slen = [4]int{sfc / 3, sfc % 3, 0, 0}
+			table = 5
+		}
+	}
+
+	blockKind := 0
+	if gi.windowSwitching && gi.blockType == 2 {
+		blockKind = 1
+		if gi.mixedBlock {
+			blockKind = 2
+		}
+	}
+
+	// read every scalefactor in order, noting the illegal intensity position of each
+	values := make([]int, 0, 39)
+	illegal := make([]bool, 0, 39)
+	for part, count := range mp3LSFBands[table][blockKind] {
+		for i := 0; i < count; i++ {
+			v := int(br.readBits(slen[part]))
+			values = append(values, v)
+			illegal = append(illegal, v == 1<<slen[part]-1)
+		}
+	}
+
+	next := 0
+	take := func() (int, bool) {
+		if next >= len(values) {
+			return 0, false
+		}
+		next++
+		return values[next-1], illegal[next-1]
+	}
+
+	switch blockKind {
+	case 0:
+		for sfb := 0; sfb < 21; sfb++ {
+			st.scalefacL[sfb], st.illegalL[sfb] = take()
+		}
+		st.scalefacL[21], st.illegalL[21] = 0, false
+	default:
+		startShort := 0
+		if blockKind == 2 {
+			for sfb := 0; sfb < 6; sfb++ {
+				st.scalefacL[sfb], st.illegalL[sfb] = take()
+			}
+			startShort = 3
+		}
+		for sfb := startShort; sfb < 12; sfb++ {
+			for w := 0; w < 3; w++ {
+				st.scalefacS[sfb][w], st.illegalS[sfb][w] = take()
+			}
+		}
+		st.scalefacS[12] = [3]int{}
+		st.illegalS[12] = [3]bool{}
+	}
+}
+
+func (dec *mp3Decoder) readHuffman(br *bitReader, gi *mp3GranuleInfo, ch int, bands int, bitEnd int) {
+	st := &dec.state[ch]
+	values := &st.values
+
+	bigEnd := min(gi.bigValues*2, MP3_GRANULE_SAMPLES)
+
+	var region1, region2 int
+	if gi.windowSwitching && gi.blockType == 2 && !gi.mixedBlock {
+		region1 = 3 * mp3BandsShort[bands][3]
+		region2 = MP3_GRANULE_SAMPLES
+	} else {
+		region1 = mp3BandsLong[bands][min(gi.region0Count+1, 22)]
+		region2 = mp3BandsLong[bands][min(gi.region0Count+gi.region1Count+2, 22)]
+	}
+
+	i := 0
+	for ; i < bigEnd; i += 2 {
+		region := 0
+		if i >= region2 {
+			region = 2
+		} else if i >= region1 {
+			region = 1
+		}
+
+		entry := mp3TableLinbits[gi.tableSelect[region]]
+		if entry.table == 0 {
+			values[i], values[i+1] = 0, 0
+			continue
+		}
+
+		code := mp3HuffmanCodes[entry.table]
+		v := mp3Trees[entry.table].decode(br)
+		if v < 0 {
+			break
+		}
+
+		x, y := v/code.size, v%code.size
+		if entry.linbits > 0 && x == 15 {
+			x += int(br.readBits(entry.linbits))
+		}
+		if x != 0 && br.readBit() {
+			x = -x
+		}
+		if entry.linbits > 0 && y == 15 {
+			y += int(br.readBits(entry.linbits))
+		}
+		if y != 0 && br.readBit() {
+			y = -y
+		}
+		values[i], values[i+1] = x, y
+	}
+
+	// count1 region of quadruples
+	for i+4 <= MP3_GRANULE_SAMPLES && br.pos < bitEnd {
+		var v int
+		if gi.count1Table == 0 {
+			v = mp3Count1Tree.decode(br)
+			if v < 0 {
+				break
+			}
+		} else {
+			v = 15 - int(br.readBits(4))
+		}
+
+		quad := [4]int{(v >> 3) & 1, (v >> 2) & 1, (v >> 1) & 1, v & 1}
+		for j := range quad {
+			if quad[j] != 0 && br.readBit() {
+				quad[j] = -1
+			}
+		}
+
+		// an overrunning final quadruple is padding, not data
+		if br.pos > bitEnd {
+			break
+		}
+		copy(values[i:i+4], quad[:])
+		i += 4
+	}
+
+	for ; i < MP3_GRANULE_SAMPLES; i++ {
+		values[i] = 0
+	}
+}
+
+func (dec *mp3Decoder) requantize(gi *mp3GranuleInfo, ch int, bands int) {
+	st := &dec.state[ch]
+	long := mp3BandsLong[bands]
+	short := mp3BandsShort[bands]
+
+	scaleShift := 0.5 * float64(1+gi.scalefacScale)
+	base := 0.25 * float64(gi.globalGain-210)
+
+	dequant := func(i int, exp float64) {
+		v := st.values[i]
+		switch {
+		case v == 0:
+			st.xr[i] = 0
+		case v > 0:
+			st.xr[i] = mp3Pow43[min(v, len(mp3Pow43)-1)] * exp
+		default:
+			st.xr[i] = -mp3Pow43[min(-v, len(mp3Pow43)-1)] * exp
+		}
+	}
+
+	longBands := 22
+	startShort := 13
+	if gi.windowSwitching && gi.blockType == 2 {
+		longBands = 0
+		startShort = 0
+		if gi.mixedBlock {
+			longBands, startShort = 8, 3
+			if bands >= 3 {
+				longBands = 6
+			}
+		}
+	}
+
+	for sfb := 0; sfb < longBands; sfb++ {
+		exp := math.Exp2(base - scaleShift*float64(st.scalefacL[sfb]+gi.preflag*mp3Pretab[sfb]))
+		for i := long[sfb]; i < long[sfb+1]; i++ {
+			dequant(i, exp)
+		}
+	}
+
+	for sfb := startShort; sfb < 13; sfb++ {
+		width := short[sfb+1] - short[sfb]
+		start := 3 * short[sfb]
+		for w := 0; w < 3; w++ {
+			exp := math.Exp2(base - 2*float64(gi.subblockGain[w]) - scaleShift*float64(st.scalefacS[sfb][w]))
+			for i := 0; i < width; i++ {
+				dequant(start+w*width+i, exp)
+			}
+		}
+	}
+}
+
+// mp3StereoBand is a run of lines sharing one intensity position
+type mp3StereoBand struct {
+	start, end int
+	pos        int
+	illegal    bool
+	intensity  bool
+}
+
+// stereo undoes mid/side and intensity stereo coding. It runs before short
+// blocks are reordered, so the lines of each window are still contiguous.
+func (dec *mp3Decoder) stereo(h *mp3FrameHeader, right *mp3GranuleInfo, bands int) {
+	left, rightCh := &dec.state[0], &dec.state[1]
+	ms := h.modeExt&2 != 0
+	intensity := h.modeExt&1 != 0
+
+	if !intensity {
+		if ms {
+			midSide(left.xr[:], rightCh.xr[:])
+		}
+		return
+	}
+
+	long := mp3BandsLong[bands]
+	short := mp3BandsShort[bands]
+	nonzero := func(start, end int) bool {
+		for i := start; i < end; i++ {
+			if rightCh.xr[i] != 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	stereoBands := make([]mp3StereoBand, 0, 40)
+
+	// the final band carries no position of its own and follows its neighbour
+	finalBand := func(prev mp3StereoBand, start, end int) mp3StereoBand {
+		band := mp3StereoBand{start: start, end: end, intensity: prev.intensity}
+		if prev.intensity && !prev.illegal {
+			band.pos = prev.pos
+		} else if !h.lsf() {
+			band.pos = 3
+		}
+		return band
+	}
+
+	if right.windowSwitching && right.blockType == 2 {
+		longBands, startShort := 0, 0
+		if right.mixedBlock {
+			longBands, startShort = 8, 3
+			if h.lsf() {
+				longBands = 6
+			}
+		}
+
+		// highest short band per window holding non-zero values
+		shortTop := [3]int{startShort - 1, startShort - 1, startShort - 1}
+		anyShort := false
+		for w := 0; w < 3; w++ {
+			for sfb := 12; sfb >= startShort; sfb-- {
+				width := short[sfb+1] - short[sfb]
+				start := 3*short[sfb] + w*width
+				if nonzero(start, start+width) {
+					shortTop[w] = sfb
+					anyShort = true
+					break
+				}
+			}
+		}
+
+		longTop := -1
+		for sfb := longBands - 1; sfb >= 0; sfb-- {
+			if nonzero(long[sfb], long[sfb+1]) {
+				longTop = sfb
+				break
+			}
+		}
+
+		for sfb := 0; sfb < longBands; sfb++ {
+			stereoBands = append(stereoBands, mp3StereoBand{
+				start: long[sfb], end: long[sfb+1],
+				pos: rightCh.scalefacL[sfb], illegal: rightCh.illegalL[sfb],
+				intensity: !anyShort && sfb > longTop,
+			})
+		}
+
+		for w := 0; w < 3; w++ {
+			var prev mp3StereoBand
+			for sfb := startShort; sfb < 13; sfb++ {
+				width := short[sfb+1] - short[sfb]
+				start := 3*short[sfb] + w*width
+				band := mp3StereoBand{
+					start: start, end: start + width,
+					pos: rightCh.scalefacS[sfb][w], illegal: rightCh.illegalS[sfb][w],
+					intensity: sfb > shortTop[w],
+				}
+				if sfb == 12 {
+					band = finalBand(prev, start, start+width)
+				}
+				stereoBands = append(stereoBands, band)
+				prev = band
+			}
+		}
+	} else {
+		top := -1
+		for sfb := 21; sfb >= 0; sfb-- {
+			if nonzero(long[sfb], long[sfb+1]) {
+				top = sfb
+				break
+			}
+		}
+
+		var prev mp3StereoBand
+		for sfb := 0; sfb < 22; sfb++ {
+			band := mp3StereoBand{
+				start: long[sfb], end: long[sfb+1],
+				pos: rightCh.scalefacL[sfb], illegal: rightCh.illegalL[sfb],
+				intensity: sfb > top,
+			}
+			if sfb == 21 {
+				band = finalBand(prev, long[sfb], long[sfb+1])
+			}
+			stereoBands = append(stereoBands, band)
+			prev = band
+		}
+	}
+
+	// MPEG-2 intensity scale comes from the right channel's scalefac_compress
+	isScale := math.Pow(2, -0.25)
+	if right.scalefacCompress&1 == 1 {
+		isScale = math.Sqrt2 / 2
+	}
+
+	for _, band := range stereoBands {
+		l := left.xr[band.start:band.end]
+		r := rightCh.xr[band.start:band.end]
+
+		if !h.lsf() && band.pos >= 7 {
+			band.illegal = true
+		}
+
+		if !band.intensity || band.illegal {
+			if ms {
+				midSide(l, r)
+			}
+			continue
+		}
+
+		var kl, kr float64
+		if h.lsf() {
+			kl, kr = 1, 1
+			if band.pos&1 == 1 {
+				kl = math.Pow(isScale, float64(band.pos+1)/2)
+			} else if band.pos != 0 {
+				kr = math.Pow(isScale, float64(band.pos)/2)
+			}
+		} else {
+			kl, kr = mp3IntensityRatios[band.pos], mp3IntensityRatios[6-band.pos]
+		}
+
+		for i := range l {
+			r[i] = l[i] * kr
+			l[i] = l[i] * kl
+		}
+	}
+}
+
+func midSide(l, r []float64) {
+	for i := range l {
+		m, s := l[i], r[i]
+		l[i] = (m + s) * math.Sqrt2 / 2
+		r[i] = (m - s) * math.Sqrt2 / 2
+	}
+}
+
+// reorderMP3 interleaves the three windows of each short band so every
+// subband holds its 18 lines window by window
+func reorderMP3(st *mp3Channel, gi *mp3GranuleInfo, bands int) {
+	short := mp3BandsShort[bands]
+	startShort := 0
+	if gi.mixedBlock {
+		startShort = 3
+	}
+
+	var tmp [MP3_GRANULE_SAMPLES]float64
+	for sfb := startShort; sfb < 13; sfb++ {
+		width := short[sfb+1] - short[sfb]
+		start := 3 * short[sfb]
+		for w := 0; w < 3; w++ {
+			for i := 0; i < width; i++ {
+				tmp[start+3*i+w] = st.xr[start+w*width+i]
+			}
+		}
+	}
+
+	start := 3 * short[startShort]
+	copy(st.xr[start:], tmp[start:])
+}
+
+func antialiasMP3(st *mp3Channel, gi *mp3GranuleInfo) {
+	limit := 32
+	if gi.windowSwitching && gi.blockType == 2 {
+		if !gi.mixedBlock {
+			return
+		}
+		limit = 2
+	}
+
+	for sb := 1; sb < limit; sb++ {
+		for i := 0; i < 8; i++ {
+			lo := 18*sb - 1 - i
+			hi := 18*sb + i
+			a, b := st.xr[lo], st.xr[hi]
+			st.xr[lo] = a*mp3AliasCS[i] - b*mp3AliasCA[i]
+			st.xr[hi] = b*mp3AliasCS[i] + a*mp3AliasCA[i]
+		}
+	}
+}
+
+// hybridSynthesisMP3 runs the IMDCT over each subband, overlapping with the
+// previous granule, and leaves time samples in xr
+func hybridSynthesisMP3(st *mp3Channel, gi *mp3GranuleInfo) {
+	var raw [36]float64
+
+	for sb := 0; sb < 32; sb++ {
+		in := st.xr[sb*18 : sb*18+18]
+
+		blockType := 0
+		if gi.windowSwitching {
+			blockType = gi.blockType
+			if gi.mixedBlock && sb < 2 {
+				blockType = 0
+			}
+		}
+
+		if blockType == 2 {
+			raw = [36]float64{}
+			for w := 0; w < 3; w++ {
+				for i := 0; i < 12; i++ {
+					sum := 0.0
+					for k := 0; k < 6; k++ {
+						sum += in[3*k+w] * mp3IMDCTShort[i][k]
+					}
+					raw[6+6*w+i] += sum * mp3Windows[2][i]
+				}
+			}
+		} else {
+			for i := 0; i < 36; i++ {
+				sum := 0.0
+				for k := 0; k < 18; k++ {
+					sum += in[k] * mp3IMDCTLong[i][k]
+				}
+				raw[i] = sum * mp3Windows[blockType][i]
+			}
+		}
+
+		for i := 0; i < 18; i++ {
+			in[i] = raw[i] + st.overlap[sb][i]
+			st.overlap[sb][i] = raw[i+18]
+		}
+
+		// frequency inversion of odd subbands
+		if sb&1 == 1 {
+			for i := 1; i < 18; i += 2 {
+				in[i] = -in[i]
+			}
+		}
+	}
+}
+
+// synthesizeMP3 runs the polyphase filterbank over the 18 time slots of a
+// granule, writing 576 samples to pcm
+func synthesizeMP3(st *mp3Channel, pcm []float64) {
+	var s [32]float64
+	v := &st.synthV
+
+	for t := 0; t < 18; t++ {
+		for sb := 0; sb < 32; sb++ {
+			s[sb] = st.xr[sb*18+t]
+		}
+
+		copy(v[64:], v[:960])
+		for i := 0; i < 64; i++ {
+			sum := 0.0
+			row := &mp3SynthMatrix[i]
+			for k := 0; k < 32; k++ {
+				sum += row[k] * s[k]
+			}
+			v[i] = sum
+		}
+
+		for j := 0; j < 32; j++ {
+			sum := 0.0
+			for i := 0; i < 8; i++ {
+				sum += v[i*128+j] * float64(mp3SynthWindow[i*64+j])
+				sum += v[i*128+96+j] * float64(mp3SynthWindow[i*64+32+j])
+			}
+			pcm[t*32+j] = sum / 65536
+		}
+	}
+}
+
+func createMP3AudioSourceFromFile(metadata *Metadata) (AudioSource, error) {
+	dec, err := openMP3(metadata.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDecodedSource(dec), nil
+}
+
+func getMP3FileMetadata(path string) (*Metadata, error) {
+	dec, err := openMP3(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.file.Close()
+
+	metadata := dec.metadata()
+	return &metadata, nil
+}
@@ -0,0 +1,150 @@
+package audio
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	testMP3FrameSize = 417 // MPEG-1 Layer III at 128 kbit/s and 44.1 kHz, unpadded
+	testMP3Delay     = 576
+	testMP3Padding   = 1000
+)
+
+// mp3Frame builds a mono 128 kbit/s frame. A tone frame codes a single line
+// of the spectrum in both granules, a steady tone at 44/1152 of the rate.
+func mp3Frame(tone bool) []byte {
+	frame := make([]byte, testMP3FrameSize)
+	copy(frame, []byte{0xFF, 0xFB, 0x90, 0xC0})
+
+	side := &bitWriter{}
+	side.writeBits(0, 9+5+4) // main_data_begin, private bits and scfsi
+	for gr := 0; gr < 2; gr++ {
+		if !tone {
+			side.writeBits(0, 59)
+			continue
+		}
+		side.writeBits(3, 12)    // part2_3_length
+		side.writeBits(23, 9)    // big_values, lines 0 to 45
+		side.writeBits(200, 8)   // global_gain
+		side.writeBits(0, 4+1)   // scalefac_compress, window_switching
+		side.writeBits(0, 5)     // region 0 is lines 0 to 43, all zero
+		side.writeBits(1, 5)     // region 1 codes with table 1
+		side.writeBits(1, 5)     // region 2
+		side.writeBits(8, 4)     // region0_count
+		side.writeBits(7, 3)     // region1_count
+		side.writeBits(0, 1+1+1) // preflag, scalefac_scale, count1table
+	}
+	copy(frame[4:], side.data)
+
+	if tone {
+		data := &bitWriter{}
+		for gr := 0; gr < 2; gr++ {
+			data.writeBits(1, 2) // lines 44 and 45 are 1 and 0
+			data.writeBits(0, 1) // positive
+		}
+		copy(frame[21:], data.data)
+	}
+	return frame
+}
+
+// mp3InfoFrame builds a Xing frame counting frames of audio, with a LAME
+// extension giving the encoder delay and padding if lame is set
+func mp3InfoFrame(frames int, lame bool) []byte {
+	frame := mp3Frame(false)
+	xing := frame[21:]
+	copy(xing, "Xing")
+	xing[7] = XING_FLAG_FRAMES
+	xing[8], xing[9], xing[10], xing[11] = byte(frames>>24), byte(frames>>16), byte(frames>>8), byte(frames)
+	if lame {
+		copy(xing[12:], "LAME3.100")
+		ext := xing[12:]
+		ext[21] = byte(testMP3Delay >> 4)
+		ext[22] = byte(testMP3Delay&0xF<<4 | testMP3Padding>>8)
+		ext[23] = byte(testMP3Padding & 0xFF)
+	}
+	return frame
+}
+
+func writeMP3(t *testing.T, path string, info []byte, frames int, tone bool) {
+	t.Helper()
+	out := info
+	for i := 0; i < frames; i++ {
+		out = append(out, mp3Frame(tone)...)
+	}
+	if err := os.WriteFile(path, out, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMP3(t *testing.T) {
+	dir := t.TempDir()
+	length := int64(20*1152 - testMP3Delay - testMP3Padding)
+
+	for _, tone := range []bool{false, true} {
+		path := filepath.Join(dir, "a.mp3")
+		writeMP3(t, path, mp3InfoFrame(20, true), 20, tone)
+		dec, err := openMP3(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkFormat(t, dec, 1, 44100, length)
+
+		// the encoder delay and padding are trimmed off
+		all := decodeAll(t, dec)
+		if int64(len(all)) != length {
+			t.Fatalf("decoded %d samples, expected %d", len(all), length)
+		}
+		if !tone {
+			checkSamples(t, "silence", all, make([]float64, len(all)), 0)
+			dec.close()
+			continue
+		}
+
+		// past the start the tone is steady, and holds nothing else
+		freq := 44.0 / 1152
+		var sin, cos, energy float64
+		for i, v := range all[4000:12000] {
+			phase := 2 * math.Pi * freq * float64(i)
+			sin += v * math.Sin(phase)
+			cos += v * math.Cos(phase)
+			energy += v * v
+		}
+		tonal := 2 * (sin*sin + cos*cos) / 8000
+		if energy == 0 || tonal < 0.95*energy {
+			t.Fatalf("%.4g of %.4g energy in the tone", tonal, energy)
+		}
+
+		checkSeek(t, dec, all, 1e-9, 0, 3000, 10000, length-1)
+		dec.close()
+	}
+}
+
+// the duration comes from the LAME tag's exact length, then the Xing frame
+// count, and only then from the bitrate
+func TestMP3Duration(t *testing.T) {
+	dir := t.TempDir()
+	for _, test := range []struct {
+		name string
+		info []byte
+		want int64
+	}{
+		{"lame", mp3InfoFrame(20, true), int64(20*1152-testMP3Delay-testMP3Padding) * SECOND / 44100},
+		{"xing", mp3InfoFrame(20, false), int64(20*1152) * SECOND / 44100},
+		{"bitrate", nil, int64(30*testMP3FrameSize*8) * SECOND / 128000},
+	} {
+		// 30 frames follow whatever the info frame claims
+		path := filepath.Join(dir, test.name+".mp3")
+		writeMP3(t, path, test.info, 30, false)
+		dec, err := openMP3(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := int64(dec.metadata().Duration); got != test.want {
+			t.Errorf("%s: duration %d, expected %d", test.name, got, test.want)
+		}
+		dec.close()
+	}
+}
@@ -0,0 +1,767 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// objectTypeIndication values of an esds decoder config that carry AAC
+	MP4_OBJECT_MPEG4_AUDIO    = 0x40
+	MP4_OBJECT_MPEG2_AAC_MAIN = 0x66
+	MP4_OBJECT_MPEG2_AAC_LC   = 0x67
+
+	MP4_DESCRIPTOR_ES             = 0x03
+	MP4_DESCRIPTOR_DECODER_CONFIG = 0x04
+	MP4_DESCRIPTOR_DECODER_INFO   = 0x05
+
+	// well-known types of an ilst data atom
+	MP4_DATA_JPEG = 13
+	MP4_DATA_PNG  = 14
+	MP4_DATA_BMP  = 27
+)
+
+var (
+	ErrNotMP4 = errors.New("no audio track found in MP4 file")
+	errMP4Box = errors.New("malformed MP4 box")
+)
+
+var (
+	// mp4ChannelOrder maps the channel order of ALAC and of the AAC channel
+	// configurations to WAVE order: wave channel i takes channel order[n-1][i]
+	mp4ChannelOrder = [8][]int{
+		{0},
+		{0, 1},
+		{1, 2, 0},
+		{1, 2, 0, 3},
+		{1, 2, 0, 3, 4},
+		{1, 2, 0, 5, 3, 4},
+		{1, 2, 0, 6, 5, 3, 4},
+		{3, 4, 0, 7, 5, 6, 1, 2},
+	}
+)
+
+func init() {
+	provider := &AudioSourceProvider{createMP4AudioSourceFromFile, getMP4FileMetadata}
+	RegisterAudioSourceProvider(".m4a", provider)
+	RegisterAudioSourceProvider(".mp4", provider)
+	RegisterAudioSourceProvider(".alac", provider)
+}
+
+// mp4Box is a box held in memory, as found inside the moov box
+type mp4Box struct {
+	kind string
+	body []byte
+}
+
+// readMP4Boxes splits data into the boxes it holds, stopping on the first
+// malformed header
+func readMP4Boxes(data []byte) []mp4Box {
+	boxes := make([]mp4Box, 0)
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data))
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return boxes
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return boxes
+		}
+
+		boxes = append(boxes, mp4Box{string(data[4:8]), data[header:size]})
+		data = data[size:]
+	}
+	return boxes
+}
+
+// findMP4Box follows a path of box types down from data, returning the body
+// of the first match or nil
+func findMP4Box(data []byte, path ...string) []byte {
+	for _, kind := range path {
+		found := false
+		for _, box := range readMP4Boxes(data) {
+			if box.kind == kind {
+				data = box.body
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+	return data
+}
+
+// mp4Track is an audio track with its sample table expanded
+type mp4Track struct {
+	timescale int64
+
+	// sample entry type and the codec configuration it carries
+	codec      string
+	config     []byte
+	channels   int
+	sampleRate int
+
+	offsets []int64
+	sizes   []uint32
+	// decode time of each sample, plus the end of the last one
+	times []int64
+
+	// media time the edit list starts playback at, and how much it plays,
+	// -1 for all of it
+	editStart    int64
+	editDuration int64
+}
+
+// readMP4Track builds the track of a trak box in a file of fileSize bytes,
+// returning nil if it is not an audio track
+func readMP4Track(trak []byte, movieTimescale int64, fileSize int64) (*mp4Track, error) {
+	handler := findMP4Box(trak, "mdia", "hdlr")
+	if len(handler) < 12 || string(handler[8:12]) != "soun" {
+		return nil, nil
+	}
+
+	track := &mp4Track{editDuration: -1}
+
+	mdhd := findMP4Box(trak, "mdia", "mdhd")
+	if len(mdhd) < 24 {
+		return nil, errMP4Box
+	}
+	if mdhd[0] == 1 {
+		if len(mdhd) < 32 {
+			return nil, errMP4Box
+		}
+		track.timescale = int64(binary.BigEndian.Uint32(mdhd[20:]))
+	} else {
+		track.timescale = int64(binary.BigEndian.Uint32(mdhd[12:]))
+	}
+	if track.timescale == 0 {
+		return nil, errMP4Box
+	}
+
+	stbl := findMP4Box(trak, "mdia", "minf", "stbl")
+	if stbl == nil {
+		return nil, errMP4Box
+	}
+	err := track.readSampleEntry(findMP4Box(stbl, "stsd"))
+	if err != nil {
+		return nil, err
+	}
+	err = track.readSampleTable(stbl, fileSize)
+	if err != nil {
+		return nil, err
+	}
+
+	track.readEditList(findMP4Box(trak, "edts", "elst"), movieTimescale)
+	return track, nil
+}
+
+func (track *mp4Track) readSampleEntry(stsd []byte) error {
+	if len(stsd) < 8 {
+		return errMP4Box
+	}
+	entries := readMP4Boxes(stsd[8:])
+	if len(entries) == 0 {
+		return errMP4Box
+	}
+
+	// AudioSampleEntry, with the QuickTime extensions of versions 1 and 2
+	entry := entries[0]
+	body := entry.body
+	if len(body) < 28 {
+		return errMP4Box
+	}
+	track.codec = entry.kind
+	track.channels = int(binary.BigEndian.Uint16(body[16:]))
+	track.sampleRate = int(binary.BigEndian.Uint32(body[24:]) >> 16)
+
+	children := body[28:]
+	switch binary.BigEndian.Uint16(body[8:]) {
+	case 1:
+		children = children[min(16, len(children)):]
+	case 2:
+		children = children[min(36, len(children)):]
+	}
+
+	switch track.codec {
+	case "mp4a":
+		esds := findMP4Box(children, "esds")
+		if esds == nil {
+			esds = findMP4Box(children, "wave", "esds")
+		}
+		track.config = parseESDS(esds)
+		if track.config == nil {
+			return ErrUnsupportedFormat
+		}
+	case "alac":
+		cookie := findMP4Box(children, "alac")
+		if cookie == nil {
+			cookie = findMP4Box(children, "wave", "alac")
+		}
+		if len(cookie) < 4+ALAC_CONFIG_SIZE {
+			return ErrUnsupportedFormat
+		}
+		track.config = cookie[4 : 4+ALAC_CONFIG_SIZE]
+	default:
+		return ErrUnsupportedFormat
+	}
+	return nil
+}
+
+// parseESDS returns the AudioSpecificConfig out of an esds box, or nil if it
+// does not describe AAC
+func parseESDS(esds []byte) []byte {
+	if len(esds) < 4 {
+		return nil
+	}
+	data := esds[4:]
+
+	// descriptors nest, each with a tag and a length of up to four bytes
+	next := func(want byte) []byte {
+		if len(data) < 2 || data[0] != want {
+			return nil
+		}
+		size, pos := 0, 1
+		for ; pos < 5 && pos < len(data); pos++ {
+			size = size<<7 | int(data[pos]&0x7F)
+			if data[pos]&0x80 == 0 {
+				break
+			}
+		}
+		pos++
+		if pos+size > len(data) {
+			return nil
+		}
+		return data[pos : pos+size]
+	}
+
+	data = next(MP4_DESCRIPTOR_ES)
+	if len(data) < 3 {
+		return nil
+	}
+	flags := data[2]
+	data = data[3:]
+	if flags&0x80 != 0 {
+		data = data[min(2, len(data)):]
+	}
+	if flags&0x40 != 0 && len(data) > 0 {
+		data = data[min(int(data[0])+1, len(data)):]
+	}
+	if flags&0x20 != 0 {
+		data = data[min(2, len(data)):]
+	}
+
+	data = next(MP4_DESCRIPTOR_DECODER_CONFIG)
+	if len(data) < 13 {
+		return nil
+	}
+	switch data[0] {
+	case MP4_OBJECT_MPEG4_AUDIO, MP4_OBJECT_MPEG2_AAC_MAIN, MP4_OBJECT_MPEG2_AAC_LC:
+	default:
+		return nil
+	}
+	data = data[13:]
+
+	return next(MP4_DESCRIPTOR_DECODER_INFO)
+}
+
+// readSampleTable reads where each sample is in a file of fileSize bytes,
+// and when it plays
+func (track *mp4Track) readSampleTable(stbl []byte, fileSize int64) error {
+	// sample sizes
+	if stsz := findMP4Box(stbl, "stsz"); stsz != nil {
+		if len(stsz) < 12 {
+			return errMP4Box
+		}
+		fixed := binary.BigEndian.Uint32(stsz[4:])
+		count := int(binary.BigEndian.Uint32(stsz[8:]))
+		if fixed == 0 && len(stsz) < 12+4*count {
+			return errMP4Box
+		}
+		// a fixed size lists no samples to check the count against, but
+		// samples past the end of the file could never be read
+		if fixed != 0 {
+			count = int(min(int64(count), fileSize/int64(fixed)))
+		}
+		track.sizes = make([]uint32, count)
+		for i := range track.sizes {
+			if fixed != 0 {
+				track.sizes[i] = fixed
+			} else {
+				track.sizes[i] = binary.BigEndian.Uint32(stsz[12+4*i:])
+			}
+		}
+	} else if stz2 := findMP4Box(stbl, "stz2"); stz2 != nil {
+		if len(stz2) < 12 {
+			return errMP4Box
+		}
+		field := int(stz2[7])
+		count := int(binary.BigEndian.Uint32(stz2[8:]))
+		if (field != 4 && field != 8 && field != 16) || len(stz2) < 12+(count*field+7)/8 {
+			return errMP4Box
+		}
+		br := newBitReader(stz2[12:])
+		track.sizes = make([]uint32, count)
+		for i := range track.sizes {
+			track.sizes[i] = br.readBits(field)
+		}
+	} else {
+		return errMP4Box
+	}
+
+	// decode times
+	stts := findMP4Box(stbl, "stts")
+	if len(stts) < 8 {
+		return errMP4Box
+	}
+	track.times = make([]int64, 1, len(track.sizes)+1)
+	entries := int(binary.BigEndian.Uint32(stts[4:]))
+	for i := 0; i < entries && 16+8*i <= len(stts); i++ {
+		count := int(binary.BigEndian.Uint32(stts[8+8*i:]))
+		delta := int64(binary.BigEndian.Uint32(stts[12+8*i:]))
+		for ; count > 0 && len(track.times) <= len(track.sizes); count-- {
+			track.times = append(track.times, track.times[len(track.times)-1]+delta)
+		}
+	}
+
+	// chunk offsets
+	var chunks []int64
+	if stco := findMP4Box(stbl, "stco"); len(stco) >= 8 {
+		count := int(binary.BigEndian.Uint32(stco[4:]))
+		for i := 0; i < count && 12+4*i <= len(stco); i++ {
+			chunks = append(chunks, int64(binary.BigEndian.Uint32(stco[8+4*i:])))
+		}
+	} else if co64 := findMP4Box(stbl, "co64"); len(co64) >= 8 {
+		count := int(binary.BigEndian.Uint32(co64[4:]))
+		for i := 0; i < count && 16+8*i <= len(co64); i++ {
+			chunks = append(chunks, int64(binary.BigEndian.Uint64(co64[8+8*i:])))
+		}
+	} else {
+		return errMP4Box
+	}
+
+	// samples per chunk, in runs starting at a 1-based chunk index
+	stsc := findMP4Box(stbl, "stsc")
+	if len(stsc) < 8 {
+		return errMP4Box
+	}
+	type run struct{ first, samples int }
+	runs := make([]run, 0)
+	count := int(binary.BigEndian.Uint32(stsc[4:]))
+	for i := 0; i < count && 20+12*i <= len(stsc); i++ {
+		runs = append(runs, run{int(binary.BigEndian.Uint32(stsc[8+12*i:])) - 1, int(binary.BigEndian.Uint32(stsc[12+12*i:]))})
+	}
+
+	track.offsets = make([]int64, 0, len(track.sizes))
+	r := 0
+	for c, offset := range chunks {
+		for r+1 < len(runs) && runs[r+1].first <= c {
+			r++
+		}
+		if len(runs) == 0 {
+			break
+		}
+		for k := 0; k < runs[r].samples && len(track.offsets) < len(track.sizes); k++ {
+			track.offsets = append(track.offsets, offset)
+			offset += int64(track.sizes[len(track.offsets)-1])
+		}
+	}
+
+	// keep the samples every table agrees on
+	n := min(len(track.offsets), len(track.times)-1)
+	track.offsets, track.sizes, track.times = track.offsets[:n], track.sizes[:n], track.times[:n+1]
+	if n == 0 {
+		return ErrNotMP4
+	}
+	return nil
+}
+
+// readEditList picks up the edit trimming encoder delay and padding, as
+// written by iTunes and most AAC encoders
+func (track *mp4Track) readEditList(elst []byte, movieTimescale int64) {
+	if len(elst) < 8 || movieTimescale == 0 {
+		return
+	}
+	version := elst[0]
+	count := int(binary.BigEndian.Uint32(elst[4:]))
+	entry := 12
+	if version == 1 {
+		entry = 20
+	}
+
+	for i := 0; i < count && 8+entry*(i+1) <= len(elst); i++ {
+		e := elst[8+entry*i:]
+		var duration, start int64
+		if version == 1 {
+			duration = int64(binary.BigEndian.Uint64(e))
+			start = int64(binary.BigEndian.Uint64(e[8:]))
+		} else {
+			duration = int64(binary.BigEndian.Uint32(e))
+			start = int64(int32(binary.BigEndian.Uint32(e[4:])))
+		}
+
+		// empty edits only delay the track
+		if start < 0 {
+			continue
+		}
+		track.editStart = start
+		if duration > 0 {
+			track.editDuration = duration * track.timescale / movieTimescale
+		}
+		return
+	}
+}
+
+// mp4Codec decodes the samples of a track into interleaved float samples in
+// WAVE channel order
+type mp4Codec interface {
+	format() *PCMWaveFormat
+	decode(sample []byte) ([]float64, error)
+	reset()
+	// preroll is the number of samples to decode ahead of a seek target
+	// before the output is correct
+	preroll() int
+}
+
+func newMP4Codec(track *mp4Track) (mp4Codec, error) {
+	switch track.codec {
+	case "alac":
+		return newALACDecoder(track.config)
+	case "mp4a":
+		return newAACDecoder(track.config)
+	}
+	return nil, ErrUnsupportedFormat
+}
+
+type mp4Decoder struct {
+	file *os.File
+
+	track  *mp4Track
+	codec  mp4Codec
+	native *PCMWaveFormat
+
+	// next sample of the track to decode
+	sample int
+
+	// output frames dropped from the start for the edit list, and the
+	// frames that play after it
+	skip   int64
+	frames int64
+
+	meta Metadata
+	buf  []byte
+}
+
+func openMP4(path string) (*mp4Decoder, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := &mp4Decoder{file: file}
+	err = dec.readHeader(path)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return dec, nil
+}
+
+func (dec *mp4Decoder) readHeader(path string) error {
+	info, err := dec.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	moov, err := readMP4Movie(dec.file, info.Size())
+	if err != nil {
+		return err
+	}
+
+	movieTimescale := int64(0)
+	if mvhd := findMP4Box(moov, "mvhd"); len(mvhd) >= 20 {
+		if mvhd[0] == 1 {
+			if len(mvhd) >= 24 {
+				movieTimescale = int64(binary.BigEndian.Uint32(mvhd[20:]))
+			}
+		} else {
+			movieTimescale = int64(binary.BigEndian.Uint32(mvhd[12:]))
+		}
+	}
+
+	// play the first audio track we can decode
+	err = ErrNotMP4
+	for _, box := range readMP4Boxes(moov) {
+		if box.kind != "trak" {
+			continue
+		}
+
+		var track *mp4Track
+		track, err = readMP4Track(box.body, movieTimescale, info.Size())
+		if err == nil && track == nil {
+			err = ErrNotMP4
+			continue
+		} else if err != nil {
+			continue
+		}
+
+		dec.codec, err = newMP4Codec(track)
+		if err == nil {
+			dec.track = track
+			break
+		}
+	}
+	if dec.track == nil {
+		return err
+	}
+
+	dec.native = dec.codec.format()
+	dec.meta = *NewMetadata()
+	dec.meta.Filepath = path
+	parseMP4Metadata(moov, &dec.meta)
+
+	// priming and padding from the edit list, falling back on iTunes' tag
+	track := dec.track
+	rate := int64(dec.native.SampleRate)
+	end := track.times[len(track.times)-1]
+	start, duration := track.editStart, track.editDuration
+	if start == 0 && duration < 0 {
+		if priming, samples, ok := parseITunSMPB(moov); ok {
+			start, duration = priming*track.timescale/rate, samples*track.timescale/rate
+		}
+	}
+	if duration < 0 || start+duration > end {
+		duration = max(end-start, 0)
+	}
+
+	dec.skip = start * rate / track.timescale
+	dec.frames = duration * rate / track.timescale
+	dec.meta.Duration = uint64(dec.frames * SECOND / rate)
+	return nil
+}
+
+// readMP4Movie finds the top-level moov box and reads it into memory
+func readMP4Movie(file io.ReadSeeker, end int64) ([]byte, error) {
+	header := make([]byte, 16)
+	pos := int64(0)
+	for pos+8 <= end {
+		if _, err := file.Seek(pos, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(file, header[:8]); err != nil {
+			break
+		}
+
+		size := int64(binary.BigEndian.Uint32(header))
+		headerSize := int64(8)
+		switch size {
+		case 0:
+			size = end - pos
+		case 1:
+			if _, err := io.ReadFull(file, header[8:]); err != nil {
+				return nil, ErrNotMP4
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:]))
+			headerSize = 16
+		}
+		if size < headerSize || pos+size > end {
+			break
+		}
+
+		if string(header[4:8]) == "moov" {
+			moov := make([]byte, size-headerSize)
+			if _, err := io.ReadFull(file, moov); err != nil {
+				return nil, err
+			}
+			return moov, nil
+		}
+		pos += size
+	}
+	return nil, ErrNotMP4
+}
+
+// mp4MetaItems returns the items of the iTunes ilst box
+func mp4MetaItems(moov []byte) []mp4Box {
+	meta := findMP4Box(moov, "udta", "meta")
+	if meta == nil {
+		return nil
+	}
+	// meta is a full box in MP4 but a plain one in QuickTime
+	if len(meta) >= 8 && string(meta[4:8]) != "hdlr" {
+		meta = meta[4:]
+	}
+	return readMP4Boxes(findMP4Box(meta, "ilst"))
+}
+
+// parseMP4Metadata fills metadata from the iTunes tags of the movie
+func parseMP4Metadata(moov []byte, metadata *Metadata) {
+	for _, item := range mp4MetaItems(moov) {
+		data := findMP4Box(item.body, "data")
+		if len(data) < 8 {
+			continue
+		}
+		kind := binary.BigEndian.Uint32(data) & 0xFFFFFF
+		value := data[8:]
+
+		switch item.kind {
+		case "\xa9nam", "\xa9ART", "\xa9alb":
+			text := trimTagString(value)
+			if text == "" {
+				continue
+			}
+			switch item.kind {
+			case "\xa9nam":
+				metadata.Title = text
+			case "\xa9ART":
+				metadata.Artist = text
+			case "\xa9alb":
+				metadata.Album = text
+			}
+		case "covr":
+			if metadata.Cover != nil || len(value) == 0 {
+				continue
+			}
+			art := &Artwork{Data: bytes.Clone(value)}
+			switch {
+			case kind == MP4_DATA_PNG || bytes.HasPrefix(value, []byte("\x89PNG")):
+				art.MIMEType = "image/png"
+			case kind == MP4_DATA_BMP:
+				art.MIMEType = "image/bmp"
+			default:
+				art.MIMEType = "image/jpeg"
+			}
+			metadata.Cover = art
+		}
+	}
+}
+
+// parseITunSMPB reads the encoder delay and the length of the audio out of
+// iTunes' gapless playback tag
+func parseITunSMPB(moov []byte) (int64, int64, bool) {
+	for _, item := range mp4MetaItems(moov) {
+		if item.kind != "----" {
+			continue
+		}
+		name := findMP4Box(item.body, "name")
+		data := findMP4Box(item.body, "data")
+		if len(name) < 4 || string(name[4:]) != "iTunSMPB" || len(data) < 8 {
+			continue
+		}
+
+		fields := strings.Fields(string(data[8:]))
+		if len(fields) < 4 {
+			return 0, 0, false
+		}
+		priming, err1 := strconv.ParseInt(fields[1], 16, 64)
+		samples, err2 := strconv.ParseInt(fields[3], 16, 64)
+		if err1 != nil || err2 != nil || samples == 0 {
+			return 0, 0, false
+		}
+		return priming, samples, true
+	}
+	return 0, 0, false
+}
+
+func (dec *mp4Decoder) nativeFormat() *PCMWaveFormat {
+	format := *dec.native
+	return &format
+}
+
+func (dec *mp4Decoder) metadata() Metadata {
+	return dec.meta
+}
+
+func (dec *mp4Decoder) close() error {
+	return dec.file.Close()
+}
+
+// outputFrame converts a media time to a frame of the decoded output
+func (dec *mp4Decoder) outputFrame(time int64) int64 {
+	return time*int64(dec.native.SampleRate)/dec.track.timescale - dec.skip
+}
+
+func (dec *mp4Decoder) decode() ([]float64, int64, error) {
+	track := dec.track
+	channels := int64(dec.native.NumChannels)
+	for {
+		if dec.sample >= len(track.sizes) {
+			return nil, 0, io.EOF
+		}
+
+		size := int(track.sizes[dec.sample])
+		if cap(dec.buf) < size {
+			dec.buf = make([]byte, size)
+		}
+		data := dec.buf[:size]
+		_, err := dec.file.ReadAt(data, track.offsets[dec.sample])
+		if err != nil {
+			return nil, 0, err
+		}
+
+		start := dec.outputFrame(track.times[dec.sample])
+		dec.sample++
+		samples, err := dec.codec.decode(data)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// trim priming and padding
+		if start >= dec.frames {
+			return nil, 0, io.EOF
+		}
+		frames := int64(len(samples)) / channels
+		from, to := max(-start, 0), min(frames, dec.frames-start)
+		if from >= to {
+			continue
+		}
+		return samples[from*channels : to*channels], start + from, nil
+	}
+}
+
+func (dec *mp4Decoder) seek(frame int64) error {
+	track := dec.track
+	time := (max(frame, 0) + dec.skip) * track.timescale / int64(dec.native.SampleRate)
+
+	// the sample holding the target, and enough before it to settle
+	sample := sort.Search(len(track.sizes), func(i int) bool {
+		return track.times[i+1] > time
+	})
+	dec.sample = max(sample-dec.codec.preroll(), 0)
+	dec.codec.reset()
+	return nil
+}
+
+func createMP4AudioSourceFromFile(metadata *Metadata) (AudioSource, error) {
+	dec, err := openMP4(metadata.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDecodedSource(dec), nil
+}
+
+func getMP4FileMetadata(path string) (*Metadata, error) {
+	dec, err := openMP4(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.file.Close()
+
+	metadata := dec.metadata()
+	return &metadata, nil
+}
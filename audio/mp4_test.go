@@ -0,0 +1,217 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// mp4BoxBytes builds a box around the concatenation of parts
+func mp4BoxBytes(kind string, parts ...[]byte) []byte {
+	body := bytes.Join(parts, nil)
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	box = append(box, kind...)
+	return append(box, body...)
+}
+
+func uint32s(values ...uint32) []byte {
+	var b []byte
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+// muxMP4 lays samples out in chunks of three behind an audio track with the
+// sample entry given, at a timescale of rate. The track plays the edit from
+// start for duration samples, after a video track that is passed over.
+func muxMP4(entry []byte, samples [][]byte, durations []uint32, rate, start, duration uint32, ilst []byte) []byte {
+	ftyp := mp4BoxBytes("ftyp", []byte("M4A "), uint32s(0), []byte("M4A mp42isom"))
+
+	var mdat []byte
+	var sizes, offsets []uint32
+	for i, sample := range samples {
+		if i%3 == 0 {
+			offsets = append(offsets, uint32(len(ftyp)+8+len(mdat)))
+		}
+		sizes = append(sizes, uint32(len(sample)))
+		mdat = append(mdat, sample...)
+	}
+	var stts []uint32
+	var total uint32
+	for _, d := range durations {
+		if n := len(stts); n > 0 && stts[n-1] == d {
+			stts[n-2]++
+		} else {
+			stts = append(stts, 1, d)
+		}
+		total += d
+	}
+	stsc := []uint32{1, 3, 1}
+	if last := uint32(len(samples) % 3); last != 0 {
+		stsc = append(stsc, uint32(len(offsets)), last, 1)
+	}
+
+	stbl := mp4BoxBytes("stbl",
+		mp4BoxBytes("stsd", uint32s(0, 1), entry),
+		mp4BoxBytes("stts", uint32s(0, uint32(len(stts)/2)), uint32s(stts...)),
+		mp4BoxBytes("stsc", uint32s(0, uint32(len(stsc)/3)), uint32s(stsc...)),
+		mp4BoxBytes("stsz", uint32s(0, 0, uint32(len(sizes))), uint32s(sizes...)),
+		mp4BoxBytes("stco", uint32s(0, uint32(len(offsets))), uint32s(offsets...)),
+	)
+	handler := func(kind string) []byte {
+		return mp4BoxBytes("hdlr", uint32s(0, 0), []byte(kind), uint32s(0, 0, 0), []byte{0})
+	}
+	audio := mp4BoxBytes("trak",
+		mp4BoxBytes("tkhd", make([]byte, 84)),
+		mp4BoxBytes("edts", mp4BoxBytes("elst", uint32s(0, 1, duration, start, 0x10000))),
+		mp4BoxBytes("mdia",
+			mp4BoxBytes("mdhd", uint32s(0, 0, 0, rate, total, 0)),
+			handler("soun"),
+			mp4BoxBytes("minf", mp4BoxBytes("smhd", make([]byte, 8)), stbl),
+		),
+	)
+	video := mp4BoxBytes("trak", mp4BoxBytes("mdia", handler("vide")))
+	moov := mp4BoxBytes("moov",
+		mp4BoxBytes("mvhd", uint32s(0, 0, 0, rate, total), make([]byte, 80)),
+		video,
+		audio,
+		mp4BoxBytes("udta", mp4BoxBytes("meta", uint32s(0), handler("mdir"), mp4BoxBytes("ilst", ilst))),
+	)
+	return bytes.Join([][]byte{ftyp, mp4BoxBytes("mdat", mdat), moov}, nil)
+}
+
+// mp4Item is an iTunes tag holding a value of the given data type
+func mp4Item(kind string, dataType uint32, value []byte) []byte {
+	return mp4BoxBytes(kind, mp4BoxBytes("data", uint32s(dataType, 0), value))
+}
+
+func alacSampleEntry(cookie []byte, channels, depth, rate int) []byte {
+	body := make([]byte, 28)
+	binary.BigEndian.PutUint16(body[6:], 1)
+	binary.BigEndian.PutUint16(body[16:], uint16(channels))
+	binary.BigEndian.PutUint16(body[18:], uint16(depth))
+	binary.BigEndian.PutUint32(body[24:], uint32(rate)<<16)
+	return mp4BoxBytes("alac", body, mp4BoxBytes("alac", uint32s(0), cookie))
+}
+
+func TestMP4ALAC(t *testing.T) {
+	dir := t.TempDir()
+	for _, test := range []struct {
+		name string
+		enc  alacEncoder
+		// the WAVE channel each of ALAC's channels is
+		order []int
+	}{
+		{"16 bit stereo", alacEncoder{bitDepth: 16, channels: 2, order: 4}, []int{0, 1}},
+		{"24 bit mono", alacEncoder{bitDepth: 24, channels: 1, shiftBytes: 1, mode: 1, order: 8}, []int{0}},
+		{"20 bit 5.1", alacEncoder{bitDepth: 20, channels: 6, order: 2}, []int{2, 0, 1, 4, 5, 3}},
+	} {
+		const rate, frames, skip, play = 48000, 50000, 1000, 40000
+		enc := test.enc
+		enc.frameLength = 4096
+
+		// tones over noise, each channel its own, silent for a while so the
+		// coder switches to runs of zeros
+		r := rand.New(rand.NewSource(5))
+		scale := float64(int64(1) << (enc.bitDepth - 1))
+		signal := make([][]int32, enc.channels)
+		for c := range signal {
+			signal[c] = make([]int32, frames)
+			for i := range signal[c] {
+				if i >= 10000 && i < 14000 {
+					continue
+				}
+				v := 0.6*math.Sin(float64(i)*0.01*float64(c+1)) + 0.05*(r.Float64()*2-1)
+				signal[c][i] = int32(math.Round(v * (scale - 1)))
+			}
+		}
+		var samples [][]byte
+		var durations []uint32
+		for start := 0; start < frames; start += enc.frameLength {
+			end := min(start+enc.frameLength, frames)
+			frame := make([][]int32, enc.channels)
+			for c := range frame {
+				frame[c] = signal[test.order[c]][start:end]
+			}
+			samples = append(samples, enc.frame(frame, len(samples)%5 == 3))
+			durations = append(durations, uint32(end-start))
+		}
+
+		cover := []byte{0xFF, 0xD8, 0xFF, 0xE0, 1, 2, 3}
+		ilst := bytes.Join([][]byte{
+			mp4Item("\xa9nam", 1, []byte("Song")),
+			mp4Item("\xa9ART", 1, []byte("Band")),
+			mp4Item("\xa9alb", 1, []byte("Record")),
+			mp4Item("covr", MP4_DATA_JPEG, cover),
+		}, nil)
+		entry := alacSampleEntry(enc.cookie(rate), enc.channels, enc.bitDepth, rate)
+		path := filepath.Join(dir, test.name+".m4a")
+		err := os.WriteFile(path, muxMP4(entry, samples, durations, rate, skip, play, ilst), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dec, err := openMP4(path)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		checkFormat(t, dec, enc.channels, rate, play)
+		m := dec.metadata()
+		if m.Title != "Song" || m.Artist != "Band" || m.Album != "Record" {
+			t.Fatalf("%s: metadata %+v", test.name, m)
+		}
+		if m.Cover == nil || m.Cover.MIMEType != "image/jpeg" || !bytes.Equal(m.Cover.Data, cover) {
+			t.Fatalf("%s: cover %+v", test.name, m.Cover)
+		}
+
+		// the edit list trims the start and the end
+		want := make([]float64, play*enc.channels)
+		for f := 0; f < play; f++ {
+			for c := range signal {
+				want[f*enc.channels+c] = float64(signal[c][skip+f]) / scale
+			}
+		}
+		all := decodeAll(t, dec)
+		if len(all) != len(want) {
+			t.Fatalf("%s: %d samples, expected %d", test.name, len(all), len(want))
+		}
+		checkSamples(t, test.name, all, want, 0)
+		checkSeek(t, dec, all, 0, 0, 1, 4096-skip-1, 4096-skip, 12000, play-1)
+		dec.close()
+	}
+}
+
+func TestMP4SampleCount(t *testing.T) {
+	// a fixed sample size claiming four billion samples in a small file
+	stbl := bytes.Join([][]byte{
+		mp4BoxBytes("stsz", uint32s(0, 4, 0xFFFFFFFF)),
+		mp4BoxBytes("stts", uint32s(0, 1, 0xFFFFFFFF, 1024)),
+		mp4BoxBytes("stsc", uint32s(0, 1, 1, 0xFFFFFFFF, 1)),
+		mp4BoxBytes("stco", uint32s(0, 1, 0)),
+	}, nil)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	track := &mp4Track{}
+	if err := track.readSampleTable(stbl, 4000); err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+	if len(track.sizes) != 1000 {
+		t.Fatalf("%d samples, expected the 1000 the file can hold", len(track.sizes))
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+		t.Fatalf("allocated %d bytes", alloc)
+	}
+
+	// sizes listed one by one must all be in the box
+	stbl = append(mp4BoxBytes("stsz", uint32s(0, 0, 0xFFFFFFFF), uint32s(4, 4)), stbl[20:]...)
+	if err := (&mp4Track{}).readSampleTable(stbl, 4000); err != errMP4Box {
+		t.Fatalf("error %v, expected %v", err, errMP4Box)
+	}
+}
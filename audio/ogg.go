@@ -0,0 +1,450 @@
+package audio
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	OGG_PAGE_HEADER_SIZE = 27
+	OGG_MAX_PAGE_SIZE    = OGG_PAGE_HEADER_SIZE + 255 + 255*255
+
+	OGG_FLAG_CONTINUED = 0x1
+	OGG_FLAG_BOS       = 0x2
+	OGG_FLAG_EOS       = 0x4
+
+	// granule position of pages on which no packet ends
+	OGG_NO_GRANULE = -1
+)
+
+var (
+	ErrNotOgg = errors.New("not an Ogg file")
+)
+
+var oggCRCTable [256]uint32
+
+func init() {
+	for i := range oggCRCTable {
+		crc := uint32(i) << 24
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+		oggCRCTable[i] = crc
+	}
+}
+
+func oggCRC(crc uint32, data []byte) uint32 {
+	for _, b := range data {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+type oggPage struct {
+	flags    byte
+	granule  int64
+	serial   uint32
+	sequence uint32
+
+	lacing []byte
+	body   []byte
+
+	offset int64 // of the capture pattern within the file
+	size   int   // header and body
+}
+
+// parseOggPageHeader reads the fixed header and segment table at the start
+// of b, returning the page without its body and the total page size
+func parseOggPageHeader(b []byte) (*oggPage, bool) {
+	if len(b) < OGG_PAGE_HEADER_SIZE || string(b[:4]) != "OggS" || b[4] != 0 {
+		return nil, false
+	}
+
+	segments := int(b[26])
+	if len(b) < OGG_PAGE_HEADER_SIZE+segments {
+		return nil, false
+	}
+
+	page := &oggPage{
+		flags:    b[5],
+		granule:  int64(binary.LittleEndian.Uint64(b[6:])),
+		serial:   binary.LittleEndian.Uint32(b[14:]),
+		sequence: binary.LittleEndian.Uint32(b[18:]),
+		lacing:   b[OGG_PAGE_HEADER_SIZE : OGG_PAGE_HEADER_SIZE+segments],
+	}
+
+	page.size = OGG_PAGE_HEADER_SIZE + segments
+	for _, l := range page.lacing {
+		page.size += int(l)
+	}
+	return page, true
+}
+
+// oggReader reads whole pages from a file, skipping anything between them
+// that does not pass the page CRC
+type oggReader struct {
+	file io.ReadSeeker
+	buf  *bufio.Reader
+	pos  int64
+	end  int64
+}
+
+func newOggReader(file io.ReadSeeker, end int64) *oggReader {
+	return &oggReader{file: file, buf: bufio.NewReaderSize(file, OGG_MAX_PAGE_SIZE), end: end}
+}
+
+func (r *oggReader) seekTo(offset int64) error {
+	_, err := r.file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	r.buf.Reset(r.file)
+	r.pos = offset
+	return nil
+}
+
+func (r *oggReader) readPage() (*oggPage, error) {
+	for {
+		if r.pos+OGG_PAGE_HEADER_SIZE > r.end {
+			return nil, io.EOF
+		}
+
+		header, err := r.buf.Peek(OGG_PAGE_HEADER_SIZE + 255)
+		if err != nil && len(header) < OGG_PAGE_HEADER_SIZE {
+			return nil, io.EOF
+		}
+
+		page, ok := parseOggPageHeader(header)
+		if ok {
+			var raw []byte
+			raw, err = r.buf.Peek(page.size)
+			ok = err == nil && pageCRCValid(raw)
+			if ok {
+				raw = append([]byte(nil), raw...)
+				page.lacing = raw[OGG_PAGE_HEADER_SIZE : OGG_PAGE_HEADER_SIZE+len(page.lacing)]
+				page.body = raw[OGG_PAGE_HEADER_SIZE+len(page.lacing):]
+				page.offset = r.pos
+
+				r.buf.Discard(page.size)
+				r.pos += int64(page.size)
+				return page, nil
+			}
+		}
+
+		// lost sync, look for the next capture pattern
+		r.buf.Discard(1)
+		r.pos++
+		for {
+			b, err := r.buf.Peek(4)
+			if err != nil {
+				r.pos += int64(len(b))
+				return nil, io.EOF
+			}
+			if string(b) == "OggS" {
+				break
+			}
+			r.buf.Discard(1)
+			r.pos++
+		}
+	}
+}
+
+func pageCRCValid(raw []byte) bool {
+	stored := binary.LittleEndian.Uint32(raw[22:])
+	crc := oggCRC(0, raw[:22])
+	crc = oggCRC(crc, []byte{0, 0, 0, 0})
+	crc = oggCRC(crc, raw[26:])
+	return crc == stored
+}
+
+type oggPacket struct {
+	data   []byte
+	serial uint32
+
+	// granule position of the page if this is the last packet ending on it,
+	// else OGG_NO_GRANULE
+	granule int64
+
+	bos bool // first packet of a logical stream
+	eos bool // last packet of a logical stream
+
+	pageOffset int64 // of the page the packet ends on
+}
+
+// oggPacketReader reassembles the packets of one logical stream. The first
+// packet of any other stream is passed through too so that codecs can spot
+// the start of a chained stream.
+type oggPacketReader struct {
+	pages  *oggReader
+	serial uint32
+
+	partial []byte
+	// the partial packet began on a page that was lost
+	broken bool
+	// sequence number the next page should carry
+	sequence uint32
+
+	queue []oggPacket
+}
+
+func newOggPacketReader(pages *oggReader) *oggPacketReader {
+	return &oggPacketReader{pages: pages}
+}
+
+// follow switches the reader to another logical stream
+func (r *oggPacketReader) follow(serial uint32) {
+	r.serial = serial
+	r.partial = r.partial[:0]
+	r.broken = true
+}
+
+func (r *oggPacketReader) seekTo(offset int64) error {
+	r.queue = r.queue[:0]
+	r.partial = r.partial[:0]
+	r.broken = true
+	return r.pages.seekTo(offset)
+}
+
+func (r *oggPacketReader) next() (oggPacket, error) {
+	for len(r.queue) == 0 {
+		page, err := r.pages.readPage()
+		if err != nil {
+			return oggPacket{}, err
+		}
+
+		if page.serial != r.serial {
+			if page.flags&OGG_FLAG_BOS != 0 {
+				r.queue = append(r.queue, oggPacket{firstPacket(page), page.serial, OGG_NO_GRANULE, true, false, page.offset})
+			}
+			continue
+		}
+
+		r.splitPage(page)
+	}
+
+	packet := r.queue[0]
+	r.queue = r.queue[1:]
+	return packet, nil
+}
+
+func firstPacket(page *oggPage) []byte {
+	size := 0
+	for _, l := range page.lacing {
+		size += int(l)
+		if l < 255 {
+			break
+		}
+	}
+	return page.body[:size]
+}
+
+// splitPage queues the packets that complete on page
+func (r *oggPacketReader) splitPage(page *oggPage) {
+	if page.sequence != r.sequence {
+		// a page went missing, taking the start of any packet continued here
+		r.partial = r.partial[:0]
+		r.broken = true
+	}
+	r.sequence = page.sequence + 1
+
+	if page.flags&OGG_FLAG_CONTINUED == 0 {
+		// anything left over belonged to a packet that was never finished
+		r.partial = r.partial[:0]
+		r.broken = false
+	}
+
+	last := -1
+	for i, l := range page.lacing {
+		if l < 255 {
+			last = i
+		}
+	}
+
+	pos := 0
+	for i, l := range page.lacing {
+		r.partial = append(r.partial, page.body[pos:pos+int(l)]...)
+		pos += int(l)
+		if l == 255 {
+			continue
+		}
+
+		if r.broken {
+			// the start of this packet is missing
+			r.broken = false
+			r.partial = r.partial[:0]
+			continue
+		}
+
+		packet := oggPacket{
+			data:       append([]byte(nil), r.partial...),
+			serial:     page.serial,
+			granule:    OGG_NO_GRANULE,
+			bos:        page.flags&OGG_FLAG_BOS != 0 && len(r.queue) == 0,
+			pageOffset: page.offset,
+		}
+		if i == last {
+			packet.granule = page.granule
+			packet.eos = page.flags&OGG_FLAG_EOS != 0
+		}
+		r.queue = append(r.queue, packet)
+		r.partial = r.partial[:0]
+	}
+}
+
+// oggChain is one link of a chained file: a logical stream of the codec
+// being decoded, along with any streams multiplexed alongside it
+type oggChain struct {
+	serial uint32
+	start  int64 // offset of the chain's first page
+	end    int64 // offset just past its last page
+
+	lastGranule int64
+	// first packet of the stream, holding the codec's identification header
+	head []byte
+
+	// index of the chain's first sample within the whole file, set by the codec
+	firstSample int64
+}
+
+// scanOggChains walks the page headers of a file and returns every chain
+// whose stream is recognised by match, given the stream's first packet
+func scanOggChains(file io.ReaderAt, end int64, match func(packet []byte) bool) ([]oggChain, error) {
+	chains := make([]oggChain, 0, 1)
+	header := make([]byte, OGG_PAGE_HEADER_SIZE+255)
+
+	var current *oggChain
+	inHeaders := false
+	pos := int64(0)
+	for pos+OGG_PAGE_HEADER_SIZE <= end {
+		n, _ := file.ReadAt(header, pos)
+		page, ok := parseOggPageHeader(header[:n])
+		if !ok || pos+int64(page.size) > end {
+			// damaged, leave it to the page reader to resynchronise
+			next, found := findCapture(file, pos+1, end)
+			if !found {
+				break
+			}
+			pos = next
+			continue
+		}
+
+		if page.flags&OGG_FLAG_BOS != 0 {
+			if !inHeaders {
+				// a new group of streams begins a new chain
+				if current != nil {
+					current.end = pos
+				}
+				current = nil
+				inHeaders = true
+			}
+
+			if current == nil {
+				body := make([]byte, page.size-OGG_PAGE_HEADER_SIZE-len(page.lacing))
+				file.ReadAt(body, pos+int64(OGG_PAGE_HEADER_SIZE+len(page.lacing)))
+				page.body = body
+				head := firstPacket(page)
+				if match(head) {
+					chains = append(chains, oggChain{serial: page.serial, start: pos, head: head})
+					current = &chains[len(chains)-1]
+				}
+			}
+		} else {
+			inHeaders = false
+		}
+
+		if current != nil && page.serial == current.serial {
+			if page.granule != OGG_NO_GRANULE {
+				current.lastGranule = page.granule
+			}
+			current.end = pos + int64(page.size)
+		}
+
+		pos += int64(page.size)
+	}
+
+	if len(chains) == 0 {
+		return nil, ErrNotOgg
+	}
+	return chains, nil
+}
+
+func findCapture(file io.ReaderAt, from int64, end int64) (int64, bool) {
+	buf := make([]byte, 4096)
+	for from+4 <= end {
+		n, _ := file.ReadAt(buf, from)
+		if n < 4 {
+			return 0, false
+		}
+		for i := 0; i+4 <= n; i++ {
+			if string(buf[i:i+4]) == "OggS" {
+				return from + int64(i), true
+			}
+		}
+		from += int64(n - 3)
+	}
+	return 0, false
+}
+
+// bisectOggGranule finds the offset of the last page of serial within
+// [lo, hi) whose granule position is at most target, or lo if there is none
+func bisectOggGranule(r *oggReader, serial uint32, lo int64, hi int64, target int64) (int64, error) {
+	best := lo
+
+	for hi-lo > OGG_MAX_PAGE_SIZE {
+		mid := lo + (hi-lo)/2
+		err := r.seekTo(mid)
+		if err != nil {
+			return 0, err
+		}
+
+		found := false
+		for {
+			page, err := r.readPage()
+			if err != nil || page.offset >= hi {
+				break
+			}
+			if page.serial != serial || page.granule == OGG_NO_GRANULE {
+				continue
+			}
+
+			found = true
+			if page.granule <= target {
+				lo, best = page.offset, page.offset
+			} else {
+				hi = mid
+			}
+			break
+		}
+
+		if !found {
+			hi = mid
+		}
+	}
+
+	// finish with a linear scan
+	err := r.seekTo(lo)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		page, err := r.readPage()
+		if err != nil || page.offset >= hi {
+			break
+		}
+		if page.serial != serial || page.granule == OGG_NO_GRANULE {
+			continue
+		}
+		if page.granule > target {
+			break
+		}
+		best = page.offset
+	}
+
+	return best, nil
+}
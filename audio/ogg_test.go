@@ -0,0 +1,91 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+// oggPageBytes builds a page around lacing and body, filling in its CRC
+func oggPageBytes(serial, sequence uint32, flags byte, granule int64, lacing, body []byte) []byte {
+	page := []byte("OggS\x00")
+	page = append(page, flags)
+	page = binary.LittleEndian.AppendUint64(page, uint64(granule))
+	page = binary.LittleEndian.AppendUint32(page, serial)
+	page = binary.LittleEndian.AppendUint32(page, sequence)
+	page = append(page, 0, 0, 0, 0, byte(len(lacing)))
+	page = append(page, lacing...)
+	page = append(page, body...)
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(0, page))
+	return page
+}
+
+// oggLacing is the segment table entries of a packet
+func oggLacing(packet []byte) []byte {
+	lacing := bytes.Repeat([]byte{255}, len(packet)/255)
+	return append(lacing, byte(len(packet)%255))
+}
+
+// muxOgg lays a logical stream out on pages: the first header alone on the
+// first page, the other headers on the next, then perPage packets a page,
+// each page taking the granule position of its last packet
+func muxOgg(serial uint32, headers [][]byte, packets [][]byte, granules []int64, perPage int) []byte {
+	out := oggPageBytes(serial, 0, OGG_FLAG_BOS, 0, oggLacing(headers[0]), headers[0])
+	var lacing, body []byte
+	for _, header := range headers[1:] {
+		lacing = append(lacing, oggLacing(header)...)
+		body = append(body, header...)
+	}
+	out = append(out, oggPageBytes(serial, 1, 0, 0, lacing, body)...)
+
+	sequence := uint32(2)
+	for start := 0; start < len(packets); start += perPage {
+		end := min(start+perPage, len(packets))
+		lacing, body = nil, nil
+		for _, packet := range packets[start:end] {
+			lacing = append(lacing, oggLacing(packet)...)
+			body = append(body, packet...)
+		}
+		flags := byte(0)
+		if end == len(packets) {
+			flags = OGG_FLAG_EOS
+		}
+		out = append(out, oggPageBytes(serial, sequence, flags, granules[end-1], lacing, body)...)
+		sequence++
+	}
+	return out
+}
+
+func TestOggPackets(t *testing.T) {
+	long := bytes.Repeat([]byte{'x'}, 600)
+	var file []byte
+	// a packet split over three pages, the last holding another packet
+	file = append(file, oggPageBytes(7, 0, OGG_FLAG_BOS, OGG_NO_GRANULE, []byte{255}, long[:255])...)
+	file = append(file, "junk"...)
+	file = append(file, oggPageBytes(7, 1, OGG_FLAG_CONTINUED, OGG_NO_GRANULE, []byte{255}, long[255:510])...)
+	file = append(file, oggPageBytes(7, 2, OGG_FLAG_CONTINUED, 100, []byte{90, 3}, append(long[510:], "abc"...))...)
+	// another stream's page is passed over
+	file = append(file, oggPageBytes(8, 0, 0, 5, []byte{3}, []byte("zzz"))...)
+	// a damaged page loses the packet it begins
+	damaged := oggPageBytes(7, 3, 0, OGG_NO_GRANULE, []byte{2, 255}, append([]byte("de"), long[:255]...))
+	damaged[30] ^= 1
+	file = append(file, damaged...)
+	file = append(file, oggPageBytes(7, 4, OGG_FLAG_CONTINUED|OGG_FLAG_EOS, 200, []byte{1, 2}, []byte("ygh"))...)
+
+	packets := newOggPacketReader(newOggReader(bytes.NewReader(file), int64(len(file))))
+	packets.follow(7)
+	packets.seekTo(0)
+	var got []string
+	for {
+		packet, err := packets.next()
+		if err != nil {
+			break
+		}
+		got = append(got, fmt.Sprintf("%d:%d:%d", len(packet.data), packet.granule, packet.serial))
+	}
+	want := "[600:-1:7 3:100:7 2:200:7]"
+	if fmt.Sprint(got) != want {
+		t.Fatalf("packets %v, expected %s", got, want)
+	}
+}
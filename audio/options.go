@@ -0,0 +1,241 @@
+package audio
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	REFILL_PERIOD = 100 * time.Millisecond // how often the client's buffer is topped up
+)
+
+var (
+	ErrInvalidOption = errors.New("invalid player option")
+)
+
+// PlayerOption configures a player made by NewPlayer
+type PlayerOption func(*Player)
+
+// WithClient plays through client rather than the default output device. The
+// player closes if the client fails, unless given WithClientFactory too.
+func WithClient(client AudioClient) PlayerOption {
+	return func(p *Player) {
+		p.client = client
+	}
+}
+
+// WithClientFactory plays through a client made by newClient, making another
+// if the one in use fails. Given along with WithClient, newClient is only
+// used once that client fails.
+func WithClientFactory(newClient func() (AudioClient, error)) PlayerOption {
+	return func(p *Player) {
+		p.newClient = newClient
+	}
+}
+
+// WithClock refills the client's buffer each time clock ticks rather than on
+// a real time ticker, or as fast as an offline client such as WavFileClient
+// can take audio
+func WithClock(clock Clock) PlayerOption {
+	return func(p *Player) {
+		p.clock = clock
+	}
+}
+
+// WithSourceProvider decodes files with the given extensions, such as ".mp3",
+// using provider ahead of the decoders registered with
+// RegisterAudioSourceProvider
+func WithSourceProvider(provider *AudioSourceProvider, exts ...string) PlayerOption {
+	return func(p *Player) {
+		for _, ext := range exts {
+			p.sources.byExt[strings.ToLower(ext)] = provider
+		}
+	}
+}
+
+// WithMagicSourceProvider decodes files holding magic at offset using
+// provider, whatever their extension
+func WithMagicSourceProvider(offset int, magic []byte, provider *AudioSourceProvider) PlayerOption {
+	return func(p *Player) {
+		p.sources.byMagic = append(p.sources.byMagic, magicProvider{offset, magic, provider})
+	}
+}
+
+// WithMetadataReader reads the metadata of queued files with read rather
+// than from the files themselves. Once a file plays its own duration is
+// used, along with any fields read left unknown.
+func WithMetadataReader(read func(path string) (*Metadata, error)) PlayerOption {
+	return func(p *Player) {
+		p.sources.readMetadata = read
+	}
+}
+
+// WithRefillPeriod sets how often the client's buffer is topped up, which
+// must be well under the length of the buffer
+func WithRefillPeriod(d time.Duration) PlayerOption {
+	return func(p *Player) {
+		p.refillPeriod = d
+	}
+}
+
+// WithSeekStep sets how far SeekForward and SeekBackward move, in 100ns
+// units
+func WithSeekStep(step int) PlayerOption {
+	return func(p *Player) {
+		p.seekStep = step
+	}
+}
+
+// WithCrossfade fades each track in over the last length of the one before,
+// as SetCrossfade does
+func WithCrossfade(length time.Duration, curve int) PlayerOption {
+	return func(p *Player) {
+		p.crossfadeLength = int(length / 100)
+		p.crossfadeCurve = curve
+	}
+}
+
+// WithDeclick sets how long the fades around pausing, resuming, seeking and
+// skipping are, 0 cutting the stream as is. It defaults to DECLICK_LENGTH.
+func WithDeclick(length time.Duration) PlayerOption {
+	return func(p *Player) {
+		p.declickLength = int(length / 100)
+	}
+}
+
+// WithProcessors starts the player with processors as its chain, in order
+func WithProcessors(processors ...Processor) PlayerOption {
+	return func(p *Player) {
+		for _, processor := range processors {
+			p.chain.insert(-1, processor)
+		}
+	}
+}
+
+// WithVolume starts the player at volume db, between VOLUME_MIN and
+// VOLUME_MAX, muted if muted is set
+func WithVolume(db float64, muted bool) PlayerOption {
+	return func(p *Player) {
+		p.volume, p.muted = db, muted
+	}
+}
+
+type magicProvider struct {
+	offset   int
+	magic    []byte
+	provider *AudioSourceProvider
+}
+
+// sourceSelector picks the provider for a file from those given to a player,
+// falling back to the registered ones
+type sourceSelector struct {
+	byExt        map[string]*AudioSourceProvider
+	byMagic      []magicProvider
+	readMetadata func(path string) (*Metadata, error)
+}
+
+func newSourceSelector() *sourceSelector {
+	return &sourceSelector{byExt: make(map[string]*AudioSourceProvider)}
+}
+
+func (s *sourceSelector) providerForPath(path string) *AudioSourceProvider {
+	if len(s.byMagic) > 0 {
+		if provider := s.providerForContent(path); provider != nil {
+			return provider
+		}
+	}
+	if provider, ok := s.byExt[strings.ToLower(filepath.Ext(path))]; ok {
+		return provider
+	}
+	return getProviderForPath(path)
+}
+
+func (s *sourceSelector) providerForContent(path string) *AudioSourceProvider {
+	size := 0
+	for _, m := range s.byMagic {
+		size = max(size, m.offset+len(m.magic))
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	head := make([]byte, size)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil
+	}
+	head = head[:n]
+
+	for _, m := range s.byMagic {
+		end := m.offset + len(m.magic)
+		if end <= len(head) && bytes.Equal(head[m.offset:end], m.magic) {
+			return m.provider
+		}
+	}
+	return nil
+}
+
+// provider returns the AudioSourceProvider the player's queue loads files
+// with
+func (s *sourceSelector) provider() *AudioSourceProvider {
+	getMetadata := func(path string) (*Metadata, error) {
+		return s.providerForPath(path).GetFileMetadata(path)
+	}
+	if s.readMetadata != nil {
+		getMetadata = func(path string) (*Metadata, error) {
+			metadata, err := s.readMetadata(path)
+			if err != nil {
+				return nil, err
+			}
+			m := *metadata
+			m.Filepath = path
+			return &m, nil
+		}
+	}
+
+	return &AudioSourceProvider{
+		func(metadata *Metadata) (AudioSource, error) {
+			source, err := s.providerForPath(metadata.Filepath).GetAudioSourceFromFile(metadata)
+			if err != nil || s.readMetadata == nil {
+				return source, err
+			}
+			return &readMetadataSource{source, *metadata}, nil
+		},
+		getMetadata,
+	}
+}
+
+// readMetadataSource reports the metadata given by a player's metadata
+// reader over that found in the file
+type readMetadataSource struct {
+	AudioSource
+	metadata Metadata
+}
+
+func (s *readMetadataSource) GetMetadata() Metadata {
+	m := s.AudioSource.GetMetadata()
+	if s.metadata.Title != NOT_FOUND && s.metadata.Title != "" {
+		m.Title = s.metadata.Title
+	}
+	if s.metadata.Album != NOT_FOUND && s.metadata.Album != "" {
+		m.Album = s.metadata.Album
+	}
+	if s.metadata.Artist != NOT_FOUND && s.metadata.Artist != "" {
+		m.Artist = s.metadata.Artist
+	}
+	if s.metadata.Comment != "" {
+		m.Comment = s.metadata.Comment
+	}
+	if s.metadata.Cover != nil {
+		m.Cover = s.metadata.Cover
+	}
+	return m
+}
@@ -0,0 +1,138 @@
+package audio
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// namedProvider is a provider whose metadata is titled name, so tests can
+// tell which provider a file went to
+func namedProvider(name string) *AudioSourceProvider {
+	return &AudioSourceProvider{
+		func(metadata *Metadata) (AudioSource, error) {
+			return nil, errors.New(name)
+		},
+		func(path string) (*Metadata, error) {
+			return &Metadata{Filepath: path, Title: name}, nil
+		},
+	}
+}
+
+func TestSourceSelector(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	wav := filepath.Join(dir, "plain.wav")
+	writeWav(t, wav, 2, 48000, 16, false, 100, constant(0.1))
+
+	// files nothing else takes go to the backend
+	useBackends(t, &Backend{
+		Name:       "test",
+		Initialize: func() error { return nil },
+		Sources:    namedProvider("backend"),
+	})
+	if err := InitializeAudioAPI(); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Player{sources: newSourceSelector()}
+	for _, option := range []PlayerOption{
+		WithSourceProvider(namedProvider("ext"), ".XYZ", ".wav"),
+		WithMagicSourceProvider(4, []byte("MAGI"), namedProvider("magic")),
+		WithMagicSourceProvider(0, []byte("RIFF"), namedProvider("other magic")),
+	} {
+		option(p)
+	}
+	which := func(s *sourceSelector, path string) string {
+		provider := s.providerForPath(path)
+		if provider == audioSourceProviders[".flac"] {
+			return "flac"
+		}
+		m, err := provider.GetFileMetadata(path)
+		if err != nil {
+			return err.Error()
+		}
+		return m.Title
+	}
+
+	for _, test := range []struct {
+		what string
+		path string
+		want string
+	}{
+		// magic bytes are looked for first, at their offset, in the order given
+		{"magic", write("a.bin", "....MAGIC"), "magic"},
+		{"magic over extension", write("b.xyz", "....MAGI"), "magic"},
+		{"first magic", write("c.xyz", "RIFFMAGI"), "magic"},
+		{"second magic", write("d.mp3", "RIFF...."), "other magic"},
+		{"magic out of place", write("e.bin", "MAGI...."), "backend"},
+		{"short file", write("f.bin", "RIF"), "backend"},
+		// then the extensions given, whatever their case
+		{"extension", write("g.xyz", "...."), "ext"},
+		{"extension case", write("h.Xyz", ""), "ext"},
+		{"missing file", filepath.Join(dir, "i.xyz"), "ext"},
+		// then those registered
+		{"registered", write("j.flac", "...."), "flac"},
+		{"wav by magic", wav, "other magic"},
+	} {
+		if got := which(p.sources, test.path); got != test.want {
+			t.Fatalf("%s: %s went to %s, expected %s", test.what, filepath.Base(test.path), got, test.want)
+		}
+	}
+
+	// without magic the extension decides, then the registered providers
+	noMagic := &sourceSelector{byExt: p.sources.byExt}
+	if got := which(noMagic, wav); got != "ext" {
+		t.Fatalf("wav file went to %s", got)
+	}
+	if got := which(newSourceSelector(), wav); got != "Song" {
+		t.Fatalf("wav file went to %s", got)
+	}
+}
+
+func TestMetadataReader(t *testing.T) {
+	dir := t.TempDir()
+	wav := filepath.Join(dir, "a.wav")
+	writeWav(t, wav, 2, 48000, 16, false, 4800, constant(0.1))
+	missing := errors.New("not in the library")
+	read := func(path string) (*Metadata, error) {
+		if filepath.Base(path) != "a.wav" {
+			return nil, missing
+		}
+		return &Metadata{Filepath: "elsewhere", Title: "Library Title", Album: NOT_FOUND, Artist: "", Duration: 1}, nil
+	}
+	p := &Player{sources: newSourceSelector()}
+	WithMetadataReader(read)(p)
+	provider := p.sources.provider()
+
+	// queued files are described by the reader alone, under their own path
+	m, err := provider.GetFileMetadata(wav)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Filepath != wav || m.Title != "Library Title" || m.Album != NOT_FOUND || m.Duration != 1 {
+		t.Fatalf("metadata %+v", *m)
+	}
+	if _, err := provider.GetFileMetadata(filepath.Join(dir, "b.wav")); err != missing {
+		t.Fatalf("error %v, expected %v", err, missing)
+	}
+
+	// once playing, what the reader left unknown and the duration come from
+	// the file
+	source, err := provider.GetAudioSourceFromFile(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	playing := source.GetMetadata()
+	if playing.Title != "Library Title" || playing.Album != "Record" || playing.Artist != "Band" || playing.Duration != 1000000 {
+		t.Fatalf("metadata %+v while playing", playing)
+	}
+}
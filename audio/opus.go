@@ -0,0 +1,946 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"sync"
+)
+
+const (
+	OPUS_RATE = 48000
+
+	OPUS_MODE_SILK_ONLY = 1
+	OPUS_MODE_HYBRID    = 2
+	OPUS_MODE_CELT_ONLY = 3
+
+	// 0 leaves the bandwidth as it was, for lost packets
+	OPUS_BANDWIDTH_NARROW    = 1
+	OPUS_BANDWIDTH_MEDIUM    = 2
+	OPUS_BANDWIDTH_WIDE      = 3
+	OPUS_BANDWIDTH_SUPERWIDE = 4
+	OPUS_BANDWIDTH_FULL      = 5
+
+	// frame sizes at 48 kHz
+	OPUS_F2_5 = 120
+	OPUS_F5   = 240
+	OPUS_F10  = 480
+	OPUS_F20  = 960
+
+	OPUS_MAX_FRAME_BYTES = 1275
+	OPUS_MAX_PACKET      = 5760 // samples per channel, 120 ms
+
+	// decoding must start this many samples before a seek target for the
+	// decoder to converge, per RFC 7845
+	OPUS_SEEK_PREROLL = 3840
+)
+
+var (
+	ErrNotOpus      = errors.New("no Opus stream found")
+	errOpusHeader   = errors.New("malformed Opus header")
+	errOpusPacket   = errors.New("malformed Opus packet")
+	opusCELTEndBand = [6]int{0, 13, 17, 17, 19, 21}
+)
+
+func init() {
+	RegisterAudioSourceProvider(".opus", &AudioSourceProvider{createOpusAudioSourceFromFile, getOpusFileMetadata})
+}
+
+// opusStreamDecoder decodes the packets of a single Opus stream, mono or
+// stereo, switching between SILK, CELT and hybrid frames as they come
+type opusStreamDecoder struct {
+	channels int
+
+	celt *celtDecoder
+	silk *silkDecoder
+
+	// configuration of the current packet's TOC
+	mode           int
+	bandwidth      int
+	frameSize      int
+	streamChannels int
+
+	prevMode       int
+	prevRedundancy bool
+}
+
+func newOpusStreamDecoder(channels int) *opusStreamDecoder {
+	dec := &opusStreamDecoder{channels: channels, celt: newCELTDecoder(channels), silk: newSILKDecoder()}
+	dec.reset()
+	return dec
+}
+
+func (dec *opusStreamDecoder) reset() {
+	dec.celt.reset()
+	dec.silk = newSILKDecoder()
+	dec.mode, dec.bandwidth, dec.prevMode = 0, 0, 0
+	dec.frameSize = OPUS_F2_5
+	dec.streamChannels = dec.channels
+	dec.prevRedundancy = false
+}
+
+// opusParseTOC reads the mode, bandwidth, frame size and channel count from
+// a packet's table of contents byte
+func opusParseTOC(toc byte) (mode int, bandwidth int, frameSize int, channels int) {
+	switch {
+	case toc&0x80 != 0:
+		mode = OPUS_MODE_CELT_ONLY
+		bandwidth = OPUS_BANDWIDTH_MEDIUM + int(toc>>5&0x3)
+		if bandwidth == OPUS_BANDWIDTH_MEDIUM {
+			bandwidth = OPUS_BANDWIDTH_NARROW
+		}
+		frameSize = OPUS_F2_5 << (toc >> 3 & 0x3)
+	case toc&0x60 == 0x60:
+		mode = OPUS_MODE_HYBRID
+		bandwidth = OPUS_BANDWIDTH_SUPERWIDE
+		if toc&0x10 != 0 {
+			bandwidth = OPUS_BANDWIDTH_FULL
+		}
+		frameSize = OPUS_F10
+		if toc&0x08 != 0 {
+			frameSize = OPUS_F20
+		}
+	default:
+		mode = OPUS_MODE_SILK_ONLY
+		bandwidth = OPUS_BANDWIDTH_NARROW + int(toc>>5&0x3)
+		frameSize = OPUS_F10 << (toc >> 3 & 0x3)
+		if toc>>3&0x3 == 3 {
+			frameSize = 60 * OPUS_RATE / 1000
+		}
+	}
+
+	channels = 1
+	if toc&0x4 != 0 {
+		channels = 2
+	}
+	return
+}
+
+// opusFrameLength reads a frame length coded in one or two bytes
+func opusFrameLength(data []byte) (int, int) {
+	switch {
+	case len(data) < 1:
+		return -1, 0
+	case data[0] < 252:
+		return int(data[0]), 1
+	case len(data) < 2:
+		return -1, 0
+	default:
+		return 4*int(data[1]) + int(data[0]), 2
+	}
+}
+
+// opusParsePacket splits a packet into its frames, returning them along with
+// the number of bytes the packet takes up including padding. Self delimited
+// packets, as used by all but the last stream of a multistream packet, carry
+// the length of their last frame.
+func opusParsePacket(data []byte, selfDelimited bool) ([][]byte, int, error) {
+	if len(data) == 0 {
+		return nil, 0, errOpusPacket
+	}
+	_, _, frameSize, _ := opusParseTOC(data[0])
+
+	toc := data[0]
+	pos := 1
+	remaining := len(data) - 1
+	lastSize := remaining
+	sizes := make([]int, 0, 2)
+	count := 0
+	cbr := false
+	pad := 0
+
+	switch toc & 0x3 {
+	case 0:
+		count = 1
+	case 1:
+		count = 2
+		cbr = true
+		if !selfDelimited {
+			if remaining&1 != 0 {
+				return nil, 0, errOpusPacket
+			}
+			lastSize = remaining / 2
+			sizes = append(sizes, lastSize)
+		}
+	case 2:
+		count = 2
+		size, n := opusFrameLength(data[pos:])
+		remaining -= n
+		if size < 0 || size > remaining {
+			return nil, 0, errOpusPacket
+		}
+		pos += n
+		sizes = append(sizes, size)
+		lastSize = remaining - size
+	default:
+		if remaining < 1 {
+			return nil, 0, errOpusPacket
+		}
+		ch := data[pos]
+		pos++
+		remaining--
+		count = int(ch & 0x3F)
+		if count <= 0 || frameSize*count > OPUS_MAX_PACKET {
+			return nil, 0, errOpusPacket
+		}
+
+		if ch&0x40 != 0 {
+			for {
+				if remaining <= 0 {
+					return nil, 0, errOpusPacket
+				}
+				p := int(data[pos])
+				pos++
+				remaining--
+				n := min(p, 254)
+				remaining -= n
+				pad += n
+				if p != 255 {
+					break
+				}
+			}
+		}
+		if remaining < 0 {
+			return nil, 0, errOpusPacket
+		}
+
+		cbr = ch&0x80 == 0
+		if !cbr {
+			lastSize = remaining
+			for i := 0; i < count-1; i++ {
+				size, n := opusFrameLength(data[pos:])
+				remaining -= n
+				if size < 0 || size > remaining {
+					return nil, 0, errOpusPacket
+				}
+				pos += n
+				sizes = append(sizes, size)
+				lastSize -= n + size
+			}
+			if lastSize < 0 {
+				return nil, 0, errOpusPacket
+			}
+		} else if !selfDelimited {
+			lastSize = remaining / count
+			if lastSize*count != remaining {
+				return nil, 0, errOpusPacket
+			}
+			for i := 0; i < count-1; i++ {
+				sizes = append(sizes, lastSize)
+			}
+		}
+	}
+
+	if selfDelimited {
+		size, n := opusFrameLength(data[pos:])
+		remaining -= n
+		if size < 0 || size > remaining {
+			return nil, 0, errOpusPacket
+		}
+		pos += n
+		if cbr {
+			if size*count > remaining {
+				return nil, 0, errOpusPacket
+			}
+			sizes = sizes[:0]
+			for i := 0; i < count-1; i++ {
+				sizes = append(sizes, size)
+			}
+		} else if n+size > lastSize {
+			return nil, 0, errOpusPacket
+		}
+		sizes = append(sizes, size)
+	} else {
+		if lastSize > OPUS_MAX_FRAME_BYTES {
+			return nil, 0, errOpusPacket
+		}
+		sizes = append(sizes, lastSize)
+	}
+
+	frames := make([][]byte, count)
+	for i, size := range sizes {
+		if pos+size > len(data) {
+			return nil, 0, errOpusPacket
+		}
+		frames[i] = data[pos : pos+size]
+		pos += size
+	}
+	return frames, pos + pad, nil
+}
+
+// decodePacket decodes all frames of a packet into out, returning the
+// number of samples per channel decoded and the bytes the packet used
+func (dec *opusStreamDecoder) decodePacket(data []byte, selfDelimited bool, out []float64) (int, int, error) {
+	frames, used, err := opusParsePacket(data, selfDelimited)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	mode, bandwidth, frameSize, streamChannels := opusParseTOC(data[0])
+	if len(frames)*frameSize > len(out)/dec.channels {
+		return 0, 0, errOpusPacket
+	}
+	dec.mode, dec.bandwidth, dec.frameSize, dec.streamChannels = mode, bandwidth, frameSize, streamChannels
+
+	n := 0
+	for _, frame := range frames {
+		decoded, err := dec.decodeFrame(frame, out[n*dec.channels:], len(out)/dec.channels-n)
+		if err != nil {
+			return 0, 0, err
+		}
+		n += decoded
+	}
+	return n, used, nil
+}
+
+// decodeFrame decodes one frame of up to frameSize samples into out,
+// returning the number of samples per channel decoded. A frame of one byte
+// or less is concealed.
+func (dec *opusStreamDecoder) decodeFrame(data []byte, out []float64, frameSize int) (int, error) {
+	channels := dec.channels
+	frameSize = min(frameSize, 3*OPUS_F20)
+	if len(data) <= 1 {
+		data = nil
+		frameSize = min(frameSize, dec.frameSize)
+	}
+
+	var rd *rangeDecoder
+	var audioSize, mode, bandwidth int
+	if data != nil {
+		audioSize, mode, bandwidth = dec.frameSize, dec.mode, dec.bandwidth
+		rd = newRangeDecoder(data)
+	} else {
+		audioSize = frameSize
+		mode = dec.prevMode
+		if dec.prevRedundancy {
+			mode = OPUS_MODE_CELT_ONLY
+		}
+		if mode == 0 {
+			clear(out[:audioSize*channels])
+			return audioSize, nil
+		}
+
+		// conceal in pieces of at most 20 ms
+		if audioSize > OPUS_F20 {
+			for done := 0; done < audioSize; {
+				n, err := dec.decodeFrame(nil, out[done*channels:], min(audioSize-done, OPUS_F20))
+				if err != nil {
+					return 0, err
+				}
+				done += n
+			}
+			return frameSize, nil
+		} else if audioSize < OPUS_F20 {
+			if audioSize > OPUS_F10 {
+				audioSize = OPUS_F10
+			} else if mode != OPUS_MODE_SILK_ONLY && audioSize > OPUS_F5 && audioSize < OPUS_F10 {
+				audioSize = OPUS_F5
+			}
+		}
+	}
+
+	// switching between CELT and SILK fades over from a concealed frame
+	transition := data != nil && dec.prevMode > 0 &&
+		((mode == OPUS_MODE_CELT_ONLY && dec.prevMode != OPUS_MODE_CELT_ONLY && !dec.prevRedundancy) ||
+			(mode != OPUS_MODE_CELT_ONLY && dec.prevMode == OPUS_MODE_CELT_ONLY))
+	var transitionPCM []float64
+	if transition && mode == OPUS_MODE_CELT_ONLY {
+		transitionPCM = make([]float64, OPUS_F5*channels)
+		dec.decodeFrame(nil, transitionPCM, min(OPUS_F5, audioSize))
+	}
+
+	if audioSize > frameSize {
+		return 0, errOpusPacket
+	}
+	frameSize = audioSize
+
+	var silkPCM []int16
+	if mode != OPUS_MODE_CELT_ONLY {
+		silkPCM = make([]int16, max(OPUS_F10, frameSize)*channels)
+		if dec.prevMode == OPUS_MODE_CELT_ONLY {
+			dec.silk.reset()
+		}
+
+		// lost SILK frames are left silent
+		if data != nil {
+			fsKHz := 16
+			if mode == OPUS_MODE_SILK_ONLY && bandwidth == OPUS_BANDWIDTH_NARROW {
+				fsKHz = 8
+			} else if mode == OPUS_MODE_SILK_ONLY && bandwidth == OPUS_BANDWIDTH_MEDIUM {
+				fsKHz = 12
+			}
+			payloadMs := max(10, 1000*audioSize/OPUS_RATE)
+
+			for decoded := 0; decoded < frameSize; {
+				n, err := dec.silk.decode(rd, channels, dec.streamChannels, fsKHz, payloadMs, decoded == 0, silkPCM[decoded*channels:])
+				if err != nil {
+					return 0, err
+				}
+				decoded += n
+			}
+		}
+	}
+
+	// a CELT frame may follow SILK to smooth a switch of mode
+	startBand := 0
+	redundancy, celtToSilk := false, false
+	redundancyBytes := 0
+	length := len(data)
+	hybrid := 0
+	if mode == OPUS_MODE_HYBRID {
+		hybrid = 1
+	}
+	if data != nil && mode != OPUS_MODE_CELT_ONLY && rd.tell()+17+20*hybrid <= 8*length {
+		redundancy = true
+		if mode == OPUS_MODE_HYBRID {
+			redundancy = rd.decodeBitLogp(12)
+		}
+		if redundancy {
+			celtToSilk = rd.decodeBitLogp(1)
+			if mode == OPUS_MODE_HYBRID {
+				redundancyBytes = int(rd.decodeUint(256)) + 2
+			} else {
+				redundancyBytes = length - (rd.tell()+7)>>3
+			}
+			length -= redundancyBytes
+			if length*8 < rd.tell() {
+				length = 0
+				redundancyBytes = 0
+				redundancy = false
+			}
+			rd.buf = rd.buf[:len(rd.buf)-redundancyBytes]
+		}
+	}
+	if mode != OPUS_MODE_CELT_ONLY {
+		startBand = 17
+	}
+
+	if redundancy {
+		transition = false
+	}
+	if transition && mode != OPUS_MODE_CELT_ONLY {
+		transitionPCM = make([]float64, OPUS_F5*channels)
+		dec.decodeFrame(nil, transitionPCM, min(OPUS_F5, audioSize))
+	}
+
+	if bandwidth != 0 {
+		dec.celt.end = opusCELTEndBand[bandwidth]
+	}
+	dec.celt.streamChannels = dec.streamChannels
+
+	var redundantPCM []float64
+	if redundancy {
+		redundantPCM = make([]float64, OPUS_F5*channels)
+	}
+	if redundancy && celtToSilk {
+		dec.celt.start = 0
+		dec.celt.decode(newRangeDecoder(data[length:length+redundancyBytes]), OPUS_F5, redundantPCM)
+	}
+
+	dec.celt.start = startBand
+	if mode != OPUS_MODE_SILK_ONLY {
+		if mode != dec.prevMode && dec.prevMode > 0 && !dec.prevRedundancy {
+			dec.celt.reset()
+		}
+		dec.celt.decode(rd, min(OPUS_F20, frameSize), out)
+	} else {
+		clear(out[:frameSize*channels])
+		// let the CELT overlap of a previous hybrid frame die away
+		if dec.prevMode == OPUS_MODE_HYBRID && !(redundancy && celtToSilk && dec.prevRedundancy) {
+			dec.celt.start = 0
+			dec.celt.decode(newRangeDecoder([]byte{0xFF, 0xFF}), OPUS_F2_5, out)
+		}
+	}
+
+	if mode != OPUS_MODE_CELT_ONLY {
+		for i := 0; i < frameSize*channels; i++ {
+			out[i] += float64(silkPCM[i]) / 32768
+		}
+	}
+
+	window := dec.celt.window
+	if redundancy && !celtToSilk {
+		dec.celt.reset()
+		dec.celt.start = 0
+		dec.celt.decode(newRangeDecoder(data[length:length+redundancyBytes]), OPUS_F5, redundantPCM)
+		tail := out[channels*(frameSize-OPUS_F2_5):]
+		opusSmoothFade(tail, redundantPCM[channels*OPUS_F2_5:], tail, channels, window)
+	}
+	if redundancy && celtToSilk && (dec.prevMode != OPUS_MODE_SILK_ONLY || dec.prevRedundancy) {
+		copy(out[:channels*OPUS_F2_5], redundantPCM)
+		opusSmoothFade(redundantPCM[channels*OPUS_F2_5:], out[channels*OPUS_F2_5:], out[channels*OPUS_F2_5:], channels, window)
+	}
+	if transition {
+		if audioSize >= OPUS_F5 {
+			copy(out[:channels*OPUS_F2_5], transitionPCM)
+			opusSmoothFade(transitionPCM[channels*OPUS_F2_5:], out[channels*OPUS_F2_5:], out[channels*OPUS_F2_5:], channels, window)
+		} else {
+			opusSmoothFade(transitionPCM, out, out, channels, window)
+		}
+	}
+
+	dec.prevMode = mode
+	dec.prevRedundancy = redundancy && !celtToSilk
+	return audioSize, nil
+}
+
+// opusSmoothFade crossfades from a to b over the length of the CELT window
+func opusSmoothFade(a []float64, b []float64, out []float64, channels int, window []float64) {
+	for i, w := range window {
+		w *= w
+		for c := 0; c < channels; c++ {
+			j := i*channels + c
+			out[j] = w*b[j] + (1-w)*a[j]
+		}
+	}
+}
+
+// opusMultistreamDecoder decodes packets that hold several streams, one
+// after the other, and gathers their channels into the output layout
+type opusMultistreamDecoder struct {
+	channels int
+	coupled  int
+	mapping  []byte
+	streams  []*opusStreamDecoder
+	buffers  [][]float64
+}
+
+func newOpusMultistreamDecoder(channels int, streams int, coupled int, mapping []byte) *opusMultistreamDecoder {
+	dec := &opusMultistreamDecoder{channels: channels, coupled: coupled, mapping: mapping}
+	for s := 0; s < streams; s++ {
+		streamChannels := 1
+		if s < coupled {
+			streamChannels = 2
+		}
+		dec.streams = append(dec.streams, newOpusStreamDecoder(streamChannels))
+		dec.buffers = append(dec.buffers, make([]float64, OPUS_MAX_PACKET*streamChannels))
+	}
+	return dec
+}
+
+func (dec *opusMultistreamDecoder) reset() {
+	for _, s := range dec.streams {
+		s.reset()
+	}
+}
+
+// decode returns the interleaved samples of a packet
+func (dec *opusMultistreamDecoder) decode(packet []byte) ([]float64, error) {
+	samples := -1
+	for s, stream := range dec.streams {
+		n, used, err := stream.decodePacket(packet, s != len(dec.streams)-1, dec.buffers[s])
+		if err != nil {
+			return nil, err
+		}
+		if samples >= 0 && n != samples {
+			return nil, errOpusPacket
+		}
+		samples = n
+		packet = packet[used:]
+	}
+
+	out := make([]float64, samples*dec.channels)
+	for c, m := range dec.mapping {
+		if m == 255 {
+			continue
+		}
+
+		stream, channel := int(m)-dec.coupled, 0
+		if int(m) < 2*dec.coupled {
+			stream, channel = int(m)/2, int(m)%2
+		}
+		from := dec.buffers[stream]
+		streamChannels := dec.streams[stream].channels
+		for i := 0; i < samples; i++ {
+			out[i*dec.channels+c] = from[i*streamChannels+channel]
+		}
+	}
+	return out, nil
+}
+
+// opusHead is the identification header of an Ogg Opus stream
+type opusHead struct {
+	channels int
+	preSkip  int64
+	gain     float64 // linear
+
+	family  int
+	streams int
+	coupled int
+	mapping []byte
+}
+
+func isOpusHead(packet []byte) bool {
+	return len(packet) >= 8 && string(packet[:8]) == "OpusHead"
+}
+
+func parseOpusHead(packet []byte) (*opusHead, error) {
+	if !isOpusHead(packet) || len(packet) < 19 || packet[8]>>4 != 0 {
+		return nil, errOpusHeader
+	}
+
+	head := &opusHead{
+		channels: int(packet[9]),
+		preSkip:  int64(binary.LittleEndian.Uint16(packet[10:])),
+		family:   int(packet[18]),
+	}
+	// output gain in Q7.8 dB
+	gain := int16(binary.LittleEndian.Uint16(packet[16:]))
+	head.gain = math.Pow(10, float64(gain)/(20*256))
+
+	if head.family == 0 {
+		if head.channels < 1 || head.channels > 2 {
+			return nil, errOpusHeader
+		}
+		head.streams, head.coupled = 1, head.channels-1
+		head.mapping = []byte{0, 1}[:head.channels]
+		return head, nil
+	}
+
+	if head.channels < 1 || len(packet) < 21+head.channels {
+		return nil, errOpusHeader
+	}
+	head.streams, head.coupled = int(packet[19]), int(packet[20])
+	head.mapping = packet[21 : 21+head.channels]
+	if head.streams < 1 || head.coupled > head.streams || head.streams+head.coupled > 255 {
+		return nil, errOpusHeader
+	}
+	for _, m := range head.mapping {
+		if m != 255 && int(m) >= head.streams+head.coupled {
+			return nil, errOpusHeader
+		}
+	}
+	return head, nil
+}
+
+type opusChunk struct {
+	samples []float64
+	frame   int64
+}
+
+type opusDecoder struct {
+	file *os.File
+
+	chains  []oggChain
+	chain   int
+	pages   *oggReader
+	packets *oggPacketReader
+
+	head    *opusHead
+	streams *opusMultistreamDecoder
+	// channels of the first chain, later chains are converted to it
+	channels int
+
+	// offset of the first audio page of the current chain
+	audioStart int64
+
+	// decoded packets waiting on a granule position to place them
+	pending []opusChunk
+	ready   []opusChunk
+	// granule position of the next sample, -1 when unknown
+	nextGranule int64
+
+	metaLock sync.Mutex
+	meta     Metadata
+}
+
+func openOpus(path string) (*opusDecoder, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := &opusDecoder{file: file}
+	err = dec.readHeader(path)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return dec, nil
+}
+
+func (dec *opusDecoder) readHeader(path string) error {
+	info, err := dec.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	dec.chains, err = scanOggChains(dec.file, info.Size(), isOpusHead)
+	if err == ErrNotOgg {
+		return ErrNotOpus
+	} else if err != nil {
+		return err
+	}
+
+	// chains play back to back, each without its pre-skip
+	total := int64(0)
+	for i := range dec.chains {
+		head, err := parseOpusHead(dec.chains[i].head)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			dec.channels = head.channels
+		}
+
+		dec.chains[i].firstSample = total
+		total += max(dec.chains[i].lastGranule-head.preSkip, 0)
+	}
+
+	dec.pages = newOggReader(dec.file, info.Size())
+	dec.packets = newOggPacketReader(dec.pages)
+
+	err = dec.enterChain(0)
+	if err != nil {
+		return err
+	}
+
+	dec.meta.Filepath = path
+	dec.meta.Duration = uint64(total * SECOND / OPUS_RATE)
+	return nil
+}
+
+// enterChain reads the headers of a chain and positions the decoder at its
+// first audio page
+func (dec *opusDecoder) enterChain(chain int) error {
+	c := &dec.chains[chain]
+	dec.packets.follow(c.serial)
+	err := dec.packets.seekTo(c.start)
+	if err != nil {
+		return err
+	}
+
+	var head *opusHead
+	tags := NewMetadata()
+	for i := 0; i < 2; {
+		packet, err := dec.packets.next()
+		if err != nil {
+			return ErrNotOpus
+		}
+		if packet.serial != c.serial {
+			continue
+		}
+
+		switch i {
+		case 0:
+			head, err = parseOpusHead(packet.data)
+		case 1:
+			if len(packet.data) < 8 || string(packet.data[:8]) != "OpusTags" {
+				err = errOpusHeader
+			} else {
+				parseVorbisComment(packet.data[8:], tags)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		i++
+	}
+	if head.family == 1 && head.channels > len(vorbisChannelOrder) {
+		return ErrUnsupportedFormat
+	}
+
+	dec.chain = chain
+	dec.head = head
+	dec.streams = newOpusMultistreamDecoder(head.channels, head.streams, head.coupled, head.mapping)
+	dec.audioStart = dec.pages.pos
+	dec.reset()
+
+	dec.metaLock.Lock()
+	dec.meta.Title, dec.meta.Artist, dec.meta.Album = tags.Title, tags.Artist, tags.Album
+	dec.metaLock.Unlock()
+	return nil
+}
+
+func (dec *opusDecoder) reset() {
+	dec.streams.reset()
+	dec.pending = dec.pending[:0]
+	dec.nextGranule = -1
+}
+
+func (dec *opusDecoder) nativeFormat() *PCMWaveFormat {
+	return &PCMWaveFormat{
+		NumChannels: uint16(dec.channels),
+		SampleRate:  OPUS_RATE,
+		SampleDepth: 32,
+		PCMType:     PCM_TYPE_FLOAT,
+	}
+}
+
+func (dec *opusDecoder) metadata() Metadata {
+	dec.metaLock.Lock()
+	defer dec.metaLock.Unlock()
+	return dec.meta
+}
+
+func (dec *opusDecoder) close() error {
+	return dec.file.Close()
+}
+
+func (dec *opusDecoder) decode() ([]float64, int64, error) {
+	for len(dec.ready) == 0 {
+		packet, err := dec.packets.next()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if packet.bos && isOpusHead(packet.data) {
+			// a chained stream begins
+			err = dec.enterChainAt(packet.pageOffset)
+			if err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		if packet.serial != dec.chains[dec.chain].serial {
+			continue
+		}
+
+		// a damaged packet is dropped, the granule position of its page
+		// keeps the rest in place
+		samples, err := dec.streams.decode(packet.data)
+		if err == nil {
+			dec.pending = append(dec.pending, opusChunk{samples, 0})
+		}
+		if packet.granule != OGG_NO_GRANULE {
+			dec.place(packet.granule, packet.eos)
+		}
+	}
+
+	chunk := dec.ready[0]
+	dec.ready = dec.ready[1:]
+	return chunk.samples, chunk.frame, nil
+}
+
+// enterChainAt moves on to the chain starting at offset, as found while
+// reading sequentially
+func (dec *opusDecoder) enterChainAt(offset int64) error {
+	for i, c := range dec.chains {
+		if c.start == offset {
+			err := dec.enterChain(i)
+			if err != nil {
+				return err
+			}
+			return dec.packets.seekTo(dec.audioStart)
+		}
+	}
+	return nil
+}
+
+// place timestamps the pending packets now that the granule position of the
+// last one is known, dropping the pre-skip at the start of the stream and
+// anything past the end of the final page
+func (dec *opusDecoder) place(granule int64, eos bool) {
+	channels := int64(dec.head.channels)
+	total := int64(0)
+	for _, chunk := range dec.pending {
+		total += int64(len(chunk.samples)) / channels
+	}
+
+	start := dec.nextGranule
+	if start < 0 {
+		start = granule - total
+	}
+
+	end := start + total
+	if eos && granule < end {
+		end = max(granule, start)
+	}
+
+	pos := start
+	for _, chunk := range dec.pending {
+		samples := chunk.samples
+		frames := int64(len(samples)) / channels
+
+		from, to := max(pos, dec.head.preSkip), min(pos+frames, end)
+		pos += frames
+		if from >= to {
+			continue
+		}
+		samples = samples[(from-(pos-frames))*channels : (to-(pos-frames))*channels]
+
+		frame := dec.chains[dec.chain].firstSample + from - dec.head.preSkip
+		dec.ready = append(dec.ready, opusChunk{dec.convert(samples), frame})
+	}
+
+	dec.pending = dec.pending[:0]
+	dec.nextGranule = end
+}
+
+// convert applies the output gain and puts the channels into WAVE order,
+// adapting chains with a different layout to the first
+func (dec *opusDecoder) convert(samples []float64) []float64 {
+	channels := dec.head.channels
+	out := make([]float64, len(samples))
+	if dec.head.family == 0 || dec.head.family == 1 {
+		order := vorbisChannelOrder[channels-1]
+		for i := 0; i+channels <= len(samples); i += channels {
+			for ch, from := range order {
+				out[i+ch] = samples[i+from] * dec.head.gain
+			}
+		}
+	} else {
+		for i, v := range samples {
+			out[i] = v * dec.head.gain
+		}
+	}
+
+	if channels != dec.channels {
+		out = remapChannels(out, channels, dec.channels)
+	}
+	return out
+}
+
+func (dec *opusDecoder) seek(frame int64) error {
+	chain := 0
+	for i, c := range dec.chains {
+		if c.firstSample <= frame {
+			chain = i
+		}
+	}
+
+	if chain != dec.chain {
+		err := dec.enterChain(chain)
+		if err != nil {
+			return err
+		}
+	}
+	dec.reset()
+	dec.ready = dec.ready[:0]
+
+	// start far enough back for the decoder to converge by the target
+	c := &dec.chains[chain]
+	target := frame - c.firstSample + dec.head.preSkip - OPUS_SEEK_PREROLL
+	offset := dec.audioStart
+	if target > 0 {
+		var err error
+		offset, err = bisectOggGranule(dec.pages, c.serial, dec.audioStart, c.end, target)
+		if err != nil {
+			return err
+		}
+	}
+
+	return dec.packets.seekTo(offset)
+}
+
+func createOpusAudioSourceFromFile(metadata *Metadata) (AudioSource, error) {
+	dec, err := openOpus(metadata.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDecodedSource(dec), nil
+}
+
+func getOpusFileMetadata(path string) (*Metadata, error) {
+	dec, err := openOpus(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.file.Close()
+
+	metadata := dec.metadata()
+	return &metadata, nil
+}
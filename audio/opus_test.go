@@ -0,0 +1,228 @@
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// opusPackets is a stream of 20 ms CELT frames in runs of ten, runs of silence
+// taking turns with runs of arbitrary frames. The range coder reads any bytes
+// as a frame, and one whose bits are all set codes silence.
+func opusPackets(count int, channels int) [][]byte {
+	r := rand.New(rand.NewSource(1))
+	toc := byte(31<<3 | (channels-1)<<2)
+	packets := make([][]byte, count)
+	for i := range packets {
+		frame := make([]byte, 80)
+		if i/10%2 == 0 {
+			for j := range frame {
+				frame[j] = 0xFF
+			}
+		} else {
+			r.Read(frame)
+		}
+		packets[i] = append([]byte{toc}, frame...)
+	}
+	return packets
+}
+
+// opusTestSamples returns the samples a single frame packet holds at 48 kHz
+func opusTestSamples(packet []byte) int {
+	switch config := int(packet[0] >> 3); {
+	case config < 12:
+		return []int{480, 960, 1920, 2880}[config%4]
+	case config < 16:
+		return []int{480, 960}[config%2]
+	default:
+		return []int{120, 240, 480, 960}[config%4]
+	}
+}
+
+// opusSILKStream makes up count mono packets of SILK frames at fsKHz, of the
+// durations given in turn, those hybrid picks coded as hybrid packets whose
+// CELT layer is left no bits and so is silent. It returns the packets and
+// the reference decoding of them at 48 kHz.
+func opusSILKStream(t *testing.T, fsKHz int, count int, durations []int, hybrid func(i int) bool) ([][]byte, []float64) {
+	t.Helper()
+	bandwidth := map[int]int{8: 0, 12: 1, 16: 2}[fsKHz]
+	src := &silkTestSource{fsKHz: fsKHz, gainIndex: 10}
+	ref := newSILKReference(fsKHz)
+
+	var packets [][]byte
+	for i := 0; i < count; i++ {
+		ms := durations[i%len(durations)]
+		frames, subframes := max(ms/20, 1), min(ms/5, SILK_MAX_SUBFRAMES)
+		durationIndex := map[int]int{10: 0, 20: 1, 40: 2, 60: 3}[ms]
+
+		// a hybrid packet ends where the SILK frame's bits do, so one
+		// without a code ending on a byte is made up again
+		for attempt := 0; ; attempt++ {
+			saved := *src
+			src.r = rand.New(rand.NewSource(int64(fsKHz<<24 + i<<8 + attempt)))
+			var fs []*silkTestFrame
+			for j := 0; j < frames; j++ {
+				fs = append(fs, src.frame(subframes, j > 0))
+			}
+
+			e := newRangeEncoder()
+			for _, f := range fs {
+				e.encodeBitLogp(f.signalType != SILK_TYPE_INACTIVE, 1)
+			}
+			e.encodeBitLogp(false, 1)
+			for j, f := range fs {
+				writeSILKFrame(e, f, fsKHz, subframes, j > 0, j > 0 && fs[j-1].signalType == SILK_TYPE_VOICED)
+			}
+
+			var toc byte
+			var code []byte
+			if hybrid != nil && hybrid(i) {
+				var ok bool
+				if code, ok = e.finish(e.tell() / 8); !ok {
+					*src = saved
+					continue
+				}
+				toc = byte(12+2*src.r.Intn(2)+durationIndex) << 3
+			} else {
+				code = e.done()
+				toc = byte(4*bandwidth+durationIndex) << 3
+			}
+			packets = append(packets, append([]byte{toc}, code...))
+
+			for j, f := range fs {
+				ref.decode(f, subframes, j > 0)
+			}
+			break
+		}
+	}
+
+	// the output is a sample behind, for the stereo unmixing mono skips
+	out := ref.output()
+	delayed := append([]float64{0}, out[:len(out)-1]...)
+	want := silkRefResample(delayed, fsKHz)
+	for i := range want {
+		want[i] /= 32768
+	}
+	return packets, want
+}
+
+// writeOpus writes packets as an Ogg Opus stream, its last page claiming
+// trim fewer samples than were coded
+func writeOpus(t *testing.T, path string, channels int, preSkip int, gain int16, packets [][]byte, trim int64) {
+	t.Helper()
+	head := []byte("OpusHead\x01")
+	head = append(head, byte(channels))
+	head = binary.LittleEndian.AppendUint16(head, uint16(preSkip))
+	head = binary.LittleEndian.AppendUint32(head, 44100)
+	head = binary.LittleEndian.AppendUint16(head, uint16(gain))
+	head = append(head, 0)
+	tags := append([]byte("OpusTags"), vorbisComment("TITLE=Song", "ALBUM=Record")...)
+
+	granules := make([]int64, len(packets))
+	var granule int64
+	for i, packet := range packets {
+		granule += int64(opusTestSamples(packet))
+		granules[i] = granule
+	}
+	granules[len(granules)-1] -= trim
+
+	data := muxOgg(99, [][]byte{head, tags}, packets, granules, 1)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOggOpus(t *testing.T) {
+	dir := t.TempDir()
+	for _, channels := range []int{1, 2} {
+		const preSkip, trim = 312, 500
+		path := filepath.Join(dir, "a.opus")
+		packets := opusPackets(1000, channels)
+		writeOpus(t, path, channels, preSkip, -3*256, packets, trim)
+
+		dec, err := openOpus(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total := int64(len(packets)*960 - preSkip - trim)
+		checkFormat(t, dec, channels, OPUS_RATE, total)
+		if m := dec.metadata(); m.Title != "Song" || m.Album != "Record" {
+			t.Fatalf("metadata %+v", m)
+		}
+
+		// the stream is the packets less the pre-skip and the end trimmed
+		// off
+		all := decodeAll(t, dec)
+		if int64(len(all)) != total*int64(channels) {
+			t.Fatalf("%d samples, expected %d", len(all)/channels, total)
+		}
+
+		// silence leads, short of the bias de-emphasis keeps off denormals,
+		// and the noise that follows is heard
+		checkSamples(t, "silence", all, make([]float64, (10*960-preSkip)*channels), 1e-20)
+		if peak := math.Abs(all[(10*960-preSkip+500)*channels]); peak == 0 {
+			t.Fatal("nothing after the silence")
+		}
+
+		// a seek rolls back into the silence before the frame sought, so the
+		// decoder is where it was when reading straight through
+		var targets []int64
+		for _, frame := range []int64{0, 10, 210, 530, 990} {
+			targets = append(targets, max(frame*960-preSkip, 0))
+		}
+		checkSeek(t, dec, all, 1e-9, targets...)
+		dec.close()
+	}
+}
+
+func TestOggOpusSILK(t *testing.T) {
+	dir := t.TempDir()
+	for _, test := range []struct {
+		what      string
+		fsKHz     int
+		durations []int
+		hybrid    func(i int) bool
+	}{
+		{"narrowband", 8, []int{10, 20, 40, 60}, nil},
+		{"mediumband", 12, []int{60, 40, 20, 10}, nil},
+		{"wideband", 16, []int{20, 60, 10, 40}, nil},
+		// SILK carries on from wideband packets to hybrid ones and back
+		{"hybrid", 16, []int{20, 10, 20, 20, 10}, func(i int) bool { return i/4%2 == 1 }},
+	} {
+		const preSkip, trim = 1000, 300
+		path := filepath.Join(dir, "a.opus")
+		packets, want := opusSILKStream(t, test.fsKHz, 60, test.durations, test.hybrid)
+		writeOpus(t, path, 1, preSkip, 2*256, packets, trim)
+
+		dec, err := openOpus(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total := int64(len(want) - preSkip - trim)
+		checkFormat(t, dec, 1, OPUS_RATE, total)
+
+		// the stream is the reference decoding less the pre-skip and the end
+		// trimmed off, at the output gain. The decoder's fixed point rounds
+		// its filters a little differently, which resonant ones make heard.
+		all := decodeAll(t, dec)
+		if int64(len(all)) != total {
+			t.Fatalf("%s: %d samples, expected %d", test.what, len(all), total)
+		}
+		want = want[preSkip : int64(preSkip)+total]
+		gain := math.Pow(10, 2.0/20)
+		var power, errPower float64
+		for i := range want {
+			want[i] *= gain
+			power += want[i] * want[i]
+			errPower += (all[i] - want[i]) * (all[i] - want[i])
+		}
+		checkSamples(t, test.what, all, want, 4e-3)
+		if snr := 10 * math.Log10(power/errPower); snr < 40 {
+			t.Fatalf("%s: %.1f dB from the reference", test.what, snr)
+		}
+		dec.close()
+	}
+}
@@ -0,0 +1,487 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+const (
+	DECODE_BLOCK_FRAMES = 4096
+
+	// the highest stream rate accepted, well past any real recording, so a
+	// corrupt header cannot ask for an enormous resampling filter
+	MAX_SAMPLE_RATE = 768000
+
+	RESAMPLER_PHASES    = 256
+	RESAMPLER_HALF_TAPS = 16
+	RESAMPLER_KAISER_B  = 8.0
+	RESAMPLER_CUTOFF    = 0.95
+	// the kernel widens with the downsampling ratio up to this many taps a
+	// side, enough for MAX_SAMPLE_RATE down to 48kHz
+	RESAMPLER_MAX_HALF_TAPS = 16 * RESAMPLER_HALF_TAPS
+)
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported sample format")
+)
+
+// frameDecoder is implemented by the native decoders. Samples are returned
+// interleaved, as float64 in [-1, 1), in the stream's own rate and layout.
+type frameDecoder interface {
+	// nativeFormat describes the stream as it is stored in the file
+	nativeFormat() *PCMWaveFormat
+
+	// decode returns the next block of samples along with the index of its
+	// first frame. io.EOF is returned once the stream is exhausted.
+	decode() (samples []float64, frame int64, err error)
+
+	// seek moves the decoder to a block at or before frame. Any extra frames
+	// are discarded by the caller.
+	seek(frame int64) error
+
+	metadata() Metadata
+
+	// close releases the file the decoder reads from
+	close() error
+}
+
+// rateSelector is implemented by decoders that can produce more than one
+// sample rate themselves, such as DSD which is decimated to PCM as it plays
+type rateSelector interface {
+	// selectRate switches the decoder to the rate it supports that is best
+	// suited to producing rate, returning the resulting native format. The
+	// decoder must be seeked before decoding at a new rate.
+	selectRate(rate uint32) *PCMWaveFormat
+}
+
+// decodedSource adapts a frameDecoder to the AudioSource interface. It
+// converts the decoded samples to the requested PCMWaveFormat, remapping
+// channels and resampling as needed.
+type decodedSource struct {
+	dec    frameDecoder
+	native *PCMWaveFormat
+	out    *PCMWaveFormat
+
+	resampler *resampler
+
+	// first frame (in native frames) the caller wants after a seek
+	skipTo int64
+	// position of the next output frame, in output frames
+	outFrame int64
+
+	reachedEOF bool
+}
+
+func newDecodedSource(dec frameDecoder) *decodedSource {
+	native := dec.nativeFormat()
+	out := *native
+	return &decodedSource{dec: dec, native: native, out: &out}
+}
+
+func (s *decodedSource) ReadNext() (data []byte, tstamp int, err error) {
+	for {
+		if s.reachedEOF {
+			return nil, 0, io.EOF
+		}
+
+		samples, frame, err := s.dec.decode()
+		if err == io.EOF {
+			s.reachedEOF = true
+			if s.resampler == nil {
+				return nil, 0, io.EOF
+			}
+			samples = s.resampler.flush()
+		} else if err != nil {
+			return nil, 0, err
+		} else {
+			samples = s.trimToSkip(samples, frame)
+			samples = remapChannels(samples, int(s.native.NumChannels), int(s.out.NumChannels))
+			if s.resampler != nil {
+				samples = s.resampler.process(samples)
+			}
+		}
+
+		if len(samples) == 0 {
+			continue
+		}
+
+		tstamp = int(s.outFrame * SECOND / int64(s.out.SampleRate))
+		s.outFrame += int64(len(samples) / int(s.out.NumChannels))
+
+		data = make([]byte, len(samples)*int(s.out.SampleDepth/8))
+		encodeSamples(data, samples, s.out)
+		return data, tstamp, nil
+	}
+}
+
+// trimToSkip drops the frames preceding a seek target
+func (s *decodedSource) trimToSkip(samples []float64, frame int64) []float64 {
+	if frame >= s.skipTo {
+		return samples
+	}
+
+	channels := int64(s.native.NumChannels)
+	skip := (s.skipTo - frame) * channels
+	if skip >= int64(len(samples)) {
+		return samples[:0]
+	}
+	return samples[skip:]
+}
+
+func (s *decodedSource) SetPosition(pos int64) error {
+	if pos < 0 {
+		pos = 0
+	}
+
+	frame := pos * int64(s.native.SampleRate) / SECOND
+	err := s.dec.seek(frame)
+	if err != nil {
+		return err
+	}
+
+	s.skipTo = frame
+	s.outFrame = pos * int64(s.out.SampleRate) / SECOND
+	s.reachedEOF = false
+	if s.resampler != nil {
+		s.resampler.reset()
+	}
+
+	return nil
+}
+
+func (s *decodedSource) SetPCMWaveFormat(format *PCMWaveFormat) error {
+	if !isSupportedFormat(format) {
+		return ErrUnsupportedFormat
+	}
+
+	if selector, ok := s.dec.(rateSelector); ok {
+		old := s.native.SampleRate
+		pos := s.outFrame * SECOND / int64(s.out.SampleRate)
+		s.native = selector.selectRate(format.SampleRate)
+		if s.native.SampleRate != old {
+			// the decoder restarts at the new rate from where playback was
+			frame := pos * int64(s.native.SampleRate) / SECOND
+			if err := s.dec.seek(frame); err != nil {
+				return err
+			}
+			s.skipTo = frame
+			s.outFrame = pos * int64(format.SampleRate) / SECOND
+			s.reachedEOF = false
+		}
+	}
+
+	out := *format
+	s.out = &out
+
+	if s.out.SampleRate != s.native.SampleRate {
+		s.resampler = newResampler(int(s.native.SampleRate), int(s.out.SampleRate), int(s.out.NumChannels))
+	} else {
+		s.resampler = nil
+	}
+
+	return nil
+}
+
+func (s *decodedSource) GetPCMWaveFormat() (*PCMWaveFormat, error) {
+	out := *s.out
+	return &out, nil
+}
+
+func (s *decodedSource) GetMetadata() Metadata {
+	return s.dec.metadata()
+}
+
+func (s *decodedSource) Close() error {
+	return s.dec.close()
+}
+
+func isSupportedFormat(format *PCMWaveFormat) bool {
+	if format == nil || format.NumChannels == 0 || format.SampleRate == 0 || format.SampleRate > MAX_SAMPLE_RATE {
+		return false
+	}
+
+	switch format.PCMType {
+	case PCM_TYPE_INT:
+		switch format.SampleDepth {
+		case 8, 16, 24, 32:
+			return true
+		}
+	case PCM_TYPE_FLOAT:
+		switch format.SampleDepth {
+		case 32, 64:
+			return true
+		}
+	}
+
+	return false
+}
+
+// decodeSamples converts raw little-endian PCM into float samples. dst must
+// hold one value per sample in src.
+func decodeSamples(dst []float64, src []byte, format *PCMWaveFormat) {
+	width := int(format.SampleDepth / 8)
+	n := len(src) / width
+	if n > len(dst) {
+		n = len(dst)
+	}
+
+	switch {
+	case format.PCMType == PCM_TYPE_FLOAT && width == 4:
+		for i := 0; i < n; i++ {
+			dst[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(src[i*4:])))
+		}
+	case format.PCMType == PCM_TYPE_FLOAT && width == 8:
+		for i := 0; i < n; i++ {
+			dst[i] = math.Float64frombits(binary.LittleEndian.Uint64(src[i*8:]))
+		}
+	case width == 1:
+		for i := 0; i < n; i++ {
+			dst[i] = float64(int(src[i])-128) / 128
+		}
+	case width == 2:
+		for i := 0; i < n; i++ {
+			dst[i] = float64(int16(binary.LittleEndian.Uint16(src[i*2:]))) / (1 << 15)
+		}
+	case width == 3:
+		for i := 0; i < n; i++ {
+			b := src[i*3:]
+			v := int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+			dst[i] = float64(v) / (1 << 23)
+		}
+	case width == 4:
+		for i := 0; i < n; i++ {
+			dst[i] = float64(int32(binary.LittleEndian.Uint32(src[i*4:]))) / (1 << 31)
+		}
+	}
+}
+
+// encodeSamples converts float samples into raw little-endian PCM. dst must
+// hold len(src) samples of the given format.
+func encodeSamples(dst []byte, src []float64, format *PCMWaveFormat) {
+	width := int(format.SampleDepth / 8)
+
+	switch {
+	case format.PCMType == PCM_TYPE_FLOAT && width == 4:
+		for i, v := range src {
+			binary.LittleEndian.PutUint32(dst[i*4:], math.Float32bits(float32(v)))
+		}
+	case format.PCMType == PCM_TYPE_FLOAT && width == 8:
+		for i, v := range src {
+			binary.LittleEndian.PutUint64(dst[i*8:], math.Float64bits(v))
+		}
+	case width == 1:
+		for i, v := range src {
+			dst[i] = byte(quantize(v, 8) + 128)
+		}
+	case width == 2:
+		for i, v := range src {
+			binary.LittleEndian.PutUint16(dst[i*2:], uint16(quantize(v, 16)))
+		}
+	case width == 3:
+		for i, v := range src {
+			q := quantize(v, 24)
+			dst[i*3] = byte(q)
+			dst[i*3+1] = byte(q >> 8)
+			dst[i*3+2] = byte(q >> 16)
+		}
+	case width == 4:
+		for i, v := range src {
+			binary.LittleEndian.PutUint32(dst[i*4:], uint32(quantize(v, 32)))
+		}
+	}
+}
+
+// quantize scales a float sample to a signed integer of the given depth,
+// rounding to nearest and clipping to the representable range
+func quantize(v float64, bits uint) int64 {
+	scale := float64(int64(1) << (bits - 1))
+	q := math.Round(v * scale)
+	if q >= scale {
+		return int64(scale) - 1
+	} else if q < -scale {
+		return -int64(scale)
+	}
+	return int64(q)
+}
+
+// remapChannels converts interleaved samples between channel counts. Layouts
+// are assumed to follow the WAVE channel order (L, R, C, LFE, BL, BR, ...).
+func remapChannels(samples []float64, in, out int) []float64 {
+	if in == out {
+		return samples
+	}
+
+	frames := len(samples) / in
+	dst := make([]float64, frames*out)
+
+	switch {
+	case in == 1:
+		for f := 0; f < frames; f++ {
+			for c := 0; c < out; c++ {
+				dst[f*out+c] = samples[f]
+			}
+		}
+	case out == 1:
+		for f := 0; f < frames; f++ {
+			sum := 0.0
+			for c := 0; c < in; c++ {
+				sum += samples[f*in+c]
+			}
+			dst[f] = sum / float64(in)
+		}
+	case out == 2 && in > 2:
+		// fold centre and surrounds into the front pair, skipping LFE
+		const mix = math.Sqrt2 / 2
+		hasCentre := in == 3 || in >= 5
+		surround := 4
+		switch in {
+		case 4:
+			surround = 2
+		case 5:
+			surround = 3
+		}
+
+		gain := 1.0
+		if hasCentre {
+			gain += mix
+		}
+		if surround < in {
+			gain += mix * float64((in-surround)/2)
+		}
+
+		for f := 0; f < frames; f++ {
+			frame := samples[f*in : f*in+in]
+			l, r := frame[0], frame[1]
+			if hasCentre {
+				l += mix * frame[2]
+				r += mix * frame[2]
+			}
+			for c := surround; c+1 < in; c += 2 {
+				l += mix * frame[c]
+				r += mix * frame[c+1]
+			}
+			dst[f*2] = l / gain
+			dst[f*2+1] = r / gain
+		}
+	default:
+		for f := 0; f < frames; f++ {
+			copy(dst[f*out:f*out+out], samples[f*in:f*in+min(in, out)])
+		}
+	}
+
+	return dst
+}
+
+// resampler converts between sample rates with a Kaiser-windowed sinc
+// filter. Filter phases are precomputed and linearly interpolated.
+type resampler struct {
+	channels int
+	step     float64 // input frames per output frame
+	halfTaps int
+
+	table [][]float64
+
+	history []float64 // interleaved input frames not yet consumed
+	pos     float64   // read position into history, in frames
+}
+
+func newResampler(inRate, outRate, channels int) *resampler {
+	r := &resampler{channels: channels, step: float64(inRate) / float64(outRate)}
+
+	// widen the kernel when downsampling so it also acts as the anti-alias filter
+	cutoff := RESAMPLER_CUTOFF
+	if r.step > 1 {
+		cutoff /= r.step
+	}
+	r.halfTaps = min(int(math.Ceil(RESAMPLER_HALF_TAPS*math.Max(1, r.step))), RESAMPLER_MAX_HALF_TAPS)
+
+	r.table = make([][]float64, RESAMPLER_PHASES+1)
+	for p := range r.table {
+		frac := float64(p) / RESAMPLER_PHASES
+		taps := make([]float64, 2*r.halfTaps)
+		for i := range taps {
+			x := float64(i-r.halfTaps+1) - frac
+			taps[i] = cutoff * sinc(cutoff*x) * kaiser(x/float64(r.halfTaps), RESAMPLER_KAISER_B)
+		}
+		r.table[p] = taps
+	}
+
+	r.reset()
+	return r
+}
+
+func (r *resampler) reset() {
+	// prime with silence so the first output frame lines up with the first input frame
+	r.history = make([]float64, (r.halfTaps-1)*r.channels)
+	r.pos = float64(r.halfTaps - 1)
+}
+
+func (r *resampler) process(samples []float64) []float64 {
+	r.history = append(r.history, samples...)
+	frames := len(r.history) / r.channels
+
+	out := make([]float64, 0, int(float64(len(samples))/r.step)+r.channels)
+	for {
+		base := int(r.pos)
+		if base+r.halfTaps >= frames {
+			break
+		}
+
+		phase := (r.pos - float64(base)) * RESAMPLER_PHASES
+		p := int(phase)
+		blend := phase - float64(p)
+		lo, hi := r.table[p], r.table[p+1]
+
+		start := base - r.halfTaps + 1
+		for c := 0; c < r.channels; c++ {
+			acc := 0.0
+			for i := range lo {
+				tap := lo[i] + (hi[i]-lo[i])*blend
+				acc += tap * r.history[(start+i)*r.channels+c]
+			}
+			out = append(out, acc)
+		}
+
+		r.pos += r.step
+	}
+
+	// drop frames that no longer fall under the kernel
+	drop := int(r.pos) - r.halfTaps + 1
+	if drop > 0 {
+		r.history = append(r.history[:0], r.history[drop*r.channels:]...)
+		r.pos -= float64(drop)
+	}
+
+	return out
+}
+
+// flush pushes the filter tail out once the input is exhausted
+func (r *resampler) flush() []float64 {
+	return r.process(make([]float64, r.halfTaps*r.channels))
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	x *= math.Pi
+	return math.Sin(x) / x
+}
+
+func kaiser(x float64, beta float64) float64 {
+	if x < -1 || x > 1 {
+		return 0
+	}
+	return besselI0(beta*math.Sqrt(1-x*x)) / besselI0(beta)
+}
+
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; k < 32; k++ {
+		term *= (x / (2 * float64(k))) * (x / (2 * float64(k)))
+		sum += term
+	}
+	return sum
+}
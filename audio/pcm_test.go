@@ -0,0 +1,94 @@
+package audio
+
+import (
+	"errors"
+	"io"
+	"math"
+	"testing"
+)
+
+// decodeAll reads dec through to the end, failing if a block does not start
+// where the one before it left off
+func decodeAll(t *testing.T, dec frameDecoder) []float64 {
+	t.Helper()
+	ch := int64(dec.nativeFormat().NumChannels)
+	var all []float64
+	for {
+		samples, frame, err := dec.decode()
+		if errors.Is(err, io.EOF) {
+			return all
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if frame != int64(len(all))/ch {
+			t.Fatalf("block at frame %d, expected %d", frame, int64(len(all))/ch)
+		}
+		all = append(all, samples...)
+	}
+}
+
+// checkFormat fails unless dec holds frames of audio at the given rate and
+// channel count
+func checkFormat(t *testing.T, dec frameDecoder, ch, rate int, frames int64) {
+	t.Helper()
+	format := dec.nativeFormat()
+	if int(format.NumChannels) != ch || int(format.SampleRate) != rate {
+		t.Fatalf("format %+v, expected %d channels at %d", *format, ch, rate)
+	}
+	if want := uint64(frames * SECOND / int64(rate)); dec.metadata().Duration != want {
+		t.Fatalf("duration %d, expected %d", dec.metadata().Duration, want)
+	}
+}
+
+// checkSamples fails if any of got is further than tol from want
+func checkSamples(t *testing.T, what string, got, want []float64, tol float64) {
+	t.Helper()
+	if len(got) < len(want) {
+		t.Fatalf("%s: %d samples, expected %d", what, len(got), len(want))
+	}
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > tol {
+			t.Fatalf("%s: sample %d is %v, expected %v", what, i, got[i], want[i])
+		}
+	}
+}
+
+// checkSeek seeks dec to each of frames, checking it picks up the stream as
+// all has it, all being the stream decoded straight through
+func checkSeek(t *testing.T, dec frameDecoder, all []float64, tol float64, frames ...int64) {
+	t.Helper()
+	ch := int64(dec.nativeFormat().NumChannels)
+	for _, target := range frames {
+		if err := dec.seek(target); err != nil {
+			t.Fatalf("seek to %d: %v", target, err)
+		}
+		want := all[min(target*ch, int64(len(all))):]
+		want = want[:min(len(want), 1024*int(ch))]
+
+		var got []float64
+		for len(got) < len(want) {
+			samples, frame, err := dec.decode()
+			if err != nil {
+				t.Fatalf("after seek to %d: %v", target, err)
+			}
+			if got == nil {
+				if frame > target {
+					t.Fatalf("seek to %d landed on %d", target, frame)
+				}
+				samples = samples[min((target-frame)*ch, int64(len(samples))):]
+			}
+			got = append(got, samples...)
+		}
+		checkSamples(t, "after seek", got, want, tol)
+	}
+}
+
+// ramp is a signal of small steps, exact in any sample depth down to 8 bits
+func ramp(f, c int) float64 {
+	return float64((f*7+c*31)%256-128) / 128
+}
+
+// constant is a signal holding v
+func constant(v float64) func(f, c int) float64 {
+	return func(f, c int) float64 { return v }
+}
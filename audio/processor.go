@@ -0,0 +1,354 @@
+package audio
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	PROCESSOR_FADE = 10 * time.Millisecond // how long a processor takes to fade in or out of the chain
+)
+
+var (
+	ErrProcessorNotFound = errors.New("processor not in chain")
+	ErrProcessorAdded    = errors.New("processor already in chain")
+)
+
+// Processor transforms audio on its way from the decoders to the client, as
+// part of a player's chain. The chain never calls a processor's methods at
+// the same time, nor calls into the player while it holds the chain.
+type Processor interface {
+	// Configure prepares for audio in format, before any is processed and
+	// again whenever the format changes
+	Configure(format *PCMWaveFormat) error
+
+	// Process transforms interleaved samples in place, full scale being ±1
+	Process(samples []float64)
+
+	// Latency is how many frames the output of Process lags behind its
+	// input, fixed once configured
+	Latency() int
+
+	// Reset forgets the audio processed so far, as after a seek
+	Reset()
+}
+
+// AddProcessor fades processor in at the end of the chain
+func (p *Player) AddProcessor(processor Processor) error {
+	return p.chain.insert(-1, processor)
+}
+
+// InsertProcessor fades processor in at index in the chain, or at its end if
+// index is out of range. A processor just removed and still fading out fades
+// back in where it was.
+func (p *Player) InsertProcessor(index int, processor Processor) error {
+	return p.chain.insert(index, processor)
+}
+
+// RemoveProcessor fades processor out of the chain and drops it
+func (p *Player) RemoveProcessor(processor Processor) error {
+	return p.chain.edit(processor, func(s *processorSlot) {
+		s.removed = true
+	})
+}
+
+// BypassProcessor fades processor out of the chain if bypass is set, leaving
+// its place, or back in if not
+func (p *Player) BypassProcessor(processor Processor, bypass bool) error {
+	return p.chain.edit(processor, func(s *processorSlot) {
+		s.bypassed = bypass
+	})
+}
+
+// Processors returns the chain in order, bypassed processors included. The
+// player's volume control is not part of it, always coming after the chain.
+func (p *Player) Processors() []Processor {
+	p.chain.mutex.Lock()
+	defer p.chain.mutex.Unlock()
+
+	processors := make([]Processor, 0, len(p.chain.slots))
+	for _, s := range p.chain.slots {
+		if !s.removed && !s.pinned {
+			processors = append(processors, s.processor)
+		}
+	}
+	return processors
+}
+
+// processorChain runs audio through processors in order. It may be changed
+// from any goroutine while the player thread runs audio through it.
+type processorChain struct {
+	mutex  sync.Mutex
+	slots  []*processorSlot
+	format *PCMWaveFormat
+	fade   int // frames a processor takes to fade in or out
+
+	held int // frames taken in and not yet given out
+}
+
+// processorSlot is a processor's place in a chain. The processor is mixed
+// with its input delayed by as much as the processor delays it, so that
+// fading it in or out never makes the audio jump.
+type processorSlot struct {
+	processor Processor
+	latency   int
+	bypassed  bool
+	removed   bool
+	pinned    bool // kept at the end of the chain, out of reach of edits
+
+	active bool      // if audio runs through the processor
+	mix    float64   // how much of the processor's output is heard
+	dry    []float64 // input waiting to line up with the processor's output
+	prime  int       // frames of output to drop, the processor not having had input for them
+}
+
+// configure prepares each processor for audio in format, dropping those that
+// cannot take it
+func (c *processorChain) configure(format *PCMWaveFormat) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.format = format
+	c.fade = int(int64(PROCESSOR_FADE/100) * int64(format.SampleRate) / SECOND)
+
+	var errs []error
+	c.slots = slices.DeleteFunc(c.slots, func(s *processorSlot) bool {
+		if err := s.processor.Configure(format); err != nil {
+			errs = append(errs, err)
+			return true
+		}
+		s.latency = s.processor.Latency()
+		s.active = false
+		return false
+	})
+	c.resetLocked()
+	return errors.Join(errs...)
+}
+
+// insert configures processor and fades it in at index, or at the end if
+// index is out of range
+func (c *processorChain) insert(index int, processor Processor) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.find(processor) != nil {
+		return ErrProcessorAdded
+	}
+	for _, s := range c.slots {
+		if s.processor == processor {
+			// still fading out; fade it back in where it was
+			s.removed, s.bypassed = false, false
+			return nil
+		}
+	}
+	if c.format != nil {
+		if err := processor.Configure(c.format); err != nil {
+			return err
+		}
+	}
+
+	slot := &processorSlot{processor: processor, latency: processor.Latency()}
+	if c.format == nil {
+		// not yet playing, so heard from the start
+		slot.mix = 1
+	}
+
+	// index counts the processors still in the chain, which all come before
+	// those pinned to its end
+	at := len(c.slots)
+	for i, s := range c.slots {
+		if index == 0 || s.pinned {
+			at = i
+			break
+		}
+		if !s.removed {
+			index--
+		}
+	}
+	c.slots = slices.Insert(c.slots, at, slot)
+	return nil
+}
+
+// pin puts processor at the end of the chain for good, after any inserted
+// before or after it. It is to be pinned before the chain is configured.
+func (c *processorChain) pin(processor Processor) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.slots = append(c.slots, &processorSlot{processor: processor, latency: processor.Latency(), mix: 1, pinned: true})
+}
+
+// edit changes the slot holding processor
+func (c *processorChain) edit(processor Processor, change func(*processorSlot)) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	s := c.find(processor)
+	if s == nil || s.pinned {
+		return ErrProcessorNotFound
+	}
+	change(s)
+	return nil
+}
+
+func (c *processorChain) find(processor Processor) *processorSlot {
+	for _, s := range c.slots {
+		if s.processor == processor && !s.removed {
+			return s
+		}
+	}
+	return nil
+}
+
+// heldFrames is how many frames the chain has taken in and not given out
+func (c *processorChain) heldFrames() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.held
+}
+
+// process runs data through the chain, returning what comes out, which is
+// shorter while processors fill up and longer as they are faded out
+func (c *processorChain) process(data []byte) []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !slices.ContainsFunc(c.slots, (*processorSlot).running) {
+		// nothing to do; leave the audio untouched
+		return data
+	}
+
+	channels := int(c.format.NumChannels)
+	frameSize := channels * int(c.format.SampleDepth/8)
+	samples := make([]float64, len(data)/frameSize*channels)
+	decodeSamples(samples, data, c.format)
+
+	samples = c.run(samples)
+	c.held += len(data)/frameSize - len(samples)/channels
+
+	out := make([]byte, len(samples)/channels*frameSize)
+	encodeSamples(out, samples, c.format)
+	return out
+}
+
+// flush gives out all the chain holds, as though its input had ended, and
+// readies it for audio that does not follow on from it
+func (c *processorChain) flush() []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.held == 0 {
+		return nil
+	}
+
+	// each processor gives out as much as its latency once fed silence
+	channels := int(c.format.NumChannels)
+	frameSize := channels * int(c.format.SampleDepth/8)
+	latency := 0
+	for _, s := range c.slots {
+		if s.active {
+			latency += s.latency
+		}
+	}
+	samples := c.run(make([]float64, latency*channels))
+	samples = samples[:min(c.held*channels, len(samples))]
+
+	out := make([]byte, len(samples)/channels*frameSize)
+	encodeSamples(out, samples, c.format)
+	c.resetLocked()
+	return out
+}
+
+// reset throws away the audio the chain holds, as after a seek
+func (c *processorChain) reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.resetLocked()
+}
+
+func (c *processorChain) resetLocked() {
+	c.slots = slices.DeleteFunc(c.slots, func(s *processorSlot) bool {
+		return s.removed
+	})
+	for _, s := range c.slots {
+		// fades under way are finished at once
+		s.mix = s.target()
+		s.active = false
+	}
+	c.held = 0
+}
+
+// run passes samples through each slot in turn, dropping the slots that
+// have faded out of the chain
+func (c *processorChain) run(samples []float64) []float64 {
+	channels := int(c.format.NumChannels)
+	for _, s := range c.slots {
+		samples = s.run(samples, channels, c.fade)
+	}
+	c.slots = slices.DeleteFunc(c.slots, func(s *processorSlot) bool {
+		return s.removed && !s.running()
+	})
+	return samples
+}
+
+// target is how much of the processor's output is to be heard
+func (s *processorSlot) target() float64 {
+	if s.bypassed || s.removed {
+		return 0
+	}
+	return 1
+}
+
+// running reports whether audio is to run through the processor
+func (s *processorSlot) running() bool {
+	return s.active || s.mix > 0 || s.target() > 0
+}
+
+// run mixes the processor's output over samples, moving towards its target
+// by 1/fade each frame
+func (s *processorSlot) run(samples []float64, channels, fade int) []float64 {
+	if !s.running() {
+		return samples
+	}
+	if !s.active {
+		s.processor.Reset()
+		s.dry = make([]float64, s.latency*channels)
+		s.prime = s.latency
+		s.active = true
+	}
+
+	wet := append([]float64(nil), samples...)
+	s.processor.Process(wet)
+
+	s.dry = append(s.dry, samples...)
+	dry := s.dry[:len(samples)]
+	s.dry = s.dry[len(samples):]
+
+	target, step := s.target(), 1/float64(max(fade, 1))
+	frames := len(samples) / channels
+	for f := 0; f < frames; f++ {
+		if f >= s.prime {
+			if s.mix < target {
+				s.mix = min(s.mix+step, target)
+			} else {
+				s.mix = max(s.mix-step, target)
+			}
+		}
+		for i := f * channels; i < (f+1)*channels; i++ {
+			wet[i] = dry[i] + s.mix*(wet[i]-dry[i])
+		}
+	}
+
+	// the first output has nothing of the input in it
+	n := min(s.prime, frames)
+	wet = wet[n*channels:]
+	s.prime -= n
+
+	if s.mix == 0 && target == 0 {
+		// faded out; what is waiting to line up goes out behind it
+		wet = append(wet, s.dry[s.prime*channels:]...)
+		s.dry, s.prime, s.active = nil, 0, false
+	}
+	return wet
+}
@@ -0,0 +1,254 @@
+package audio
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// delayProcessor delays audio by a number of frames and scales it by a gain,
+// refusing anything but floating point audio if floatOnly is set
+type delayProcessor struct {
+	delay     int
+	gain      float64
+	floatOnly bool
+	channels  int
+	buf       []float64
+	resets    int
+}
+
+func (d *delayProcessor) Configure(format *PCMWaveFormat) error {
+	if d.floatOnly && format.PCMType != PCM_TYPE_FLOAT {
+		return ErrUnsupportedFormat
+	}
+	d.channels = int(format.NumChannels)
+	d.Reset()
+	return nil
+}
+
+func (d *delayProcessor) Process(samples []float64) {
+	queue := append(d.buf, samples...)
+	for i := range samples {
+		samples[i] = queue[i] * d.gain
+	}
+	d.buf = append([]float64(nil), queue[len(samples):]...)
+}
+
+func (d *delayProcessor) Latency() int {
+	return d.delay
+}
+
+func (d *delayProcessor) Reset() {
+	d.buf = make([]float64, d.delay*d.channels)
+	d.resets++
+}
+
+// floatFormat holds samples as they are worked on, so nothing is lost
+// between the chain's processors and the test
+var floatFormat = &PCMWaveFormat{1, 48000, 64, PCM_TYPE_FLOAT}
+
+func floatBytes(samples []float64) []byte {
+	out := make([]byte, len(samples)*8)
+	encodeSamples(out, samples, floatFormat)
+	return out
+}
+
+func floatSamples(data []byte) []float64 {
+	out := make([]float64, len(data)/8)
+	decodeSamples(out, data, floatFormat)
+	return out
+}
+
+// fadeMix is how much of a processor is heard at frame f of the audio, when
+// it starts fading from one mix to another at frame start over fade frames
+func fadeMix(f, start, fade int, from, to float64) float64 {
+	if f < start {
+		return from
+	}
+	step := float64(f-start+1) / float64(fade)
+	if to > from {
+		return min(from+step, to)
+	}
+	return max(from-step, to)
+}
+
+func TestProcessorChainEdits(t *testing.T) {
+	const block, fade = 256, 480 // PROCESSOR_FADE at 48kHz
+	r := rand.New(rand.NewSource(3))
+	input := make([]float64, 50*block)
+	for i := range input {
+		input[i] = r.Float64()*2 - 1
+	}
+
+	var chain processorChain
+	a := &delayProcessor{delay: 100, gain: 0.5}
+	b := &delayProcessor{delay: 37, gain: 2}
+	if err := chain.insert(-1, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.configure(floatFormat); err != nil {
+		t.Fatal(err)
+	}
+	if chain.fade != fade {
+		t.Fatalf("fades over %d frames", chain.fade)
+	}
+
+	// the chain is edited between blocks, each edit taking effect from the
+	// first frame a processor gives out after it. The chain gives out every
+	// frame it takes in, in order, each at the mix of both processors.
+	var output []float64
+	fed := 0
+	feed := func(blocks int, held int) {
+		t.Helper()
+		for i := 0; i < blocks; i++ {
+			output = append(output, floatSamples(chain.process(floatBytes(input[fed:fed+block])))...)
+			fed += block
+		}
+		if chain.heldFrames() != held || len(output) != fed-held {
+			t.Fatalf("at frame %d: %d frames out, %d held, expected %d held", fed, len(output), chain.heldFrames(), held)
+		}
+	}
+
+	// a, there from the start, is heard whole once it has filled
+	feed(10, 100)
+	// b fades in ahead of a, holding back its own latency
+	if err := chain.insert(0, b); err != nil {
+		t.Fatal(err)
+	}
+	bIn := fed
+	feed(10, 137)
+	// a fades out while bypassed, then gives out what it held
+	if err := chain.edit(a, func(s *processorSlot) { s.bypassed = true }); err != nil {
+		t.Fatal(err)
+	}
+	aOut := fed - 137
+	feed(10, 37)
+	// b fades out and is dropped, and with nothing running the audio is
+	// passed through untouched
+	if err := chain.edit(b, func(s *processorSlot) { s.removed = true }); err != nil {
+		t.Fatal(err)
+	}
+	bOut := fed - 37
+	feed(10, 0)
+	if len(chain.slots) != 1 {
+		t.Fatalf("%d slots left", len(chain.slots))
+	}
+	data := floatBytes(input[:block])
+	if out := chain.process(data); &out[0] != &data[0] {
+		t.Fatal("audio copied with nothing running")
+	}
+	// a comes back, filling up from silence again
+	resets := a.resets
+	if err := chain.edit(a, func(s *processorSlot) { s.bypassed = false }); err != nil {
+		t.Fatal(err)
+	}
+	aIn := fed
+	feed(10, 100)
+	if a.resets != resets+1 {
+		t.Fatalf("a reset %d times on coming back", a.resets-resets)
+	}
+	// and what it holds comes out at the end
+	output = append(output, floatSamples(chain.flush())...)
+	if len(output) != len(input) || chain.heldFrames() != 0 {
+		t.Fatalf("%d frames out of %d, %d held", len(output), len(input), chain.heldFrames())
+	}
+
+	want := make([]float64, len(input))
+	for f, v := range input {
+		mixB := fadeMix(f, bIn, fade, 0, 1)
+		if f >= bOut {
+			mixB = fadeMix(f, bOut, fade, 1, 0)
+		}
+		mixA := fadeMix(f, aOut, fade, 1, 0)
+		if f >= aIn {
+			mixA = fadeMix(f, aIn, fade, 0, 1)
+		}
+		v *= 1 + mixB*(b.gain-1)
+		want[f] = v * (1 + mixA*(a.gain-1))
+	}
+	checkSamples(t, "chain", output, want, 1e-12)
+}
+
+func TestProcessorChainFlush(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	input := make([]float64, 1000)
+	for i := range input {
+		input[i] = r.Float64()*2 - 1
+	}
+
+	// each of several latent processors holds frames back, and all of them
+	// come out at a flush, after which the chain fills up again
+	var chain processorChain
+	delays := []*delayProcessor{{delay: 30, gain: 1}, {delay: 1, gain: -1}, {delay: 200, gain: 0.25}}
+	for _, d := range delays {
+		chain.insert(-1, d)
+	}
+	chain.configure(floatFormat)
+	for run := 0; run < 2; run++ {
+		out := floatSamples(chain.process(floatBytes(input)))
+		if len(out) != len(input)-231 || chain.heldFrames() != 231 {
+			t.Fatalf("run %d: %d frames out, %d held", run, len(out), chain.heldFrames())
+		}
+		out = append(out, floatSamples(chain.flush())...)
+		want := make([]float64, len(input))
+		for i, v := range input {
+			want[i] = -0.25 * v
+		}
+		checkSamples(t, "flushed", out, want, 1e-15)
+		if len(out) != len(input) || chain.heldFrames() != 0 {
+			t.Fatalf("run %d: %d frames after flush, %d held", run, len(out), chain.heldFrames())
+		}
+	}
+
+	// a reset throws away what is held instead
+	chain.process(floatBytes(input))
+	chain.reset()
+	if out := chain.flush(); chain.heldFrames() != 0 || len(out) != 0 {
+		t.Fatalf("%d frames held, %d flushed after a reset", chain.heldFrames(), len(out)/8)
+	}
+}
+
+func TestProcessorChainOrder(t *testing.T) {
+	var chain processorChain
+	a, b, c, d := &delayProcessor{gain: 1, floatOnly: true}, &delayProcessor{gain: 1, floatOnly: true}, &delayProcessor{gain: 1, floatOnly: true}, &delayProcessor{gain: 1, floatOnly: true}
+	chain.insert(-1, a)
+	chain.insert(0, b)
+	chain.insert(1, c)
+	if err := chain.insert(1, a); err != ErrProcessorAdded {
+		t.Fatalf("adding a twice: error %v", err)
+	}
+	if err := chain.configure(floatFormat); err != nil {
+		t.Fatal(err)
+	}
+	order := func() []Processor {
+		var out []Processor
+		for _, s := range chain.slots {
+			out = append(out, s.processor)
+		}
+		return out
+	}
+	if got := order(); len(got) != 3 || got[0] != b || got[1] != c || got[2] != a {
+		t.Fatalf("order %v", got)
+	}
+
+	// a processor fading out keeps its place until it has gone, and comes
+	// back to it if added again meanwhile. Indices count only the processors
+	// still in the chain.
+	chain.edit(c, func(s *processorSlot) { s.removed = true })
+	if err := chain.edit(c, func(s *processorSlot) {}); err != ErrProcessorNotFound {
+		t.Fatalf("editing a removed processor: error %v", err)
+	}
+	chain.insert(1, d)
+	if got := order(); len(got) != 4 || got[1] != d || got[2] != c {
+		t.Fatalf("order %v", got)
+	}
+	chain.insert(-1, c)
+	if got := order(); len(got) != 4 || got[2] != c || chain.slots[2].removed {
+		t.Fatalf("order %v", got)
+	}
+
+	// processors that cannot take a format are dropped when it is set
+	err := chain.configure(&PCMWaveFormat{2, 44100, 16, PCM_TYPE_INT})
+	if err == nil || len(chain.slots) != 0 {
+		t.Fatalf("error %v with %d slots left", err, len(chain.slots))
+	}
+}
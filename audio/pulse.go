@@ -0,0 +1,673 @@
+//go:build linux
+
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// PulseAudio native protocol, which PipeWire's pulse server also speaks
+const (
+	PULSE_PROTOCOL_VERSION = 32
+	PULSE_MIN_VERSION      = 13 // first with property lists
+	PULSE_VERSION_MASK     = 0xFFFF
+
+	PULSE_DESCRIPTOR_SIZE = 20
+	PULSE_CONTROL_CHANNEL = 0xFFFFFFFF
+	PULSE_MAX_PACKET      = 16 * 1024 * 1024
+	PULSE_MAX_BLOCK       = 64 * 1024 // most audio sent in one packet
+	PULSE_COOKIE_LENGTH   = 256
+	PULSE_INVALID_INDEX   = 0xFFFFFFFF
+	PULSE_VOLUME_NORM     = 0x10000
+
+	PULSE_BUFFER_DURATION = SECOND / 5  // 200 ms
+	PULSE_MINREQ_DURATION = SECOND / 50 // 20 ms
+	PULSE_TIMEOUT         = 5 * time.Second
+	PULSE_DEFAULT_RATE    = 48000
+)
+
+const (
+	PULSE_COMMAND_ERROR                  = 0
+	PULSE_COMMAND_REPLY                  = 2
+	PULSE_COMMAND_CREATE_PLAYBACK_STREAM = 3
+	PULSE_COMMAND_DELETE_PLAYBACK_STREAM = 4
+	PULSE_COMMAND_AUTH                   = 8
+	PULSE_COMMAND_SET_CLIENT_NAME        = 9
+	PULSE_COMMAND_CORK_PLAYBACK_STREAM   = 41
+	PULSE_COMMAND_FLUSH_PLAYBACK_STREAM  = 42
+	PULSE_COMMAND_REQUEST                = 61
+	PULSE_COMMAND_PLAYBACK_STREAM_KILLED = 64
+)
+
+// types of the values in a control packet
+const (
+	PULSE_TAG_STRING      = 't'
+	PULSE_TAG_STRING_NULL = 'N'
+	PULSE_TAG_U32         = 'L'
+	PULSE_TAG_U8          = 'B'
+	PULSE_TAG_SAMPLE_SPEC = 'a'
+	PULSE_TAG_ARBITRARY   = 'x'
+	PULSE_TAG_TRUE        = '1'
+	PULSE_TAG_FALSE       = '0'
+	PULSE_TAG_CHANNEL_MAP = 'm'
+	PULSE_TAG_CVOLUME     = 'v'
+	PULSE_TAG_PROPLIST    = 'P'
+)
+
+const (
+	PULSE_SAMPLE_S16LE     = 3
+	PULSE_SAMPLE_FLOAT32LE = 5
+	PULSE_SAMPLE_S32LE     = 7
+
+	PULSE_CHANNEL_MONO        = 0
+	PULSE_CHANNEL_FRONT_LEFT  = 1
+	PULSE_CHANNEL_FRONT_RIGHT = 2
+)
+
+var (
+	ErrNoPulseServer     = errors.New("no PulseAudio server socket found")
+	ErrPulseProtocol     = errors.New("malformed PulseAudio packet")
+	ErrPulseVersion      = errors.New("PulseAudio server is too old")
+	ErrPulseTimeout      = errors.New("PulseAudio server did not reply")
+	ErrPulseStreamKilled = errors.New("PulseAudio server killed the playback stream")
+	ErrPulseFormat       = errors.New("PulseAudio server chose an unsupported sample format")
+)
+
+// error codes the server replies with
+var pulseErrors = map[uint32]string{
+	1:  "access denied",
+	2:  "unknown command",
+	3:  "invalid argument",
+	4:  "entity exists",
+	5:  "no such entity",
+	6:  "connection refused",
+	7:  "protocol error",
+	8:  "timeout",
+	9:  "no authentication key",
+	10: "internal error",
+	11: "connection terminated",
+	12: "entity killed",
+	13: "invalid server",
+	15: "bad state",
+	16: "no data",
+	17: "incompatible protocol version",
+	18: "too large",
+	19: "not supported",
+}
+
+type PulseError struct {
+	Code uint32
+}
+
+func (e *PulseError) Error() string {
+	if msg, ok := pulseErrors[e.Code]; ok {
+		return "pulseaudio: " + msg
+	}
+	return fmt.Sprintf("pulseaudio: error %d", e.Code)
+}
+
+func init() {
+	RegisterBackend(&Backend{
+		Name: "pulseaudio",
+		Initialize: func() error {
+			if findPulseSocket() == "" {
+				return ErrNoPulseServer
+			}
+			return nil
+		},
+		NewClient: func() (AudioClient, error) {
+			client, err := getDefaultPulseClient()
+			if err != nil {
+				return nil, err
+			}
+			return client, nil
+		},
+	})
+}
+
+// pulseTags holds the tagged values of a control packet, read or written in
+// order
+type pulseTags struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (t *pulseTags) putU32(v uint32) {
+	t.data = append(t.data, PULSE_TAG_U32)
+	t.data = binary.BigEndian.AppendUint32(t.data, v)
+}
+
+func (t *pulseTags) putU8(v uint8) {
+	t.data = append(t.data, PULSE_TAG_U8, v)
+}
+
+func (t *pulseTags) putBool(v bool) {
+	if v {
+		t.data = append(t.data, PULSE_TAG_TRUE)
+	} else {
+		t.data = append(t.data, PULSE_TAG_FALSE)
+	}
+}
+
+// putString writes a null terminated string, or the null string if s is
+// empty
+func (t *pulseTags) putString(s string) {
+	if s == "" {
+		t.data = append(t.data, PULSE_TAG_STRING_NULL)
+		return
+	}
+	t.data = append(t.data, PULSE_TAG_STRING)
+	t.data = append(t.data, s...)
+	t.data = append(t.data, 0)
+}
+
+func (t *pulseTags) putArbitrary(b []byte) {
+	t.data = append(t.data, PULSE_TAG_ARBITRARY)
+	t.data = binary.BigEndian.AppendUint32(t.data, uint32(len(b)))
+	t.data = append(t.data, b...)
+}
+
+func (t *pulseTags) putSampleSpec(format uint8, channels uint8, rate uint32) {
+	t.data = append(t.data, PULSE_TAG_SAMPLE_SPEC, format, channels)
+	t.data = binary.BigEndian.AppendUint32(t.data, rate)
+}
+
+func (t *pulseTags) putChannelMap(positions ...uint8) {
+	t.data = append(t.data, PULSE_TAG_CHANNEL_MAP, uint8(len(positions)))
+	t.data = append(t.data, positions...)
+}
+
+func (t *pulseTags) putCVolume(volumes ...uint32) {
+	t.data = append(t.data, PULSE_TAG_CVOLUME, uint8(len(volumes)))
+	for _, v := range volumes {
+		t.data = binary.BigEndian.AppendUint32(t.data, v)
+	}
+}
+
+// putProplist writes properties as null terminated strings, in the order
+// given by keys
+func (t *pulseTags) putProplist(keys []string, props map[string]string) {
+	t.data = append(t.data, PULSE_TAG_PROPLIST)
+	for _, k := range keys {
+		t.putString(k)
+		t.putU32(uint32(len(props[k]) + 1))
+		t.putArbitrary(append([]byte(props[k]), 0))
+	}
+	t.data = append(t.data, PULSE_TAG_STRING_NULL)
+}
+
+// next checks that the next value has the tag given and n bytes after it,
+// returning them
+func (t *pulseTags) next(tag byte, n int) []byte {
+	if t.err != nil || t.pos+1+n > len(t.data) || t.data[t.pos] != tag {
+		t.err = ErrPulseProtocol
+		return make([]byte, n)
+	}
+	b := t.data[t.pos+1 : t.pos+1+n]
+	t.pos += 1 + n
+	return b
+}
+
+func (t *pulseTags) u32() uint32 {
+	return binary.BigEndian.Uint32(t.next(PULSE_TAG_U32, 4))
+}
+
+func (t *pulseTags) sampleSpec() (format uint8, channels uint8, rate uint32) {
+	b := t.next(PULSE_TAG_SAMPLE_SPEC, 6)
+	return b[0], b[1], binary.BigEndian.Uint32(b[2:])
+}
+
+type pulseReply struct {
+	tags *pulseTags
+	err  error
+}
+
+// PulseAudioClient plays one stream through a PulseAudio or PipeWire server
+type PulseAudioClient struct {
+	conn       *net.UnixConn
+	writeMutex sync.Mutex
+
+	mutex   sync.Mutex // guards what the reader goroutine touches
+	tag     uint32
+	pending map[uint32]chan pulseReply
+	err     error
+
+	// bytes the server has asked for and not yet been sent
+	requested int
+
+	version    uint32
+	channel    uint32
+	format     PCMWaveFormat
+	frameSize  int
+	bufferSize int // in bytes
+	playing    bool
+}
+
+func getDefaultPulseClient() (*PulseAudioClient, error) {
+	path := findPulseSocket()
+	if path == "" {
+		return nil, ErrNoPulseServer
+	}
+	return dialPulse(path, PULSE_DEFAULT_RATE)
+}
+
+// findPulseSocket returns the server in PULSE_SERVER if it is a local one,
+// or else the first socket found where servers usually listen
+func findPulseSocket() string {
+	if server := os.Getenv("PULSE_SERVER"); server != "" {
+		for _, s := range strings.Fields(server) {
+			// entries may be scoped to a machine with a {id} prefix
+			if i := strings.Index(s, "}"); strings.HasPrefix(s, "{") && i > 0 {
+				s = s[i+1:]
+			}
+			s = strings.TrimPrefix(s, "unix:")
+			if strings.HasPrefix(s, "/") {
+				return s
+			}
+		}
+		return ""
+	}
+
+	runtime := os.Getenv("XDG_RUNTIME_DIR")
+	if runtime == "" {
+		runtime = fmt.Sprintf("/run/user/%d", os.Getuid())
+	}
+	for _, path := range []string{filepath.Join(runtime, "pulse", "native"), "/var/run/pulse/native"} {
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			return path
+		}
+	}
+	return ""
+}
+
+// readPulseCookie returns the key servers authenticate clients with, or
+// zeros if there is none, which servers that check credentials accept
+func readPulseCookie() []byte {
+	paths := make([]string, 0)
+	if env := os.Getenv("PULSE_COOKIE"); env != "" {
+		paths = append(paths, env)
+	}
+	if config, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(config, "pulse", "cookie"))
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".pulse-cookie"))
+	}
+
+	for _, path := range paths {
+		if cookie, err := os.ReadFile(path); err == nil && len(cookie) >= PULSE_COOKIE_LENGTH {
+			return cookie[:PULSE_COOKIE_LENGTH]
+		}
+	}
+	return make([]byte, PULSE_COOKIE_LENGTH)
+}
+
+// dialPulse connects to the server listening on the socket at path and
+// opens a corked stereo stream, at the sink's own rate if it lets us choose
+func dialPulse(path string, rate uint32) (*PulseAudioClient, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+
+	c := &PulseAudioClient{conn: conn, pending: make(map[uint32]chan pulseReply)}
+	go c.readLoop()
+
+	if err := c.connect(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := c.createStream(rate); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *PulseAudioClient) connect() error {
+	// credentials let the server trust a client run by the same user
+	creds := syscall.UnixCredentials(&syscall.Ucred{
+		Pid: int32(os.Getpid()),
+		Uid: uint32(os.Getuid()),
+		Gid: uint32(os.Getgid()),
+	})
+
+	auth := &pulseTags{}
+	auth.putU32(PULSE_PROTOCOL_VERSION)
+	auth.putArbitrary(readPulseCookie())
+	reply, err := c.request(PULSE_COMMAND_AUTH, auth, creds)
+	if err != nil {
+		return err
+	}
+	c.version = min(reply.u32()&PULSE_VERSION_MASK, PULSE_PROTOCOL_VERSION)
+	if reply.err != nil {
+		return reply.err
+	}
+	if c.version < PULSE_MIN_VERSION {
+		return ErrPulseVersion
+	}
+
+	name := &pulseTags{}
+	name.putProplist([]string{"application.name", "application.process.id"}, map[string]string{
+		"application.name":       "maestro",
+		"application.process.id": fmt.Sprint(os.Getpid()),
+	})
+	_, err = c.request(PULSE_COMMAND_SET_CLIENT_NAME, name, nil)
+	return err
+}
+
+func (c *PulseAudioClient) createStream(rate uint32) error {
+	bufferSize := uint32(int64(rate) * 8 * PULSE_BUFFER_DURATION / SECOND)
+	minreq := uint32(int64(rate) * 8 * PULSE_MINREQ_DURATION / SECOND)
+
+	t := &pulseTags{}
+	t.putSampleSpec(PULSE_SAMPLE_FLOAT32LE, 2, rate)
+	t.putChannelMap(PULSE_CHANNEL_FRONT_LEFT, PULSE_CHANNEL_FRONT_RIGHT)
+	t.putU32(PULSE_INVALID_INDEX) // default sink
+	t.putString("")
+	t.putU32(PULSE_INVALID_INDEX) // largest buffer the server allows
+	t.putBool(true)               // start corked
+	t.putU32(bufferSize)
+	t.putU32(minreq) // prebuffer only enough to not underrun at once
+	t.putU32(minreq)
+	t.putU32(0) // sync group
+	t.putCVolume(PULSE_VOLUME_NORM, PULSE_VOLUME_NORM)
+
+	// remapping, remixing and fixed format, rate, channels, moving and
+	// variable rate; the rate is the sink's so nothing is resampled twice
+	for _, flag := range []bool{false, false, false, true, false, false, false} {
+		t.putBool(flag)
+	}
+
+	// muted and adjusting latency
+	t.putBool(false)
+	t.putBool(false)
+	t.putProplist([]string{"media.name", "media.role"}, map[string]string{
+		"media.name": "maestro",
+		"media.role": "music",
+	})
+	if c.version >= 14 {
+		// volume set and early requests
+		t.putBool(false)
+		t.putBool(false)
+	}
+	if c.version >= 15 {
+		// muted set, not inhibiting auto suspend and failing on suspend
+		t.putBool(false)
+		t.putBool(false)
+		t.putBool(false)
+	}
+	if c.version >= 17 {
+		t.putBool(false) // relative volume
+	}
+	if c.version >= 18 {
+		t.putBool(false) // passthrough
+	}
+	if c.version >= 21 {
+		t.putU8(0) // no formats, the sample spec is used
+	}
+
+	reply, err := c.request(PULSE_COMMAND_CREATE_PLAYBACK_STREAM, t, nil)
+	if err != nil {
+		return err
+	}
+	channel := reply.u32()
+	reply.u32() // sink input
+	missing := reply.u32()
+	reply.u32() // max length
+	length := reply.u32()
+	reply.u32() // prebuffer
+	reply.u32() // minimum request
+	format, channels, rate := reply.sampleSpec()
+	if reply.err != nil {
+		return reply.err
+	}
+
+	c.format = PCMWaveFormat{NumChannels: uint16(channels), SampleRate: rate}
+	switch format {
+	case PULSE_SAMPLE_FLOAT32LE:
+		c.format.SampleDepth, c.format.PCMType = 32, PCM_TYPE_FLOAT
+	case PULSE_SAMPLE_S32LE:
+		c.format.SampleDepth, c.format.PCMType = 32, PCM_TYPE_INT
+	case PULSE_SAMPLE_S16LE:
+		c.format.SampleDepth, c.format.PCMType = 16, PCM_TYPE_INT
+	default:
+		return ErrPulseFormat
+	}
+	if channels == 0 || rate == 0 {
+		return ErrPulseFormat
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.channel = channel
+	c.frameSize = int(c.format.NumChannels) * int(c.format.SampleDepth) / 8
+	c.bufferSize = int(length)
+	c.requested += int(missing)
+	return nil
+}
+
+// send writes a packet on a channel, the control channel or a stream's
+func (c *PulseAudioClient) send(channel uint32, payload []byte, oob []byte) error {
+	packet := make([]byte, PULSE_DESCRIPTOR_SIZE, PULSE_DESCRIPTOR_SIZE+len(payload))
+	binary.BigEndian.PutUint32(packet, uint32(len(payload)))
+	binary.BigEndian.PutUint32(packet[4:], channel)
+	// offset and flags are left zero, audio is written where the last ended
+	packet = append(packet, payload...)
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	_, _, err := c.conn.WriteMsgUnix(packet, oob, nil)
+	return err
+}
+
+// request sends a command and waits for the server's reply to it
+func (c *PulseAudioClient) request(command uint32, args *pulseTags, oob []byte) (*pulseTags, error) {
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		return nil, c.err
+	}
+	tag := c.tag
+	c.tag++
+	replies := make(chan pulseReply, 1)
+	c.pending[tag] = replies
+	c.mutex.Unlock()
+
+	t := &pulseTags{}
+	t.putU32(command)
+	t.putU32(tag)
+	t.data = append(t.data, args.data...)
+	if err := c.send(PULSE_CONTROL_CHANNEL, t.data, oob); err != nil {
+		c.fail(err)
+		return nil, err
+	}
+
+	select {
+	case reply, ok := <-replies:
+		if !ok {
+			return nil, c.failure()
+		}
+		return reply.tags, reply.err
+	case <-time.After(PULSE_TIMEOUT):
+		c.mutex.Lock()
+		delete(c.pending, tag)
+		c.mutex.Unlock()
+		return nil, ErrPulseTimeout
+	}
+}
+
+// readLoop handles what the server sends until the connection fails
+func (c *PulseAudioClient) readLoop() {
+	header := make([]byte, PULSE_DESCRIPTOR_SIZE)
+	for {
+		if _, err := io.ReadFull(c.conn, header); err != nil {
+			c.fail(err)
+			return
+		}
+		length := binary.BigEndian.Uint32(header)
+		if length > PULSE_MAX_PACKET {
+			c.fail(ErrPulseProtocol)
+			return
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.conn, payload); err != nil {
+			c.fail(err)
+			return
+		}
+
+		// a playback client is only ever sent commands
+		if binary.BigEndian.Uint32(header[4:]) == PULSE_CONTROL_CHANNEL {
+			c.dispatch(&pulseTags{data: payload})
+		}
+	}
+}
+
+func (c *PulseAudioClient) dispatch(t *pulseTags) {
+	command := t.u32()
+	tag := t.u32()
+	if t.err != nil {
+		return
+	}
+
+	switch command {
+	case PULSE_COMMAND_REPLY, PULSE_COMMAND_ERROR:
+		c.mutex.Lock()
+		replies, ok := c.pending[tag]
+		delete(c.pending, tag)
+		c.mutex.Unlock()
+		if !ok {
+			return
+		}
+		if command == PULSE_COMMAND_ERROR {
+			replies <- pulseReply{nil, &PulseError{t.u32()}}
+		} else {
+			replies <- pulseReply{t, nil}
+		}
+	case PULSE_COMMAND_REQUEST:
+		// there is only one stream, which the request may arrive before we
+		// know the channel of
+		t.u32()
+		bytes := t.u32()
+		if t.err == nil {
+			c.mutex.Lock()
+			c.requested += int(bytes)
+			c.mutex.Unlock()
+		}
+	case PULSE_COMMAND_PLAYBACK_STREAM_KILLED:
+		c.fail(ErrPulseStreamKilled)
+	}
+}
+
+// fail records the first error the connection hits and wakes everything
+// waiting on a reply
+func (c *PulseAudioClient) fail(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+	for tag, replies := range c.pending {
+		close(replies)
+		delete(c.pending, tag)
+	}
+}
+
+func (c *PulseAudioClient) failure() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err
+}
+
+func (c *PulseAudioClient) GetPCMWaveFormat() *PCMWaveFormat {
+	format := c.format
+	return &format
+}
+
+func (c *PulseAudioClient) GetBufferSize() (int, error) {
+	return c.bufferSize / c.frameSize, c.failure()
+}
+
+// GetBufferPadding is the number of frames queued, what the server has not
+// asked to be replaced
+func (c *PulseAudioClient) GetBufferPadding() (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	queued := Clamp(c.bufferSize-c.requested, 0, c.bufferSize)
+	return queued / c.frameSize, nil
+}
+
+func (c *PulseAudioClient) LoadToBuffer(data []byte) (int, error) {
+	data = data[:len(data)-len(data)%c.frameSize]
+	for sent := 0; sent < len(data); {
+		n := min(len(data)-sent, PULSE_MAX_BLOCK-PULSE_MAX_BLOCK%c.frameSize)
+		if err := c.send(c.channel, data[sent:sent+n], nil); err != nil {
+			c.fail(err)
+			return sent, err
+		}
+		sent += n
+
+		c.mutex.Lock()
+		c.requested -= n
+		c.mutex.Unlock()
+	}
+	return len(data), nil
+}
+
+// ClearBuffer drops what is queued, the server then asks for it again
+func (c *PulseAudioClient) ClearBuffer() error {
+	t := &pulseTags{}
+	t.putU32(c.channel)
+	_, err := c.request(PULSE_COMMAND_FLUSH_PLAYBACK_STREAM, t, nil)
+	return err
+}
+
+func (c *PulseAudioClient) cork(corked bool) error {
+	t := &pulseTags{}
+	t.putU32(c.channel)
+	t.putBool(corked)
+	_, err := c.request(PULSE_COMMAND_CORK_PLAYBACK_STREAM, t, nil)
+	return err
+}
+
+func (c *PulseAudioClient) Start() error {
+	if err := c.cork(false); err != nil {
+		return err
+	}
+	c.playing = true
+	return nil
+}
+
+func (c *PulseAudioClient) Stop() (bool, error) {
+	wasPlaying := c.playing
+	if err := c.cork(true); err != nil {
+		return wasPlaying, err
+	}
+	c.playing = false
+	return wasPlaying, nil
+}
+
+// Close deletes the stream and disconnects
+func (c *PulseAudioClient) Close() error {
+	t := &pulseTags{}
+	t.putU32(c.channel)
+	_, err := c.request(PULSE_COMMAND_DELETE_PLAYBACK_STREAM, t, nil)
+	if cerr := c.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
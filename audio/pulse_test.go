@@ -0,0 +1,626 @@
+//go:build linux
+
+package audio
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePulse is a stand-in PulseAudio server on a Unix socket, speaking enough
+// of the native protocol to host one playback stream per connection
+type fakePulse struct {
+	t        *testing.T
+	path     string
+	listener net.Listener
+
+	// fixed once made
+	version uint32
+	format  uint8
+	rate    uint32
+
+	mutex    sync.Mutex
+	conn     net.Conn
+	packets  []fakePacket
+	fail     map[uint32]uint32 // error code to reply to a command with
+	consume  bool              // play what is queued in real time once uncorked
+	cookie   []byte
+	creates  int
+	received []byte // audio sent on the stream
+	queued   int    // bytes received and not yet played
+	corked   bool
+	deleted  bool
+}
+
+// fakePacket is a command the server was sent
+type fakePacket struct {
+	command uint32
+	tag     uint32
+	types   string // the tags after the command and its tag
+}
+
+func newFakePulse(t *testing.T, version uint32, format uint8) *fakePulse {
+	// socket paths are short, too short for most test temporary directories
+	dir, err := os.MkdirTemp("", "pulse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	s := &fakePulse{
+		t:       t,
+		path:    filepath.Join(dir, "native"),
+		version: version,
+		format:  format,
+		rate:    44100,
+		fail:    make(map[uint32]uint32),
+	}
+	s.listener, err = net.Listen("unix", s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.listener.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *fakePulse) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.conn = conn
+		s.mutex.Unlock()
+		go s.handle(conn)
+		go s.play(conn)
+	}
+}
+
+// play asks for as much as it plays while consuming, every 10ms
+func (s *fakePulse) play(conn net.Conn) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mutex.Lock()
+		if s.conn != conn {
+			s.mutex.Unlock()
+			return
+		}
+		n := 0
+		if s.consume && !s.corked {
+			n = min(s.queued, int(s.rate)*8/100)
+			s.queued -= n
+		}
+		s.mutex.Unlock()
+		if n > 0 {
+			s.command(PULSE_COMMAND_REQUEST, 3, uint32(n))
+		}
+	}
+}
+
+func (s *fakePulse) write(payload []byte) {
+	s.mutex.Lock()
+	conn := s.conn
+	s.mutex.Unlock()
+	header := make([]byte, PULSE_DESCRIPTOR_SIZE)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:], PULSE_CONTROL_CHANNEL)
+	conn.Write(append(header, payload...))
+}
+
+// command sends a command of the server's own, untagged
+func (s *fakePulse) command(command uint32, args ...uint32) {
+	t := &pulseTags{}
+	t.putU32(command)
+	t.putU32(PULSE_INVALID_INDEX)
+	for _, a := range args {
+		t.putU32(a)
+	}
+	s.write(t.data)
+}
+
+func (s *fakePulse) reply(tag uint32, args *pulseTags) {
+	t := &pulseTags{}
+	t.putU32(PULSE_COMMAND_REPLY)
+	t.putU32(tag)
+	t.data = append(t.data, args.data...)
+	s.write(t.data)
+}
+
+// failNext makes the server reply to command with an error from now on
+func (s *fakePulse) failNext(command, code uint32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.fail[command] = code
+}
+
+// commands lists the commands received since the last call
+func (s *fakePulse) commands() []fakePacket {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	packets := s.packets
+	s.packets = nil
+	return packets
+}
+
+func (s *fakePulse) handle(conn net.Conn) {
+	header := make([]byte, PULSE_DESCRIPTOR_SIZE)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return
+		}
+
+		if channel := binary.BigEndian.Uint32(header[4:]); channel != PULSE_CONTROL_CHANNEL {
+			s.mutex.Lock()
+			if channel != 3 {
+				s.t.Errorf("audio sent on channel %d", channel)
+			}
+			s.received = append(s.received, payload...)
+			s.queued += len(payload)
+			s.mutex.Unlock()
+			continue
+		}
+
+		values, err := readTags(payload)
+		if err != nil || len(values) < 2 || values[0].tag != PULSE_TAG_U32 || values[1].tag != PULSE_TAG_U32 {
+			s.t.Errorf("malformed command: %v", err)
+			return
+		}
+		packet := fakePacket{command: values[0].u32, tag: values[1].u32}
+		for _, v := range values[2:] {
+			if v.tag == PULSE_TAG_TRUE || v.tag == PULSE_TAG_FALSE {
+				// booleans listed whichever they are
+				packet.types += "?"
+			} else {
+				packet.types += string(v.tag)
+			}
+		}
+		args := values[2:]
+
+		s.mutex.Lock()
+		s.packets = append(s.packets, packet)
+		code, fail := s.fail[packet.command]
+		s.mutex.Unlock()
+		if fail {
+			t := &pulseTags{}
+			t.putU32(PULSE_COMMAND_ERROR)
+			t.putU32(packet.tag)
+			t.putU32(code)
+			s.write(t.data)
+			continue
+		}
+
+		reply := &pulseTags{}
+		switch packet.command {
+		case PULSE_COMMAND_AUTH:
+			if packet.types == "Lx" {
+				s.mutex.Lock()
+				s.cookie = args[1].data
+				s.mutex.Unlock()
+			}
+			reply.putU32(s.version)
+		case PULSE_COMMAND_SET_CLIENT_NAME:
+			reply.putU32(12) // client index
+		case PULSE_COMMAND_CREATE_PLAYBACK_STREAM:
+			// the buffer attributes follow the sample spec, channel map,
+			// sink index and name
+			if len(args) < 9 {
+				s.t.Errorf("stream created with %q", packet.types)
+				return
+			}
+			maxLength, corked := args[4].u32, args[5].tag == PULSE_TAG_TRUE
+			length, prebuffer, minimum := args[6].u32, args[7].u32, args[8].u32
+			if maxLength != PULSE_INVALID_INDEX || !corked {
+				s.t.Errorf("stream max length %d, corked %v", maxLength, corked)
+			}
+			s.mutex.Lock()
+			s.creates++
+			s.corked = true
+			s.mutex.Unlock()
+
+			reply.putU32(3) // channel
+			reply.putU32(9) // sink input
+			reply.putU32(length)
+			reply.putU32(4 * 1024 * 1024)
+			reply.putU32(length)
+			reply.putU32(prebuffer)
+			reply.putU32(minimum)
+			reply.putSampleSpec(s.format, 2, s.rate)
+			reply.putChannelMap(PULSE_CHANNEL_FRONT_LEFT, PULSE_CHANNEL_FRONT_RIGHT)
+			reply.putU32(0)
+			reply.putString("sink")
+			reply.putBool(false)
+		case PULSE_COMMAND_CORK_PLAYBACK_STREAM:
+			s.mutex.Lock()
+			s.corked = args[len(args)-1].tag == PULSE_TAG_TRUE
+			s.mutex.Unlock()
+		case PULSE_COMMAND_FLUSH_PLAYBACK_STREAM:
+			// what is dropped is asked for again
+			s.mutex.Lock()
+			n := s.queued
+			s.queued = 0
+			s.mutex.Unlock()
+			s.reply(packet.tag, reply)
+			if n > 0 {
+				s.command(PULSE_COMMAND_REQUEST, 3, uint32(n))
+			}
+			continue
+		case PULSE_COMMAND_DELETE_PLAYBACK_STREAM:
+			s.mutex.Lock()
+			s.deleted = true
+			s.mutex.Unlock()
+		default:
+			t := &pulseTags{}
+			t.putU32(PULSE_COMMAND_ERROR)
+			t.putU32(packet.tag)
+			t.putU32(2) // unknown command
+			s.write(t.data)
+			continue
+		}
+		s.reply(packet.tag, reply)
+	}
+}
+
+// tagValue is a value read from a control packet
+type tagValue struct {
+	tag  byte
+	u32  uint32
+	data []byte // what follows the tag, but for the length of arbitrary data
+}
+
+// readTags splits a control packet into its values, failing if it is
+// malformed
+func readTags(b []byte) ([]tagValue, error) {
+	var values []tagValue
+	for len(b) > 0 {
+		v := tagValue{tag: b[0]}
+		b = b[1:]
+		n := 0
+		switch v.tag {
+		case PULSE_TAG_U32:
+			n = 4
+		case PULSE_TAG_U8:
+			n = 1
+		case PULSE_TAG_STRING_NULL, PULSE_TAG_TRUE, PULSE_TAG_FALSE:
+		case PULSE_TAG_STRING:
+			n = bytes.IndexByte(b, 0) + 1
+			if n == 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+		case PULSE_TAG_SAMPLE_SPEC:
+			n = 6
+		case PULSE_TAG_ARBITRARY:
+			if len(b) < 4 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			n = int(binary.BigEndian.Uint32(b))
+			b = b[4:]
+		case PULSE_TAG_CHANNEL_MAP, PULSE_TAG_CVOLUME:
+			if len(b) < 1 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			n = 1 + int(b[0])
+			if v.tag == PULSE_TAG_CVOLUME {
+				n = 1 + 4*int(b[0])
+			}
+		case PULSE_TAG_PROPLIST:
+			// keys, each followed by the length of its value and the value,
+			// up to a null string
+			for n < len(b) && b[n] != PULSE_TAG_STRING_NULL {
+				key := bytes.IndexByte(b[n:], 0)
+				if b[n] != PULSE_TAG_STRING || key < 0 || n+key+11 > len(b) {
+					return nil, errors.New("malformed property")
+				}
+				n += key + 1
+				if b[n] != PULSE_TAG_U32 || b[n+5] != PULSE_TAG_ARBITRARY {
+					return nil, errors.New("malformed property")
+				}
+				length := binary.BigEndian.Uint32(b[n+1:])
+				if binary.BigEndian.Uint32(b[n+6:]) != length {
+					return nil, errors.New("property length mismatch")
+				}
+				n += 10 + int(length)
+			}
+			n++
+		default:
+			return nil, fmt.Errorf("unknown tag %q", v.tag)
+		}
+		if n < 0 || n > len(b) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		v.data = b[:n]
+		if v.tag == PULSE_TAG_U32 {
+			v.u32 = binary.BigEndian.Uint32(v.data)
+		}
+		values = append(values, v)
+		b = b[n:]
+	}
+	return values, nil
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for " + what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPulseHandshake(t *testing.T) {
+	cookie := bytes.Repeat([]byte{0xA5}, PULSE_COOKIE_LENGTH)
+	cookiePath := filepath.Join(t.TempDir(), "cookie")
+	if err := os.WriteFile(cookiePath, cookie, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PULSE_COOKIE", cookiePath)
+
+	// the create request grows with the version the server speaks
+	base := "amLNL?LLLLv" + "???????" + "??" + "P"
+	for version, create := range map[uint32]string{
+		13: base,
+		14: base + "??",
+		15: base + "?????",
+		17: base + "??????",
+		18: base + "???????",
+		35: base + "???????B",
+	} {
+		s := newFakePulse(t, version, PULSE_SAMPLE_FLOAT32LE)
+		c, err := dialPulse(s.path, 48000)
+		if err != nil {
+			t.Fatalf("version %d: %v", version, err)
+		}
+		got := fmt.Sprint(s.commands())
+		want := fmt.Sprint([]fakePacket{
+			{PULSE_COMMAND_AUTH, 0, "Lx"},
+			{PULSE_COMMAND_SET_CLIENT_NAME, 1, "P"},
+			{PULSE_COMMAND_CREATE_PLAYBACK_STREAM, 2, create},
+		})
+		if got != want {
+			t.Fatalf("version %d: commands\n got %v\nwant %v", version, got, want)
+		}
+		s.mutex.Lock()
+		if !bytes.Equal(s.cookie, cookie) {
+			t.Fatalf("cookie % x", s.cookie[:8])
+		}
+		s.mutex.Unlock()
+
+		if format := c.GetPCMWaveFormat(); *format != (PCMWaveFormat{2, 44100, 32, PCM_TYPE_FLOAT}) {
+			t.Fatalf("format %+v", format)
+		}
+		// 200ms at the rate asked for
+		if size, err := c.GetBufferSize(); size != 48000/5 || err != nil {
+			t.Fatalf("buffer %d, %v", size, err)
+		}
+		c.Close()
+	}
+}
+
+func TestPulseStream(t *testing.T) {
+	s := newFakePulse(t, 35, PULSE_SAMPLE_S16LE)
+	c, err := dialPulse(s.path, 44100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.commands()
+	if *c.GetPCMWaveFormat() != (PCMWaveFormat{2, 44100, 16, PCM_TYPE_INT}) {
+		t.Fatalf("format %+v", c.GetPCMWaveFormat())
+	}
+	size, _ := c.GetBufferSize()
+
+	// the server asked for the whole buffer on creating the stream
+	if padding, err := c.GetBufferPadding(); padding != 0 || err != nil {
+		t.Fatalf("padding %d, %v", padding, err)
+	}
+	// whole frames are sent, split into blocks
+	data := make([]byte, size*4+3)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if n, err := c.LoadToBuffer(data); n != size*4 || err != nil {
+		t.Fatalf("loaded %d, %v", n, err)
+	}
+	if padding, _ := c.GetBufferPadding(); padding != size {
+		t.Fatalf("padding %d when full", padding)
+	}
+	waitFor(t, "audio", func() bool {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return len(s.received) == size*4
+	})
+	s.mutex.Lock()
+	if !bytes.Equal(s.received, data[:size*4]) {
+		t.Fatal("audio changed on the way")
+	}
+	s.mutex.Unlock()
+
+	// requests free up the buffer
+	s.command(PULSE_COMMAND_REQUEST, 3, 400)
+	waitFor(t, "request", func() bool {
+		padding, _ := c.GetBufferPadding()
+		return padding == size-100
+	})
+
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if playing, err := c.Stop(); !playing || err != nil {
+		t.Fatalf("stop: %v, %v", playing, err)
+	}
+	if err := c.ClearBuffer(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "flush", func() bool {
+		padding, _ := c.GetBufferPadding()
+		return padding == 0
+	})
+	got := fmt.Sprint(s.commands())
+	want := fmt.Sprint([]fakePacket{
+		{PULSE_COMMAND_CORK_PLAYBACK_STREAM, 3, "L?"},
+		{PULSE_COMMAND_CORK_PLAYBACK_STREAM, 4, "L?"},
+		{PULSE_COMMAND_FLUSH_PLAYBACK_STREAM, 5, "L"},
+	})
+	if got != want {
+		t.Fatalf("commands\n got %v\nwant %v", got, want)
+	}
+
+	// error replies come back as the server's code
+	s.failNext(PULSE_COMMAND_CORK_PLAYBACK_STREAM, 15)
+	var perr *PulseError
+	if err := c.Start(); !errors.As(err, &perr) || perr.Code != 15 || err.Error() != "pulseaudio: bad state" {
+		t.Fatalf("start: %v", err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.deleted {
+		t.Fatal("stream not deleted")
+	}
+}
+
+func TestPulseFailures(t *testing.T) {
+	// refused
+	s := newFakePulse(t, 35, PULSE_SAMPLE_FLOAT32LE)
+	s.failNext(PULSE_COMMAND_AUTH, 1)
+	var perr *PulseError
+	if _, err := dialPulse(s.path, 48000); !errors.As(err, &perr) || perr.Code != 1 {
+		t.Fatalf("refused auth: %v", err)
+	}
+	if _, err := dialPulse(newFakePulse(t, 12, PULSE_SAMPLE_FLOAT32LE).path, 48000); err != ErrPulseVersion {
+		t.Fatalf("old server: %v", err)
+	}
+	if _, err := dialPulse(newFakePulse(t, 35, 1).path, 48000); err != ErrPulseFormat {
+		t.Fatalf("unsupported format: %v", err)
+	}
+	if _, err := dialPulse(filepath.Join(t.TempDir(), "none"), 48000); err == nil {
+		t.Fatal("dialed nothing")
+	}
+
+	// the stream is killed
+	s = newFakePulse(t, 35, PULSE_SAMPLE_FLOAT32LE)
+	c, err := dialPulse(s.path, 48000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.command(PULSE_COMMAND_PLAYBACK_STREAM_KILLED, 3)
+	waitFor(t, "kill", func() bool {
+		_, err := c.GetBufferPadding()
+		return err != nil
+	})
+	if _, err := c.GetBufferPadding(); err != ErrPulseStreamKilled {
+		t.Fatal(err)
+	}
+	if err := c.Start(); err != ErrPulseStreamKilled {
+		t.Fatal(err)
+	}
+
+	// the server goes away
+	s = newFakePulse(t, 35, PULSE_SAMPLE_FLOAT32LE)
+	c, err = dialPulse(s.path, 48000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mutex.Lock()
+	s.conn.Close()
+	s.mutex.Unlock()
+	if err := c.Start(); err == nil {
+		t.Fatal("started with no server")
+	}
+}
+
+func TestPulseSocket(t *testing.T) {
+	t.Setenv("PULSE_SERVER", "{abc}unix:/tmp/x/native tcp:host")
+	if path := findPulseSocket(); path != "/tmp/x/native" {
+		t.Fatal(path)
+	}
+	t.Setenv("PULSE_SERVER", "tcp:localhost:4713")
+	if path := findPulseSocket(); path != "" {
+		t.Fatal(path)
+	}
+
+	s := newFakePulse(t, 35, PULSE_SAMPLE_FLOAT32LE)
+	runtime := t.TempDir()
+	os.Mkdir(filepath.Join(runtime, "pulse"), 0755)
+	os.Symlink(s.path, filepath.Join(runtime, "pulse", "native"))
+	t.Setenv("PULSE_SERVER", "")
+	t.Setenv("XDG_RUNTIME_DIR", runtime)
+	if path := findPulseSocket(); path != filepath.Join(runtime, "pulse", "native") {
+		t.Fatal(path)
+	}
+}
+
+// a player whose stream is killed plays on through a new one
+func TestPulseReconnect(t *testing.T) {
+	s := newFakePulse(t, 35, PULSE_SAMPLE_FLOAT32LE)
+	s.consume = true
+	a := filepath.Join(t.TempDir(), "a.wav")
+	writeWav(t, a, 2, 44100, 16, false, 44100*5, constant(0.25))
+
+	dial := func() (AudioClient, error) {
+		return dialPulse(s.path, 44100)
+	}
+	p, err := NewPlayer(WithClientFactory(dial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close(context.Background())
+	tp := newTap(p)
+	p.AddSourcesToQueue(a)
+	tp.waitQueued(t, 1)
+	p.Start()
+
+	received := func() int {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return len(s.received)
+	}
+	waitFor(t, "audio", func() bool { return received() > 44100*8/2 })
+
+	s.command(PULSE_COMMAND_PLAYBACK_STREAM_KILLED, 3)
+	var lost PlayerError
+	waitFor(t, "error", func() bool {
+		for _, e := range tp.drain() {
+			if pe, ok := e.(PlayerError); ok {
+				lost = pe
+				return true
+			}
+		}
+		return false
+	})
+	if lost.Kind != ERROR_DEVICE || !errors.Is(lost.Err, ErrPulseStreamKilled) {
+		t.Fatalf("error %+v", lost)
+	}
+
+	// reopened after RECONNECT_DELAY, uncorked and fed again
+	before := received()
+	waitFor(t, "reconnect", func() bool {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return s.creates == 2 && !s.corked
+	})
+	waitFor(t, "audio after reconnecting", func() bool { return received() > before+44100*8/2 })
+	if pos := p.GetPositionInTrack(); pos <= 0 {
+		t.Fatalf("position %d", pos)
+	}
+}
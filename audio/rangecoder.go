@@ -0,0 +1,224 @@
+package audio
+
+import "math/bits"
+
+const (
+	RANGE_CODE_BITS  = 32
+	RANGE_SYM_BITS   = 8
+	RANGE_CODE_TOP   = 1 << (RANGE_CODE_BITS - 1)
+	RANGE_CODE_BOT   = RANGE_CODE_TOP >> RANGE_SYM_BITS
+	RANGE_CODE_EXTRA = (RANGE_CODE_BITS-2)%RANGE_SYM_BITS + 1
+	RANGE_UINT_BITS  = 8
+
+	// resolution of rangeDecoder.tellFrac, in bits
+	RANGE_BITRES = 3
+)
+
+// rangeDecoder is the entropy decoder shared by SILK and CELT. Symbols are
+// read from the front of the buffer while raw bits are read from the back.
+type rangeDecoder struct {
+	buf  []byte
+	offs int
+
+	rng uint32
+	val uint32
+	ext uint32
+	rem int
+
+	endOffs   int
+	endWindow uint32
+	endBits   int
+
+	totalBits int
+}
+
+func newRangeDecoder(buf []byte) *rangeDecoder {
+	d := &rangeDecoder{buf: buf}
+	d.totalBits = RANGE_CODE_BITS + 1 - ((RANGE_CODE_BITS-RANGE_CODE_EXTRA)/RANGE_SYM_BITS)*RANGE_SYM_BITS
+	d.rng = 1 << RANGE_CODE_EXTRA
+	d.rem = d.readByte()
+	d.val = d.rng - 1 - uint32(d.rem>>(RANGE_SYM_BITS-RANGE_CODE_EXTRA))
+	d.normalize()
+	return d
+}
+
+func (d *rangeDecoder) readByte() int {
+	if d.offs < len(d.buf) {
+		d.offs++
+		return int(d.buf[d.offs-1])
+	}
+	return 0
+}
+
+func (d *rangeDecoder) readByteFromEnd() int {
+	if d.endOffs < len(d.buf) {
+		d.endOffs++
+		return int(d.buf[len(d.buf)-d.endOffs])
+	}
+	return 0
+}
+
+func (d *rangeDecoder) normalize() {
+	for d.rng <= RANGE_CODE_BOT {
+		d.totalBits += RANGE_SYM_BITS
+		d.rng <<= RANGE_SYM_BITS
+
+		sym := d.rem
+		d.rem = d.readByte()
+		sym = (sym<<RANGE_SYM_BITS | d.rem) >> (RANGE_SYM_BITS - RANGE_CODE_EXTRA)
+		d.val = ((d.val << RANGE_SYM_BITS) + uint32(0xFF&^sym)) & (RANGE_CODE_TOP - 1)
+	}
+}
+
+// decode returns the cumulative frequency of the next symbol out of ft.
+// It must be followed by a call to update.
+func (d *rangeDecoder) decode(ft uint32) uint32 {
+	d.ext = d.rng / ft
+	s := d.val / d.ext
+	return ft - min(s+1, ft)
+}
+
+func (d *rangeDecoder) decodeBin(bits uint) uint32 {
+	d.ext = d.rng >> bits
+	s := d.val / d.ext
+	return 1<<bits - min(s+1, 1<<bits)
+}
+
+func (d *rangeDecoder) update(fl, fh, ft uint32) {
+	s := d.ext * (ft - fh)
+	d.val -= s
+	if fl > 0 {
+		d.rng = d.ext * (fh - fl)
+	} else {
+		d.rng -= s
+	}
+	d.normalize()
+}
+
+// decodeBitLogp reads a bit that is set with probability 1/2^logp
+func (d *rangeDecoder) decodeBitLogp(logp uint) bool {
+	s := d.rng >> logp
+	ret := d.val < s
+	if ret {
+		d.rng = s
+	} else {
+		d.val -= s
+		d.rng -= s
+	}
+	d.normalize()
+	return ret
+}
+
+// decodeICDF reads a symbol given its inverse cumulative distribution,
+// scaled to 2^ftb
+func (d *rangeDecoder) decodeICDF(icdf []uint8, ftb uint) int {
+	s := d.rng
+	r := s >> ftb
+	ret := -1
+	var t uint32
+	for {
+		t = s
+		ret++
+		s = r * uint32(icdf[ret])
+		if d.val >= s {
+			break
+		}
+	}
+	d.val -= s
+	d.rng = t - s
+	d.normalize()
+	return ret
+}
+
+// decodeUint reads a uniformly distributed value in [0, ft)
+func (d *rangeDecoder) decodeUint(ft uint32) uint32 {
+	ft--
+	ftb := bits.Len32(ft)
+	if ftb > RANGE_UINT_BITS {
+		ftb -= RANGE_UINT_BITS
+		top := ft>>ftb + 1
+		s := d.decode(top)
+		d.update(s, s+1, top)
+		t := s<<ftb | d.decodeBits(uint(ftb))
+		if t <= ft {
+			return t
+		}
+		return ft
+	}
+
+	ft++
+	s := d.decode(ft)
+	d.update(s, s+1, ft)
+	return s
+}
+
+// decodeBits reads raw bits from the end of the buffer
+func (d *rangeDecoder) decodeBits(n uint) uint32 {
+	window := d.endWindow
+	available := d.endBits
+	if available < int(n) {
+		for available <= 32-RANGE_SYM_BITS {
+			window |= uint32(d.readByteFromEnd()) << available
+			available += RANGE_SYM_BITS
+		}
+	}
+
+	ret := window & (1<<n - 1)
+	d.endWindow = window >> n
+	d.endBits = available - int(n)
+	d.totalBits += int(n)
+	return ret
+}
+
+// decodeLaplace reads a value from the two-sided geometric distribution CELT
+// codes energies with, where fs is the probability of zero and decay the
+// rate of falloff, both out of 2^15
+func (d *rangeDecoder) decodeLaplace(fs uint32, decay int) int {
+	val := 0
+	fm := d.decodeBin(15)
+	fl := uint32(0)
+	if fm >= fs {
+		val++
+		fl = fs
+		fs = (32768-2*16-fs)*uint32(16384-decay)>>15 + 1
+
+		for fs > 1 && fm >= fl+2*fs {
+			fs *= 2
+			fl += fs
+			fs = (fs-2)*uint32(decay)>>15 + 1
+			val++
+		}
+		if fs <= 1 {
+			di := (fm - fl) >> 1
+			val += int(di)
+			fl += 2 * di
+		}
+		if fm < fl+fs {
+			val = -val
+		} else {
+			fl += fs
+		}
+	}
+
+	d.update(fl, min(fl+fs, 32768), 32768)
+	return val
+}
+
+// tell returns the number of bits read so far, rounded up
+func (d *rangeDecoder) tell() int {
+	return d.totalBits - bits.Len32(d.rng)
+}
+
+// tellFrac returns the number of bits read so far in 1/8 bits
+func (d *rangeDecoder) tellFrac() int {
+	nbits := d.totalBits << RANGE_BITRES
+	l := bits.Len32(d.rng)
+	r := d.rng >> (l - 16)
+	for i := 0; i < RANGE_BITRES; i++ {
+		r = r * r >> 15
+		b := int(r >> 16)
+		l = l<<1 | b
+		r >>= b
+	}
+	return nbits - l
+}
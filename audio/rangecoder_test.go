@@ -0,0 +1,172 @@
+package audio
+
+import (
+	"math/big"
+	"math/bits"
+	"math/rand"
+	"testing"
+)
+
+// rangeEncoder is the encoder rangeDecoder undoes. Rather than emitting
+// bytes as it goes it keeps the exact interval the symbols narrow the code
+// down to, low/2^scale up to (low+rng)/2^scale, and picks a code in it once
+// done.
+type rangeEncoder struct {
+	low   *big.Int
+	rng   uint32
+	scale uint
+}
+
+func newRangeEncoder() *rangeEncoder {
+	return &rangeEncoder{low: new(big.Int), rng: RANGE_CODE_TOP, scale: RANGE_CODE_BITS - 1}
+}
+
+// narrow moves the bottom of the interval up by skip and leaves it rng wide
+func (e *rangeEncoder) narrow(skip uint32, rng uint32) {
+	e.low.Add(e.low, new(big.Int).SetUint64(uint64(skip)))
+	e.rng = rng
+	for e.rng <= RANGE_CODE_BOT {
+		e.rng <<= RANGE_SYM_BITS
+		e.low.Lsh(e.low, RANGE_SYM_BITS)
+		e.scale += RANGE_SYM_BITS
+	}
+}
+
+// encode codes the symbol taking up fl to fh of ft, the lowest symbol
+// getting what is left over from dividing the range
+func (e *rangeEncoder) encode(fl, fh, ft uint32) {
+	r := e.rng / ft
+	if fl > 0 {
+		e.narrow(e.rng-r*(ft-fl), r*(fh-fl))
+	} else {
+		e.narrow(0, e.rng-r*(ft-fh))
+	}
+}
+
+func (e *rangeEncoder) encodeBitLogp(bit bool, logp uint) {
+	s := e.rng >> logp
+	if bit {
+		e.narrow(e.rng-s, s)
+	} else {
+		e.narrow(0, e.rng-s)
+	}
+}
+
+func (e *rangeEncoder) encodeICDF(s int, icdf []uint8, ftb uint) {
+	fl := uint32(0)
+	if s > 0 {
+		fl = 1<<ftb - uint32(icdf[s-1])
+	}
+	e.encode(fl, 1<<ftb-uint32(icdf[s]), 1<<ftb)
+}
+
+// tell returns the number of bits the symbols so far take, rounded up
+func (e *rangeEncoder) tell() int {
+	return int(e.scale) + 2 - bits.Len32(e.rng)
+}
+
+// finish returns a code of n bytes for the symbols, read as though followed
+// by zeros, if there is one
+func (e *rangeEncoder) finish(n int) ([]byte, bool) {
+	code := new(big.Int)
+	if 8*n >= int(e.scale) {
+		code.Lsh(e.low, uint(8*n)-e.scale)
+	} else {
+		// the lowest code of n bytes not below the interval
+		shift := e.scale - uint(8*n)
+		code.Lsh(big.NewInt(1), shift)
+		code.Sub(code, big.NewInt(1))
+		code.Add(code, e.low)
+		code.Rsh(code, shift)
+
+		top := new(big.Int).Add(e.low, new(big.Int).SetUint64(uint64(e.rng)))
+		if new(big.Int).Lsh(code, shift).Cmp(top) >= 0 {
+			return nil, false
+		}
+	}
+	return code.FillBytes(make([]byte, n)), true
+}
+
+// done returns the shortest code for the symbols
+func (e *rangeEncoder) done() []byte {
+	for n := 0; ; n++ {
+		if code, ok := e.finish(n); ok {
+			return code
+		}
+	}
+}
+
+func TestRangeCoder(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	// a made up distribution for each symbol, some of them lopsided
+	type symbol struct {
+		kind  int
+		icdf  []uint8
+		ft    uint32
+		logp  uint
+		value int
+	}
+	var symbols []symbol
+	for i := 0; i < 5000; i++ {
+		s := symbol{kind: r.Intn(3)}
+		switch s.kind {
+		case 0:
+			n := 2 + r.Intn(20)
+			s.icdf = make([]uint8, n)
+			for j := n - 2; j >= 0; j-- {
+				s.icdf[j] = s.icdf[j+1] + uint8(1+r.Intn(256/n))
+			}
+			s.value = r.Intn(n)
+		case 1:
+			s.logp = uint(1 + r.Intn(15))
+			s.value = r.Intn(2)
+			if r.Intn(4) == 0 {
+				s.value = 1
+			}
+		case 2:
+			s.ft = uint32(2 + r.Intn(255))
+			s.value = r.Intn(int(s.ft))
+		}
+		symbols = append(symbols, s)
+	}
+
+	e := newRangeEncoder()
+	var tells []int
+	for _, s := range symbols {
+		switch s.kind {
+		case 0:
+			e.encodeICDF(s.value, s.icdf, 8)
+		case 1:
+			e.encodeBitLogp(s.value == 1, s.logp)
+		case 2:
+			e.encode(uint32(s.value), uint32(s.value)+1, s.ft)
+		}
+		tells = append(tells, e.tell())
+	}
+	code := e.done()
+
+	d := newRangeDecoder(code)
+	for i, s := range symbols {
+		var got int
+		switch s.kind {
+		case 0:
+			got = d.decodeICDF(s.icdf, 8)
+		case 1:
+			if d.decodeBitLogp(s.logp) {
+				got = 1
+			}
+		case 2:
+			got = int(d.decodeUint(s.ft))
+		}
+		if got != s.value {
+			t.Fatalf("symbol %d decoded as %d, expected %d", i, got, s.value)
+		}
+		if d.tell() != tells[i] {
+			t.Fatalf("told %d bits after symbol %d, expected %d", d.tell(), i, tells[i])
+		}
+	}
+	if 8*len(code) < tells[len(tells)-1] || 8*len(code) > tells[len(tells)-1]+8 {
+		t.Fatalf("%d bytes for %d bits", len(code), tells[len(tells)-1])
+	}
+}
@@ -0,0 +1,366 @@
+package audio
+
+import (
+	"encoding/binary"
+)
+
+const (
+	S3M_HEADER_SIZE   = 0x60
+	S3M_CHANNELS      = 32
+	S3M_SAMPLE_SIZE   = 0x50
+	S3M_ROWS          = 64
+	S3M_NOTE_EMPTY    = 0xFF
+	S3M_NOTE_CUT      = 0xFE
+	S3M_VOLUME_EMPTY  = 0xFF
+	S3M_PAN_TABLE     = 0xFC
+	S3M_CHANNEL_OFF   = 0x80
+	S3M_CHANNEL_RIGHT = 8
+	S3M_CHANNEL_ADLIB = 16
+	S3M_STEREO        = 0x80
+	S3M_PAN_SURROUND  = 0xA4
+
+	S3M_FLAG_AMIGA_LIMITS = 0x10
+	S3M_FLAG_FAST_SLIDES  = 0x40
+	S3M_VERSION_FAST      = 0x1300 // ScreamTracker 3.00 always slid fast
+
+	S3M_SAMPLE_PCM    = 1
+	S3M_SAMPLE_LOOP   = 1
+	S3M_SAMPLE_STEREO = 2
+	S3M_SAMPLE_16BIT  = 4
+	S3M_SIGNED        = 1
+)
+
+func loadS3M(data []byte) (*trackerModule, error) {
+	if len(data) < S3M_HEADER_SIZE || string(data[0x2C:0x30]) != "SCRM" {
+		return nil, ErrNotTracker
+	}
+	le := binary.LittleEndian
+
+	numOrders := int(le.Uint16(data[0x20:]))
+	numSamples := int(le.Uint16(data[0x22:]))
+	numPatterns := int(le.Uint16(data[0x24:]))
+	flags := le.Uint16(data[0x26:])
+	version := le.Uint16(data[0x28:])
+	signed := le.Uint16(data[0x2A:]) == S3M_SIGNED
+
+	pos := S3M_HEADER_SIZE
+	if len(data) < pos+numOrders+2*(numSamples+numPatterns) {
+		return nil, ErrNotTracker
+	}
+
+	mod := &trackerModule{
+		kind:         TRACKER_S3M,
+		title:        trackerString(data[:28]),
+		speed:        int(data[0x31]),
+		tempo:        int(data[0x32]),
+		globalVolume: min(int(data[0x30]), 64) * 2,
+		amigaLimits:  flags&S3M_FLAG_AMIGA_LIMITS != 0,
+		fastSlides:   flags&S3M_FLAG_FAST_SLIDES != 0 || version == S3M_VERSION_FAST,
+	}
+	stereo := data[0x33]&S3M_STEREO != 0
+
+	// pack the enabled channels together
+	channelMap := make([]int, S3M_CHANNELS)
+	for c := range channelMap {
+		setting := data[0x40+c]
+		channelMap[c] = -1
+		if setting&S3M_CHANNEL_OFF != 0 || setting >= S3M_CHANNEL_ADLIB {
+			continue
+		}
+		channelMap[c] = mod.channels
+		pan := 128
+		if stereo {
+			pan = 0x3 * 17
+			if setting >= S3M_CHANNEL_RIGHT {
+				pan = 0xC * 17
+			}
+		}
+		mod.channelPan = append(mod.channelPan, pan)
+		mod.channels++
+	}
+
+	orders := data[pos : pos+numOrders]
+	pos += numOrders
+	mod.orders = make([]uint8, 0, numOrders)
+	for _, o := range orders {
+		mod.orders = append(mod.orders, o)
+	}
+
+	samplePtrs := make([]int, numSamples)
+	for i := range samplePtrs {
+		samplePtrs[i] = int(le.Uint16(data[pos:])) * 16
+		pos += 2
+	}
+	patternPtrs := make([]int, numPatterns)
+	for i := range patternPtrs {
+		patternPtrs[i] = int(le.Uint16(data[pos:])) * 16
+		pos += 2
+	}
+
+	if data[0x35] == S3M_PAN_TABLE && pos+S3M_CHANNELS <= len(data) {
+		for c, setting := range data[pos : pos+S3M_CHANNELS] {
+			if channelMap[c] >= 0 && setting&0x20 != 0 && stereo {
+				mod.channelPan[channelMap[c]] = int(setting&0xF) * 17
+			}
+		}
+	}
+
+	mod.samples = make([]trackerSample, numSamples)
+	for i, ptr := range samplePtrs {
+		mod.samples[i] = parseS3MSample(data, ptr, signed)
+	}
+
+	mod.patterns = make([]trackerPattern, numPatterns)
+	for i, ptr := range patternPtrs {
+		mod.patterns[i] = parseS3MPattern(data, ptr, mod.channels, channelMap)
+	}
+
+	mod.mixVolume = trackerMixVolume(mod.channels)
+	return mod, nil
+}
+
+func parseS3MSample(data []byte, ptr int, signed bool) trackerSample {
+	s := trackerSample{pan: -1, globalVolume: 64}
+	if ptr == 0 || ptr+S3M_SAMPLE_SIZE > len(data) {
+		return s
+	}
+	le := binary.LittleEndian
+	h := data[ptr : ptr+S3M_SAMPLE_SIZE]
+	s.name = trackerString(h[0x30:0x4C])
+	if h[0] != S3M_SAMPLE_PCM || string(h[0x4C:0x50]) != "SCRS" {
+		return s
+	}
+
+	offset := (int(h[0x0D])<<16 | int(le.Uint16(h[0x0E:]))) * 16
+	length := int(le.Uint32(h[0x10:]))
+	s.loopStart = int(le.Uint32(h[0x14:]))
+	s.loopEnd = int(le.Uint32(h[0x18:]))
+	s.volume = min(int(h[0x1C]), 64)
+	flags := h[0x1F]
+	s.baseFreq = float64(le.Uint32(h[0x20:]))
+	if flags&S3M_SAMPLE_LOOP != 0 {
+		s.loop = TRACKER_LOOP_FORWARD
+	}
+
+	width := 1
+	if flags&S3M_SAMPLE_16BIT != 0 {
+		width = 2
+	}
+	channels := 1
+	if flags&S3M_SAMPLE_STEREO != 0 {
+		channels = 2
+	}
+	s.data = trackerPCM(data, offset, length, width, channels, signed, false)
+	clampLoop(&s.loop, &s.loopStart, &s.loopEnd, len(s.data))
+	return s
+}
+
+// trackerPCM reads little-endian sample data, mixing stereo stored as one
+// channel after the other down to mono. Delta coded data holds differences
+// between samples.
+func trackerPCM(data []byte, offset int, length int, width int, channels int, signed bool, delta bool) []float32 {
+	if offset < 0 || offset >= len(data) || length <= 0 {
+		return nil
+	}
+	length = min(length, (len(data)-offset)/(width*channels))
+	out := make([]float32, length)
+	scale := float32(1) / float32(int(1)<<(8*width-1))
+
+	for c := 0; c < channels; c++ {
+		base := offset + c*length*width
+		prev := 0
+		for i := range out {
+			var v int
+			if width == 1 {
+				v = int(data[base+i])
+				if signed || delta {
+					v = int(int8(v))
+				} else {
+					v -= 128
+				}
+			} else {
+				v = int(binary.LittleEndian.Uint16(data[base+2*i:]))
+				if signed || delta {
+					v = int(int16(v))
+				} else {
+					v -= 32768
+				}
+			}
+			if delta {
+				if width == 1 {
+					v = int(int8(prev + v))
+				} else {
+					v = int(int16(prev + v))
+				}
+				prev = v
+			}
+			out[i] += float32(v) * scale / float32(channels)
+		}
+	}
+	return out
+}
+
+func parseS3MPattern(data []byte, ptr int, channels int, channelMap []int) trackerPattern {
+	pat := trackerPattern{rows: S3M_ROWS, cells: make([]trackerCell, S3M_ROWS*channels)}
+	if ptr == 0 || ptr+2 > len(data) {
+		return pat
+	}
+	end := min(ptr+2+int(binary.LittleEndian.Uint16(data[ptr:])), len(data))
+
+	pos := ptr + 2
+	for row := 0; row < S3M_ROWS && pos < end; {
+		what := data[pos]
+		pos++
+		if what == 0 {
+			row++
+			continue
+		}
+
+		var cell trackerCell
+		if what&0x20 != 0 && pos+2 <= end {
+			switch note := data[pos]; note {
+			case S3M_NOTE_EMPTY:
+			case S3M_NOTE_CUT:
+				cell.note = TRACKER_NOTE_CUT
+			default:
+				key := int(note>>4)*12 + int(note&0xF) + 12
+				cell.note = uint8(min(key, TRACKER_NOTES-1) + 1)
+			}
+			cell.instrument = data[pos+1]
+			pos += 2
+		}
+		if what&0x40 != 0 && pos < end {
+			if vol := data[pos]; vol != S3M_VOLUME_EMPTY {
+				cell.volCmd, cell.volParam = TRACKER_VOL_SET, min(vol, 64)
+			}
+			pos++
+		}
+		if what&0x80 != 0 && pos+2 <= end {
+			cell.effect, cell.param = s3mEffect(TRACKER_S3M, data[pos], data[pos+1])
+			pos += 2
+		}
+
+		if c := channelMap[what&0x1F]; c >= 0 {
+			pat.cells[row*channels+c] = cell
+		}
+	}
+	return pat
+}
+
+// s3mEffect translates a ScreamTracker effect letter, which Impulse Tracker
+// extends
+func s3mEffect(kind int, cmd uint8, param uint8) (uint8, uint8) {
+	x, y := param>>4, param&0xF
+	it := kind == TRACKER_IT
+	switch cmd {
+	case 'A' - '@':
+		return TRACKER_FX_SPEED, param
+	case 'B' - '@':
+		return TRACKER_FX_JUMP, param
+	case 'C' - '@':
+		if it {
+			return TRACKER_FX_BREAK, param
+		}
+		return TRACKER_FX_BREAK, x*10 + y
+	case 'D' - '@':
+		return TRACKER_FX_VOL_SLIDE, param
+	case 'E' - '@':
+		return TRACKER_FX_PORTA_DOWN, param
+	case 'F' - '@':
+		return TRACKER_FX_PORTA_UP, param
+	case 'G' - '@':
+		return TRACKER_FX_TONE_PORTA, param
+	case 'H' - '@':
+		return TRACKER_FX_VIBRATO, param
+	case 'I' - '@':
+		return TRACKER_FX_TREMOR, param
+	case 'J' - '@':
+		return TRACKER_FX_ARPEGGIO, param
+	case 'K' - '@':
+		return TRACKER_FX_VIBRATO_VOL, param
+	case 'L' - '@':
+		return TRACKER_FX_TONE_PORTA_VOL, param
+	case 'M' - '@':
+		if it {
+			return TRACKER_FX_CHANNEL_VOL, param
+		}
+	case 'N' - '@':
+		if it {
+			return TRACKER_FX_CHANNEL_VOL_SLIDE, param
+		}
+	case 'O' - '@':
+		return TRACKER_FX_OFFSET, param
+	case 'P' - '@':
+		if it {
+			return TRACKER_FX_PAN_SLIDE, param
+		}
+	case 'Q' - '@':
+		return TRACKER_FX_RETRIG, param
+	case 'R' - '@':
+		return TRACKER_FX_TREMOLO, param
+	case 'S' - '@':
+		return s3mExtendedEffect(it, x, y)
+	case 'T' - '@':
+		return TRACKER_FX_TEMPO, param
+	case 'U' - '@':
+		return TRACKER_FX_FINE_VIBRATO, param
+	case 'V' - '@':
+		if it {
+			return TRACKER_FX_GLOBAL_VOL, param
+		}
+		return TRACKER_FX_GLOBAL_VOL, min(param, 64) * 2
+	case 'W' - '@':
+		if it {
+			return TRACKER_FX_GLOBAL_VOL_SLIDE, param
+		}
+	case 'X' - '@':
+		if it {
+			return TRACKER_FX_PAN, param
+		}
+		switch {
+		case param <= 0x80:
+			return TRACKER_FX_PAN, uint8(min(int(param)*2, 255))
+		case param == S3M_PAN_SURROUND:
+			return TRACKER_FX_PAN, 128
+		}
+	case 'Y' - '@':
+		if it {
+			return TRACKER_FX_PANBRELLO, param
+		}
+	}
+	return TRACKER_FX_NONE, 0
+}
+
+func s3mExtendedEffect(it bool, x uint8, y uint8) (uint8, uint8) {
+	switch x {
+	case 0x3:
+		return TRACKER_FX_VIB_WAVE, y
+	case 0x4:
+		return TRACKER_FX_TREM_WAVE, y
+	case 0x5:
+		return TRACKER_FX_PAN_WAVE, y
+	case 0x6:
+		if it {
+			return TRACKER_FX_FINE_PATTERN_DELAY, y
+		}
+	case 0x7:
+		if it {
+			return TRACKER_FX_NNA, y
+		}
+	case 0x8:
+		return TRACKER_FX_PAN, y * 17
+	case 0xA:
+		if it {
+			return TRACKER_FX_HIGH_OFFSET, y
+		}
+	case 0xB:
+		return TRACKER_FX_PATTERN_LOOP, y
+	case 0xC:
+		return TRACKER_FX_NOTE_CUT, y
+	case 0xD:
+		return TRACKER_FX_NOTE_DELAY, y
+	case 0xE:
+		return TRACKER_FX_PATTERN_DELAY, y
+	}
+	return TRACKER_FX_NONE, 0
+}
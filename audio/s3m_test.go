@@ -0,0 +1,86 @@
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// s3mTestFile has two channels panned left and right, the left one playing a
+// square at speed 3 until a pattern break on row 32
+func s3mTestFile() []byte {
+	le := binary.LittleEndian
+	out := make([]byte, 0x200+32)
+	copy(out, "S3M Song")
+	out[0x1C], out[0x1D] = 0x1A, 16
+	le.PutUint16(out[0x20:], 2) // orders
+	le.PutUint16(out[0x22:], 1) // instruments
+	le.PutUint16(out[0x24:], 1) // patterns
+	le.PutUint16(out[0x28:], 0x1320)
+	le.PutUint16(out[0x2A:], 2) // unsigned samples
+	copy(out[0x2C:], "SCRM")
+	out[0x30], out[0x31], out[0x32], out[0x33] = 64, 6, 125, 0xB0
+	for c := 0; c < 32; c++ {
+		out[0x40+c] = 255
+	}
+	out[0x40], out[0x41] = 0, 8
+	out[0x60], out[0x61] = 0, 255
+	le.PutUint16(out[0x62:], 0x70/16)
+	le.PutUint16(out[0x64:], 0xC0/16)
+
+	ins := out[0x70:]
+	ins[0] = 1
+	le.PutUint16(ins[0x0E:], 0x200/16)
+	le.PutUint32(ins[0x10:], 32)
+	le.PutUint32(ins[0x18:], 32)
+	ins[0x1C] = 64
+	ins[0x1F] = 1 // looped
+	le.PutUint32(ins[0x20:], 8363)
+	copy(ins[0x30:], "s3m sample")
+	copy(ins[0x4C:], "SCRS")
+
+	// C-4 with sample 1 at full volume and speed 3, then a break on row 32
+	p := []byte{0x20 | 0x40 | 0x80, 0x40, 1, 64, 1, 3, 0}
+	for r := 1; r < 32; r++ {
+		p = append(p, 0)
+	}
+	p = append(p, 0x80|1, 3, 0, 0)
+	for r := 33; r < 64; r++ {
+		p = append(p, 0)
+	}
+	le.PutUint16(out[0xC0:], uint16(len(p)))
+	copy(out[0xC2:], p)
+	for i := 0; i < 32; i++ {
+		out[0x200+i] = 0xC0
+		if i >= 16 {
+			out[0x200+i] = 0x40
+		}
+	}
+	return out
+}
+
+func TestS3M(t *testing.T) {
+	const frames = 33 * 3 * TRACKER_TEST_TICK
+	dec := openTestModule(t, "a.s3m", s3mTestFile(), loadS3M, frames)
+	if m := dec.metadata(); m.Title != "S3M Song" || m.Artist != NOT_FOUND {
+		t.Fatalf("metadata %+v", m)
+	}
+	if pan := dec.mod.channelPan; dec.mod.channels != 2 || pan[0] != 51 || pan[1] != 204 {
+		t.Fatalf("%d channels panned %v", dec.mod.channels, pan)
+	}
+
+	all := decodeAll(t, dec)
+	if len(all) != frames*2 {
+		t.Fatalf("%d frames, expected %d", len(all)/2, frames)
+	}
+	checkPitch(t, "row 0", all, 1000, 1)
+	var l, r float64
+	for i := 0; i < 10000; i++ {
+		l += math.Abs(all[2*i])
+		r += math.Abs(all[2*i+1])
+	}
+	if l < 2*r {
+		t.Fatalf("left %v right %v, expected to lean left", l, r)
+	}
+	checkSeek(t, dec, all, 1e-9, 0, 20*3*TRACKER_TEST_TICK, frames-1)
+}
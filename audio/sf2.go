@@ -0,0 +1,383 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// generators, the parameters SoundFont zones set
+const (
+	SF2_GEN_START_OFFSET         = 0
+	SF2_GEN_END_OFFSET           = 1
+	SF2_GEN_LOOP_START_OFFSET    = 2
+	SF2_GEN_LOOP_END_OFFSET      = 3
+	SF2_GEN_START_COARSE         = 4
+	SF2_GEN_INITIAL_FILTER_FC    = 8
+	SF2_GEN_INITIAL_FILTER_Q     = 9
+	SF2_GEN_END_COARSE           = 12
+	SF2_GEN_VIB_LFO_TO_PITCH     = 6
+	SF2_GEN_PAN                  = 17
+	SF2_GEN_DELAY_VIB_LFO        = 23
+	SF2_GEN_FREQ_VIB_LFO         = 24
+	SF2_GEN_DELAY_VOL_ENV        = 33
+	SF2_GEN_ATTACK_VOL_ENV       = 34
+	SF2_GEN_HOLD_VOL_ENV         = 35
+	SF2_GEN_DECAY_VOL_ENV        = 36
+	SF2_GEN_SUSTAIN_VOL_ENV      = 37
+	SF2_GEN_RELEASE_VOL_ENV      = 38
+	SF2_GEN_KEY_TO_VOL_ENV_HOLD  = 39
+	SF2_GEN_KEY_TO_VOL_ENV_DECAY = 40
+	SF2_GEN_INSTRUMENT           = 41
+	SF2_GEN_KEY_RANGE            = 43
+	SF2_GEN_VEL_RANGE            = 44
+	SF2_GEN_LOOP_START_COARSE    = 45
+	SF2_GEN_KEYNUM               = 46
+	SF2_GEN_VELOCITY             = 47
+	SF2_GEN_ATTENUATION          = 48
+	SF2_GEN_LOOP_END_COARSE      = 50
+	SF2_GEN_COARSE_TUNE          = 51
+	SF2_GEN_FINE_TUNE            = 52
+	SF2_GEN_SAMPLE_ID            = 53
+	SF2_GEN_SAMPLE_MODES         = 54
+	SF2_GEN_SCALE_TUNING         = 56
+	SF2_GEN_EXCLUSIVE_CLASS      = 57
+	SF2_GEN_ROOT_KEY             = 58
+	SF2_GENERATORS               = 61
+)
+
+const (
+	SF2_PHDR_SIZE = 38
+	SF2_BAG_SIZE  = 4
+	SF2_GEN_SIZE  = 4
+	SF2_INST_SIZE = 22
+	SF2_SHDR_SIZE = 46
+
+	SF2_LOOP_NONE    = 0
+	SF2_LOOP         = 1
+	SF2_LOOP_RELEASE = 3 // loops until the key is released, then plays out
+
+	SF2_ROM_SAMPLE = 0x8000
+	SF2_PERCUSSION = 128 // bank of the drum kits
+)
+
+var (
+	ErrNotSoundFont = errors.New("not a SoundFont 2 file")
+)
+
+// the values generators take when no zone sets them
+var sf2Defaults = func() (d [SF2_GENERATORS]int) {
+	for _, g := range []int{SF2_GEN_DELAY_VIB_LFO, SF2_GEN_DELAY_VOL_ENV, SF2_GEN_ATTACK_VOL_ENV,
+		SF2_GEN_HOLD_VOL_ENV, SF2_GEN_DECAY_VOL_ENV, SF2_GEN_RELEASE_VOL_ENV} {
+		d[g] = -12000
+	}
+	d[SF2_GEN_INITIAL_FILTER_FC] = 13500
+	d[SF2_GEN_KEY_RANGE] = 127 << 8
+	d[SF2_GEN_VEL_RANGE] = 127 << 8
+	d[SF2_GEN_KEYNUM] = -1
+	d[SF2_GEN_VELOCITY] = -1
+	d[SF2_GEN_SCALE_TUNING] = 100
+	d[SF2_GEN_ROOT_KEY] = -1
+	return d
+}()
+
+// generators that only instruments may set, which presets cannot offset
+var sf2InstrumentOnly = map[int]bool{
+	SF2_GEN_START_OFFSET: true, SF2_GEN_END_OFFSET: true, SF2_GEN_LOOP_START_OFFSET: true,
+	SF2_GEN_LOOP_END_OFFSET: true, SF2_GEN_START_COARSE: true, SF2_GEN_END_COARSE: true,
+	SF2_GEN_LOOP_START_COARSE: true, SF2_GEN_LOOP_END_COARSE: true, SF2_GEN_KEYNUM: true,
+	SF2_GEN_VELOCITY: true, SF2_GEN_SAMPLE_MODES: true, SF2_GEN_EXCLUSIVE_CLASS: true,
+	SF2_GEN_ROOT_KEY: true, SF2_GEN_SAMPLE_ID: true, SF2_GEN_INSTRUMENT: true,
+	SF2_GEN_KEY_RANGE: true, SF2_GEN_VEL_RANGE: true,
+}
+
+type sf2Sample struct {
+	name      string
+	start     int
+	end       int
+	loopStart int
+	loopEnd   int
+	rate      int
+	key       int // original pitch
+	cents     int // pitch correction
+}
+
+// sf2Zone holds the generators of a zone along with what it covers. Preset
+// zone values are offsets added to the instrument's.
+type sf2Zone struct {
+	gens   [SF2_GENERATORS]int
+	keyLo  int
+	keyHi  int
+	velLo  int
+	velHi  int
+	target int // instrument or sample index
+}
+
+func (z *sf2Zone) covers(key int, vel int) bool {
+	return key >= z.keyLo && key <= z.keyHi && vel >= z.velLo && vel <= z.velHi
+}
+
+type sf2Instrument struct {
+	name  string
+	zones []sf2Zone
+}
+
+type sf2Preset struct {
+	name    string
+	bank    int
+	program int
+	zones   []sf2Zone
+}
+
+type soundFont struct {
+	name        string
+	data        []int16
+	samples     []sf2Sample
+	instruments []sf2Instrument
+	presets     map[int]*sf2Preset // by bank<<8 | program
+}
+
+// soundfonts are large and shared by every MIDI file that plays, so each is
+// only loaded once
+var (
+	soundFontPath  string
+	soundFonts     = map[string]*soundFont{}
+	soundFontMutex sync.Mutex
+)
+
+// SetSoundFontPath selects the SoundFont MIDI files are played with, in place
+// of the MAESTRO_SOUNDFONT variable and the usual install locations
+func SetSoundFontPath(path string) {
+	soundFontMutex.Lock()
+	defer soundFontMutex.Unlock()
+	soundFontPath = path
+}
+
+// getSoundFont loads the configured SoundFont, or returns the copy already
+// loaded
+func getSoundFont() (*soundFont, error) {
+	soundFontMutex.Lock()
+	defer soundFontMutex.Unlock()
+
+	path := findSoundFont(soundFontPath)
+	if path == "" {
+		return nil, ErrNoSoundFont
+	}
+	if sf, ok := soundFonts[path]; ok {
+		return sf, nil
+	}
+	sf, err := loadSoundFont(path)
+	if err != nil {
+		return nil, err
+	}
+	soundFonts[path] = sf
+	return sf, nil
+}
+
+func loadSoundFont(path string) (*soundFont, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(file, header); err != nil || string(header[:4]) != "RIFF" || string(header[8:]) != "sfbk" {
+		return nil, ErrNotSoundFont
+	}
+	end := 8 + int64(binary.LittleEndian.Uint32(header[4:]))
+	if info, err := file.Stat(); err == nil {
+		end = min(end, info.Size())
+	}
+
+	chunks, err := readChunks(file, 12, end, binary.LittleEndian)
+	if err != nil {
+		return nil, err
+	}
+
+	sf := &soundFont{presets: map[int]*sf2Preset{}}
+	hydra := map[string][]byte{}
+	for _, list := range chunks {
+		if list.id != "LIST" || list.size < 4 {
+			continue
+		}
+		kind := make([]byte, 4)
+		if _, err := file.Seek(list.offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(file, kind); err != nil {
+			return nil, err
+		}
+		subs, err := readChunks(file, list.offset+4, list.offset+list.size, binary.LittleEndian)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, sub := range subs {
+			switch {
+			case string(kind) == "INFO" && sub.id == "INAM":
+				body, err := readChunkBody(file, sub)
+				if err != nil {
+					return nil, err
+				}
+				sf.name = trimTagString(body)
+			case string(kind) == "sdta" && sub.id == "smpl":
+				body, err := readChunkBody(file, sub)
+				if err != nil {
+					return nil, err
+				}
+				sf.data = make([]int16, len(body)/2)
+				for i := range sf.data {
+					sf.data[i] = int16(binary.LittleEndian.Uint16(body[2*i:]))
+				}
+			case string(kind) == "pdta":
+				body, err := readChunkBody(file, sub)
+				if err != nil {
+					return nil, err
+				}
+				hydra[sub.id] = body
+			}
+		}
+	}
+
+	if sf.data == nil {
+		return nil, ErrNotSoundFont
+	}
+	if err := sf.readHydra(hydra); err != nil {
+		return nil, err
+	}
+	return sf, nil
+}
+
+// readHydra builds the presets, instruments and samples out of the pdta
+// chunks
+func (sf *soundFont) readHydra(hydra map[string][]byte) error {
+	le := binary.LittleEndian
+	for _, id := range []string{"phdr", "pbag", "pgen", "inst", "ibag", "igen", "shdr"} {
+		if len(hydra[id]) == 0 {
+			return ErrNotSoundFont
+		}
+	}
+
+	shdr := hydra["shdr"]
+	for i := 0; i+SF2_SHDR_SIZE <= len(shdr)-SF2_SHDR_SIZE; i += SF2_SHDR_SIZE {
+		h := shdr[i : i+SF2_SHDR_SIZE]
+		s := sf2Sample{
+			name:      trackerString(h[:20]),
+			start:     int(le.Uint32(h[20:])),
+			end:       int(le.Uint32(h[24:])),
+			loopStart: int(le.Uint32(h[28:])),
+			loopEnd:   int(le.Uint32(h[32:])),
+			rate:      int(le.Uint32(h[36:])),
+			key:       int(h[40]),
+			cents:     int(int8(h[41])),
+		}
+		// samples in ROM belong to hardware that is not here
+		if le.Uint16(h[44:])&SF2_ROM_SAMPLE != 0 || s.rate == 0 {
+			s.end = s.start
+		}
+		s.end = min(s.end, len(sf.data))
+		s.start = min(s.start, s.end)
+		sf.samples = append(sf.samples, s)
+	}
+
+	inst := hydra["inst"]
+	for i := 0; i+SF2_INST_SIZE < len(inst); i += SF2_INST_SIZE {
+		first, last := int(le.Uint16(inst[i+20:])), int(le.Uint16(inst[i+20+SF2_INST_SIZE:]))
+		zones := readSF2Zones(hydra["ibag"], hydra["igen"], first, last, SF2_GEN_SAMPLE_ID, len(sf.samples), false)
+		sf.instruments = append(sf.instruments, sf2Instrument{name: trackerString(inst[i : i+20]), zones: zones})
+	}
+
+	phdr := hydra["phdr"]
+	for i := 0; i+SF2_PHDR_SIZE < len(phdr); i += SF2_PHDR_SIZE {
+		h := phdr[i : i+SF2_PHDR_SIZE]
+		first, last := int(le.Uint16(h[24:])), int(le.Uint16(phdr[i+SF2_PHDR_SIZE+24:]))
+		p := &sf2Preset{
+			name:    trackerString(h[:20]),
+			program: int(le.Uint16(h[20:])),
+			bank:    int(le.Uint16(h[22:])),
+			zones:   readSF2Zones(hydra["pbag"], hydra["pgen"], first, last, SF2_GEN_INSTRUMENT, len(sf.instruments), true),
+		}
+		if _, ok := sf.presets[p.bank<<8|p.program]; !ok {
+			sf.presets[p.bank<<8|p.program] = p
+		}
+	}
+	return nil
+}
+
+// readSF2Zones reads the zones of bags first up to last. A first zone that
+// does not end in the terminal generator holds defaults for the others.
+func readSF2Zones(bags []byte, gens []byte, first int, last int, terminal int, targets int, relative bool) []sf2Zone {
+	le := binary.LittleEndian
+	numBags := len(bags)/SF2_BAG_SIZE - 1
+	last = min(last, numBags)
+
+	global := sf2Zone{}
+	if !relative {
+		global.gens = sf2Defaults
+	}
+	global.gens[SF2_GEN_KEY_RANGE] = 127 << 8
+	global.gens[SF2_GEN_VEL_RANGE] = 127 << 8
+
+	zones := make([]sf2Zone, 0)
+	for b := first; b < last; b++ {
+		genFirst := int(le.Uint16(bags[b*SF2_BAG_SIZE:]))
+		genLast := int(le.Uint16(bags[(b+1)*SF2_BAG_SIZE:]))
+		genLast = min(genLast, len(gens)/SF2_GEN_SIZE)
+
+		zone := global
+		zone.target = -1
+		for g := genFirst; g < genLast; g++ {
+			op := int(le.Uint16(gens[g*SF2_GEN_SIZE:]))
+			amount := gens[g*SF2_GEN_SIZE+2:]
+			if op >= SF2_GENERATORS {
+				continue
+			}
+			switch op {
+			case SF2_GEN_KEY_RANGE, SF2_GEN_VEL_RANGE:
+				zone.gens[op] = int(amount[0]) | int(amount[1])<<8
+			case terminal:
+				zone.target = int(le.Uint16(amount))
+			default:
+				if relative && sf2InstrumentOnly[op] {
+					continue
+				}
+				zone.gens[op] = int(int16(le.Uint16(amount)))
+			}
+		}
+
+		if zone.target < 0 {
+			if b == first {
+				global = zone
+			}
+			continue
+		}
+		if zone.target >= targets {
+			continue
+		}
+		zone.keyLo, zone.keyHi = zone.gens[SF2_GEN_KEY_RANGE]&0xFF, zone.gens[SF2_GEN_KEY_RANGE]>>8
+		zone.velLo, zone.velHi = zone.gens[SF2_GEN_VEL_RANGE]&0xFF, zone.gens[SF2_GEN_VEL_RANGE]>>8
+		zones = append(zones, zone)
+	}
+	return zones
+}
+
+// preset finds the preset for a bank and program, falling back on the
+// general MIDI sounds when the bank does not have it
+func (sf *soundFont) preset(bank int, program int) *sf2Preset {
+	if p, ok := sf.presets[bank<<8|program]; ok {
+		return p
+	}
+	if bank == SF2_PERCUSSION {
+		if p, ok := sf.presets[SF2_PERCUSSION<<8]; ok {
+			return p
+		}
+		return nil
+	}
+	if p, ok := sf.presets[program]; ok {
+		return p
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// riffChunkBytes is a little-endian chunk, padded to an even length
+func riffChunkBytes(id string, parts ...[]byte) []byte {
+	var body []byte
+	for _, part := range parts {
+		body = append(body, part...)
+	}
+	b := binary.LittleEndian.AppendUint32([]byte(id), uint32(len(body)))
+	b = append(b, body...)
+	if len(body)&1 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// sf2TestFont has a looped 440 Hz sine, played as is by program 0 and the
+// drum kit and 20 dB down by program 5
+func sf2TestFont() []byte {
+	le := binary.LittleEndian
+	const n = 4400
+	var smpl []byte
+	for i := 0; i < n; i++ {
+		smpl = le.AppendUint16(smpl, uint16(int16(20000*math.Sin(2*math.Pi*float64(i)/100))))
+	}
+	// samples are followed by at least 46 zeros
+	smpl = append(smpl, make([]byte, 92)...)
+
+	gen := func(op, amount int) []byte {
+		return le.AppendUint16(le.AppendUint16(nil, uint16(op)), uint16(int16(amount)))
+	}
+	bags := func(first ...int) []byte {
+		var b []byte
+		for _, f := range first {
+			b = le.AppendUint32(b, uint32(f))
+		}
+		return b
+	}
+	named := func(name string, fields ...uint16) []byte {
+		b := append([]byte(name), make([]byte, 20-len(name))...)
+		for _, f := range fields {
+			b = le.AppendUint16(b, f)
+		}
+		return b
+	}
+
+	var igen []byte
+	for _, g := range [][2]int{
+		{SF2_GEN_SAMPLE_MODES, 1}, {SF2_GEN_RELEASE_VOL_ENV, -1200}, {SF2_GEN_SAMPLE_ID, 0},
+		{SF2_GEN_SAMPLE_MODES, 1}, {SF2_GEN_ATTENUATION, 200}, {SF2_GEN_SAMPLE_ID, 0},
+		{0, 0},
+	} {
+		igen = append(igen, gen(g[0], g[1])...)
+	}
+	inst := append(named("Sine", 0), named("Quiet", 1)...)
+	inst = append(inst, named("EOI", 2)...)
+
+	var pgen []byte
+	for _, i := range []int{0, 1, 0} {
+		pgen = append(pgen, gen(SF2_GEN_INSTRUMENT, i)...)
+	}
+	pgen = append(pgen, gen(0, 0)...)
+	var phdr []byte
+	for _, p := range []struct {
+		name                 string
+		program, bank, first uint16
+	}{{"Piano", 0, 0, 0}, {"Quiet", 5, 0, 1}, {"Drums", 0, 128, 2}, {"EOP", 0, 0, 3}} {
+		phdr = append(phdr, named(p.name, p.program, p.bank, p.first)...)
+		phdr = append(phdr, make([]byte, 12)...)
+	}
+
+	shdr := func(name string, end, rate, key int) []byte {
+		b := append([]byte(name), make([]byte, 20-len(name))...)
+		for _, v := range []int{0, end, 0, end, rate} {
+			b = le.AppendUint32(b, uint32(v))
+		}
+		return append(b, byte(key), 0, 0, 0, 1, 0)
+	}
+
+	return riffChunkBytes("RIFF", []byte("sfbk"),
+		riffChunkBytes("LIST", []byte("INFO"),
+			riffChunkBytes("ifil", []byte{2, 0, 1, 0}),
+			riffChunkBytes("INAM", []byte("Test Font\x00"))),
+		riffChunkBytes("LIST", []byte("sdta"), riffChunkBytes("smpl", smpl)),
+		riffChunkBytes("LIST", []byte("pdta"),
+			riffChunkBytes("phdr", phdr),
+			riffChunkBytes("pbag", bags(0, 1, 2, 3)),
+			riffChunkBytes("pmod", make([]byte, 10)),
+			riffChunkBytes("pgen", pgen),
+			riffChunkBytes("inst", inst),
+			riffChunkBytes("ibag", bags(0, 3, 6)),
+			riffChunkBytes("imod", make([]byte, 10)),
+			riffChunkBytes("igen", igen),
+			riffChunkBytes("shdr", shdr("sine", n, 44000, 69), shdr("EOS", 0, 0, 0))),
+	)
+}
+
+func TestSoundFont(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.sf2")
+	if err := os.WriteFile(path, sf2TestFont(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sf, err := loadSoundFont(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range [][2]int{{0, 0}, {0, 5}, {128, 0}} {
+		if sf.preset(p[0], p[1]) == nil {
+			t.Fatalf("no preset %d in bank %d", p[1], p[0])
+		}
+	}
+	if _, err := loadSoundFont(filepath.Join(t.TempDir(), "missing.sf2")); err == nil {
+		t.Fatal("missing SoundFont loaded")
+	}
+}
@@ -0,0 +1,1327 @@
+package audio
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+	"slices"
+)
+
+const (
+	SILK_MAX_LPC_ORDER      = 16
+	SILK_MIN_LPC_ORDER      = 10
+	SILK_LTP_ORDER          = 5
+	SILK_MAX_SUBFRAMES      = 4
+	SILK_SUBFRAME_MS        = 5
+	SILK_LTP_MEMORY_MS      = 20
+	SILK_MAX_FRAME_LENGTH   = SILK_MAX_SUBFRAMES * SILK_SUBFRAME_MS * 16
+	SILK_MAX_FRAMES         = 3 // per packet
+	SILK_SHELL_BLOCK        = 16
+	SILK_MAX_PULSES         = 16
+	SILK_STEREO_INTERP_MS   = 8
+	SILK_NLSF_MAX_AMPLITUDE = 4
+	SILK_NLSF_LEVEL_ADJUST  = 102 // 0.1 in Q10
+	SILK_QUANT_LEVEL_ADJUST = 80  // in Q10
+
+	SILK_TYPE_INACTIVE = 0
+	SILK_TYPE_UNVOICED = 1
+	SILK_TYPE_VOICED   = 2
+
+	SILK_CODE_INDEPENDENTLY          = 0
+	SILK_CODE_INDEPENDENTLY_NO_SCALE = 1
+	SILK_CODE_CONDITIONALLY          = 2
+
+	SILK_GAIN_OFFSET    = (2*128)/6 + 16*128
+	SILK_GAIN_INV_SCALE = (65536 * (((88 - 2) * 128) / 6)) / 63
+	SILK_GAIN_LEVELS    = 64
+
+	SILK_PITCH_MIN_LAG_MS = 2
+	SILK_PITCH_MAX_LAG_MS = 18
+
+	SILK_RESAMPLER_ORDER = 8
+)
+
+var (
+	errSILKFrameSize = errors.New("invalid SILK frame size")
+)
+
+// silkNLSFCodebook is one of the two codebooks normalised line spectral
+// frequencies are vector quantised with
+type silkNLSFCodebook struct {
+	order    int
+	stepSize int32 // in Q16
+
+	cb1        []uint8 // first stage vectors in Q8
+	cb1Weights []int32 // in Q9
+	cb1ICDF    []uint8 // by signal type
+
+	pred     []uint8 // backwards prediction coefficients in Q8
+	ecSelect []uint8 // packed cdf and predictor selections of each vector
+	ecICDF   []uint8
+	deltaMin []int32 // minimum spacing in Q15
+}
+
+// silkIndices holds the quantisation indices coded for one SILK frame
+type silkIndices struct {
+	gains       [SILK_MAX_SUBFRAMES]int32
+	ltp         [SILK_MAX_SUBFRAMES]int32
+	nlsf        [SILK_MAX_LPC_ORDER + 1]int32
+	lag         int32
+	contour     int32
+	signalType  int32
+	offsetType  int32
+	nlsfInterp  int32
+	periodicity int32
+	ltpScale    int32
+	seed        int32
+}
+
+// silkControl holds the parameters dequantised from the indices of a frame
+type silkControl struct {
+	pitchL   [SILK_MAX_SUBFRAMES]int32
+	gains    [SILK_MAX_SUBFRAMES]int32                  // in Q16
+	predCoef [2][SILK_MAX_LPC_ORDER]int16               // in Q12
+	ltpCoef  [SILK_LTP_ORDER * SILK_MAX_SUBFRAMES]int16 // in Q14
+	ltpScale int32                                      // in Q14
+}
+
+// silkChannel is the state of one coded channel. SILK is specified bit
+// exactly in fixed point, so everything here follows the integer arithmetic
+// of the reference decoder.
+type silkChannel struct {
+	fsKHz        int
+	subframes    int
+	subfrLength  int
+	frameLength  int
+	ltpMemLength int
+	lpcOrder     int
+
+	framesPerPacket int
+	framesDecoded   int
+	vadFlags        [SILK_MAX_FRAMES]bool
+	lbrrFlag        bool
+	lbrrFlags       [SILK_MAX_FRAMES]bool
+
+	nlsfCB           *silkNLSFCodebook
+	lagLowICDF       []uint8
+	pitchContourICDF []uint8
+
+	firstFrameAfterReset bool
+	lagPrev              int32
+	lastGainIndex        int32
+	prevSignalType       int32
+	ecPrevSignalType     int32
+	ecPrevLagIndex       int32
+	prevGain             int32 // in Q16
+	prevNLSF             [SILK_MAX_LPC_ORDER]int16
+
+	outBuf [SILK_MAX_FRAME_LENGTH + 2*SILK_SUBFRAME_MS*16]int16
+	sLPC   [SILK_MAX_LPC_ORDER]int32 // in Q14
+	exc    [SILK_MAX_FRAME_LENGTH]int32
+
+	indices silkIndices
+
+	resampler silkResampler
+}
+
+// silkDecoder decodes the SILK layer of Opus packets, mono or mid/side
+// stereo, and resamples it to 48 kHz
+type silkDecoder struct {
+	channels [2]silkChannel
+
+	channelsAPI      int
+	channelsInternal int
+
+	predPrev             [2]int32 // stereo prediction in Q13
+	sMid                 [2]int16
+	sSide                [2]int16
+	prevDecodeOnlyMiddle bool
+}
+
+func newSILKDecoder() *silkDecoder {
+	dec := &silkDecoder{}
+	dec.reset()
+	return dec
+}
+
+func (dec *silkDecoder) reset() {
+	for n := range dec.channels {
+		dec.channels[n].reset()
+	}
+	dec.predPrev = [2]int32{}
+	dec.sMid = [2]int16{}
+	dec.sSide = [2]int16{}
+	dec.prevDecodeOnlyMiddle = false
+}
+
+func (ch *silkChannel) reset() {
+	*ch = silkChannel{}
+	ch.firstFrameAfterReset = true
+	ch.prevGain = 65536
+}
+
+// decode decodes the next frame of every coded channel of a packet with
+// payloadMs of audio at fsKHz, writing it interleaved over channels at
+// 48 kHz to out. It returns the number of samples per channel written.
+func (dec *silkDecoder) decode(rd *rangeDecoder, channels int, streamChannels int, fsKHz int, payloadMs int, newPacket bool, out []int16) (int, error) {
+	chs := dec.channels[:]
+
+	if newPacket {
+		for n := 0; n < streamChannels; n++ {
+			chs[n].framesDecoded = 0
+		}
+	}
+	if streamChannels > dec.channelsInternal {
+		chs[1].reset()
+	}
+	stereoToMono := streamChannels == 1 && dec.channelsInternal == 2 && fsKHz == chs[0].fsKHz
+
+	if chs[0].framesDecoded == 0 {
+		for n := 0; n < streamChannels; n++ {
+			switch payloadMs {
+			case 0, 10:
+				chs[n].framesPerPacket, chs[n].subframes = 1, 2
+			case 20:
+				chs[n].framesPerPacket, chs[n].subframes = 1, 4
+			case 40:
+				chs[n].framesPerPacket, chs[n].subframes = 2, 4
+			case 60:
+				chs[n].framesPerPacket, chs[n].subframes = 3, 4
+			default:
+				return 0, errSILKFrameSize
+			}
+			chs[n].setSampleRate(fsKHz)
+		}
+	}
+
+	if channels == 2 && streamChannels == 2 && (dec.channelsAPI == 1 || dec.channelsInternal == 1) {
+		dec.predPrev = [2]int32{}
+		dec.sSide = [2]int16{}
+		chs[1].resampler = chs[0].resampler
+	}
+	dec.channelsAPI = channels
+	dec.channelsInternal = streamChannels
+
+	if chs[0].framesDecoded == 0 {
+		for n := 0; n < streamChannels; n++ {
+			for i := 0; i < chs[n].framesPerPacket; i++ {
+				chs[n].vadFlags[i] = rd.decodeBitLogp(1)
+			}
+			chs[n].lbrrFlag = rd.decodeBitLogp(1)
+		}
+
+		for n := 0; n < streamChannels; n++ {
+			chs[n].lbrrFlags = [SILK_MAX_FRAMES]bool{}
+			if !chs[n].lbrrFlag {
+				continue
+			}
+			if chs[n].framesPerPacket == 1 {
+				chs[n].lbrrFlags[0] = true
+				continue
+			}
+			symbol := rd.decodeICDF(silkLBRRFlagsICDF[chs[n].framesPerPacket-2], 8) + 1
+			for i := 0; i < chs[n].framesPerPacket; i++ {
+				chs[n].lbrrFlags[i] = symbol>>i&1 != 0
+			}
+		}
+
+		// the low bitrate redundancy repeats earlier frames, only of use
+		// after a loss, so it is parsed and thrown away
+		var pulses [SILK_MAX_FRAME_LENGTH]int16
+		var pred [2]int32
+		for i := 0; i < chs[0].framesPerPacket; i++ {
+			for n := 0; n < streamChannels; n++ {
+				if !chs[n].lbrrFlags[i] {
+					continue
+				}
+				if streamChannels == 2 && n == 0 {
+					silkStereoDecodePred(rd, &pred)
+					if !chs[1].lbrrFlags[i] {
+						rd.decodeICDF(silkStereoOnlyMidICDF, 8)
+					}
+				}
+				condCoding := SILK_CODE_INDEPENDENTLY
+				if i > 0 && chs[n].lbrrFlags[i-1] {
+					condCoding = SILK_CODE_CONDITIONALLY
+				}
+				chs[n].decodeIndices(rd, i, true, condCoding)
+				silkDecodePulses(rd, pulses[:], chs[n].indices.signalType, chs[n].indices.offsetType, chs[n].frameLength)
+			}
+		}
+	}
+
+	var pred [2]int32
+	decodeOnlyMiddle := false
+	if streamChannels == 2 {
+		silkStereoDecodePred(rd, &pred)
+		if !chs[1].vadFlags[chs[0].framesDecoded] {
+			decodeOnlyMiddle = rd.decodeICDF(silkStereoOnlyMidICDF, 8) == 1
+		}
+	}
+
+	if streamChannels == 2 && !decodeOnlyMiddle && dec.prevDecodeOnlyMiddle {
+		// the side channel restarts
+		side := &chs[1]
+		side.outBuf = [len(side.outBuf)]int16{}
+		side.sLPC = [SILK_MAX_LPC_ORDER]int32{}
+		side.lagPrev = 100
+		side.lastGainIndex = 10
+		side.prevSignalType = SILK_TYPE_INACTIVE
+		side.firstFrameAfterReset = true
+	}
+
+	// each channel is decoded after two samples of history for the stereo
+	// unmixing
+	frameLength := chs[0].frameLength
+	var samples [2][SILK_MAX_FRAME_LENGTH + 2]int16
+	for n := 0; n < streamChannels; n++ {
+		if n == 0 || !decodeOnlyMiddle {
+			frameIndex := chs[0].framesDecoded - n
+			condCoding := SILK_CODE_CONDITIONALLY
+			switch {
+			case frameIndex <= 0:
+				condCoding = SILK_CODE_INDEPENDENTLY
+			case n > 0 && dec.prevDecodeOnlyMiddle:
+				condCoding = SILK_CODE_INDEPENDENTLY_NO_SCALE
+			}
+			chs[n].decodeFrame(rd, samples[n][2:2+frameLength], condCoding)
+		}
+		chs[n].framesDecoded++
+	}
+
+	if channels == 2 && streamChannels == 2 {
+		dec.msToLR(samples[0][:frameLength+2], samples[1][:frameLength+2], pred, chs[0].fsKHz)
+	} else {
+		samples[0][0], samples[0][1] = dec.sMid[0], dec.sMid[1]
+		dec.sMid[0], dec.sMid[1] = samples[0][frameLength], samples[0][frameLength+1]
+	}
+
+	outLength := frameLength * 48 / chs[0].fsKHz
+	resampled := make([]int16, outLength)
+	for n := 0; n < min(channels, streamChannels); n++ {
+		chs[n].resampler.process(resampled, samples[n][1:1+frameLength])
+		for i, s := range resampled {
+			out[i*channels+n] = s
+		}
+	}
+	if channels == 2 && streamChannels == 1 {
+		if stereoToMono {
+			chs[1].resampler.process(resampled, samples[0][1:1+frameLength])
+			for i, s := range resampled {
+				out[i*2+1] = s
+			}
+		} else {
+			for i := 0; i < outLength; i++ {
+				out[i*2+1] = out[i*2]
+			}
+		}
+	}
+
+	dec.prevDecodeOnlyMiddle = decodeOnlyMiddle
+	return outLength, nil
+}
+
+// setSampleRate configures the channel for frames at fsKHz with the current
+// number of subframes, resetting it if the rate changes
+func (ch *silkChannel) setSampleRate(fsKHz int) {
+	ch.subfrLength = SILK_SUBFRAME_MS * fsKHz
+	frameLength := ch.subframes * ch.subfrLength
+
+	if ch.fsKHz != fsKHz {
+		ch.resampler.init(fsKHz)
+	}
+
+	if ch.fsKHz == fsKHz && ch.frameLength == frameLength {
+		return
+	}
+
+	switch {
+	case fsKHz == 8 && ch.subframes == SILK_MAX_SUBFRAMES:
+		ch.pitchContourICDF = silkPitchContourNBICDF
+	case fsKHz == 8:
+		ch.pitchContourICDF = silkPitchContour10msNBICDF
+	case ch.subframes == SILK_MAX_SUBFRAMES:
+		ch.pitchContourICDF = silkPitchContourICDF
+	default:
+		ch.pitchContourICDF = silkPitchContour10msICDF
+	}
+
+	if ch.fsKHz != fsKHz {
+		ch.ltpMemLength = SILK_LTP_MEMORY_MS * fsKHz
+		if fsKHz == 16 {
+			ch.lpcOrder = SILK_MAX_LPC_ORDER
+			ch.nlsfCB = &silkNLSFCodebookWB
+		} else {
+			ch.lpcOrder = SILK_MIN_LPC_ORDER
+			ch.nlsfCB = &silkNLSFCodebookNBMB
+		}
+		switch fsKHz {
+		case 16:
+			ch.lagLowICDF = silkUniform8ICDF
+		case 12:
+			ch.lagLowICDF = silkUniform6ICDF
+		default:
+			ch.lagLowICDF = silkUniform4ICDF
+		}
+
+		ch.firstFrameAfterReset = true
+		ch.lagPrev = 100
+		ch.lastGainIndex = 10
+		ch.prevSignalType = SILK_TYPE_INACTIVE
+		ch.outBuf = [len(ch.outBuf)]int16{}
+		ch.sLPC = [SILK_MAX_LPC_ORDER]int32{}
+	}
+
+	ch.fsKHz = fsKHz
+	ch.frameLength = frameLength
+}
+
+// decodeFrame decodes one frame into out
+func (ch *silkChannel) decodeFrame(rd *rangeDecoder, out []int16, condCoding int) {
+	var pulses [SILK_MAX_FRAME_LENGTH]int16
+	var ctrl silkControl
+
+	ch.decodeIndices(rd, ch.framesDecoded, false, condCoding)
+	silkDecodePulses(rd, pulses[:], ch.indices.signalType, ch.indices.offsetType, ch.frameLength)
+	ch.decodeParameters(&ctrl, condCoding)
+	ch.decodeCore(&ctrl, out, pulses[:])
+
+	ch.prevSignalType = ch.indices.signalType
+	ch.firstFrameAfterReset = false
+
+	mv := ch.ltpMemLength - ch.frameLength
+	copy(ch.outBuf[:mv], ch.outBuf[ch.frameLength:ch.frameLength+mv])
+	copy(ch.outBuf[mv:], out[:ch.frameLength])
+
+	ch.lagPrev = ctrl.pitchL[ch.subframes-1]
+}
+
+func (ch *silkChannel) decodeIndices(rd *rangeDecoder, frame int, lbrr bool, condCoding int) {
+	ix := &ch.indices
+
+	var typeOffset int
+	if lbrr || ch.vadFlags[frame] {
+		typeOffset = rd.decodeICDF(silkTypeOffsetVADICDF, 8) + 2
+	} else {
+		typeOffset = rd.decodeICDF(silkTypeOffsetNoVADICDF, 8)
+	}
+	ix.signalType = int32(typeOffset >> 1)
+	ix.offsetType = int32(typeOffset & 1)
+
+	// gains
+	if condCoding == SILK_CODE_CONDITIONALLY {
+		ix.gains[0] = int32(rd.decodeICDF(silkDeltaGainICDF, 8))
+	} else {
+		ix.gains[0] = int32(rd.decodeICDF(silkGainICDF[ix.signalType], 8)) << 3
+		ix.gains[0] += int32(rd.decodeICDF(silkUniform8ICDF, 8))
+	}
+	for i := 1; i < ch.subframes; i++ {
+		ix.gains[i] = int32(rd.decodeICDF(silkDeltaGainICDF, 8))
+	}
+
+	// NLSFs
+	cb := ch.nlsfCB
+	vectors := len(cb.cb1) / cb.order
+	ix.nlsf[0] = int32(rd.decodeICDF(cb.cb1ICDF[int(ix.signalType>>1)*vectors:], 8))
+	var ecIx [SILK_MAX_LPC_ORDER]int
+	var predQ8 [SILK_MAX_LPC_ORDER]uint8
+	cb.unpack(ecIx[:], predQ8[:], int(ix.nlsf[0]))
+	for i := 0; i < cb.order; i++ {
+		v := rd.decodeICDF(cb.ecICDF[ecIx[i]:], 8)
+		if v == 0 {
+			v -= rd.decodeICDF(silkNLSFExtICDF, 8)
+		} else if v == 2*SILK_NLSF_MAX_AMPLITUDE {
+			v += rd.decodeICDF(silkNLSFExtICDF, 8)
+		}
+		ix.nlsf[i+1] = int32(v - SILK_NLSF_MAX_AMPLITUDE)
+	}
+	if ch.subframes == SILK_MAX_SUBFRAMES {
+		ix.nlsfInterp = int32(rd.decodeICDF(silkNLSFInterpolationICDF, 8))
+	} else {
+		ix.nlsfInterp = 4
+	}
+
+	// pitch and long term prediction
+	if ix.signalType == SILK_TYPE_VOICED {
+		absolute := true
+		if condCoding == SILK_CODE_CONDITIONALLY && ch.ecPrevSignalType == SILK_TYPE_VOICED {
+			delta := int32(rd.decodeICDF(silkPitchDeltaICDF, 8))
+			if delta > 0 {
+				ix.lag = ch.ecPrevLagIndex + delta - 9
+				absolute = false
+			}
+		}
+		if absolute {
+			ix.lag = int32(rd.decodeICDF(silkPitchLagICDF, 8) * (ch.fsKHz >> 1))
+			ix.lag += int32(rd.decodeICDF(ch.lagLowICDF, 8))
+		}
+		ch.ecPrevLagIndex = ix.lag
+
+		ix.contour = int32(rd.decodeICDF(ch.pitchContourICDF, 8))
+		ix.periodicity = int32(rd.decodeICDF(silkLTPPerIndexICDF, 8))
+		for k := 0; k < ch.subframes; k++ {
+			ix.ltp[k] = int32(rd.decodeICDF(silkLTPGainICDF[ix.periodicity], 8))
+		}
+		if condCoding == SILK_CODE_INDEPENDENTLY {
+			ix.ltpScale = int32(rd.decodeICDF(silkLTPScaleICDF, 8))
+		} else {
+			ix.ltpScale = 0
+		}
+	}
+	ch.ecPrevSignalType = ix.signalType
+
+	ix.seed = int32(rd.decodeICDF(silkUniform4ICDF, 8))
+}
+
+// silkDecodePulses reads the excitation pulses of a frame
+func silkDecodePulses(rd *rangeDecoder, pulses []int16, signalType int32, offsetType int32, frameLength int) {
+	rateLevel := rd.decodeICDF(silkRateLevelsICDF[signalType>>1][:], 8)
+
+	blocks := (frameLength + SILK_SHELL_BLOCK - 1) / SILK_SHELL_BLOCK
+	var sums, shifts [SILK_MAX_FRAME_LENGTH / SILK_SHELL_BLOCK]int
+	for i := 0; i < blocks; i++ {
+		sums[i] = rd.decodeICDF(silkPulsesPerBlockICDF[rateLevel][:], 8)
+		for sums[i] == SILK_MAX_PULSES+1 {
+			shifts[i]++
+			icdf := silkPulsesPerBlockICDF[len(silkPulsesPerBlockICDF)-1][:]
+			if shifts[i] == 10 {
+				icdf = icdf[1:]
+			}
+			sums[i] = rd.decodeICDF(icdf, 8)
+		}
+	}
+
+	for i := 0; i < blocks; i++ {
+		block := pulses[i*SILK_SHELL_BLOCK : (i+1)*SILK_SHELL_BLOCK]
+		if sums[i] > 0 {
+			silkShellDecode(rd, block, sums[i])
+		} else {
+			clear(block)
+		}
+	}
+
+	// least significant bits of large pulses
+	for i := 0; i < blocks; i++ {
+		if shifts[i] == 0 {
+			continue
+		}
+		block := pulses[i*SILK_SHELL_BLOCK : (i+1)*SILK_SHELL_BLOCK]
+		for k := range block {
+			q := int(block[k])
+			for j := 0; j < shifts[i]; j++ {
+				q = q<<1 + rd.decodeICDF(silkLSBICDF, 8)
+			}
+			block[k] = int16(q)
+		}
+		sums[i] |= shifts[i] << 5
+	}
+
+	// signs
+	signs := silkSignICDF[7*(offsetType+2*signalType):]
+	icdf := []uint8{0, 0}
+	for i := 0; i < (frameLength+SILK_SHELL_BLOCK/2)/SILK_SHELL_BLOCK; i++ {
+		if sums[i] <= 0 {
+			continue
+		}
+		icdf[0] = signs[min(sums[i]&0x1F, 6)]
+		block := pulses[i*SILK_SHELL_BLOCK : (i+1)*SILK_SHELL_BLOCK]
+		for j := range block {
+			if block[j] > 0 {
+				block[j] *= int16(2*rd.decodeICDF(icdf, 8) - 1)
+			}
+		}
+	}
+}
+
+// silkShellDecode splits the pulses of a block of 16 in halves recursively
+func silkShellDecode(rd *rangeDecoder, out []int16, total int) {
+	var p3 [2]int16
+	var p2 [4]int16
+	var p1 [8]int16
+
+	split := func(child []int16, p int16, table int) {
+		if p > 0 {
+			child[0] = int16(rd.decodeICDF(silkShellCodeTables[table][silkShellCodeTableOffsets[p]:], 8))
+			child[1] = p - child[0]
+		} else {
+			child[0], child[1] = 0, 0
+		}
+	}
+
+	split(p3[0:], int16(total), 3)
+	split(p2[0:], p3[0], 2)
+	split(p1[0:], p2[0], 1)
+	split(out[0:], p1[0], 0)
+	split(out[2:], p1[1], 0)
+	split(p1[2:], p2[1], 1)
+	split(out[4:], p1[2], 0)
+	split(out[6:], p1[3], 0)
+	split(p2[2:], p3[1], 2)
+	split(p1[4:], p2[2], 1)
+	split(out[8:], p1[4], 0)
+	split(out[10:], p1[5], 0)
+	split(p1[6:], p2[3], 1)
+	split(out[12:], p1[6], 0)
+	split(out[14:], p1[7], 0)
+}
+
+func (ch *silkChannel) decodeParameters(ctrl *silkControl, condCoding int) {
+	ix := &ch.indices
+
+	// gains
+	for k := 0; k < ch.subframes; k++ {
+		if k == 0 && condCoding != SILK_CODE_CONDITIONALLY {
+			ch.lastGainIndex = max(ix.gains[k], ch.lastGainIndex-16)
+		} else {
+			delta := ix.gains[k] - 4
+			threshold := 2*36 - SILK_GAIN_LEVELS + ch.lastGainIndex
+			if delta > threshold {
+				ch.lastGainIndex += delta<<1 - threshold
+			} else {
+				ch.lastGainIndex += delta
+			}
+		}
+		ch.lastGainIndex = min(max(ch.lastGainIndex, 0), SILK_GAIN_LEVELS-1)
+		ctrl.gains[k] = silkLog2Lin(min(smulwb(SILK_GAIN_INV_SCALE, ch.lastGainIndex)+SILK_GAIN_OFFSET, 3967))
+	}
+
+	// LPC coefficients, interpolated with the last frame's in the first
+	// half of the frame
+	var nlsf, nlsf0 [SILK_MAX_LPC_ORDER]int16
+	ch.nlsfCB.decode(nlsf[:], ix.nlsf[:])
+	silkNLSF2A(ctrl.predCoef[1][:ch.lpcOrder], nlsf[:ch.lpcOrder])
+
+	if ch.firstFrameAfterReset {
+		ix.nlsfInterp = 4
+	}
+	if ix.nlsfInterp < 4 {
+		for i := 0; i < ch.lpcOrder; i++ {
+			nlsf0[i] = ch.prevNLSF[i] + int16((ix.nlsfInterp*(int32(nlsf[i])-int32(ch.prevNLSF[i])))>>2)
+		}
+		silkNLSF2A(ctrl.predCoef[0][:ch.lpcOrder], nlsf0[:ch.lpcOrder])
+	} else {
+		ctrl.predCoef[0] = ctrl.predCoef[1]
+	}
+	ch.prevNLSF = nlsf
+
+	if ix.signalType == SILK_TYPE_VOICED {
+		silkDecodePitch(ix.lag, ix.contour, ctrl.pitchL[:ch.subframes], ch.fsKHz)
+
+		codebook := silkLTPGainVQ[ix.periodicity]
+		for k := 0; k < ch.subframes; k++ {
+			for i := 0; i < SILK_LTP_ORDER; i++ {
+				ctrl.ltpCoef[k*SILK_LTP_ORDER+i] = int16(codebook[ix.ltp[k]][i]) << 7
+			}
+		}
+		ctrl.ltpScale = silkLTPScales[ix.ltpScale]
+	} else {
+		ix.periodicity = 0
+	}
+}
+
+// decodeCore reconstructs the excitation and runs it through the long and
+// short term synthesis filters
+func (ch *silkChannel) decodeCore(ctrl *silkControl, out []int16, pulses []int16) {
+	ix := &ch.indices
+
+	sLTP := make([]int16, ch.ltpMemLength)
+	sLTPQ15 := make([]int32, ch.ltpMemLength+ch.frameLength)
+	res := make([]int32, ch.subfrLength)
+	sLPC := make([]int32, ch.subfrLength+SILK_MAX_LPC_ORDER)
+
+	offset := silkQuantOffsets[ix.signalType>>1][ix.offsetType]
+	interpolated := ix.nlsfInterp < 4
+
+	seed := ix.seed
+	for i := 0; i < ch.frameLength; i++ {
+		seed = silkRand(seed)
+		e := int32(pulses[i]) << 14
+		if e > 0 {
+			e -= SILK_QUANT_LEVEL_ADJUST << 4
+		} else if e < 0 {
+			e += SILK_QUANT_LEVEL_ADJUST << 4
+		}
+		e += offset << 4
+		if seed < 0 {
+			e = -e
+		}
+		ch.exc[i] = e
+		seed += int32(pulses[i])
+	}
+
+	copy(sLPC, ch.sLPC[:])
+	exc := ch.exc[:]
+	xq := out
+	ltpIdx := ch.ltpMemLength
+	lag := int32(0)
+	for k := 0; k < ch.subframes; k++ {
+		resid := res
+		a := ctrl.predCoef[k>>1][:ch.lpcOrder]
+		b := ctrl.ltpCoef[k*SILK_LTP_ORDER:]
+
+		gainQ10 := ctrl.gains[k] >> 6
+		invGain := silkInverse32VarQ(ctrl.gains[k], 47)
+
+		gainAdj := int32(1 << 16)
+		if ctrl.gains[k] != ch.prevGain {
+			gainAdj = silkDiv32VarQ(ch.prevGain, ctrl.gains[k], 16)
+			for i := 0; i < SILK_MAX_LPC_ORDER; i++ {
+				sLPC[i] = smulww(gainAdj, sLPC[i])
+			}
+		}
+		ch.prevGain = ctrl.gains[k]
+
+		if ix.signalType == SILK_TYPE_VOICED {
+			lag = ctrl.pitchL[k]
+
+			if k == 0 || (k == 2 && interpolated) {
+				// rewhiten the past output with the current filter
+				start := ch.ltpMemLength - int(lag) - ch.lpcOrder - SILK_LTP_ORDER/2
+				if k == 2 {
+					copy(ch.outBuf[ch.ltpMemLength:], out[:2*ch.subfrLength])
+				}
+				silkLPCAnalysisFilter(sLTP[start:], ch.outBuf[start+k*ch.subfrLength:], a, ch.ltpMemLength-start)
+
+				if k == 0 {
+					invGain = smulwb(invGain, ctrl.ltpScale) << 2
+				}
+				for i := 0; i < int(lag)+SILK_LTP_ORDER/2; i++ {
+					sLTPQ15[ltpIdx-i-1] = smulwb(invGain, int32(sLTP[ch.ltpMemLength-i-1]))
+				}
+			} else if gainAdj != 1<<16 {
+				for i := 0; i < int(lag)+SILK_LTP_ORDER/2; i++ {
+					sLTPQ15[ltpIdx-i-1] = smulww(gainAdj, sLTPQ15[ltpIdx-i-1])
+				}
+			}
+
+			// long term prediction
+			p := ltpIdx - int(lag) + SILK_LTP_ORDER/2
+			for i := 0; i < ch.subfrLength; i++ {
+				pred := int32(2)
+				for j := 0; j < SILK_LTP_ORDER; j++ {
+					pred = smlawb(pred, sLTPQ15[p-j], int32(b[j]))
+				}
+				p++
+				resid[i] = exc[i] + pred<<1
+				sLTPQ15[ltpIdx] = resid[i] << 1
+				ltpIdx++
+			}
+		} else {
+			resid = exc
+		}
+
+		// short term prediction
+		for i := 0; i < ch.subfrLength; i++ {
+			pred := int32(ch.lpcOrder >> 1)
+			for j := 0; j < ch.lpcOrder; j++ {
+				pred = smlawb(pred, sLPC[SILK_MAX_LPC_ORDER+i-j-1], int32(a[j]))
+			}
+			sLPC[SILK_MAX_LPC_ORDER+i] = addSat32(resid[i], lshiftSat32(pred, 4))
+			xq[i] = sat16(rshiftRound(smulww(sLPC[SILK_MAX_LPC_ORDER+i], gainQ10), 8))
+		}
+
+		copy(sLPC, sLPC[ch.subfrLength:ch.subfrLength+SILK_MAX_LPC_ORDER])
+		exc = exc[ch.subfrLength:]
+		xq = xq[ch.subfrLength:]
+	}
+	copy(ch.sLPC[:], sLPC)
+}
+
+// unpack returns the cdf offsets and prediction coefficients of each
+// coefficient of the first stage vector index
+func (cb *silkNLSFCodebook) unpack(ecIx []int, predQ8 []uint8, index int) {
+	sel := cb.ecSelect[index*cb.order/2:]
+	for i := 0; i < cb.order; i += 2 {
+		entry := sel[i/2]
+		ecIx[i] = int(entry>>1&7) * (2*SILK_NLSF_MAX_AMPLITUDE + 1)
+		predQ8[i] = cb.pred[i+int(entry&1)*(cb.order-1)]
+		ecIx[i+1] = int(entry>>5&7) * (2*SILK_NLSF_MAX_AMPLITUDE + 1)
+		predQ8[i+1] = cb.pred[i+int(entry>>4&1)*(cb.order-1)+1]
+	}
+}
+
+// decode dequantises the NLSFs of the indices in Q15
+func (cb *silkNLSFCodebook) decode(nlsf []int16, indices []int32) {
+	var ecIx [SILK_MAX_LPC_ORDER]int
+	var predQ8 [SILK_MAX_LPC_ORDER]uint8
+	cb.unpack(ecIx[:], predQ8[:], int(indices[0]))
+
+	// residuals, predicted backwards from the last coefficient
+	var res [SILK_MAX_LPC_ORDER]int16
+	out := int32(0)
+	for i := cb.order - 1; i >= 0; i-- {
+		pred := smulbb(out, int32(predQ8[i])) >> 8
+		out = indices[i+1] << 10
+		if out > 0 {
+			out -= SILK_NLSF_LEVEL_ADJUST
+		} else if out < 0 {
+			out += SILK_NLSF_LEVEL_ADJUST
+		}
+		out = smlawb(pred, out, cb.stepSize)
+		res[i] = int16(out)
+	}
+
+	base := int(indices[0]) * cb.order
+	for i := 0; i < cb.order; i++ {
+		v := (int32(res[i])<<14)/cb.cb1Weights[base+i] + int32(cb.cb1[base+i])<<7
+		nlsf[i] = int16(min(max(v, 0), 32767))
+	}
+
+	silkNLSFStabilize(nlsf[:cb.order], cb.deltaMin)
+}
+
+// silkNLSFStabilize enforces the minimum spacing between NLSFs
+func silkNLSFStabilize(nlsf []int16, deltaMin []int32) {
+	l := len(nlsf)
+	for loops := 0; loops < 20; loops++ {
+		minDiff := int32(nlsf[0]) - deltaMin[0]
+		at := 0
+		for i := 1; i < l; i++ {
+			diff := int32(nlsf[i]) - (int32(nlsf[i-1]) + deltaMin[i])
+			if diff < minDiff {
+				minDiff, at = diff, i
+			}
+		}
+		diff := 1<<15 - (int32(nlsf[l-1]) + deltaMin[l])
+		if diff < minDiff {
+			minDiff, at = diff, l
+		}
+
+		if minDiff >= 0 {
+			return
+		}
+
+		switch at {
+		case 0:
+			nlsf[0] = int16(deltaMin[0])
+		case l:
+			nlsf[l-1] = int16(1<<15 - deltaMin[l])
+		default:
+			minCenter := int32(0)
+			for k := 0; k < at; k++ {
+				minCenter += deltaMin[k]
+			}
+			minCenter += deltaMin[at] >> 1
+
+			maxCenter := int32(1 << 15)
+			for k := l; k > at; k-- {
+				maxCenter -= deltaMin[k]
+			}
+			maxCenter -= deltaMin[at] >> 1
+
+			center := int16(silkLimit(rshiftRound(int32(nlsf[at-1])+int32(nlsf[at]), 1), minCenter, maxCenter))
+			nlsf[at-1] = center - int16(deltaMin[at]>>1)
+			nlsf[at] = nlsf[at-1] + int16(deltaMin[at])
+		}
+	}
+
+	// give up and force the spacing
+	slices.Sort(nlsf)
+	nlsf[0] = int16(max(int32(nlsf[0]), deltaMin[0]))
+	for i := 1; i < l; i++ {
+		nlsf[i] = int16(max(int32(nlsf[i]), int32(sat16(int32(nlsf[i-1])+deltaMin[i]))))
+	}
+	nlsf[l-1] = int16(min(int32(nlsf[l-1]), 1<<15-deltaMin[l]))
+	for i := l - 2; i >= 0; i-- {
+		nlsf[i] = int16(min(int32(nlsf[i]), int32(nlsf[i+1])-deltaMin[i+1]))
+	}
+}
+
+var (
+	silkNLSFOrdering16 = [16]int{0, 15, 8, 7, 4, 11, 12, 3, 2, 13, 10, 5, 6, 9, 14, 1}
+	silkNLSFOrdering10 = [10]int{0, 9, 6, 3, 4, 5, 8, 1, 2, 7}
+)
+
+// silkNLSF2A converts NLSFs in Q15 to stable LPC coefficients in Q12
+func silkNLSF2A(a []int16, nlsf []int16) {
+	const QA = 16
+	d := len(nlsf)
+
+	ordering := silkNLSFOrdering10[:]
+	if d == 16 {
+		ordering = silkNLSFOrdering16[:]
+	}
+
+	var cosLSF [SILK_MAX_LPC_ORDER]int32
+	for k := 0; k < d; k++ {
+		fInt := int32(nlsf[k]) >> (15 - 7)
+		fFrac := int32(nlsf[k]) - fInt<<(15-7)
+		cos := silkLSFCos[fInt]
+		delta := silkLSFCos[fInt+1] - cos
+		cosLSF[ordering[k]] = rshiftRound(cos<<8+delta*fFrac, 20-QA)
+	}
+
+	findPoly := func(out []int32, c []int32, dd int) {
+		out[0] = 1 << QA
+		out[1] = -c[0]
+		for k := 1; k < dd; k++ {
+			f := int64(c[2*k])
+			out[k+1] = out[k-1]<<1 - int32(rshiftRound64(f*int64(out[k]), QA))
+			for n := k; n > 1; n-- {
+				out[n] += out[n-2] - int32(rshiftRound64(f*int64(out[n-1]), QA))
+			}
+			out[1] -= int32(f)
+		}
+	}
+
+	dd := d >> 1
+	var p, q [SILK_MAX_LPC_ORDER/2 + 1]int32
+	findPoly(p[:], cosLSF[0:], dd)
+	findPoly(q[:], cosLSF[1:], dd)
+
+	var a32 [SILK_MAX_LPC_ORDER]int32
+	for k := 0; k < dd; k++ {
+		pt := p[k+1] + p[k]
+		qt := q[k+1] - q[k]
+		a32[k] = -qt - pt
+		a32[d-k-1] = qt - pt
+	}
+
+	silkLPCFit(a, a32[:d], 12, QA+1)
+
+	for i := 0; silkLPCInversePredGain(a) == 0 && i < 16; i++ {
+		silkBWExpander32(a32[:d], 65536-int32(2)<<i)
+		for k := 0; k < d; k++ {
+			a[k] = int16(rshiftRound(a32[k], QA+1-12))
+		}
+	}
+}
+
+// silkLPCFit converts coefficients from qIn to 16 bit qOut, bandwidth
+// expanding them until they fit
+func silkLPCFit(out []int16, in []int32, qOut uint, qIn uint) {
+	i := 0
+	for ; i < 10; i++ {
+		maxAbs, idx := int32(0), 0
+		for k, v := range in {
+			if abs32(v) > maxAbs {
+				maxAbs, idx = abs32(v), k
+			}
+		}
+		maxAbs = rshiftRound(maxAbs, qIn-qOut)
+		if maxAbs <= math.MaxInt16 {
+			break
+		}
+
+		maxAbs = min(maxAbs, 163838)
+		chirp := int32(65470) - ((maxAbs-math.MaxInt16)<<14)/((maxAbs*int32(idx+1))>>2)
+		silkBWExpander32(in, chirp)
+	}
+
+	if i == 10 {
+		for k := range in {
+			out[k] = sat16(rshiftRound(in[k], qIn-qOut))
+			in[k] = int32(out[k]) << (qIn - qOut)
+		}
+	} else {
+		for k := range in {
+			out[k] = int16(rshiftRound(in[k], qIn-qOut))
+		}
+	}
+}
+
+func silkBWExpander32(a []int32, chirp int32) {
+	d := len(a)
+	chirpMinusOne := chirp - 65536
+	for i := 0; i < d-1; i++ {
+		a[i] = smulww(chirp, a[i])
+		chirp += rshiftRound(chirp*chirpMinusOne, 16)
+	}
+	a[d-1] = smulww(chirp, a[d-1])
+}
+
+// silkLPCInversePredGain returns the inverse prediction gain of a filter in
+// Q30, or 0 if the filter is unstable
+func silkLPCInversePredGain(a []int16) int32 {
+	const QA = 24
+	const A_LIMIT = 16773022    // 0.99975 in QA
+	const MIN_INV_GAIN = 107374 // 1/1e4 in Q30
+
+	var aQA [SILK_MAX_LPC_ORDER]int32
+	dc := int32(0)
+	for k, v := range a {
+		dc += int32(v)
+		aQA[k] = int32(v) << (QA - 12)
+	}
+	if dc >= 4096 {
+		return 0
+	}
+
+	invGain := int32(1 << 30)
+	k := len(a) - 1
+	for ; k > 0; k-- {
+		if aQA[k] > A_LIMIT || aQA[k] < -A_LIMIT {
+			return 0
+		}
+		rc := -(aQA[k] << (31 - QA))
+		rcMult1 := int32(1<<30) - smmul(rc, rc)
+		invGain = smmul(invGain, rcMult1) << 2
+		if invGain < MIN_INV_GAIN {
+			return 0
+		}
+
+		mult2Q := uint(32 - clz32(abs32(rcMult1)))
+		rcMult2 := silkInverse32VarQ(rcMult1, int(mult2Q+30))
+		for n := 0; n < (k+1)>>1; n++ {
+			t1 := aQA[n]
+			t2 := aQA[k-n-1]
+			v := rshiftRound64(int64(subSat32(t1, int32(rshiftRound64(int64(t2)*int64(rc), 31))))*int64(rcMult2), mult2Q)
+			if v > math.MaxInt32 || v < math.MinInt32 {
+				return 0
+			}
+			aQA[n] = int32(v)
+			v = rshiftRound64(int64(subSat32(t2, int32(rshiftRound64(int64(t1)*int64(rc), 31))))*int64(rcMult2), mult2Q)
+			if v > math.MaxInt32 || v < math.MinInt32 {
+				return 0
+			}
+			aQA[k-n-1] = int32(v)
+		}
+	}
+
+	if aQA[0] > A_LIMIT || aQA[0] < -A_LIMIT {
+		return 0
+	}
+	rc := -(aQA[0] << (31 - QA))
+	rcMult1 := int32(1<<30) - smmul(rc, rc)
+	invGain = smmul(invGain, rcMult1) << 2
+	if invGain < MIN_INV_GAIN {
+		return 0
+	}
+	return invGain
+}
+
+// silkLPCAnalysisFilter writes the prediction residual of in to out, the
+// first len(a) outputs being zero
+func silkLPCAnalysisFilter(out []int16, in []int16, a []int16, n int) {
+	d := len(a)
+	for ix := d; ix < n; ix++ {
+		acc := int32(0)
+		for j := 0; j < d; j++ {
+			acc += int32(in[ix-1-j]) * int32(a[j])
+		}
+		acc = int32(in[ix])<<12 - acc
+		out[ix] = sat16(rshiftRound(acc, 12))
+	}
+	clear(out[:d])
+}
+
+// silkDecodePitch returns the pitch lag of each subframe
+func silkDecodePitch(lagIndex int32, contour int32, lags []int32, fsKHz int) {
+	minLag := int32(SILK_PITCH_MIN_LAG_MS * fsKHz)
+	maxLag := int32(SILK_PITCH_MAX_LAG_MS * fsKHz)
+	lag := minLag + lagIndex
+
+	for k := range lags {
+		var offset int8
+		switch {
+		case fsKHz == 8 && len(lags) == SILK_MAX_SUBFRAMES:
+			offset = silkLagsStage2[k][contour]
+		case fsKHz == 8:
+			offset = silkLagsStage2_10ms[k][contour]
+		case len(lags) == SILK_MAX_SUBFRAMES:
+			offset = silkLagsStage3[k][contour]
+		default:
+			offset = silkLagsStage3_10ms[k][contour]
+		}
+		lags[k] = silkLimit(lag+int32(offset), minLag, maxLag)
+	}
+}
+
+// silkStereoDecodePred reads the mid to side prediction weights in Q13
+func silkStereoDecodePred(rd *rangeDecoder, pred *[2]int32) {
+	var ix [2][3]int
+	n := rd.decodeICDF(silkStereoPredJointICDF, 8)
+	ix[0][2] = n / 5
+	ix[1][2] = n - 5*ix[0][2]
+	for n := 0; n < 2; n++ {
+		ix[n][0] = rd.decodeICDF(silkUniform3ICDF, 8)
+		ix[n][1] = rd.decodeICDF(silkUniform5ICDF, 8)
+	}
+
+	for n := 0; n < 2; n++ {
+		ix[n][0] += 3 * ix[n][2]
+		low := silkStereoPredQuant[ix[n][0]]
+		step := smulwb(silkStereoPredQuant[ix[n][0]+1]-low, 6554) // 0.1 in Q16
+		pred[n] = low + smulbb(step, int32(2*ix[n][1]+1))
+	}
+	pred[0] -= pred[1]
+}
+
+// msToLR converts mid and side, each after two samples of history, to left
+// and right in place
+func (dec *silkDecoder) msToLR(x1 []int16, x2 []int16, pred [2]int32, fsKHz int) {
+	n := len(x1) - 2
+
+	x1[0], x1[1] = dec.sMid[0], dec.sMid[1]
+	x2[0], x2[1] = dec.sSide[0], dec.sSide[1]
+	dec.sMid[0], dec.sMid[1] = x1[n], x1[n+1]
+	dec.sSide[0], dec.sSide[1] = x2[n], x2[n+1]
+
+	pred0, pred1 := dec.predPrev[0], dec.predPrev[1]
+	interp := SILK_STEREO_INTERP_MS * fsKHz
+	denom := int32((1 << 16) / interp)
+	delta0 := rshiftRound(smulbb(pred[0]-dec.predPrev[0], denom), 16)
+	delta1 := rshiftRound(smulbb(pred[1]-dec.predPrev[1], denom), 16)
+
+	for i := 0; i < n; i++ {
+		if i < interp {
+			pred0 += delta0
+			pred1 += delta1
+		} else {
+			pred0, pred1 = pred[0], pred[1]
+		}
+		sum := (int32(x1[i]) + int32(x1[i+2]) + int32(x1[i+1])<<1) << 9
+		sum = smlawb(int32(x2[i+1])<<8, sum, pred0)
+		sum = smlawb(sum, int32(x1[i+1])<<11, pred1)
+		x2[i+1] = sat16(rshiftRound(sum, 8))
+	}
+	dec.predPrev = pred
+
+	for i := 1; i <= n; i++ {
+		sum := int32(x1[i]) + int32(x2[i])
+		diff := int32(x1[i]) - int32(x2[i])
+		x1[i] = sat16(sum)
+		x2[i] = sat16(diff)
+	}
+}
+
+// silkResampler upsamples SILK's internal rate to 48 kHz with a 2x allpass
+// interpolator followed by a fractional FIR
+type silkResampler struct {
+	iir        [6]int32
+	fir        [SILK_RESAMPLER_ORDER]int16
+	delayBuf   [16]int16
+	inputDelay int
+	fsInKHz    int
+	batchSize  int
+	invRatio   int32 // in Q16
+}
+
+func (r *silkResampler) init(fsKHz int) {
+	*r = silkResampler{fsInKHz: fsKHz, batchSize: fsKHz * 10}
+	switch fsKHz {
+	case 12:
+		r.inputDelay = 4
+	case 16:
+		r.inputDelay = 7
+	}
+
+	in := int32(fsKHz * 1000)
+	r.invRatio = ((in << 15) / 48000) << 2
+	for smulww(r.invRatio, 48000) < in<<1 {
+		r.invRatio++
+	}
+}
+
+// process resamples in to out, which must hold 48/fsInKHz times as many
+// samples
+func (r *silkResampler) process(out []int16, in []int16) {
+	n := r.fsInKHz - r.inputDelay
+	copy(r.delayBuf[r.inputDelay:r.fsInKHz], in[:n])
+
+	r.interpolate(out, r.delayBuf[:r.fsInKHz])
+	r.interpolate(out[48:], in[n:len(in)-r.inputDelay])
+
+	copy(r.delayBuf[:r.inputDelay], in[len(in)-r.inputDelay:])
+}
+
+func (r *silkResampler) interpolate(out []int16, in []int16) {
+	buf := make([]int16, 2*r.batchSize+SILK_RESAMPLER_ORDER)
+	copy(buf, r.fir[:])
+
+	o := 0
+	var n int
+	for {
+		n = min(len(in), r.batchSize)
+		r.up2(buf[SILK_RESAMPLER_ORDER:], in[:n])
+
+		maxIndex := int32(n) << 17
+		for index := int32(0); index < maxIndex; index += r.invRatio {
+			t := smulwb(index&0xFFFF, 12)
+			p := buf[index>>16:]
+			res := int32(p[0]) * silkResamplerFracFIR12[t][0]
+			res += int32(p[1]) * silkResamplerFracFIR12[t][1]
+			res += int32(p[2]) * silkResamplerFracFIR12[t][2]
+			res += int32(p[3]) * silkResamplerFracFIR12[t][3]
+			res += int32(p[4]) * silkResamplerFracFIR12[11-t][3]
+			res += int32(p[5]) * silkResamplerFracFIR12[11-t][2]
+			res += int32(p[6]) * silkResamplerFracFIR12[11-t][1]
+			res += int32(p[7]) * silkResamplerFracFIR12[11-t][0]
+			out[o] = sat16(rshiftRound(res, 15))
+			o++
+		}
+
+		in = in[n:]
+		if len(in) == 0 {
+			break
+		}
+		copy(buf, buf[n<<1:n<<1+SILK_RESAMPLER_ORDER])
+	}
+	copy(r.fir[:], buf[n<<1:n<<1+SILK_RESAMPLER_ORDER])
+}
+
+// up2 doubles the rate of in with two allpass filter chains
+func (r *silkResampler) up2(out []int16, in []int16) {
+	s := &r.iir
+	for k, v := range in {
+		in32 := int32(v) << 10
+
+		y := in32 - s[0]
+		x := smulwb(y, silkResamplerUp2HQ0[0])
+		out1 := s[0] + x
+		s[0] = in32 + x
+		y = out1 - s[1]
+		x = smulwb(y, silkResamplerUp2HQ0[1])
+		out2 := s[1] + x
+		s[1] = out1 + x
+		y = out2 - s[2]
+		x = smlawb(y, y, silkResamplerUp2HQ0[2])
+		out1 = s[2] + x
+		s[2] = out2 + x
+		out[2*k] = sat16(rshiftRound(out1, 10))
+
+		y = in32 - s[3]
+		x = smulwb(y, silkResamplerUp2HQ1[0])
+		out1 = s[3] + x
+		s[3] = in32 + x
+		y = out1 - s[4]
+		x = smulwb(y, silkResamplerUp2HQ1[1])
+		out2 = s[4] + x
+		s[4] = out1 + x
+		y = out2 - s[5]
+		x = smlawb(y, y, silkResamplerUp2HQ1[2])
+		out1 = s[5] + x
+		s[5] = out2 + x
+		out[2*k+1] = sat16(rshiftRound(out1, 10))
+	}
+}
+
+// fixed point helpers, named after the reference's macros
+
+func smulwb(a int32, b int32) int32 {
+	return int32(int64(a) * int64(int16(b)) >> 16)
+}
+
+func smlawb(a int32, b int32, c int32) int32 {
+	return a + smulwb(b, c)
+}
+
+func smulww(a int32, b int32) int32 {
+	return int32(int64(a) * int64(b) >> 16)
+}
+
+func smulbb(a int32, b int32) int32 {
+	return int32(int16(a)) * int32(int16(b))
+}
+
+func smmul(a int32, b int32) int32 {
+	return int32(int64(a) * int64(b) >> 32)
+}
+
+func rshiftRound(a int32, shift uint) int32 {
+	if shift == 1 {
+		return a>>1 + a&1
+	}
+	return (a>>(shift-1) + 1) >> 1
+}
+
+func rshiftRound64(a int64, shift uint) int64 {
+	return (a>>(shift-1) + 1) >> 1
+}
+
+func sat16(a int32) int16 {
+	return int16(min(max(a, math.MinInt16), math.MaxInt16))
+}
+
+func addSat32(a int32, b int32) int32 {
+	return int32(min(max(int64(a)+int64(b), math.MinInt32), math.MaxInt32))
+}
+
+func subSat32(a int32, b int32) int32 {
+	return int32(min(max(int64(a)-int64(b), math.MinInt32), math.MaxInt32))
+}
+
+func lshiftSat32(a int32, shift uint) int32 {
+	return min(max(a, math.MinInt32>>shift), math.MaxInt32>>shift) << shift
+}
+
+func abs32(a int32) int32 {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+func clz32(a int32) int {
+	return bits.LeadingZeros32(uint32(a))
+}
+
+// silkLimit clamps a to the range between limits given in either order
+func silkLimit(a int32, lo int32, hi int32) int32 {
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+	return min(max(a, lo), hi)
+}
+
+func silkRand(seed int32) int32 {
+	return 907633515 + seed*196314165
+}
+
+// silkLog2Lin approximates 2^(in/128)
+func silkLog2Lin(in int32) int32 {
+	if in < 0 {
+		return 0
+	} else if in >= 3967 {
+		return math.MaxInt32
+	}
+
+	out := int32(1) << (in >> 7)
+	frac := in & 0x7F
+	if in < 2048 {
+		out += (out * smlawb(frac, smulbb(frac, 128-frac), -174)) >> 7
+	} else {
+		out += (out >> 7) * smlawb(frac, smulbb(frac, 128-frac), -174)
+	}
+	return out
+}
+
+// silkInverse32VarQ approximates 1/b in Q format q
+func silkInverse32VarQ(b int32, q int) int32 {
+	headroom := clz32(abs32(b)) - 1
+	norm := b << headroom
+	inv := (math.MaxInt32 >> 2) / (norm >> 16)
+
+	result := inv << 16
+	err := (int32(1<<29) - smulwb(norm, inv)) << 3
+	result += smulww(err, inv)
+
+	shift := 61 - headroom - q
+	if shift <= 0 {
+		return lshiftSat32(result, uint(-shift))
+	} else if shift < 32 {
+		return result >> shift
+	}
+	return 0
+}
+
+// silkDiv32VarQ approximates a/b in Q format q
+func silkDiv32VarQ(a int32, b int32, q int) int32 {
+	aHeadroom := clz32(abs32(a)) - 1
+	aNorm := a << aHeadroom
+	bHeadroom := clz32(abs32(b)) - 1
+	bNorm := b << bHeadroom
+
+	inv := (math.MaxInt32 >> 2) / (bNorm >> 16)
+	result := smulwb(aNorm, inv)
+	aNorm -= smmul(bNorm, result) << 3
+	result = smlawb(result, aNorm, inv)
+
+	shift := 29 + aHeadroom - bHeadroom - q
+	if shift < 0 {
+		return lshiftSat32(result, uint(-shift))
+	} else if shift < 32 {
+		return result >> shift
+	}
+	return 0
+}
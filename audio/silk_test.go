@@ -0,0 +1,766 @@
+package audio
+
+import (
+	"math"
+	"math/bits"
+	"math/rand"
+	"testing"
+)
+
+// silkTestFrame holds the quantisation indices of one SILK frame
+type silkTestFrame struct {
+	signalType int
+	offsetType int
+	// the first gain is absolute when the frame is coded independently, the
+	// rest are deltas
+	gains       [SILK_MAX_SUBFRAMES]int
+	nlsf1       int
+	nlsf2       [SILK_MAX_LPC_ORDER]int
+	interp      int
+	lagDelta    int // 0 when the lag is coded absolutely
+	lag         int
+	contour     int
+	periodicity int
+	ltp         [SILK_MAX_SUBFRAMES]int
+	ltpScale    int
+	seed        int
+	rateLevel   int
+	pulses      []int
+}
+
+func silkTestCodebook(fsKHz int) *silkNLSFCodebook {
+	if fsKHz == 16 {
+		return &silkNLSFCodebookWB
+	}
+	return &silkNLSFCodebookNBMB
+}
+
+func silkTestContourICDF(fsKHz int, subframes int) []uint8 {
+	switch {
+	case fsKHz == 8 && subframes == 4:
+		return silkPitchContourNBICDF
+	case fsKHz == 8:
+		return silkPitchContour10msNBICDF
+	case subframes == 4:
+		return silkPitchContourICDF
+	}
+	return silkPitchContour10msICDF
+}
+
+// silkTestNLSFCoding unpacks the selectors of the stage one vector i1,
+// returning the distribution each residual is coded with and the predictor
+// of each from the one above it
+func silkTestNLSFCoding(cb *silkNLSFCodebook, i1 int) ([][]uint8, []int) {
+	var cdfs [][]uint8
+	var pred []int
+	for k := 0; k < cb.order; k++ {
+		sel := cb.ecSelect[(i1*cb.order+k)/2] >> (4 * (k & 1))
+		cdfs = append(cdfs, cb.ecICDF[int(sel>>1&7)*(2*SILK_NLSF_MAX_AMPLITUDE+1):])
+		if k < cb.order-1 {
+			pred = append(pred, int(cb.pred[k+int(sel&1)*(cb.order-1)]))
+		}
+	}
+	return cdfs, pred
+}
+
+// writeSILKFrame codes f, a frame of subframes at fsKHz. Frames after the
+// first of a packet are coded conditionally on the one before, prevVoiced
+// telling whether it was voiced.
+func writeSILKFrame(e *rangeEncoder, f *silkTestFrame, fsKHz int, subframes int, conditional bool, prevVoiced bool) {
+	if f.signalType == SILK_TYPE_INACTIVE {
+		e.encodeICDF(f.offsetType, silkTypeOffsetNoVADICDF, 8)
+	} else {
+		e.encodeICDF(2*f.signalType+f.offsetType-2, silkTypeOffsetVADICDF, 8)
+	}
+
+	if conditional {
+		e.encodeICDF(f.gains[0], silkDeltaGainICDF, 8)
+	} else {
+		e.encodeICDF(f.gains[0]>>3, silkGainICDF[f.signalType], 8)
+		e.encodeICDF(f.gains[0]&7, silkUniform8ICDF, 8)
+	}
+	for k := 1; k < subframes; k++ {
+		e.encodeICDF(f.gains[k], silkDeltaGainICDF, 8)
+	}
+
+	cb := silkTestCodebook(fsKHz)
+	e.encodeICDF(f.nlsf1, cb.cb1ICDF[f.signalType>>1*len(cb.cb1)/cb.order:], 8)
+	cdfs, _ := silkTestNLSFCoding(cb, f.nlsf1)
+	for k, cdf := range cdfs {
+		switch v := f.nlsf2[k]; {
+		case v >= SILK_NLSF_MAX_AMPLITUDE:
+			e.encodeICDF(2*SILK_NLSF_MAX_AMPLITUDE, cdf, 8)
+			e.encodeICDF(v-SILK_NLSF_MAX_AMPLITUDE, silkNLSFExtICDF, 8)
+		case v <= -SILK_NLSF_MAX_AMPLITUDE:
+			e.encodeICDF(0, cdf, 8)
+			e.encodeICDF(-SILK_NLSF_MAX_AMPLITUDE-v, silkNLSFExtICDF, 8)
+		default:
+			e.encodeICDF(v+SILK_NLSF_MAX_AMPLITUDE, cdf, 8)
+		}
+	}
+	if subframes == SILK_MAX_SUBFRAMES {
+		e.encodeICDF(f.interp, silkNLSFInterpolationICDF, 8)
+	}
+
+	if f.signalType == SILK_TYPE_VOICED {
+		if conditional && prevVoiced {
+			e.encodeICDF(f.lagDelta, silkPitchDeltaICDF, 8)
+		}
+		if f.lagDelta == 0 {
+			low := map[int][]uint8{8: silkUniform4ICDF, 12: silkUniform6ICDF, 16: silkUniform8ICDF}[fsKHz]
+			e.encodeICDF(f.lag/(fsKHz/2), silkPitchLagICDF, 8)
+			e.encodeICDF(f.lag%(fsKHz/2), low, 8)
+		}
+		e.encodeICDF(f.contour, silkTestContourICDF(fsKHz, subframes), 8)
+		e.encodeICDF(f.periodicity, silkLTPPerIndexICDF, 8)
+		for k := 0; k < subframes; k++ {
+			e.encodeICDF(f.ltp[k], silkLTPGainICDF[f.periodicity], 8)
+		}
+		if !conditional {
+			e.encodeICDF(f.ltpScale, silkLTPScaleICDF, 8)
+		}
+	}
+	e.encodeICDF(f.seed, silkUniform4ICDF, 8)
+
+	writeSILKPulses(e, f)
+}
+
+// writeSILKPulses codes the excitation of a frame in blocks of 16: the
+// count of pulses in each, shifted down until there are at most 16, the
+// counts split by halves, the bits shifted off, then the signs
+func writeSILKPulses(e *rangeEncoder, f *silkTestFrame) {
+	e.encodeICDF(f.rateLevel, silkRateLevelsICDF[f.signalType>>1][:], 8)
+
+	blocks := len(f.pulses) / SILK_SHELL_BLOCK
+	counts := make([]int, blocks)
+	shifts := make([]int, blocks)
+	mags := make([]int, len(f.pulses))
+	for i := range mags {
+		mags[i] = max(f.pulses[i], -f.pulses[i])
+	}
+	for i := 0; i < blocks; i++ {
+		block := mags[i*SILK_SHELL_BLOCK : (i+1)*SILK_SHELL_BLOCK]
+		for {
+			counts[i] = 0
+			for _, m := range block {
+				counts[i] += m >> shifts[i]
+			}
+			if counts[i] <= SILK_MAX_PULSES {
+				break
+			}
+			shifts[i]++
+		}
+
+		table := silkPulsesPerBlockICDF[f.rateLevel][:]
+		for j := 0; j < shifts[i]; j++ {
+			e.encodeICDF(SILK_MAX_PULSES+1, table, 8)
+			table = silkPulsesPerBlockICDF[len(silkPulsesPerBlockICDF)-1][:]
+		}
+		e.encodeICDF(counts[i], table, 8)
+	}
+
+	for i := 0; i < blocks; i++ {
+		shifted := make([]int, SILK_SHELL_BLOCK)
+		for k := range shifted {
+			shifted[k] = mags[i*SILK_SHELL_BLOCK+k] >> shifts[i]
+		}
+		writeSILKShell(e, shifted)
+	}
+
+	for i := 0; i < blocks; i++ {
+		for _, m := range mags[i*SILK_SHELL_BLOCK : (i+1)*SILK_SHELL_BLOCK] {
+			for j := shifts[i] - 1; j >= 0; j-- {
+				e.encodeICDF(m>>j&1, silkLSBICDF, 8)
+			}
+		}
+	}
+
+	signs := silkSignICDF[7*(f.offsetType+2*f.signalType):]
+	for i := 0; i < blocks; i++ {
+		if counts[i] == 0 && shifts[i] == 0 {
+			continue
+		}
+		icdf := []uint8{signs[min(counts[i], 6)], 0}
+		for _, p := range f.pulses[i*SILK_SHELL_BLOCK : (i+1)*SILK_SHELL_BLOCK] {
+			if p != 0 {
+				e.encodeICDF(boolInt(p > 0), icdf, 8)
+			}
+		}
+	}
+}
+
+// writeSILKShell codes how the pulses of a block divide between its halves,
+// then those of each half in turn
+func writeSILKShell(e *rangeEncoder, mags []int) {
+	if len(mags) == 1 {
+		return
+	}
+	half := len(mags) / 2
+	left, total := 0, 0
+	for k, m := range mags {
+		if k < half {
+			left += m
+		}
+		total += m
+	}
+	if total == 0 {
+		return
+	}
+	table := silkShellCodeTables[bits.TrailingZeros(uint(len(mags)))-1][silkShellCodeTableOffsets[total]:]
+	e.encodeICDF(left, table, 8)
+	writeSILKShell(e, mags[:half])
+	writeSILKShell(e, mags[half:])
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// silkReference decodes the indices of a mono SILK stream at one rate in
+// floating point, from the description in RFC 6716 section 4.2.7 rather than
+// the fixed point the decoder follows. Output is in 16 bit units.
+type silkReference struct {
+	fsKHz int
+
+	// the output so far and the unclamped output of the synthesis filter,
+	// after as much silence as the long term predictor looks back
+	out []float64
+	lpc []float64
+
+	gainIndex int
+	prevNLSF  []int
+	started   bool
+}
+
+func newSILKReference(fsKHz int) *silkReference {
+	history := SILK_LTP_MEMORY_MS * fsKHz
+	return &silkReference{
+		fsKHz:     fsKHz,
+		out:       make([]float64, history),
+		lpc:       make([]float64, history),
+		gainIndex: 10,
+	}
+}
+
+// output returns everything decoded
+func (ref *silkReference) output() []float64 {
+	return ref.out[SILK_LTP_MEMORY_MS*ref.fsKHz:]
+}
+
+// silkRefLog2Lin is the approximation of 2^(x/128) gains are dequantised by
+func silkRefLog2Lin(x int) int {
+	i, f := x>>7, x&127
+	return 1<<i + ((-174*f*(128-f))>>16+f)*((1<<i)>>7)
+}
+
+// silkRefGainIndex returns the gain index coded as symbol after prev,
+// absolutely though never dropping by more than 16 or as a delta that
+// doubles in size when large
+func silkRefGainIndex(prev int, symbol int, absolute bool) int {
+	next := max(symbol, prev-16)
+	if !absolute {
+		next = max(2*symbol-16, prev+symbol-4)
+	}
+	return min(max(next, 0), 63)
+}
+
+// silkRefNLSF dequantises and stabilises the NLSFs of a frame, in Q15, or
+// returns nil if they cannot be spaced out in the passes allowed
+func silkRefNLSF(cb *silkNLSFCodebook, i1 int, i2 []int) []int {
+	d := cb.order
+	_, pred := silkTestNLSFCoding(cb, i1)
+
+	res := make([]int, d) // in Q10
+	for k := d - 1; k >= 0; k-- {
+		q := i2[k] << 10
+		switch {
+		case q > 0:
+			q -= 102
+		case q < 0:
+			q += 102
+		}
+		res[k] = q * int(cb.stepSize) >> 16
+		if k+1 < d {
+			res[k] += res[k+1] * pred[k] >> 8
+		}
+	}
+
+	nlsf := make([]int, d)
+	for k := range nlsf {
+		v := int(cb.cb1[i1*d+k])<<7 + res[k]<<14/int(cb.cb1Weights[i1*d+k])
+		nlsf[k] = min(max(v, 0), 32767)
+	}
+
+	// the gap below each NLSF, and above the last, must be at least its
+	// minimum spacing
+	minGap := func(k int) int { return int(cb.deltaMin[k]) }
+	at := func(k int) int {
+		switch k {
+		case -1:
+			return 0
+		case d:
+			return 32768
+		}
+		return nlsf[k]
+	}
+	for loop := 0; loop < 20; loop++ {
+		worst, worstGap := 0, math.MaxInt
+		for k := 0; k <= d; k++ {
+			if gap := at(k) - at(k-1) - minGap(k); gap < worstGap {
+				worst, worstGap = k, gap
+			}
+		}
+		if worstGap >= 0 {
+			return nlsf
+		}
+
+		switch worst {
+		case 0:
+			nlsf[0] = minGap(0)
+		case d:
+			nlsf[d-1] = 32768 - minGap(d)
+		default:
+			lowest := minGap(worst) >> 1
+			for k := 0; k < worst; k++ {
+				lowest += minGap(k)
+			}
+			highest := 32768 - minGap(worst)>>1
+			for k := worst + 1; k <= d; k++ {
+				highest -= minGap(k)
+			}
+			center := min(max((nlsf[worst-1]+nlsf[worst]+1)>>1, lowest), highest)
+			nlsf[worst-1] = center - minGap(worst)>>1
+			nlsf[worst] = nlsf[worst-1] + minGap(worst)
+		}
+	}
+	return nil
+}
+
+// silkRefLPC converts NLSFs in Q15 to the prediction coefficients of the
+// synthesis filter, rounded to Q12
+func silkRefLPC(nlsf []int) []float64 {
+	a := silkRefPredictor(nlsf)
+	for k := range a {
+		a[k] = math.Round(a[k]*4096) / 4096
+	}
+	return a
+}
+
+// silkRefPredictor converts NLSFs in Q15 to the prediction coefficients of
+// the synthesis filter. The even NLSFs are the roots of P(z), the odd those
+// of Q(z), and A(z) = 1 - sum of a[k] z^-(k+1) is their mean once the
+// trivial roots are added. Cosines are interpolated from the table of RFC
+// 6716 section 4.2.7.5.6.
+func silkRefPredictor(nlsf []int) []float64 {
+	mul := func(a []float64, b []float64) []float64 {
+		out := make([]float64, len(a)+len(b)-1)
+		for i, x := range a {
+			for j, y := range b {
+				out[i+j] += x * y
+			}
+		}
+		return out
+	}
+	p, q := []float64{1, 1}, []float64{1, -1}
+	for k, f := range nlsf {
+		i, frac := f>>8, f&255
+		cos := float64(silkLSFCos[i]) + float64(silkLSFCos[i+1]-silkLSFCos[i])*float64(frac)/256
+		root := []float64{1, -cos / 4096, 1}
+		if k%2 == 0 {
+			p = mul(p, root)
+		} else {
+			q = mul(q, root)
+		}
+	}
+	a := make([]float64, len(nlsf))
+	for k := range a {
+		a[k] = -(p[k+1] + q[k+1]) / 2
+	}
+	return a
+}
+
+// silkRefRoundable tells whether the coefficients of nlsf round to Q12
+// clear of where the decoder's fixed point could round them the other way
+func silkRefRoundable(nlsf []int) bool {
+	for _, a := range silkRefPredictor(nlsf) {
+		if _, frac := math.Modf(math.Abs(a * 4096)); math.Abs(frac-0.5) < 0.05 {
+			return false
+		}
+	}
+	return true
+}
+
+// silkRefStable tells whether the synthesis filter of a is comfortably
+// stable, checked by stepping down through its reflection coefficients
+func silkRefStable(a []float64) bool {
+	for _, c := range a {
+		if math.Abs(c)*4096 > 30000 {
+			return false
+		}
+	}
+	a = append([]float64(nil), a...)
+	gain := 1.0
+	for m := len(a) - 1; m >= 0; m-- {
+		rc := a[m]
+		if math.Abs(rc) > 0.99 {
+			return false
+		}
+		gain *= 1 - rc*rc
+		b := append([]float64(nil), a[:m]...)
+		for i := range b {
+			b[i] = (a[i] + rc*a[m-1-i]) / (1 - rc*rc)
+		}
+		a = b
+	}
+	return gain > 3e-2
+}
+
+// silkRefLagOffset is the contour's offset of the pitch lag of subframe s
+func silkRefLagOffset(fsKHz int, subframes int, s int, contour int) int {
+	switch {
+	case fsKHz == 8 && subframes == 4:
+		return int(silkLagsStage2[s][contour])
+	case fsKHz == 8:
+		return int(silkLagsStage2_10ms[s][contour])
+	case subframes == 4:
+		return int(silkLagsStage3[s][contour])
+	}
+	return int(silkLagsStage3_10ms[s][contour])
+}
+
+// decode decodes the next frame, of subframes, coded conditionally on the
+// one before if it is not the first of its packet
+func (ref *silkReference) decode(f *silkTestFrame, subframes int, conditional bool) {
+	fs := ref.fsKHz
+	n := SILK_SUBFRAME_MS * fs
+	length := subframes * n
+	cb := silkTestCodebook(fs)
+
+	// gains
+	var gains [SILK_MAX_SUBFRAMES]float64
+	for s := 0; s < subframes; s++ {
+		ref.gainIndex = silkRefGainIndex(ref.gainIndex, f.gains[s], s == 0 && !conditional)
+		gains[s] = float64(silkRefLog2Lin(0x1D1C71*ref.gainIndex>>16+2090)) / 65536
+	}
+
+	// the filter of the first half of a 20 ms frame may be interpolated
+	// from the last frame's
+	nlsf := silkRefNLSF(cb, f.nlsf1, f.nlsf2[:cb.order])
+	a1 := silkRefLPC(nlsf)
+	a0 := a1
+	interpolated := subframes == SILK_MAX_SUBFRAMES && f.interp < 4 && ref.started
+	if interpolated {
+		mid := make([]int, cb.order)
+		for k := range mid {
+			mid[k] = ref.prevNLSF[k] + f.interp*(nlsf[k]-ref.prevNLSF[k])>>2
+		}
+		a0 = silkRefLPC(mid)
+	}
+	ref.prevNLSF, ref.started = nlsf, true
+
+	// excitation, its signs scrambled by a generator seeded from the frame
+	offsets := [2][2]float64{{25, 60}, {8, 25}}
+	offset := offsets[f.signalType>>1][f.offsetType] / 256
+	exc := make([]float64, length)
+	seed := uint32(f.seed)
+	for i := range exc {
+		seed = 196314165*seed + 907633515
+		p := f.pulses[i]
+		v := float64(p)
+		if p > 0 {
+			v -= 20.0 / 256
+		} else if p < 0 {
+			v += 20.0 / 256
+		}
+		v += offset
+		if seed&0x80000000 != 0 {
+			v = -v
+		}
+		exc[i] = v
+		seed += uint32(p)
+	}
+
+	voiced := f.signalType == SILK_TYPE_VOICED
+	var lags [SILK_MAX_SUBFRAMES]int
+	var taps [SILK_MAX_SUBFRAMES][SILK_LTP_ORDER]float64
+	ltpScale := 0.0
+	if voiced {
+		for s := 0; s < subframes; s++ {
+			lag := 2*fs + f.lag + silkRefLagOffset(fs, subframes, s, f.contour)
+			lags[s] = min(max(lag, 2*fs), 18*fs)
+			for k := range taps[s] {
+				taps[s][k] = float64(silkLTPGainVQ[f.periodicity][f.ltp[s]][k]) / 128
+			}
+		}
+		ltpScale = []float64{15565, 12288, 8192}[f.ltpScale] / 16384
+	}
+
+	start := len(ref.out)
+	ref.out = append(ref.out, make([]float64, length)...)
+	ref.lpc = append(ref.lpc, make([]float64, length)...)
+	out := ref.out[start:]
+	lpc := ref.lpc[start:]
+	clamp := func(v float64) float64 { return min(max(v, -32768), 32767) }
+
+	// the excitation after long term prediction, and times its gain
+	res := make([]float64, length)
+	scaled := make([]float64, length)
+	for s := 0; s < subframes; s++ {
+		j := s * n
+		a := a1
+		if s < 2 {
+			a = a0
+		}
+		g := gains[s]
+		copy(res[j:j+n], exc[j:j+n])
+
+		if voiced {
+			// the predictor looks back over the residual, from the output
+			// up to where it was last whitened, scaled to this subframe's
+			// gain
+			whiten, scale, whitened := a0, ltpScale, 0
+			if interpolated && s >= 2 {
+				whiten, scale, whitened = a1, 1.0, 2*n
+			}
+			lag := lags[s]
+			from := j - lag - 2
+			hist := make([]float64, lag+2+n)
+			for i := from; i < j; i++ {
+				if i < whitened {
+					w := ref.out[start+i]
+					for k, c := range whiten {
+						w -= c * ref.out[start+i-k-1]
+					}
+					hist[i-from] = clamp(w) * scale / g
+				} else {
+					hist[i-from] = scaled[i] / g
+				}
+			}
+			for i := j; i < j+n; i++ {
+				v := exc[i]
+				for k, b := range taps[s] {
+					v += b * hist[i-lag+2-k-from]
+				}
+				hist[i-from] = v
+				res[i] = v
+			}
+		}
+
+		for i := j; i < j+n; i++ {
+			scaled[i] = g * res[i]
+			v := scaled[i]
+			for k, c := range a {
+				v += c * ref.lpc[start+i-k-1]
+			}
+			lpc[i] = v
+			out[i] = clamp(v)
+		}
+	}
+}
+
+// silkRefResample upsamples x at fsKHz to 48 kHz the way the reference
+// decoder does: delayed, doubled by a pair of allpass chains, then
+// interpolated with a 12 phase FIR
+func silkRefResample(x []float64, fsKHz int) []float64 {
+	delay := map[int]int{8: 0, 12: 4, 16: 7}[fsKHz]
+	in := append(make([]float64, delay), x[:len(x)-delay]...)
+
+	chains := [2][3]float64{
+		{1746.0 / 65536, 14986.0 / 65536, 39083.0 / 65536},
+		{6854.0 / 65536, 25769.0 / 65536, 55542.0 / 65536},
+	}
+	var state [2][3]float64
+	doubled := make([]float64, 2*len(in))
+	for i, v := range in {
+		for c, chain := range chains {
+			y := v
+			for k, coef := range chain {
+				d := coef * (y - state[c][k])
+				y, state[c][k] = state[c][k]+d, y+d
+			}
+			doubled[2*i+c] = y
+		}
+	}
+
+	// each output takes the eight doubled samples around it, the phase
+	// of the filter picked by where it falls between them
+	at := func(i int) float64 {
+		if i < 0 {
+			return 0
+		}
+		return doubled[i]
+	}
+	out := make([]float64, len(x)*48/fsKHz)
+	for o := range out {
+		base, phase := o*fsKHz/24-8, o*fsKHz%24/2
+		v := 0.0
+		for k := 0; k < 4; k++ {
+			v += at(base+k) * float64(silkResamplerFracFIR12[phase][k])
+			v += at(base+7-k) * float64(silkResamplerFracFIR12[11-phase][k])
+		}
+		out[o] = v / 32768
+	}
+	return out
+}
+
+// silkTestSource makes up the frames of a mono SILK stream at one rate,
+// within what the reference decodes the way the decoder does: filters
+// that need no bandwidth expansion to be stable, and pitch lags in range
+type silkTestSource struct {
+	r     *rand.Rand
+	fsKHz int
+
+	gainIndex  int
+	prevNLSF   []int
+	prevVoiced bool
+	prevLag    int
+}
+
+// frame makes up the next frame, of subframes, coded conditionally on the
+// one before if it is not the first of its packet
+func (src *silkTestSource) frame(subframes int, conditional bool) *silkTestFrame {
+	r := src.r
+	fs := src.fsKHz
+	cb := silkTestCodebook(fs)
+	f := &silkTestFrame{
+		signalType: r.Intn(3),
+		offsetType: r.Intn(2),
+		seed:       r.Intn(4),
+		rateLevel:  r.Intn(9),
+	}
+
+	// gains wander about within earshot, now and then leaping up and
+	// dropping back
+	for k := 0; k < subframes; k++ {
+		switch {
+		case k == 0 && !conditional && src.gainIndex > 20 && r.Intn(4) == 0:
+			f.gains[0] = r.Intn(4)
+		case k == 0 && !conditional:
+			f.gains[0] = 12 + r.Intn(12)
+		case src.gainIndex <= 6 && r.Intn(2) == 0:
+			f.gains[k] = src.gainIndex + 13 + r.Intn(2)
+		case src.gainIndex > 24:
+			f.gains[k] = r.Intn(4)
+		default:
+			f.gains[k] = 2 + r.Intn(5)
+		}
+		src.gainIndex = silkRefGainIndex(src.gainIndex, f.gains[k], k == 0 && !conditional)
+	}
+
+	// mostly small residuals, now and then one needing the extension
+	for {
+		f.nlsf1 = r.Intn(len(cb.cb1) / cb.order)
+		for k := 0; k < cb.order; k++ {
+			f.nlsf2[k] = r.Intn(3) - 1
+			if r.Intn(20) == 0 {
+				f.nlsf2[k] = (r.Intn(7) - 3) * 2
+			}
+		}
+		f.interp = 4
+		if subframes == SILK_MAX_SUBFRAMES {
+			f.interp = r.Intn(5)
+		}
+
+		nlsf := silkRefNLSF(cb, f.nlsf1, f.nlsf2[:cb.order])
+		if nlsf == nil {
+			continue
+		}
+		stable := silkRefStable(silkRefLPC(nlsf)) && silkRefRoundable(nlsf)
+		if src.prevNLSF != nil && f.interp < 4 {
+			mid := make([]int, cb.order)
+			for k := range mid {
+				mid[k] = src.prevNLSF[k] + f.interp*(nlsf[k]-src.prevNLSF[k])>>2
+			}
+			stable = stable && silkRefStable(silkRefLPC(mid)) && silkRefRoundable(mid)
+		}
+		if stable {
+			src.prevNLSF = nlsf
+			break
+		}
+	}
+
+	if f.signalType == SILK_TYPE_VOICED {
+		lags := 16 * fs
+		f.lag = r.Intn(lags)
+		if conditional && src.prevVoiced && r.Intn(2) == 0 {
+			f.lagDelta = 1 + r.Intn(20)
+			f.lag = src.prevLag + f.lagDelta - 9
+			if f.lag < 0 || f.lag >= lags {
+				f.lagDelta, f.lag = 0, r.Intn(lags)
+			}
+		}
+		f.contour = r.Intn(len(silkTestContourICDF(fs, subframes)))
+		f.periodicity = r.Intn(3)
+		for k := 0; k < subframes; k++ {
+			f.ltp[k] = r.Intn(len(silkLTPGainICDF[f.periodicity]))
+		}
+		if !conditional {
+			f.ltpScale = r.Intn(3)
+		}
+		src.prevLag = f.lag
+	}
+	src.prevVoiced = f.signalType == SILK_TYPE_VOICED
+
+	// sparse pulses, with now and then a block loud enough that its counts
+	// are shifted down
+	length := subframes * SILK_SUBFRAME_MS * fs
+	f.pulses = make([]int, (length+SILK_SHELL_BLOCK-1)/SILK_SHELL_BLOCK*SILK_SHELL_BLOCK)
+	density := []int{12, 4, 6}[f.signalType]
+	for i := 0; i < length; i++ {
+		if r.Intn(density) == 0 {
+			f.pulses[i] = (1 + r.Intn(3)) * (2*r.Intn(2) - 1)
+		}
+	}
+	if r.Intn(4) == 0 {
+		f.pulses[r.Intn(length)] = 20 + r.Intn(60)
+	}
+	return f
+}
+
+func TestSILKResampler(t *testing.T) {
+	// a tone at each rate comes out at 48 kHz as the same tone, images of it
+	// filtered away
+	for _, fsKHz := range []int{8, 12, 16} {
+		for _, freq := range []float64{1000, 0.35 * float64(fsKHz) * 1000} {
+			var r silkResampler
+			r.init(fsKHz)
+			in := make([]int16, 20*fsKHz)
+			var out []float64
+			for frame := 0; frame < 20; frame++ {
+				for i := range in {
+					phase := 2 * math.Pi * freq * float64(frame*len(in)+i) / float64(fsKHz*1000)
+					in[i] = int16(math.Round(10000 * math.Sin(phase)))
+				}
+				resampled := make([]int16, len(in)*48/fsKHz)
+				r.process(resampled, in)
+				for _, v := range resampled {
+					out = append(out, float64(v))
+				}
+			}
+
+			// fit a tone to what follows the first frame, at whatever phase
+			// the delay through the filters leaves it
+			var ss, cc, sc, ys, yc float64
+			for i := 960; i < len(out); i++ {
+				si, ci := math.Sincos(2 * math.Pi * freq * float64(i) / 48000)
+				ss, cc, sc = ss+si*si, cc+ci*ci, sc+si*ci
+				ys, yc = ys+out[i]*si, yc+out[i]*ci
+			}
+			det := ss*cc - sc*sc
+			a, b := (ys*cc-yc*sc)/det, (yc*ss-ys*sc)/det
+			var residual float64
+			for i := 960; i < len(out); i++ {
+				si, ci := math.Sincos(2 * math.Pi * freq * float64(i) / 48000)
+				residual += math.Pow(out[i]-a*si-b*ci, 2)
+			}
+			residual = math.Sqrt(residual / float64(len(out)-960))
+
+			if amplitude := math.Hypot(a, b); math.Abs(amplitude-10000) > 20 || residual > 2 {
+				t.Fatalf("%d kHz, %g Hz: amplitude %.1f, residual %.2f", fsKHz, freq, amplitude, residual)
+			}
+		}
+	}
+}
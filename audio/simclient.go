@@ -0,0 +1,154 @@
+package audio
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBufferFull = errors.New("more audio loaded than the buffer has room for")
+)
+
+// SimulatedClient is an AudioClient that plays into nothing, draining its
+// buffer as a VirtualClock moves rather than as real time passes. Driving a
+// player with it and the same clock makes playback reproducible, for tests.
+type SimulatedClient struct {
+	mutex  sync.Mutex
+	clock  *VirtualClock
+	format PCMWaveFormat
+
+	bufferFrames int
+	queued       int // frames loaded and not yet played
+
+	playing  bool
+	lastTick time.Duration // clock time the buffer was last drained to
+	playTime time.Duration // clock time spent playing
+	consumed int           // frames due by playTime, played or not
+
+	written   []byte
+	played    int
+	underruns int
+}
+
+// NewSimulatedClient makes a client taking audio of the given format into a
+// buffer bufferFrames long
+func NewSimulatedClient(clock *VirtualClock, format *PCMWaveFormat, bufferFrames int) (*SimulatedClient, error) {
+	if !isSupportedFormat(format) {
+		return nil, ErrUnsupportedFormat
+	}
+	return &SimulatedClient{
+		clock:        clock,
+		format:       *format,
+		bufferFrames: bufferFrames,
+		lastTick:     clock.Now(),
+	}, nil
+}
+
+// drain plays the frames due since it was last called. Must hold the mutex.
+func (c *SimulatedClient) drain() {
+	now := c.clock.Now()
+	if c.playing {
+		c.playTime += now - c.lastTick
+	}
+	c.lastTick = now
+
+	due := int(int64(c.playTime) * int64(c.format.SampleRate) / int64(time.Second))
+	n := due - c.consumed
+	c.consumed = due
+
+	taken := min(n, c.queued)
+	c.queued -= taken
+	c.played += taken
+	c.underruns += n - taken
+}
+
+func (c *SimulatedClient) frameSize() int {
+	return int(c.format.NumChannels) * int(c.format.SampleDepth) / 8
+}
+
+func (c *SimulatedClient) GetPCMWaveFormat() *PCMWaveFormat {
+	format := c.format
+	return &format
+}
+
+func (c *SimulatedClient) GetBufferSize() (int, error) {
+	return c.bufferFrames, nil
+}
+
+func (c *SimulatedClient) GetBufferPadding() (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.drain()
+	return c.queued, nil
+}
+
+func (c *SimulatedClient) LoadToBuffer(data []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.drain()
+
+	frames := len(data) / c.frameSize()
+	if frames > c.bufferFrames-c.queued {
+		return 0, ErrBufferFull
+	}
+	c.queued += frames
+	c.written = append(c.written, data[:frames*c.frameSize()]...)
+	return frames * c.frameSize(), nil
+}
+
+func (c *SimulatedClient) ClearBuffer() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.drain()
+	c.queued = 0
+	return nil
+}
+
+func (c *SimulatedClient) Start() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.drain()
+	c.playing = true
+	return nil
+}
+
+func (c *SimulatedClient) Stop() (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.drain()
+	wasPlaying := c.playing
+	c.playing = false
+	return wasPlaying, nil
+}
+
+// Close stops the client, which holds nothing else to release
+func (c *SimulatedClient) Close() error {
+	_, err := c.Stop()
+	return err
+}
+
+// Written returns a copy of all the audio loaded into the client, including
+// any later cleared from the buffer before it played
+func (c *SimulatedClient) Written() []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]byte(nil), c.written...)
+}
+
+// Played is the number of frames that have left the buffer by playing
+func (c *SimulatedClient) Played() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.drain()
+	return c.played
+}
+
+// Underruns is the number of frames the client was due to play while its
+// buffer was empty
+func (c *SimulatedClient) Underruns() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.drain()
+	return c.underruns
+}
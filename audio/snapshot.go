@@ -0,0 +1,79 @@
+package audio
+
+const (
+	STATE_PAUSED = iota
+	STATE_PLAYING
+	STATE_CLOSED
+)
+
+// Snapshot is the state of a player at one moment. The player thread makes a
+// new one whenever its state changes, so one can be read from any goroutine
+// and stays the same once taken.
+type Snapshot struct {
+	State    int // one of the STATE_ constants
+	Position int // in 100ns units
+	Duration int // of the current track, in 100ns units
+
+	// the track playing, or last played once the queue has ended
+	Current Metadata
+
+	// the track fading out under the current one, nil unless crossfading
+	Outgoing *Metadata
+
+	// changes each time the queue does
+	QueueVersion uint64
+
+	Volume float64 // in dB
+	Muted  bool
+
+	queue  []Metadata // every track queued, never written once shared
+	played int        // tracks in queue up to and including the current one
+}
+
+// Queue returns the tracks still to play after the current one, preceded by
+// up to lookBehind of those already played, including the current one
+func (s *Snapshot) Queue(lookBehind int) []Metadata {
+	lookBehind = Clamp(lookBehind, 0, s.played)
+	return append([]Metadata(nil), s.queue[s.played-lookBehind:]...)
+}
+
+// Snapshot returns the player's state as last recorded by its thread
+func (p *Player) Snapshot() *Snapshot {
+	return p.snapshot.Load()
+}
+
+// storeSnapshot records the player's state for Snapshot, reusing the last
+// copy of the queue unless it has changed. Only the player thread may call
+// it once the thread has started.
+func (p *Player) storeSnapshot(state int) {
+	s := &Snapshot{
+		State:        state,
+		Position:     p.trackPosition,
+		Current:      *NewMetadata(),
+		Outgoing:     p.outgoing,
+		QueueVersion: p.queue.version,
+		Volume:       p.volume,
+		Muted:        p.muted,
+	}
+	if p.curSource != nil {
+		s.Current = p.curSource.GetMetadata()
+		s.Duration = int(s.Current.Duration)
+	}
+
+	if last := p.snapshot.Load(); last != nil && last.QueueVersion == s.QueueVersion {
+		s.queue, s.played = last.queue, last.played
+	} else {
+		s.queue, s.played = p.queue.GetDataQueue(len(p.queue.prevQ)), len(p.queue.prevQ)
+	}
+
+	p.snapshot.Store(s)
+}
+
+// updateSnapshot records the player's state while its thread runs
+func (p *Player) updateSnapshot() {
+	state := STATE_PAUSED
+	if p.playing {
+		state = STATE_PLAYING
+	}
+	p.storeSnapshot(state)
+}
@@ -0,0 +1,180 @@
+package audio
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// titles names the tracks of a queue
+func titles(queue []Metadata) []string {
+	out := make([]string, len(queue))
+	for i, m := range queue {
+		out[i] = m.Title
+	}
+	return out
+}
+
+func TestSnapshotQueue(t *testing.T) {
+	queue := make([]Metadata, 4)
+	for i := range queue {
+		queue[i] = Metadata{Title: fmt.Sprint(i)}
+	}
+	for _, test := range []struct {
+		played, lookBehind int
+		want               string
+	}{
+		// nothing played yet
+		{0, 0, "[0 1 2 3]"},
+		{0, 2, "[0 1 2 3]"},
+		// playing the first track
+		{1, 0, "[1 2 3]"},
+		{1, 1, "[0 1 2 3]"},
+		{1, 5, "[0 1 2 3]"},
+		{1, -1, "[1 2 3]"},
+		// playing the third
+		{3, 0, "[3]"},
+		{3, 2, "[1 2 3]"},
+		// playing the last, or having played it
+		{4, 0, "[]"},
+		{4, 1, "[3]"},
+		{4, 4, "[0 1 2 3]"},
+		{4, 9, "[0 1 2 3]"},
+	} {
+		s := &Snapshot{queue: queue, played: test.played}
+		got := s.Queue(test.lookBehind)
+		if fmt.Sprint(titles(got)) != test.want {
+			t.Fatalf("%d played, looking behind %d: %v, expected %s", test.played, test.lookBehind, titles(got), test.want)
+		}
+
+		// the queue returned is the caller's to change
+		if len(got) > 0 {
+			got[0].Title = "changed"
+			if s.Queue(test.lookBehind)[0].Title == "changed" {
+				t.Fatal("snapshot changed through its queue")
+			}
+		}
+	}
+}
+
+func TestSnapshotPlayer(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for _, name := range []string{"a", "b", "c"} {
+		path := filepath.Join(dir, name+".wav")
+		writeWav(t, path, 2, 48000, 16, false, 4800, constant(0.1))
+		paths = append(paths, path)
+	}
+	p := newSimPlayer(t, paths[:2])
+
+	first := p.Snapshot()
+	if first.State != STATE_PAUSED || first.Current.Title != "Song" || first.Current.Filepath != paths[0] {
+		t.Fatalf("first snapshot %+v", *first)
+	}
+	if got := len(first.Queue(0)); got != 1 {
+		t.Fatalf("%d tracks after the first", got)
+	}
+
+	// taking a snapshot does not hold it still for later ones, nor do later
+	// ones change it
+	p.AddSourcesToQueue(paths[2])
+	p.tap.waitQueued(t, 1)
+	p.Start()
+	p.Skip()
+	s := p.Snapshot()
+	if s.State != STATE_PLAYING || s.Current.Filepath != paths[1] || s.QueueVersion == first.QueueVersion {
+		t.Fatalf("snapshot %+v after skipping", *s)
+	}
+	if got := s.Queue(5); len(got) != 3 || got[2].Filepath != paths[2] {
+		t.Fatalf("queue %v", got)
+	}
+	if first.State != STATE_PAUSED || first.Current.Filepath != paths[0] || len(first.Queue(5)) != 2 {
+		t.Fatalf("first snapshot changed to %+v", *first)
+	}
+
+	// once the queue ends the last track stays current, and nothing is
+	// left after it
+	p.Skip()
+	p.step(5)
+	s = p.Snapshot()
+	if s.Current.Filepath != paths[2] || len(s.Queue(0)) != 0 || len(s.Queue(1)) != 1 {
+		t.Fatalf("snapshot %+v at the end", *s)
+	}
+
+	p.Close(context.Background())
+	if s := p.Snapshot(); s.State != STATE_CLOSED {
+		t.Fatalf("state %d after closing", s.State)
+	}
+}
+
+// TestSnapshotConcurrent reads snapshots while the player skips about, each
+// of which must hold together. Run with -race to check they are never
+// written once taken.
+func TestSnapshotConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for i := 0; i < 8; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("%d.wav", i))
+		writeWav(t, path, 2, 48000, 16, false, 2400*(i+1), constant(0.1))
+		paths = append(paths, path)
+	}
+	p := newSimPlayer(t, paths)
+	p.Start()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				s := p.Snapshot()
+				queue := s.Queue(1)
+				switch {
+				case len(queue) == 0 || queue[0].Filepath != s.Current.Filepath:
+					errs <- fmt.Errorf("current %s is not first in %v", s.Current.Filepath, queue)
+				case s.Duration != int(s.Current.Duration):
+					errs <- fmt.Errorf("duration %d for %s", s.Duration, s.Current.Filepath)
+				case s.Position < 0 || s.Position > s.Duration:
+					errs <- fmt.Errorf("position %d of %d", s.Position, s.Duration)
+				default:
+					continue
+				}
+				return
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		switch i % 5 {
+		case 0, 1:
+			p.Skip()
+		case 2:
+			p.Back()
+		case 3:
+			p.SeekForward()
+		case 4:
+			p.clock.Advance(30 * time.Millisecond)
+		}
+		if i%40 == 39 {
+			p.Back()
+			p.Back()
+			p.Back()
+		}
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
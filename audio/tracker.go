@@ -0,0 +1,412 @@
+package audio
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tracker formats, used where their effects behave differently
+const (
+	TRACKER_MOD = iota
+	TRACKER_S3M
+	TRACKER_XM
+	TRACKER_IT
+)
+
+const (
+	// notes are stored as key+1, with 0 meaning no note
+	TRACKER_NOTES     = 120
+	TRACKER_NOTE_FADE = 253
+	TRACKER_NOTE_CUT  = 254
+	TRACKER_NOTE_OFF  = 255
+
+	TRACKER_ORDER_SKIP = 254
+	TRACKER_ORDER_END  = 255
+
+	TRACKER_MAX_ROWS     = 256
+	TRACKER_DEFAULT_ROWS = 64
+
+	// a sample plays at its base frequency on C-5
+	TRACKER_BASE_NOTE = 60
+
+	TRACKER_DEFAULT_RATE = 44100
+	TRACKER_MIN_RATE     = 8000
+	TRACKER_MAX_RATE     = 192000
+
+	// a song that has not looped by then is rendered no further
+	TRACKER_MAX_DURATION = 2 * 60 * 60 * SECOND
+)
+
+const (
+	TRACKER_LOOP_NONE = iota
+	TRACKER_LOOP_FORWARD
+	TRACKER_LOOP_PINGPONG
+)
+
+// effects, translated from each format's own letters by its loader
+const (
+	TRACKER_FX_NONE = iota
+	TRACKER_FX_ARPEGGIO
+	TRACKER_FX_PORTA_UP // S3M and IT hold fine slides in the parameter
+	TRACKER_FX_PORTA_DOWN
+	TRACKER_FX_FINE_PORTA_UP
+	TRACKER_FX_FINE_PORTA_DOWN
+	TRACKER_FX_EXTRA_FINE_PORTA_UP
+	TRACKER_FX_EXTRA_FINE_PORTA_DOWN
+	TRACKER_FX_TONE_PORTA
+	TRACKER_FX_TONE_PORTA_VOL
+	TRACKER_FX_VIBRATO
+	TRACKER_FX_FINE_VIBRATO
+	TRACKER_FX_VIBRATO_VOL
+	TRACKER_FX_TREMOLO
+	TRACKER_FX_TREMOR
+	TRACKER_FX_PAN // 0-255
+	TRACKER_FX_PAN_SLIDE
+	TRACKER_FX_PANBRELLO
+	TRACKER_FX_OFFSET
+	TRACKER_FX_HIGH_OFFSET
+	TRACKER_FX_VOL_SLIDE
+	TRACKER_FX_FINE_VOL_UP
+	TRACKER_FX_FINE_VOL_DOWN
+	TRACKER_FX_VOLUME
+	TRACKER_FX_CHANNEL_VOL
+	TRACKER_FX_CHANNEL_VOL_SLIDE
+	TRACKER_FX_GLOBAL_VOL // 0-128
+	TRACKER_FX_GLOBAL_VOL_SLIDE
+	TRACKER_FX_JUMP
+	TRACKER_FX_BREAK // row number, already decoded from BCD
+	TRACKER_FX_SPEED
+	TRACKER_FX_TEMPO
+	TRACKER_FX_PATTERN_LOOP
+	TRACKER_FX_PATTERN_DELAY
+	TRACKER_FX_FINE_PATTERN_DELAY
+	TRACKER_FX_RETRIG // x volume change, y interval
+	TRACKER_FX_NOTE_CUT
+	TRACKER_FX_NOTE_DELAY
+	TRACKER_FX_KEY_OFF
+	TRACKER_FX_ENVELOPE_POS
+	TRACKER_FX_VIB_WAVE
+	TRACKER_FX_TREM_WAVE
+	TRACKER_FX_PAN_WAVE
+	TRACKER_FX_NNA
+)
+
+// volume column commands
+const (
+	TRACKER_VOL_NONE = iota
+	TRACKER_VOL_SET
+	TRACKER_VOL_SLIDE_UP
+	TRACKER_VOL_SLIDE_DOWN
+	TRACKER_VOL_FINE_UP
+	TRACKER_VOL_FINE_DOWN
+	TRACKER_VOL_PAN // 0-255
+	TRACKER_VOL_PAN_SLIDE_LEFT
+	TRACKER_VOL_PAN_SLIDE_RIGHT
+	TRACKER_VOL_PORTA_UP
+	TRACKER_VOL_PORTA_DOWN
+	TRACKER_VOL_TONE_PORTA // speed in TRACKER_FX_TONE_PORTA units
+	TRACKER_VOL_VIB_SPEED
+	TRACKER_VOL_VIBRATO // sets the depth and vibrates
+)
+
+// new note actions, for what happens to a note a new one replaces
+const (
+	TRACKER_NNA_CUT = iota
+	TRACKER_NNA_CONTINUE
+	TRACKER_NNA_OFF
+	TRACKER_NNA_FADE
+)
+
+var (
+	ErrNotTracker = errors.New("not a tracker module")
+)
+
+func init() {
+	RegisterAudioSourceProvider(".mod", newTrackerProvider(loadMOD))
+	RegisterAudioSourceProvider(".s3m", newTrackerProvider(loadS3M))
+	RegisterAudioSourceProvider(".xm", newTrackerProvider(loadXM))
+	RegisterAudioSourceProvider(".it", newTrackerProvider(loadIT))
+}
+
+type trackerCell struct {
+	note       uint8
+	instrument uint8
+	volCmd     uint8
+	volParam   uint8
+	effect     uint8
+	param      uint8
+}
+
+type trackerPattern struct {
+	rows  int
+	cells []trackerCell // rows * channels
+}
+
+type trackerSample struct {
+	name string
+	data []float32 // mono, -1 to 1
+
+	loop      int
+	loopStart int
+	loopEnd   int
+
+	// held while the key is down, before the normal loop takes over
+	susLoop  int
+	susStart int
+	susEnd   int
+
+	volume       int // 0-64
+	globalVolume int // 0-64
+	pan          int // 0-256, or -1 to keep the channel's
+
+	baseFreq float64 // frequency at TRACKER_BASE_NOTE
+
+	// automatic vibrato
+	vibType  int
+	vibSweep int
+	vibDepth int
+	vibRate  int
+}
+
+type trackerEnvPoint struct {
+	tick  int
+	value int
+}
+
+type trackerEnvelope struct {
+	enabled bool
+	points  []trackerEnvPoint
+
+	sustain  bool
+	susStart int // point indices
+	susEnd   int
+
+	loop      bool
+	loopStart int
+	loopEnd   int
+}
+
+type trackerKey struct {
+	note   uint8 // key actually played
+	sample int   // index into the samples, -1 for none
+}
+
+type trackerInstrument struct {
+	name   string
+	keymap [TRACKER_NOTES]trackerKey
+
+	volEnv   trackerEnvelope // 0-64
+	panEnv   trackerEnvelope // -32 to 32
+	pitchEnv trackerEnvelope // half semitones, -32 to 32
+
+	fadeout      int // subtracted from 65536 each tick after release
+	globalVolume int // 0-128
+	pan          int // 0-256, or -1 to keep the channel's
+	nna          int
+}
+
+type trackerModule struct {
+	kind    int
+	title   string
+	message string
+
+	channels int
+	orders   []uint8
+	patterns []trackerPattern
+
+	samples []trackerSample
+	// nil when notes select samples directly
+	instruments []trackerInstrument
+
+	speed        int
+	tempo        int
+	globalVolume int // 0-128
+	mixVolume    float64
+
+	channelPan    []int // 0-256
+	channelVolume []int // 0-64
+
+	linear      bool // slides in fractions of a semitone rather than periods
+	amigaLimits bool
+	fastSlides  bool // S3M volume slides also on the first tick
+	linkedPorta bool // IT tone portamento shares memory with E and F
+}
+
+// comment gathers the song message and instrument text, which trackers use
+// for credits and greetings
+func (mod *trackerModule) comment() string {
+	lines := make([]string, 0)
+	if msg := strings.TrimSpace(mod.message); msg != "" {
+		lines = append(lines, msg)
+	}
+	for _, ins := range mod.instruments {
+		if name := strings.TrimSpace(ins.name); name != "" {
+			lines = append(lines, name)
+		}
+	}
+	for _, s := range mod.samples {
+		if name := strings.TrimSpace(s.name); name != "" {
+			lines = append(lines, name)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// pattern returns the pattern playing at order, nil if it is missing
+func (mod *trackerModule) pattern(order int) *trackerPattern {
+	idx := int(mod.orders[order])
+	if idx >= len(mod.patterns) {
+		return nil
+	}
+	return &mod.patterns[idx]
+}
+
+// trackerString reads a fixed width text field
+func trackerString(b []byte) string {
+	return strings.TrimRight(trimTagString(b), " ")
+}
+
+// newTrackerEnvelope builds an envelope, cutting it short where its points
+// stop moving forward
+func newTrackerEnvelope(points []trackerEnvPoint, flags trackerEnvelope) trackerEnvelope {
+	env := flags
+	env.points = points
+	if len(points) == 0 {
+		env.enabled = false
+		return env
+	}
+	for i := 1; i < len(points); i++ {
+		if points[i].tick <= points[i-1].tick {
+			env.points = points[:i]
+			break
+		}
+	}
+	last := len(env.points) - 1
+	if env.susStart > env.susEnd || env.susEnd > last {
+		env.sustain = false
+	}
+	if env.loopStart > env.loopEnd || env.loopEnd > last {
+		env.loop = false
+	}
+	return env
+}
+
+// clampLoop keeps a loop inside the sample, disabling it if nothing is left
+func clampLoop(loop *int, start *int, end *int, length int) {
+	*end = min(*end, length)
+	if *loop == TRACKER_LOOP_NONE || *start < 0 || *end-*start < 2 {
+		*loop = TRACKER_LOOP_NONE
+		*start, *end = 0, 0
+	}
+}
+
+// trackerDecoder renders a module as a frameDecoder
+type trackerDecoder struct {
+	mod    *trackerModule
+	player *trackerPlayer
+
+	meta   Metadata
+	format PCMWaveFormat
+}
+
+type trackerLoader func(data []byte) (*trackerModule, error)
+
+func openTracker(path string, load trackerLoader) (*trackerDecoder, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	mod, err := load(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(mod.orders) == 0 || mod.channels == 0 {
+		return nil, ErrNotTracker
+	}
+
+	dec := &trackerDecoder{mod: mod}
+	dec.meta = *NewMetadata()
+	dec.meta.Filepath = path
+	dec.meta.Title = mod.title
+	if dec.meta.Title == "" {
+		dec.meta.Title = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	// none of the formats has an author field, so the artist stays unknown
+	// and any credits are left in the comment
+	dec.meta.Comment = mod.comment()
+
+	dec.selectRate(TRACKER_DEFAULT_RATE)
+	dec.meta.Duration = uint64(dec.player.duration())
+	dec.player.reset()
+
+	return dec, nil
+}
+
+func (dec *trackerDecoder) nativeFormat() *PCMWaveFormat {
+	format := dec.format
+	return &format
+}
+
+// selectRate renders at any rate within reason, so no resampling is needed
+func (dec *trackerDecoder) selectRate(rate uint32) *PCMWaveFormat {
+	rate = min(max(rate, TRACKER_MIN_RATE), TRACKER_MAX_RATE)
+	if dec.player != nil && rate == dec.format.SampleRate {
+		return dec.nativeFormat()
+	}
+	dec.format = PCMWaveFormat{
+		NumChannels: 2,
+		SampleRate:  rate,
+		SampleDepth: 32,
+		PCMType:     PCM_TYPE_FLOAT,
+	}
+	dec.player = newTrackerPlayer(dec.mod, int(rate))
+	return dec.nativeFormat()
+}
+
+func (dec *trackerDecoder) decode() ([]float64, int64, error) {
+	start := dec.player.frame
+	out := make([]float64, DECODE_BLOCK_FRAMES*2)
+	n := dec.player.render(out)
+	if n == 0 {
+		return nil, 0, io.EOF
+	}
+	return out[:n*2], start, nil
+}
+
+func (dec *trackerDecoder) seek(frame int64) error {
+	dec.player.seek(frame)
+	return nil
+}
+
+func (dec *trackerDecoder) metadata() Metadata {
+	return dec.meta
+}
+
+// close has nothing to release, the file was read whole when opened
+func (dec *trackerDecoder) close() error {
+	return nil
+}
+
+func newTrackerProvider(load trackerLoader) *AudioSourceProvider {
+	return &AudioSourceProvider{
+		func(metadata *Metadata) (AudioSource, error) {
+			dec, err := openTracker(metadata.Filepath, load)
+			if err != nil {
+				return nil, err
+			}
+			return newDecodedSource(dec), nil
+		},
+		func(path string) (*Metadata, error) {
+			dec, err := openTracker(path, load)
+			if err != nil {
+				return nil, err
+			}
+			metadata := dec.metadata()
+			return &metadata, nil
+		},
+	}
+}
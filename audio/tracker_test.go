@@ -0,0 +1,112 @@
+package audio
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TRACKER_TEST_TICK is the frames in a tick at the default tempo and rate
+const TRACKER_TEST_TICK = TRACKER_DEFAULT_RATE * 5 / (2 * MOD_DEFAULT_TEMPO)
+
+// trackerField is s in a zero padded field of n bytes
+func trackerField(s string, n int) []byte {
+	b := make([]byte, n)
+	copy(b, s)
+	return b
+}
+
+// openTestModule writes data out and opens it with load, checking what every
+// module has in common: stereo at the default rate for the given number of
+// frames, and no album
+func openTestModule(t *testing.T, name string, data []byte, load trackerLoader, frames int64) *trackerDecoder {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dec, err := openTracker(path, load)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFormat(t, dec, 2, TRACKER_DEFAULT_RATE, frames)
+	if m := dec.metadata(); m.Album != NOT_FOUND {
+		t.Fatalf("album %q", m.Album)
+	}
+	return dec
+}
+
+// zeroCrossings counts sign changes of the left channel over [from, to)
+func zeroCrossings(all []float64, from, to int) int {
+	n := 0
+	for i := from + 1; i < to; i++ {
+		if (all[2*i] >= 0) != (all[2*i-2] >= 0) {
+			n++
+		}
+	}
+	return n
+}
+
+// stereoEnergy is the mean power of both channels over [from, to)
+func stereoEnergy(all []float64, from, to int) float64 {
+	e := 0.0
+	for i := from; i < to; i++ {
+		e += all[2*i]*all[2*i] + all[2*i+1]*all[2*i+1]
+	}
+	return e / float64(max(to-from, 1))
+}
+
+// TestTrackerCorrupt loads truncated and damaged modules, which must fail
+// cleanly or play without panicking
+func TestTrackerCorrupt(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		data []byte
+		load trackerLoader
+	}{
+		{"mod", modTestFile(), loadMOD},
+		{"s3m", s3mTestFile(), loadS3M},
+		{"xm", xmTestFile(), loadXM},
+		{"it", itTestFile(), loadIT},
+	} {
+		play := func(data []byte) {
+			mod, err := test.load(data)
+			if err != nil || len(mod.orders) == 0 || mod.channels == 0 {
+				return
+			}
+			p := newTrackerPlayer(mod, 8000)
+			p.duration()
+			p.reset()
+			out := make([]float64, 4096)
+			for i := 0; i < 20 && p.render(out) > 0; i++ {
+			}
+		}
+		for n := 0; n < len(test.data); n += 7 {
+			play(test.data[:n])
+		}
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 300; i++ {
+			data := append([]byte(nil), test.data...)
+			for k := 0; k < 8; k++ {
+				data[r.Intn(len(data))] = byte(r.Intn(256))
+			}
+			play(data)
+		}
+		if _, err := test.load([]byte("garbage")); err == nil {
+			t.Fatalf("%s: garbage loaded", test.name)
+		}
+	}
+}
+
+// checkPitch fails unless the left channel crosses zero about as often as a
+// 32 sample square at 8363 Hz would in the tenth of a second from frame,
+// times octaves
+func checkPitch(t *testing.T, what string, all []float64, frame int, octaves int) {
+	t.Helper()
+	want := 2 * 8363.0 / 32 / 10 * float64(octaves)
+	if n := zeroCrossings(all, frame, frame+TRACKER_DEFAULT_RATE/10); math.Abs(float64(n)-want) > want/6 {
+		t.Fatalf("%s: %d zero crossings, expected about %.0f", what, n, want)
+	}
+}
@@ -0,0 +1,324 @@
+package audio
+
+import (
+	"math"
+)
+
+// trackerVoice is one playing note. Channels own their current voice, and
+// hand it to the player's background list when a new note replaces it.
+type trackerVoice struct {
+	sample  *trackerSample
+	ins     *trackerInstrument
+	channel int
+
+	pos     float64
+	reverse bool // travelling backwards through a ping-pong loop
+	active  bool
+
+	// from the channel, frozen once the voice is in the background
+	period  float64
+	volume  int
+	pan     int
+	chanVol int
+
+	keyOn   bool
+	fading  bool
+	fade    int
+	cutting bool
+
+	volTick   int
+	panTick   int
+	pitchTick int
+	vibPos    int
+	vibTicks  int
+
+	step float64
+
+	// gains are ramped towards their targets to avoid clicks
+	left, right         float64
+	leftStep, rightStep float64
+	ramp                int
+}
+
+func newTrackerVoice(s *trackerSample, ins *trackerInstrument, channel int) *trackerVoice {
+	return &trackerVoice{
+		sample:  s,
+		ins:     ins,
+		channel: channel,
+		active:  true,
+		keyOn:   true,
+		fade:    TRACKER_FADE_MAX,
+		chanVol: 64,
+	}
+}
+
+// restart plays the note again from the start of the sample
+func (v *trackerVoice) restart() {
+	v.pos = 0
+	v.reverse = false
+	v.active = true
+	v.cutting = false
+	v.keyOn = true
+	v.fading = false
+	v.fade = TRACKER_FADE_MAX
+	v.restartEnvelopes()
+}
+
+func (v *trackerVoice) restartEnvelopes() {
+	v.volTick, v.panTick, v.pitchTick = 0, 0, 0
+	v.vibPos, v.vibTicks = 0, 0
+	v.keyOn = true
+	v.fading = false
+	v.fade = TRACKER_FADE_MAX
+}
+
+func (v *trackerVoice) setOffset(offset int) {
+	if offset >= len(v.sample.data) {
+		v.active = false
+		return
+	}
+	v.pos = float64(offset)
+}
+
+// cut fades the voice out over the ramp and then stops it
+func (v *trackerVoice) cut() {
+	v.cutting = true
+}
+
+// keyOff releases the note, leaving sustain loops and starting any fadeout
+func (v *trackerVoice) keyOff(kind int) {
+	v.keyOn = false
+	switch kind {
+	case TRACKER_XM:
+		if v.ins == nil || !v.ins.volEnv.enabled {
+			v.cut()
+		} else {
+			v.fading = true
+		}
+	case TRACKER_IT:
+		if v.ins != nil && (!v.ins.volEnv.enabled || v.ins.volEnv.loop) {
+			v.fading = true
+		}
+	}
+}
+
+// update runs the voice's envelopes for a tick and sets its gains and pitch
+func (v *trackerVoice) update(p *trackerPlayer) {
+	s := v.sample
+	vol := float64(v.volume) / 64 * float64(v.chanVol) / 64 * float64(s.globalVolume) / 64
+	vol *= float64(p.globalVol) / 128 * p.mod.mixVolume
+	pan := float64(v.pan)
+	freq := p.frequency(s, v.period)
+
+	if ins := v.ins; ins != nil {
+		vol *= float64(ins.globalVolume) / 128
+
+		if ins.volEnv.enabled {
+			value := ins.volEnv.value(v.volTick)
+			vol *= value / 64
+			var end bool
+			v.volTick, end = ins.volEnv.next(v.volTick, v.keyOn)
+			if end && p.mod.kind == TRACKER_IT {
+				v.fading = true
+				if value == 0 {
+					v.cut()
+				}
+			}
+		}
+		if ins.panEnv.enabled {
+			value := ins.panEnv.value(v.panTick)
+			pan += value * (128 - math.Abs(pan-128)) / 32
+			v.panTick, _ = ins.panEnv.next(v.panTick, v.keyOn)
+		}
+		if ins.pitchEnv.enabled {
+			freq *= math.Exp2(ins.pitchEnv.value(v.pitchTick) / 24)
+			v.pitchTick, _ = ins.pitchEnv.next(v.pitchTick, v.keyOn)
+		}
+
+		if v.fading {
+			vol *= float64(v.fade) / TRACKER_FADE_MAX
+			v.fade -= ins.fadeout
+			if v.fade <= 0 {
+				v.fade = 0
+				v.cut()
+			}
+		}
+	}
+
+	if s.vibDepth > 0 {
+		depth := s.vibDepth
+		if s.vibSweep > 0 && v.vibTicks < s.vibSweep {
+			depth = depth * v.vibTicks / s.vibSweep
+		}
+		v.vibTicks++
+		delta := p.wave(s.vibType, v.vibPos>>2) * depth >> 8
+		freq *= math.Exp2(-float64(delta) / TRACKER_OCTAVE)
+		v.vibPos = (v.vibPos + s.vibRate) & 255
+	}
+
+	if v.cutting {
+		vol = 0
+	}
+	v.step = freq / float64(p.rate)
+
+	angle := pan / 256 * math.Pi / 2
+	v.setGains(vol*math.Cos(angle), vol*math.Sin(angle), p.rampLen)
+}
+
+func (v *trackerVoice) setGains(left float64, right float64, ramp int) {
+	v.leftStep = (left - v.left) / float64(ramp)
+	v.rightStep = (right - v.right) / float64(ramp)
+	v.ramp = ramp
+}
+
+// loop returns the loop in effect, the sustain loop while the key is held
+func (v *trackerVoice) loop() (int, int, int) {
+	s := v.sample
+	if v.keyOn && s.susLoop != TRACKER_LOOP_NONE {
+		return s.susLoop, s.susStart, s.susEnd
+	}
+	return s.loop, s.loopStart, s.loopEnd
+}
+
+// at returns sample i, following the loop past its end
+func (v *trackerVoice) at(i int, loop int, start int, end int) float64 {
+	data := v.sample.data
+	if loop == TRACKER_LOOP_NONE {
+		if i < 0 || i >= len(data) {
+			return 0
+		}
+		return float64(data[i])
+	}
+	if i >= end {
+		length := end - start
+		if loop == TRACKER_LOOP_FORWARD {
+			i = start + (i-end)%length
+		} else if off := (i - end) % (2 * length); off < length {
+			i = end - 1 - off
+		} else {
+			i = start + off - length
+		}
+	}
+	if i < 0 {
+		return 0
+	}
+	return float64(data[i])
+}
+
+// move advances the position, wrapping around the loop
+func (v *trackerVoice) move(distance float64) {
+	loop, start, end := v.loop()
+	if loop != TRACKER_LOOP_PINGPONG {
+		v.reverse = false
+	}
+	if v.reverse {
+		v.pos -= distance
+	} else {
+		v.pos += distance
+	}
+
+	length := float64(end - start)
+	switch loop {
+	case TRACKER_LOOP_NONE:
+		if v.pos >= float64(len(v.sample.data)) || v.pos < 0 {
+			v.active = false
+		}
+	case TRACKER_LOOP_FORWARD:
+		if v.pos >= float64(end) {
+			v.pos = float64(start) + math.Mod(v.pos-float64(start), length)
+		}
+	case TRACKER_LOOP_PINGPONG:
+		if v.pos < float64(end) && (!v.reverse || v.pos >= float64(start)) {
+			break
+		}
+		// unfold the bounce into one forward pass over twice the loop
+		u := v.pos - float64(start)
+		if v.reverse {
+			u = 2*length - u
+		}
+		u = math.Mod(u, 2*length)
+		if u < 0 {
+			u += 2 * length
+		}
+		if u < length {
+			v.pos, v.reverse = float64(start)+u, false
+		} else {
+			v.pos, v.reverse = float64(start)+2*length-u, true
+		}
+	}
+}
+
+// mix adds the voice to the interleaved stereo block with cubic
+// interpolation
+func (v *trackerVoice) mix(out []float64) {
+	for i := 0; i+1 < len(out) && v.active; i += 2 {
+		loop, start, end := v.loop()
+		idx := int(math.Floor(v.pos))
+		t := v.pos - float64(idx)
+
+		s0 := v.at(idx-1, loop, start, end)
+		s1 := v.at(idx, loop, start, end)
+		s2 := v.at(idx+1, loop, start, end)
+		s3 := v.at(idx+2, loop, start, end)
+		c1 := 0.5 * (s2 - s0)
+		c2 := s0 - 2.5*s1 + 2*s2 - 0.5*s3
+		c3 := 0.5*(s3-s0) + 1.5*(s1-s2)
+		value := ((c3*t+c2)*t+c1)*t + s1
+
+		if v.ramp > 0 {
+			v.left += v.leftStep
+			v.right += v.rightStep
+			v.ramp--
+			if v.ramp == 0 && v.cutting {
+				v.active = false
+			}
+		}
+		out[i] += value * v.left
+		out[i+1] += value * v.right
+
+		v.move(v.step)
+	}
+}
+
+// skip advances the voice as mixing frames would, without the output
+func (v *trackerVoice) skip(frames int) {
+	v.left += v.leftStep * float64(min(frames, v.ramp))
+	v.right += v.rightStep * float64(min(frames, v.ramp))
+	v.ramp = max(v.ramp-frames, 0)
+	if v.ramp == 0 && v.cutting {
+		v.active = false
+		return
+	}
+	v.move(v.step * float64(frames))
+}
+
+func (env *trackerEnvelope) value(tick int) float64 {
+	pts := env.points
+	if tick <= pts[0].tick {
+		return float64(pts[0].value)
+	}
+	for i := 1; i < len(pts); i++ {
+		if tick <= pts[i].tick {
+			a, b := pts[i-1], pts[i]
+			return float64(a.value) + float64((b.value-a.value)*(tick-a.tick))/float64(b.tick-a.tick)
+		}
+	}
+	return float64(pts[len(pts)-1].value)
+}
+
+// next returns the tick after tick, following the loops, and whether the
+// envelope has reached its end
+func (env *trackerEnvelope) next(tick int, keyOn bool) (int, bool) {
+	pts := env.points
+	tick++
+	if env.sustain && keyOn && tick > pts[env.susEnd].tick {
+		return pts[env.susStart].tick, false
+	}
+	if env.loop && tick > pts[env.loopEnd].tick {
+		return pts[env.loopStart].tick, false
+	}
+	if last := pts[len(pts)-1].tick; tick >= last {
+		return last, true
+	}
+	return tick, false
+}
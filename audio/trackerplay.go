@@ -0,0 +1,1142 @@
+package audio
+
+import (
+	"math"
+)
+
+const (
+	// amiga periods are kept at four times their original resolution, as
+	// ScreamTracker and FastTracker do, so all slides share one unit
+	TRACKER_AMIGA_PERIOD     = 1712 // period of the base note
+	TRACKER_MIN_AMIGA_PERIOD = 113 * 4
+	TRACKER_MAX_AMIGA_PERIOD = 856 * 4
+
+	// linear periods count 64ths of a semitone down from the base note
+	TRACKER_SEMITONE     = 64
+	TRACKER_OCTAVE       = 12 * TRACKER_SEMITONE
+	TRACKER_LINEAR_RANGE = 6 * TRACKER_OCTAVE
+
+	TRACKER_FADE_MAX       = 65536
+	TRACKER_MAX_BACKGROUND = 64
+	TRACKER_MIX_GAIN       = 0.5
+	TRACKER_RAMP_MS        = 1.5
+)
+
+// effect parameter memory slots
+const (
+	TRACKER_MEM_NONE = iota // no memory, a zero parameter does nothing
+	TRACKER_MEM_SHARED
+	TRACKER_MEM_PORTA_UP
+	TRACKER_MEM_PORTA_DOWN
+	TRACKER_MEM_FINE_PORTA_UP
+	TRACKER_MEM_FINE_PORTA_DOWN
+	TRACKER_MEM_EXTRA_FINE_UP
+	TRACKER_MEM_EXTRA_FINE_DOWN
+	TRACKER_MEM_TONE_PORTA
+	TRACKER_MEM_VOL_SLIDE
+	TRACKER_MEM_FINE_VOL_UP
+	TRACKER_MEM_FINE_VOL_DOWN
+	TRACKER_MEM_OFFSET
+	TRACKER_MEM_RETRIG
+	TRACKER_MEM_TREMOR
+	TRACKER_MEM_ARPEGGIO
+	TRACKER_MEM_CHANNEL_VOL_SLIDE
+	TRACKER_MEM_GLOBAL_VOL_SLIDE
+	TRACKER_MEM_PAN_SLIDE
+	TRACKER_MEM_TEMPO
+	TRACKER_MEM_VOL_COLUMN
+	TRACKER_MEM_SLOTS
+)
+
+// volume changes of a multi retrigger, by the parameter's high nibble
+var trackerRetrigVolume = [16]func(int) int{
+	func(v int) int { return v },
+	func(v int) int { return v - 1 },
+	func(v int) int { return v - 2 },
+	func(v int) int { return v - 4 },
+	func(v int) int { return v - 8 },
+	func(v int) int { return v - 16 },
+	func(v int) int { return v * 2 / 3 },
+	func(v int) int { return v / 2 },
+	func(v int) int { return v },
+	func(v int) int { return v + 1 },
+	func(v int) int { return v + 2 },
+	func(v int) int { return v + 4 },
+	func(v int) int { return v + 8 },
+	func(v int) int { return v + 16 },
+	func(v int) int { return v * 3 / 2 },
+	func(v int) int { return v * 2 },
+}
+
+type trackerChannel struct {
+	index int
+	voice *trackerVoice
+
+	ins    *trackerInstrument
+	sample *trackerSample
+	key    int
+
+	period      float64
+	portaTarget float64
+	portaSpeed  int
+
+	volume  int // 0-64
+	pan     int // 0-256
+	chanVol int // 0-64
+
+	// the current row, with the effect parameter after memory
+	cell  trackerCell
+	param int
+	delay int // tick a delayed note is due on, 0 if none
+
+	memory [TRACKER_MEM_SLOTS]int
+
+	vibSpeed, vibDepth, vibPos, vibWave int
+	vibFine                             bool
+	tremSpeed, tremDepth, tremPos       int
+	tremWave                            int
+	panSpeed, panDepth, panPos, panWave int
+
+	tremorCount int
+	retrigCount int
+	loopRow     int
+	loopCount   int
+	highOffset  int
+	nna         int // overrides the instrument's for the current note, or -1
+
+	// modulation for this tick only
+	periodDelta float64
+	arpeggio    int
+	volDelta    int
+	panDelta    int
+	muted       bool
+}
+
+// trackerPlayer steps through a module tick by tick and mixes its voices
+type trackerPlayer struct {
+	mod  *trackerModule
+	rate int
+
+	channels   []trackerChannel
+	background []*trackerVoice
+
+	order int
+	row   int
+	tick  int
+
+	speed     int
+	tempo     int
+	globalVol int
+
+	// flow control requested by the current row
+	jumpOrder int
+	breakRow  int
+	loopTo    int
+	rowDelay  int
+	fineDelay int
+
+	visited map[int]bool
+	ended   bool
+
+	frame   int64 // frames rendered
+	left    int   // frames left in the current tick
+	tickRem int
+	rampLen int
+	random  uint32
+}
+
+func newTrackerPlayer(mod *trackerModule, rate int) *trackerPlayer {
+	p := &trackerPlayer{mod: mod, rate: rate}
+	p.rampLen = max(1, int(float64(rate)*TRACKER_RAMP_MS/1000))
+	p.reset()
+	return p
+}
+
+// reset returns to the start of the song
+func (p *trackerPlayer) reset() {
+	mod := p.mod
+	p.channels = make([]trackerChannel, mod.channels)
+	for i := range p.channels {
+		ch := &p.channels[i]
+		ch.index = i
+		ch.pan = 128
+		ch.chanVol = 64
+		ch.nna = -1
+		if i < len(mod.channelPan) {
+			ch.pan = mod.channelPan[i]
+		}
+		if i < len(mod.channelVolume) {
+			ch.chanVol = mod.channelVolume[i]
+		}
+	}
+	p.background = p.background[:0]
+
+	p.speed = max(mod.speed, 1)
+	p.tempo = max(mod.tempo, 32)
+	p.globalVol = mod.globalVolume
+	p.tick = 0
+	p.frame = 0
+	p.left = 0
+	p.tickRem = 0
+	p.random = 1
+	p.ended = false
+	p.visited = make(map[int]bool)
+	p.moveTo(0, 0, true)
+}
+
+// duration plays through the song without mixing, in 100ns units
+func (p *trackerPlayer) duration() int64 {
+	p.reset()
+	limit := int64(TRACKER_MAX_DURATION) * int64(p.rate) / SECOND
+	for p.frame < limit && p.step() {
+		p.frame += int64(p.left)
+		p.left = 0
+	}
+	return p.frame * SECOND / int64(p.rate)
+}
+
+// seek replays the song silently up to the tick that contains frame, so
+// every channel is in the state it would have been in
+func (p *trackerPlayer) seek(frame int64) {
+	p.reset()
+	for {
+		if p.left == 0 && !p.step() {
+			return
+		}
+		if p.frame+int64(p.left) > frame {
+			return
+		}
+		p.skipVoices(p.left)
+		p.frame += int64(p.left)
+		p.left = 0
+	}
+}
+
+// render mixes into out, returning the number of frames written
+func (p *trackerPlayer) render(out []float64) int {
+	limit := int64(TRACKER_MAX_DURATION) * int64(p.rate) / SECOND
+	frames := len(out) / 2
+	n := 0
+	for n < frames {
+		if p.left == 0 && (p.frame >= limit || !p.step()) {
+			break
+		}
+		k := min(p.left, frames-n)
+		block := out[n*2 : (n+k)*2]
+		clear(block)
+		p.forEachVoice(func(v *trackerVoice) {
+			v.mix(block)
+		})
+		p.left -= k
+		p.frame += int64(k)
+		n += k
+	}
+	return n
+}
+
+// step processes the next tick, returning false once the song is over
+func (p *trackerPlayer) step() bool {
+	if p.ended {
+		return false
+	}
+	p.processTick()
+
+	num := p.rate*5 + p.tickRem
+	p.left = num / (2 * p.tempo)
+	p.tickRem = num % (2 * p.tempo)
+
+	p.tick++
+	if p.tick >= p.speed*(1+p.rowDelay)+p.fineDelay {
+		p.tick = 0
+		p.nextRow()
+	}
+	return true
+}
+
+func (p *trackerPlayer) skipVoices(frames int) {
+	p.forEachVoice(func(v *trackerVoice) {
+		v.skip(frames)
+	})
+}
+
+func (p *trackerPlayer) forEachVoice(f func(v *trackerVoice)) {
+	for i := range p.channels {
+		if v := p.channels[i].voice; v != nil && v.active {
+			f(v)
+		}
+	}
+	for _, v := range p.background {
+		if v.active {
+			f(v)
+		}
+	}
+}
+
+func (p *trackerPlayer) processTick() {
+	for i := range p.channels {
+		ch := &p.channels[i]
+		ch.periodDelta, ch.arpeggio, ch.volDelta, ch.panDelta = 0, 0, 0, 0
+		ch.muted = false
+	}
+
+	if p.tick == 0 {
+		p.startRow()
+	} else {
+		for i := range p.channels {
+			p.tickEffects(&p.channels[i])
+		}
+	}
+
+	for i := range p.channels {
+		p.updateVoice(&p.channels[i])
+	}
+	p.forEachVoice(func(v *trackerVoice) {
+		v.update(p)
+	})
+
+	// drop finished background voices
+	kept := p.background[:0]
+	for _, v := range p.background {
+		if v.active {
+			kept = append(kept, v)
+		}
+	}
+	clear(p.background[len(kept):])
+	p.background = kept
+}
+
+func (p *trackerPlayer) rows(order int) int {
+	if pat := p.mod.pattern(order); pat != nil {
+		return pat.rows
+	}
+	return TRACKER_DEFAULT_ROWS
+}
+
+// moveTo goes to row of order, skipping markers and ending the song at the
+// end of the order list or on reaching a row already played. A row past the
+// end of a pattern continues with the next order when reached naturally.
+func (p *trackerPlayer) moveTo(order int, row int, natural bool) {
+	orders := p.mod.orders
+	for guard := 0; ; guard++ {
+		if order >= len(orders) || orders[order] == TRACKER_ORDER_END || guard > len(orders) {
+			p.ended = true
+			return
+		}
+		if orders[order] == TRACKER_ORDER_SKIP {
+			order++
+			continue
+		}
+		if row >= p.rows(order) {
+			if natural {
+				order, row = order+1, 0
+				continue
+			}
+			row = 0
+		}
+		break
+	}
+
+	if p.visited[order<<8|row] {
+		p.ended = true
+		return
+	}
+	p.order, p.row = order, row
+}
+
+func (p *trackerPlayer) nextRow() {
+	switch {
+	case p.loopTo >= 0:
+		// rows inside a pattern loop are meant to be played again
+		for r := p.loopTo; r <= p.row; r++ {
+			delete(p.visited, p.order<<8|r)
+		}
+		p.moveTo(p.order, p.loopTo, false)
+	case p.jumpOrder >= 0 || p.breakRow >= 0:
+		order := p.order + 1
+		if p.jumpOrder >= 0 {
+			order = p.jumpOrder
+		}
+		p.moveTo(order, max(p.breakRow, 0), false)
+	default:
+		p.moveTo(p.order, p.row+1, true)
+	}
+}
+
+func (p *trackerPlayer) startRow() {
+	p.jumpOrder, p.breakRow, p.loopTo = -1, -1, -1
+	p.rowDelay, p.fineDelay = 0, 0
+	p.visited[p.order<<8|p.row] = true
+
+	pat := p.mod.pattern(p.order)
+	for i := range p.channels {
+		ch := &p.channels[i]
+		cell := trackerCell{}
+		if pat != nil && p.row < pat.rows {
+			cell = pat.cells[p.row*p.mod.channels+i]
+		}
+
+		ch.cell = cell
+		ch.param = p.recall(ch, int(cell.effect), int(cell.param))
+		ch.delay = 0
+		if cell.effect == TRACKER_FX_NOTE_DELAY && ch.param > 0 {
+			ch.delay = ch.param
+		} else {
+			p.applyCell(ch)
+		}
+		p.rowEffect(ch)
+	}
+}
+
+// memorySlot returns where a format remembers an effect's last parameter
+func (p *trackerPlayer) memorySlot(effect int) int {
+	switch p.mod.kind {
+	case TRACKER_MOD:
+		switch effect {
+		case TRACKER_FX_TONE_PORTA:
+			return TRACKER_MEM_TONE_PORTA
+		case TRACKER_FX_OFFSET:
+			return TRACKER_MEM_OFFSET
+		}
+	case TRACKER_S3M:
+		switch effect {
+		case TRACKER_FX_VOL_SLIDE, TRACKER_FX_PORTA_UP, TRACKER_FX_PORTA_DOWN, TRACKER_FX_TREMOR,
+			TRACKER_FX_ARPEGGIO, TRACKER_FX_VIBRATO_VOL, TRACKER_FX_TONE_PORTA_VOL, TRACKER_FX_RETRIG:
+			return TRACKER_MEM_SHARED
+		case TRACKER_FX_TONE_PORTA:
+			return TRACKER_MEM_TONE_PORTA
+		case TRACKER_FX_OFFSET:
+			return TRACKER_MEM_OFFSET
+		}
+	case TRACKER_XM:
+		switch effect {
+		case TRACKER_FX_PORTA_UP:
+			return TRACKER_MEM_PORTA_UP
+		case TRACKER_FX_PORTA_DOWN:
+			return TRACKER_MEM_PORTA_DOWN
+		case TRACKER_FX_FINE_PORTA_UP:
+			return TRACKER_MEM_FINE_PORTA_UP
+		case TRACKER_FX_FINE_PORTA_DOWN:
+			return TRACKER_MEM_FINE_PORTA_DOWN
+		case TRACKER_FX_EXTRA_FINE_PORTA_UP:
+			return TRACKER_MEM_EXTRA_FINE_UP
+		case TRACKER_FX_EXTRA_FINE_PORTA_DOWN:
+			return TRACKER_MEM_EXTRA_FINE_DOWN
+		case TRACKER_FX_TONE_PORTA:
+			return TRACKER_MEM_TONE_PORTA
+		case TRACKER_FX_VOL_SLIDE, TRACKER_FX_VIBRATO_VOL, TRACKER_FX_TONE_PORTA_VOL:
+			return TRACKER_MEM_VOL_SLIDE
+		case TRACKER_FX_FINE_VOL_UP:
+			return TRACKER_MEM_FINE_VOL_UP
+		case TRACKER_FX_FINE_VOL_DOWN:
+			return TRACKER_MEM_FINE_VOL_DOWN
+		case TRACKER_FX_OFFSET:
+			return TRACKER_MEM_OFFSET
+		case TRACKER_FX_RETRIG:
+			return TRACKER_MEM_RETRIG
+		case TRACKER_FX_TREMOR:
+			return TRACKER_MEM_TREMOR
+		case TRACKER_FX_GLOBAL_VOL_SLIDE:
+			return TRACKER_MEM_GLOBAL_VOL_SLIDE
+		case TRACKER_FX_PAN_SLIDE:
+			return TRACKER_MEM_PAN_SLIDE
+		}
+	case TRACKER_IT:
+		switch effect {
+		case TRACKER_FX_VOL_SLIDE, TRACKER_FX_VIBRATO_VOL, TRACKER_FX_TONE_PORTA_VOL:
+			return TRACKER_MEM_VOL_SLIDE
+		case TRACKER_FX_PORTA_UP, TRACKER_FX_PORTA_DOWN:
+			return TRACKER_MEM_PORTA_UP
+		case TRACKER_FX_TONE_PORTA:
+			if p.mod.linkedPorta {
+				return TRACKER_MEM_PORTA_UP
+			}
+			return TRACKER_MEM_TONE_PORTA
+		case TRACKER_FX_OFFSET:
+			return TRACKER_MEM_OFFSET
+		case TRACKER_FX_RETRIG:
+			return TRACKER_MEM_RETRIG
+		case TRACKER_FX_TREMOR:
+			return TRACKER_MEM_TREMOR
+		case TRACKER_FX_ARPEGGIO:
+			return TRACKER_MEM_ARPEGGIO
+		case TRACKER_FX_CHANNEL_VOL_SLIDE:
+			return TRACKER_MEM_CHANNEL_VOL_SLIDE
+		case TRACKER_FX_GLOBAL_VOL_SLIDE:
+			return TRACKER_MEM_GLOBAL_VOL_SLIDE
+		case TRACKER_FX_PAN_SLIDE:
+			return TRACKER_MEM_PAN_SLIDE
+		case TRACKER_FX_TEMPO:
+			return TRACKER_MEM_TEMPO
+		}
+	}
+	return TRACKER_MEM_NONE
+}
+
+// recall swaps a zero parameter for the last one given to the effect
+func (p *trackerPlayer) recall(ch *trackerChannel, effect int, param int) int {
+	slot := p.memorySlot(effect)
+	if slot == TRACKER_MEM_NONE {
+		return param
+	}
+	if effect == TRACKER_FX_TEMPO && param >= 0x20 {
+		return param
+	}
+	if param == 0 {
+		return ch.memory[slot]
+	}
+	ch.memory[slot] = param
+	return param
+}
+
+// applyCell handles the note, instrument and volume column of the row
+func (p *trackerPlayer) applyCell(ch *trackerChannel) {
+	cell := ch.cell
+	porta := cell.effect == TRACKER_FX_TONE_PORTA || cell.effect == TRACKER_FX_TONE_PORTA_VOL ||
+		cell.volCmd == TRACKER_VOL_TONE_PORTA
+	triggered := false
+
+	if cell.instrument > 0 {
+		p.setInstrument(ch, int(cell.instrument), cell.note, porta)
+	}
+
+	switch {
+	case cell.note == TRACKER_NOTE_OFF:
+		if ch.voice != nil {
+			ch.voice.keyOff(p.mod.kind)
+		}
+	case cell.note == TRACKER_NOTE_CUT:
+		p.releaseVoice(ch, TRACKER_NNA_CUT)
+	case cell.note == TRACKER_NOTE_FADE:
+		if ch.voice != nil {
+			ch.voice.fading = true
+		}
+	case cell.note > 0 && cell.note <= TRACKER_NOTES:
+		key := int(cell.note) - 1
+		if porta && ch.voice != nil && ch.voice.active {
+			ch.portaTarget = p.notePeriod(p.mappedKey(ch, key))
+		} else {
+			triggered = p.triggerNote(ch, key, cell.instrument > 0)
+		}
+	}
+
+	param := int(cell.volParam)
+	switch cell.volCmd {
+	case TRACKER_VOL_SET:
+		ch.volume = min(param, 64)
+	case TRACKER_VOL_FINE_UP, TRACKER_VOL_FINE_DOWN:
+		param = p.recallVolColumn(ch, param)
+		if cell.volCmd == TRACKER_VOL_FINE_DOWN {
+			param = -param
+		}
+		ch.volume = min(max(ch.volume+param, 0), 64)
+	case TRACKER_VOL_PAN:
+		ch.pan = param * 256 / 255
+	case TRACKER_VOL_VIB_SPEED:
+		if param > 0 {
+			ch.vibSpeed = param
+		}
+	case TRACKER_VOL_VIBRATO:
+		if param > 0 {
+			ch.vibDepth = param
+		}
+	case TRACKER_VOL_TONE_PORTA:
+		if param > 0 {
+			ch.portaSpeed = param
+		}
+	}
+
+	if triggered && cell.effect == TRACKER_FX_OFFSET && ch.voice != nil {
+		ch.voice.setOffset(ch.param*256 + ch.highOffset*65536)
+	}
+}
+
+// recallVolColumn gives the volume column slides their own memory
+func (p *trackerPlayer) recallVolColumn(ch *trackerChannel, param int) int {
+	if param == 0 && p.mod.kind == TRACKER_IT {
+		return ch.memory[TRACKER_MEM_VOL_COLUMN]
+	}
+	ch.memory[TRACKER_MEM_VOL_COLUMN] = param
+	return param
+}
+
+func (p *trackerPlayer) setInstrument(ch *trackerChannel, num int, note uint8, porta bool) {
+	mod := p.mod
+	if mod.instruments == nil {
+		if num > len(mod.samples) {
+			return
+		}
+		ch.ins = nil
+		ch.sample = &mod.samples[num-1]
+	} else {
+		if num > len(mod.instruments) {
+			return
+		}
+		ch.ins = &mod.instruments[num-1]
+		key := ch.key
+		if note > 0 && note <= TRACKER_NOTES {
+			key = int(note) - 1
+		}
+		if s := ch.ins.keymap[key].sample; s >= 0 && s < len(mod.samples) {
+			ch.sample = &mod.samples[s]
+		}
+		if ch.ins.pan >= 0 {
+			ch.pan = ch.ins.pan
+		}
+	}
+
+	if ch.sample != nil {
+		ch.volume = ch.sample.volume
+		if ch.sample.pan >= 0 {
+			ch.pan = ch.sample.pan
+		}
+	}
+
+	// FastTracker restarts the envelopes of a note that keeps playing
+	if mod.kind == TRACKER_XM && ch.voice != nil && (note == 0 || porta) {
+		ch.voice.restartEnvelopes()
+	}
+}
+
+// mappedKey is the key an instrument's keyboard plays for key
+func (p *trackerPlayer) mappedKey(ch *trackerChannel, key int) int {
+	if ch.ins != nil {
+		return int(ch.ins.keymap[key].note)
+	}
+	return key
+}
+
+// triggerNote starts key on the channel, returning false if there was
+// nothing to play
+func (p *trackerPlayer) triggerNote(ch *trackerChannel, key int, withIns bool) bool {
+	mod := p.mod
+	s := ch.sample
+	if ch.ins != nil {
+		km := ch.ins.keymap[key]
+		if km.sample < 0 || km.sample >= len(mod.samples) {
+			p.releaseVoice(ch, TRACKER_NNA_CUT)
+			return false
+		}
+		s = &mod.samples[km.sample]
+		key = int(km.note)
+		if withIns && s != ch.sample {
+			ch.volume = s.volume
+			if s.pan >= 0 {
+				ch.pan = s.pan
+			}
+		}
+		ch.sample = s
+	}
+	if s == nil || len(s.data) == 0 {
+		p.releaseVoice(ch, TRACKER_NNA_CUT)
+		return false
+	}
+
+	p.releaseVoice(ch, -1)
+	ch.voice = newTrackerVoice(s, ch.ins, ch.index)
+	ch.key = key
+	ch.period = p.notePeriod(key)
+	ch.portaTarget = ch.period
+	ch.nna = -1
+	ch.retrigCount = 0
+	ch.tremorCount = 0
+	if ch.vibWave&4 == 0 {
+		ch.vibPos = 0
+	}
+	if ch.tremWave&4 == 0 {
+		ch.tremPos = 0
+	}
+	return true
+}
+
+// releaseVoice hands the channel's voice to the background, applying the new
+// note action, or the instrument's when nna is negative
+func (p *trackerPlayer) releaseVoice(ch *trackerChannel, nna int) {
+	v := ch.voice
+	ch.voice = nil
+	if v == nil || !v.active {
+		return
+	}
+
+	if nna < 0 {
+		nna = TRACKER_NNA_CUT
+		if ch.nna >= 0 {
+			nna = ch.nna
+		} else if v.ins != nil {
+			nna = v.ins.nna
+		}
+	}
+	switch nna {
+	case TRACKER_NNA_CUT:
+		v.cut()
+	case TRACKER_NNA_OFF:
+		v.keyOff(p.mod.kind)
+	case TRACKER_NNA_FADE:
+		v.fading = true
+	}
+
+	if len(p.background) >= TRACKER_MAX_BACKGROUND {
+		p.background[0].active = false
+		p.background = p.background[1:]
+	}
+	p.background = append(p.background, v)
+}
+
+// noteCut silences the channel, which IT does by stopping the note
+func (p *trackerPlayer) noteCut(ch *trackerChannel) {
+	if p.mod.kind == TRACKER_IT {
+		p.releaseVoice(ch, TRACKER_NNA_CUT)
+	} else {
+		ch.volume = 0
+	}
+}
+
+func (p *trackerPlayer) notePeriod(key int) float64 {
+	if p.mod.linear {
+		return float64((TRACKER_BASE_NOTE - key) * TRACKER_SEMITONE)
+	}
+	return TRACKER_AMIGA_PERIOD * math.Exp2(float64(TRACKER_BASE_NOTE-key)/12)
+}
+
+// shiftPeriod raises period by a number of semitones
+func (p *trackerPlayer) shiftPeriod(period float64, semitones int) float64 {
+	if p.mod.linear {
+		return period - float64(semitones*TRACKER_SEMITONE)
+	}
+	return period * math.Exp2(-float64(semitones)/12)
+}
+
+func (p *trackerPlayer) clampPeriod(period float64) float64 {
+	switch {
+	case p.mod.linear:
+		return min(max(period, -TRACKER_LINEAR_RANGE), TRACKER_LINEAR_RANGE)
+	case p.mod.amigaLimits:
+		return min(max(period, TRACKER_MIN_AMIGA_PERIOD), TRACKER_MAX_AMIGA_PERIOD)
+	}
+	return min(max(period, 1), TRACKER_AMIGA_PERIOD*64)
+}
+
+func (p *trackerPlayer) frequency(s *trackerSample, period float64) float64 {
+	if p.mod.linear {
+		return s.baseFreq * math.Exp2(-period/TRACKER_OCTAVE)
+	}
+	return s.baseFreq * TRACKER_AMIGA_PERIOD / period
+}
+
+// slide moves the channel's period, negative amounts raising the pitch
+func (p *trackerPlayer) slide(ch *trackerChannel, amount int) {
+	ch.period = p.clampPeriod(ch.period + float64(amount))
+}
+
+// rowEffect runs the part of an effect that happens on the row's first tick
+func (p *trackerPlayer) rowEffect(ch *trackerChannel) {
+	param := ch.param
+	x, y := param>>4, param&15
+	s3m := p.mod.kind == TRACKER_S3M || p.mod.kind == TRACKER_IT
+
+	switch ch.cell.effect {
+	case TRACKER_FX_SPEED:
+		if param > 0 {
+			p.speed = param
+		}
+	case TRACKER_FX_TEMPO:
+		if param >= 0x20 {
+			p.tempo = param
+		}
+	case TRACKER_FX_JUMP:
+		p.jumpOrder = param
+	case TRACKER_FX_BREAK:
+		p.breakRow = param
+	case TRACKER_FX_PATTERN_LOOP:
+		switch {
+		case param == 0:
+			ch.loopRow = p.row
+		case ch.loopCount == 0:
+			ch.loopCount = param
+			p.loopTo = ch.loopRow
+		default:
+			ch.loopCount--
+			if ch.loopCount > 0 {
+				p.loopTo = ch.loopRow
+			}
+		}
+	case TRACKER_FX_PATTERN_DELAY:
+		if p.rowDelay == 0 {
+			p.rowDelay = param
+		}
+	case TRACKER_FX_FINE_PATTERN_DELAY:
+		p.fineDelay += param
+	case TRACKER_FX_GLOBAL_VOL:
+		p.globalVol = min(param, 128)
+	case TRACKER_FX_VOLUME:
+		ch.volume = min(param, 64)
+	case TRACKER_FX_CHANNEL_VOL:
+		ch.chanVol = min(param, 64)
+	case TRACKER_FX_PAN:
+		ch.pan = param * 256 / 255
+	case TRACKER_FX_HIGH_OFFSET:
+		ch.highOffset = param
+	case TRACKER_FX_FINE_PORTA_UP:
+		p.slide(ch, -4*param)
+	case TRACKER_FX_FINE_PORTA_DOWN:
+		p.slide(ch, 4*param)
+	case TRACKER_FX_EXTRA_FINE_PORTA_UP:
+		p.slide(ch, -param)
+	case TRACKER_FX_EXTRA_FINE_PORTA_DOWN:
+		p.slide(ch, param)
+	case TRACKER_FX_PORTA_UP, TRACKER_FX_PORTA_DOWN:
+		if !s3m || param < 0xE0 {
+			break
+		}
+		amount := y
+		if param >= 0xF0 {
+			amount *= 4
+		}
+		if ch.cell.effect == TRACKER_FX_PORTA_UP {
+			amount = -amount
+		}
+		p.slide(ch, amount)
+	case TRACKER_FX_VOL_SLIDE, TRACKER_FX_TONE_PORTA_VOL, TRACKER_FX_VIBRATO_VOL:
+		if s3m {
+			delta := trackerSlide(param, true)
+			if p.mod.fastSlides {
+				delta += trackerSlide(param, false)
+			}
+			ch.volume = min(max(ch.volume+delta, 0), 64)
+		}
+	case TRACKER_FX_FINE_VOL_UP:
+		ch.volume = min(ch.volume+param, 64)
+	case TRACKER_FX_FINE_VOL_DOWN:
+		ch.volume = max(ch.volume-param, 0)
+	case TRACKER_FX_CHANNEL_VOL_SLIDE:
+		ch.chanVol = min(max(ch.chanVol+trackerSlide(param, true), 0), 64)
+	case TRACKER_FX_GLOBAL_VOL_SLIDE:
+		if s3m {
+			p.globalVol = min(max(p.globalVol+trackerSlide(param, true), 0), 128)
+		}
+	case TRACKER_FX_PAN_SLIDE:
+		if s3m {
+			ch.pan = min(max(ch.pan-4*trackerSlide(param, true), 0), 256)
+		}
+	case TRACKER_FX_TONE_PORTA:
+		if param > 0 {
+			ch.portaSpeed = param
+		}
+	case TRACKER_FX_VIBRATO, TRACKER_FX_FINE_VIBRATO:
+		if x > 0 {
+			ch.vibSpeed = x
+		}
+		if y > 0 {
+			ch.vibDepth = y
+		}
+		ch.vibFine = ch.cell.effect == TRACKER_FX_FINE_VIBRATO
+	case TRACKER_FX_TREMOLO:
+		if x > 0 {
+			ch.tremSpeed = x
+		}
+		if y > 0 {
+			ch.tremDepth = y
+		}
+	case TRACKER_FX_PANBRELLO:
+		if x > 0 {
+			ch.panSpeed = x
+		}
+		if y > 0 {
+			ch.panDepth = y
+		}
+	case TRACKER_FX_VIB_WAVE:
+		ch.vibWave = param & 7
+	case TRACKER_FX_TREM_WAVE:
+		ch.tremWave = param & 7
+	case TRACKER_FX_PAN_WAVE:
+		ch.panWave = param & 7
+	case TRACKER_FX_NOTE_CUT:
+		if param == 0 {
+			p.noteCut(ch)
+		}
+	case TRACKER_FX_KEY_OFF:
+		if param == 0 && ch.voice != nil {
+			ch.voice.keyOff(p.mod.kind)
+		}
+	case TRACKER_FX_ENVELOPE_POS:
+		if ch.voice != nil {
+			ch.voice.volTick, ch.voice.panTick = param, param
+		}
+	case TRACKER_FX_NNA:
+		p.newNoteAction(ch, param)
+	}
+
+	p.volumeColumn(ch, true)
+}
+
+// newNoteAction handles IT's S7x, which acts on the notes a channel has left
+// in the background or sets the action for the current one
+func (p *trackerPlayer) newNoteAction(ch *trackerChannel, param int) {
+	if param >= 3 && param <= 6 {
+		ch.nna = param - 3
+		return
+	}
+	for _, v := range p.background {
+		if v.channel != ch.index {
+			continue
+		}
+		switch param {
+		case 0:
+			v.cut()
+		case 1:
+			v.keyOff(p.mod.kind)
+		case 2:
+			v.fading = true
+		}
+	}
+}
+
+// tickEffects runs the effects of every tick but the row's first
+func (p *trackerPlayer) tickEffects(ch *trackerChannel) {
+	if ch.delay > 0 && p.tick == ch.delay {
+		ch.delay = 0
+		p.applyCell(ch)
+	}
+
+	param := ch.param
+	x, y := param>>4, param&15
+	s3m := p.mod.kind == TRACKER_S3M || p.mod.kind == TRACKER_IT
+
+	switch ch.cell.effect {
+	case TRACKER_FX_PORTA_UP:
+		if !s3m || param < 0xE0 {
+			p.slide(ch, -4*param)
+		}
+	case TRACKER_FX_PORTA_DOWN:
+		if !s3m || param < 0xE0 {
+			p.slide(ch, 4*param)
+		}
+	case TRACKER_FX_TONE_PORTA:
+		p.tonePorta(ch)
+	case TRACKER_FX_TONE_PORTA_VOL:
+		p.tonePorta(ch)
+		p.volumeSlide(ch)
+	case TRACKER_FX_VIBRATO, TRACKER_FX_FINE_VIBRATO:
+		p.vibrato(ch)
+	case TRACKER_FX_VIBRATO_VOL:
+		p.vibrato(ch)
+		p.volumeSlide(ch)
+	case TRACKER_FX_TREMOLO:
+		ch.volDelta = p.wave(ch.tremWave, ch.tremPos) * ch.tremDepth >> 6
+		ch.tremPos = (ch.tremPos + ch.tremSpeed) & 63
+	case TRACKER_FX_TREMOR:
+		on, off := x+1, y+1
+		if p.mod.kind == TRACKER_IT {
+			on, off = max(x, 1), max(y, 1)
+		}
+		ch.muted = ch.tremorCount%(on+off) >= on
+		ch.tremorCount++
+	case TRACKER_FX_PANBRELLO:
+		ch.panDelta = p.wave(ch.panWave, ch.panPos) * ch.panDepth >> 5
+		ch.panPos = (ch.panPos + ch.panSpeed) & 63
+	case TRACKER_FX_VOL_SLIDE:
+		p.volumeSlide(ch)
+	case TRACKER_FX_CHANNEL_VOL_SLIDE:
+		ch.chanVol = min(max(ch.chanVol+trackerSlide(param, false), 0), 64)
+	case TRACKER_FX_GLOBAL_VOL_SLIDE:
+		delta := trackerSlide(param, false)
+		if !s3m {
+			delta = 2 * xmSlide(param)
+		}
+		p.globalVol = min(max(p.globalVol+delta, 0), 128)
+	case TRACKER_FX_PAN_SLIDE:
+		delta := -4 * trackerSlide(param, false)
+		if !s3m {
+			delta = xmSlide(param)
+		}
+		ch.pan = min(max(ch.pan+delta, 0), 256)
+	case TRACKER_FX_RETRIG:
+		p.retrig(ch)
+	case TRACKER_FX_NOTE_CUT:
+		if p.tick == param {
+			p.noteCut(ch)
+		}
+	case TRACKER_FX_KEY_OFF:
+		if p.tick == param && ch.voice != nil {
+			ch.voice.keyOff(p.mod.kind)
+		}
+	case TRACKER_FX_TEMPO:
+		// IT slides the tempo with T0x and T1x
+		if param < 0x20 {
+			if x == 0 {
+				p.tempo = max(p.tempo-y, 32)
+			} else {
+				p.tempo = min(p.tempo+y, 255)
+			}
+		}
+	}
+
+	p.volumeColumn(ch, false)
+}
+
+// volumeColumn runs the volume column commands that slide or modulate
+func (p *trackerPlayer) volumeColumn(ch *trackerChannel, first bool) {
+	cell := ch.cell
+	param := int(cell.volParam)
+	switch cell.volCmd {
+	case TRACKER_VOL_SLIDE_UP, TRACKER_VOL_SLIDE_DOWN:
+		if first {
+			if p.mod.kind == TRACKER_IT {
+				p.recallVolColumn(ch, param)
+			}
+			break
+		}
+		if p.mod.kind == TRACKER_IT && param == 0 {
+			param = ch.memory[TRACKER_MEM_VOL_COLUMN]
+		}
+		if cell.volCmd == TRACKER_VOL_SLIDE_DOWN {
+			param = -param
+		}
+		ch.volume = min(max(ch.volume+param, 0), 64)
+	case TRACKER_VOL_PAN_SLIDE_LEFT:
+		if !first {
+			ch.pan = max(ch.pan-param, 0)
+		}
+	case TRACKER_VOL_PAN_SLIDE_RIGHT:
+		if !first {
+			ch.pan = min(ch.pan+param, 256)
+		}
+	case TRACKER_VOL_PORTA_UP, TRACKER_VOL_PORTA_DOWN:
+		if param > 0 {
+			ch.memory[TRACKER_MEM_PORTA_UP] = param
+		}
+		if first {
+			break
+		}
+		param = ch.memory[TRACKER_MEM_PORTA_UP]
+		if cell.volCmd == TRACKER_VOL_PORTA_UP {
+			param = -param
+		}
+		p.slide(ch, 4*param)
+	case TRACKER_VOL_TONE_PORTA:
+		if !first && cell.effect != TRACKER_FX_TONE_PORTA && cell.effect != TRACKER_FX_TONE_PORTA_VOL {
+			p.tonePorta(ch)
+		}
+	case TRACKER_VOL_VIBRATO:
+		if !first && cell.effect != TRACKER_FX_VIBRATO && cell.effect != TRACKER_FX_VIBRATO_VOL {
+			p.vibrato(ch)
+		}
+	}
+}
+
+// trackerSlide decodes an S3M style slide, where xF and Fx are fine slides
+// made on the first tick and x0 and 0x slide on the others
+func trackerSlide(param int, first bool) int {
+	x, y := param>>4, param&15
+	switch {
+	case y == 15 && x != 0:
+		if first {
+			return x
+		}
+	case x == 15 && y != 0:
+		if first {
+			return -y
+		}
+	case y == 0:
+		if !first {
+			return x
+		}
+	default:
+		if !first {
+			return -y
+		}
+	}
+	return 0
+}
+
+// xmSlide decodes a ProTracker style slide, up by x or else down by y
+func xmSlide(param int) int {
+	if x := param >> 4; x > 0 {
+		return x
+	}
+	return -(param & 15)
+}
+
+func (p *trackerPlayer) volumeSlide(ch *trackerChannel) {
+	delta := xmSlide(ch.param)
+	if p.mod.kind == TRACKER_S3M || p.mod.kind == TRACKER_IT {
+		delta = trackerSlide(ch.param, false)
+	}
+	ch.volume = min(max(ch.volume+delta, 0), 64)
+}
+
+func (p *trackerPlayer) tonePorta(ch *trackerChannel) {
+	speed := float64(4 * ch.portaSpeed)
+	if ch.period < ch.portaTarget {
+		ch.period = min(ch.period+speed, ch.portaTarget)
+	} else {
+		ch.period = max(ch.period-speed, ch.portaTarget)
+	}
+}
+
+func (p *trackerPlayer) vibrato(ch *trackerChannel) {
+	shift := 5
+	if ch.vibFine {
+		shift = 7
+	}
+	ch.periodDelta = float64(p.wave(ch.vibWave, ch.vibPos) * ch.vibDepth >> shift)
+	ch.vibPos = (ch.vibPos + ch.vibSpeed) & 63
+}
+
+func (p *trackerPlayer) retrig(ch *trackerChannel) {
+	interval := ch.param & 15
+	if interval == 0 || ch.voice == nil {
+		return
+	}
+	ch.retrigCount++
+	if ch.retrigCount < interval {
+		return
+	}
+	ch.retrigCount = 0
+	ch.volume = min(max(trackerRetrigVolume[ch.param>>4](ch.volume), 0), 64)
+	ch.voice.restart()
+}
+
+// wave returns a point of a modulation waveform, from -255 to 255, at a
+// position out of 64
+func (p *trackerPlayer) wave(wave int, pos int) int {
+	pos &= 63
+	switch wave & 3 {
+	case 1:
+		return 255 - pos*8
+	case 2:
+		if pos < 32 {
+			return 255
+		}
+		return -255
+	case 3:
+		p.random = p.random*1103515245 + 12345
+		return int(p.random>>16)%511 - 255
+	}
+	return int(math.Round(255 * math.Sin(2*math.Pi*float64(pos)/64)))
+}
+
+// updateVoice hands the channel's state for this tick to its voice
+func (p *trackerPlayer) updateVoice(ch *trackerChannel) {
+	v := ch.voice
+	if v == nil {
+		return
+	}
+
+	period := ch.period + ch.periodDelta
+	if ch.cell.effect == TRACKER_FX_ARPEGGIO && ch.param != 0 {
+		switch p.tick % 3 {
+		case 1:
+			period = p.shiftPeriod(period, ch.param>>4)
+		case 2:
+			period = p.shiftPeriod(period, ch.param&15)
+		}
+	}
+	v.period = p.clampPeriod(period)
+
+	v.volume = min(max(ch.volume+ch.volDelta, 0), 64)
+	if ch.muted {
+		v.volume = 0
+	}
+	v.pan = min(max(ch.pan+ch.panDelta, 0), 256)
+	v.chanVol = ch.chanVol
+}
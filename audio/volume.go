@@ -0,0 +1,89 @@
+package audio
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	VOLUME_MIN       = -60.0                 // dB, the quietest volume short of muting
+	VOLUME_MAX       = 0.0                   // dB, full scale
+	VOLUME_SMOOTHING = 10 * time.Millisecond // how long a change in volume takes to be mostly heard
+)
+
+// SetVolume sets the volume in dB, held between VOLUME_MIN and VOLUME_MAX.
+// It fails if db is not a finite number.
+func (p *Player) SetVolume(db float64) error {
+	if math.IsNaN(db) || math.IsInf(db, 0) {
+		return ErrInvalidOption
+	}
+	db = math.Max(VOLUME_MIN, math.Min(db, VOLUME_MAX))
+	p.command(CTL_VOLUME, int(math.Round(db*100)))
+	return nil
+}
+
+// Volume is the volume in dB, whether or not muted
+func (p *Player) Volume() float64 {
+	return p.Snapshot().Volume
+}
+
+// Mute silences the player, or brings it back to its volume if muted is not
+// set
+func (p *Player) Mute(muted bool) {
+	op := 0
+	if muted {
+		op = 1
+	}
+	p.command(CTL_MUTE, op)
+}
+
+// volumeGain is the factor samples are scaled by at volume db
+func volumeGain(db float64, muted bool) float64 {
+	if muted {
+		return 0
+	}
+	return math.Pow(10, db/20)
+}
+
+// volumeProcessor scales audio by a gain, easing into each new one so that
+// no steps are heard. Its gain is only set from the player thread.
+type volumeProcessor struct {
+	channels int
+	gain     float64 // applied to the last frame
+	target   float64
+	ease     float64 // fraction of the way to target moved each frame
+}
+
+func newVolumeProcessor(gain float64) *volumeProcessor {
+	return &volumeProcessor{gain: gain, target: gain}
+}
+
+func (v *volumeProcessor) Configure(format *PCMWaveFormat) error {
+	v.channels = int(format.NumChannels)
+	v.ease = 1 - math.Exp(-1/(VOLUME_SMOOTHING.Seconds()*float64(format.SampleRate)))
+	return nil
+}
+
+func (v *volumeProcessor) Process(samples []float64) {
+	if v.gain == v.target && v.gain == 1 {
+		return
+	}
+	for f := 0; f < len(samples); f += v.channels {
+		v.gain += (v.target - v.gain) * v.ease
+		if math.Abs(v.target-v.gain) < 1e-5 {
+			v.gain = v.target
+		}
+		for i := f; i < f+v.channels; i++ {
+			samples[i] *= v.gain
+		}
+	}
+}
+
+func (v *volumeProcessor) Latency() int {
+	return 0
+}
+
+// Reset takes up the new gain at once, nothing before it being heard
+func (v *volumeProcessor) Reset() {
+	v.gain = v.target
+}
@@ -0,0 +1,195 @@
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// leftSamples returns the left channel of 16 bit stereo audio, full scale
+// being ±1
+func leftSamples(data []byte) []float64 {
+	out := make([]float64, 0, len(data)/4)
+	for i := 0; i+4 <= len(data); i += 4 {
+		out = append(out, float64(int16(binary.LittleEndian.Uint16(data[i:])))/32768)
+	}
+	return out
+}
+
+// steady is n samples of v
+func steady(v float64, n int) []float64 {
+	out := make([]float64, n)
+	for i := range out {
+		out[i] = v
+	}
+	return out
+}
+
+func TestVolumeLevels(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.wav")
+	writeWav(t, a, 2, 48000, 16, false, 480000, constant(0.5))
+	p := newSimPlayer(t, []string{a}, WithVolume(-6, false))
+	p.Start()
+	p.step(3)
+
+	// the level the player starts at is heard from the first sample
+	level := 0.5 * math.Pow(10, -6.0/20)
+	checkSamples(t, "start", leftSamples(p.client.Written()), []float64{level}, 1.0/32768)
+
+	// a change eases in, moving one way in small steps, and is whole within
+	// a fraction of a second
+	for _, step := range []struct {
+		what  string
+		set   func()
+		level float64
+	}{
+		{"full volume", func() { p.SetVolume(0) }, 0.5},
+		{"muted", func() { p.Mute(true) }, 0},
+		{"quietest", func() { p.SetVolume(VOLUME_MIN) }, 0},
+		{"unmuted", func() { p.Mute(false) }, 0.5 * math.Pow(10, VOLUME_MIN/20)},
+		{"-20 dB", func() { p.SetVolume(-20) }, 0.05},
+	} {
+		from := len(p.client.Written()) / 4
+		before := leftSamples(p.client.Written())[from-1]
+		step.set()
+		p.step(3)
+		after := leftSamples(p.client.Written())[from:]
+		if len(after) < 9600 {
+			t.Fatalf("%s: %d frames written", step.what, len(after))
+		}
+
+		rising := step.level > before
+		change := math.Abs(step.level - before)
+		for i := 1; i < len(after); i++ {
+			if (rising && after[i] < after[i-1]) || (!rising && after[i] > after[i-1]) {
+				t.Fatalf("%s: frame %d went from %v to %v, heading for %v", step.what, i, after[i-1], after[i], step.level)
+			}
+			if math.Abs(after[i]-after[i-1]) > change/100+1.0/32768 {
+				t.Fatalf("%s: frame %d jumped from %v to %v", step.what, i, after[i-1], after[i])
+			}
+		}
+		tail := after[len(after)-2400:]
+		checkSamples(t, step.what, tail, steady(step.level, len(tail)), 1.0/32768)
+	}
+}
+
+func TestVolumeSettings(t *testing.T) {
+	p := newSimPlayer(t, nil)
+	volume := func() (float64, bool) {
+		s := p.Snapshot()
+		return s.Volume, s.Muted
+	}
+	if v, muted := volume(); v != VOLUME_MAX || muted {
+		t.Fatalf("starts at %v dB, muted %v", v, muted)
+	}
+
+	// volumes out of range are held to it
+	for _, set := range []struct{ db, want float64 }{
+		{12, VOLUME_MAX}, {-200, VOLUME_MIN}, {-12.345, -12.35}, {math.SmallestNonzeroFloat64, 0},
+	} {
+		if err := p.SetVolume(set.db); err != nil {
+			t.Fatal(err)
+		}
+		if v := p.Volume(); v != set.want {
+			t.Fatalf("set to %v dB, volume is %v", set.db, v)
+		}
+	}
+
+	// and what is not a volume at all is refused
+	for _, db := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		if err := p.SetVolume(db); err != ErrInvalidOption {
+			t.Fatalf("set to %v dB: error %v", db, err)
+		}
+		if v := p.Volume(); v != 0 {
+			t.Fatalf("set to %v dB, volume is %v", db, v)
+		}
+	}
+
+	// muting keeps the volume to come back to, and a change made while muted
+	// is kept for then
+	p.SetVolume(-10)
+	p.Mute(true)
+	p.SetVolume(-20)
+	if v, muted := volume(); v != -20 || !muted {
+		t.Fatalf("%v dB, muted %v", v, muted)
+	}
+	p.Mute(false)
+	if v, muted := volume(); v != -20 || muted {
+		t.Fatalf("%v dB, muted %v", v, muted)
+	}
+
+	// each change is published once
+	var changes []VolumeChanged
+	for _, e := range p.tap.drain() {
+		if v, ok := e.(VolumeChanged); ok {
+			changes = append(changes, v)
+		}
+	}
+	want := []VolumeChanged{{VOLUME_MIN, false}, {-12.35, false}, {0, false}, {-10, false}, {-10, true}, {-20, true}, {-20, false}}
+	if len(changes) != len(want) {
+		t.Fatalf("changes %v, expected %v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Fatalf("changes %v, expected %v", changes, want)
+		}
+	}
+
+	for _, db := range []float64{math.NaN(), 1, VOLUME_MIN - 1} {
+		if _, err := NewPlayer(WithClient(p.client), WithVolume(db, false)); err != ErrInvalidOption {
+			t.Fatalf("made at %v dB: error %v", db, err)
+		}
+	}
+}
+
+func TestVolumeOutsideChain(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.wav")
+	writeWav(t, a, 2, 48000, 16, false, 480000, constant(0.5))
+	first := &delayProcessor{gain: 0.5}
+	p := newSimPlayer(t, []string{a}, WithProcessors(first), WithVolume(-6, false))
+
+	// the volume control cannot be reached through the chain
+	if list := p.Processors(); len(list) != 1 || list[0] != first {
+		t.Fatalf("processors %v", list)
+	}
+	if err := p.RemoveProcessor(p.volumeControl); err != ErrProcessorNotFound {
+		t.Fatalf("removing the volume control: error %v", err)
+	}
+	if err := p.BypassProcessor(p.volumeControl, true); err != ErrProcessorNotFound {
+		t.Fatalf("bypassing the volume control: error %v", err)
+	}
+	if err := p.AddProcessor(p.volumeControl); err != ErrProcessorAdded {
+		t.Fatalf("adding the volume control again: error %v", err)
+	}
+
+	// processors added later, wherever asked for, go ahead of it
+	second := &delayProcessor{gain: 2}
+	if err := p.InsertProcessor(5, second); err != nil {
+		t.Fatal(err)
+	}
+	if list := p.Processors(); len(list) != 2 || list[1] != second {
+		t.Fatalf("processors %v", list)
+	}
+	slots := p.chain.slots
+	if last := slots[len(slots)-1]; last.processor != p.volumeControl {
+		t.Fatalf("chain ends with %T", last.processor)
+	}
+
+	// and emptying the chain leaves the volume working
+	p.RemoveProcessor(first)
+	p.RemoveProcessor(second)
+	p.Start()
+	p.step(3)
+	p.SetVolume(-20)
+	from := len(p.client.Written()) / 4
+	p.clock.Advance(500 * time.Millisecond)
+	if list := p.Processors(); len(list) != 0 {
+		t.Fatalf("processors %v", list)
+	}
+	after := leftSamples(p.client.Written())[from+7200:]
+	checkSamples(t, "-20 dB", after, steady(0.05, len(after)), 1.0/32768)
+}
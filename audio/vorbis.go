@@ -0,0 +1,1568 @@
+package audio
+
+import (
+	"errors"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"sync"
+)
+
+const (
+	VORBIS_PACKET_IDENTIFICATION = 1
+	VORBIS_PACKET_COMMENT        = 3
+	VORBIS_PACKET_SETUP          = 5
+
+	VORBIS_CODEBOOK_SYNC = 0x564342
+)
+
+var (
+	ErrNotVorbis       = errors.New("no Vorbis stream found")
+	errVorbisHeader    = errors.New("malformed Vorbis header")
+	errVorbisPacket    = errors.New("malformed Vorbis audio packet")
+	vorbisFloor1Amps   [256]float64
+	vorbisFloor1Ranges = [4]int{256, 128, 86, 64}
+
+	// Vorbis (and Opus family 1) channel orders mapped onto WAVE order.
+	// wave channel i takes Vorbis channel vorbisChannelOrder[n-1][i].
+	vorbisChannelOrder = [8][]int{
+		{0},
+		{0, 1},
+		{0, 2, 1},
+		{0, 1, 2, 3},
+		{0, 2, 1, 3, 4},
+		{0, 2, 1, 5, 3, 4},
+		{0, 2, 1, 6, 5, 3, 4},
+		{0, 2, 1, 7, 5, 6, 3, 4},
+	}
+)
+
+func init() {
+	RegisterAudioSourceProvider(".ogg", &AudioSourceProvider{createVorbisAudioSourceFromFile, getVorbisFileMetadata})
+	RegisterAudioSourceProvider(".oga", &AudioSourceProvider{createVorbisAudioSourceFromFile, getVorbisFileMetadata})
+
+	// floor 1 amplitudes step evenly in dB from 1.0649863e-07 up to 1
+	step := math.Log(1.0649863e-07) / 255
+	for i := range vorbisFloor1Amps {
+		vorbisFloor1Amps[i] = math.Exp(step * float64(255-i))
+	}
+}
+
+func ilog(x int) int {
+	n := 0
+	for x > 0 {
+		n++
+		x >>= 1
+	}
+	return n
+}
+
+// vorbisBitReader reads LSB-first bit fields out of a packet. Reads past the
+// end return zero and set eop.
+type vorbisBitReader struct {
+	data []byte
+	pos  int // in bits
+	eop  bool
+}
+
+func (r *vorbisBitReader) read(n int) uint32 {
+	var v uint32
+	shift := 0
+	for n > 0 {
+		idx := r.pos >> 3
+		if idx >= len(r.data) {
+			r.eop = true
+			r.pos += n
+			return v
+		}
+
+		used := r.pos & 7
+		take := min(8-used, n)
+		v |= uint32(r.data[idx]>>used) & (1<<take - 1) << shift
+
+		shift += take
+		n -= take
+		r.pos += take
+	}
+	return v
+}
+
+func (r *vorbisBitReader) readFlag() bool {
+	return r.read(1) == 1
+}
+
+func float32Unpack(x uint32) float64 {
+	mantissa := float64(x & 0x1FFFFF)
+	if x&0x80000000 != 0 {
+		mantissa = -mantissa
+	}
+	exponent := int(x&0x7FE00000) >> 21
+	return math.Ldexp(mantissa, exponent-788)
+}
+
+// lookup1Values is the largest r such that r^dimensions <= entries
+func lookup1Values(entries int, dimensions int) int {
+	r := int(math.Floor(math.Pow(float64(entries), 1/float64(dimensions))))
+	for intPow(r+1, dimensions) <= entries {
+		r++
+	}
+	for r > 0 && intPow(r, dimensions) > entries {
+		r--
+	}
+	return r
+}
+
+func intPow(base int, exp int) int {
+	result := 1
+	for i := 0; i < exp; i++ {
+		result *= base
+		if result > math.MaxInt32 {
+			return result
+		}
+	}
+	return result
+}
+
+type vorbisCodebook struct {
+	dimensions int
+	entries    int
+
+	tree huffmanTree
+	// the entry of a codebook with one used entry, -1 otherwise
+	single    int
+	singleLen int
+
+	// VQ vectors, dimensions values per entry, nil without a lookup table
+	values []float64
+}
+
+func readVorbisCodebook(r *vorbisBitReader) (*vorbisCodebook, error) {
+	if r.read(24) != VORBIS_CODEBOOK_SYNC {
+		return nil, errVorbisHeader
+	}
+
+	book := &vorbisCodebook{single: -1}
+	book.dimensions = int(r.read(16))
+	book.entries = int(r.read(24))
+
+	lens := make([]uint8, book.entries)
+	if r.readFlag() {
+		// ordered, runs of increasing length
+		length := int(r.read(5)) + 1
+		for entry := 0; entry < book.entries; length++ {
+			count := int(r.read(ilog(book.entries - entry)))
+			if entry+count > book.entries || length > 32 {
+				return nil, errVorbisHeader
+			}
+			for i := 0; i < count; i++ {
+				lens[entry+i] = uint8(length)
+			}
+			entry += count
+		}
+	} else {
+		sparse := r.readFlag()
+		for i := range lens {
+			if !sparse || r.readFlag() {
+				lens[i] = uint8(r.read(5)) + 1
+			}
+		}
+	}
+
+	used := 0
+	for i, l := range lens {
+		if l > 0 {
+			used++
+			book.single, book.singleLen = i, int(l)
+		}
+	}
+	if used != 1 {
+		book.single = -1
+		codes, ok := vorbisCodewords(lens)
+		if !ok {
+			return nil, errVorbisHeader
+		}
+		book.tree = newHuffmanTree(lens, codes)
+	}
+
+	lookupType := r.read(4)
+	switch lookupType {
+	case 0:
+	case 1, 2:
+		minimum := float32Unpack(r.read(32))
+		delta := float32Unpack(r.read(32))
+		valueBits := int(r.read(4)) + 1
+		sequence := r.readFlag()
+
+		count := book.entries * book.dimensions
+		if lookupType == 1 {
+			count = lookup1Values(book.entries, book.dimensions)
+		}
+		multiplicands := make([]float64, count)
+		for i := range multiplicands {
+			multiplicands[i] = float64(r.read(valueBits))
+		}
+		if r.eop {
+			return nil, errVorbisHeader
+		}
+
+		book.values = make([]float64, book.entries*book.dimensions)
+		for entry := 0; entry < book.entries; entry++ {
+			last := 0.0
+			divisor := 1
+			for d := 0; d < book.dimensions; d++ {
+				var offset int
+				if lookupType == 1 {
+					offset = entry / divisor % count
+					divisor *= count
+				} else {
+					offset = entry*book.dimensions + d
+				}
+
+				v := multiplicands[offset]*delta + minimum + last
+				if sequence {
+					last = v
+				}
+				book.values[entry*book.dimensions+d] = v
+			}
+		}
+	default:
+		return nil, errVorbisHeader
+	}
+
+	if r.eop {
+		return nil, errVorbisHeader
+	}
+	return book, nil
+}
+
+// vorbisCodewords assigns codewords to lengths the way the Vorbis spec does,
+// each entry taking the lowest free codeword of its length in order
+func vorbisCodewords(lens []uint8) ([]uint32, bool) {
+	codes := make([]uint32, len(lens))
+	var marker [33]uint32
+
+	for i, l := range lens {
+		if l == 0 {
+			continue
+		}
+		length := int(l)
+
+		entry := marker[length]
+		if length < 32 && entry>>length != 0 {
+			// overspecified
+			return nil, false
+		}
+		codes[i] = entry
+
+		for j := length; j > 0; j-- {
+			if marker[j]&1 != 0 {
+				if j == 1 {
+					marker[1]++
+				} else {
+					marker[j] = marker[j-1] << 1
+				}
+				break
+			}
+			marker[j]++
+		}
+
+		for j := length + 1; j < 33; j++ {
+			if marker[j]>>1 != entry {
+				break
+			}
+			entry = marker[j]
+			marker[j] = marker[j-1] << 1
+		}
+	}
+
+	return codes, true
+}
+
+func (book *vorbisCodebook) decodeScalar(r *vorbisBitReader) int {
+	if book.single >= 0 {
+		r.read(book.singleLen)
+		return book.single
+	}
+
+	node := int32(0)
+	for {
+		node = book.tree[node][r.read(1)]
+		if node < 0 {
+			if r.eop {
+				return -1
+			}
+			return int(-node - 1)
+		} else if node == 0 || r.eop {
+			return -1
+		}
+	}
+}
+
+// decodeVector returns the VQ vector of the next entry, or nil at the end of
+// the packet
+func (book *vorbisCodebook) decodeVector(r *vorbisBitReader) []float64 {
+	entry := book.decodeScalar(r)
+	if entry < 0 || book.values == nil {
+		return nil
+	}
+	return book.values[entry*book.dimensions : (entry+1)*book.dimensions]
+}
+
+// vorbisFloor decodes a channel's spectral envelope, writing it over curve.
+// It returns false if the channel is unused in this packet.
+type vorbisFloor interface {
+	decode(r *vorbisBitReader, books []*vorbisCodebook, curve []float64) bool
+}
+
+type vorbisFloor0 struct {
+	order           int
+	rate            int
+	barkMapSize     int
+	amplitudeBits   int
+	amplitudeOffset int
+	books           []int
+
+	// bark scale maps, by half block size
+	maps map[int][]int
+}
+
+func readVorbisFloor0(r *vorbisBitReader, bookCount int) (*vorbisFloor0, error) {
+	floor := &vorbisFloor0{maps: make(map[int][]int)}
+	floor.order = int(r.read(8))
+	floor.rate = int(r.read(16))
+	floor.barkMapSize = int(r.read(16))
+	floor.amplitudeBits = int(r.read(6))
+	floor.amplitudeOffset = int(r.read(8))
+
+	floor.books = make([]int, r.read(4)+1)
+	for i := range floor.books {
+		floor.books[i] = int(r.read(8))
+		if floor.books[i] >= bookCount {
+			return nil, errVorbisHeader
+		}
+	}
+
+	if floor.rate == 0 || floor.barkMapSize == 0 {
+		return nil, errVorbisHeader
+	}
+	return floor, nil
+}
+
+func bark(x float64) float64 {
+	return 13.1*math.Atan(0.00074*x) + 2.24*math.Atan(0.0000000185*x*x) + 0.0001*x
+}
+
+func (floor *vorbisFloor0) barkMap(n int) []int {
+	if m, ok := floor.maps[n]; ok {
+		return m
+	}
+
+	m := make([]int, n)
+	scale := float64(floor.barkMapSize) / bark(0.5*float64(floor.rate))
+	for i := range m {
+		m[i] = min(floor.barkMapSize-1, int(math.Floor(bark(float64(floor.rate*i)/float64(2*n))*scale)))
+	}
+	floor.maps[n] = m
+	return m
+}
+
+func (floor *vorbisFloor0) decode(r *vorbisBitReader, books []*vorbisCodebook, curve []float64) bool {
+	amplitude := int(r.read(floor.amplitudeBits))
+	if amplitude == 0 {
+		return false
+	}
+
+	bookNumber := int(r.read(ilog(len(floor.books))))
+	if bookNumber >= len(floor.books) {
+		return false
+	}
+	book := books[floor.books[bookNumber]]
+
+	coefficients := make([]float64, 0, floor.order+book.dimensions)
+	last := 0.0
+	for len(coefficients) < floor.order {
+		v := book.decodeVector(r)
+		if v == nil {
+			return false
+		}
+		for _, c := range v {
+			coefficients = append(coefficients, c+last)
+		}
+		last = coefficients[len(coefficients)-1]
+	}
+
+	for i := range coefficients {
+		coefficients[i] = math.Cos(coefficients[i])
+	}
+
+	m := floor.barkMap(len(curve))
+	maxAmplitude := float64(int(1)<<floor.amplitudeBits - 1)
+	for i := 0; i < len(curve); {
+		omega := math.Pi * float64(m[i]) / float64(floor.barkMapSize)
+		cosOmega := math.Cos(omega)
+
+		var p, q float64
+		if floor.order%2 == 1 {
+			p = 1 - cosOmega*cosOmega
+			q = 0.25
+		} else {
+			p = (1 - cosOmega) / 2
+			q = (1 + cosOmega) / 2
+		}
+		for j := 0; j+1 < floor.order; j += 2 {
+			d := coefficients[j+1] - cosOmega
+			p *= 4 * d * d
+		}
+		for j := 0; j < floor.order; j += 2 {
+			d := coefficients[j] - cosOmega
+			q *= 4 * d * d
+		}
+
+		value := math.Exp(0.11512925 * (float64(amplitude*floor.amplitudeOffset)/(maxAmplitude*math.Sqrt(p+q)) - float64(floor.amplitudeOffset)))
+
+		// runs of the same bark index share a value
+		for iteration := m[i]; i < len(curve) && m[i] == iteration; i++ {
+			curve[i] = value
+		}
+	}
+
+	return true
+}
+
+type vorbisFloor1 struct {
+	partitionClasses []int
+
+	classDimensions []int
+	classSubclasses []int
+	classMasterbook []int
+	subclassBooks   [][]int
+
+	multiplier int
+	xList      []int
+
+	// x positions in increasing order, and each point's neighbours among
+	// the points before it
+	sorted []int
+	low    []int
+	high   []int
+}
+
+func readVorbisFloor1(r *vorbisBitReader, bookCount int) (*vorbisFloor1, error) {
+	floor := &vorbisFloor1{}
+
+	partitions := int(r.read(5))
+	floor.partitionClasses = make([]int, partitions)
+	maxClass := -1
+	for i := range floor.partitionClasses {
+		floor.partitionClasses[i] = int(r.read(4))
+		maxClass = max(maxClass, floor.partitionClasses[i])
+	}
+
+	classes := maxClass + 1
+	floor.classDimensions = make([]int, classes)
+	floor.classSubclasses = make([]int, classes)
+	floor.classMasterbook = make([]int, classes)
+	floor.subclassBooks = make([][]int, classes)
+	for c := 0; c < classes; c++ {
+		floor.classDimensions[c] = int(r.read(3)) + 1
+		floor.classSubclasses[c] = int(r.read(2))
+		if floor.classSubclasses[c] > 0 {
+			floor.classMasterbook[c] = int(r.read(8))
+			if floor.classMasterbook[c] >= bookCount {
+				return nil, errVorbisHeader
+			}
+		}
+
+		floor.subclassBooks[c] = make([]int, 1<<floor.classSubclasses[c])
+		for j := range floor.subclassBooks[c] {
+			floor.subclassBooks[c][j] = int(r.read(8)) - 1
+			if floor.subclassBooks[c][j] >= bookCount {
+				return nil, errVorbisHeader
+			}
+		}
+	}
+
+	floor.multiplier = int(r.read(2)) + 1
+	rangeBits := int(r.read(4))
+	floor.xList = []int{0, 1 << rangeBits}
+	for _, class := range floor.partitionClasses {
+		for j := 0; j < floor.classDimensions[class]; j++ {
+			floor.xList = append(floor.xList, int(r.read(rangeBits)))
+		}
+	}
+	if len(floor.xList) > 65 {
+		return nil, errVorbisHeader
+	}
+
+	floor.sorted = make([]int, len(floor.xList))
+	for i := range floor.sorted {
+		floor.sorted[i] = i
+	}
+	sort.SliceStable(floor.sorted, func(a, b int) bool {
+		return floor.xList[floor.sorted[a]] < floor.xList[floor.sorted[b]]
+	})
+
+	floor.low = make([]int, len(floor.xList))
+	floor.high = make([]int, len(floor.xList))
+	for i := 2; i < len(floor.xList); i++ {
+		x := floor.xList[i]
+		lowX, highX := -1, math.MaxInt
+		for j := 0; j < i; j++ {
+			if floor.xList[j] < x && floor.xList[j] > lowX {
+				lowX, floor.low[i] = floor.xList[j], j
+			}
+			if floor.xList[j] > x && floor.xList[j] < highX {
+				highX, floor.high[i] = floor.xList[j], j
+			}
+		}
+	}
+
+	return floor, nil
+}
+
+func (floor *vorbisFloor1) decode(r *vorbisBitReader, books []*vorbisCodebook, curve []float64) bool {
+	if !r.readFlag() {
+		return false
+	}
+
+	floorRange := vorbisFloor1Ranges[floor.multiplier-1]
+	y := make([]int, len(floor.xList))
+	y[0] = int(r.read(ilog(floorRange - 1)))
+	y[1] = int(r.read(ilog(floorRange - 1)))
+
+	offset := 2
+	for _, class := range floor.partitionClasses {
+		dimensions := floor.classDimensions[class]
+		bits := floor.classSubclasses[class]
+		mask := 1<<bits - 1
+
+		value := 0
+		if bits > 0 {
+			value = books[floor.classMasterbook[class]].decodeScalar(r)
+			if value < 0 {
+				return false
+			}
+		}
+
+		for j := 0; j < dimensions; j++ {
+			book := floor.subclassBooks[class][value&mask]
+			value >>= bits
+			if book >= 0 {
+				y[offset+j] = books[book].decodeScalar(r)
+				if y[offset+j] < 0 {
+					return false
+				}
+			}
+		}
+		offset += dimensions
+	}
+	if r.eop {
+		return false
+	}
+
+	// amplitude values are deltas from a line between the neighbours
+	used := make([]bool, len(y))
+	final := make([]int, len(y))
+	used[0], used[1] = true, true
+	final[0], final[1] = y[0], y[1]
+	for i := 2; i < len(y); i++ {
+		low, high := floor.low[i], floor.high[i]
+		predicted := renderPoint(floor.xList[low], final[low], floor.xList[high], final[high], floor.xList[i])
+
+		value := y[i]
+		highRoom := floorRange - predicted
+		lowRoom := predicted
+		room := min(highRoom, lowRoom) * 2
+
+		if value == 0 {
+			final[i] = predicted
+			continue
+		}
+
+		used[low], used[high], used[i] = true, true, true
+		switch {
+		case value >= room && highRoom > lowRoom:
+			final[i] = value - lowRoom + predicted
+		case value >= room:
+			final[i] = predicted - value + highRoom - 1
+		case value%2 == 1:
+			final[i] = predicted - (value+1)/2
+		default:
+			final[i] = predicted + value/2
+		}
+	}
+
+	n := len(curve)
+	amps := make([]int, n)
+	lx, ly := 0, final[floor.sorted[0]]*floor.multiplier
+	hx, hy := 0, 0
+	for _, i := range floor.sorted[1:] {
+		if !used[i] {
+			continue
+		}
+		hx, hy = floor.xList[i], final[i]*floor.multiplier
+		renderLine(lx, ly, hx, hy, amps)
+		lx, ly = hx, hy
+	}
+	if hx < n {
+		renderLine(hx, hy, n, hy, amps)
+	}
+
+	for i, a := range amps {
+		curve[i] = vorbisFloor1Amps[min(max(a, 0), 255)]
+	}
+	return true
+}
+
+func renderPoint(x0, y0, x1, y1, x int) int {
+	dy := y1 - y0
+	adx := x1 - x0
+	ady := dy
+	if ady < 0 {
+		ady = -ady
+	}
+	offset := ady * (x - x0) / adx
+	if dy < 0 {
+		return y0 - offset
+	}
+	return y0 + offset
+}
+
+// renderLine draws a Bresenham line from x0 up to but not including x1,
+// clipped to the length of v
+func renderLine(x0, y0, x1, y1 int, v []int) {
+	dy := y1 - y0
+	adx := x1 - x0
+	if adx <= 0 {
+		return
+	}
+	ady := dy
+	if ady < 0 {
+		ady = -ady
+	}
+
+	base := dy / adx
+	sy := base + 1
+	if dy < 0 {
+		sy = base - 1
+	}
+	absBase := base
+	if absBase < 0 {
+		absBase = -absBase
+	}
+	ady -= absBase * adx
+
+	y, err := y0, 0
+	if x0 < len(v) {
+		v[x0] = y
+	}
+	for x := x0 + 1; x < x1 && x < len(v); x++ {
+		err += ady
+		if err >= adx {
+			err -= adx
+			y += sy
+		} else {
+			y += base
+		}
+		v[x] = y
+	}
+}
+
+type vorbisResidue struct {
+	kind            int
+	begin           int
+	end             int
+	partitionSize   int
+	classifications int
+	classbook       int
+
+	// books[class][pass], -1 where unused
+	books [][8]int
+}
+
+func readVorbisResidue(r *vorbisBitReader, kind int, bookCount int) (*vorbisResidue, error) {
+	res := &vorbisResidue{kind: kind}
+	res.begin = int(r.read(24))
+	res.end = int(r.read(24))
+	res.partitionSize = int(r.read(24)) + 1
+	res.classifications = int(r.read(6)) + 1
+	res.classbook = int(r.read(8))
+	if res.classbook >= bookCount {
+		return nil, errVorbisHeader
+	}
+
+	cascade := make([]int, res.classifications)
+	for i := range cascade {
+		low := int(r.read(3))
+		high := 0
+		if r.readFlag() {
+			high = int(r.read(5))
+		}
+		cascade[i] = high<<3 | low
+	}
+
+	res.books = make([][8]int, res.classifications)
+	for i := range res.books {
+		for pass := 0; pass < 8; pass++ {
+			res.books[i][pass] = -1
+			if cascade[i]&(1<<pass) != 0 {
+				res.books[i][pass] = int(r.read(8))
+				if res.books[i][pass] >= bookCount {
+					return nil, errVorbisHeader
+				}
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// decode adds the residue of the given channels into vectors. Channels with
+// skip set are left alone.
+func (res *vorbisResidue) decode(r *vorbisBitReader, books []*vorbisCodebook, vectors [][]float64, skip []bool) {
+	if res.kind == 2 {
+		decodeAll := false
+		for _, s := range skip {
+			decodeAll = decodeAll || !s
+		}
+		if !decodeAll {
+			return
+		}
+
+		// type 2 codes the channels interleaved into a single vector
+		channels := len(vectors)
+		n := len(vectors[0])
+		joined := make([]float64, n*channels)
+		res.decodeVectors(r, books, [][]float64{joined}, []bool{false})
+		for i := 0; i < n; i++ {
+			for ch := range vectors {
+				vectors[ch][i] += joined[i*channels+ch]
+			}
+		}
+		return
+	}
+
+	res.decodeVectors(r, books, vectors, skip)
+}
+
+func (res *vorbisResidue) decodeVectors(r *vorbisBitReader, books []*vorbisCodebook, vectors [][]float64, skip []bool) {
+	size := len(vectors[0])
+	begin := min(res.begin, size)
+	end := min(res.end, size)
+	partitions := (end - begin) / res.partitionSize
+	if partitions <= 0 {
+		return
+	}
+
+	classbook := books[res.classbook]
+	perCodeword := classbook.dimensions
+	classes := make([][]int, len(vectors))
+	for ch := range classes {
+		classes[ch] = make([]int, partitions+perCodeword)
+	}
+
+	for pass := 0; pass < 8; pass++ {
+		for partition := 0; partition < partitions; {
+			if pass == 0 {
+				for ch := range vectors {
+					if skip[ch] {
+						continue
+					}
+					temp := classbook.decodeScalar(r)
+					if temp < 0 {
+						return
+					}
+					for i := perCodeword - 1; i >= 0; i-- {
+						classes[ch][partition+i] = temp % res.classifications
+						temp /= res.classifications
+					}
+				}
+			}
+
+			for i := 0; i < perCodeword && partition < partitions; i++ {
+				for ch, v := range vectors {
+					if skip[ch] {
+						continue
+					}
+					book := res.books[classes[ch][partition]][pass]
+					if book < 0 {
+						continue
+					}
+
+					offset := begin + partition*res.partitionSize
+					if !res.decodePartition(r, books[book], v[offset:offset+res.partitionSize]) {
+						return
+					}
+				}
+				partition++
+			}
+		}
+	}
+}
+
+func (res *vorbisResidue) decodePartition(r *vorbisBitReader, book *vorbisCodebook, v []float64) bool {
+	dimensions := book.dimensions
+	if res.kind == 0 {
+		// interleaved by step
+		step := len(v) / dimensions
+		for i := 0; i < step; i++ {
+			vector := book.decodeVector(r)
+			if vector == nil {
+				return false
+			}
+			for j, value := range vector {
+				v[i+j*step] += value
+			}
+		}
+		return true
+	}
+
+	for i := 0; i < len(v); {
+		vector := book.decodeVector(r)
+		if vector == nil {
+			return false
+		}
+		for _, value := range vector {
+			if i < len(v) {
+				v[i] += value
+			}
+			i++
+		}
+	}
+	return true
+}
+
+type vorbisMapping struct {
+	magnitudes []int
+	angles     []int
+
+	mux            []int // submap of each channel
+	submapFloors   []int
+	submapResidues []int
+}
+
+type vorbisMode struct {
+	long    bool
+	mapping int
+}
+
+// vorbisSetup holds everything the three header packets of a stream describe
+type vorbisSetup struct {
+	channels   int
+	sampleRate int
+	blockSizes [2]int
+
+	books    []*vorbisCodebook
+	floors   []vorbisFloor
+	residues []*vorbisResidue
+	mappings []*vorbisMapping
+	modes    []vorbisMode
+
+	meta Metadata
+}
+
+func isVorbisIdentification(packet []byte) bool {
+	return len(packet) >= 7 && packet[0] == VORBIS_PACKET_IDENTIFICATION && string(packet[1:7]) == "vorbis"
+}
+
+func (setup *vorbisSetup) readIdentification(packet []byte) error {
+	if !isVorbisIdentification(packet) || len(packet) < 30 {
+		return errVorbisHeader
+	}
+
+	r := &vorbisBitReader{data: packet[7:]}
+	version := r.read(32)
+	setup.channels = int(r.read(8))
+	setup.sampleRate = int(r.read(32))
+	r.read(32 * 3) // bitrates
+	setup.blockSizes[0] = 1 << r.read(4)
+	setup.blockSizes[1] = 1 << r.read(4)
+
+	if version != 0 || setup.channels == 0 || setup.sampleRate == 0 || setup.sampleRate > MAX_SAMPLE_RATE || !r.readFlag() ||
+		setup.blockSizes[0] < 64 || setup.blockSizes[1] < setup.blockSizes[0] || setup.blockSizes[1] > 8192 {
+		return errVorbisHeader
+	}
+	return nil
+}
+
+func (setup *vorbisSetup) readComment(packet []byte) error {
+	if len(packet) < 7 || packet[0] != VORBIS_PACKET_COMMENT || string(packet[1:7]) != "vorbis" {
+		return errVorbisHeader
+	}
+
+	setup.meta = *NewMetadata()
+	parseVorbisComment(packet[7:], &setup.meta)
+	return nil
+}
+
+func (setup *vorbisSetup) readSetup(packet []byte) error {
+	if len(packet) < 7 || packet[0] != VORBIS_PACKET_SETUP || string(packet[1:7]) != "vorbis" {
+		return errVorbisHeader
+	}
+	r := &vorbisBitReader{data: packet[7:]}
+
+	setup.books = make([]*vorbisCodebook, r.read(8)+1)
+	for i := range setup.books {
+		book, err := readVorbisCodebook(r)
+		if err != nil {
+			return err
+		}
+		setup.books[i] = book
+	}
+
+	// time domain transforms are placeholders
+	for i := r.read(6) + 1; i > 0; i-- {
+		if r.read(16) != 0 {
+			return errVorbisHeader
+		}
+	}
+
+	setup.floors = make([]vorbisFloor, r.read(6)+1)
+	for i := range setup.floors {
+		var err error
+		switch r.read(16) {
+		case 0:
+			setup.floors[i], err = readVorbisFloor0(r, len(setup.books))
+		case 1:
+			setup.floors[i], err = readVorbisFloor1(r, len(setup.books))
+		default:
+			err = errVorbisHeader
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	setup.residues = make([]*vorbisResidue, r.read(6)+1)
+	for i := range setup.residues {
+		kind := int(r.read(16))
+		if kind > 2 {
+			return errVorbisHeader
+		}
+		res, err := readVorbisResidue(r, kind, len(setup.books))
+		if err != nil {
+			return err
+		}
+		setup.residues[i] = res
+	}
+
+	setup.mappings = make([]*vorbisMapping, r.read(6)+1)
+	for i := range setup.mappings {
+		mapping, err := setup.readMapping(r)
+		if err != nil {
+			return err
+		}
+		setup.mappings[i] = mapping
+	}
+
+	setup.modes = make([]vorbisMode, r.read(6)+1)
+	for i := range setup.modes {
+		setup.modes[i].long = r.readFlag()
+		windowType, transformType := r.read(16), r.read(16)
+		setup.modes[i].mapping = int(r.read(8))
+		if windowType != 0 || transformType != 0 || setup.modes[i].mapping >= len(setup.mappings) {
+			return errVorbisHeader
+		}
+	}
+
+	if !r.readFlag() || r.eop {
+		return errVorbisHeader
+	}
+	return nil
+}
+
+func (setup *vorbisSetup) readMapping(r *vorbisBitReader) (*vorbisMapping, error) {
+	if r.read(16) != 0 {
+		return nil, errVorbisHeader
+	}
+
+	mapping := &vorbisMapping{}
+	submaps := 1
+	if r.readFlag() {
+		submaps = int(r.read(4)) + 1
+	}
+
+	if r.readFlag() {
+		steps := int(r.read(8)) + 1
+		bits := ilog(setup.channels - 1)
+		for i := 0; i < steps; i++ {
+			magnitude, angle := int(r.read(bits)), int(r.read(bits))
+			if magnitude == angle || magnitude >= setup.channels || angle >= setup.channels {
+				return nil, errVorbisHeader
+			}
+			mapping.magnitudes = append(mapping.magnitudes, magnitude)
+			mapping.angles = append(mapping.angles, angle)
+		}
+	}
+
+	if r.read(2) != 0 {
+		return nil, errVorbisHeader
+	}
+
+	mapping.mux = make([]int, setup.channels)
+	if submaps > 1 {
+		for ch := range mapping.mux {
+			mapping.mux[ch] = int(r.read(4))
+			if mapping.mux[ch] >= submaps {
+				return nil, errVorbisHeader
+			}
+		}
+	}
+
+	mapping.submapFloors = make([]int, submaps)
+	mapping.submapResidues = make([]int, submaps)
+	for i := 0; i < submaps; i++ {
+		r.read(8) // unused time configuration
+		mapping.submapFloors[i] = int(r.read(8))
+		mapping.submapResidues[i] = int(r.read(8))
+		if mapping.submapFloors[i] >= len(setup.floors) || mapping.submapResidues[i] >= len(setup.residues) {
+			return nil, errVorbisHeader
+		}
+	}
+
+	return mapping, nil
+}
+
+// vorbisWindow returns the window for a block of size n whose slopes are
+// leftN and rightN samples long
+func vorbisWindow(n int, leftN int, rightN int) []float64 {
+	w := make([]float64, n)
+
+	leftStart := n/4 - leftN/2
+	rightStart := n*3/4 - rightN/2
+	for i := 0; i < leftN; i++ {
+		s := math.Sin((float64(i) + 0.5) / float64(leftN) * math.Pi / 2)
+		w[leftStart+i] = math.Sin(math.Pi / 2 * s * s)
+	}
+	for i := leftStart + leftN; i < rightStart; i++ {
+		w[i] = 1
+	}
+	for i := 0; i < rightN; i++ {
+		s := math.Sin((float64(i)+0.5)/float64(rightN)*math.Pi/2 + math.Pi/2)
+		w[rightStart+i] = math.Sin(math.Pi / 2 * s * s)
+	}
+	return w
+}
+
+type vorbisChunk struct {
+	samples []float64
+	frame   int64
+}
+
+type vorbisDecoder struct {
+	file *os.File
+
+	chains  []oggChain
+	chain   int
+	pages   *oggReader
+	packets *oggPacketReader
+
+	setup *vorbisSetup
+	// format of the first chain, later chains are converted to it
+	channels  int
+	rate      int
+	resampler *resampler
+
+	// offset of the first audio page of the current chain
+	audioStart int64
+
+	transforms map[int]*imdct
+	windows    map[[3]int][]float64
+
+	// windowed right half of the previous block for each channel
+	overlap   [][]float64
+	prevBlock int // 0 before the first block after a reset
+
+	// decoded packets waiting on a granule position to place them
+	pending []vorbisChunk
+	ready   []vorbisChunk
+	// chain-relative position of the next sample, -1 when unknown
+	nextSample int64
+
+	metaLock sync.Mutex
+	meta     Metadata
+}
+
+func openVorbis(path string) (*vorbisDecoder, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := &vorbisDecoder{file: file}
+	err = dec.readHeader(path)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return dec, nil
+}
+
+func (dec *vorbisDecoder) readHeader(path string) error {
+	info, err := dec.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	dec.chains, err = scanOggChains(dec.file, info.Size(), isVorbisIdentification)
+	if err == ErrNotOgg {
+		return ErrNotVorbis
+	} else if err != nil {
+		return err
+	}
+
+	// chains play back to back, counted at the rate of the first
+	total := int64(0)
+	for i := range dec.chains {
+		head := &vorbisSetup{}
+		err = head.readIdentification(dec.chains[i].head)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			dec.channels, dec.rate = head.channels, head.sampleRate
+		}
+
+		dec.chains[i].firstSample = total
+		total += max(dec.chains[i].lastGranule, 0) * int64(dec.rate) / int64(head.sampleRate)
+	}
+	if dec.channels > len(vorbisChannelOrder) {
+		return ErrUnsupportedFormat
+	}
+
+	dec.pages = newOggReader(dec.file, info.Size())
+	dec.packets = newOggPacketReader(dec.pages)
+	dec.transforms = make(map[int]*imdct)
+	dec.windows = make(map[[3]int][]float64)
+
+	err = dec.enterChain(0)
+	if err != nil {
+		return err
+	}
+
+	dec.meta.Filepath = path
+	dec.meta.Duration = uint64(total * SECOND / int64(dec.rate))
+	return nil
+}
+
+// enterChain reads the headers of a chain and positions the decoder at its
+// first audio page
+func (dec *vorbisDecoder) enterChain(chain int) error {
+	c := &dec.chains[chain]
+	dec.packets.follow(c.serial)
+	err := dec.packets.seekTo(c.start)
+	if err != nil {
+		return err
+	}
+
+	setup := &vorbisSetup{}
+	for i := 0; i < 3; {
+		packet, err := dec.packets.next()
+		if err != nil {
+			return ErrNotVorbis
+		}
+		if packet.serial != c.serial {
+			continue
+		}
+
+		switch i {
+		case 0:
+			err = setup.readIdentification(packet.data)
+		case 1:
+			err = setup.readComment(packet.data)
+		case 2:
+			err = setup.readSetup(packet.data)
+		}
+		if err != nil {
+			return err
+		}
+		i++
+	}
+
+	dec.chain = chain
+	dec.setup = setup
+	dec.resampler = nil
+	if setup.sampleRate != dec.rate {
+		dec.resampler = newResampler(setup.sampleRate, dec.rate, dec.channels)
+	}
+	dec.audioStart = dec.pages.pos
+	dec.reset()
+	dec.updateMetadata()
+	return nil
+}
+
+// updateMetadata takes on the tags of the current chain
+func (dec *vorbisDecoder) updateMetadata() {
+	dec.metaLock.Lock()
+	defer dec.metaLock.Unlock()
+
+	tags := dec.setup.meta
+	dec.meta.Title, dec.meta.Artist, dec.meta.Album = tags.Title, tags.Artist, tags.Album
+}
+
+func (dec *vorbisDecoder) reset() {
+	dec.overlap = make([][]float64, dec.setup.channels)
+	dec.prevBlock = 0
+	dec.pending = dec.pending[:0]
+	dec.nextSample = -1
+	if dec.resampler != nil {
+		dec.resampler.reset()
+	}
+}
+
+func (dec *vorbisDecoder) nativeFormat() *PCMWaveFormat {
+	return &PCMWaveFormat{
+		NumChannels: uint16(dec.channels),
+		SampleRate:  uint32(dec.rate),
+		SampleDepth: 32,
+		PCMType:     PCM_TYPE_FLOAT,
+	}
+}
+
+func (dec *vorbisDecoder) metadata() Metadata {
+	dec.metaLock.Lock()
+	defer dec.metaLock.Unlock()
+	return dec.meta
+}
+
+func (dec *vorbisDecoder) close() error {
+	return dec.file.Close()
+}
+
+func (dec *vorbisDecoder) decode() ([]float64, int64, error) {
+	for len(dec.ready) == 0 {
+		packet, err := dec.packets.next()
+		if err == io.EOF && dec.flushResampler() {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+
+		if packet.bos && isVorbisIdentification(packet.data) {
+			// a chained stream begins
+			err = dec.enterChainAt(packet.pageOffset)
+			if err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		if packet.serial != dec.chains[dec.chain].serial {
+			continue
+		}
+
+		samples := dec.decodePacket(packet.data)
+		if samples != nil {
+			dec.pending = append(dec.pending, vorbisChunk{samples, 0})
+		}
+		if packet.granule != OGG_NO_GRANULE {
+			dec.place(packet.granule, packet.eos)
+		}
+	}
+
+	chunk := dec.ready[0]
+	dec.ready = dec.ready[1:]
+	return chunk.samples, chunk.frame, nil
+}
+
+// enterChainAt moves on to the chain starting at offset, as found while
+// reading sequentially
+func (dec *vorbisDecoder) enterChainAt(offset int64) error {
+	for i, c := range dec.chains {
+		if c.start == offset {
+			dec.flushResampler()
+			err := dec.enterChain(i)
+			if err != nil {
+				return err
+			}
+			return dec.packets.seekTo(dec.audioStart)
+		}
+	}
+	return nil
+}
+
+// flushResampler queues the tail of a resampled chain, returning whether
+// there was one
+func (dec *vorbisDecoder) flushResampler() bool {
+	if dec.resampler == nil || dec.nextSample < 0 {
+		return false
+	}
+
+	tail := dec.resampler.flush()
+	end := dec.chains[dec.chain].firstSample + dec.nextSample*int64(dec.rate)/int64(dec.setup.sampleRate)
+	dec.ready = append(dec.ready, vorbisChunk{tail, end - int64(len(tail)/dec.channels)})
+	dec.resampler = nil
+	return true
+}
+
+// place timestamps the pending packets now that the granule position of the
+// last one is known. Until the position is established it is worked out
+// backwards from the granule, dropping anything before the stream start.
+func (dec *vorbisDecoder) place(granule int64, eos bool) {
+	total := int64(0)
+	for _, chunk := range dec.pending {
+		total += int64(len(chunk.samples) / dec.setup.channels)
+	}
+
+	start := dec.nextSample
+	if start < 0 {
+		start = granule - total
+	}
+
+	// the final page may end partway through its last packet
+	end := start + total
+	if eos && granule < end {
+		end = max(granule, start)
+	}
+
+	channels := int64(dec.setup.channels)
+	pos := start
+	for _, chunk := range dec.pending {
+		samples := chunk.samples
+		frames := int64(len(samples)) / channels
+
+		from, to := max(pos, 0), min(pos+frames, end)
+		pos += frames
+		if from >= to {
+			continue
+		}
+		samples = samples[(from-(pos-frames))*channels : (to-(pos-frames))*channels]
+
+		frame := dec.chains[dec.chain].firstSample + from*int64(dec.rate)/int64(dec.setup.sampleRate)
+		dec.ready = append(dec.ready, vorbisChunk{dec.convert(samples), frame})
+	}
+
+	dec.pending = dec.pending[:0]
+	dec.nextSample = end
+}
+
+// convert reorders interleaved Vorbis channels into WAVE order, adapting
+// chains with a different format to the first
+func (dec *vorbisDecoder) convert(samples []float64) []float64 {
+	channels := dec.setup.channels
+	order := vorbisChannelOrder[min(channels, len(vorbisChannelOrder))-1]
+
+	out := make([]float64, len(samples))
+	for i := 0; i+channels <= len(samples); i += channels {
+		for ch, from := range order {
+			out[i+ch] = samples[i+from]
+		}
+	}
+
+	if channels != dec.channels {
+		out = remapChannels(out, channels, dec.channels)
+	}
+	if dec.resampler != nil {
+		out = dec.resampler.process(out)
+	}
+	return out
+}
+
+func (dec *vorbisDecoder) transform(n int) *imdct {
+	t, ok := dec.transforms[n]
+	if !ok {
+		t = newIMDCT(n)
+		dec.transforms[n] = t
+	}
+	return t
+}
+
+func (dec *vorbisDecoder) window(n int, leftN int, rightN int) []float64 {
+	key := [3]int{n, leftN, rightN}
+	w, ok := dec.windows[key]
+	if !ok {
+		w = vorbisWindow(n, leftN, rightN)
+		dec.windows[key] = w
+	}
+	return w
+}
+
+// decodePacket decodes one audio packet, returning the interleaved samples
+// it completes. The first packet after a reset only primes the overlap.
+func (dec *vorbisDecoder) decodePacket(packet []byte) []float64 {
+	setup := dec.setup
+	r := &vorbisBitReader{data: packet}
+	if r.readFlag() {
+		// not an audio packet
+		return nil
+	}
+
+	modeNumber := int(r.read(ilog(len(setup.modes) - 1)))
+	if modeNumber >= len(setup.modes) || r.eop {
+		return nil
+	}
+	mode := setup.modes[modeNumber]
+	mapping := setup.mappings[mode.mapping]
+
+	n := setup.blockSizes[0]
+	prevLong, nextLong := false, false
+	if mode.long {
+		n = setup.blockSizes[1]
+		prevLong, nextLong = r.readFlag(), r.readFlag()
+	}
+	half := n / 2
+
+	// floors
+	channels := setup.channels
+	curves := make([][]float64, channels)
+	unused := make([]bool, channels)
+	for ch := 0; ch < channels; ch++ {
+		curves[ch] = make([]float64, half)
+		floor := setup.floors[mapping.submapFloors[mapping.mux[ch]]]
+		unused[ch] = !floor.decode(r, setup.books, curves[ch])
+	}
+
+	// coupled channels are decoded together if either has a floor
+	noResidue := append([]bool(nil), unused...)
+	for i := range mapping.magnitudes {
+		m, a := mapping.magnitudes[i], mapping.angles[i]
+		if !noResidue[m] || !noResidue[a] {
+			noResidue[m], noResidue[a] = false, false
+		}
+	}
+
+	// residues by submap
+	spectra := make([][]float64, channels)
+	for ch := range spectra {
+		spectra[ch] = make([]float64, half)
+	}
+	for submap, residue := range mapping.submapResidues {
+		vectors := make([][]float64, 0, channels)
+		skip := make([]bool, 0, channels)
+		for ch := 0; ch < channels; ch++ {
+			if mapping.mux[ch] == submap {
+				vectors = append(vectors, spectra[ch])
+				skip = append(skip, noResidue[ch])
+			}
+		}
+		if len(vectors) > 0 {
+			setup.residues[residue].decode(r, setup.books, vectors, skip)
+		}
+	}
+
+	// inverse coupling, last step first
+	for i := len(mapping.magnitudes) - 1; i >= 0; i-- {
+		magnitude, angle := spectra[mapping.magnitudes[i]], spectra[mapping.angles[i]]
+		for j := range magnitude {
+			m, a := magnitude[j], angle[j]
+			switch {
+			case m > 0 && a > 0:
+				magnitude[j], angle[j] = m, m-a
+			case m > 0:
+				magnitude[j], angle[j] = m+a, m
+			case a > 0:
+				magnitude[j], angle[j] = m, m+a
+			default:
+				magnitude[j], angle[j] = m-a, m
+			}
+		}
+	}
+
+	// window slopes follow the neighbouring block sizes
+	short := setup.blockSizes[0]
+	leftN, rightN := half, half
+	if mode.long && !prevLong {
+		leftN = short / 2
+	}
+	if mode.long && !nextLong {
+		rightN = short / 2
+	}
+	window := dec.window(n, leftN, rightN)
+	transform := dec.transform(n)
+
+	block := make([][]float64, channels)
+	for ch := 0; ch < channels; ch++ {
+		block[ch] = make([]float64, n)
+		if unused[ch] {
+			continue
+		}
+		for i, f := range curves[ch] {
+			spectra[ch][i] *= f
+		}
+		transform.transform(spectra[ch], block[ch])
+		for i, w := range window {
+			block[ch][i] *= w
+		}
+	}
+
+	// overlap with the previous block, from its centre to this one's
+	var out []float64
+	prev := dec.prevBlock
+	if prev > 0 {
+		length := prev/4 + n/4
+		out = make([]float64, length*channels)
+		for ch := 0; ch < channels; ch++ {
+			for i := 0; i < length; i++ {
+				v := 0.0
+				if i < prev/2 {
+					v = dec.overlap[ch][i]
+				}
+				if c := i - prev/4 + n/4; c >= 0 && c < n {
+					v += block[ch][c]
+				}
+				out[i*channels+ch] = v
+			}
+		}
+	}
+
+	for ch := 0; ch < channels; ch++ {
+		dec.overlap[ch] = block[ch][half:]
+	}
+	dec.prevBlock = n
+
+	return out
+}
+
+func (dec *vorbisDecoder) seek(frame int64) error {
+	chain := 0
+	for i, c := range dec.chains {
+		if c.firstSample <= frame {
+			chain = i
+		}
+	}
+
+	if chain != dec.chain {
+		err := dec.enterChain(chain)
+		if err != nil {
+			return err
+		}
+	}
+	dec.reset()
+	dec.ready = dec.ready[:0]
+
+	// start early enough that the packet straddling a page boundary is covered
+	c := &dec.chains[chain]
+	local := (frame - c.firstSample) * int64(dec.setup.sampleRate) / int64(dec.rate)
+	target := local - int64(dec.setup.blockSizes[1])
+	offset := dec.audioStart
+	if target > 0 {
+		var err error
+		offset, err = bisectOggGranule(dec.pages, c.serial, dec.audioStart, c.end, target)
+		if err != nil {
+			return err
+		}
+	}
+
+	return dec.packets.seekTo(offset)
+}
+
+func createVorbisAudioSourceFromFile(metadata *Metadata) (AudioSource, error) {
+	dec, err := openVorbis(metadata.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDecodedSource(dec), nil
+}
+
+func getVorbisFileMetadata(path string) (*Metadata, error) {
+	dec, err := openVorbis(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.file.Close()
+
+	metadata := dec.metadata()
+	return &metadata, nil
+}
@@ -0,0 +1,250 @@
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// vorbisBitWriter packs LSB-first bit fields, the inverse of vorbisBitReader
+type vorbisBitWriter struct {
+	data []byte
+	pos  int // in bits
+}
+
+func (w *vorbisBitWriter) write(v uint64, n int) {
+	for i := 0; i < n; i++ {
+		if w.pos&7 == 0 {
+			w.data = append(w.data, 0)
+		}
+		if v>>i&1 != 0 {
+			w.data[len(w.data)-1] |= 1 << (w.pos & 7)
+		}
+		w.pos++
+	}
+}
+
+// testVorbis describes a generated stream: a short block of 256 and a long
+// block of 2048 samples, and two codebooks. Each channel's floor is flat at
+// full scale, and its residue codes the first 128 lines of the spectrum as
+// zeros but for a single 1 at line[ch].
+type testVorbis struct {
+	channels int
+	rate     int
+	line     []int
+}
+
+func (v *testVorbis) headers(title string) [][]byte {
+	id := []byte("\x01vorbis")
+	id = binary.LittleEndian.AppendUint32(id, 0)
+	id = append(id, byte(v.channels))
+	id = binary.LittleEndian.AppendUint32(id, uint32(v.rate))
+	id = append(id, make([]byte, 12)...)
+	id = append(id, 8|11<<4, 1)
+
+	comment := append([]byte("\x03vorbis"), vorbisComment("TITLE="+title, "ARTIST=Band")...)
+	comment = append(comment, 1)
+
+	w := &vorbisBitWriter{}
+	w.write(1, 8) // two codebooks
+	// the residue classbook, with one entry whose codeword is a single bit
+	w.write(VORBIS_CODEBOOK_SYNC, 24)
+	w.write(1, 16)
+	w.write(1, 24)
+	w.write(0, 2)
+	w.write(0, 5)
+	w.write(0, 4)
+	// the residue values, entries 0 and 1 coding 0 and 1
+	w.write(VORBIS_CODEBOOK_SYNC, 24)
+	w.write(1, 16)
+	w.write(2, 24)
+	w.write(0, 2)
+	w.write(0, 5)
+	w.write(0, 5)
+	w.write(1, 4)          // lookup type 1
+	w.write(0, 32)         // minimum 0
+	w.write(1|788<<21, 32) // delta 1
+	w.write(0, 4)          // one bit values
+	w.write(0, 1)
+	w.write(0, 1)
+	w.write(1, 1)
+
+	w.write(0, 6) // time domain transforms
+	w.write(0, 16)
+
+	w.write(0, 6) // one floor 1, no partitions
+	w.write(1, 16)
+	w.write(0, 5)
+	w.write(0, 2)
+	w.write(7, 4)
+
+	w.write(0, 6) // one residue 1, 128 lines in partitions of 8
+	w.write(1, 16)
+	w.write(0, 24)
+	w.write(128, 24)
+	w.write(7, 24)
+	w.write(0, 6)
+	w.write(0, 8)
+	w.write(1, 3) // the single class decodes the first pass with book 1
+	w.write(0, 1)
+	w.write(1, 8)
+
+	w.write(0, 6) // one mapping, no coupling
+	w.write(0, 16)
+	w.write(0, 1)
+	w.write(0, 1)
+	w.write(0, 2)
+	w.write(0, 8+8+8)
+
+	w.write(1, 6) // short and long modes
+	for long := 0; long < 2; long++ {
+		w.write(uint64(long), 1)
+		w.write(0, 16+16+8)
+	}
+	w.write(1, 1)
+	setup := append([]byte("\x05vorbis"), w.data...)
+
+	return [][]byte{id, comment, setup}
+}
+
+func flagBit(flag bool) uint64 {
+	if flag {
+		return 1
+	}
+	return 0
+}
+
+// packet codes one audio packet in the long or short mode, given whether the
+// blocks either side of a long one are long
+func (v *testVorbis) packet(long, prev, next bool) []byte {
+	w := &vorbisBitWriter{}
+	w.write(0, 1)
+	if long {
+		w.write(1, 1)
+		w.write(flagBit(prev), 1)
+		w.write(flagBit(next), 1)
+	} else {
+		w.write(0, 1)
+	}
+	for ch := 0; ch < v.channels; ch++ {
+		w.write(1, 1)
+		w.write(255, 8)
+		w.write(255, 8)
+	}
+	for partition := 0; partition < 16; partition++ {
+		for ch := 0; ch < v.channels; ch++ {
+			w.write(0, 1)
+		}
+		for ch := 0; ch < v.channels; ch++ {
+			for i := partition * 8; i < partition*8+8; i++ {
+				w.write(flagBit(i == v.line[ch]), 1)
+			}
+		}
+	}
+	return w.data
+}
+
+// write lays out a stream whose packets are long where long says so, its
+// last page claiming trim fewer samples than were coded. It returns the
+// number of samples in the stream.
+func (v *testVorbis) write(t *testing.T, path string, long []bool, trim int64) int64 {
+	t.Helper()
+	var packets [][]byte
+	var granules []int64
+	granule, prev := int64(0), 0
+	for i, l := range long {
+		next := i+1 < len(long) && long[i+1]
+		before := i > 0 && long[i-1]
+		packets = append(packets, v.packet(l, before, next))
+		n := 256
+		if l {
+			n = 2048
+		}
+		if prev > 0 {
+			granule += int64(prev/4 + n/4)
+		}
+		granules = append(granules, granule)
+		prev = n
+	}
+	granules[len(granules)-1] -= trim
+
+	data := muxOgg(1234, v.headers("Song"), packets, granules, 4)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return granule - trim
+}
+
+// vorbisShortBlock is what a short block of the generated stream holds once
+// transformed and windowed, worked out straight from the definitions
+func vorbisShortBlock(line int) []float64 {
+	const n = 256
+	block := make([]float64, n)
+	for i := range block {
+		x := math.Cos(2 * math.Pi / n * (float64(i) + 0.5 + n/4) * (float64(line) + 0.5))
+		s := math.Sin(math.Pi / 2 * (float64(i%(n/2)) + 0.5) / (n / 2))
+		if i >= n/2 {
+			s = math.Cos(math.Pi / 2 * (float64(i-n/2) + 0.5) / (n / 2))
+		}
+		block[i] = x * math.Sin(math.Pi/2*s*s)
+	}
+	return block
+}
+
+func TestVorbis(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.ogg")
+	stream := &testVorbis{channels: 2, rate: 44100, line: []int{96, 20}}
+	total := stream.write(t, path, make([]bool, 2000), 100)
+
+	dec, err := openVorbis(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.close()
+	checkFormat(t, dec, 2, 44100, total)
+	if m := dec.metadata(); m.Title != "Song" || m.Artist != "Band" {
+		t.Fatalf("metadata %+v", m)
+	}
+
+	// every short block is the same, each 128 samples out is the overlap of
+	// one block's second half with the next one's first
+	all := decodeAll(t, dec)
+	if int64(len(all)) != total*2 {
+		t.Fatalf("%d samples, expected %d", len(all)/2, total)
+	}
+	want := make([]float64, 2*1024)
+	for ch, line := range stream.line {
+		block := vorbisShortBlock(line)
+		for i := 0; i < 1024; i++ {
+			want[i*2+ch] = block[128+i%128] + block[i%128]
+		}
+	}
+	checkSamples(t, "first samples", all, want, 1e-9)
+	checkSeek(t, dec, all, 1e-9, 0, 1, 5000, 100000, total-1)
+}
+
+func TestVorbisBlockSizes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.ogg")
+	stream := &testVorbis{channels: 1, rate: 48000, line: []int{50}}
+	long := make([]bool, 3000)
+	for i := range long {
+		long[i] = i%13 > 6 || i%50 == 0
+	}
+	total := stream.write(t, path, long, 1000)
+
+	dec, err := openVorbis(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.close()
+	checkFormat(t, dec, 1, 48000, total)
+	all := decodeAll(t, dec)
+	if int64(len(all)) != total {
+		t.Fatalf("%d samples, expected %d", len(all), total)
+	}
+	checkSeek(t, dec, all, 1e-9, 0, 3000, 12345, 200000, total/2, total-1)
+}
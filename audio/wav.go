@@ -0,0 +1,316 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	WAVE_FORMAT_PCM        = 0x0001
+	WAVE_FORMAT_IEEE_FLOAT = 0x0003
+	WAVE_FORMAT_EXTENSIBLE = 0xFFFE
+)
+
+var (
+	ErrNotWave = errors.New("not a RIFF/WAVE file")
+)
+
+func init() {
+	RegisterAudioSourceProvider(".wav", &AudioSourceProvider{createWavAudioSourceFromFile, getWavFileMetadata})
+}
+
+// riffChunk is a chunk header within a RIFF (little-endian) or IFF
+// (big-endian) file
+type riffChunk struct {
+	id     string
+	size   int64
+	offset int64 // offset of the chunk body within the file
+}
+
+// readChunks walks the chunks following a container header at start,
+// stopping at end or on the first malformed header
+func readChunks(r io.ReadSeeker, start int64, end int64, order binary.ByteOrder) ([]riffChunk, error) {
+	chunks := make([]riffChunk, 0)
+	header := make([]byte, 8)
+
+	pos := start
+	for pos+8 <= end {
+		if _, err := r.Seek(pos, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+
+		chunk := riffChunk{string(header[:4]), int64(order.Uint32(header[4:])), pos + 8}
+		if chunk.offset+chunk.size > end {
+			// truncated or streamed file, take what is there
+			chunk.size = end - chunk.offset
+		}
+		chunks = append(chunks, chunk)
+
+		// chunks are padded to an even length
+		pos = chunk.offset + chunk.size + chunk.size&1
+	}
+
+	return chunks, nil
+}
+
+func readChunkBody(r io.ReadSeeker, chunk riffChunk) ([]byte, error) {
+	if _, err := r.Seek(chunk.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	body := make([]byte, chunk.size)
+	_, err := io.ReadFull(r, body)
+	return body, err
+}
+
+// trimTagString strips the padding and terminators tag writers leave behind
+func trimTagString(b []byte) string {
+	if idx := bytes.IndexByte(b, 0); idx >= 0 {
+		b = b[:idx]
+	}
+	return strings.TrimSpace(string(b))
+}
+
+type wavDecoder struct {
+	file *os.File
+
+	format     PCMWaveFormat
+	blockAlign int
+
+	dataStart  int64
+	dataFrames int64
+	frame      int64
+
+	meta Metadata
+	buf  []byte
+}
+
+func openWav(path string) (*wavDecoder, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := &wavDecoder{file: file}
+	err = dec.readHeader(path)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return dec, nil
+}
+
+func (dec *wavDecoder) readHeader(path string) error {
+	info, err := dec.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(dec.file, header); err != nil {
+		return ErrNotWave
+	}
+	if string(header[:4]) != "RIFF" || string(header[8:]) != "WAVE" {
+		return ErrNotWave
+	}
+
+	chunks, err := readChunks(dec.file, 12, info.Size(), binary.LittleEndian)
+	if err != nil {
+		return err
+	}
+
+	dec.meta = *NewMetadata()
+	dec.meta.Filepath = path
+
+	var data *riffChunk
+	foundFormat := false
+	for i, chunk := range chunks {
+		switch chunk.id {
+		case "fmt ":
+			body, err := readChunkBody(dec.file, chunk)
+			if err != nil {
+				return err
+			}
+			err = dec.parseFormat(body)
+			if err != nil {
+				return err
+			}
+			foundFormat = true
+		case "data":
+			data = &chunks[i]
+		case "LIST":
+			body, err := readChunkBody(dec.file, chunk)
+			if err == nil {
+				parseInfoList(body, &dec.meta)
+			}
+		}
+	}
+
+	if !foundFormat || data == nil {
+		return ErrNotWave
+	}
+
+	dec.dataStart = data.offset
+	dec.dataFrames = data.size / int64(dec.blockAlign)
+	dec.meta.Duration = uint64(dec.dataFrames * SECOND / int64(dec.format.SampleRate))
+
+	dec.buf = make([]byte, DECODE_BLOCK_FRAMES*dec.blockAlign)
+	return dec.seek(0)
+}
+
+func (dec *wavDecoder) parseFormat(body []byte) error {
+	if len(body) < 16 {
+		return ErrNotWave
+	}
+
+	tag := binary.LittleEndian.Uint16(body[0:])
+	channels := binary.LittleEndian.Uint16(body[2:])
+	rate := binary.LittleEndian.Uint32(body[4:])
+	blockAlign := binary.LittleEndian.Uint16(body[12:])
+
+	if tag == WAVE_FORMAT_EXTENSIBLE {
+		if len(body) < 40 {
+			return ErrNotWave
+		}
+		// the first two bytes of the sub-format GUID hold the real format tag
+		tag = binary.LittleEndian.Uint16(body[24:])
+	}
+
+	if channels == 0 || blockAlign%channels != 0 {
+		return ErrNotWave
+	}
+
+	dec.format = PCMWaveFormat{
+		NumChannels: channels,
+		SampleRate:  rate,
+		// use the container size, valid bits are left-justified within it
+		SampleDepth: blockAlign / channels * 8,
+	}
+
+	switch tag {
+	case WAVE_FORMAT_PCM:
+		dec.format.PCMType = PCM_TYPE_INT
+	case WAVE_FORMAT_IEEE_FLOAT:
+		dec.format.PCMType = PCM_TYPE_FLOAT
+	default:
+		return ErrUnsupportedFormat
+	}
+
+	if !isSupportedFormat(&dec.format) {
+		return ErrUnsupportedFormat
+	}
+
+	dec.blockAlign = int(blockAlign)
+	return nil
+}
+
+// parseInfoList reads the title, artist and album out of a LIST/INFO chunk
+func parseInfoList(body []byte, metadata *Metadata) {
+	if len(body) < 4 || string(body[:4]) != "INFO" {
+		return
+	}
+
+	for pos := 4; pos+8 <= len(body); {
+		id := string(body[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(body[pos+4:]))
+		pos += 8
+		if pos+size > len(body) {
+			size = len(body) - pos
+		}
+
+		value := trimTagString(body[pos : pos+size])
+		if value != "" {
+			switch id {
+			case "INAM":
+				metadata.Title = value
+			case "IART":
+				metadata.Artist = value
+			case "IPRD":
+				metadata.Album = value
+			}
+		}
+
+		pos += size + size&1
+	}
+}
+
+func (dec *wavDecoder) nativeFormat() *PCMWaveFormat {
+	format := dec.format
+	return &format
+}
+
+func (dec *wavDecoder) decode() ([]float64, int64, error) {
+	frames := dec.dataFrames - dec.frame
+	if frames <= 0 {
+		return nil, 0, io.EOF
+	}
+	if frames > DECODE_BLOCK_FRAMES {
+		frames = DECODE_BLOCK_FRAMES
+	}
+
+	n, err := io.ReadFull(dec.file, dec.buf[:frames*int64(dec.blockAlign)])
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		// data chunk claims more than the file holds
+		frames = int64(n / dec.blockAlign)
+		dec.dataFrames = dec.frame + frames
+		if frames == 0 {
+			return nil, 0, io.EOF
+		}
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	samples := make([]float64, frames*int64(dec.format.NumChannels))
+	decodeSamples(samples, dec.buf[:frames*int64(dec.blockAlign)], &dec.format)
+
+	start := dec.frame
+	dec.frame += frames
+	return samples, start, nil
+}
+
+func (dec *wavDecoder) seek(frame int64) error {
+	frame = min(max(frame, 0), dec.dataFrames)
+
+	_, err := dec.file.Seek(dec.dataStart+frame*int64(dec.blockAlign), io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	dec.frame = frame
+	return nil
+}
+
+func (dec *wavDecoder) metadata() Metadata {
+	return dec.meta
+}
+
+func (dec *wavDecoder) close() error {
+	return dec.file.Close()
+}
+
+func createWavAudioSourceFromFile(metadata *Metadata) (AudioSource, error) {
+	dec, err := openWav(metadata.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDecodedSource(dec), nil
+}
+
+func getWavFileMetadata(path string) (*Metadata, error) {
+	dec, err := openWav(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.file.Close()
+
+	metadata := dec.metadata()
+	return &metadata, nil
+}
@@ -0,0 +1,170 @@
+package audio
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWav(t *testing.T) {
+	dir := t.TempDir()
+	for _, test := range []struct {
+		name       string
+		ch, rate   int
+		bits       int
+		float      bool
+		frames     int
+		extensible bool
+	}{
+		{"8 bit", 1, 8000, 8, false, 3000, false},
+		{"16 bit", 2, 44100, 16, false, 10000, false},
+		{"24 bit", 2, 48000, 24, false, 10000, false},
+		{"32 bit", 1, 96000, 32, false, 10000, false},
+		{"float", 2, 44100, 32, true, 10000, false},
+		{"double", 1, 22050, 64, true, 5000, false},
+		{"extensible 24 bit", 6, 48000, 24, false, 9000, true},
+		{"extensible float", 3, 44100, 32, true, 9000, true},
+	} {
+		path := filepath.Join(dir, test.name+".wav")
+		if test.extensible {
+			writeExtensibleWav(t, path, test.ch, test.rate, test.bits, test.float, test.frames)
+		} else {
+			writeWav(t, path, test.ch, test.rate, test.bits, test.float, test.frames, ramp)
+		}
+
+		dec, err := openWav(path)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		checkFormat(t, dec, test.ch, test.rate, int64(test.frames))
+		if format := dec.nativeFormat(); int(format.SampleDepth) != test.bits || (format.PCMType == PCM_TYPE_FLOAT) != test.float {
+			t.Fatalf("%s: format %+v", test.name, *format)
+		}
+		if !test.extensible && dec.metadata().Title != "Song" {
+			t.Fatalf("%s: metadata %+v", test.name, dec.metadata())
+		}
+
+		want := make([]float64, test.frames*test.ch)
+		for f := 0; f < test.frames; f++ {
+			for c := 0; c < test.ch; c++ {
+				want[f*test.ch+c] = ramp(f, c)
+			}
+		}
+		all := decodeAll(t, dec)
+		if len(all) != len(want) {
+			t.Fatalf("%s: %d samples, expected %d", test.name, len(all), len(want))
+		}
+		checkSamples(t, test.name, all, want, 0)
+		checkSeek(t, dec, all, 0, 0, 1, 4095, 4096, int64(test.frames)/2, int64(test.frames)-1)
+		dec.close()
+	}
+}
+
+// a header claiming an absurd rate is refused rather than resampled from
+func TestWavRate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fast.wav")
+	writeWav(t, path, 2, 872463232, 16, false, 10, ramp)
+	if _, err := openWav(path); err != ErrUnsupportedFormat {
+		t.Fatalf("error %v, expected %v", err, ErrUnsupportedFormat)
+	}
+
+	// and the resampler's kernel stays bounded whatever it is asked for
+	if r := newResampler(872463232, 44100, 2); r.halfTaps > RESAMPLER_MAX_HALF_TAPS {
+		t.Fatalf("%d taps a side", r.halfTaps)
+	}
+}
+
+// writeWav writes a WAV file of frames generated by gen, tagged as the song
+// "Song" on "Record" by "Band"
+func writeWav(t *testing.T, path string, ch, rate, bits int, float bool, frames int, gen func(f, c int) float64) {
+	t.Helper()
+	format := &PCMWaveFormat{uint16(ch), uint32(rate), uint16(bits), PCM_TYPE_INT}
+	tag := 1
+	if float {
+		format.PCMType = PCM_TYPE_FLOAT
+		tag = 3
+	}
+	samples := make([]float64, frames*ch)
+	for f := 0; f < frames; f++ {
+		for c := 0; c < ch; c++ {
+			samples[f*ch+c] = gen(f, c)
+		}
+	}
+	data := make([]byte, len(samples)*bits/8)
+	encodeSamples(data, samples, format)
+
+	le := binary.LittleEndian
+	fmtChunk := make([]byte, 16)
+	le.PutUint16(fmtChunk, uint16(tag))
+	le.PutUint16(fmtChunk[2:], uint16(ch))
+	le.PutUint32(fmtChunk[4:], uint32(rate))
+	le.PutUint32(fmtChunk[8:], uint32(rate*ch*bits/8))
+	le.PutUint16(fmtChunk[12:], uint16(ch*bits/8))
+	le.PutUint16(fmtChunk[14:], uint16(bits))
+
+	chunk := func(out []byte, id string, body []byte) []byte {
+		out = append(out, id...)
+		out = le.AppendUint32(out, uint32(len(body)))
+		out = append(out, body...)
+		if len(body)%2 == 1 {
+			out = append(out, 0)
+		}
+		return out
+	}
+	info := []byte("INFO")
+	info = chunk(info, "INAM", []byte("Song\x00"))
+	info = chunk(info, "IART", []byte("Band\x00"))
+	info = chunk(info, "IPRD", []byte("Record\x00"))
+
+	out := []byte("RIFF\x00\x00\x00\x00WAVE")
+	out = chunk(out, "fmt ", fmtChunk)
+	out = chunk(out, "LIST", info)
+	out = chunk(out, "data", data)
+	le.PutUint32(out[4:], uint32(len(out)-8))
+	if err := os.WriteFile(path, out, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeExtensibleWav writes a ramp with its format in the extensible layout,
+// as used for more than two channels or deep PCM
+func writeExtensibleWav(t *testing.T, path string, ch, rate, bits int, float bool, frames int) {
+	t.Helper()
+	format := &PCMWaveFormat{uint16(ch), uint32(rate), uint16(bits), PCM_TYPE_INT}
+	subformat := uint16(1)
+	if float {
+		format.PCMType = PCM_TYPE_FLOAT
+		subformat = 3
+	}
+	samples := make([]float64, frames*ch)
+	for f := 0; f < frames; f++ {
+		for c := 0; c < ch; c++ {
+			samples[f*ch+c] = ramp(f, c)
+		}
+	}
+	data := make([]byte, len(samples)*bits/8)
+	encodeSamples(data, samples, format)
+
+	le := binary.LittleEndian
+	out := []byte("RIFF\x00\x00\x00\x00WAVEfmt \x28\x00\x00\x00")
+	out = le.AppendUint16(out, 0xFFFE)
+	out = le.AppendUint16(out, uint16(ch))
+	out = le.AppendUint32(out, uint32(rate))
+	out = le.AppendUint32(out, uint32(rate*ch*bits/8))
+	out = le.AppendUint16(out, uint16(ch*bits/8))
+	out = le.AppendUint16(out, uint16(bits))
+	out = le.AppendUint16(out, 22)
+	out = le.AppendUint16(out, uint16(bits))
+	out = le.AppendUint32(out, 1<<ch-1)
+	// the subformat GUID, the format tag followed by a fixed suffix
+	out = le.AppendUint16(out, subformat)
+	out = append(out, "\x00\x00\x00\x00\x10\x00\x80\x00\x00\xaa\x00\x38\x9b\x71"...)
+	out = append(out, "data"...)
+	out = le.AppendUint32(out, uint32(len(data)))
+	out = append(out, data...)
+	le.PutUint32(out[4:], uint32(len(out)-8))
+	if err := os.WriteFile(path, out, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,165 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+)
+
+const (
+	WAV_HEADER_SIZE     = 12
+	WAV_FMT_SIZE        = 16
+	WAV_FMT_EXT_SIZE    = 40
+	WAV_MAX_DATA        = 0xFFFFFFFF - 64 // largest data chunk the 32 bit sizes can describe
+	WAV_BUFFER_DURATION = SECOND / 2      // audio taken per refill
+)
+
+// tail of the KSDATAFORMAT_SUBTYPE GUIDs, after the format tag
+var WAV_SUBTYPE_GUID = []byte{0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0xAA, 0x00, 0x38, 0x9B, 0x71}
+
+var (
+	ErrWavTooLarge = errors.New("rendered audio does not fit in a WAV file")
+)
+
+// WavFileClient is an AudioClient that writes what the player loads into it
+// to a WAV file, taking it as fast as it can be decoded rather than as a
+// device would play it
+type WavFileClient struct {
+	file   *os.File
+	format PCMWaveFormat
+
+	dataStart int64
+	written   int64 // bytes of audio in the data chunk
+	playing   bool
+}
+
+// NewWavFileClient creates the file at path, replacing any there, to hold
+// audio of the given format
+func NewWavFileClient(path string, format *PCMWaveFormat) (*WavFileClient, error) {
+	if !isSupportedFormat(format) {
+		return nil, ErrUnsupportedFormat
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &WavFileClient{file: file, format: *format}
+	if err := client.writeHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// writeHeader writes the RIFF, fmt and data chunk headers, with the sizes of
+// the audio written so far
+func (c *WavFileClient) writeHeader() error {
+	le := binary.LittleEndian
+	frameSize := int(c.format.NumChannels) * int(c.format.SampleDepth) / 8
+
+	tag := uint16(WAVE_FORMAT_PCM)
+	if c.format.PCMType == PCM_TYPE_FLOAT {
+		tag = WAVE_FORMAT_IEEE_FLOAT
+	}
+
+	fmtBody := make([]byte, 0, WAV_FMT_EXT_SIZE)
+	// more than two channels or deeper than 16 bit PCM needs the extensible
+	// format to be read unambiguously
+	extensible := c.format.NumChannels > 2 || (tag == WAVE_FORMAT_PCM && c.format.SampleDepth > 16)
+	if extensible {
+		fmtBody = le.AppendUint16(fmtBody, WAVE_FORMAT_EXTENSIBLE)
+	} else {
+		fmtBody = le.AppendUint16(fmtBody, tag)
+	}
+	fmtBody = le.AppendUint16(fmtBody, c.format.NumChannels)
+	fmtBody = le.AppendUint32(fmtBody, c.format.SampleRate)
+	fmtBody = le.AppendUint32(fmtBody, c.format.SampleRate*uint32(frameSize))
+	fmtBody = le.AppendUint16(fmtBody, uint16(frameSize))
+	fmtBody = le.AppendUint16(fmtBody, c.format.SampleDepth)
+	if extensible {
+		fmtBody = le.AppendUint16(fmtBody, WAV_FMT_EXT_SIZE-WAV_FMT_SIZE-2)
+		fmtBody = le.AppendUint16(fmtBody, c.format.SampleDepth) // valid bits
+		fmtBody = le.AppendUint32(fmtBody, 0)                    // unassigned speaker positions
+		fmtBody = le.AppendUint16(fmtBody, tag)
+		fmtBody = append(fmtBody, WAV_SUBTYPE_GUID...)
+	}
+
+	header := make([]byte, 0, WAV_HEADER_SIZE+8+len(fmtBody)+8)
+	header = append(header, "RIFF"...)
+	header = le.AppendUint32(header, uint32(int64(4+8+len(fmtBody)+8)+c.written+c.written%2))
+	header = append(header, "WAVE"...)
+	header = append(header, "fmt "...)
+	header = le.AppendUint32(header, uint32(len(fmtBody)))
+	header = append(header, fmtBody...)
+	header = append(header, "data"...)
+	header = le.AppendUint32(header, uint32(c.written))
+
+	if _, err := c.file.WriteAt(header, 0); err != nil {
+		return err
+	}
+	c.dataStart = int64(len(header))
+	return nil
+}
+
+func (c *WavFileClient) GetPCMWaveFormat() *PCMWaveFormat {
+	format := c.format
+	return &format
+}
+
+func (c *WavFileClient) GetBufferSize() (int, error) {
+	return int(int64(c.format.SampleRate) * WAV_BUFFER_DURATION / SECOND), nil
+}
+
+// GetBufferPadding is always zero, audio is written out as soon as it is
+// loaded
+func (c *WavFileClient) GetBufferPadding() (int, error) {
+	return 0, nil
+}
+
+func (c *WavFileClient) LoadToBuffer(data []byte) (int, error) {
+	if c.written+int64(len(data)) > WAV_MAX_DATA {
+		return 0, ErrWavTooLarge
+	}
+	n, err := c.file.WriteAt(data, c.dataStart+c.written)
+	c.written += int64(n)
+	return n, err
+}
+
+// ClearBuffer has nothing to drop, what was loaded is already written
+func (c *WavFileClient) ClearBuffer() error {
+	return nil
+}
+
+func (c *WavFileClient) Start() error {
+	c.playing = true
+	return nil
+}
+
+func (c *WavFileClient) Stop() (bool, error) {
+	wasPlaying := c.playing
+	c.playing = false
+	return wasPlaying, nil
+}
+
+// offline lets the player feed the client without waiting on its clock
+func (c *WavFileClient) offline() bool {
+	return true
+}
+
+// Close fills in the chunk sizes and closes the file
+func (c *WavFileClient) Close() error {
+	// the data chunk is padded to an even size
+	if c.written%2 == 1 {
+		if _, err := c.file.WriteAt([]byte{0}, c.dataStart+c.written); err != nil {
+			c.file.Close()
+			return err
+		}
+	}
+	err := c.writeHeader()
+	if cerr := c.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
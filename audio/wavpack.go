@@ -0,0 +1,1369 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+)
+
+const (
+	WAVPACK_HEADER_SIZE      = 32
+	WAVPACK_MIN_VERSION      = 0x402
+	WAVPACK_MAX_VERSION      = 0x410
+	WAVPACK_MAX_BLOCK_SIZE   = 1 << 24
+	WAVPACK_MAX_BLOCK_FRAMES = 1 << 20
+	WAVPACK_SEARCH_LIMIT     = 1 << 20
+	WAVPACK_SCAN_SIZE        = 1 << 16
+
+	WAVPACK_MAX_TERMS  = 16
+	WAVPACK_MAX_TERM   = 8
+	WAVPACK_LIMIT_ONES = 16
+
+	// slow_level is a running log average with this many fraction bits
+	WAVPACK_SLOW_SHIFT = 8
+	WAVPACK_SLOW_ROUND = 1 << (WAVPACK_SLOW_SHIFT - 1)
+
+	// block header flags
+	WAVPACK_FLAG_BYTES_STORED   = 0x3
+	WAVPACK_FLAG_MONO           = 0x4
+	WAVPACK_FLAG_HYBRID         = 0x8
+	WAVPACK_FLAG_JOINT_STEREO   = 0x10
+	WAVPACK_FLAG_FLOAT          = 0x80
+	WAVPACK_FLAG_INT32          = 0x100
+	WAVPACK_FLAG_HYBRID_BITRATE = 0x200
+	WAVPACK_FLAG_HYBRID_BALANCE = 0x400
+	WAVPACK_FLAG_INITIAL_BLOCK  = 0x800
+	WAVPACK_FLAG_FINAL_BLOCK    = 0x1000
+	WAVPACK_FLAG_FALSE_STEREO   = 0x40000000
+	WAVPACK_FLAG_DSD            = 0x80000000
+	WAVPACK_FLAG_MONO_DATA      = WAVPACK_FLAG_MONO | WAVPACK_FLAG_FALSE_STEREO
+
+	WAVPACK_SHIFT_LSB    = 13
+	WAVPACK_SHIFT_MASK   = 0x1F << WAVPACK_SHIFT_LSB
+	WAVPACK_SRATE_LSB    = 23
+	WAVPACK_SRATE_MASK   = 0xF << WAVPACK_SRATE_LSB
+	WAVPACK_SRATE_CUSTOM = 15
+
+	// metadata sub-block ids
+	WAVPACK_ID_UNIQUE         = 0x3F
+	WAVPACK_ID_ODD_SIZE       = 0x40
+	WAVPACK_ID_LARGE          = 0x80
+	WAVPACK_ID_DECORR_TERMS   = 0x2
+	WAVPACK_ID_DECORR_WEIGHTS = 0x3
+	WAVPACK_ID_DECORR_SAMPLES = 0x4
+	WAVPACK_ID_ENTROPY_VARS   = 0x5
+	WAVPACK_ID_HYBRID_PROFILE = 0x6
+	WAVPACK_ID_FLOAT_INFO     = 0x8
+	WAVPACK_ID_INT32_INFO     = 0x9
+	WAVPACK_ID_WV_BITSTREAM   = 0xA
+	WAVPACK_ID_WVX_BITSTREAM  = 0xC
+	WAVPACK_ID_CHANNEL_INFO   = 0xD
+	WAVPACK_ID_SAMPLE_RATE    = 0x27
+
+	// float info flags
+	WAVPACK_FLOAT_SHIFT_ONES = 0x1
+	WAVPACK_FLOAT_SHIFT_SAME = 0x2
+	WAVPACK_FLOAT_SHIFT_SENT = 0x4
+	WAVPACK_FLOAT_ZEROS_SENT = 0x8
+	WAVPACK_FLOAT_NEG_ZEROS  = 0x10
+)
+
+var (
+	ErrNotWavPack = errors.New("not a WavPack file")
+	ErrWavPackCRC = errors.New("WavPack block failed its CRC check")
+
+	errWavPackInvalid = errors.New("invalid WavPack block")
+)
+
+var wavpackSampleRates = [15]int{
+	6000, 8000, 9600, 11025, 12000, 16000, 22050, 24000,
+	32000, 44100, 48000, 64000, 88200, 96000, 192000,
+}
+
+// fractional parts of the 8.8 fixed point logs used by the entropy coder
+var (
+	wavpackExp2Table [256]uint32
+	wavpackLog2Table [256]uint32
+)
+
+func init() {
+	for i := range wavpackExp2Table {
+		wavpackExp2Table[i] = uint32(math.Round((math.Exp2(float64(i)/256) - 1) * 256))
+		wavpackLog2Table[i] = uint32(math.Round(math.Log2(1+float64(i)/256) * 256))
+	}
+
+	RegisterAudioSourceProvider(".wv", &AudioSourceProvider{createWavPackAudioSourceFromFile, getWavPackFileMetadata})
+}
+
+// wavpackExp2 converts a signed 8.8 fixed point log back to a linear value
+func wavpackExp2(log int32) int32 {
+	if log < 0 {
+		return -wavpackExp2(-log)
+	}
+
+	value := wavpackExp2Table[log&0xFF] | 0x100
+	log >>= 8
+	if log <= 9 {
+		return int32(value >> (9 - log))
+	}
+	return int32(value << ((log - 9) & 0x1F))
+}
+
+// wavpackLog2 returns the 8.8 fixed point log of a value
+func wavpackLog2(value uint32) int32 {
+	value += value >> 9
+	if value < 1<<8 {
+		n := bits.Len32(value)
+		return int32(n<<8) + int32(wavpackLog2Table[(value<<(9-n))&0xFF])
+	}
+
+	n := bits.Len32(value)
+	return int32(n<<8) + int32(wavpackLog2Table[(value>>(n-9))&0xFF])
+}
+
+type wavpackBlockHeader struct {
+	size    int64 // whole block, including the header
+	version int
+	flags   uint32
+	crc     uint32
+
+	totalSamples int64 // -1 if unknown
+	blockIndex   int64
+	blockSamples int64
+}
+
+func parseWavPackBlockHeader(b []byte) (*wavpackBlockHeader, error) {
+	if len(b) < WAVPACK_HEADER_SIZE || string(b[:4]) != "wvpk" {
+		return nil, errWavPackInvalid
+	}
+
+	size := binary.LittleEndian.Uint32(b[4:])
+	h := &wavpackBlockHeader{
+		size:         int64(size) + 8,
+		version:      int(binary.LittleEndian.Uint16(b[8:])),
+		blockIndex:   int64(b[10])<<32 | int64(binary.LittleEndian.Uint32(b[16:])),
+		blockSamples: int64(binary.LittleEndian.Uint32(b[20:])),
+		flags:        binary.LittleEndian.Uint32(b[24:]),
+		crc:          binary.LittleEndian.Uint32(b[28:]),
+	}
+
+	// the total is stored modulo 0xFFFFFFFF so that all ones can mean unknown
+	total := binary.LittleEndian.Uint32(b[12:])
+	h.totalSamples = -1
+	if total != 0xFFFFFFFF {
+		h.totalSamples = int64(b[11])*0xFFFFFFFF + int64(total)
+	}
+
+	if size&1 != 0 || size < WAVPACK_HEADER_SIZE-8 || size > WAVPACK_MAX_BLOCK_SIZE ||
+		h.version < WAVPACK_MIN_VERSION || h.version > WAVPACK_MAX_VERSION ||
+		h.blockSamples > WAVPACK_MAX_BLOCK_FRAMES {
+		return nil, errWavPackInvalid
+	}
+	return h, nil
+}
+
+// wavpackBits reads the LSB-first bit streams of a block. Reads past the end
+// of the data return zero bits and set overrun.
+type wavpackBits struct {
+	data []byte
+	pos  int // in bits
+
+	overrun bool
+}
+
+func (bs *wavpackBits) readBit() uint32 {
+	idx := bs.pos >> 3
+	if idx >= len(bs.data) {
+		bs.overrun = true
+		return 0
+	}
+
+	bit := uint32(bs.data[idx]>>(bs.pos&7)) & 1
+	bs.pos++
+	return bit
+}
+
+func (bs *wavpackBits) readBits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		v |= bs.readBit() << i
+	}
+	return v
+}
+
+// readCount reads the Elias gamma style counts used for runs of zeros and
+// long unary codes, returning false on a code that is too long
+func (bs *wavpackBits) readCount() (uint32, bool) {
+	n := 0
+	for n < 33 && bs.readBit() == 1 {
+		n++
+	}
+	if n == 33 {
+		return 0, false
+	} else if n < 2 {
+		return uint32(n), true
+	}
+
+	value, mask := uint32(0), uint32(1)
+	for n--; n > 0; n-- {
+		if bs.readBit() == 1 {
+			value |= mask
+		}
+		mask <<= 1
+	}
+	return value | mask, true
+}
+
+// readCode reads a value in [0, maxCode] in the fewest bits, giving the
+// shorter codes to the values at the bottom of the range
+func (bs *wavpackBits) readCode(maxCode uint32) uint32 {
+	if maxCode < 2 {
+		if maxCode == 0 {
+			return 0
+		}
+		return bs.readBit()
+	}
+
+	n := bits.Len32(maxCode)
+	extras := uint32(1)<<n - maxCode - 1
+	code := bs.readBits(n - 1)
+	if code >= extras {
+		code = code<<1 - extras + bs.readBit()
+	}
+	return code
+}
+
+type wavpackEntropy struct {
+	median     [3]uint32
+	slowLevel  uint32
+	errorLimit uint32
+}
+
+func (c *wavpackEntropy) getMedian(i int) uint32 {
+	return c.median[i]>>4 + 1
+}
+
+// adjustMedian moves a running median up or down, the higher medians adapt
+// faster
+func (c *wavpackEntropy) adjustMedian(i int, up bool) {
+	div := uint32(128) >> i
+	if up {
+		c.median[i] += (c.median[i] + div) / div * 5
+	} else {
+		c.median[i] -= (c.median[i] + div - 2) / div * 2
+	}
+}
+
+// wavpackWords is the state of the entropy decoder over one block
+type wavpackWords struct {
+	c [2]wavpackEntropy
+
+	bitrateDelta [2]uint32
+	bitrateAcc   [2]uint32
+
+	holdingOne  uint32
+	holdingZero uint32
+	zerosAcc    uint32
+}
+
+// updateErrorLimit sets the quantisation of the next samples from the
+// hybrid bitrate
+func (w *wavpackWords) updateErrorLimit(flags uint32) {
+	w.bitrateAcc[0] += w.bitrateDelta[0]
+	bitrate0 := int32(w.bitrateAcc[0] >> 16)
+
+	if flags&WAVPACK_FLAG_MONO_DATA != 0 {
+		if flags&WAVPACK_FLAG_HYBRID_BITRATE != 0 {
+			slowLog0 := int32((w.c[0].slowLevel + WAVPACK_SLOW_ROUND) >> WAVPACK_SLOW_SHIFT)
+			w.c[0].errorLimit = wavpackErrorLimit(slowLog0, bitrate0)
+		} else {
+			w.c[0].errorLimit = uint32(wavpackExp2(bitrate0))
+		}
+		return
+	}
+
+	w.bitrateAcc[1] += w.bitrateDelta[1]
+	bitrate1 := int32(w.bitrateAcc[1] >> 16)
+
+	if flags&WAVPACK_FLAG_HYBRID_BITRATE == 0 {
+		w.c[0].errorLimit = uint32(wavpackExp2(bitrate0))
+		w.c[1].errorLimit = uint32(wavpackExp2(bitrate1))
+		return
+	}
+
+	slowLog0 := int32((w.c[0].slowLevel + WAVPACK_SLOW_ROUND) >> WAVPACK_SLOW_SHIFT)
+	slowLog1 := int32((w.c[1].slowLevel + WAVPACK_SLOW_ROUND) >> WAVPACK_SLOW_SHIFT)
+
+	if flags&WAVPACK_FLAG_HYBRID_BALANCE != 0 {
+		balance := (slowLog1 - slowLog0 + bitrate1 + 1) >> 1
+		switch {
+		case balance > bitrate0:
+			bitrate1 = bitrate0 * 2
+			bitrate0 = 0
+		case -balance > bitrate0:
+			bitrate0 = bitrate0 * 2
+			bitrate1 = 0
+		default:
+			bitrate1 = bitrate0 + balance
+			bitrate0 = bitrate0 - balance
+		}
+	}
+
+	w.c[0].errorLimit = wavpackErrorLimit(slowLog0, bitrate0)
+	w.c[1].errorLimit = wavpackErrorLimit(slowLog1, bitrate1)
+}
+
+func wavpackErrorLimit(slowLog int32, bitrate int32) uint32 {
+	if slowLog-bitrate > -0x100 {
+		return uint32(wavpackExp2(slowLog - bitrate + 0x100))
+	}
+	return 0
+}
+
+// getWord decodes the next residual of channel ch, returning false if the
+// bit stream is damaged
+func (w *wavpackWords) getWord(bs *wavpackBits, ch int, flags uint32) (int32, bool) {
+	c := &w.c[ch]
+
+	// with all medians near zero the encoder switches to coding runs of zeros
+	if w.c[0].median[0]&^1 == 0 && w.holdingZero == 0 && w.holdingOne == 0 && w.c[1].median[0]&^1 == 0 {
+		if w.zerosAcc > 0 {
+			w.zerosAcc--
+			if w.zerosAcc > 0 {
+				c.slowLevel -= (c.slowLevel + WAVPACK_SLOW_ROUND) >> WAVPACK_SLOW_SHIFT
+				return 0, true
+			}
+		} else {
+			count, ok := bs.readCount()
+			if !ok {
+				return 0, false
+			}
+			w.zerosAcc = count
+			if w.zerosAcc > 0 {
+				c.slowLevel -= (c.slowLevel + WAVPACK_SLOW_ROUND) >> WAVPACK_SLOW_SHIFT
+				w.c[0].median = [3]uint32{}
+				w.c[1].median = [3]uint32{}
+				return 0, true
+			}
+		}
+	}
+
+	var ones uint32
+	if w.holdingZero != 0 {
+		w.holdingZero = 0
+	} else {
+		for ones < WAVPACK_LIMIT_ONES+1 && bs.readBit() == 1 {
+			ones++
+		}
+		if ones == WAVPACK_LIMIT_ONES+1 {
+			return 0, false
+		}
+		if ones == WAVPACK_LIMIT_ONES {
+			count, ok := bs.readCount()
+			if !ok {
+				return 0, false
+			}
+			ones = count + WAVPACK_LIMIT_ONES
+		}
+
+		// the low bit of the count carries over to the next word
+		if w.holdingOne != 0 {
+			w.holdingOne = ones & 1
+			ones = ones>>1 + 1
+		} else {
+			w.holdingOne = ones & 1
+			ones >>= 1
+		}
+		w.holdingZero = ^w.holdingOne & 1
+	}
+
+	if flags&WAVPACK_FLAG_HYBRID != 0 && ch == 0 {
+		w.updateErrorLimit(flags)
+	}
+
+	var low, high uint32
+	switch {
+	case ones == 0:
+		high = c.getMedian(0) - 1
+		c.adjustMedian(0, false)
+	case ones == 1:
+		low = c.getMedian(0)
+		c.adjustMedian(0, true)
+		high = low + c.getMedian(1) - 1
+		c.adjustMedian(1, false)
+	default:
+		low = c.getMedian(0)
+		c.adjustMedian(0, true)
+		low += c.getMedian(1)
+		c.adjustMedian(1, true)
+		if ones == 2 {
+			high = low + c.getMedian(2) - 1
+			c.adjustMedian(2, false)
+		} else {
+			low += (ones - 2) * c.getMedian(2)
+			high = low + c.getMedian(2) - 1
+			c.adjustMedian(2, true)
+		}
+	}
+
+	low &= 0x7FFFFFFF
+	high &= 0x7FFFFFFF
+	if low > high {
+		high = low
+	}
+
+	mid := (high + low + 1) >> 1
+	if c.errorLimit == 0 {
+		mid = bs.readCode(high-low) + low
+	} else {
+		// lossy blocks only narrow the range down to the error limit
+		for high-low > c.errorLimit {
+			if bs.readBit() == 1 {
+				low = mid
+			} else {
+				high = mid - 1
+			}
+			mid = (high + low + 1) >> 1
+		}
+	}
+
+	sign := bs.readBit()
+
+	if flags&WAVPACK_FLAG_HYBRID_BITRATE != 0 {
+		c.slowLevel -= (c.slowLevel + WAVPACK_SLOW_ROUND) >> WAVPACK_SLOW_SHIFT
+		c.slowLevel += uint32(wavpackLog2(mid))
+	}
+
+	if sign == 1 {
+		return int32(^mid), true
+	}
+	return int32(mid), true
+}
+
+type wavpackDecorrPass struct {
+	term  int
+	delta int32
+
+	weightA  int32
+	weightB  int32
+	samplesA [WAVPACK_MAX_TERM]int32
+	samplesB [WAVPACK_MAX_TERM]int32
+}
+
+func wavpackApplyWeight(weight int32, sample int32) int32 {
+	if sample != int32(int16(sample)) {
+		// split so the product fits in 32 bits
+		return ((((sample & 0xFFFF) * weight) >> 9) + (((sample &^ 0xFFFF) >> 9) * weight) + 1) >> 1
+	}
+	return (weight*sample + 512) >> 10
+}
+
+func wavpackUpdateWeight(weight *int32, delta int32, source int32, result int32) {
+	if source != 0 && result != 0 {
+		s := (source ^ result) >> 31
+		*weight = (delta ^ s) + (*weight - s)
+	}
+}
+
+// wavpackUpdateWeightClip is the update of the cross channel terms, whose
+// weights are limited to +-1.0
+func wavpackUpdateWeightClip(weight *int32, delta int32, source int32, result int32) {
+	if source != 0 && result != 0 {
+		s := (source ^ result) >> 31
+		w := (*weight ^ s) + (delta - s)
+		if w > 1024 {
+			w = 1024
+		}
+		*weight = (w ^ s) - s
+	}
+}
+
+func (dpp *wavpackDecorrPass) mono(buf []int32) {
+	switch dpp.term {
+	case 17, 18:
+		for i, v := range buf {
+			var sam int32
+			if dpp.term == 17 {
+				sam = 2*dpp.samplesA[0] - dpp.samplesA[1]
+			} else {
+				sam = (3*dpp.samplesA[0] - dpp.samplesA[1]) >> 1
+			}
+			dpp.samplesA[1] = dpp.samplesA[0]
+			dpp.samplesA[0] = wavpackApplyWeight(dpp.weightA, sam) + v
+			wavpackUpdateWeight(&dpp.weightA, dpp.delta, sam, v)
+			buf[i] = dpp.samplesA[0]
+		}
+	default:
+		m, k := 0, dpp.term&(WAVPACK_MAX_TERM-1)
+		for i, v := range buf {
+			sam := dpp.samplesA[m]
+			dpp.samplesA[k] = wavpackApplyWeight(dpp.weightA, sam) + v
+			wavpackUpdateWeight(&dpp.weightA, dpp.delta, sam, v)
+			buf[i] = dpp.samplesA[k]
+			m = (m + 1) & (WAVPACK_MAX_TERM - 1)
+			k = (k + 1) & (WAVPACK_MAX_TERM - 1)
+		}
+	}
+}
+
+func (dpp *wavpackDecorrPass) stereo(buf []int32) {
+	switch dpp.term {
+	case 17, 18:
+		for i := 0; i+1 < len(buf); i += 2 {
+			var samA, samB int32
+			if dpp.term == 17 {
+				samA = 2*dpp.samplesA[0] - dpp.samplesA[1]
+				samB = 2*dpp.samplesB[0] - dpp.samplesB[1]
+			} else {
+				samA = (3*dpp.samplesA[0] - dpp.samplesA[1]) >> 1
+				samB = (3*dpp.samplesB[0] - dpp.samplesB[1]) >> 1
+			}
+
+			dpp.samplesA[1] = dpp.samplesA[0]
+			dpp.samplesA[0] = wavpackApplyWeight(dpp.weightA, samA) + buf[i]
+			wavpackUpdateWeight(&dpp.weightA, dpp.delta, samA, buf[i])
+			buf[i] = dpp.samplesA[0]
+
+			dpp.samplesB[1] = dpp.samplesB[0]
+			dpp.samplesB[0] = wavpackApplyWeight(dpp.weightB, samB) + buf[i+1]
+			wavpackUpdateWeight(&dpp.weightB, dpp.delta, samB, buf[i+1])
+			buf[i+1] = dpp.samplesB[0]
+		}
+	case -1:
+		for i := 0; i+1 < len(buf); i += 2 {
+			samA := buf[i] + wavpackApplyWeight(dpp.weightA, dpp.samplesA[0])
+			wavpackUpdateWeightClip(&dpp.weightA, dpp.delta, dpp.samplesA[0], buf[i])
+			buf[i] = samA
+			dpp.samplesA[0] = buf[i+1] + wavpackApplyWeight(dpp.weightB, samA)
+			wavpackUpdateWeightClip(&dpp.weightB, dpp.delta, samA, buf[i+1])
+			buf[i+1] = dpp.samplesA[0]
+		}
+	case -2:
+		for i := 0; i+1 < len(buf); i += 2 {
+			samB := buf[i+1] + wavpackApplyWeight(dpp.weightB, dpp.samplesB[0])
+			wavpackUpdateWeightClip(&dpp.weightB, dpp.delta, dpp.samplesB[0], buf[i+1])
+			buf[i+1] = samB
+			dpp.samplesB[0] = buf[i] + wavpackApplyWeight(dpp.weightA, samB)
+			wavpackUpdateWeightClip(&dpp.weightA, dpp.delta, samB, buf[i])
+			buf[i] = dpp.samplesB[0]
+		}
+	case -3:
+		for i := 0; i+1 < len(buf); i += 2 {
+			samA := buf[i] + wavpackApplyWeight(dpp.weightA, dpp.samplesA[0])
+			wavpackUpdateWeightClip(&dpp.weightA, dpp.delta, dpp.samplesA[0], buf[i])
+			samB := buf[i+1] + wavpackApplyWeight(dpp.weightB, dpp.samplesB[0])
+			wavpackUpdateWeightClip(&dpp.weightB, dpp.delta, dpp.samplesB[0], buf[i+1])
+			buf[i], dpp.samplesB[0] = samA, samA
+			buf[i+1], dpp.samplesA[0] = samB, samB
+		}
+	default:
+		m, k := 0, dpp.term&(WAVPACK_MAX_TERM-1)
+		for i := 0; i+1 < len(buf); i += 2 {
+			sam := dpp.samplesA[m]
+			dpp.samplesA[k] = wavpackApplyWeight(dpp.weightA, sam) + buf[i]
+			wavpackUpdateWeight(&dpp.weightA, dpp.delta, sam, buf[i])
+			buf[i] = dpp.samplesA[k]
+
+			sam = dpp.samplesB[m]
+			dpp.samplesB[k] = wavpackApplyWeight(dpp.weightB, sam) + buf[i+1]
+			wavpackUpdateWeight(&dpp.weightB, dpp.delta, sam, buf[i+1])
+			buf[i+1] = dpp.samplesB[k]
+
+			m = (m + 1) & (WAVPACK_MAX_TERM - 1)
+			k = (k + 1) & (WAVPACK_MAX_TERM - 1)
+		}
+	}
+}
+
+// wavpackBlock is everything needed to unpack the audio of one block, which
+// holds one or two channels
+type wavpackBlock struct {
+	header *wavpackBlockHeader
+	flags  uint32
+
+	// decorrelation passes in the order they were stored, they are undone
+	// last to first
+	passes []wavpackDecorrPass
+	words  wavpackWords
+
+	bits       *wavpackBits
+	extraBits  *wavpackBits // extended precision stream for floats and 32-bit integers
+	hasEntropy bool
+
+	int32SentBits uint
+	int32Zeros    uint
+	int32Ones     uint
+	int32Dups     uint
+
+	floatFlags   byte
+	floatShift   uint
+	floatMaxExp  int
+	floatNormExp int
+
+	// only set when the block carries them
+	sampleRate int
+	channels   int
+}
+
+func (blk *wavpackBlock) monoData() bool {
+	return blk.flags&WAVPACK_FLAG_MONO_DATA != 0
+}
+
+// parseWavPackBlock reads the metadata sub-blocks that follow a block header
+func parseWavPackBlock(h *wavpackBlockHeader, body []byte) (*wavpackBlock, error) {
+	blk := &wavpackBlock{header: h, flags: h.flags}
+	for len(body) >= 2 {
+		id := body[0]
+		size := int(body[1]) * 2
+		start := 2
+		if id&WAVPACK_ID_LARGE != 0 {
+			if len(body) < 4 {
+				return nil, errWavPackInvalid
+			}
+			size = (int(body[1]) | int(body[2])<<8 | int(body[3])<<16) * 2
+			start = 4
+		}
+		if start+size > len(body) {
+			return nil, errWavPackInvalid
+		}
+
+		data := body[start : start+size]
+		if id&WAVPACK_ID_ODD_SIZE != 0 && size > 0 {
+			data = data[:size-1]
+		}
+		body = body[start+size:]
+
+		if err := blk.readSubBlock(id&WAVPACK_ID_UNIQUE, data); err != nil {
+			return nil, err
+		}
+	}
+	return blk, nil
+}
+
+func (blk *wavpackBlock) readSubBlock(id byte, data []byte) error {
+	mono := blk.monoData()
+
+	switch id {
+	case WAVPACK_ID_DECORR_TERMS:
+		if len(data) > WAVPACK_MAX_TERMS {
+			return errWavPackInvalid
+		}
+		blk.passes = make([]wavpackDecorrPass, len(data))
+		for i, b := range data {
+			term := int(b&0x1F) - 5
+			if term == 0 || term < -3 || (term > WAVPACK_MAX_TERM && term < 17) || term > 18 || (mono && term < 0) {
+				return errWavPackInvalid
+			}
+			blk.passes[i].term = term
+			blk.passes[i].delta = int32(b>>5) & 0x7
+		}
+
+	case WAVPACK_ID_DECORR_WEIGHTS:
+		perTerm := 2
+		if mono {
+			perTerm = 1
+		}
+		if len(data)/perTerm > len(blk.passes) {
+			return errWavPackInvalid
+		}
+		for i := 0; i < len(data)/perTerm; i++ {
+			blk.passes[i].weightA = wavpackRestoreWeight(int8(data[i*perTerm]))
+			if !mono {
+				blk.passes[i].weightB = wavpackRestoreWeight(int8(data[i*perTerm+1]))
+			}
+		}
+
+	case WAVPACK_ID_DECORR_SAMPLES:
+		r := &wavpackLogReader{data: data}
+		if blk.header.version == WAVPACK_MIN_VERSION && blk.flags&WAVPACK_FLAG_HYBRID != 0 {
+			r.skip(1)
+			if !mono {
+				r.skip(1)
+			}
+		}
+
+		for i := range blk.passes {
+			if len(r.data) == 0 {
+				break
+			}
+			dpp := &blk.passes[i]
+			switch {
+			case dpp.term > WAVPACK_MAX_TERM:
+				dpp.samplesA[0], dpp.samplesA[1] = r.next(), r.next()
+				if !mono {
+					dpp.samplesB[0], dpp.samplesB[1] = r.next(), r.next()
+				}
+			case dpp.term < 0:
+				dpp.samplesA[0], dpp.samplesB[0] = r.next(), r.next()
+			default:
+				for m := 0; m < dpp.term; m++ {
+					dpp.samplesA[m] = r.next()
+					if !mono {
+						dpp.samplesB[m] = r.next()
+					}
+				}
+			}
+		}
+		if r.overrun {
+			return errWavPackInvalid
+		}
+
+	case WAVPACK_ID_ENTROPY_VARS:
+		r := &wavpackLogReader{data: data}
+		for ch := 0; ch < 2 && !(mono && ch == 1); ch++ {
+			for i := range blk.words.c[ch].median {
+				blk.words.c[ch].median[i] = uint32(wavpackExp2(int32(r.word())))
+			}
+		}
+		if r.overrun {
+			return errWavPackInvalid
+		}
+		blk.hasEntropy = true
+
+	case WAVPACK_ID_HYBRID_PROFILE:
+		blk.readHybridProfile(data)
+
+	case WAVPACK_ID_INT32_INFO:
+		if len(data) < 4 {
+			return errWavPackInvalid
+		}
+		blk.int32SentBits = uint(data[0])
+		blk.int32Zeros = uint(data[1])
+		blk.int32Ones = uint(data[2])
+		blk.int32Dups = uint(data[3])
+		if blk.int32SentBits+blk.int32Zeros+blk.int32Ones+blk.int32Dups > 32 {
+			return errWavPackInvalid
+		}
+
+	case WAVPACK_ID_FLOAT_INFO:
+		if len(data) < 4 {
+			return errWavPackInvalid
+		}
+		blk.floatFlags = data[0]
+		blk.floatShift = uint(data[1])
+		blk.floatMaxExp = int(data[2])
+		blk.floatNormExp = int(data[3])
+
+	case WAVPACK_ID_WV_BITSTREAM:
+		blk.bits = &wavpackBits{data: data}
+
+	case WAVPACK_ID_WVX_BITSTREAM:
+		// a CRC of the extended values precedes the bits
+		if len(data) > 4 {
+			blk.extraBits = &wavpackBits{data: data[4:]}
+		}
+
+	case WAVPACK_ID_CHANNEL_INFO:
+		switch {
+		case len(data) == 6:
+			blk.channels = int(data[0]) + 1 + int(data[2]&0xF)<<8
+		case len(data) > 0:
+			blk.channels = int(data[0])
+		}
+
+	case WAVPACK_ID_SAMPLE_RATE:
+		if len(data) >= 3 {
+			blk.sampleRate = int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+			if len(data) >= 4 {
+				blk.sampleRate |= int(data[3]&0x7F) << 24
+			}
+		}
+	}
+	return nil
+}
+
+func (blk *wavpackBlock) readHybridProfile(data []byte) {
+	mono := blk.monoData()
+	r := &wavpackLogReader{data: data}
+
+	if blk.flags&WAVPACK_FLAG_HYBRID_BITRATE != 0 {
+		blk.words.c[0].slowLevel = uint32(wavpackExp2(int32(r.word())))
+		if !mono {
+			blk.words.c[1].slowLevel = uint32(wavpackExp2(int32(r.word())))
+		}
+	}
+
+	blk.words.bitrateAcc[0] = r.word() << 16
+	if !mono {
+		blk.words.bitrateAcc[1] = r.word() << 16
+	}
+
+	if len(r.data) > 0 {
+		blk.words.bitrateDelta[0] = uint32(r.next())
+		if !mono {
+			blk.words.bitrateDelta[1] = uint32(r.next())
+		}
+	}
+}
+
+// wavpackRestoreWeight expands a decorrelation weight stored in a byte
+func wavpackRestoreWeight(weight int8) int32 {
+	result := int32(weight) << 3
+	if result > 0 {
+		result += (result + 64) >> 7
+	}
+	return result
+}
+
+// wavpackLogReader reads the 16-bit log values that seed a block's state
+type wavpackLogReader struct {
+	data    []byte
+	overrun bool
+}
+
+func (r *wavpackLogReader) word() uint32 {
+	if len(r.data) < 2 {
+		r.overrun = true
+		r.data = nil
+		return 0
+	}
+	v := uint32(binary.LittleEndian.Uint16(r.data))
+	r.data = r.data[2:]
+	return v
+}
+
+func (r *wavpackLogReader) skip(words int) {
+	for ; words > 0; words-- {
+		r.word()
+	}
+}
+
+// next reads a signed log and converts it to a linear value
+func (r *wavpackLogReader) next() int32 {
+	return wavpackExp2(int32(int16(r.word())))
+}
+
+// unpack decodes the block's samples, interleaved when it holds two
+// channels. Float data is returned as IEEE bit patterns.
+func (blk *wavpackBlock) unpack() ([]int32, error) {
+	if blk.bits == nil || !blk.hasEntropy {
+		return nil, errWavPackInvalid
+	}
+
+	frames := int(blk.header.blockSamples)
+	channels := 2
+	if blk.monoData() {
+		channels = 1
+	}
+
+	buf := make([]int32, frames*channels)
+	for i := range buf {
+		v, ok := blk.words.getWord(blk.bits, i%channels, blk.flags)
+		if !ok || blk.bits.overrun {
+			return nil, errWavPackInvalid
+		}
+		buf[i] = v
+	}
+
+	for i := len(blk.passes) - 1; i >= 0; i-- {
+		if channels == 1 {
+			blk.passes[i].mono(buf)
+		} else {
+			blk.passes[i].stereo(buf)
+		}
+	}
+
+	if channels == 2 && blk.flags&WAVPACK_FLAG_JOINT_STEREO != 0 {
+		for i := 0; i+1 < len(buf); i += 2 {
+			buf[i+1] -= buf[i] >> 1
+			buf[i] += buf[i+1]
+		}
+	}
+
+	crc := uint32(0xFFFFFFFF)
+	for _, v := range buf {
+		crc = crc*3 + uint32(v)
+	}
+	if crc != blk.header.crc {
+		return nil, ErrWavPackCRC
+	}
+
+	if blk.flags&WAVPACK_FLAG_FLOAT != 0 {
+		blk.floatValues(buf)
+	} else {
+		blk.fixupIntegers(buf)
+	}
+	return buf, nil
+}
+
+// fixupIntegers restores the low bits that were shifted out before coding
+func (blk *wavpackBlock) fixupIntegers(buf []int32) {
+	lossy := blk.flags&WAVPACK_FLAG_HYBRID != 0
+	shift := uint(blk.flags&WAVPACK_SHIFT_MASK) >> WAVPACK_SHIFT_LSB
+
+	if blk.flags&WAVPACK_FLAG_INT32 != 0 {
+		sent, zeros, ones, dups := blk.int32SentBits, blk.int32Zeros, blk.int32Ones, blk.int32Dups
+		switch {
+		case blk.extraBits != nil:
+			for i, v := range buf {
+				v = v<<sent | int32(blk.extraBits.readBits(int(sent)))
+				buf[i] = wavpackRestoreLowBits(v, zeros, ones, dups)
+			}
+		case sent == 0 && zeros+ones+dups > 0:
+			// lossy 32-bit samples move what they can of the low bits
+			// into the shift so that clipping sees them
+			for lossy && blk.flags&WAVPACK_FLAG_BYTES_STORED == 3 && shift < 8 && zeros+ones+dups > 0 {
+				switch {
+				case zeros > 0:
+					zeros--
+				case ones > 0:
+					ones--
+				default:
+					dups--
+				}
+				shift++
+			}
+			for i, v := range buf {
+				buf[i] = wavpackRestoreLowBits(v, zeros, ones, dups)
+			}
+		default:
+			shift += zeros + sent + ones + dups
+		}
+	}
+
+	if lossy {
+		// lossy values can overshoot, clip them to the stored width
+		width := uint(blk.flags&WAVPACK_FLAG_BYTES_STORED+1) * 8
+		minValue := int32(-1) << (width - 1) >> shift
+		maxValue := int32(uint32(1)<<(width-1)-1) >> shift
+		for i, v := range buf {
+			switch {
+			case v < minValue:
+				buf[i] = minValue << shift
+			case v > maxValue:
+				buf[i] = maxValue << shift
+			default:
+				buf[i] = v << shift
+			}
+		}
+	} else if shift > 0 {
+		for i := range buf {
+			buf[i] <<= shift
+		}
+	}
+}
+
+// wavpackRestoreLowBits puts back the constant low bits of 32-bit samples
+func wavpackRestoreLowBits(v int32, zeros uint, ones uint, dups uint) int32 {
+	switch {
+	case zeros > 0:
+		return v << zeros
+	case ones > 0:
+		return (v+1)<<ones - 1
+	case dups > 0:
+		return (v+v&1)<<dups - v&1
+	}
+	return v
+}
+
+// floatValues rebuilds floats from the integers the encoder reduced them to
+func (blk *wavpackBlock) floatValues(buf []int32) {
+	extra := blk.extraBits
+	for i, v := range buf {
+		exp := blk.floatMaxExp
+		var out uint32
+
+		if v == 0 {
+			if extra != nil && blk.floatFlags&WAVPACK_FLOAT_ZEROS_SENT != 0 {
+				if extra.readBit() == 1 {
+					out = extra.readBits(23)
+					if exp >= 25 {
+						out |= extra.readBits(8) << 23
+					}
+					out |= extra.readBit() << 31
+				} else if blk.floatFlags&WAVPACK_FLOAT_NEG_ZEROS != 0 {
+					out = extra.readBit() << 31
+				}
+			}
+			buf[i] = int32(out)
+			continue
+		}
+
+		v <<= blk.floatShift
+		if v < 0 {
+			v = -v
+			out = 1 << 31
+		}
+
+		switch {
+		case extra != nil && v == 0x1000000:
+			// infinities and NaNs
+			if extra.readBit() == 1 {
+				out |= extra.readBits(23)
+			}
+			out |= 0xFF << 23
+		case extra == nil && v >= 0x1000000:
+			for v&0xF000000 != 0 {
+				v >>= 1
+				exp++
+			}
+			out |= uint32(v)&0x7FFFFF | uint32(exp&0xFF)<<23
+		default:
+			shifted := 0
+			if exp > 0 {
+				for v&0x800000 == 0 {
+					exp--
+					if exp == 0 {
+						break
+					}
+					shifted++
+					v <<= 1
+				}
+			}
+
+			if shifted > 0 {
+				mask := int32(1)<<shifted - 1
+				switch {
+				case blk.floatFlags&WAVPACK_FLOAT_SHIFT_ONES != 0:
+					v |= mask
+				case extra == nil:
+				case blk.floatFlags&WAVPACK_FLOAT_SHIFT_SAME != 0:
+					if extra.readBit() == 1 {
+						v |= mask
+					}
+				case blk.floatFlags&WAVPACK_FLOAT_SHIFT_SENT != 0:
+					v |= int32(extra.readBits(shifted)) & mask
+				}
+			}
+			out |= uint32(v)&0x7FFFFF | uint32(exp&0xFF)<<23
+		}
+		buf[i] = int32(out)
+	}
+}
+
+type wavpackDecoder struct {
+	file *os.File
+
+	format     PCMWaveFormat
+	scale      float64
+	audioStart int64
+	audioEnd   int64
+	firstIndex int64
+	frames     int64
+
+	offset int64 // of the next block to decode
+
+	meta Metadata
+}
+
+func openWavPack(path string) (*wavpackDecoder, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := &wavpackDecoder{file: file}
+	err = dec.readHeader(path)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return dec, nil
+}
+
+func (dec *wavpackDecoder) readHeader(path string) error {
+	info, err := dec.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	dec.meta = *NewMetadata()
+	dec.meta.Filepath = path
+
+	tag, tagStart, err := readAPETag(dec.file, info.Size())
+	if err != nil {
+		return err
+	}
+	dec.audioEnd = tagStart
+	if tag != nil {
+		tag.apply(&dec.meta)
+	} else if tag, err := readID3v1(dec.file); err == nil && tag != nil {
+		tag.apply(&dec.meta)
+	}
+
+	// skip over anything ahead of the first block, such as an ID3v2 tag
+	h, offset, err := dec.findBlock(0)
+	if err != nil || offset > WAVPACK_SEARCH_LIMIT {
+		return ErrNotWavPack
+	}
+	dec.audioStart = offset
+	dec.firstIndex = h.blockIndex
+	dec.frames = h.totalSamples
+
+	// the format comes from the first block that holds audio
+	for h.blockSamples == 0 || h.flags&WAVPACK_FLAG_INITIAL_BLOCK == 0 {
+		h, offset, err = dec.findBlock(offset + h.size)
+		if err != nil {
+			return ErrNotWavPack
+		}
+	}
+	body, err := dec.readBlockBody(h, offset)
+	if err != nil {
+		return err
+	}
+	blk, err := parseWavPackBlock(h, body)
+	if err != nil {
+		return err
+	}
+	if err := dec.parseFormat(blk); err != nil {
+		return err
+	}
+
+	if dec.frames < 0 {
+		dec.frames = dec.countFrames()
+	}
+	dec.meta.Duration = uint64(dec.frames * SECOND / int64(dec.format.SampleRate))
+
+	return dec.seek(0)
+}
+
+func (dec *wavpackDecoder) parseFormat(blk *wavpackBlock) error {
+	flags := blk.flags
+	if flags&WAVPACK_FLAG_DSD != 0 {
+		return ErrUnsupportedFormat
+	}
+
+	channels := blk.channels
+	if channels == 0 {
+		channels = 2
+		if flags&WAVPACK_FLAG_MONO != 0 {
+			channels = 1
+		}
+	}
+
+	rate := blk.sampleRate
+	if index := (flags & WAVPACK_SRATE_MASK) >> WAVPACK_SRATE_LSB; index != WAVPACK_SRATE_CUSTOM {
+		rate = wavpackSampleRates[index]
+	}
+	if rate <= 0 {
+		return ErrNotWavPack
+	}
+
+	dec.format = PCMWaveFormat{
+		NumChannels: uint16(channels),
+		SampleRate:  uint32(rate),
+		SampleDepth: uint16(flags&WAVPACK_FLAG_BYTES_STORED+1) * 8,
+		PCMType:     PCM_TYPE_INT,
+	}
+	dec.scale = 1 / float64(int64(1)<<(dec.format.SampleDepth-1))
+
+	if flags&WAVPACK_FLAG_FLOAT != 0 {
+		dec.format.SampleDepth = 32
+		dec.format.PCMType = PCM_TYPE_FLOAT
+		// full scale is wherever the encoder says the exponent of 1.0 was
+		dec.scale = math.Ldexp(1, 127-blk.floatNormExp)
+		if blk.floatNormExp == 0 {
+			dec.scale = 1
+		}
+	}
+
+	if !isSupportedFormat(&dec.format) {
+		return ErrUnsupportedFormat
+	}
+	return nil
+}
+
+// countFrames walks the block headers to the end of the stream for files
+// that were written without a total
+func (dec *wavpackDecoder) countFrames() int64 {
+	var frames int64
+	offset := dec.audioStart
+	for {
+		h, at, err := dec.findBlock(offset)
+		if err != nil {
+			return frames
+		}
+		frames = max(frames, h.blockIndex-dec.firstIndex+h.blockSamples)
+		offset = at + h.size
+	}
+}
+
+// findBlock returns the first valid block header at or after offset,
+// returning io.EOF if there is none before the end of the audio
+func (dec *wavpackDecoder) findBlock(offset int64) (*wavpackBlockHeader, int64, error) {
+	// blocks normally follow on directly from each other
+	buf := make([]byte, WAVPACK_HEADER_SIZE)
+	if offset+WAVPACK_HEADER_SIZE <= dec.audioEnd {
+		if _, err := dec.file.ReadAt(buf, offset); err == nil {
+			h, err := parseWavPackBlockHeader(buf)
+			if err == nil && offset+h.size <= dec.audioEnd {
+				return h, offset, nil
+			}
+		}
+	}
+
+	buf = make([]byte, WAVPACK_SCAN_SIZE)
+	for offset+WAVPACK_HEADER_SIZE <= dec.audioEnd {
+		n, err := dec.file.ReadAt(buf[:min(int64(len(buf)), dec.audioEnd-offset)], offset)
+		if err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+		data := buf[:n]
+
+		for pos := 0; pos+WAVPACK_HEADER_SIZE <= len(data); pos++ {
+			idx := bytes.Index(data[pos:], []byte("wvpk"))
+			if idx < 0 {
+				break
+			}
+			pos += idx
+			if pos+WAVPACK_HEADER_SIZE > len(data) {
+				break
+			}
+
+			h, err := parseWavPackBlockHeader(data[pos:])
+			if err == nil && offset+int64(pos)+h.size <= dec.audioEnd {
+				return h, offset + int64(pos), nil
+			}
+		}
+
+		if n < WAVPACK_HEADER_SIZE {
+			break
+		}
+		// overlap the next read so headers across the boundary are seen
+		offset += int64(n - WAVPACK_HEADER_SIZE + 1)
+	}
+	return nil, 0, io.EOF
+}
+
+func (dec *wavpackDecoder) readBlockBody(h *wavpackBlockHeader, offset int64) ([]byte, error) {
+	body := make([]byte, h.size-WAVPACK_HEADER_SIZE)
+	if _, err := dec.file.ReadAt(body, offset+WAVPACK_HEADER_SIZE); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// nextBlock reads the block at the decode position and moves past it
+func (dec *wavpackDecoder) nextBlock() (*wavpackBlock, error) {
+	h, offset, err := dec.findBlock(dec.offset)
+	if err != nil {
+		dec.offset = dec.audioEnd
+		return nil, err
+	}
+	dec.offset = offset + h.size
+
+	body, err := dec.readBlockBody(h, offset)
+	if err != nil {
+		return nil, err
+	}
+	return parseWavPackBlock(h, body)
+}
+
+func (dec *wavpackDecoder) nativeFormat() *PCMWaveFormat {
+	format := dec.format
+	return &format
+}
+
+func (dec *wavpackDecoder) metadata() Metadata {
+	return dec.meta
+}
+
+func (dec *wavpackDecoder) close() error {
+	return dec.file.Close()
+}
+
+func (dec *wavpackDecoder) decode() ([]float64, int64, error) {
+	// a frame starts at an initial block, anything else is left over from a
+	// damaged frame
+	var blk *wavpackBlock
+	for blk == nil || blk.header.blockSamples == 0 || blk.flags&WAVPACK_FLAG_INITIAL_BLOCK == 0 {
+		var err error
+		blk, err = dec.nextBlock()
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	index := blk.header.blockIndex
+	frames := int(blk.header.blockSamples)
+	channels := int(dec.format.NumChannels)
+	samples := make([]float64, frames*channels)
+
+	// each block of the frame adds one or two channels
+	for ch := 0; ; {
+		if blk.header.blockIndex != index || int(blk.header.blockSamples) != frames {
+			return nil, 0, errWavPackInvalid
+		}
+		buf, err := blk.unpack()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		width := 2
+		if blk.flags&WAVPACK_FLAG_MONO != 0 {
+			width = 1
+		}
+		for c := 0; c < width && ch+c < channels; c++ {
+			for i := 0; i < frames; i++ {
+				v := buf[i]
+				if !blk.monoData() {
+					v = buf[i*2+c]
+				}
+				if dec.format.PCMType == PCM_TYPE_FLOAT {
+					samples[i*channels+ch+c] = float64(math.Float32frombits(uint32(v))) * dec.scale
+				} else {
+					samples[i*channels+ch+c] = float64(v) * dec.scale
+				}
+			}
+		}
+		ch += width
+
+		if blk.flags&WAVPACK_FLAG_FINAL_BLOCK != 0 {
+			break
+		}
+		blk, err = dec.nextBlock()
+		if err != nil {
+			return nil, 0, errWavPackInvalid
+		}
+	}
+
+	return samples, index - dec.firstIndex, nil
+}
+
+// seek walks the block headers to the frame holding the target, leaving the
+// rest to be discarded after decoding
+func (dec *wavpackDecoder) seek(frame int64) error {
+	offset := dec.audioStart
+	for frame > 0 {
+		h, at, err := dec.findBlock(offset)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		offset = at
+		if h.flags&WAVPACK_FLAG_INITIAL_BLOCK != 0 && h.blockIndex-dec.firstIndex+h.blockSamples > frame {
+			break
+		}
+		offset += h.size
+	}
+
+	dec.offset = offset
+	return nil
+}
+
+func createWavPackAudioSourceFromFile(metadata *Metadata) (AudioSource, error) {
+	dec, err := openWavPack(metadata.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDecodedSource(dec), nil
+}
+
+func getWavPackFileMetadata(path string) (*Metadata, error) {
+	dec, err := openWavPack(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.file.Close()
+
+	metadata := dec.metadata()
+	return &metadata, nil
+}
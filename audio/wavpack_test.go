@@ -0,0 +1,395 @@
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// wavpackWordEncoder is the lossless entropy coder getWord decodes, as the
+// reference encoder writes it
+type wavpackWordEncoder struct {
+	w *vorbisBitWriter
+	c [2]wavpackEntropy
+
+	holdingOne  uint32
+	holdingZero uint32
+	zerosAcc    uint32
+
+	// the bits of the word held back until the next one settles its count
+	pending     uint64
+	pendingBits int
+}
+
+func (e *wavpackWordEncoder) writeCount(v uint32) {
+	n := bits.Len32(v)
+	e.w.write(1<<n-1, n)
+	e.w.write(0, 1)
+	for ; v > 1; v >>= 1 {
+		e.w.write(uint64(v&1), 1)
+	}
+}
+
+func (e *wavpackWordEncoder) flush() {
+	if e.zerosAcc != 0 {
+		e.writeCount(e.zerosAcc)
+		e.zerosAcc = 0
+	}
+	if e.holdingOne != 0 {
+		if e.holdingOne >= WAVPACK_LIMIT_ONES {
+			e.w.write(1<<WAVPACK_LIMIT_ONES-1, WAVPACK_LIMIT_ONES+1)
+			e.writeCount(e.holdingOne - WAVPACK_LIMIT_ONES)
+			e.holdingZero = 0
+		} else {
+			e.w.write(1<<e.holdingOne-1, int(e.holdingOne))
+		}
+		e.holdingOne = 0
+	}
+	if e.holdingZero != 0 {
+		e.w.write(0, 1)
+		e.holdingZero = 0
+	}
+	e.w.write(e.pending, e.pendingBits)
+	e.pending, e.pendingBits = 0, 0
+}
+
+func (e *wavpackWordEncoder) hold(v uint64, n int) {
+	e.pending |= v << e.pendingBits
+	e.pendingBits += n
+}
+
+func (e *wavpackWordEncoder) send(value int32, ch int) {
+	if e.c[0].median[0] < 2 && e.holdingZero == 0 && e.c[1].median[0] < 2 {
+		switch {
+		case e.zerosAcc != 0 && value == 0:
+			e.zerosAcc++
+			return
+		case e.zerosAcc != 0:
+			e.flush()
+		case value != 0:
+			e.w.write(0, 1)
+		default:
+			e.c[0].median, e.c[1].median = [3]uint32{}, [3]uint32{}
+			e.zerosAcc = 1
+			return
+		}
+	}
+
+	sign, v := uint64(0), uint32(value)
+	if value < 0 {
+		sign, v = 1, ^v
+	}
+
+	c := &e.c[ch]
+	var ones, low, high uint32
+	if v < c.getMedian(0) {
+		high = c.getMedian(0) - 1
+		c.adjustMedian(0, false)
+	} else {
+		low = c.getMedian(0)
+		c.adjustMedian(0, true)
+		if v-low < c.getMedian(1) {
+			ones = 1
+			high = low + c.getMedian(1) - 1
+			c.adjustMedian(1, false)
+		} else {
+			low += c.getMedian(1)
+			c.adjustMedian(1, true)
+			if v-low < c.getMedian(2) {
+				ones = 2
+				high = low + c.getMedian(2) - 1
+				c.adjustMedian(2, false)
+			} else {
+				ones = 2 + (v-low)/c.getMedian(2)
+				low += (ones - 2) * c.getMedian(2)
+				high = low + c.getMedian(2) - 1
+				c.adjustMedian(2, true)
+			}
+		}
+	}
+
+	// the count of ones is shared out between this word and the next
+	if e.holdingZero != 0 {
+		if ones != 0 {
+			e.holdingOne++
+		}
+		e.flush()
+		if ones != 0 {
+			e.holdingZero = 1
+			ones--
+		} else {
+			e.holdingZero = 0
+		}
+	} else {
+		e.holdingZero = 1
+	}
+	e.holdingOne = ones * 2
+
+	if maxCode, code := high-low, v-low; maxCode != 0 {
+		n := bits.Len32(maxCode)
+		extras := uint32(1)<<n - maxCode - 1
+		if code < extras {
+			e.hold(uint64(code), n-1)
+		} else {
+			e.hold(uint64((code+extras)>>1), n-1)
+			e.hold(uint64((code+extras)&1), 1)
+		}
+	}
+	e.hold(sign, 1)
+	if e.holdingZero == 0 {
+		e.flush()
+	}
+}
+
+// testWavPackTerm is a decorrelation pass, starting from a zero history
+type testWavPackTerm struct {
+	term   int
+	delta  int32
+	weight int8
+}
+
+// wavpackMedianLogs seed the entropy coder of every block
+var wavpackMedianLogs = [3]uint16{0x600, 0x500, 0x400}
+
+// wavpackSubBlock wraps data as a metadata sub-block
+func wavpackSubBlock(id byte, data []byte) []byte {
+	if len(data)&1 != 0 {
+		data = append(data, 0)
+		id |= WAVPACK_ID_ODD_SIZE
+	}
+	if words := len(data) / 2; words > 255 {
+		return append([]byte{id | WAVPACK_ID_LARGE, byte(words), byte(words >> 8), byte(words >> 16)}, data...)
+	}
+	return append([]byte{id, byte(len(data) / 2)}, data...)
+}
+
+// wavpackBlockBytes codes one or two channels of samples, already shifted
+// down, as a block with the given flags and extra sub-blocks
+func wavpackBlockBytes(samples [][]int32, terms []testWavPackTerm, flags uint32, index, total int64, extra []byte) []byte {
+	n := len(samples[0])
+	if len(samples) == 1 {
+		flags |= WAVPACK_FLAG_MONO
+	}
+
+	// the CRC covers the samples as they come out of the decorrelation
+	crc := uint32(0xFFFFFFFF)
+	buf := make([][]int32, len(samples))
+	for c := range buf {
+		buf[c] = append([]int32(nil), samples[c]...)
+	}
+	for i := 0; i < n; i++ {
+		for c := range buf {
+			crc = crc*3 + uint32(buf[c][i])
+		}
+	}
+	if len(buf) == 2 && flags&WAVPACK_FLAG_JOINT_STEREO != 0 {
+		for i := 0; i < n; i++ {
+			side := buf[0][i] - buf[1][i]
+			buf[0][i], buf[1][i] = side, buf[1][i]+side>>1
+		}
+	}
+
+	var termBytes, weights []byte
+	for _, t := range terms {
+		termBytes = append(termBytes, byte(t.term+5)|byte(t.delta<<5))
+		for c := range buf {
+			weights = append(weights, byte(t.weight))
+			history := make([]int32, 2, n+2)
+			if t.term <= WAVPACK_MAX_TERM {
+				history = make([]int32, t.term, n+t.term)
+			}
+			weight := wavpackRestoreWeight(t.weight)
+			for i, x := range buf[c] {
+				h := len(history)
+				var sam int32
+				switch t.term {
+				case 17:
+					sam = 2*history[h-1] - history[h-2]
+				case 18:
+					sam = (3*history[h-1] - history[h-2]) >> 1
+				default:
+					sam = history[h-t.term]
+				}
+				residual := x - wavpackApplyWeight(weight, sam)
+				wavpackUpdateWeight(&weight, t.delta, sam, residual)
+				history = append(history, x)
+				buf[c][i] = residual
+			}
+		}
+	}
+
+	enc := &wavpackWordEncoder{w: &vorbisBitWriter{}}
+	var medians []byte
+	for c := range buf {
+		for i, log := range wavpackMedianLogs {
+			enc.c[c].median[i] = uint32(wavpackExp2(int32(log)))
+			medians = binary.LittleEndian.AppendUint16(medians, log)
+		}
+	}
+	for i := 0; i < n; i++ {
+		for c := range buf {
+			enc.send(buf[c][i], c)
+		}
+	}
+	enc.flush()
+
+	body := append([]byte(nil), extra...)
+	if len(terms) > 0 {
+		body = append(body, wavpackSubBlock(WAVPACK_ID_DECORR_TERMS, termBytes)...)
+		body = append(body, wavpackSubBlock(WAVPACK_ID_DECORR_WEIGHTS, weights)...)
+	}
+	body = append(body, wavpackSubBlock(WAVPACK_ID_ENTROPY_VARS, medians)...)
+	body = append(body, wavpackSubBlock(WAVPACK_ID_WV_BITSTREAM, enc.w.data)...)
+
+	h := make([]byte, WAVPACK_HEADER_SIZE)
+	copy(h, "wvpk")
+	binary.LittleEndian.PutUint32(h[4:], uint32(len(body)+WAVPACK_HEADER_SIZE-8))
+	binary.LittleEndian.PutUint16(h[8:], WAVPACK_MAX_VERSION)
+	binary.LittleEndian.PutUint32(h[12:], 0xFFFFFFFF)
+	if total >= 0 {
+		binary.LittleEndian.PutUint32(h[12:], uint32(total))
+	}
+	binary.LittleEndian.PutUint32(h[16:], uint32(index))
+	binary.LittleEndian.PutUint32(h[20:], uint32(n))
+	binary.LittleEndian.PutUint32(h[24:], flags)
+	binary.LittleEndian.PutUint32(h[28:], crc)
+	return append(h, body...)
+}
+
+// apeTagBytes is an APEv2 tag of text items, with a header and a footer
+func apeTagBytes(fields ...string) []byte {
+	var items []byte
+	for i := 0; i+1 < len(fields); i += 2 {
+		items = binary.LittleEndian.AppendUint32(items, uint32(len(fields[i+1])))
+		items = binary.LittleEndian.AppendUint32(items, 0)
+		items = append(items, fields[i]+"\x00"+fields[i+1]...)
+	}
+	frame := func(flags uint32) []byte {
+		b := []byte("APETAGEX")
+		b = binary.LittleEndian.AppendUint32(b, 2000)
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(items)+APE_FOOTER_SIZE))
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(fields)/2))
+		b = binary.LittleEndian.AppendUint32(b, flags)
+		return append(b, make([]byte, 8)...)
+	}
+	tag := append(frame(APE_FLAG_HAS_HEADER|1<<29), items...)
+	return append(tag, frame(APE_FLAG_HAS_HEADER)...)
+}
+
+func TestWavPack(t *testing.T) {
+	dir := t.TempDir()
+	for _, test := range []struct {
+		name     string
+		ch, rate int
+		bytes    int
+		shift    int
+		joint    bool
+		terms    []testWavPackTerm
+		// frames are counted from the blocks if the total is left out
+		total bool
+	}{
+		{"16 bit mono", 1, 44100, 2, 0, false, []testWavPackTerm{{18, 2, 100}, {2, 2, -20}}, true},
+		{"16 bit stereo", 2, 48000, 2, 0, true, []testWavPackTerm{{17, 2, 0}, {3, 3, 30}, {1, 2, 60}}, true},
+		{"24 bit stereo", 2, 96000, 3, 4, false, []testWavPackTerm{{18, 2, 0}, {8, 1, 0}}, false},
+		{"custom rate 3 channels", 3, 37800, 2, 0, true, nil, true},
+	} {
+		const frames, blockFrames = 30000, 4096
+		scale := float64(int64(1) << (8*test.bytes - 1))
+
+		// tones over noise, with a stretch of silence coded as runs of zeros
+		r := rand.New(rand.NewSource(7))
+		signal := make([][]int32, test.ch)
+		for c := range signal {
+			signal[c] = make([]int32, frames)
+			for i := range signal[c] {
+				if i >= 9000 && i < 11000 {
+					continue
+				}
+				v := 0.5*math.Sin(float64(i)*0.02*float64(c+1)) + 0.05*(r.Float64()*2-1)
+				signal[c][i] = int32(v*scale) >> test.shift << test.shift
+			}
+		}
+
+		srate := uint32(WAVPACK_SRATE_CUSTOM)
+		for i, rate := range wavpackSampleRates {
+			if rate == test.rate {
+				srate = uint32(i)
+			}
+		}
+		flags := uint32(test.bytes-1) | srate<<WAVPACK_SRATE_LSB | uint32(test.shift)<<WAVPACK_SHIFT_LSB
+		if test.joint {
+			flags |= WAVPACK_FLAG_JOINT_STEREO
+		}
+		total := int64(-1)
+		if test.total {
+			total = frames
+		}
+
+		// junk ahead of the first block is skipped over
+		file := []byte("ID3 junk ahead of the audio")
+		for start := 0; start < frames; start += blockFrames {
+			end := min(start+blockFrames, frames)
+			// a frame of more than two channels is a stereo block and a mono one
+			for c := 0; c < test.ch; c += 2 {
+				var samples [][]int32
+				for _, s := range signal[c:min(c+2, test.ch)] {
+					shifted := make([]int32, end-start)
+					for i := range shifted {
+						shifted[i] = s[start+i] >> test.shift
+					}
+					samples = append(samples, shifted)
+				}
+				blockFlags := flags
+				var extra []byte
+				if c == 0 {
+					blockFlags |= WAVPACK_FLAG_INITIAL_BLOCK
+					if test.ch > 2 {
+						extra = wavpackSubBlock(WAVPACK_ID_CHANNEL_INFO, []byte{byte(test.ch), 0x07})
+					}
+					if srate == WAVPACK_SRATE_CUSTOM {
+						extra = append(extra, wavpackSubBlock(WAVPACK_ID_SAMPLE_RATE, []byte{byte(test.rate), byte(test.rate >> 8), byte(test.rate >> 16)})...)
+					}
+				}
+				if c+2 >= test.ch {
+					blockFlags |= WAVPACK_FLAG_FINAL_BLOCK
+				}
+				file = append(file, wavpackBlockBytes(samples, test.terms, blockFlags, int64(start), total, extra)...)
+			}
+		}
+		file = append(file, apeTagBytes("Title", "Song", "Artist", "Band")...)
+		path := filepath.Join(dir, test.name+".wv")
+		if err := os.WriteFile(path, file, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		dec, err := openWavPack(path)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		checkFormat(t, dec, test.ch, test.rate, frames)
+		if depth := dec.nativeFormat().SampleDepth; int(depth) != 8*test.bytes {
+			t.Fatalf("%s: depth %d", test.name, depth)
+		}
+		if m := dec.metadata(); m.Title != "Song" || m.Artist != "Band" {
+			t.Fatalf("%s: metadata %+v", test.name, m)
+		}
+
+		want := make([]float64, frames*test.ch)
+		for f := 0; f < frames; f++ {
+			for c := range signal {
+				want[f*test.ch+c] = float64(signal[c][f]) / scale
+			}
+		}
+		all := decodeAll(t, dec)
+		if len(all) != len(want) {
+			t.Fatalf("%s: %d samples, expected %d", test.name, len(all), len(want))
+		}
+		checkSamples(t, test.name, all, want, 0)
+		checkSeek(t, dec, all, 0, 0, 1, blockFrames-1, blockFrames, 10000, frames-1)
+		dec.close()
+	}
+}
@@ -1,3 +1,5 @@
+//go:build windows
+
 package audio
 
 import (
@@ -9,7 +11,22 @@ import (
 	"golang.org/x/sys/windows"
 )
 
-func InitializeAudioAPI() error {
+func init() {
+	RegisterBackend(&Backend{
+		Name:       "wasapi",
+		Initialize: initializeWindowsAPI,
+		NewClient: func() (AudioClient, error) {
+			client, err := getDefaultWindowsClient()
+			if err != nil {
+				return nil, err
+			}
+			return client, nil
+		},
+		Sources: getWinAudioSourceProvider(),
+	})
+}
+
+func initializeWindowsAPI() error {
 	err := windows.CoInitializeEx(0, windows.COINIT_APARTMENTTHREADED)
 	if err != nil {
 		return err
@@ -99,6 +116,7 @@ func PCMWaveFormatToWaveFormatEx(pcm *PCMWaveFormat) *win32.WaveFormatExtensible
 func getWinAudioSourceProvider() *AudioSourceProvider {
 	return &AudioSourceProvider{
 		createWinAudioSourceFromFile,
+		WinGetFileMetadata,
 	}
 }
 
@@ -222,6 +240,11 @@ func (winSource *WinAudioSource) GetMetadata() Metadata {
 	return *winSource.metadata
 }
 
+func (winSource *WinAudioSource) Close() error {
+	winSource.reader.Release()
+	return nil
+}
+
 func (winSource *WinAudioSource) SetPosition(pos int64) error {
 	// create propvariant
 	prop := &win32.PropVariant{PropType: win32.VT_I8, Data: uint64(pos)}
@@ -299,3 +322,11 @@ func (winClient *WinAudioClient) Start() (err error) {
 func (winClient *WinAudioClient) Stop() (wasPlaying bool, err error) {
 	return winClient.client.Stop()
 }
+
+// Close stops the client and releases it
+func (winClient *WinAudioClient) Close() error {
+	_, err := winClient.client.Stop()
+	winClient.renderer.Release()
+	winClient.client.Release()
+	return err
+}
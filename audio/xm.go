@@ -0,0 +1,317 @@
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+const (
+	XM_SIGNATURE       = "Extended Module: "
+	XM_HEADER_SIZE     = 80
+	XM_ORDERS          = 256
+	XM_MAX_CHANNELS    = 64
+	XM_NOTES           = 96
+	XM_NOTE_OFF        = 97
+	XM_ENV_POINTS      = 12
+	XM_SAMPLE_SIZE     = 40
+	XM_INSTRUMENT_SIZE = 241 // up to the end of the fadeout
+	XM_BASE_FREQ       = 8363
+	XM_FINETUNE_STEPS  = 1536 // per octave
+
+	XM_FLAG_LINEAR = 1
+
+	XM_ENV_ON      = 1
+	XM_ENV_SUSTAIN = 2
+	XM_ENV_LOOP    = 4
+
+	XM_SAMPLE_LOOP_MASK = 3
+	XM_SAMPLE_PINGPONG  = 2
+	XM_SAMPLE_16BIT     = 16
+)
+
+// FastTracker's autovibrato waves, as the player's waveforms
+var xmVibratoWaves = [4]int{0, 2, 1, 1}
+
+func loadXM(data []byte) (*trackerModule, error) {
+	if len(data) < XM_HEADER_SIZE || string(data[:len(XM_SIGNATURE)]) != XM_SIGNATURE {
+		return nil, ErrNotTracker
+	}
+	le := binary.LittleEndian
+
+	headerSize := int(le.Uint32(data[60:]))
+	length := int(le.Uint16(data[64:]))
+	channels := int(le.Uint16(data[68:]))
+	numPatterns := int(le.Uint16(data[70:]))
+	numInstruments := int(le.Uint16(data[72:]))
+	if channels == 0 || channels > XM_MAX_CHANNELS || length > XM_ORDERS || len(data) < XM_HEADER_SIZE+length {
+		return nil, ErrNotTracker
+	}
+
+	mod := &trackerModule{
+		kind:         TRACKER_XM,
+		title:        trackerString(data[17:37]),
+		channels:     channels,
+		speed:        int(le.Uint16(data[76:])),
+		tempo:        int(le.Uint16(data[78:])),
+		globalVolume: 128,
+		linear:       le.Uint16(data[74:])&XM_FLAG_LINEAR != 0,
+	}
+	mod.mixVolume = trackerMixVolume(channels)
+	mod.orders = append([]uint8(nil), data[XM_HEADER_SIZE:XM_HEADER_SIZE+length]...)
+
+	pos := 60 + headerSize
+	mod.patterns = make([]trackerPattern, numPatterns)
+	for i := range mod.patterns {
+		if pos+9 > len(data) {
+			return nil, ErrNotTracker
+		}
+		patHeader := int(le.Uint32(data[pos:]))
+		rows := int(le.Uint16(data[pos+5:]))
+		size := int(le.Uint16(data[pos+7:]))
+		pos += patHeader
+		if rows == 0 || rows > TRACKER_MAX_ROWS {
+			rows = TRACKER_DEFAULT_ROWS
+		}
+		mod.patterns[i] = parseXMPattern(data[min(pos, len(data)):min(pos+size, len(data))], rows, channels)
+		pos += size
+	}
+
+	mod.instruments = make([]trackerInstrument, numInstruments)
+	for i := range mod.instruments {
+		next, err := parseXMInstrument(data, pos, mod, &mod.instruments[i])
+		if err != nil {
+			return nil, err
+		}
+		pos = next
+	}
+
+	return mod, nil
+}
+
+func parseXMPattern(data []byte, rows int, channels int) trackerPattern {
+	pat := trackerPattern{rows: rows, cells: make([]trackerCell, rows*channels)}
+	pos := 0
+	next := func() uint8 {
+		if pos >= len(data) {
+			return 0
+		}
+		pos++
+		return data[pos-1]
+	}
+
+	for i := range pat.cells {
+		if pos >= len(data) {
+			break
+		}
+		var note, ins, vol, cmd, param uint8
+		if flags := next(); flags&0x80 != 0 {
+			if flags&1 != 0 {
+				note = next()
+			}
+			if flags&2 != 0 {
+				ins = next()
+			}
+			if flags&4 != 0 {
+				vol = next()
+			}
+			if flags&8 != 0 {
+				cmd = next()
+			}
+			if flags&16 != 0 {
+				param = next()
+			}
+		} else {
+			note, ins, vol, cmd, param = flags, next(), next(), next(), next()
+		}
+
+		cell := &pat.cells[i]
+		switch {
+		case note == XM_NOTE_OFF:
+			cell.note = TRACKER_NOTE_OFF
+		case note > 0 && note < XM_NOTE_OFF:
+			cell.note = note + 12
+		}
+		cell.instrument = ins
+		cell.volCmd, cell.volParam = xmVolumeColumn(vol)
+		cell.effect, cell.param = xmEffect(cmd, param)
+	}
+	return pat
+}
+
+func xmVolumeColumn(vol uint8) (uint8, uint8) {
+	x, y := vol>>4, vol&0xF
+	switch x {
+	case 0x1, 0x2, 0x3, 0x4:
+		return TRACKER_VOL_SET, vol - 0x10
+	case 0x5:
+		if vol == 0x50 {
+			return TRACKER_VOL_SET, 64
+		}
+	case 0x6:
+		return TRACKER_VOL_SLIDE_DOWN, y
+	case 0x7:
+		return TRACKER_VOL_SLIDE_UP, y
+	case 0x8:
+		return TRACKER_VOL_FINE_DOWN, y
+	case 0x9:
+		return TRACKER_VOL_FINE_UP, y
+	case 0xA:
+		return TRACKER_VOL_VIB_SPEED, y
+	case 0xB:
+		return TRACKER_VOL_VIBRATO, y
+	case 0xC:
+		return TRACKER_VOL_PAN, y * 17
+	case 0xD:
+		return TRACKER_VOL_PAN_SLIDE_LEFT, y
+	case 0xE:
+		return TRACKER_VOL_PAN_SLIDE_RIGHT, y
+	case 0xF:
+		return TRACKER_VOL_TONE_PORTA, y * 16
+	}
+	return TRACKER_VOL_NONE, 0
+}
+
+// xmEffect translates FastTracker's effects past ProTracker's
+func xmEffect(cmd uint8, param uint8) (uint8, uint8) {
+	x, y := param>>4, param&0xF
+	switch cmd {
+	case 'G' - 'A' + 10:
+		return TRACKER_FX_GLOBAL_VOL, min(param, 64) * 2
+	case 'H' - 'A' + 10:
+		return TRACKER_FX_GLOBAL_VOL_SLIDE, param
+	case 'K' - 'A' + 10:
+		return TRACKER_FX_KEY_OFF, param
+	case 'L' - 'A' + 10:
+		return TRACKER_FX_ENVELOPE_POS, param
+	case 'P' - 'A' + 10:
+		return TRACKER_FX_PAN_SLIDE, param
+	case 'R' - 'A' + 10:
+		return TRACKER_FX_RETRIG, param
+	case 'T' - 'A' + 10:
+		return TRACKER_FX_TREMOR, param
+	case 'X' - 'A' + 10:
+		switch x {
+		case 1:
+			return TRACKER_FX_EXTRA_FINE_PORTA_UP, y
+		case 2:
+			return TRACKER_FX_EXTRA_FINE_PORTA_DOWN, y
+		}
+	default:
+		if cmd < 0x10 {
+			return modEffect(cmd, param)
+		}
+	}
+	return TRACKER_FX_NONE, 0
+}
+
+// parseXMInstrument reads the instrument at pos along with its samples,
+// returning where the next one starts
+func parseXMInstrument(data []byte, pos int, mod *trackerModule, ins *trackerInstrument) (int, error) {
+	le := binary.LittleEndian
+	if pos+29 > len(data) {
+		return 0, ErrNotTracker
+	}
+	size := int(le.Uint32(data[pos:]))
+	ins.name = trackerString(data[pos+4 : pos+26])
+	numSamples := int(le.Uint16(data[pos+27:]))
+	ins.globalVolume = 128
+	ins.pan = -1
+	ins.nna = TRACKER_NNA_CUT
+	for k := range ins.keymap {
+		ins.keymap[k] = trackerKey{note: uint8(k), sample: -1}
+	}
+	if numSamples == 0 {
+		return pos + size, nil
+	}
+	if size < XM_INSTRUMENT_SIZE || pos+size > len(data) {
+		return 0, ErrNotTracker
+	}
+
+	h := data[pos : pos+size]
+	sampleHeader := int(le.Uint32(h[29:]))
+	first := len(mod.samples)
+	for k := range ins.keymap {
+		n := min(max(k-12, 0), XM_NOTES-1)
+		if s := int(h[33+n]); s < numSamples {
+			ins.keymap[k].sample = first + s
+		}
+	}
+
+	ins.volEnv = parseXMEnvelope(h, 129, 225, 227, 233, 0)
+	ins.panEnv = parseXMEnvelope(h, 177, 226, 230, 234, 32)
+	ins.fadeout = int(le.Uint16(h[239:])) * 2
+
+	vibType := xmVibratoWaves[h[235]&3]
+	vibSweep, vibDepth, vibRate := int(h[236]), int(h[237]), int(h[238])
+
+	pos += size
+	headers := pos
+	pos += numSamples * sampleHeader
+	if sampleHeader < XM_SAMPLE_SIZE || pos > len(data) {
+		return 0, ErrNotTracker
+	}
+
+	for i := 0; i < numSamples; i++ {
+		sh := data[headers+i*sampleHeader:]
+		length := int(le.Uint32(sh[0:]))
+		s := trackerSample{
+			name:         trackerString(sh[18:40]),
+			loopStart:    int(le.Uint32(sh[4:])),
+			loopEnd:      int(le.Uint32(sh[4:]) + le.Uint32(sh[8:])),
+			volume:       min(int(sh[12]), 64),
+			globalVolume: 64,
+			pan:          int(sh[15]) * 256 / 255,
+			vibType:      vibType,
+			vibSweep:     vibSweep,
+			vibDepth:     vibDepth,
+			vibRate:      vibRate,
+		}
+		finetune, relative := int(int8(sh[13])), int(int8(sh[16]))
+		s.baseFreq = XM_BASE_FREQ * math.Exp2(float64(relative*128+finetune)/XM_FINETUNE_STEPS)
+
+		switch sh[14] & XM_SAMPLE_LOOP_MASK {
+		case 0:
+		case XM_SAMPLE_PINGPONG:
+			s.loop = TRACKER_LOOP_PINGPONG
+		default:
+			s.loop = TRACKER_LOOP_FORWARD
+		}
+
+		width := 1
+		if sh[14]&XM_SAMPLE_16BIT != 0 {
+			width = 2
+			s.loopStart /= 2
+			s.loopEnd /= 2
+		}
+		s.data = trackerPCM(data, pos, length/width, width, 1, true, true)
+		clampLoop(&s.loop, &s.loopStart, &s.loopEnd, len(s.data))
+		pos += length
+
+		mod.samples = append(mod.samples, s)
+	}
+	return pos, nil
+}
+
+// parseXMEnvelope reads an envelope from an instrument header, given where
+// its points, point count, sustain and loop indices and flags are
+func parseXMEnvelope(h []byte, points int, count int, indices int, flags int, center int) trackerEnvelope {
+	le := binary.LittleEndian
+	n := min(int(h[count]), XM_ENV_POINTS)
+	pts := make([]trackerEnvPoint, n)
+	for i := range pts {
+		pts[i].tick = int(le.Uint16(h[points+4*i:]))
+		pts[i].value = int(le.Uint16(h[points+4*i+2:])) - center
+	}
+
+	f := h[flags]
+	sustain := int(h[indices])
+	return newTrackerEnvelope(pts, trackerEnvelope{
+		enabled:   f&XM_ENV_ON != 0,
+		sustain:   f&XM_ENV_SUSTAIN != 0,
+		susStart:  sustain,
+		susEnd:    sustain,
+		loop:      f&XM_ENV_LOOP != 0,
+		loopStart: int(h[indices+1]),
+		loopEnd:   int(h[indices+2]),
+	})
+}
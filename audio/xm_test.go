@@ -0,0 +1,101 @@
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+)
+
+// xmTestFile plays a delta coded square through an instrument whose volume
+// envelope sustains at half, keyed off on row 8
+func xmTestFile() []byte {
+	le := binary.LittleEndian
+	out := []byte("Extended Module: ")
+	out = append(out, trackerField("XM Song", 20)...)
+	out = append(out, 0x1A)
+	out = append(out, trackerField("test", 20)...)
+	out = le.AppendUint16(out, 0x0104)
+	out = le.AppendUint32(out, 276)
+	for _, v := range []uint16{1, 0, 2, 1, 1, 1, 6, 125} {
+		out = le.AppendUint16(out, v)
+	}
+	out = append(out, make([]byte, 256)...)
+
+	var p []byte
+	for r := 0; r < 16; r++ {
+		switch r {
+		case 0:
+			p = append(p, 0x83, 49, 1)
+		case 8:
+			p = append(p, 0x81, 97) // key off
+		default:
+			p = append(p, 0x80)
+		}
+		p = append(p, 0x80)
+	}
+	out = le.AppendUint32(out, 9)
+	out = append(out, 0)
+	out = le.AppendUint16(out, 16)
+	out = le.AppendUint16(out, uint16(len(p)))
+	out = append(out, p...)
+
+	ins := make([]byte, 263)
+	le.PutUint32(ins, 263)
+	copy(ins[4:], "xm instrument")
+	le.PutUint16(ins[27:], 1)
+	le.PutUint32(ins[29:], 40)
+	// 64 falling to 32 over four ticks, held there
+	le.PutUint16(ins[131:], 64)
+	le.PutUint16(ins[133:], 4)
+	le.PutUint16(ins[135:], 32)
+	ins[225] = 2
+	ins[227] = 1
+	ins[233] = 1 | 2
+	le.PutUint16(ins[239:], 0x800)
+	out = append(out, ins...)
+
+	sh := make([]byte, 40)
+	le.PutUint32(sh[0:], 32)
+	le.PutUint32(sh[8:], 32)
+	sh[12] = 64
+	sh[14] = 1
+	sh[15] = 128
+	copy(sh[18:], "xm sample")
+	out = append(out, sh...)
+	prev := 0
+	for i := 0; i < 32; i++ {
+		v := 64
+		if i >= 16 {
+			v = -64
+		}
+		out = append(out, byte(int8(v-prev)))
+		prev = v
+	}
+	return out
+}
+
+func TestXM(t *testing.T) {
+	const row = 6 * TRACKER_TEST_TICK
+	const frames = 16 * row
+	dec := openTestModule(t, "a.xm", xmTestFile(), loadXM, frames)
+	if m := dec.metadata(); m.Title != "XM Song" || m.Artist != NOT_FOUND || !strings.Contains(m.Comment, "xm instrument\nxm sample") {
+		t.Fatalf("metadata %+v", m)
+	}
+	if s := dec.mod.samples[0]; len(s.data) != 32 || math.Abs(float64(s.data[20])+0.5) > 1e-6 {
+		t.Fatalf("sample %v", s.data)
+	}
+
+	all := decodeAll(t, dec)
+	if len(all) != frames*2 {
+		t.Fatalf("%d frames, expected %d", len(all)/2, frames)
+	}
+	checkPitch(t, "row 0", all, 1000, 1)
+	start := stereoEnergy(all, 0, 2*TRACKER_TEST_TICK)
+	held := stereoEnergy(all, 2*row, 7*row)
+	faded := stereoEnergy(all, 14*row, 16*row)
+	if held == 0 || held/start > 0.5 || faded != 0 {
+		t.Fatalf("energy %v at the start, %v held and %v after the fade", start, held, faded)
+	}
+	checkSeek(t, dec, all, 1e-9, 0, 9*row+7, frames-1)
+}
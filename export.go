@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/J-Dufour/maestro/audio"
+)
+
+// sample formats an export can be written in
+var EXPORT_FORMATS = map[string]audio.PCMWaveFormat{
+	"s16": {SampleDepth: 16, PCMType: audio.PCM_TYPE_INT},
+	"s24": {SampleDepth: 24, PCMType: audio.PCM_TYPE_INT},
+	"s32": {SampleDepth: 32, PCMType: audio.PCM_TYPE_INT},
+	"f32": {SampleDepth: 32, PCMType: audio.PCM_TYPE_FLOAT},
+}
+
+// export renders the files given into one WAV file through the player, as
+// they would be heard, returning the exit code
+func export(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	out := flags.String("o", "", "WAV file to write")
+	rate := flags.Uint("rate", 44100, "sample rate of the file")
+	channels := flags.Uint("channels", 2, "number of channels")
+	sampleFormat := flags.String("format", "s16", "sample format: s16, s24, s32 or f32")
+	soundFont := flags.String("soundfont", "", "SoundFont (.sf2) used to play MIDI files")
+	crossfade := flags.Float64("crossfade", 0, "seconds to fade each track in over the last, 0 for none")
+	crossfadeCurve := flags.String("crossfade-curve", "equal-power", "crossfade curve: linear, equal-power or log")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: maestro export -o out.wav [options] <path>...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	format, ok := EXPORT_FORMATS[*sampleFormat]
+	curve, curveOk := CROSSFADE_CURVES[*crossfadeCurve]
+	if *out == "" || flags.NArg() < 1 || !ok || !curveOk || *crossfade < 0 || *rate == 0 || *channels == 0 {
+		flags.Usage()
+		return 2
+	}
+	format.SampleRate = uint32(*rate)
+	format.NumChannels = uint16(*channels)
+
+	// formats without a native decoder need the platform's
+	audio.InitializeAudioAPI()
+	audio.SetSoundFontPath(*soundFont)
+
+	paths, err := findMusicFiles(flags.Args())
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if len(paths) == 0 {
+		fmt.Println("please provide path(s) to valid music file")
+		return 1
+	}
+
+	client, err := audio.NewWavFileClient(*out, &format)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	clock := &exportClock{held: make(chan time.Time)}
+	player, err := audio.NewPlayer(audio.WithClient(client), audio.WithClock(clock), audio.WithCrossfade(time.Duration(*crossfade*float64(time.Second)), curve))
+	if err != nil {
+		client.Close()
+		fmt.Println(err)
+		return 1
+	}
+
+	// nothing is rendered until every path is queued, so that what is heard
+	// does not depend on how far the player got while they were being added.
+	// Blocking keeps every event.
+	sub := player.Subscribe(0, audio.EVENT_BLOCK)
+
+	go func() {
+		player.Start()
+		player.AddSourcesToQueue(paths...)
+	}()
+
+	added := 0
+	for done := false; !done; {
+		event, ok := <-sub.Events
+		if !ok {
+			// the player failed, closing it says why
+			break
+		}
+		switch e := event.(type) {
+		case audio.QueueChanged:
+			added += len(e.Added)
+			if added == len(paths) {
+				close(clock.held)
+			}
+		case audio.QueueEnded:
+			done = added == len(paths)
+		}
+	}
+
+	// closing the player finishes the file
+	if err := player.Close(context.Background()); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// exportClock ticks as fast as the player reads it, the file never needing
+// to wait for its buffer to drain, but not before held is closed
+type exportClock struct {
+	running bool
+	held    chan time.Time
+}
+
+func (c *exportClock) C() <-chan time.Time {
+	if c.running {
+		// once closed, always ready to receive from
+		return c.held
+	}
+	return nil
+}
+
+func (c *exportClock) Reset(d time.Duration) {
+	c.running = true
+}
+
+func (c *exportClock) Stop() {
+	c.running = false
+}
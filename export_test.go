@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTone writes a 16 bit stereo WAV file holding a sine wave
+func writeTone(t *testing.T, path string, rate, frames int, freq float64) {
+	t.Helper()
+	le := binary.LittleEndian
+	out := []byte("RIFF\x00\x00\x00\x00WAVEfmt \x10\x00\x00\x00")
+	out = le.AppendUint16(out, 1)
+	out = le.AppendUint16(out, 2)
+	out = le.AppendUint32(out, uint32(rate))
+	out = le.AppendUint32(out, uint32(rate*4))
+	out = le.AppendUint16(out, 4)
+	out = le.AppendUint16(out, 16)
+	out = append(out, "data"...)
+	out = le.AppendUint32(out, uint32(frames*4))
+	for f := 0; f < frames; f++ {
+		v := uint16(int16(8000 * math.Sin(2*math.Pi*freq*float64(f)/float64(rate))))
+		out = le.AppendUint16(out, v)
+		out = le.AppendUint16(out, v)
+	}
+	le.PutUint32(out[4:], uint32(len(out)-8))
+	if err := os.WriteFile(path, out, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// an export comes out the same every time, crossfades included
+func TestExportDeterministic(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for i, track := range []struct{ rate, frames int }{{44100, 44100}, {44100, 22050}, {44100, 30000}, {48000, 40000}} {
+		path := filepath.Join(dir, string(rune('a'+i))+".wav")
+		writeTone(t, path, track.rate, track.frames, 440*float64(i+1))
+		paths = append(paths, path)
+	}
+
+	var first []byte
+	for i := 0; i < 10; i++ {
+		out := filepath.Join(dir, "out.wav")
+		if code := export(append([]string{"-o", out, "-crossfade", "0.3"}, paths...)); code != 0 {
+			t.Fatalf("exit code %d", code)
+		}
+		data, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == nil {
+			first = data
+		} else if !bytes.Equal(data, first) {
+			t.Fatalf("export %d differs: %d bytes, first %d", i, len(data), len(first))
+		}
+	}
+	if len(first) == 0 {
+		t.Fatal("nothing exported")
+	}
+}
@@ -1,16 +1,26 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
 	"slices"
+	"time"
 
 	"github.com/J-Dufour/maestro/audio"
 	"github.com/J-Dufour/maestro/terminal"
 )
 
-var VALID_EXT = []string{".mp3", ".wav"}
+var VALID_EXT = []string{".mp3", ".wav", ".flac", ".ogg", ".oga", ".opus", ".aif", ".aiff", ".aifc", ".m4a", ".mp4", ".alac", ".wv", ".dsf", ".dff", ".mod", ".s3m", ".xm", ".it", ".mid", ".midi"}
+
+// crossfade curves by the name given with -crossfade-curve
+var CROSSFADE_CURVES = map[string]int{
+	"linear":      audio.CROSSFADE_LINEAR,
+	"equal-power": audio.CROSSFADE_EQUAL_POWER,
+	"log":         audio.CROSSFADE_LOGARITHMIC,
+}
 
 const (
 	KEY_SKIP   = 'k'
@@ -18,52 +28,58 @@ const (
 	KEY_BACK   = 'j'
 	KEY_SEEKF  = '.'
 	KEY_SEEKB  = ','
+	KEY_VOLUP  = '+'
+	KEY_VOLDN  = '-'
+	KEY_MUTE   = 'm'
+)
+
+const (
+	VOLUME_STEP = 2.0              // dB
+	VOLUME_FILE = "maestro/volume" // in the user's config directory, holding the volume between runs
 )
 
 func main() {
 
-	// startup
-	audio.InitializeAudioAPI()
+	// subcommands come before any flags
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		os.Exit(export(os.Args[2:]))
+	}
+
+	soundFont := flag.String("soundfont", "", "SoundFont (.sf2) used to play MIDI files")
+	crossfade := flag.Float64("crossfade", 0, "seconds to fade each track in over the last, 0 for none")
+	crossfadeCurve := flag.String("crossfade-curve", "equal-power", "crossfade curve: linear, equal-power or log")
+	flag.Parse()
 
-	// get file names
-	if len(os.Args) < 2 {
-		fmt.Println("please provide path(s) to valid music file")
+	curve, ok := CROSSFADE_CURVES[*crossfadeCurve]
+	if !ok || *crossfade < 0 {
+		flag.Usage()
 		return
 	}
 
-	absolutePaths := make([]string, 0)
-	for _, arg := range os.Args[1:] {
-
-		// get absolute paths
-		path, err := filepath.Abs(arg)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+	// startup, with nothing to play through if no backend starts
+	if err := audio.InitializeAudioAPI(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	audio.SetSoundFontPath(*soundFont)
 
-		// if folder, find all files within
-		if info, err := os.Stat(path); err == nil && info.IsDir() {
-			path += "/*"
-			subfiles, err := filepath.Glob(path)
-			if err == nil {
-				for _, subfile := range subfiles {
-					if slices.Contains[[]string](VALID_EXT, filepath.Ext(subfile)) {
-						if info, err := os.Stat(subfile); err == nil && !info.IsDir() {
-							absolutePaths = append(absolutePaths, subfile)
-						}
-					}
-				}
-			}
-		} else if err == nil && !info.IsDir() {
-			// filter by extension
-			if slices.Contains[[]string](VALID_EXT, filepath.Ext(path)) {
-				absolutePaths = append(absolutePaths, path)
-			}
-		}
+	// get file names
+	if flag.NArg() < 1 {
+		fmt.Println("please provide path(s) to valid music file")
+		return
+	}
 
+	absolutePaths, err := findMusicFiles(flag.Args())
+	if err != nil {
+		fmt.Println(err)
+		return
 	}
 
-	player, err := audio.NewPlayer()
+	volume, muted := loadVolume()
+	player, err := audio.NewPlayer(
+		audio.WithCrossfade(time.Duration(*crossfade*float64(time.Second)), curve),
+		audio.WithVolume(volume, muted),
+	)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -97,6 +113,52 @@ func main() {
 	player.Start()
 
 	<-done
+
+	snapshot := player.Snapshot()
+	if err := saveVolume(snapshot.Volume, snapshot.Muted); err != nil {
+		fmt.Println(err)
+	}
+
+	// release the device, without holding up exit if it hangs
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	player.Close(ctx)
+}
+
+// findMusicFiles returns the absolute paths of the files given and of the
+// files within the folders given that have a supported extension
+func findMusicFiles(args []string) ([]string, error) {
+	absolutePaths := make([]string, 0)
+	for _, arg := range args {
+
+		// get absolute paths
+		path, err := filepath.Abs(arg)
+		if err != nil {
+			return nil, err
+		}
+
+		// if folder, find all files within
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			path += "/*"
+			subfiles, err := filepath.Glob(path)
+			if err == nil {
+				for _, subfile := range subfiles {
+					if slices.Contains[[]string](VALID_EXT, filepath.Ext(subfile)) {
+						if info, err := os.Stat(subfile); err == nil && !info.IsDir() {
+							absolutePaths = append(absolutePaths, subfile)
+						}
+					}
+				}
+			}
+		} else if err == nil && !info.IsDir() {
+			// filter by extension
+			if slices.Contains[[]string](VALID_EXT, filepath.Ext(path)) {
+				absolutePaths = append(absolutePaths, path)
+			}
+		}
+
+	}
+	return absolutePaths, nil
 }
 
 func inputDecoder(input chan byte, player *audio.Player) {
@@ -112,7 +174,44 @@ func inputDecoder(input chan byte, player *audio.Player) {
 			player.SeekForward()
 		case KEY_SEEKB:
 			player.SeekBackward()
+		case KEY_VOLUP:
+			player.SetVolume(player.Volume() + VOLUME_STEP)
+		case KEY_VOLDN:
+			player.SetVolume(player.Volume() - VOLUME_STEP)
+		case KEY_MUTE:
+			player.Mute(!player.Snapshot().Muted)
 		default:
 		}
 	}
 }
+
+// loadVolume returns the volume saved by the last run, or full volume if
+// there is none
+func loadVolume() (volume float64, muted bool) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return audio.VOLUME_MAX, false
+	}
+	data, err := os.ReadFile(filepath.Join(dir, VOLUME_FILE))
+	if err != nil {
+		return audio.VOLUME_MAX, false
+	}
+	_, err = fmt.Sscanf(string(data), "%g %t", &volume, &muted)
+	if err != nil || !(volume >= audio.VOLUME_MIN && volume <= audio.VOLUME_MAX) {
+		return audio.VOLUME_MAX, false
+	}
+	return volume, muted
+}
+
+// saveVolume keeps the volume for the next run
+func saveVolume(volume float64, muted bool) error {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, VOLUME_FILE)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(fmt.Sprintf("%g %t\n", volume, muted)), 0o644)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/J-Dufour/maestro/audio"
+)
+
+func TestLoadVolume(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("HOME", dir)
+	config, err := os.UserConfigDir()
+	if err != nil {
+		t.Skip(err)
+	}
+	path := filepath.Join(config, VOLUME_FILE)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for saved, want := range map[string]float64{
+		"-12 true":    -12,
+		"NaN true":    audio.VOLUME_MAX,
+		"+Inf false":  audio.VOLUME_MAX,
+		"-1000 false": audio.VOLUME_MAX,
+	} {
+		if err := os.WriteFile(path, []byte(saved), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if volume, muted := loadVolume(); volume != want || muted != (want != audio.VOLUME_MAX) {
+			t.Fatalf("%q loaded as %g %t", saved, volume, muted)
+		}
+	}
+}
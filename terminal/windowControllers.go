@@ -156,27 +156,27 @@ func NewQueueWindowController(player *audio.Player) Controller {
 	return NewBaseWindowController(func(buildCommand func() *CommandBuilder, con ControllerChannels) {
 		MAX_LOOKBEHIND := 3
 
-		queueUpdated := make(chan struct{})
-		songUpdated := make(chan struct{})
+		sub := player.Subscribe(EVENT_BUFFER, audio.EVENT_DROP_OLDEST)
+		events := sub.Events
 
-		player.SubscribeToQueueUpdate(queueUpdated)
-		player.SubscribeToSourceChange(songUpdated)
-
-		queue := player.GetQueue(MAX_LOOKBEHIND)
-		var curItem audio.Metadata
-		maxIdxLen := 1
+		snapshot := player.Snapshot()
+		queue := snapshot.Queue(MAX_LOOKBEHIND)
+		curItem := snapshot.Current
+		queueVersion := snapshot.QueueVersion
+		maxIdxLen := indexWidth(len(queue))
 
 		dims := area{0, 0}
 		for {
+			var event audio.Event
 			select {
-			case <-queueUpdated:
-				queue = player.GetQueue(MAX_LOOKBEHIND)
-				if length := len(queue); length == 0 {
-					maxIdxLen = 1
-				} else {
-					maxIdxLen = 1 + int(math.Log10(float64(length)))
+			case e, ok := <-events:
+				if !ok {
+					// the player has closed
+					events = nil
 				}
-
+				event = e
+			case newDims := <-con.ResizeChan:
+				dims = newDims
 				curIdx := -1
 				for i, e := range queue {
 					if e.Filepath == curItem.Filepath {
@@ -184,49 +184,67 @@ func NewQueueWindowController(player *audio.Player) Controller {
 						break
 					}
 				}
+
 				DrawQueue(buildCommand(), queue, curIdx, maxIdxLen, dims.w, dims.h)
+			case <-con.TerminateChan:
+				sub.Unsubscribe()
+				return
+			case <-con.SelectChan:
+			case <-con.InputChan:
+			}
 
-			case <-songUpdated:
-				builder := buildCommand()
+			switch e := event.(type) {
+			case audio.QueueChanged:
+				snapshot := player.Snapshot()
+				if snapshot.QueueVersion == queueVersion {
+					// already drawn
+					break
+				}
+				queue, queueVersion = snapshot.Queue(MAX_LOOKBEHIND), snapshot.QueueVersion
+				maxIdxLen = indexWidth(len(queue))
 
-				// find current item
+				curIdx := -1
 				for i, e := range queue {
 					if e.Filepath == curItem.Filepath {
-						builder.MoveTo(1, uint(i+1))
-						WriteQueueLine(builder, i+1, maxIdxLen, e, dims.w-2-maxIdxLen, false)
+						curIdx = i
 						break
 					}
 				}
-				curItem = player.GetCurrentSourceMetadata()
-				for i, e := range queue {
-					if e.Filepath == curItem.Filepath {
+				DrawQueue(buildCommand(), queue, curIdx, maxIdxLen, dims.w, dims.h)
+
+			case audio.TrackChanged:
+				builder := buildCommand()
+
+				// find current item
+				for i, item := range queue {
+					if item.Filepath == curItem.Filepath {
 						builder.MoveTo(1, uint(i+1))
-						WriteQueueLine(builder, i+1, maxIdxLen, e, dims.w-2-maxIdxLen, true)
+						WriteQueueLine(builder, i+1, maxIdxLen, item, dims.w-2-maxIdxLen, false)
 						break
 					}
 				}
-				builder.Exec()
-
-			case newDims := <-con.ResizeChan:
-				dims = newDims
-				curIdx := -1
-				for i, e := range queue {
-					if e.Filepath == curItem.Filepath {
-						curIdx = i
+				curItem = e.Metadata
+				for i, item := range queue {
+					if item.Filepath == curItem.Filepath {
+						builder.MoveTo(1, uint(i+1))
+						WriteQueueLine(builder, i+1, maxIdxLen, item, dims.w-2-maxIdxLen, true)
 						break
 					}
 				}
-
-				DrawQueue(buildCommand(), queue, curIdx, maxIdxLen, dims.w, dims.h)
-			case <-con.TerminateChan:
-				return
-			case <-con.SelectChan:
-			case <-con.InputChan:
+				builder.Exec()
 			}
 		}
 	}, "")
 }
 
+// indexWidth is the number of digits needed to number length queue lines
+func indexWidth(length int) int {
+	if length == 0 {
+		return 1
+	}
+	return 1 + int(math.Log10(float64(length)))
+}
+
 func DrawQueue(builder *CommandBuilder, queue []audio.Metadata, curIdx, maxIdxLen, w, h int) {
 	maxTitleLen := w - maxIdxLen - 2
 
@@ -259,6 +277,11 @@ func WriteQueueLine(builder *CommandBuilder, idx int, maxIdx int, metadata audio
 	return builder.SelectGraphicsRendition(graphics).Write(fmt.Sprintf("%*d. %-*s", maxIdx, idx, maxW, line)).ClearGraphicsRendition()
 }
 
+const (
+	ERROR_DISPLAY_TIME = 5 * time.Second
+	EVENT_BUFFER       = 16 // player events a window can fall behind by before losing the oldest
+)
+
 const (
 	LINE_START = '├'
 	LINE_MID   = '─'
@@ -271,35 +294,81 @@ const (
 
 func NewPlayerWindowController(player *audio.Player) Controller {
 	return NewBaseWindowController(func(buildCommand func() *CommandBuilder, con ControllerChannels) {
-		songUpdated := make(chan struct{})
-		player.SubscribeToSourceChange(songUpdated)
+		sub := player.Subscribe(EVENT_BUFFER, audio.EVENT_DROP_OLDEST)
+		events := sub.Events
+
+		snapshot := player.Snapshot()
+		curSource := snapshot.Current
+
+		// the track fading out under curSource, if any
+		outgoing := snapshot.Outgoing
 
-		curSource := player.GetCurrentSourceMetadata()
+		volume, muted := snapshot.Volume, snapshot.Muted
 
 		dims := area{0, 0}
 		infoLines := []int{1}
 
+		// the last error, shown until errorUntil
+		var lastError string
+		var errorUntil time.Time
+
 		period := 100 * time.Millisecond
 		clock := time.NewTicker(period)
 
+		drawInfo := func() {
+			DrawInfo(buildCommand(), curSource, infoLines, int64(player.Snapshot().Position), dims)
+			DrawStatus(buildCommand(), outgoing, curSource, lastError, infoLines, dims)
+			DrawVolume(buildCommand(), volume, muted, infoLines, dims)
+		}
+
 		for {
+			var event audio.Event
 			select {
-			case <-songUpdated:
-				curSource = player.GetCurrentSourceMetadata()
-
-				DrawInfo(buildCommand(), curSource, infoLines, int64(player.GetPositionInTrack()), dims)
-
+			case e, ok := <-events:
+				if !ok {
+					// the player has closed
+					events = nil
+				}
+				event = e
 			case newDims := <-con.ResizeChan:
 				dims = newDims
 				infoLines = infoLinesFromHeight(dims.h)
-				DrawInfo(buildCommand(), curSource, infoLines, int64(player.GetPositionInTrack()), dims)
+				drawInfo()
 			case <-clock.C:
-				DrawTrack(buildCommand(), curSource, int64(player.GetPositionInTrack()), infoLines[len(infoLines)-1], dims)
+				if lastError != "" && !errorUntil.IsZero() && time.Now().After(errorUntil) {
+					lastError = ""
+					drawInfo()
+				}
+				DrawTrack(buildCommand(), curSource, int64(player.Snapshot().Position), infoLines[len(infoLines)-1], dims)
 			case <-con.TerminateChan:
+				clock.Stop()
+				sub.Unsubscribe()
 				return
 			case <-con.SelectChan:
 			case <-con.InputChan:
 			}
+
+			switch e := event.(type) {
+			case audio.TrackChanged:
+				curSource = e.Metadata
+				drawInfo()
+			case audio.CrossfadeChanged:
+				outgoing = e.Outgoing
+				drawInfo()
+			case audio.Seeked:
+				DrawTrack(buildCommand(), curSource, int64(e.Position), infoLines[len(infoLines)-1], dims)
+			case audio.VolumeChanged:
+				volume, muted = e.Volume, e.Muted
+				drawInfo()
+			case audio.PlayerError:
+				lastError = e.Error()
+				errorUntil = time.Now().Add(ERROR_DISPLAY_TIME)
+				if e.Kind == audio.ERROR_FATAL {
+					// the player is gone, keep saying why
+					errorUntil = time.Time{}
+				}
+				drawInfo()
+			}
 		}
 	}, "")
 }
@@ -347,6 +416,40 @@ func DrawMetadata(builder *CommandBuilder, source audio.Metadata, lines []int, d
 	}
 }
 
+// DrawStatus writes the last error and the tracks fading out and in over the
+// first line of metadata, if there is room and either is worth showing. The
+// error goes first so that it stays in view on a narrow window.
+func DrawStatus(builder *CommandBuilder, outgoing *audio.Metadata, incoming audio.Metadata, msg string, lines []int, dims area) {
+	if len(lines) < 2 {
+		return
+	}
+	parts := make([]string, 0, 2)
+	if msg != "" {
+		parts = append(parts, "error: "+msg)
+	}
+	if outgoing != nil {
+		parts = append(parts, outgoing.Title+" > "+incoming.Title)
+	}
+	if len(parts) == 0 {
+		return
+	}
+	line := centeredString(concatMax(dims.w, " | ", parts...), dims.w)
+	builder.MoveTo(1, uint(lines[0])).Write(line).Exec()
+}
+
+// DrawVolume writes the volume at the end of the line above the track, if
+// there is room
+func DrawVolume(builder *CommandBuilder, volume float64, muted bool, lines []int, dims area) {
+	label := fmt.Sprintf(" vol %.0f dB ", volume)
+	if muted {
+		label = " muted "
+	}
+	if len(lines) < 2 || dims.w < len(label) {
+		return
+	}
+	builder.MoveTo(uint(dims.w-len(label)+1), uint(lines[len(lines)-2])).Write(label).Exec()
+}
+
 func concatMax(max int, separator string, strings ...string) (concat string) {
 	concat = strings[0]
 	for _, str := range strings[1:] {
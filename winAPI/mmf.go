@@ -1,3 +1,5 @@
+//go:build windows
+
 package winAPI
 
 import (
@@ -177,6 +179,12 @@ func (s MFSourceReader) GetWaveFormat() (w *WaveFormatExtensible, err error) {
 
 }
 
+// Release drops the reference to the reader, closing its file once no others
+// remain
+func (s MFSourceReader) Release() {
+	syscall.SyscallN(s.vtbl.release, s.ptr)
+}
+
 func (s MFSourceReader) SetCurrentPosition(position *PropVariant) error {
 	r1, _, _ := syscall.SyscallN(s.vtbl.SetCurrentPosition, s.ptr, uintptr(unsafe.Pointer(&GUID_null)), uintptr(unsafe.Pointer(position)))
 	if uint32(r1) != uint32(windows.S_OK) {
@@ -1,3 +1,5 @@
+//go:build windows
+
 package winAPI
 
 import (
@@ -201,6 +203,11 @@ func (a AudioClient) Reset() (err error) {
 	return nil
 }
 
+// Release drops the reference to the client, freeing it once no others remain
+func (a AudioClient) Release() {
+	syscall.SyscallN(a.vtbl.release, a.ptr)
+}
+
 func (a AudioRenderClient) GetBuffer(frames uint32) (buffStart *byte, err error) {
 	r1, _, err := syscall.SyscallN(a.vtbl.getBuffer, a.ptr, uintptr(frames), uintptr(unsafe.Pointer(&buffStart)))
 	if uint32(r1) != uint32(windows.S_OK) {
@@ -221,6 +228,10 @@ func (a AudioRenderClient) ReleaseBuffer(frames uint32) (err error) {
 	return nil
 }
 
+func (a AudioRenderClient) Release() {
+	syscall.SyscallN(a.vtbl.release, a.ptr)
+}
+
 func GetDefaultClient() (client *AudioClient, err error) {
 	var (
 		MMDeviceEnumPtr **MMDeviceEnumVtbl